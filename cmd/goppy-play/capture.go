@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// recording is the capture file --record writes what is sent to.
+type recording struct {
+	dev  *controller.Device
+	file *os.File
+	c    *controller.CaptureWriter
+}
+
+// record starts writing every frame sent to dev, on port at baud, to the
+// capture file name.
+func record(name string, dev *controller.Device, port string, baud int) (*recording, error) {
+	h := protocol.CaptureHeader{Transport: protocol.CaptureSerial, Baud: uint32(baud)}
+	if strings.HasPrefix(port, "udp:") {
+		h = protocol.CaptureHeader{Transport: protocol.CaptureUDP}
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	c, err := controller.NewCaptureWriter(f, h)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	dev.Record(c)
+	return &recording{dev: dev, file: f, c: c}, nil
+}
+
+// close stops the recording and writes out the rest of it. It may be
+// called again, or on a nil recording, to no effect.
+func (r *recording) close() error {
+	if r == nil || r.file == nil {
+		return nil
+	}
+	r.dev.Record(nil)
+	err := r.c.Flush()
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	r.file = nil
+	return err
+}
+
+// bake writes the song p would play to the baked file name, as --bake
+// asks, and returns the exit code.
+func bake(e env, name, song string, p *controller.Player, events []controller.Event) int {
+	var b bytes.Buffer
+	if err := p.Bake(&b, events, 0); err != nil {
+		fmt.Fprintln(e.stderr, "goppy-play: --bake:", err)
+		return exitUsage
+	}
+	h, _, _ := protocol.DecodeBakedHeader(b.Bytes())
+	if err := os.WriteFile(name, b.Bytes(), 0o644); err != nil {
+		fmt.Fprintln(e.stderr, "goppy-play: --bake:", err)
+		return exitFile
+	}
+	fmt.Fprintf(e.stdout, "baked %s to %s, %s, for devices taking %s\n", song, name, length(events), controller.Capabilities(h.Caps))
+	return exitOK
+}
+
+// dryRunTickRate is what --dry-run bakes the song at to log it:
+// microseconds.
+const dryRunTickRate = 1000000
+
+// dryRunLog prints to log what p would send playing events, as --dry-run
+// asks, baking it to see when each frame goes without a device.
+func dryRunLog(log *messageLog, p *controller.Player, events []controller.Event) error {
+	var b bytes.Buffer
+	if err := p.Bake(&b, events, dryRunTickRate); err != nil {
+		return err
+	}
+	_, frames, err := controller.ReadBaked(&b)
+	if err != nil {
+		return err
+	}
+	return log.print(frames)
+}
+
+// replay plays the capture or baked file name on the device at port, as
+// --replay asks, and returns the exit code. A capture's transport and
+// baud are used unless the flags say otherwise. With log, as --dry-run
+// asks, it prints the frames to it in place of playing them.
+func replay(ctx context.Context, e env, name, port string, baud int, iface, recordFile string, set map[string]bool, log *messageLog) int {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		fmt.Fprintln(e.stderr, "goppy-play: read capture:", err)
+		return exitFile
+	}
+	var (
+		h      protocol.CaptureHeader
+		frames []controller.CapturedFrame
+		baked  protocol.BakedHeader
+	)
+	isBaked := bytes.HasPrefix(data, []byte(protocol.BakedMagic))
+	if isBaked {
+		baked, frames, err = controller.ReadBaked(bytes.NewReader(data))
+	} else {
+		h, frames, err = controller.ReadCapture(bytes.NewReader(data))
+	}
+	if err != nil {
+		fmt.Fprintf(e.stderr, "goppy-play: read capture %s: %v\n", name, err)
+		return exitFile
+	}
+	if log != nil {
+		if err := log.print(frames); err != nil {
+			fmt.Fprintf(e.stderr, "goppy-play: read capture %s: %v\n", name, err)
+			return exitFile
+		}
+		return exitOK
+	}
+	if !set["port"] && h.Transport == protocol.CaptureUDP {
+		port = "udp"
+	}
+	if !set["baud"] && h.Transport == protocol.CaptureSerial && h.Baud != 0 {
+		baud = int(h.Baud)
+	}
+
+	dev, portName, code := connect(ctx, e, port, baud, iface)
+	if dev == nil {
+		return code
+	}
+	defer dev.Close()
+	go func() {
+		for range dev.Messages() {
+		}
+	}()
+	var rec *recording
+	if recordFile != "" {
+		if rec, err = record(recordFile, dev, portName, baud); err != nil {
+			fmt.Fprintln(e.stderr, "goppy-play: --record:", err)
+			return exitFile
+		}
+		defer rec.close()
+	}
+
+	var length time.Duration
+	if len(frames) > 0 {
+		length = frames[len(frames)-1].At.Round(time.Millisecond)
+	}
+	if isBaked {
+		fmt.Fprintf(e.stdout, "replaying %s, baked for devices taking %s, %d frames, %s\n", name, controller.Capabilities(baked.Caps), len(frames), length)
+	} else {
+		fmt.Fprintf(e.stdout, "replaying %s, %d frames, %s\n", name, len(frames), length)
+	}
+	err = controller.NewPlayer(dev, nil).Replay(ctx, frames)
+	if cerr := rec.close(); err == nil && cerr != nil {
+		err = fmt.Errorf("--record: %w", cerr)
+	}
+	return exit(e, err)
+}
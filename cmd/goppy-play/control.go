@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller"
+	"github.com/ystepanoff/goppy/controller/api"
+	"github.com/ystepanoff/goppy/controller/mapping"
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+	host "github.com/ystepanoff/goppy/internal/protocol"
+)
+
+// show is what goppy-play is playing, and the command channel that drives
+// it: each command, from the API or anything else, is run on show's own
+// goroutine, which alone keeps its state, and the Player and Playlist are
+// only told what to do from there.
+type show struct {
+	player   *controller.Player
+	playlist *controller.Playlist       // nil for one song
+	song     string                     // the one song
+	sched    *controller.Scheduler      // what the player sends through
+	found    []controller.DeviceInfo    // what answered Discover, if asked
+	devices  *controller.DeviceRegistry // what the devices last said of themselves
+	warn     func(err error)            // told of an offset that can't be kept to
+
+	// load readies a song a play command names, from --song-dir; nil
+	// without one.
+	load func(name string) (func(ctx context.Context) error, error)
+
+	cmds    chan func()
+	restart chan struct{} // play after a stop
+	over    chan struct{} // closed once nothing runs cmds
+
+	// Kept by the show's goroutine.
+	m       *mapping.Map
+	mapFile string
+	cancel  context.CancelFunc // stops the song or playlist playing
+	stopped bool
+	cue     func(ctx context.Context) error // to play in place of it
+}
+
+var (
+	errStopped    = errors.New("stopped")
+	errNoPlaylist = errors.New("playing one song, not a playlist")
+	errNoSongs    = errors.New("no --song-dir to play songs from")
+	errNothing    = errors.New("nothing to play yet: name a song")
+)
+
+func newShow(p *controller.Player, pl *controller.Playlist, m *mapping.Map, mapFile string) *show {
+	return &show{
+		player:   p,
+		playlist: pl,
+		m:        m,
+		mapFile:  mapFile,
+		cmds:     make(chan func()),
+		restart:  make(chan struct{}, 1),
+		over:     make(chan struct{}),
+	}
+}
+
+// serve runs commands until ctx is done.
+func (s *show) serve(ctx context.Context) {
+	defer close(s.over)
+	for {
+		select {
+		case f := <-s.cmds:
+			f()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// call runs f on the show's goroutine and returns its error.
+func (s *show) call(f func() error) error {
+	done := make(chan error, 1)
+	select {
+	case s.cmds <- func() { done <- f() }:
+		return <-done
+	case <-s.over:
+		return errors.New("goppy-play is stopping")
+	}
+}
+
+// begin notes that a song or playlist has started playing under ctx,
+// stopped with cancel.
+func (s *show) begin(cancel context.CancelFunc) {
+	s.call(func() error {
+		s.cancel = cancel
+		return nil
+	})
+}
+
+// wasStopped reports whether a stop command ended what was playing.
+func (s *show) wasStopped() bool {
+	var stopped bool
+	s.call(func() error {
+		stopped = s.stopped
+		return nil
+	})
+	return stopped
+}
+
+// takeCue returns the song a play command named, to play next, if any.
+func (s *show) takeCue() func(ctx context.Context) error {
+	var cue func(ctx context.Context) error
+	s.call(func() error {
+		cue, s.cue = s.cue, nil
+		return nil
+	})
+	return cue
+}
+
+// cued reports whether a play command has named a song to play next.
+func (s *show) cued() bool {
+	var cued bool
+	s.call(func() error {
+		cued = s.cue != nil
+		return nil
+	})
+	return cued
+}
+
+// channels returns the MIDI channels, from 0, the mapping plays.
+func (s *show) channels() []byte {
+	var channels []byte
+	s.call(func() error {
+		for ch, c := range s.m.Channels {
+			if c.Mapped() || s.m.Drums(byte(ch)) {
+				channels = append(channels, byte(ch))
+			}
+		}
+		return nil
+	})
+	return channels
+}
+
+// Do carries out an API command.
+func (s *show) Do(c api.Command) error {
+	return s.call(func() error {
+		switch c.Op {
+		case api.OpMute:
+			s.player.Mute(c.Channel, c.Mute)
+			return nil
+		case api.OpSolo:
+			s.player.Solo(c.Channel, c.Solo)
+			return nil
+		case api.OpMuteDevice, api.OpSoloDevice:
+			if !slices.Contains(s.m.Devices(), c.Device) {
+				return fmt.Errorf("device 0x%02X: not in the mapping", c.Device)
+			}
+			if c.Op == api.OpMuteDevice {
+				s.player.MuteDevice(c.Device, c.Mute)
+			} else {
+				s.player.SoloDevice(c.Device, c.Solo)
+			}
+			return nil
+		case api.OpMapping:
+			s.player.SetMapping(c.Mapping)
+			for _, d := range c.Mapping.Devices() {
+				s.setOffset(d, c.Mapping.Offsets[d])
+			}
+			s.m, s.mapFile = c.Mapping, c.MappingFile
+			if s.mapFile == "" {
+				s.mapFile = "(uploaded)"
+			}
+			return nil
+		case api.OpPlay:
+			if c.Song != "" {
+				return s.play(c.Song)
+			}
+			if s.song == "" {
+				return errNothing
+			}
+			if s.stopped {
+				s.stopped = false
+				s.restart <- struct{}{}
+			} else {
+				s.player.Resume()
+			}
+			return nil
+		case api.OpStop:
+			s.stop()
+			return nil
+		case api.OpPanic:
+			s.stop()
+			for _, d := range s.m.Devices() {
+				if err := s.sched.Send(protocol.AllNotesOff(d)); err != nil {
+					return err
+				}
+			}
+			return nil
+		case api.OpOffset:
+			offset := c.Offset
+			if c.Nudge {
+				offset += s.sched.Offset(c.Device)
+			}
+			if offset < -mapping.MaxOffset || offset > mapping.MaxOffset {
+				return fmt.Errorf("device 0x%02X: an offset of %v isn't within %v either way", c.Device, offset, mapping.MaxOffset)
+			}
+			s.setOffset(c.Device, offset)
+			return nil
+		case api.OpTempo:
+			if c.Nudge {
+				c.Tempo += s.player.Tempo()
+			}
+			s.player.SetTempo(c.Tempo)
+			return nil
+		case api.OpTranspose:
+			if c.Nudge {
+				c.Transpose += s.player.Transposed()
+			}
+			s.player.Transpose(c.Transpose)
+			return nil
+		}
+		if s.stopped {
+			return errStopped
+		}
+		switch c.Op {
+		case api.OpPause:
+			s.player.Pause()
+		case api.OpNext, api.OpPrev:
+			if s.playlist == nil {
+				return errNoPlaylist
+			}
+			if c.Op == api.OpNext {
+				s.playlist.Next()
+			} else {
+				s.playlist.Prev()
+			}
+		case api.OpSeek:
+			if c.Bar != 0 {
+				s.player.SeekBar(c.Bar)
+			} else {
+				s.player.Seek(c.At)
+			}
+		default:
+			return fmt.Errorf("unknown command %q", c.Op)
+		}
+		return nil
+	})
+}
+
+// setOffset sets how much earlier device is sent to, warning if the
+// lookahead is too short for it.
+func (s *show) setOffset(device byte, offset time.Duration) {
+	if err := s.sched.SetOffset(device, offset); err != nil && s.warn != nil {
+		s.warn(err)
+	}
+}
+
+func (s *show) stop() {
+	if !s.stopped && s.cancel != nil {
+		s.stopped = true
+		s.cancel()
+	}
+}
+
+// play readies the song called name, from --song-dir, and plays it in
+// place of what is playing, or after a stop. At its end the show stops,
+// to wait for the next command.
+func (s *show) play(name string) error {
+	if s.load == nil {
+		return errNoSongs
+	}
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("%s: want the name of a song in --song-dir", name)
+	}
+	play, err := s.load(name)
+	if err != nil {
+		return err
+	}
+	s.cue = func(ctx context.Context) error {
+		err := play(ctx)
+		s.call(func() error {
+			if err == nil && s.cue == nil {
+				s.stopped = true
+			}
+			return nil
+		})
+		return err
+	}
+	s.song, s.playlist = name, nil
+	if s.stopped {
+		s.stopped = false
+		s.restart <- struct{}{}
+	} else if s.cancel != nil {
+		s.cancel()
+	}
+	return nil
+}
+
+// Status says where the show is, for the API.
+func (s *show) Status() api.Status {
+	var st api.Status
+	s.call(func() error {
+		st = s.status()
+		return nil
+	})
+	return st
+}
+
+func (s *show) status() api.Status {
+	st := api.Status{State: api.Playing, Song: s.song, Songs: 1, Mapping: s.mapFile, Muted: []int{}, Soloed: []int{}}
+	st.Tempo, st.Transpose = s.player.Tempo(), s.player.Transposed()
+	switch {
+	case s.stopped:
+		st.State = api.Stopped
+	case s.player.Paused():
+		st.State = api.Paused
+	}
+	if s.playlist != nil {
+		ps := s.playlist.State()
+		st.Song, st.Index, st.Songs = ps.Song, ps.Position, ps.Len
+	}
+	if !s.stopped {
+		at, length := s.player.Position()
+		st.Position, st.Length = at.Seconds(), length.Seconds()
+	}
+	for ch := range byte(16) {
+		if s.player.Muted(ch) {
+			st.Muted = append(st.Muted, int(ch)+1)
+		}
+		if s.player.Soloed(ch) {
+			st.Soloed = append(st.Soloed, int(ch)+1)
+		}
+	}
+	links := s.sched.Links()
+	for _, addr := range s.m.Devices() {
+		// A device no port answered for is taken to be on the first.
+		l := links[0]
+		for _, x := range links {
+			if slices.Contains(x.Addresses, addr) {
+				l = x
+			}
+		}
+		err := l.Device.Err()
+		d := api.Device{
+			Address:   fmt.Sprintf("0x%02X", addr),
+			Port:      l.Name,
+			Connected: err == nil,
+			Latency:   float64(l.Latency.Round(100*time.Microsecond)) / float64(time.Millisecond),
+			Offset:    int(s.sched.Offset(addr) / time.Millisecond),
+			Muted:     s.player.DeviceMuted(addr),
+			Soloed:    s.player.DeviceSoloed(addr),
+		}
+		if err != nil {
+			d.Error = err.Error()
+		}
+		if err := s.sched.CheckDevice(addr); err != nil {
+			d.Warning = err.Error()
+		}
+		for _, f := range s.found {
+			if f.Address == addr {
+				d.FirstDrive, d.LastDrive = int(f.FirstDrive), int(f.LastDrive)
+			}
+		}
+		if s.devices != nil {
+			s.deviceStatus(&d, addr)
+		}
+		st.Devices = append(st.Devices, d)
+	}
+	return st
+}
+
+// deviceStatus fills in what the device at addr last said of itself, if
+// it has said anything.
+func (s *show) deviceStatus(d *api.Device, addr byte) {
+	ds, ok := s.devices.Status(addr)
+	if !ok {
+		return
+	}
+	d.Uptime, d.Sequence = int(ds.Uptime/time.Second), host.SequenceName(ds.Sequence)
+	for _, drive := range ds.Drives {
+		d.Sounding = append(d.Sounding, int(drive))
+	}
+	if ds.Fault != config.FaultNone {
+		d.LastFault = host.FaultName(ds.Fault)
+	}
+}
+
+// statusEvery is how often pollStatus asks the devices how they are.
+const statusEvery = 5 * time.Second
+
+// pollStatus asks the devices on every link how they are, now and each
+// statusEvery until ctx is done. Their answers reach the registry the
+// links' messages are passed to, for the API's status.
+func pollStatus(ctx context.Context, links []controller.Link) {
+	t := time.NewTicker(statusEvery)
+	defer t.Stop()
+	for {
+		for _, l := range links {
+			l.Device.Send(protocol.GetStatus())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/api"
+)
+
+// hotkeys reads keys from the terminal while goppy-play plays, as
+// --hotkeys asks, and carries them out through sh as it does the API's
+// commands: Tab chooses the next of the devices, ] and [ send to it 1ms
+// earlier or later, } and { 10ms, M and S mute or solo it, or clear that;
+// c chooses the next of the mapped channels, and m and s mute or solo it;
+// + and - play 1% faster or slower, > and < a semitone higher or lower,
+// and q or Ctrl-C call quit. It returns what puts the terminal back.
+func hotkeys(ctx context.Context, e env, sh *show, quit func()) (restore func(), err error) {
+	put, err := e.rawTerminal()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(e.stdout, "keys: Tab chooses a device, ] and [ send to it 1ms earlier or later, } and { 10ms, M and S mute or solo it, c chooses a channel, m and s mute or solo it, + and - the tempo, > and < transpose, q quits")
+	go func() {
+		r := bufio.NewReader(e.stdin)
+		chosen, channel := 0, -1
+		for {
+			key, err := r.ReadByte()
+			if err != nil || ctx.Err() != nil {
+				return
+			}
+			var by time.Duration
+			switch key {
+			case 'q', 0x03:
+				quit()
+				return
+			case '+', '=':
+				live(e, sh, api.Command{Op: api.OpTempo, Tempo: 1, Nudge: true})
+				continue
+			case '-', '_':
+				live(e, sh, api.Command{Op: api.OpTempo, Tempo: -1, Nudge: true})
+				continue
+			case '>', '.':
+				live(e, sh, api.Command{Op: api.OpTranspose, Transpose: 1, Nudge: true})
+				continue
+			case '<', ',':
+				live(e, sh, api.Command{Op: api.OpTranspose, Transpose: -1, Nudge: true})
+				continue
+			case 'c', 'm', 's':
+				channels := sh.channels()
+				if len(channels) == 0 {
+					continue
+				}
+				if key == 'c' || channel < 0 {
+					channel++
+				}
+				channel %= len(channels)
+				silence(e, sh, channels[channel], key)
+				continue
+			case '\t':
+				chosen++
+			case 'M', 'S':
+			case ']':
+				by = time.Millisecond
+			case '[':
+				by = -time.Millisecond
+			case '}':
+				by = 10 * time.Millisecond
+			case '{':
+				by = -10 * time.Millisecond
+			default:
+				continue
+			}
+			devices := sh.Status().Devices
+			if len(devices) == 0 {
+				continue
+			}
+			chosen %= len(devices)
+			d := devices[chosen]
+			if key == 'M' || key == 'S' {
+				addr, _ := strconv.ParseUint(d.Address, 0, 8)
+				c := api.Command{Op: api.OpMuteDevice, Device: byte(addr), Mute: !d.Muted}
+				if key == 'S' {
+					c = api.Command{Op: api.OpSoloDevice, Device: byte(addr), Solo: !d.Soloed}
+				}
+				if err := sh.Do(c); err != nil {
+					fmt.Fprintln(e.stderr, "goppy-play:", err)
+					continue
+				}
+				if devices := sh.Status().Devices; chosen < len(devices) {
+					d = devices[chosen]
+				}
+				fmt.Fprintf(e.stdout, "device %s: %s\n", d.Address, flags(d.Muted, d.Soloed))
+				continue
+			}
+			if by != 0 {
+				addr, _ := strconv.ParseUint(d.Address, 0, 8)
+				if err := sh.Do(api.Command{Op: api.OpOffset, Device: byte(addr), Offset: by, Nudge: true}); err != nil {
+					fmt.Fprintln(e.stderr, "goppy-play:", err)
+					continue
+				}
+				if devices := sh.Status().Devices; chosen < len(devices) {
+					d = devices[chosen]
+				}
+			}
+			fmt.Fprintf(e.stdout, "device %s: sent %dms early\n", d.Address, d.Offset)
+		}
+	}()
+	return func() { put() }, nil
+}
+
+// live moves the tempo or transpose by c and says where they are.
+func live(e env, sh *show, c api.Command) {
+	if err := sh.Do(c); err != nil {
+		fmt.Fprintln(e.stderr, "goppy-play:", err)
+		return
+	}
+	st := sh.Status()
+	fmt.Fprintf(e.stdout, "tempo %d%%, transposed %+d\n", st.Tempo, st.Transpose)
+}
+
+// silence carries out the channel key, c, m or s, for channel, from 0:
+// c says how it is, and m and s mute or solo it, or clear that. Then it
+// says how the channel is.
+func silence(e env, sh *show, channel, key byte) {
+	st := sh.Status()
+	muted, soloed := slices.Contains(st.Muted, int(channel)+1), slices.Contains(st.Soloed, int(channel)+1)
+	switch key {
+	case 'm':
+		muted = !muted
+		if err := sh.Do(api.Command{Op: api.OpMute, Channel: channel, Mute: muted}); err != nil {
+			fmt.Fprintln(e.stderr, "goppy-play:", err)
+			return
+		}
+	case 's':
+		soloed = !soloed
+		if err := sh.Do(api.Command{Op: api.OpSolo, Channel: channel, Solo: soloed}); err != nil {
+			fmt.Fprintln(e.stderr, "goppy-play:", err)
+			return
+		}
+	}
+	fmt.Fprintf(e.stdout, "channel %d: %s\n", channel+1, flags(muted, soloed))
+}
+
+// flags says whether a channel or device is muted or soloed.
+func flags(muted, soloed bool) string {
+	switch {
+	case muted && soloed:
+		return "muted, soloed"
+	case muted:
+		return "muted"
+	case soloed:
+		return "soloed"
+	}
+	return "playing"
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller"
+	"github.com/ystepanoff/goppy/controller/mapping"
+)
+
+// keyboard plays the terminal's keys on the device at port, as --keyboard
+// asks, through a controller.Bridge, and returns the exit code.
+func keyboard(ctx context.Context, e env, port string, baud int, iface, mapFile string, noteLength time.Duration, bendRate int) int {
+	var m *mapping.Map
+	if mapFile != "" {
+		var err error
+		if m, err = mapping.Load(mapFile); err != nil {
+			fmt.Fprintln(e.stderr, "goppy-play: read mapping:", err)
+			return exitFile
+		}
+	}
+	dev, _, code := connect(ctx, e, port, baud, iface)
+	if dev == nil {
+		return code
+	}
+	defer dev.Close()
+	devices := controller.NewDeviceRegistry()
+	if m == nil {
+		found, err := dev.Discover(time.Second)
+		if err != nil || len(found) == 0 {
+			fmt.Fprintln(e.stderr, "goppy-play: no device answered on", port)
+			return exitNoDevice
+		}
+		devices.Add(found...)
+		d := found[0]
+		m = mapping.Channels(d.Address, d.FirstDrive, d.LastDrive)
+		fmt.Fprintf(e.stdout, "device 0x%02X drives %d..%d\n", d.Address, d.FirstDrive, d.LastDrive)
+		legacy(e, d)
+	}
+	go func() {
+		for range dev.Messages() {
+		}
+	}()
+
+	restore, err := e.rawTerminal()
+	if err != nil {
+		fmt.Fprintln(e.stderr, "goppy-play: --keyboard needs a terminal:", err)
+		return exitError
+	}
+	// Put the terminal back however this returns, a panic unwinding
+	// included.
+	defer func() {
+		fmt.Fprint(e.stdout, controller.KeyboardProtocolOff)
+		restore()
+	}()
+	fmt.Fprint(e.stdout, controller.KeyboardProtocol)
+	fmt.Fprintln(e.stdout, "keys A W S E D F T G Y H U J K play C to C, with Shift an octave up;")
+	fmt.Fprintln(e.stdout, "Z and X change octave, 1 to 0 choose channel 1 to 10, space silences, Ctrl-C quits")
+	kb := controller.NewKeyboard(e.stdin, controller.KeyboardOptions{
+		NoteLength: noteLength,
+		Changed: func(s controller.KeyboardState) {
+			held := "notes last " + noteLength.String()
+			if s.KeyUp {
+				held = "notes held with their keys"
+			}
+			fmt.Fprintf(e.stdout, "octave %d, channel %d: %s; %s\n", s.Octave, s.Channel+1, describe(m, s.Channel), held)
+		},
+	})
+	defer kb.Close()
+	b := controller.NewBridge(kb, dev, m)
+	b.Bends.Rate = bendRate
+	b.Devices = devices
+	return exit(e, b.Run(ctx))
+}
+
+// rawTerminal puts the terminal on stdin into raw mode, reading each key
+// as it is pressed, unechoed, with Ctrl-C a key rather than a signal, and
+// returns what puts it back as it was.
+func rawTerminal() (func() error, error) {
+	stty := func(args ...string) (string, error) {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = os.Stdin
+		out, err := cmd.Output()
+		return strings.TrimSpace(string(out)), err
+	}
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("-icanon", "-echo", "-isig", "-ixon", "min", "1", "time", "0"); err != nil {
+		return nil, err
+	}
+	return func() error {
+		_, err := stty(saved)
+		return err
+	}, nil
+}
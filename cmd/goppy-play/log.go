@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+	host "github.com/ystepanoff/goppy/internal/protocol"
+)
+
+// messageLog prints what --dry-run would send, or a capture holds: each
+// frame decoded, at its offset, by internal/protocol's Describer, which
+// goppy replay's log is too. It leaves out the devices and commands
+// --log-device and --log-command don't name, if they name any, and with
+// --log-json prints each frame as a line of JSON, for diffing.
+type messageLog struct {
+	w        io.Writer
+	json     bool
+	devices  []byte   // nil for all of them
+	commands []string // by name, nil for all of them
+}
+
+// logLine is a frame of the log as a line of JSON.
+type logLine struct {
+	At     float64 `json:"at_ms"`
+	Device string  `json:"device"`
+	host.Described
+	Frame string `json:"frame"` // as sent, in hex
+}
+
+// newMessageLog returns the log --dry-run prints to w, for the devices,
+// as 0x01,0x02, and commands, as note-on,note-off, named; "" names them
+// all.
+func newMessageLog(w io.Writer, devices, commands string, asJSON bool) (*messageLog, error) {
+	l := &messageLog{w: w, json: asJSON}
+	if devices != "" {
+		for _, s := range strings.Split(devices, ",") {
+			d, err := strconv.ParseUint(strings.TrimSpace(s), 0, 8)
+			if err != nil {
+				return nil, fmt.Errorf("--log-device %s: want device addresses, as 0x01,0x02", devices)
+			}
+			l.devices = append(l.devices, byte(d))
+		}
+	}
+	if commands != "" {
+		for _, s := range strings.Split(commands, ",") {
+			name := strings.ReplaceAll(strings.TrimSpace(s), "-", " ")
+			if !knownCommand(name) {
+				return nil, fmt.Errorf("--log-command %s: unknown command %q: want names such as note-on,pitch-bend", commands, s)
+			}
+			l.commands = append(l.commands, name)
+		}
+	}
+	return l, nil
+}
+
+// knownCommand reports whether name is a command's, as CommandName has
+// it: "command 0x2a" names one it doesn't know.
+func knownCommand(name string) bool {
+	for c := range 256 {
+		if host.CommandName(false, byte(c)) == name || host.CommandName(true, byte(c)) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// print prints frames, the first of them the song's or capture's start.
+func (l *messageLog) print(frames []controller.CapturedFrame) error {
+	var d host.Describer
+	for _, f := range frames {
+		m, n, err := protocol.Decode(f.Frame)
+		if errors.Is(err, protocol.ErrReservedSubAddress) {
+			// A drive this build of the firmware hasn't, as a device
+			// built with another config may: logged all the same.
+			m, err = protocol.Message{Device: f.Frame[1], Sub: f.Frame[2], Command: f.Frame[4], Payload: f.Frame[protocol.HeaderSize+1 : n]}, nil
+		}
+		if err != nil {
+			return fmt.Errorf("frame at %v, % x: %w", f.At, f.Frame, err)
+		}
+		// Described whether shown or not, to follow the bend ranges.
+		desc := d.Describe(m)
+		if l.devices != nil && !slices.Contains(l.devices, m.Device) ||
+			l.commands != nil && !slices.Contains(l.commands, desc.Command) {
+			continue
+		}
+		if l.json {
+			line, err := json.Marshal(logLine{
+				At:        float64(f.At) / float64(time.Millisecond),
+				Device:    fmt.Sprintf("0x%02X", m.Device),
+				Described: desc,
+				Frame:     fmt.Sprintf("% x", f.Frame),
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(l.w, "%s\n", line)
+			continue
+		}
+		fmt.Fprintf(l.w, "%s  0x%02X %s\n", host.Stamp(f.At), m.Device, desc)
+	}
+	return nil
+}
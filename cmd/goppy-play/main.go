@@ -0,0 +1,1258 @@
+// Command goppy-play plays a MIDI file on goppy/Moppy devices, built on
+// package controller:
+//
+//	goppy-play song.mid... [--port auto] [--map mapping.yaml] [--transpose N]
+//	           [--tempo 1.0] [--min-velocity N] [--arrange fold]
+//	           [--max-notes N] [--min-length 30ms] [--allocate outer]
+//	           [--voices N] [--min-hold 80ms] [--loop markers] [--loops N]
+//	           [--loop-gap 0s] [--bend-rate 100]
+//	           [--watchdog 2s] [--gap 2s] [--rehome] [--shuffle] [--seed N]
+//	           [--repeat none] [--listen :8080] [--token T] [--map-dir DIR]
+//	           [--song-dir DIR] [--osc :57120] [--mqtt broker:1883]
+//	           [--mqtt-topic goppy] [--sync PORT,...] [--lookahead 0s]
+//	           [--hotkeys] [--clock /dev/snd/midiC1D0] [--record capture.gop]
+//	           [--bake song.gopb] [--count-in N] [--metronome off] [--pattern N]
+//	           [--dry-run] [--log-device 0x01,...] [--log-command note-on,...]
+//	           [--log-json]
+//	goppy-play --replay capture.gop [--port auto] [--record capture.gop]
+//	           [--dry-run]
+//	goppy-play --keyboard [--port auto] [--map mapping.yaml] [--note-length 300ms]
+//	goppy-play --osc :57120 [--port auto]
+//
+// With --port auto it plays on the first device a scan of the USB serial
+// ports finds. --port udp plays on network-attached devices, through
+// Moppy's multicast group, or udp:GROUP:PORT through another; --iface
+// picks the network interface to send from. Without --map, MIDI channel 1
+// plays on the device's first drive, channel 2 on the next, and so on; see
+// package mapping for the mapping file. --arrange, or the mapping's arrange default, picks how
+// notes outside the drives' range are brought in before the song starts:
+// see controller.Arrange. --max-notes and --min-length thin every mapped
+// channel as the mapping's max-notes and min-length settings do, in place
+// of them: see controller.Thin. What thinning took out is printed after
+// the song, or with --dry-run. --allocate, or the mapping's allocate
+// default, shares out each device's voices, its drives or --voices, when
+// the song strikes more notes at once than it has, holding a note
+// --min-hold before another takes its voice: see controller.Allocate.
+// What it dropped on each channel is printed as the song starts, or with
+// --dry-run. The mapping's quantise and humanise settings move each
+// channel's notes toward a grid and at random, the same way for the same
+// --seed, as the song is read: see controller.Retime. --loop plays a
+// section of the song over and over: the one between its loopStart and
+// loopEnd markers, or bars FIRST-LAST. It plays --loops times, then the
+// song plays on, or with 0 until Ctrl-C; --loop-gap leaves a silence
+// between passes: see controller.Loop. --bend-rate holds each channel's pitch
+// bends to a rate the link keeps up with. If a serial port fails mid-song,
+// or the device stops answering for --watchdog, it is reopened until the
+// device answers again, and the song picks up where it stopped. Ctrl-C
+// silences the drives and stops the sequence.
+//
+// --sync plays on the devices on more serial ports alongside --port's,
+// such as an Arduino on each USB port, as the mapping says. Each port's
+// round trip is measured before the song, and what is sent to each is
+// held back so that it sounds when the slowest port's does: notes struck
+// together sound together. See controller.Scheduler.
+//
+// What is written to a serial port is kept to what --baud carries: when
+// a passage is too dense for it, note-offs go first and pitch bends last,
+// a bend overtaken by the next to its drive dropped. The messages that
+// came late, and the bends dropped, are reported for each port at the end.
+//
+// A device that sounds late by more than its port's round trip says, as
+// one behind a WiFi bridge does, is sent to early by its offset in the
+// mapping, which stacks on the round trip's. Everything else is held back
+// --lookahead to make room, by default as long as the largest offset
+// needs; a device that needs longer is warned of, and sounds late. The
+// API moves an offset live, and so do the keys with --hotkeys: Tab
+// chooses a device, ] and [ send to it 1ms earlier or later, } and {
+// 10ms, and q quits.
+//
+// The API and --hotkeys also move the tempo and transpose as the song
+// plays, on top of --tempo's and --transpose's: + and - play 1% faster
+// or slower, from the next event, > and < a semitone higher or lower,
+// from the next note struck; a note moved out of its channel's range goes
+// as --arrange has it. The progress line shows both once moved.
+//
+// They mute and solo channels and devices too, for rehearsing a part
+// alone: c chooses a mapped channel, m mutes it and s solos it, and M and
+// S do the same for the device Tab chose; pressed again, they clear it.
+// A muted channel's or device's notes sounding are released at once.
+// While anything is soloed, what isn't is silenced, and sounds again, if
+// not muted, once the solos are cleared. The progress line marks each
+// channel M for muted and S for soloed, and names the devices muted or
+// soloed.
+//
+// --clock follows the MIDI clock a sequencer or drum machine sends on a
+// raw MIDI device in place of the wall clock, so the drives play along
+// with it: the song waits for its start, goes at its tempo as it drifts,
+// pauses at its stop, and moves to its song position pointer. See
+// controller.ClockSync.
+//
+// --count-in clicks N beats at the song's starting tempo before it
+// starts, and --metronome clicks its beats, or its downbeats, as it
+// plays, through its tempo changes and at --tempo's and the API's tempo.
+// The clicks go where the mapping's metronome section says: see
+// controller.Clicks. A playlist's songs are each counted in, but those
+// an .m3u file marks with a #GOPPY:no-count-in line before them.
+//
+// Given more than one song, or a directory, a glob pattern or an .m3u
+// file of them, it plays them as a playlist, with --gap between songs in
+// which the drives are silenced, and re-homed with --rehome. --shuffle
+// plays them in an order drawn from --seed; --repeat all plays the list
+// again and again, and --repeat one each song. A song that can't be read
+// is skipped: see controller.Playlist.
+//
+// --listen serves the HTTP control API of package api on an address, for
+// a phone or a Stream Deck: status, play, pause, stop, next, prev, seek,
+// channel mutes, and a mapping chosen from --map-dir or uploaded. With
+// --token, each request must bear it. The status has what each device
+// last said of itself, asked every 5s: its uptime, sequence state, drives
+// sounding and last fault. A stop from the API silences the
+// drives until a play starts the song, or the playlist, again. A play may
+// name a song in --song-dir to play in place of what is playing; the show
+// stops at its end, to wait for the next command. A WebSocket at /events
+// streams the notes and bends sent, the transport's state, devices coming
+// and going and the status every second, for a dashboard, and takes the
+// transport's commands and mutes: see package feed.
+//
+// --mqtt connects to an MQTT broker, for home automation, and takes the
+// API's commands as JSON on --mqtt-topic/command, such as {"action":
+// "play", "file": "fanfare.mid"} for a doorbell, and publishes the
+// status, retained, to --mqtt-topic/state as it changes and every
+// --mqtt-heartbeat. A lost broker is dialled again, waiting longer after
+// each failure: see package mqtt.
+//
+// --osc serves Open Sound Control on a UDP address, for live-coding
+// environments such as TidalCycles and SuperCollider to play the drives
+// alongside the song, or without one until Ctrl-C: see package osc for
+// its messages. Those it can't decode or carry out are logged and
+// dropped.
+//
+// --record writes every frame sent to the device, and when, to a capture
+// file, in package protocol's format: bends, mutes and seeks made live
+// included. --replay plays one back with its timing, in place of a song,
+// through the capture's transport and at its baud unless --port or
+// --baud say otherwise.
+//
+// --bake writes the song to a baked file, in place of playing it: every
+// frame the song sends, and when, through the mapping, --arrange,
+// thinning, --allocate, --transpose and --tempo, ready to stream verbatim
+// from a player with no host attached. Without --map it is baked for
+// device 1, a drive a channel. --replay plays a baked file as it does a
+// capture, through --port at --baud.
+//
+// A MIDI file of format 2 holds patterns, not one song: they play one
+// after another, each at its own tempo, or with --pattern N only the Nth,
+// from 1. Files with SMPTE timing play in frames, whatever their tempo.
+//
+// --dry-run reads each song and prints what it holds, then every frame
+// playing it would send, and when, decoded as goppy replay decodes a
+// capture: notes by name, bends in cents. --log-device and --log-command
+// print only the frames for the devices and commands they name, and
+// --log-json prints each as a line of JSON, for diffing one arrangement's
+// against another's. With --replay it prints the capture's frames in
+// place of playing them.
+//
+// --keyboard turns the terminal into an instrument, for a demo without a
+// MIDI keyboard: A W S E D F T G Y H U J K play an octave, with Shift the
+// one above, Z and X change octave, the number keys choose the channel
+// and so the drive or pool the mapping gives it, and space silences the
+// drives. Keys held sustain where the terminal reports their release, as
+// those with the kitty keyboard protocol do; elsewhere each note lasts
+// --note-length. The terminal is put back as it was on the way out: see
+// controller.Keyboard.
+//
+// The exit code says what went wrong, for scripts:
+//
+//	0  played to the end
+//	1  anything else, such as the port failing mid-song
+//	2  bad flags
+//	3  the song or mapping file can't be read
+//	4  no device found
+//	5  interrupted
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller"
+	"github.com/ystepanoff/goppy/controller/api"
+	"github.com/ystepanoff/goppy/controller/feed"
+	"github.com/ystepanoff/goppy/controller/mapping"
+)
+
+const (
+	exitOK = iota
+	exitError
+	exitUsage
+	exitFile
+	exitNoDevice
+	exitInterrupted
+)
+
+// env is what run talks to: the terminal and the serial ports, or fakes
+// in tests.
+type env struct {
+	stdout, stderr io.Writer
+	stdin          io.Reader
+	rawTerminal    func() (restore func() error, err error)
+	scan           func(ctx context.Context, opts controller.ScanOptions) ([]controller.FoundDevice, error)
+	open           func(port string, baud int) (*controller.Device, error)
+	openUDP        func(group string, port int, opts controller.UDPOptions) (*controller.Device, error)
+	listen         func(network, address string) (net.Listener, error)
+	listenPacket   func(network, address string) (net.PacketConn, error)
+	dial           func(ctx context.Context, network, address string) (net.Conn, error)
+	openMIDI       func(path string) (controller.MIDIIn, error)
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	code := run(ctx, os.Args[1:], env{
+		stdout:       os.Stdout,
+		stderr:       os.Stderr,
+		stdin:        os.Stdin,
+		rawTerminal:  rawTerminal,
+		scan:         controller.ScanAll,
+		open:         controller.OpenSerial,
+		openUDP:      controller.OpenUDPWith,
+		listen:       net.Listen,
+		listenPacket: net.ListenPacket,
+		dial:         (&net.Dialer{}).DialContext,
+		openMIDI:     controller.OpenMIDIClock,
+	})
+	stop()
+	os.Exit(code)
+}
+
+// run plays the song args name and returns the exit code.
+func run(ctx context.Context, args []string, e env) int {
+	fs := flag.NewFlagSet("goppy-play", flag.ContinueOnError)
+	fs.SetOutput(e.stderr)
+	port := fs.String("port", "auto", "serial port path, auto to scan for a device, or udp[:GROUP:PORT] for network-attached devices")
+	iface := fs.String("iface", "", "with --port udp, the network interface to send from")
+	baud := fs.Int("baud", 57600, "serial baud rate")
+	mapFile := fs.String("map", "", "mapping file from MIDI channel to device/sub; default one drive per channel")
+	transpose := fs.Int("transpose", 0, "semitones to shift every note by; notes shifted out of MIDI's range are dropped")
+	tempo := fs.Float64("tempo", 1, "tempo scale: 2 plays twice as fast")
+	minVelocity := fs.Int("min-velocity", 0, "drop notes struck softer than this")
+	arrange := fs.String("arrange", "", "what to do with notes outside the drives' range: none, fold, shift or drop; default the mapping's, else none")
+	maxNotes := fs.Int("max-notes", 0, "keep at most this many notes at once on each channel, the loudest; 0 for the mapping's")
+	minLength := fs.Duration("min-length", 0, "drop notes shorter than this; 0 for the mapping's")
+	allocate := fs.String("allocate", "", "how to share out a device's voices when the song strikes more notes than it has: none, first or outer; default the mapping's, else none")
+	voices := fs.Int("voices", 0, "with --allocate, the notes each device sounds at once; 0 for the mapping's, else its drives")
+	minHold := fs.Duration("min-hold", 80*time.Millisecond, "with --allocate, how long a note keeps its voice before another may take it")
+	loopFlag := fs.String("loop", "none", "a section to play over and over: markers for the song's loopStart and loopEnd, bars FIRST-LAST, or none")
+	loops := fs.Int("loops", 0, "with --loop, how many times to play the section before playing on; 0 until stopped")
+	loopGap := fs.Duration("loop-gap", 0, "with --loop, a silence between passes")
+	bendRate := fs.Int("bend-rate", 100, "most pitch bends a second to send for each channel; 0 for any")
+	watchdog := fs.Duration("watchdog", 2*time.Second, "reconnect to a serial device that doesn't answer for this long; 0 to wait for the port to fail")
+	gap := fs.Duration("gap", 2*time.Second, "with a playlist, the wait between songs")
+	rehome := fs.Bool("rehome", false, "with a playlist, re-home the drives between songs")
+	shuffle := fs.Bool("shuffle", false, "shuffle the playlist")
+	seed := fs.Uint64("seed", 0, "with --shuffle, the seed for the order, 0 for a new order each time; and for the mapping's humanise")
+	repeatMode := fs.String("repeat", "none", "repeat the playlist: none, all, or one to repeat each song")
+	listen := fs.String("listen", "", "serve the HTTP control API on this address, such as :8080")
+	token := fs.String("token", "", "with --listen, the token each API request must bear")
+	mapDir := fs.String("map-dir", "", "with --listen, the directory of mapping files the API may choose from")
+	songDir := fs.String("song-dir", "", "with --listen or --mqtt, the directory of songs a play command may name")
+	oscAddr := fs.String("osc", "", "serve OSC for live coding on this UDP address, such as :57120; without a song, until Ctrl-C")
+	syncPorts := fs.String("sync", "", "with --map, more serial ports, comma-separated, whose devices play in step with --port's")
+	lookahead := fs.Duration("lookahead", 0, "how long to hold everything sent back, so a device may be sent to earlier by its offset; default the most the offsets and --sync need")
+	clockDev := fs.String("clock", "", "follow the MIDI clock on this raw MIDI device, such as /dev/snd/midiC1D0: its start, stop, continue and song position move the song, at its tempo")
+	keysLive := fs.Bool("hotkeys", false, "take keys from the terminal while playing: Tab chooses a device, [ and ] move its offset by 1ms, { and } by 10ms, M and S mute or solo it, c chooses a channel, m and s mute or solo it, + and - the tempo by 1%, > and < transpose by a semitone, q quits")
+	var mq mqttOptions
+	fs.StringVar(&mq.broker, "mqtt", "", "take commands from, and publish the status to, this MQTT broker, such as broker:1883")
+	fs.StringVar(&mq.topic, "mqtt-topic", "goppy", "with --mqtt, the topics' prefix: commands on PREFIX/command, the status on PREFIX/state")
+	fs.StringVar(&mq.username, "mqtt-user", "", "with --mqtt, the user name to connect with")
+	fs.StringVar(&mq.password, "mqtt-password", "", "with --mqtt, the password to connect with")
+	fs.DurationVar(&mq.heartbeat, "mqtt-heartbeat", 30*time.Second, "with --mqtt, how often to publish the status, changed or not")
+	recordFile := fs.String("record", "", "write every frame sent to this capture file, to play again with --replay")
+	replayFile := fs.String("replay", "", "play this capture file, written with --record, or baked file, written with --bake, in place of a song")
+	keys := fs.Bool("keyboard", false, "play the terminal's keys as a keyboard, in place of a song")
+	noteLength := fs.Duration("note-length", 300*time.Millisecond, "with --keyboard, how long notes last where the terminal doesn't report keys released")
+	pattern := fs.Int("pattern", 0, "with a format 2 MIDI file, play only this pattern, from 1; 0 plays them one after another")
+	countIn := fs.Int("count-in", 0, "click this many beats at the song's starting tempo before it starts, where the mapping's metronome says")
+	metronomeMode := fs.String("metronome", "off", "click as the song plays, where the mapping's metronome says: off, beats or downbeats")
+	bakeFile := fs.String("bake", "", "write the song, mapped, arranged and thinned, to this baked file for a player with no host, in place of playing it")
+	dryRun := fs.Bool("dry-run", false, "read the song and print what it holds, and every frame it would send, decoded, without a device; with --replay, the capture's frames")
+	logDevices := fs.String("log-device", "", "with --dry-run, print only the frames for these devices, comma-separated, as 0x01,0x02")
+	logCommands := fs.String("log-command", "", "with --dry-run, print only these commands' frames, comma-separated, as note-on,pitch-bend")
+	logJSON := fs.Bool("log-json", false, "with --dry-run, print each frame as a line of JSON, for diffing")
+
+	// Flags may follow the song, as in goppy-play song.mid --port auto.
+	var songs []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return exitUsage
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		songs = append(songs, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var log *messageLog
+	if *dryRun {
+		var err error
+		if log, err = newMessageLog(e.stdout, *logDevices, *logCommands, *logJSON); err != nil {
+			fmt.Fprintln(e.stderr, "goppy-play:", err)
+			return exitUsage
+		}
+	} else if set["log-device"] || set["log-command"] || set["log-json"] {
+		fmt.Fprintln(e.stderr, "goppy-play: --log-device, --log-command and --log-json choose what --dry-run prints, and want it")
+		return exitUsage
+	}
+	if *replayFile != "" {
+		if len(songs) > 0 {
+			fmt.Fprintln(e.stderr, "goppy-play: --replay plays a capture in place of a song, not with songs")
+			return exitUsage
+		}
+		return replay(ctx, e, *replayFile, *port, *baud, *iface, *recordFile, set, log)
+	}
+	if *keys {
+		if len(songs) > 0 || *dryRun || *noteLength <= 0 {
+			fmt.Fprintln(e.stderr, "goppy-play: --keyboard plays the keys in place of a song, not with songs or --dry-run, and --note-length must be positive")
+			return exitUsage
+		}
+		return keyboard(ctx, e, *port, *baud, *iface, *mapFile, *noteLength, *bendRate)
+	}
+	if len(songs) == 0 && *oscAddr != "" && !*dryRun {
+		return oscOnly(ctx, e, *port, *baud, *iface, *oscAddr)
+	}
+	// With --mqtt and songs to name, goppy-play may wait for the first.
+	idle := len(songs) == 0 && mq.broker != "" && *songDir != ""
+	if len(songs) == 0 && !idle {
+		fmt.Fprintln(e.stderr, "usage: goppy-play [flags] song.mid...\n       goppy-play --replay capture.gop\n       goppy-play --keyboard\n       goppy-play --osc :57120")
+		return exitUsage
+	}
+	if *tempo <= 0 || *minVelocity < 0 || *minVelocity > 127 || *transpose < -127 || *transpose > 127 {
+		fmt.Fprintln(e.stderr, "goppy-play: --tempo must be positive, --min-velocity 0 to 127 and --transpose -127 to 127")
+		return exitUsage
+	}
+	if *maxNotes < 0 || *maxNotes > 127 || *minLength < 0 || *bendRate < 0 || *watchdog < 0 || *gap < 0 || *voices < 0 || *minHold < 0 || *loops < 0 || *loopGap < 0 || *lookahead < 0 || *countIn < 0 || *pattern < 0 {
+		fmt.Fprintln(e.stderr, "goppy-play: --max-notes must be 0 to 127, and --min-length, --bend-rate, --watchdog, --gap, --voices, --min-hold, --loops, --loop-gap, --lookahead, --count-in and --pattern not negative")
+		return exitUsage
+	}
+	var extra []string
+	if *syncPorts != "" {
+		extra = strings.Split(*syncPorts, ",")
+		if *mapFile == "" || *recordFile != "" || slices.Contains(extra, "") {
+			fmt.Fprintln(e.stderr, "goppy-play: --sync wants --map, to say which devices play what, and not --record, which captures one port")
+			return exitUsage
+		}
+	}
+	if mq.broker != "" && (mq.topic == "" || mq.heartbeat < time.Second) {
+		fmt.Fprintln(e.stderr, "goppy-play: --mqtt-topic must not be empty, and --mqtt-heartbeat at least 1s")
+		return exitUsage
+	}
+	repeat, err := controller.ParseRepeat(*repeatMode)
+	if err != nil {
+		fmt.Fprintln(e.stderr, "goppy-play: --repeat:", err)
+		return exitUsage
+	}
+	mt := controller.Metronome{CountIn: *countIn}
+	if mt.Mode, err = controller.ParseMetronomeMode(*metronomeMode); err != nil {
+		fmt.Fprintln(e.stderr, "goppy-play: --metronome:", err)
+		return exitUsage
+	}
+	if mt.On() && *mapFile == "" {
+		fmt.Fprintln(e.stderr, "goppy-play: --count-in and --metronome want --map, with a metronome section saying where the clicks go")
+		return exitUsage
+	}
+	entries, err := controller.ExpandPlaylistEntries(songs...)
+	if err != nil {
+		fmt.Fprintln(e.stderr, "goppy-play: playlist:", err)
+		return exitFile
+	}
+	songs = songs[:0]
+	for _, en := range entries {
+		songs = append(songs, en.Song)
+	}
+	// clicks adds the metronome to the song at entry i, or to a song a
+	// play command names if i is past them.
+	clicks := func(events []controller.Event, i int) []controller.Event {
+		m := mt
+		if i < len(entries) && entries[i].NoCountIn {
+			m.CountIn = 0
+		}
+		return controller.Clicks(events, m)
+	}
+	if len(songs) == 0 && !idle {
+		fmt.Fprintln(e.stderr, "goppy-play: no songs to play")
+		return exitFile
+	}
+	if *bakeFile != "" && (len(songs) != 1 || *dryRun || *recordFile != "" || *syncPorts != "") {
+		fmt.Fprintln(e.stderr, "goppy-play: --bake writes one song in place of playing it, not with --dry-run, --record or --sync")
+		return exitUsage
+	}
+	// Humanise draws from --seed as given, so that it is the same each
+	// time without one.
+	humanise := *seed
+	if *shuffle && *seed == 0 {
+		*seed = uint64(time.Now().UnixNano())
+	}
+	thinning := func(m *mapping.Map) bool {
+		thins := false
+		for i := range m.Channels {
+			c := &m.Channels[i]
+			if *maxNotes > 0 {
+				c.MaxNotes = *maxNotes
+			}
+			if *minLength > 0 {
+				c.MinLength = *minLength
+			}
+			thins = thins || c.Mapped() && (c.MinVelocity > 0 || c.MaxNotes > 0 || c.MinLength > 0)
+		}
+		return thins
+	}
+	var strategy mapping.Strategy
+	if *arrange != "" {
+		var err error
+		if strategy, err = mapping.ParseStrategy(*arrange); err != nil {
+			fmt.Fprintln(e.stderr, "goppy-play: --arrange:", err)
+			return exitUsage
+		}
+	}
+	loop, err := parseLoop(*loopFlag)
+	if err != nil {
+		fmt.Fprintln(e.stderr, "goppy-play: --loop:", err)
+		return exitUsage
+	}
+	loopOf := func(events []controller.Event) (controller.Loop, bool) {
+		l, ok := loop(events)
+		l.Count, l.Gap = *loops, *loopGap
+		return l, ok
+	}
+	voicing := controller.Voicing{Voices: *voices, MinHold: *minHold}
+	if *allocate != "" {
+		if voicing.Strategy, err = mapping.ParseVoiceStrategy(*allocate); err != nil {
+			fmt.Fprintln(e.stderr, "goppy-play: --allocate:", err)
+			return exitUsage
+		}
+	}
+
+	var m *mapping.Map
+	if *mapFile != "" {
+		if m, err = mapping.Load(*mapFile); err != nil {
+			fmt.Fprintln(e.stderr, "goppy-play: read mapping:", err)
+			return exitFile
+		}
+		if *arrange == "" {
+			strategy = m.Strategy
+		}
+		if *allocate == "" {
+			voicing.Strategy = m.Voicing
+		}
+		if mt.On() && !m.Metronome.On() {
+			fmt.Fprintf(e.stderr, "goppy-play: --count-in and --metronome: %s has no metronome section saying where the clicks go\n", *mapFile)
+			return exitUsage
+		}
+	}
+	read := func(song string) ([]controller.Event, error) {
+		events, err := readSong(song, *pattern)
+		if err != nil {
+			return nil, err
+		}
+		// Retimed before --tempo scales it, on the song's own tempo map.
+		if m != nil && retimes(m) {
+			var rt controller.Retiming
+			events, rt = controller.Retime(events, m, humanise)
+			fmt.Fprintln(e.stdout, "retimed notes:", rt)
+		}
+		return adjust(events, *transpose, *tempo, byte(*minVelocity)), nil
+	}
+	playlist := !idle && (len(songs) > 1 || repeat != controller.RepeatNone)
+
+	if *dryRun {
+		plan := m
+		if plan == nil {
+			plan = mapping.Channels(0x01, 1, 16)
+		}
+		code := exitOK
+		for i, song := range songs {
+			events, err := read(song)
+			if err != nil {
+				fmt.Fprintln(e.stderr, "goppy-play: read song:", err)
+				code = exitFile
+				continue
+			}
+			summarise(e.stdout, song, events, m)
+			l, looped := loopOf(events)
+			if looped {
+				fmt.Fprintln(e.stdout, "loop:", describeLoop(l))
+			} else if *loopFlag != "none" {
+				fmt.Fprintln(e.stdout, "loop: no loop markers")
+			}
+			if strategy != mapping.StrategyNone {
+				var a controller.Arrangement
+				events, a = controller.Arrange(events, plan, strategy)
+				fmt.Fprintln(e.stdout, "out of range notes:", a)
+			}
+			if thinning(plan) {
+				var th controller.Thinning
+				events, th = controller.Thin(events, plan)
+				fmt.Fprintln(e.stdout, "thinned notes:", th)
+			}
+			events, va := controller.Allocate(events, plan, voicing)
+			if voicing.Strategy != mapping.VoicesNone {
+				fmt.Fprintln(e.stdout, "voice allocation:", va)
+			}
+			p := controller.NewPlayer(nil, plan)
+			p.Bends.Rate, p.Arrange = *bendRate, strategy
+			if looped {
+				if l.Count == 0 {
+					// Until stopped, it is logged once round.
+					l.Count = 1
+				}
+				p.Loop = l
+			}
+			if err := dryRunLog(log, p, clicks(events, i)); err != nil {
+				fmt.Fprintf(e.stderr, "goppy-play: --dry-run %s: %v\n", song, err)
+				code = exitFile
+			}
+		}
+		return code
+	}
+	if *bakeFile != "" {
+		// Without a device to ask, the song is baked for device 1, one
+		// drive a channel, as --dry-run plans it.
+		plan := m
+		if plan == nil {
+			plan = mapping.Channels(0x01, 1, 16)
+		}
+		events, err := read(songs[0])
+		if err != nil {
+			fmt.Fprintln(e.stderr, "goppy-play: read song:", err)
+			return exitFile
+		}
+		events, a := controller.Arrange(events, plan, strategy)
+		fmt.Fprintln(e.stdout, "out of range notes:", a)
+		if thinning(plan) {
+			var th controller.Thinning
+			events, th = controller.Thin(events, plan)
+			fmt.Fprintln(e.stdout, "thinned notes:", th)
+		}
+		events, va := controller.Allocate(events, plan, voicing)
+		if voicing.Strategy != mapping.VoicesNone {
+			fmt.Fprintln(e.stdout, "voice allocation:", va)
+		}
+		events = clicks(events, 0)
+		p := controller.NewPlayer(nil, plan)
+		p.Bends.Rate, p.Arrange = *bendRate, strategy
+		p.Loop, _ = loopOf(events)
+		return bake(e, *bakeFile, songs[0], p, events)
+	}
+	var events []controller.Event
+	if !playlist && !idle {
+		if events, err = read(songs[0]); err != nil {
+			fmt.Fprintln(e.stderr, "goppy-play: read song:", err)
+			return exitFile
+		}
+	}
+
+	dev, name, code := connect(ctx, e, *port, *baud, *iface)
+	if dev == nil {
+		return code
+	}
+	defer dev.Close()
+	var rec *recording
+	if *recordFile != "" {
+		if rec, err = record(*recordFile, dev, name, *baud); err != nil {
+			fmt.Fprintln(e.stderr, "goppy-play: --record:", err)
+			return exitFile
+		}
+		defer rec.close()
+	}
+	links := []controller.Link{{Name: name, Device: dev}}
+	for _, port := range extra {
+		d, err := e.open(port, *baud)
+		if err != nil {
+			fmt.Fprintln(e.stderr, "goppy-play: --sync:", err)
+			return exitNoDevice
+		}
+		defer d.Close()
+		links = append(links, controller.Link{Name: port, Device: d})
+	}
+	var found []controller.DeviceInfo
+	// The registry merges what answers on each link, by address; a
+	// mapping's transports say which link plays a device on more than one.
+	devices := controller.NewDeviceRegistry()
+	transport := mapping.TransportSerial
+	if strings.HasPrefix(name, "udp:") {
+		transport = mapping.TransportUDP
+	}
+	if m == nil {
+		found, err = dev.Discover(time.Second)
+		if err != nil || len(found) == 0 {
+			fmt.Fprintln(e.stderr, "goppy-play: no device answered on", *port)
+			return exitNoDevice
+		}
+		devices.Merge(controller.Sightings(transport, name, dev, found...)...)
+		d := found[0]
+		m = mapping.Channels(d.Address, d.FirstDrive, d.LastDrive)
+		fmt.Fprintf(e.stdout, "device 0x%02X drives %d..%d\n", d.Address, d.FirstDrive, d.LastDrive)
+		legacy(e, d)
+	}
+	for d, t := range m.Transports {
+		devices.Prefer(d, t)
+	}
+	// Everything goes through a Scheduler, which sends each device its
+	// offset early, and with --sync plays on every port, each ahead of
+	// the others by how much later what is written to it sounds.
+	sched := controller.NewScheduler(links...)
+	defer sched.Close()
+	for d, o := range m.Offsets {
+		sched.SetOffset(d, o)
+	}
+	if len(links) > 1 {
+		if err := sched.Calibrate(ctx, 5); err != nil {
+			if errors.Is(err, context.Canceled) {
+				return exitInterrupted
+			}
+			fmt.Fprintln(e.stderr, "goppy-play: --sync:", err)
+			return exitNoDevice
+		}
+		links = sched.Links()
+		for _, l := range links {
+			fmt.Fprintf(e.stdout, "%s: devices % X, %v late\n", l.Name, l.Addresses, l.Latency.Round(100*time.Microsecond))
+		}
+	}
+	sched.Lookahead = sched.Need()
+	if set["lookahead"] {
+		sched.Lookahead = *lookahead
+	}
+	if sched.Lookahead > 0 {
+		fmt.Fprintf(e.stdout, "playing %v ahead, in step\n", sched.Lookahead.Round(100*time.Microsecond))
+	}
+	if err := sched.Check(); err != nil {
+		fmt.Fprintf(e.stderr, "goppy-play: warning: %v\n", strings.ReplaceAll(err.Error(), "\n", "\ngoppy-play: warning: "))
+	}
+	// Only a port OpenSerial opened can be reopened: UDP has no link to
+	// lose.
+	for _, l := range links {
+		// The watchdog pings a device the mapping plays on this port.
+		var address byte
+		for _, a := range m.Devices() {
+			if len(links) == 1 || slices.Contains(l.Addresses, a) {
+				address = a
+				break
+			}
+		}
+		l.Device.Supervise(controller.Supervision{
+			Address: address,
+			Silence: *watchdog,
+			Notify: func(err error) {
+				if err != nil {
+					fmt.Fprintf(e.stderr, "\ngoppy-play: %v; reconnecting\n", err)
+				} else {
+					fmt.Fprintln(e.stderr, "goppy-play: reconnected; playing on")
+				}
+			},
+		})
+		go func() {
+			// Drain what the device sends back, so its reader never waits,
+			// noting the watchdog's pongs.
+			for msg := range l.Device.Messages() {
+				devices.Heard(l.Device, msg)
+			}
+		}()
+	}
+	thins := thinning(m)
+
+	// With --listen, what the player sends is streamed to the API's
+	// WebSocket too.
+	var (
+		out controller.Sender = sched
+		fd  *feed.Feed
+	)
+	if *listen != "" {
+		fd = &feed.Feed{Logf: func(format string, args ...any) {
+			fmt.Fprintf(e.stderr, "goppy-play: events: "+format+"\n", args...)
+		}}
+		out = fd.Tap(sched)
+	}
+	p := controller.NewPlayer(out, m)
+	p.Bends.Rate = *bendRate
+	p.Arrange = strategy
+	p.Devices = devices
+	if *clockDev != "" {
+		in, err := e.openMIDI(*clockDev)
+		if err != nil {
+			fmt.Fprintln(e.stderr, "goppy-play: --clock:", err)
+			return exitNoDevice
+		}
+		defer in.Close()
+		cs := controller.NewClockSync(in)
+		p.Follow(cs)
+		clockCtx, stopClock := context.WithCancel(ctx)
+		following := make(chan struct{})
+		go func() {
+			defer close(following)
+			if err := cs.Run(clockCtx); err != nil && clockCtx.Err() == nil {
+				fmt.Fprintln(e.stderr, "goppy-play: --clock:", err)
+			}
+		}()
+		defer func() {
+			stopClock()
+			<-following
+		}()
+		fmt.Fprintf(e.stdout, "following the MIDI clock on %s: waiting for start\n", *clockDev)
+	}
+	var (
+		prog *progress
+		pl   *controller.Playlist
+		play func(ctx context.Context) error
+	)
+	if playlist {
+		pl = controller.NewPlaylistEntries(entries)
+		pl.Gap, pl.Rehome, pl.Repeat = *gap, *rehome, repeat
+		pl.Metronome = mt
+		pl.Shuffle, pl.Seed = *shuffle, *seed
+		pl.Load = func(song string) ([]controller.Event, error) {
+			events, err := read(song)
+			if err != nil {
+				return nil, err
+			}
+			events, a := controller.Arrange(events, m, strategy)
+			fmt.Fprintln(e.stdout, "out of range notes:", a)
+			events, th := controller.Thin(events, m)
+			if thins {
+				fmt.Fprintln(e.stdout, "thinned notes:", th)
+			}
+			events, va := controller.Allocate(events, m, voicing)
+			if voicing.Strategy != mapping.VoicesNone {
+				fmt.Fprintln(e.stdout, "voice allocation:", va)
+			}
+			return events, nil
+		}
+		pl.Started = func(song string, events []controller.Event) {
+			prog.done()
+			prog = newProgress(e.stdout, m, p)
+			p.Progress = prog.event
+			s := pl.State()
+			fmt.Fprintf(e.stdout, "playing %s, %s (%d of %d)\n", song, length(events), s.Position+1, s.Len)
+			p.Loop, _ = loopOf(events)
+			if p.Loop.On() {
+				fmt.Fprintln(e.stdout, "loop:", describeLoop(p.Loop))
+			}
+		}
+		pl.Skipped = func(song string, err error) {
+			prog.done()
+			prog = nil
+			fmt.Fprintf(e.stderr, "goppy-play: skipped %s: %v\n", song, err)
+		}
+		play = func(ctx context.Context) error {
+			err := pl.Play(ctx, p)
+			prog.done()
+			return err
+		}
+	}
+	// single readies one song to play, as the only one, entry 0, or one
+	// a play command names.
+	single := func(song string, entry int, events []controller.Event) func(ctx context.Context) error {
+		events, a := controller.Arrange(events, m, strategy)
+		fmt.Fprintln(e.stdout, "out of range notes:", a)
+		events, th := controller.Thin(events, m)
+		events, va := controller.Allocate(events, m, voicing)
+		if voicing.Strategy != mapping.VoicesNone {
+			fmt.Fprintln(e.stdout, "voice allocation:", va)
+		}
+		events = clicks(events, entry)
+		loop, _ := loopOf(events)
+		if loop.On() {
+			fmt.Fprintln(e.stdout, "loop:", describeLoop(loop))
+		}
+		return func(ctx context.Context) error {
+			prog = newProgress(e.stdout, m, p)
+			p.Progress, p.Loop = prog.event, loop
+			fmt.Fprintf(e.stdout, "playing %s, %s\n", song, length(events))
+			err := p.Play(ctx, events)
+			prog.done()
+			if thins {
+				fmt.Fprintln(e.stdout, "thinned notes:", th)
+			}
+			return err
+		}
+	}
+	if !playlist && !idle {
+		play = single(songs[0], 0, events)
+	}
+
+	sh := newShow(p, pl, m, *mapFile)
+	if *songDir != "" {
+		sh.load = func(name string) (func(ctx context.Context) error, error) {
+			events, err := read(filepath.Join(*songDir, name))
+			if err != nil {
+				return nil, err
+			}
+			return single(name, len(entries), events), nil
+		}
+	}
+	sh.sched, sh.found, sh.devices = sched, found, devices
+	if *listen != "" || mq.broker != "" {
+		go pollStatus(ctx, links)
+	}
+	sh.warn = func(err error) { fmt.Fprintln(e.stderr, "goppy-play: warning:", err) }
+	if idle {
+		sh.stopped = true
+	} else {
+		sh.song = songs[0]
+	}
+	if *keysLive {
+		var quit context.CancelFunc
+		ctx, quit = context.WithCancel(ctx)
+		defer quit()
+		restore, err := hotkeys(ctx, e, sh, quit)
+		if err != nil {
+			fmt.Fprintln(e.stderr, "goppy-play: --hotkeys needs a terminal:", err)
+			return exitError
+		}
+		defer restore()
+	}
+	showCtx, endShow := context.WithCancel(ctx)
+	defer endShow()
+	go sh.serve(showCtx)
+	if *listen != "" {
+		l, err := e.listen("tcp", *listen)
+		if err != nil {
+			fmt.Fprintln(e.stderr, "goppy-play: --listen:", err)
+			return exitError
+		}
+		fd.Transport = sh
+		go fd.Run(showCtx)
+		srv := &http.Server{Handler: (&api.Server{Transport: sh, Token: *token, Maps: *mapDir, Events: fd}).Handler()}
+		go srv.Serve(l)
+		defer srv.Close()
+		fmt.Fprintf(e.stdout, "API on http://%s, events on ws://%[1]s/events\n", l.Addr())
+	}
+	stopOSC := func() {}
+	if *oscAddr != "" {
+		if stopOSC, err = serveOSC(ctx, e, *oscAddr, out); err != nil {
+			fmt.Fprintln(e.stderr, "goppy-play: --osc:", err)
+			return exitError
+		}
+	}
+	stopMQTT := func() {}
+	if mq.broker != "" {
+		stopMQTT = serveMQTT(showCtx, e, sh, mq)
+	}
+	for {
+		if next := sh.takeCue(); next != nil {
+			play = next
+		}
+		if play != nil {
+			playCtx, cancel := context.WithCancel(ctx)
+			sh.begin(cancel)
+			err = play(playCtx)
+			cancel()
+			if ctx.Err() != nil {
+				break
+			}
+			if sh.cued() {
+				continue
+			}
+			if err == nil && mq.broker != "" {
+				// Stay up for the broker's next command.
+				sh.Do(api.Command{Op: api.OpStop})
+			}
+			if !sh.wasStopped() {
+				break
+			}
+		}
+		fmt.Fprintln(e.stdout, "stopped; drives silenced until a play command")
+		select {
+		case <-sh.restart:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	// Their note-offs go to the device, and the capture, before they
+	// close.
+	stopMQTT()
+	stopOSC()
+	sched.Close()
+	for _, l := range sched.Links() {
+		if th := l.Throttling; th.Delayed > 0 || th.Dropped > 0 {
+			fmt.Fprintf(e.stdout, "%s too slow: %s\n", l.Name, th)
+		}
+	}
+	if cerr := rec.close(); err == nil && cerr != nil {
+		err = fmt.Errorf("--record: %w", cerr)
+	}
+	return exit(e, err)
+}
+
+// exit reports how playing ended, with err, and returns the exit code.
+func exit(e env, err error) int {
+	switch {
+	case errors.Is(err, context.Canceled):
+		fmt.Fprintln(e.stderr, "goppy-play: interrupted; drives silenced")
+		return exitInterrupted
+	case err != nil:
+		fmt.Fprintln(e.stderr, "goppy-play:", err)
+		return exitError
+	}
+	return exitOK
+}
+
+// connect opens port, with "auto" the port of the first device a scan
+// finds, or with "udp" the multicast group. It returns nil and the exit
+// code if there is no device, or the device and the port's name.
+func connect(ctx context.Context, e env, port string, baud int, iface string) (*controller.Device, string, int) {
+	if port == "udp" || strings.HasPrefix(port, "udp:") {
+		group, udpPort := controller.DefaultGroup, controller.DefaultUDPPort
+		if rest, ok := strings.CutPrefix(port, "udp:"); ok {
+			host, p, err := net.SplitHostPort(rest)
+			n, perr := strconv.Atoi(p)
+			if err != nil || perr != nil || n <= 0 || n > 65535 {
+				fmt.Fprintf(e.stderr, "goppy-play: --port %s: want udp:GROUP:PORT\n", port)
+				return nil, "", exitUsage
+			}
+			group, udpPort = host, n
+		}
+		dev, err := e.openUDP(group, udpPort, controller.UDPOptions{Interface: iface})
+		if err != nil {
+			fmt.Fprintln(e.stderr, "goppy-play:", err)
+			return nil, "", exitNoDevice
+		}
+		return dev, fmt.Sprintf("udp:%s:%d", group, udpPort), exitOK
+	}
+	if port == "auto" {
+		found, err := e.scan(ctx, controller.ScanOptions{Bauds: []int{baud}})
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				return nil, "", exitInterrupted
+			}
+			fmt.Fprintln(e.stderr, "goppy-play: scan:", err)
+			return nil, "", exitNoDevice
+		}
+		port = ""
+		for _, f := range found {
+			if f.Err != nil {
+				fmt.Fprintf(e.stderr, "goppy-play: skipped %s: %v\n", f.Port, f.Err)
+			} else if port == "" {
+				port, baud = f.Port, f.Baud
+			}
+		}
+		if port == "" {
+			fmt.Fprintln(e.stderr, "goppy-play: no device found; plug one in, or give --port")
+			return nil, "", exitNoDevice
+		}
+		fmt.Fprintln(e.stdout, "found a device on", port)
+	}
+	dev, err := e.open(port, baud)
+	if err != nil {
+		fmt.Fprintln(e.stderr, "goppy-play:", err)
+		return nil, "", exitNoDevice
+	}
+	return dev, port, exitOK
+}
+
+// readSong reads a MIDI file: all of it, or with pattern above 0 only
+// that pattern of a format 2 file's.
+func readSong(song string, pattern int) ([]controller.Event, error) {
+	if pattern == 0 {
+		return controller.ReadSMF(song)
+	}
+	patterns, err := controller.ReadSMFPatterns(song)
+	if err != nil {
+		return nil, err
+	}
+	if pattern > len(patterns) {
+		return nil, fmt.Errorf("--pattern %d: %s has %d", pattern, song, len(patterns))
+	}
+	return patterns[pattern-1], nil
+}
+
+// retimes reports whether m quantises or humanises a channel.
+func retimes(m *mapping.Map) bool {
+	for _, c := range m.Channels {
+		if c.Quantise != (mapping.Quantise{}) || c.Humanise > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// legacy says so if d answered as Moppy's firmware does, taking none of
+// goppy's optional commands.
+func legacy(e env, d controller.DeviceInfo) {
+	if d.Caps == controller.LegacyCapabilities {
+		fmt.Fprintf(e.stdout, "device 0x%02X answered as Moppy's firmware does: sending it only Moppy's commands\n", d.Address)
+	}
+}
+
+// adjust transposes the song's notes, scales its tempo and drops notes
+// struck softer than minVelocity.
+func adjust(events []controller.Event, transpose int, tempo float64, minVelocity byte) []controller.Event {
+	out := events[:0]
+	for _, ev := range events {
+		ev.At = time.Duration(float64(ev.At) / tempo)
+		switch ev.Kind {
+		case controller.NoteOn, controller.NoteOff:
+			n := int(ev.Note) + transpose
+			if n < 0 || n > 127 {
+				continue
+			}
+			ev.Note = byte(n)
+			if ev.Kind == controller.NoteOn && ev.Value < minVelocity {
+				continue
+			}
+		case controller.Tempo:
+			ev.Tempo = uint32(float64(ev.Tempo) / tempo)
+		}
+		out = append(out, ev)
+	}
+	return out
+}
+
+// parseLoop reads --loop: markers, FIRST-LAST, or none. It returns what
+// finds a song's Loop, or false for none.
+func parseLoop(s string) (func([]controller.Event) (controller.Loop, bool), error) {
+	switch s {
+	case "none":
+		return func([]controller.Event) (controller.Loop, bool) { return controller.Loop{}, false }, nil
+	case "markers":
+		return controller.LoopMarkers, nil
+	}
+	a, b, ok := strings.Cut(s, "-")
+	first, ferr := strconv.Atoi(a)
+	last, lerr := strconv.Atoi(b)
+	if !ok || ferr != nil || lerr != nil || first < 1 || last < first {
+		return nil, fmt.Errorf("%q: want markers, bars FIRST-LAST from 1, or none", s)
+	}
+	return func(events []controller.Event) (controller.Loop, bool) {
+		return controller.LoopBars(events, first, last), true
+	}, nil
+}
+
+// describeLoop says where l is and how often it plays.
+func describeLoop(l controller.Loop) string {
+	s := fmt.Sprintf("%s to %s", l.Start.Round(time.Millisecond), l.End.Round(time.Millisecond))
+	if l.Count == 0 {
+		s += ", until stopped"
+	} else {
+		s += fmt.Sprintf(", %d times", l.Count)
+	}
+	if l.Gap > 0 {
+		s += fmt.Sprintf(", %s apart", l.Gap)
+	}
+	return s
+}
+
+func length(events []controller.Event) time.Duration {
+	if len(events) == 0 {
+		return 0
+	}
+	return events[len(events)-1].At.Round(time.Millisecond)
+}
+
+// summarise prints what --dry-run found in the song.
+func summarise(w io.Writer, song string, events []controller.Event, mp *mapping.Map) {
+	var notes, unmapped [16]int
+	m := newMeter()
+	for _, ev := range events {
+		m.advance(ev)
+		if ev.Kind == controller.NoteOn {
+			notes[ev.Channel]++
+			if mp != nil && mp.Drums(ev.Channel) {
+				if _, ok := mp.Percussion.Hit(ev.Note); !ok {
+					unmapped[ev.Channel]++
+				}
+			}
+		}
+	}
+	fmt.Fprintf(w, "%s: %d events, %s, %d bars\n", song, len(events), length(events), m.bar+1)
+	for ch, n := range notes {
+		if n == 0 {
+			continue
+		}
+		target := "one drive per channel"
+		if mp != nil {
+			target = describe(mp, byte(ch))
+		}
+		if unmapped[ch] > 0 {
+			target += fmt.Sprintf(", %d with no drum, dropped", unmapped[ch])
+		}
+		fmt.Fprintf(w, "  channel %2d: %5d notes, %s\n", ch+1, n, target)
+	}
+}
+
+// describe says where mp sends channel's notes.
+func describe(mp *mapping.Map, channel byte) string {
+	c := mp.Channels[channel]
+	switch {
+	case mp.Drums(channel):
+		return fmt.Sprintf("percussion, %d kit drums and %d hits", len(mp.Percussion.Kit), len(mp.Percussion.Hits))
+	case c.Ignore:
+		return "ignored"
+	case !c.Mapped():
+		return "not mapped"
+	case len(c.Stripe) > 0:
+		pools := make([]string, len(c.Stripe))
+		for i, p := range c.Stripe {
+			pools[i] = p.String()
+		}
+		return fmt.Sprintf("stripe %s, %s", strings.Join(pools, ", "), c.Balance)
+	case c.Pool != (mapping.Pool{}):
+		return "pool " + c.Pool.String()
+	}
+	return c.Target.String()
+}
+
+// meter follows a song's bars and beats through its tempo changes and
+// time signatures.
+type meter struct {
+	at    time.Duration
+	tempo float64 // microseconds per quarter note
+	num   int
+	den   int
+	beat  float64 // beats into the bar
+	bar   int     // from 0
+}
+
+func newMeter() *meter {
+	return &meter{tempo: 500000, num: 4, den: 4}
+}
+
+// advance moves the meter on to ev, and applies it if it is a tempo
+// change or time signature.
+func (m *meter) advance(ev controller.Event) {
+	beatUs := m.tempo * 4 / float64(m.den)
+	m.beat += float64((ev.At - m.at).Microseconds()) / beatUs
+	m.at = ev.At
+	for m.beat >= float64(m.num)-1e-6 {
+		m.beat -= float64(m.num)
+		m.bar++
+	}
+	m.beat = max(m.beat, 0)
+	switch ev.Kind {
+	case controller.Tempo:
+		if ev.Tempo > 0 {
+			m.tempo = float64(ev.Tempo)
+		}
+	case controller.Meter:
+		if ev.Note > 0 && ev.Value > 0 {
+			m.num, m.den = int(ev.Note), int(ev.Value)
+		}
+	}
+}
+
+// position is bar:beat, from 1:1.
+func (m *meter) position() string {
+	return fmt.Sprintf("%d:%d", m.bar+1, int(m.beat)+1)
+}
+
+// progress prints the song's bar and beat, or the count-in's click,
+// and what each mapped channel is sounding, M after it if muted and S if
+// soloed, on one line rewritten as the song plays; and the devices muted
+// or soloed, and the player's tempo and transpose once moved from the
+// song's.
+type progress struct {
+	w        io.Writer
+	player   *controller.Player
+	meter    *meter
+	channels []byte
+	devices  []byte
+	held     [16]int
+	counted  int // clicks of the count-in
+	last     string
+}
+
+func newProgress(w io.Writer, m *mapping.Map, player *controller.Player) *progress {
+	p := &progress{w: w, player: player, meter: newMeter()}
+	for ch, c := range m.Channels {
+		if c.Mapped() || m.Drums(byte(ch)) {
+			p.channels = append(p.channels, byte(ch))
+		}
+	}
+	p.devices = m.Devices()
+	return p
+}
+
+func (p *progress) event(ev controller.Event) {
+	if ev.At < 0 {
+		if ev.Kind == controller.Click {
+			p.counted++
+			p.show(fmt.Sprintf("count-in %d", p.counted))
+		}
+		return
+	}
+	p.meter.advance(ev)
+	switch ev.Kind {
+	case controller.NoteOn:
+		p.held[ev.Channel]++
+	case controller.NoteOff:
+		p.held[ev.Channel] = max(p.held[ev.Channel]-1, 0)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "bar %-7s", p.meter.position())
+	for _, ch := range p.channels {
+		fmt.Fprintf(&b, " %d", ch+1)
+		if p.player.Muted(ch) {
+			b.WriteString("M")
+		}
+		if p.player.Soloed(ch) {
+			b.WriteString("S")
+		}
+		if p.held[ch] > 0 && !p.player.Silenced(ch) {
+			b.WriteString("♪")
+		} else {
+			b.WriteString("·")
+		}
+	}
+	var muted, soloed []string
+	for _, d := range p.devices {
+		if p.player.DeviceMuted(d) {
+			muted = append(muted, fmt.Sprintf("0x%02X", d))
+		}
+		if p.player.DeviceSoloed(d) {
+			soloed = append(soloed, fmt.Sprintf("0x%02X", d))
+		}
+	}
+	if len(muted) > 0 {
+		fmt.Fprintf(&b, "  muted %s", strings.Join(muted, " "))
+	}
+	if len(soloed) > 0 {
+		fmt.Fprintf(&b, "  soloed %s", strings.Join(soloed, " "))
+	}
+	if t := p.player.Tempo(); t != 100 {
+		fmt.Fprintf(&b, "  tempo %d%%", t)
+	}
+	if n := p.player.Transposed(); n != 0 {
+		fmt.Fprintf(&b, "  transposed %+d", n)
+	}
+	p.show(b.String())
+}
+
+// show rewrites the line as line, if it has changed.
+func (p *progress) show(line string) {
+	if line != p.last {
+		fmt.Fprint(p.w, "\r"+line)
+		p.last = line
+	}
+}
+
+func (p *progress) done() {
+	if p != nil && p.last != "" {
+		fmt.Fprintln(p.w)
+	}
+}
@@ -0,0 +1,1289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller"
+	"github.com/ystepanoff/goppy/controller/mapping"
+	"github.com/ystepanoff/goppy/controller/osc"
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+	"github.com/ystepanoff/goppy/internal/mqtttest"
+	"github.com/ystepanoff/goppy/internal/wstest"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden dry-run log in testdata")
+
+const (
+	shortSong = "../../controller/testdata/format0.mid" // 1.25s on channels 1 and 10
+	longSong  = "../../controller/testdata/format1.mid" // 1.5s on channels 1 and 2
+)
+
+// memDevice is a device on the far end of an in-memory port: it answers
+// pings with its pong and records every other message it is sent.
+type memDevice struct {
+	conn net.Conn
+	pong protocol.Message
+	done chan struct{}
+
+	mu   sync.Mutex
+	got  []protocol.Message
+	seen func(protocol.Message) // called with each message recorded
+}
+
+// newMemDevice returns a memDevice answering pings as goppy firmware
+// does, taking every optional command.
+func newMemDevice() (*memDevice, *controller.Device) {
+	return newMemDeviceAnswering(protocol.PongCaps(0x01, 1, 8, uint16(controller.AllCapabilities)))
+}
+
+// newMemDeviceAnswering returns a memDevice answering pings with pong.
+func newMemDeviceAnswering(pong protocol.Message) (*memDevice, *controller.Device) {
+	host, far := net.Pipe()
+	d := &memDevice{conn: far, pong: pong, done: make(chan struct{})}
+	go d.serve()
+	return d, controller.New(host)
+}
+
+func (d *memDevice) serve() {
+	defer close(d.done)
+	var pending []byte
+	buf := make([]byte, 64)
+	for {
+		n, err := d.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		pending = append(pending, buf[:n]...)
+		for {
+			m, used, err := protocol.Decode(pending)
+			if errors.Is(err, protocol.ErrIncomplete) {
+				break
+			}
+			pending = pending[used:]
+			if err != nil {
+				continue
+			}
+			if m.Device == config.SystemAddress && m.Command == config.CmdPing {
+				frame := make([]byte, d.pong.Len())
+				d.pong.Encode(frame)
+				d.conn.Write(frame)
+				continue
+			}
+			if m.Device == config.SystemAddress && m.Command == config.CmdGetStatus {
+				// Up 42s, playing on drive 1.
+				st := protocol.Status(d.pong.Payload[0], 42, 1, 0b1, config.SequencePlaying, config.FaultNone)
+				frame := make([]byte, st.Len())
+				st.Encode(frame)
+				d.conn.Write(frame)
+				continue
+			}
+			m.Payload = bytes.Clone(m.Payload)
+			d.mu.Lock()
+			d.got = append(d.got, m)
+			seen := d.seen
+			d.mu.Unlock()
+			if seen != nil {
+				seen(m)
+			}
+		}
+	}
+}
+
+// messages waits for the port to close and returns what the device got.
+func (d *memDevice) messages() []protocol.Message {
+	<-d.done
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.got
+}
+
+// harness runs goppy-play against a memDevice found by a scan on
+// /dev/ttyUSB0, or opened by name.
+type harness struct {
+	dev    *memDevice
+	scans  []controller.ScanOptions
+	opened []string
+	udp    []string // group:port%iface of each OpenUDP
+	stdout syncBuffer
+	stderr syncBuffer
+	found  []controller.FoundDevice
+	keys   string // what the terminal types, for --keyboard
+	tty    []string
+	osc    chan string // the address --osc listens on
+	broker *mqtttest.Broker
+	dialed []string
+	sync   map[string]protocol.Message // the pong of the device on each --sync port
+	extra  map[string]*memDevice       // the devices opened on them
+	clock  chan []byte                 // what the --clock device sends
+}
+
+// clockInput is the --clock device, sending what the test puts on a
+// harness's clock.
+type clockInput struct{ messages chan []byte }
+
+func (in clockInput) Messages() <-chan []byte { return in.messages }
+func (in clockInput) Err() error              { return nil }
+func (in clockInput) Close() error            { return nil }
+
+// syncBuffer is a bytes.Buffer for goroutines of run's to write to at
+// once.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func newHarness() *harness {
+	return &harness{osc: make(chan string, 1), found: []controller.FoundDevice{
+		{Port: "/dev/ttyUSB1", Err: errors.New("busy")},
+		{Port: "/dev/ttyUSB0", Baud: 57600, DeviceInfo: controller.DeviceInfo{Address: 0x01, FirstDrive: 1, LastDrive: 8}},
+	}}
+}
+
+func (h *harness) run(ctx context.Context, args ...string) int {
+	h.dev, h.extra = nil, map[string]*memDevice{}
+	return run(ctx, args, env{
+		stdout: &h.stdout,
+		stderr: &h.stderr,
+		stdin:  strings.NewReader(h.keys),
+		rawTerminal: func() (func() error, error) {
+			h.tty = append(h.tty, "raw")
+			return func() error {
+				h.tty = append(h.tty, "restored")
+				return nil
+			}, nil
+		},
+		scan: func(_ context.Context, opts controller.ScanOptions) ([]controller.FoundDevice, error) {
+			h.scans = append(h.scans, opts)
+			return h.found, nil
+		},
+		open: func(port string, baud int) (*controller.Device, error) {
+			h.opened = append(h.opened, port)
+			if pong, ok := h.sync[port]; ok {
+				var d *controller.Device
+				h.extra[port], d = newMemDeviceAnswering(pong)
+				return d, nil
+			}
+			if h.dev != nil {
+				return nil, errors.New("opened twice")
+			}
+			var d *controller.Device
+			h.dev, d = newMemDevice()
+			return d, nil
+		},
+		openUDP: func(group string, port int, opts controller.UDPOptions) (*controller.Device, error) {
+			h.udp = append(h.udp, fmt.Sprintf("%s:%d%%%s", group, port, opts.Interface))
+			var d *controller.Device
+			h.dev, d = newMemDevice()
+			return d, nil
+		},
+		listenPacket: func(network, _ string) (net.PacketConn, error) {
+			conn, err := net.ListenPacket(network, "127.0.0.1:0")
+			if err == nil {
+				h.osc <- conn.LocalAddr().String()
+			}
+			return conn, err
+		},
+		dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			h.dialed = append(h.dialed, network+" "+address)
+			if h.broker == nil {
+				return nil, errors.New("no broker")
+			}
+			return h.broker.Dial(ctx)
+		},
+		openMIDI: func(path string) (controller.MIDIIn, error) {
+			if h.clock == nil {
+				return nil, fmt.Errorf("open %s: no such device", path)
+			}
+			return clockInput{h.clock}, nil
+		},
+	})
+}
+
+func checkMessages(t *testing.T, got, want []protocol.Message) {
+	t.Helper()
+	same := func(a, b protocol.Message) bool {
+		return a.Device == b.Device && a.Sub == b.Sub && a.Command == b.Command && slices.Equal(a.Payload, b.Payload)
+	}
+	if !slices.EqualFunc(got, want, same) {
+		t.Errorf("device got\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestFlags(t *testing.T) {
+	h := newHarness()
+	code := h.run(context.Background(), shortSong, "--transpose", "2", "--tempo", "10", "--min-velocity", "90", "--baud", "115200")
+	if code != exitOK {
+		t.Fatalf("exit %d: %s", code, h.stderr.String())
+	}
+	if len(h.scans) != 1 || !slices.Equal(h.scans[0].Bauds, []int{115200}) {
+		t.Errorf("scanned with %+v, want one scan at 115200", h.scans)
+	}
+	if !slices.Equal(h.opened, []string{"/dev/ttyUSB0"}) {
+		t.Errorf("opened %v, want the port the scan found", h.opened)
+	}
+	checkMessages(t, h.dev.messages(), []protocol.Message{
+		protocol.SequenceStart(),
+		protocol.NoteOnVelocity(0x01, 1, 62, 100), // 60 up two
+		protocol.NoteOff(0x01, 1, 62),
+		protocol.PitchBend(0x01, 1, 0x1000),
+		// The note at velocity 80 is dropped, and so its note-off.
+		protocol.PitchBend(0x01, 1, 0),
+		protocol.SequenceStop(),
+	})
+}
+
+// TestCountIn counts the song in with four clicks where the mapping's
+// metronome says, the first accented, before its first note; and wants a
+// mapping saying where the clicks go.
+func TestCountIn(t *testing.T) {
+	mapFile := filepath.Join(t.TempDir(), "mapping.yaml")
+	rig := "channels:\n  1: 0x01/1\nmetronome:\n  click: 0x01/8 note 90\n  accent: 0x01/8 note 96\n"
+	if err := os.WriteFile(mapFile, []byte(rig), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := newHarness()
+	if code := h.run(context.Background(), "--map", mapFile, "--count-in", "4", "--tempo", "10", shortSong); code != exitOK {
+		t.Fatalf("exit %d: %s", code, h.stderr.String())
+	}
+	want := []protocol.Message{protocol.SequenceStart()}
+	for i, note := range []byte{96, 90, 90, 90} {
+		velocity := byte(96)
+		if i == 0 {
+			velocity = 127
+		}
+		want = append(want, protocol.NoteOnVelocity(0x01, 8, note, velocity), protocol.NoteOff(0x01, 8, note))
+	}
+	want = append(want,
+		protocol.NoteOnVelocity(0x01, 1, 60, 100),
+		protocol.NoteOff(0x01, 1, 60),
+		protocol.PitchBend(0x01, 1, 0x1000),
+		protocol.NoteOnVelocity(0x01, 1, 62, 80),
+		protocol.PitchBend(0x01, 1, 0),
+		protocol.NoteOff(0x01, 1, 62),
+		protocol.SequenceStop(),
+	)
+	checkMessages(t, h.dev.messages(), want)
+	if !strings.Contains(h.stdout.String(), "\rcount-in 4\rbar 1:1") {
+		t.Errorf("printed\n%q\nwant the count-in counted before bar 1", h.stdout.String())
+	}
+
+	noClicks := filepath.Join(t.TempDir(), "mapping.yaml")
+	if err := os.WriteFile(noClicks, []byte("channels:\n  1: 0x01/1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"--count-in", "2", shortSong},
+		{"--map", noClicks, "--metronome", "beats", shortSong},
+		{"--map", mapFile, "--metronome", "bars", shortSong},
+		{"--map", mapFile, "--count-in", "-1", shortSong},
+	} {
+		h = newHarness()
+		if code := h.run(context.Background(), args...); code != exitUsage {
+			t.Errorf("%q: exit %d, want %d", args, code, exitUsage)
+		}
+	}
+}
+
+// TestMoppyFirmware plays on a device answering as Moppy's firmware does,
+// which takes no velocity.
+func TestMoppyFirmware(t *testing.T) {
+	h := newHarness()
+	h.sync = map[string]protocol.Message{"/dev/ttyUSB0": protocol.Pong(0x01, 1, 8)}
+	if code := h.run(context.Background(), "--tempo", "10", shortSong); code != exitOK {
+		t.Fatalf("exit %d: %s", code, h.stderr.String())
+	}
+	if want := "device 0x01 answered as Moppy's firmware does: sending it only Moppy's commands\n"; !strings.Contains(h.stdout.String(), want) {
+		t.Errorf("printed\n%s\nwant %q", h.stdout.String(), want)
+	}
+	checkMessages(t, h.extra["/dev/ttyUSB0"].messages(), []protocol.Message{
+		protocol.SequenceStart(),
+		protocol.NoteOn(0x01, 1, 60),
+		protocol.NoteOff(0x01, 1, 60),
+		protocol.PitchBend(0x01, 1, 0x1000),
+		protocol.NoteOn(0x01, 1, 62),
+		protocol.PitchBend(0x01, 1, 0),
+		protocol.NoteOff(0x01, 1, 62),
+		protocol.SequenceStop(),
+	})
+}
+
+// TestClock plays along with a MIDI clock: nothing until its start, then
+// the song as the clocks come, its 1.25s two and a half quarter notes at
+// 120 BPM, whatever --tempo says.
+func TestClock(t *testing.T) {
+	h := newHarness()
+	h.clock = make(chan []byte)
+	exit := make(chan int, 1)
+	go func() {
+		exit <- h.run(context.Background(), "--clock", "/dev/snd/midiC1D0", "--tempo", "10", shortSong)
+	}()
+	send := func(msg ...byte) {
+		select {
+		case h.clock <- msg:
+		case code := <-exit:
+			t.Fatalf("exit %d before % X: %s", code, msg, h.stderr.String())
+		}
+	}
+	send(0xF8) // before the start: ignored
+	send(0xFA)
+	code := -1
+	for n := 0; code < 0; n++ {
+		if n > 3*controller.ClocksPerQuarter {
+			t.Fatal("still playing after the song's clocks")
+		}
+		select {
+		case h.clock <- []byte{0xF8}:
+			time.Sleep(time.Millisecond)
+		case code = <-exit:
+			if n < 5*controller.ClocksPerQuarter/2 {
+				t.Errorf("ended %d clocks in, want 60", n)
+			}
+		}
+	}
+	if code != exitOK {
+		t.Fatalf("exit %d: %s", code, h.stderr.String())
+	}
+	if want := "following the MIDI clock on /dev/snd/midiC1D0: waiting for start\n"; !strings.Contains(h.stdout.String(), want) {
+		t.Errorf("printed\n%s\nwant %q", h.stdout.String(), want)
+	}
+	checkMessages(t, h.dev.messages(), []protocol.Message{
+		protocol.SequenceStart(),
+		protocol.NoteOnVelocity(0x01, 1, 60, 100),
+		protocol.NoteOff(0x01, 1, 60),
+		protocol.PitchBend(0x01, 1, 0x1000),
+		protocol.NoteOnVelocity(0x01, 1, 62, 80),
+		protocol.PitchBend(0x01, 1, 0),
+		protocol.NoteOff(0x01, 1, 62),
+		protocol.SequenceStop(),
+	})
+
+	h = newHarness()
+	if code := h.run(context.Background(), "--clock", "/dev/snd/midiC1D0", shortSong); code != exitNoDevice {
+		t.Errorf("with no clock device: exit %d, want %d", code, exitNoDevice)
+	}
+}
+
+func TestMapFile(t *testing.T) {
+	mapFile := filepath.Join(t.TempDir(), "mapping.yaml")
+	if err := os.WriteFile(mapFile, []byte("channels:\n  1: 0x02/5 # lead\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := newHarness()
+	code := h.run(context.Background(), "--port", "/dev/ttyACM3", "--map", mapFile, "--tempo", "10", shortSong)
+	if code != exitOK {
+		t.Fatalf("exit %d: %s", code, h.stderr.String())
+	}
+	if len(h.scans) != 0 || !slices.Equal(h.opened, []string{"/dev/ttyACM3"}) {
+		t.Errorf("scanned %d times and opened %v, want /dev/ttyACM3 opened directly", len(h.scans), h.opened)
+	}
+	checkMessages(t, h.dev.messages(), []protocol.Message{
+		protocol.SequenceStart(),
+		protocol.NoteOnVelocity(0x02, 5, 60, 100),
+		protocol.NoteOff(0x02, 5, 60),
+		protocol.PitchBend(0x02, 5, 0x1000),
+		protocol.NoteOnVelocity(0x02, 5, 62, 80),
+		protocol.PitchBend(0x02, 5, 0),
+		protocol.NoteOff(0x02, 5, 62),
+		protocol.SequenceStop(),
+	})
+}
+
+func TestExitCodes(t *testing.T) {
+	badMap := filepath.Join(t.TempDir(), "bad.yaml")
+	if err := os.WriteFile(badMap, []byte("channels:\n  17: 1/1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	notMIDI := filepath.Join(t.TempDir(), "song.mid")
+	if err := os.WriteFile(notMIDI, []byte("RIFF"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		args    []string
+		nothing bool // no devices to find
+		want    int
+	}{
+		{"no song", nil, false, exitUsage},
+		{"bad flag", []string{"--loud", shortSong}, false, exitUsage},
+		{"bad tempo", []string{"--tempo", "0", shortSong}, false, exitUsage},
+		{"missing song", []string{"nosuch.mid"}, false, exitFile},
+		{"not a song", []string{notMIDI}, false, exitFile},
+		{"missing mapping", []string{"--map", "nosuch.yaml", shortSong}, false, exitFile},
+		{"bad mapping", []string{"--map", badMap, shortSong}, false, exitFile},
+		{"no device", []string{shortSong}, true, exitNoDevice},
+		{"dry run", []string{"--dry-run", shortSong}, true, exitOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness()
+			if tt.nothing {
+				h.found = h.found[:1] // only the busy port
+			}
+			if got := h.run(context.Background(), tt.args...); got != tt.want {
+				t.Errorf("exit %d, want %d; stderr: %s", got, tt.want, h.stderr.String())
+			}
+			if tt.want != exitOK && len(h.opened) != 0 {
+				t.Errorf("opened %v", h.opened)
+			}
+		})
+	}
+}
+
+// TestDryRun prints what a song holds and the frames playing it sends,
+// decoded, against testdata/dry-run.log; rewrite it with
+//
+//	go test -run TestDryRun -update
+func TestDryRun(t *testing.T) {
+	h := newHarness()
+	if code := h.run(context.Background(), "--dry-run", "--bend-rate", "0", longSong, shortSong); code != exitOK {
+		t.Fatalf("exit %d: %s", code, h.stderr.String())
+	}
+	if len(h.scans)+len(h.opened) != 0 {
+		t.Error("a dry run looked for a device")
+	}
+	const golden = "testdata/dry-run.log"
+	if *update {
+		if err := os.WriteFile(golden, []byte(h.stdout.String()), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	} else if want, err := os.ReadFile(golden); err != nil {
+		t.Fatal(err)
+	} else if got := h.stdout.String(); got != string(want) {
+		t.Errorf("printed\n%s\nwant, as %s\n%s", got, golden, want)
+	}
+
+	// Filtered, as JSON lines.
+	h = newHarness()
+	if code := h.run(context.Background(), "--dry-run", "--log-json", "--log-device", "0x01", "--log-command", "pitch-bend", shortSong); code != exitOK {
+		t.Fatalf("--log-json: exit %d: %s", code, h.stderr.String())
+	}
+	var lines []string
+	for _, line := range strings.Split(h.stdout.String(), "\n") {
+		if strings.HasPrefix(line, "{") {
+			lines = append(lines, line)
+		}
+	}
+	want := []string{
+		`{"at_ms":500,"device":"0x01","target":"drive 1","command":"pitch bend","detail":"+100 cents (+4096)","frame":"4d 01 01 03 0e 10 00"}`,
+		`{"at_ms":1000,"device":"0x01","target":"drive 1","command":"pitch bend","detail":"+0 cents (+0)","frame":"4d 01 01 03 0e 00 00"}`,
+	}
+	if !slices.Equal(lines, want) {
+		t.Errorf("JSON lines\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+	for _, args := range [][]string{
+		{"--dry-run", "--log-command", "note-up", shortSong},
+		{"--dry-run", "--log-device", "one", shortSong},
+		{"--log-json", shortSong},
+	} {
+		h = newHarness()
+		if code := h.run(context.Background(), args...); code != exitUsage {
+			t.Errorf("%q: exit %d, want %d", args, code, exitUsage)
+		}
+	}
+
+	mapFile := filepath.Join(t.TempDir(), "mapping.yaml")
+	if err := os.WriteFile(mapFile, []byte("channels:\n  1:\n    stripe: 1/1-8, 2/1-8, 3/1\n    balance: least-busy\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h = newHarness()
+	if code := h.run(context.Background(), "--dry-run", "--map", mapFile, longSong); code != exitOK {
+		t.Fatalf("exit %d: %s", code, h.stderr.String())
+	}
+	if want := "  channel  1:     2 notes, stripe 0x01/1-8, 0x02/1-8, 0x03/1-1, least-busy\n"; !strings.Contains(h.stdout.String(), want) {
+		t.Errorf("printed\n%s\nwant\n%s", h.stdout.String(), want)
+	}
+}
+
+// TestInterrupt stops the song once the device has its first note, as
+// Ctrl-C does: the drives must be silenced and the sequence stopped.
+func TestInterrupt(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := newHarness()
+	code := run(ctx, []string{longSong}, env{
+		stdout: &h.stdout,
+		stderr: &h.stderr,
+		scan: func(context.Context, controller.ScanOptions) ([]controller.FoundDevice, error) {
+			return h.found, nil
+		},
+		open: func(string, int) (*controller.Device, error) {
+			var d *controller.Device
+			h.dev, d = newMemDevice()
+			h.dev.seen = func(m protocol.Message) {
+				if m.Command == config.DevCmdNoteOn {
+					cancel()
+				}
+			}
+			return d, nil
+		},
+	})
+	if code != exitInterrupted {
+		t.Fatalf("exit %d, want %d: %s", code, exitInterrupted, h.stderr.String())
+	}
+	checkMessages(t, h.dev.messages(), []protocol.Message{
+		protocol.SequenceStart(),
+		protocol.NoteOnVelocity(0x01, 1, 60, 100),
+		protocol.NoteOff(0x01, 1, 60),
+		protocol.AllNotesOff(0x01),
+		protocol.SequenceStop(),
+	})
+}
+
+// dryRunFrame matches a line of the log --dry-run prints after a song's
+// summary.
+var dryRunFrame = regexp.MustCompile(`(?m)^ +\d+\.\d{3}ms  0x.*\n`)
+
+// summary returns what --dry-run printed, out, but its log of frames.
+func summary(out string) string {
+	return dryRunFrame.ReplaceAllString(out, "")
+}
+
+func TestArrange(t *testing.T) {
+	const song = "../../controller/testdata/arrange/basspiccolo.mid"
+	mapFile := filepath.Join(t.TempDir(), "mapping.yaml")
+	if err := os.WriteFile(mapFile, []byte("defaults:\n  arrange: shift\nchannels:\n  1: 1/1\n  2: 1/2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--arrange", "fold"}, "out of range notes: fold: 10 notes, 8 moved, 0 dropped\n"},
+		{[]string{"--map", mapFile}, "out of range notes: shift: 10 notes, 10 moved, 0 dropped, song shifted +8, 5 still out of range\n"},
+		{[]string{"--map", mapFile, "--arrange", "drop"}, "out of range notes: drop: 10 notes, 0 moved, 8 dropped\n"},
+	}
+	for _, tt := range tests {
+		h := newHarness()
+		if code := h.run(context.Background(), append(tt.args, "--dry-run", song)...); code != exitOK {
+			t.Fatalf("%v: exit %d: %s", tt.args, code, h.stderr.String())
+		}
+		if got := summary(h.stdout.String()); !strings.HasSuffix(got, tt.want) {
+			t.Errorf("%v printed\n%s\nwant it to end\n%s", tt.args, got, tt.want)
+		}
+	}
+	h := newHarness()
+	if code := h.run(context.Background(), "--arrange", "squash", song); code != exitUsage {
+		t.Errorf("--arrange squash: exit %d, want %d", code, exitUsage)
+	}
+}
+
+func TestThin(t *testing.T) {
+	const song = "../../controller/testdata/thin/chords.mid"
+	h := newHarness()
+	if code := h.run(context.Background(), "--dry-run", "--max-notes", "2", "--min-length", "50ms", song); code != exitOK {
+		t.Fatalf("exit %d: %s", code, h.stderr.String())
+	}
+	want := "thinned notes: 17 notes, 0 softer than min-velocity, 1 shorter than min-length, 9 over max-notes\n"
+	if got := summary(h.stdout.String()); !strings.HasSuffix(got, want) {
+		t.Errorf("printed\n%s\nwant it to end\n%s", got, want)
+	}
+	h = newHarness()
+	if code := h.run(context.Background(), "--dry-run", song); code != exitOK || strings.Contains(h.stdout.String(), "thinned") {
+		t.Errorf("without thinning: exit %d, printed\n%s", code, h.stdout.String())
+	}
+	h = newHarness()
+	if code := h.run(context.Background(), "--max-notes", "-1", song); code != exitUsage {
+		t.Errorf("--max-notes -1: exit %d, want %d", code, exitUsage)
+	}
+}
+
+// TestRetime dry-runs a song its mapping quantises and humanises: the
+// same --seed logs the same frames, and another seed others.
+func TestRetime(t *testing.T) {
+	const song = "../../controller/testdata/thin/chords.mid"
+	mapFile := filepath.Join(t.TempDir(), "mapping.yaml")
+	if err := os.WriteFile(mapFile, []byte("channels:\n  1:\n    target: 1/1\n    quantise: 1/4 50%\n    humanise: 10ms\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	run := func(seed string) string {
+		t.Helper()
+		h := newHarness()
+		if code := h.run(context.Background(), "--dry-run", "--map", mapFile, "--seed", seed, song); code != exitOK {
+			t.Fatalf("exit %d: %s", code, h.stderr.String())
+		}
+		return h.stdout.String()
+	}
+	first := run("5")
+	if !strings.Contains(first, "retimed notes: 17 notes, 5 quantised, ") {
+		t.Errorf("printed\n%s\nwant the retiming of 17 notes, 5 off the beat", first)
+	}
+	if again := run("5"); again != first {
+		t.Errorf("the same seed printed\n%s\nthen\n%s", first, again)
+	}
+	if other := run("6"); other == first {
+		t.Error("another seed printed the same")
+	}
+}
+
+func TestPattern(t *testing.T) {
+	const song = "../../internal/smf/testdata/format2.mid" // three patterns of two notes
+	h := newHarness()
+	if code := h.run(context.Background(), "--dry-run", "--pattern", "2", song); code != exitOK {
+		t.Fatalf("exit %d: %s", code, h.stderr.String())
+	}
+	if out := h.stdout.String(); !strings.Contains(out, "4 events, 1.5s") || strings.Count(out, "note on") != 2 {
+		t.Errorf("printed\n%s\nwant the second pattern's two notes", out)
+	}
+	h = newHarness()
+	if code := h.run(context.Background(), "--dry-run", "--pattern", "4", song); code != exitFile || !strings.Contains(h.stderr.String(), "has 3") {
+		t.Errorf("--pattern 4 of 3: exit %d, %s", code, h.stderr.String())
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	const song = "../../controller/testdata/voices/sixteen.mid"
+	mapFile := filepath.Join(t.TempDir(), "mapping.yaml")
+	rig := "defaults:\n  device: 1\n  allocate: first\nchannels:\n  1:\n    pool: 1-4\n  2:\n    pool: 5-8\n  3:\n    pool: 9-12\n  4:\n    pool: 13-16\n    priority: 1\nvoices:\n  1: 6\n"
+	if err := os.WriteFile(mapFile, []byte(rig), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--map", mapFile}, "voice allocation: first: 88 notes, 40 (channel 1: 16, 2: 8, 3: 16) dropped, 0 stolen\n"},
+		{[]string{"--map", mapFile, "--allocate", "outer", "--min-hold", "100ms"}, "voice allocation: outer: 88 notes, 41 (channel 1: 18, 2: 7, 3: 16) dropped, 1 (channel 2: 1) stolen\n"},
+		{[]string{"--map", mapFile, "--voices", "16"}, "voice allocation: first: 88 notes, 0 dropped, 0 stolen\n"},
+	}
+	for _, tt := range tests {
+		h := newHarness()
+		if code := h.run(context.Background(), append(tt.args, "--dry-run", song)...); code != exitOK {
+			t.Fatalf("%v: exit %d: %s", tt.args, code, h.stderr.String())
+		}
+		if got := summary(h.stdout.String()); !strings.HasSuffix(got, tt.want) {
+			t.Errorf("%v printed\n%s\nwant it to end\n%s", tt.args, got, tt.want)
+		}
+	}
+	h := newHarness()
+	if code := h.run(context.Background(), "--allocate", "loudest", song); code != exitUsage {
+		t.Errorf("--allocate loudest: exit %d, want %d", code, exitUsage)
+	}
+}
+
+// TestLoop plays the loop between the song's markers twice, and bars 1-1
+// with a gap in a dry run.
+func TestLoop(t *testing.T) {
+	const song = "../../controller/testdata/loop/markers.mid"
+	h := newHarness()
+	if code := h.run(context.Background(), "--loop", "markers", "--loops", "2", "--tempo", "10", song); code != exitOK {
+		t.Fatalf("exit %d: %s", code, h.stderr.String())
+	}
+	if want := "loop: 50ms to 160ms, 2 times\n"; !strings.Contains(h.stdout.String(), want) {
+		t.Errorf("printed\n%s\nwant\n%s", h.stdout.String(), want)
+	}
+	strikes := map[byte]int{}
+	for _, m := range h.dev.messages() {
+		if m.Command == config.DevCmdNoteOn {
+			strikes[m.Payload[0]]++
+		}
+	}
+	// 60 before the loop, 55 from before it struck again, 65 after it.
+	if want := map[byte]int{60: 1, 55: 2, 62: 2, 48: 2, 64: 2, 65: 1}; !maps.Equal(strikes, want) {
+		t.Errorf("notes struck %v, want %v", strikes, want)
+	}
+
+	h = newHarness()
+	if code := h.run(context.Background(), "--dry-run", "--loop", "1-1", "--loop-gap", "1s", song); code != exitOK {
+		t.Fatalf("exit %d: %s", code, h.stderr.String())
+	}
+	if want := "loop: 0s to 2.2s, until stopped, 1s apart\n"; !strings.Contains(h.stdout.String(), want) {
+		t.Errorf("printed\n%s\nwant\n%s", h.stdout.String(), want)
+	}
+	for _, bad := range []string{"2-1", "0-3", "intro"} {
+		h := newHarness()
+		if code := h.run(context.Background(), "--loop", bad, song); code != exitUsage {
+			t.Errorf("--loop %s: exit %d, want %d", bad, code, exitUsage)
+		}
+	}
+}
+
+// TestKeyboard plays keys from a terminal that reports their release, and
+// quits on Ctrl-C with the drives silenced and the terminal restored.
+func TestKeyboard(t *testing.T) {
+	h := newHarness()
+	h.keys = "\x1b[?11ua2g\x1b[97;1:3u\x03"
+	if code := h.run(context.Background(), "--keyboard"); code != exitOK {
+		t.Fatalf("exit %d: %s", code, h.stderr.String())
+	}
+	checkMessages(t, h.dev.messages(), []protocol.Message{
+		protocol.NoteOnVelocity(0x01, 1, 60, 100),
+		protocol.NoteOnVelocity(0x01, 2, 67, 100),
+		protocol.NoteOff(0x01, 1, 60),
+		protocol.NoteOff(0x01, 2, 67),
+		protocol.AllNotesOff(0x01),
+	})
+	if want := []string{"raw", "restored"}; !slices.Equal(h.tty, want) {
+		t.Errorf("terminal %v, want %v", h.tty, want)
+	}
+	out := h.stdout.String()
+	for _, want := range []string{controller.KeyboardProtocol, "octave 4, channel 2: 0x01/2; notes held with their keys\n", controller.KeyboardProtocolOff} {
+		if !strings.Contains(out, want) {
+			t.Errorf("printed\n%q\nwant %q in it", out, want)
+		}
+	}
+
+	for _, args := range [][]string{{"--keyboard", shortSong}, {"--keyboard", "--dry-run"}, {"--keyboard", "--note-length", "0s"}} {
+		h := newHarness()
+		if code := h.run(context.Background(), args...); code != exitUsage {
+			t.Errorf("%v: exit %d, want %d", args, code, exitUsage)
+		}
+	}
+}
+
+func TestOSC(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := newHarness()
+	exit := make(chan int, 1)
+	go func() { exit <- h.run(ctx, "--osc", ":57120") }()
+	client, err := net.Dial("udp", <-h.osc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write(osc.AppendBundle(nil, time.Now().Add(20*time.Millisecond),
+		osc.AppendMessage(nil, "/goppy/note", int32(1), int32(1), int32(60), int32(30)),
+		osc.AppendMessage(nil, "/goppy/note", int32(1), int32(2), int32(62))))
+	client.Write([]byte("/goppy/note\x00,i"))
+	time.Sleep(150 * time.Millisecond)
+	cancel()
+	if code := <-exit; code != exitInterrupted {
+		t.Fatalf("exit %d, want %d: %s", code, exitInterrupted, h.stderr.String())
+	}
+	checkMessages(t, h.dev.messages(), []protocol.Message{
+		protocol.NoteOn(0x01, 1, 60),
+		protocol.NoteOn(0x01, 2, 62),
+		protocol.NoteOff(0x01, 1, 60),
+		protocol.NoteOff(0x01, 2, 62),
+	})
+	if out := h.stdout.String(); !strings.Contains(out, "\nOSC on udp://127.0.0.1:") {
+		t.Errorf("printed %q", out)
+	}
+	if !strings.Contains(h.stderr.String(), "goppy-play: osc: dropped a packet") {
+		t.Errorf("stderr %q, want the malformed packet logged", h.stderr.String())
+	}
+
+	// Alongside a song.
+	h = newHarness()
+	if code := h.run(context.Background(), "--osc", ":57120", "--tempo", "10", shortSong); code != exitOK {
+		t.Fatalf("exit %d: %s", code, h.stderr.String())
+	}
+	if !strings.Contains(h.stdout.String(), "OSC on udp://") {
+		t.Errorf("printed %q", h.stdout.String())
+	}
+}
+
+// TestMQTT starts with no song, for a broker's command to name one, as a
+// doorbell would, and plays it.
+func TestMQTT(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := newHarness()
+	h.broker = mqtttest.New()
+	b := h.broker
+	exit := make(chan int, 1)
+	go func() {
+		exit <- h.run(ctx, "--mqtt", "broker.local", "--mqtt-topic", "house/goppy", "--song-dir", filepath.Dir(shortSong), "--tempo", "4")
+	}()
+	b.WaitSubscribed(t, "house/goppy/command")
+	b.Wait(t, "house/goppy/state", func(p []byte) bool { return bytes.Contains(p, []byte(`"state":"stopped"`)) })
+	b.Publish("house/goppy/command", []byte(`{"action":"play"}`))
+	b.Publish("house/goppy/command", []byte(`{"action":"play","file":"../main.go"}`))
+	b.Publish("house/goppy/command", []byte(`{"action":"play","file":"format0.mid"}`))
+	b.Wait(t, "house/goppy/state", func(p []byte) bool {
+		return bytes.Contains(p, []byte(`"state":"playing","song":"format0.mid"`))
+	})
+	// At the song's end it stops, for the next command.
+	b.Wait(t, "house/goppy/state", func(p []byte) bool {
+		return bytes.Contains(p, []byte(`"state":"stopped","song":"format0.mid"`))
+	})
+	cancel()
+	if code := <-exit; code != exitInterrupted {
+		t.Fatalf("exit %d, want %d: %s", code, exitInterrupted, h.stderr.String())
+	}
+	if want := []string{"tcp broker.local:1883"}; !slices.Equal(h.dialed, want) {
+		t.Errorf("dialled %q, want %q", h.dialed, want)
+	}
+	states := b.Published("house/goppy/state")
+	if last := states[len(states)-1]; string(last.Payload) != `{"state":"offline"}` {
+		t.Errorf("last state %s, want offline", last.Payload)
+	}
+	notes := 0
+	for _, m := range h.dev.messages() {
+		if m.Command == config.DevCmdNoteOn {
+			notes++
+		}
+	}
+	if notes == 0 {
+		t.Error("the song named wasn't played")
+	}
+	for _, want := range []string{
+		`goppy-play: mqtt: {"action":"play"}: nothing to play yet: name a song`,
+		`goppy-play: mqtt: {"action":"play","file":"../main.go"}: ../main.go: want the name of a song in --song-dir`,
+	} {
+		if !strings.Contains(h.stderr.String(), want) {
+			t.Errorf("stderr\n%s\nwant %q", h.stderr.String(), want)
+		}
+	}
+	if !strings.Contains(h.stdout.String(), "MQTT on broker.local:1883: commands on house/goppy/command, state on house/goppy/state\n") {
+		t.Errorf("printed %q", h.stdout.String())
+	}
+}
+
+// TestSync plays channel 1 on the device on one port and channel 2 on
+// the one on another, through a Scheduler.
+func TestSync(t *testing.T) {
+	mapFile := filepath.Join(t.TempDir(), "mapping.yaml")
+	if err := os.WriteFile(mapFile, []byte("channels:\n  1: 0x01/1\n  2: 0x02/1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := newHarness()
+	h.sync = map[string]protocol.Message{"/dev/ttyUSB2": protocol.Pong(0x02, 1, 4)}
+	code := h.run(context.Background(), "--port", "/dev/ttyUSB0", "--sync", "/dev/ttyUSB2", "--map", mapFile, "--tempo", "10", longSong)
+	if code != exitOK {
+		t.Fatalf("exit %d: %s", code, h.stderr.String())
+	}
+	if !slices.Equal(h.opened, []string{"/dev/ttyUSB0", "/dev/ttyUSB2"}) {
+		t.Errorf("opened %v", h.opened)
+	}
+	for _, want := range []string{"/dev/ttyUSB0: devices 01, ", "/dev/ttyUSB2: devices 02, ", "ahead, in step\n"} {
+		if !strings.Contains(h.stdout.String(), want) {
+			t.Errorf("printed\n%s\nwant %q", h.stdout.String(), want)
+		}
+	}
+	for port, dev := range map[string]*memDevice{"/dev/ttyUSB0": h.dev, "/dev/ttyUSB2": h.extra["/dev/ttyUSB2"]} {
+		got := dev.messages()
+		notes := 0
+		for _, m := range got {
+			if m.Command == config.DevCmdNoteOn {
+				notes++
+			}
+		}
+		// Both ports start and stop the sequence, and play only their own.
+		if notes == 0 || got[0].Command != config.CmdSequenceStart || got[len(got)-1].Command != config.CmdSequenceStop {
+			t.Errorf("%s got %v", port, got)
+		}
+		for _, m := range got {
+			if want := map[string]byte{"/dev/ttyUSB0": 0x01, "/dev/ttyUSB2": 0x02}[port]; m.Device != want && m.Device != config.SystemAddress {
+				t.Errorf("%s got %v, for another port's device", port, m)
+			}
+		}
+	}
+	if code := newHarness().run(context.Background(), "--sync", "/dev/ttyUSB2", longSong); code != exitUsage {
+		t.Errorf("--sync without --map: exit %d, want %d", code, exitUsage)
+	}
+}
+
+// TestOffsets moves a device's offset from the mapping's with --hotkeys,
+// past the lookahead the mapping needs.
+func TestOffsets(t *testing.T) {
+	mapFile := filepath.Join(t.TempDir(), "mapping.yaml")
+	if err := os.WriteFile(mapFile, []byte("channels:\n  1: 0x01/1\noffsets:\n  0x01: 12\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := newHarness()
+	h.keys = "]}[x"
+	code := h.run(context.Background(), "--hotkeys", "--map", mapFile, "--tempo", "10", longSong)
+	if code != exitOK {
+		t.Fatalf("exit %d: %s", code, h.stderr.String())
+	}
+	for _, want := range []string{"playing 12ms ahead", "device 0x01: sent 13ms early\n", "device 0x01: sent 23ms early\n", "device 0x01: sent 22ms early\n"} {
+		if !strings.Contains(h.stdout.String(), want) {
+			t.Errorf("printed\n%s\nwant %q", h.stdout.String(), want)
+		}
+	}
+	if want := "goppy-play: warning: controller: device 0x01 needs 23ms of lookahead, more than 12ms: it sounds 11ms late"; !strings.Contains(h.stderr.String(), want) {
+		t.Errorf("stderr\n%s\nwant %q", h.stderr.String(), want)
+	}
+	if !slices.Equal(h.tty, []string{"raw", "restored"}) {
+		t.Errorf("terminal %v", h.tty)
+	}
+
+	// A --lookahead too short for the mapping is warned of at the start;
+	// q quits.
+	h = newHarness()
+	h.keys = "q"
+	code = h.run(context.Background(), "--hotkeys", "--lookahead", "5ms", "--map", mapFile, longSong)
+	if code != exitInterrupted {
+		t.Errorf("exit %d after q, want %d", code, exitInterrupted)
+	}
+	if !strings.Contains(h.stderr.String(), "warning: controller: device 0x01 needs 12ms of lookahead, more than 5ms") {
+		t.Errorf("stderr\n%s", h.stderr.String())
+	}
+}
+
+// TestLiveKeys moves the tempo and transpose with --hotkeys, which needs
+// no devices to choose from.
+func TestLiveKeys(t *testing.T) {
+	h := newHarness()
+	h.keys = "++->.<<x"
+	if code := h.run(context.Background(), "--hotkeys", "--tempo", "10", longSong); code != exitOK {
+		t.Fatalf("exit %d: %s", code, h.stderr.String())
+	}
+	for _, want := range []string{"tempo 102%, transposed +0\n", "tempo 101%, transposed +2\n", "tempo 101%, transposed +0\n"} {
+		if !strings.Contains(h.stdout.String(), want) {
+			t.Errorf("printed\n%s\nwant %q", h.stdout.String(), want)
+		}
+	}
+}
+
+// TestMuteKeys mutes and solos a channel and a device with --hotkeys,
+// and checks the progress line marks them.
+func TestMuteKeys(t *testing.T) {
+	mapFile := filepath.Join(t.TempDir(), "mapping.yaml")
+	if err := os.WriteFile(mapFile, []byte("channels:\n  1: 0x01/1\n  2: 0x01/2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := newHarness()
+	h.keys = "mcssSm"
+	if code := h.run(context.Background(), "--hotkeys", "--map", mapFile, "--tempo", "10", longSong); code != exitOK {
+		t.Fatalf("exit %d: %s", code, h.stderr.String())
+	}
+	want := "channel 1: muted\nchannel 2: playing\nchannel 2: soloed\nchannel 2: playing\ndevice 0x01: soloed\nchannel 2: muted\n"
+	// Each follows the progress line it interrupts.
+	got := strings.Join(regexp.MustCompile(`(channel \d+|device 0x..): [a-z, ]+\n`).FindAllString(h.stdout.String(), -1), "")
+	if got != want {
+		t.Errorf("printed\n%s\nwant\n%s", got, want)
+	}
+
+	m := mapping.Channels(0x01, 1, 2)
+	m.Channels[2] = mapping.Channel{Target: mapping.Target{Device: 0x02, Sub: 1}}
+	p := controller.NewPlayer(nil, m)
+	var out strings.Builder
+	prog := newProgress(&out, m, p)
+	p.Mute(0, true)
+	p.Solo(1, true)
+	p.Solo(2, true)
+	p.MuteDevice(0x02, true)
+	p.SoloDevice(0x01, true)
+	prog.event(controller.Event{Kind: controller.NoteOn, Channel: 0, Note: 60})
+	prog.event(controller.Event{Kind: controller.NoteOn, Channel: 1, Note: 60})
+	if want := "\rbar 1:1     1M· 2S♪ 3S·  muted 0x02  soloed 0x01"; !strings.HasSuffix(out.String(), want) {
+		t.Errorf("progress %q, want it to end %q", out.String(), want)
+	}
+}
+
+func TestUDPPort(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--port", "udp"}, "239.2.2.7:30994%"},
+		{[]string{"--port", "udp:239.1.2.3:4000", "--iface", "eth1"}, "239.1.2.3:4000%eth1"},
+	}
+	for _, tt := range tests {
+		h := newHarness()
+		if code := h.run(context.Background(), append(tt.args, "--tempo", "10", shortSong)...); code != exitOK {
+			t.Fatalf("%v: exit %d: %s", tt.args, code, h.stderr.String())
+		}
+		if len(h.scans)+len(h.opened) != 0 || !slices.Equal(h.udp, []string{tt.want}) {
+			t.Errorf("%v: scanned %d, opened %v and %v, want only %s over UDP", tt.args, len(h.scans), h.opened, h.udp, tt.want)
+		}
+		if got := h.dev.messages(); len(got) == 0 || got[0].Command != config.CmdSequenceStart {
+			t.Errorf("%v: device got %v", tt.args, got)
+		}
+	}
+	h := newHarness()
+	if code := h.run(context.Background(), "--port", "udp:239.1.2.3", shortSong); code != exitUsage {
+		t.Errorf("udp without a port: exit %d, want %d", code, exitUsage)
+	}
+}
+
+// TestPlaylist plays an M3U list of the short song twice around a file
+// that isn't MIDI: the bad song is skipped, and the drives are silenced
+// after each song played.
+func TestPlaylist(t *testing.T) {
+	dir := t.TempDir()
+	song, err := filepath.Abs(shortSong)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bad.mid"), []byte("RIFF"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	list := filepath.Join(dir, "show.m3u")
+	if err := os.WriteFile(list, []byte(song+"\nbad.mid\n"+song+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := newHarness()
+	if code := h.run(context.Background(), "--tempo", "10", "--gap", "0", "--rehome", list); code != exitOK {
+		t.Fatalf("exit %d: %s", code, h.stderr.String())
+	}
+	if got := h.stderr.String(); !strings.Contains(got, "skipped "+filepath.Join(dir, "bad.mid")) {
+		t.Errorf("stderr %q, want the bad song skipped", got)
+	}
+	if got := h.stdout.String(); !strings.Contains(got, "(1 of 3)") || !strings.Contains(got, "(3 of 3)") {
+		t.Errorf("printed\n%s\nwant songs 1 and 3 of 3 played", got)
+	}
+	played := []protocol.Message{
+		protocol.SequenceStart(),
+		protocol.NoteOnVelocity(0x01, 1, 60, 100),
+		protocol.NoteOff(0x01, 1, 60),
+		protocol.PitchBend(0x01, 1, 0x1000),
+		protocol.NoteOnVelocity(0x01, 1, 62, 80),
+		protocol.PitchBend(0x01, 1, 0),
+		protocol.NoteOff(0x01, 1, 62),
+		protocol.SequenceStop(),
+		protocol.AllNotesOff(0x01),
+		protocol.DriveReset(0x01, 0),
+	}
+	checkMessages(t, h.dev.messages(), append(slices.Clone(played), played...))
+
+	h = newHarness()
+	if code := h.run(context.Background(), "--repeat", "twice", shortSong); code != exitUsage {
+		t.Errorf("--repeat twice: exit %d, want %d", code, exitUsage)
+	}
+}
+
+// TestListen drives a song through the HTTP API once it has started:
+// status, a mute, a stop that silences the drives, and a pause refused
+// once stopped.
+// TestRecordReplay records a song played with --record, then plays the
+// capture with --replay: the device gets the song again.
+func TestRecordReplay(t *testing.T) {
+	capture := filepath.Join(t.TempDir(), "song.gop")
+	h := newHarness()
+	if code := h.run(context.Background(), "--tempo", "10", "--record", capture, shortSong); code != exitOK {
+		t.Fatalf("exit %d: %s", code, h.stderr.String())
+	}
+	played := h.dev.messages()
+	if len(played) == 0 {
+		t.Fatal("the device got nothing")
+	}
+
+	h = newHarness()
+	if code := h.run(context.Background(), "--replay", capture, "--port", "/dev/ttyACM0"); code != exitOK {
+		t.Fatalf("--replay: exit %d: %s", code, h.stderr.String())
+	}
+	if !slices.Equal(h.opened, []string{"/dev/ttyACM0"}) {
+		t.Errorf("opened %v, want /dev/ttyACM0", h.opened)
+	}
+	checkMessages(t, h.dev.messages(), played)
+
+	h = newHarness()
+	if code := h.run(context.Background(), "--replay", capture, shortSong); code != exitUsage {
+		t.Errorf("--replay with a song: exit %d, want %d", code, exitUsage)
+	}
+
+	// With --dry-run, the capture is printed as --dry-run prints the song:
+	// its notes but channel 10's, for a drive the device hasn't.
+	h = newHarness()
+	if code := h.run(context.Background(), "--replay", capture, "--dry-run", "--log-command", "note-on"); code != exitOK {
+		t.Fatalf("--replay --dry-run: exit %d: %s", code, h.stderr.String())
+	}
+	if len(h.opened) != 0 {
+		t.Errorf("--replay --dry-run opened %v", h.opened)
+	}
+	if got := regexp.MustCompile(`0x01 drive \d+ +note on .*`).FindAllString(h.stdout.String(), -1); !slices.Equal(got, []string{
+		"0x01 drive 1     note on C4 velocity 100",
+		"0x01 drive 1     note on D4 velocity 80",
+	}) {
+		t.Errorf("printed\n%s\nwant the song's channel 1 notes", h.stdout.String())
+	}
+	h = newHarness()
+	if code := h.run(context.Background(), "--replay", shortSong); code != exitFile {
+		t.Errorf("--replay of a MIDI file: exit %d, want %d", code, exitFile)
+	}
+}
+
+// TestBake bakes a song, with no device, and replays it: the device gets
+// what playing the song does.
+func TestBake(t *testing.T) {
+	dir := t.TempDir()
+	mapFile, baked := filepath.Join(dir, "mapping.yaml"), filepath.Join(dir, "song.gopb")
+	if err := os.WriteFile(mapFile, []byte("channels:\n  1: 0x02/5\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := newHarness()
+	if code := h.run(context.Background(), "--map", mapFile, "--tempo", "10", shortSong); code != exitOK {
+		t.Fatalf("exit %d: %s", code, h.stderr.String())
+	}
+	played := h.dev.messages()
+
+	h = newHarness()
+	if code := h.run(context.Background(), "--bake", baked, "--map", mapFile, "--tempo", "10", shortSong); code != exitOK {
+		t.Fatalf("--bake: exit %d: %s", code, h.stderr.String())
+	}
+	if len(h.opened) != 0 || len(h.scans) != 0 {
+		t.Errorf("--bake opened %v, scanned %d times, want no device", h.opened, len(h.scans))
+	}
+	if want := "baked " + shortSong + " to " + baked + ", 125ms, for devices taking velocity\n"; !strings.Contains(h.stdout.String(), want) {
+		t.Errorf("printed\n%s\nwant %q", h.stdout.String(), want)
+	}
+
+	h = newHarness()
+	if code := h.run(context.Background(), "--replay", baked, "--port", "/dev/ttyACM0"); code != exitOK {
+		t.Fatalf("--replay: exit %d: %s", code, h.stderr.String())
+	}
+	if want := "replaying " + baked + ", baked for devices taking velocity, "; !strings.Contains(h.stdout.String(), want) {
+		t.Errorf("printed\n%s\nwant %q", h.stdout.String(), want)
+	}
+	checkMessages(t, h.dev.messages(), played)
+
+	for _, args := range [][]string{
+		{"--bake", baked, shortSong, shortSong},
+		{"--bake", baked, "--dry-run", shortSong},
+		{"--bake", baked, "--loop", "1-1", shortSong}, // until stopped
+	} {
+		h = newHarness()
+		if code := h.run(context.Background(), args...); code != exitUsage {
+			t.Errorf("%q: exit %d, want %d", args, code, exitUsage)
+		}
+	}
+}
+
+func TestListen(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := newHarness()
+	started := make(chan struct{})
+	addr := make(chan string, 1)
+	exit := make(chan int, 1)
+	go func() {
+		exit <- run(ctx, []string{"--listen", ":0", "--token", "t0k", longSong}, env{
+			stdout: &bytes.Buffer{}, // written by run while the test reads h
+			stderr: &h.stderr,
+			scan: func(context.Context, controller.ScanOptions) ([]controller.FoundDevice, error) {
+				return h.found, nil
+			},
+			open: func(string, int) (*controller.Device, error) {
+				var d *controller.Device
+				h.dev, d = newMemDevice()
+				var once sync.Once
+				h.dev.seen = func(m protocol.Message) {
+					if m.Command == config.DevCmdNoteOn {
+						once.Do(func() { close(started) })
+					}
+				}
+				return d, nil
+			},
+			listen: func(network, _ string) (net.Listener, error) {
+				l, err := net.Listen(network, "127.0.0.1:0")
+				if err == nil {
+					addr <- l.Addr().String()
+				}
+				return l, err
+			},
+		})
+	}()
+	base := "http://" + <-addr
+	<-started
+
+	call := func(method, path string, want int) map[string]any {
+		t.Helper()
+		req, err := http.NewRequest(method, base+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer t0k")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var v map[string]any
+		if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != want {
+			t.Errorf("%s %s: status %d, want %d: %v", method, path, resp.StatusCode, want, v)
+		}
+		return v
+	}
+	// The event feed streams the song's notes.
+	ws := wstest.Dial(t, base+"/events?token=t0k")
+	if ev := ws.Next(t); ev["type"] != "stats" || ev["status"].(map[string]any)["song"] != longSong {
+		t.Errorf("the feed began %v, want the stats", ev)
+	}
+	if ev := ws.Wait(t, func(ev map[string]any) bool { return ev["type"] == "note-on" }); ev["device"] != "0x01" || ev["name"] != "E4" {
+		t.Errorf("the feed's first note %v, want E4 on device 0x01", ev)
+	}
+
+	// The device is asked how it is as the API starts.
+	v := call("GET", "/status", http.StatusOK)
+	for deadline := time.Now().Add(time.Second); v["devices"].([]any)[0].(map[string]any)["uptime_s"] == nil && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+		v = call("GET", "/status", http.StatusOK)
+	}
+	devices, _ := json.Marshal(v["devices"])
+	if v["state"] != "playing" || v["song"] != longSong || v["length"] != 1.5 ||
+		string(devices) != `[{"address":"0x01","connected":true,"first_drive":1,"last_drive":8,"port":"/dev/ttyUSB0","sequence":"playing","sounding":[1],"uptime_s":42}]` {
+		t.Errorf("status %v", v)
+	}
+	if v := call("POST", "/channels/2/mute", http.StatusOK); fmt.Sprint(v["muted"]) != "[2]" {
+		t.Errorf("muted %v, want channel 2", v["muted"])
+	}
+	if v := call("POST", "/channels/1/solo", http.StatusOK); fmt.Sprint(v["soloed"]) != "[1]" {
+		t.Errorf("soloed %v, want channel 1", v["soloed"])
+	}
+	v = call("POST", "/devices/0x01/mute", http.StatusOK)
+	if d := v["devices"].([]any)[0].(map[string]any); d["muted"] != true {
+		t.Errorf("device %v, want it muted", d)
+	}
+	call("POST", "/devices/0x01/unmute", http.StatusOK)
+	call("POST", "/devices/0x09/solo", http.StatusConflict)
+	call("POST", "/next", http.StatusConflict)
+	if v := call("POST", "/stop", http.StatusOK); v["state"] != "stopped" {
+		t.Errorf("state %v after a stop", v["state"])
+	}
+	call("POST", "/pause", http.StatusConflict)
+	ws.Wait(t, func(ev map[string]any) bool { return ev["type"] == "transport" && ev["state"] == "stopped" })
+	v = call("POST", "/devices/0x01/offset?ms=5", http.StatusOK)
+	if d := v["devices"].([]any)[0].(map[string]any); d["offset_ms"] != 5.0 || !strings.Contains(fmt.Sprint(d["warning"]), "needs 5ms of lookahead") {
+		t.Errorf("device %v after an offset beyond the lookahead", d)
+	}
+	v = call("POST", "/devices/0x01/offset?by=-5", http.StatusOK)
+	if d := v["devices"].([]any)[0].(map[string]any); d["offset_ms"] != nil || d["warning"] != nil {
+		t.Errorf("device %v after the offset was moved back", d)
+	}
+	call("POST", "/devices/0x01/offset?by=-1000", http.StatusOK)
+	call("POST", "/devices/0x01/offset?by=-1", http.StatusConflict)
+	if v := call("POST", "/tempo?percent=150", http.StatusOK); v["tempo"] != 150.0 {
+		t.Errorf("tempo %v, want 150", v["tempo"])
+	}
+	if v := call("POST", "/tempo?by=-1", http.StatusOK); v["tempo"] != 149.0 {
+		t.Errorf("tempo %v after 1%% slower, want 149", v["tempo"])
+	}
+	if v := call("POST", "/transpose?semitones=-3", http.StatusOK); v["transpose"] != -3.0 {
+		t.Errorf("transpose %v, want -3", v["transpose"])
+	}
+	call("POST", "/transpose?semitones=30", http.StatusBadRequest)
+
+	cancel()
+	if code := <-exit; code != exitInterrupted {
+		t.Errorf("exit %d, want %d: %s", code, exitInterrupted, h.stderr.String())
+	}
+	got := h.dev.messages()
+	if n := len(got); n < 2 || got[n-2].Sub != 0 || got[n-2].Command != config.DevCmdNoteOff || got[n-1].Command != config.CmdSequenceStop {
+		t.Errorf("device got %v, want the stop to silence the drives", got)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/api"
+	"github.com/ystepanoff/goppy/controller/mqtt"
+)
+
+// mqttOptions are the --mqtt flags.
+type mqttOptions struct {
+	broker, topic      string
+	username, password string
+	heartbeat          time.Duration
+}
+
+// serveMQTT takes commands for t from the broker, and publishes its
+// status there, as --mqtt asks, until ctx is done or the returned stop is
+// called. stop waits for the client to say it is going.
+func serveMQTT(ctx context.Context, e env, t api.Transport, o mqttOptions) (stop func()) {
+	broker := o.broker
+	for _, scheme := range []string{"mqtt://", "tcp://"} {
+		broker = strings.TrimPrefix(broker, scheme)
+	}
+	if _, _, err := net.SplitHostPort(broker); err != nil {
+		broker = net.JoinHostPort(broker, "1883")
+	}
+	c := &mqtt.Client{
+		Transport: t,
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			return e.dial(ctx, "tcp", broker)
+		},
+		Username:  o.username,
+		Password:  o.password,
+		Commands:  o.topic + "/command",
+		State:     o.topic + "/state",
+		Heartbeat: o.heartbeat,
+		Logf: func(format string, args ...any) {
+			fmt.Fprintf(e.stderr, "goppy-play: mqtt: "+format+"\n", args...)
+		},
+	}
+	fmt.Fprintf(e.stdout, "MQTT on %s: commands on %s, state on %s\n", broker, c.Commands, c.State)
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ystepanoff/goppy/controller"
+	"github.com/ystepanoff/goppy/controller/osc"
+)
+
+// serveOSC serves OSC on addr, as --osc asks, playing through out until
+// ctx is done or the returned stop is called. stop waits for the server
+// to release the notes it holds.
+func serveOSC(ctx context.Context, e env, addr string, out controller.Sender) (stop func(), err error) {
+	conn, err := e.listenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(e.stdout, "OSC on udp://%s\n", conn.LocalAddr())
+	s := oscServer(e, out)
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Serve(ctx, conn)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}, nil
+}
+
+// oscOnly plays what OSC messages sent to addr say on the device at port,
+// with no song, until Ctrl-C, and returns the exit code.
+func oscOnly(ctx context.Context, e env, port string, baud int, iface, addr string) int {
+	dev, _, code := connect(ctx, e, port, baud, iface)
+	if dev == nil {
+		return code
+	}
+	defer dev.Close()
+	go func() {
+		for range dev.Messages() {
+		}
+	}()
+	conn, err := e.listenPacket("udp", addr)
+	if err != nil {
+		fmt.Fprintln(e.stderr, "goppy-play: --osc:", err)
+		return exitError
+	}
+	fmt.Fprintf(e.stdout, "OSC on udp://%s; Ctrl-C quits\n", conn.LocalAddr())
+	s := oscServer(e, dev)
+	return exit(e, s.Serve(ctx, conn))
+}
+
+// oscServer returns a server playing through out, logging what it drops.
+func oscServer(e env, out controller.Sender) *osc.Server {
+	return &osc.Server{Out: out, Logf: func(format string, args ...any) {
+		fmt.Fprintf(e.stderr, "goppy-play: osc: "+format+"\n", args...)
+	}}
+}
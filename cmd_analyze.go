@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller"
+	"github.com/ystepanoff/goppy/controller/mapping"
+)
+
+// cmdAnalyze reports, before a gig, whether a song will play on the rig:
+// each channel's notes, their range, how many sound at once and how many
+// are beyond the drives, and the bends, pedal and pressure they'd lose.
+// Given a mapping file, it also predicts what the mapping drops or leaves
+// out of range, and suggests the device of the mapping for each channel
+// that drops fewest notes, by the devices' ranges and voices. The
+// mapping's ranges and voices sections describe the devices.
+func cmdAnalyze(args []string) error {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the analysis as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return fmt.Errorf("usage: goppy analyze [--json] song.mid [mapping.yaml]")
+	}
+	r, err := analyze(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		data, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	return printAnalysis(os.Stdout, r)
+}
+
+// analysisReport is what goppy analyze prints.
+type analysisReport struct {
+	Song        string          `json:"song"`
+	Length      float64         `json:"length"` // seconds
+	Mapping     string          `json:"mapping,omitempty"`
+	Channels    []channelReport `json:"channels"`
+	Arrangement string          `json:"arrangement,omitempty"`
+	Suggested   []suggestion    `json:"suggested,omitempty"`
+}
+
+type channelReport struct {
+	Channel      int    `json:"channel"` // from 1
+	Notes        int    `json:"notes"`
+	Low          string `json:"low,omitempty"` // C4
+	High         string `json:"high,omitempty"`
+	LowNote      int    `json:"low_note"` // 60
+	HighNote     int    `json:"high_note"`
+	MaxPolyphony int    `json:"max_polyphony"`
+	OutOfRange   int    `json:"out_of_range"` // of the floppy range
+	Bends        int    `json:"bends"`
+	Sustain      int    `json:"sustain"`
+	Pressure     int    `json:"pressure"`
+	Dropped      *int   `json:"dropped,omitempty"` // by the mapping
+	Outside      *int   `json:"outside,omitempty"` // the mapped drives' range
+}
+
+type suggestion struct {
+	Channel int    `json:"channel"` // from 1
+	Device  string `json:"device"`  // 0x01
+	Dropped int    `json:"dropped"`
+}
+
+// analyze reads the song, and the mapping file if mapFile isn't "", and
+// analyses the one through the other.
+func analyze(song, mapFile string) (analysisReport, error) {
+	events, err := controller.ReadSMF(song)
+	if err != nil {
+		return analysisReport{}, err
+	}
+	var m *mapping.Map
+	if mapFile != "" {
+		if m, err = mapping.Load(mapFile); err != nil {
+			return analysisReport{}, err
+		}
+	}
+	a := controller.Analyze(events, m)
+	r := analysisReport{Song: filepath.Base(song), Channels: []channelReport{}}
+	if mapFile != "" {
+		r.Mapping = filepath.Base(mapFile)
+	}
+	if len(events) > 0 {
+		r.Length = events[len(events)-1].At.Seconds()
+	}
+	for _, c := range a.Channels {
+		cr := channelReport{
+			Channel: int(c.Channel) + 1, Notes: c.Notes, LowNote: int(c.Low), HighNote: int(c.High),
+			MaxPolyphony: c.MaxPolyphony, OutOfRange: c.OutOfRange,
+			Bends: c.Bends, Sustain: c.Sustain, Pressure: c.Pressure,
+		}
+		if c.Notes > 0 {
+			cr.Low, cr.High = noteName(c.Low), noteName(c.High)
+		}
+		if m != nil {
+			cr.Dropped, cr.Outside = &c.Dropped, &c.Outside
+		}
+		r.Channels = append(r.Channels, cr)
+	}
+	if a.Arrangement != nil {
+		r.Arrangement = a.Arrangement.String()
+	}
+	for _, s := range a.Suggested {
+		r.Suggested = append(r.Suggested, suggestion{Channel: int(s.Channel) + 1, Device: fmt.Sprintf("0x%02X", s.Device), Dropped: s.Dropped})
+	}
+	return r, nil
+}
+
+// printAnalysis prints r as a table, a row per channel, and what the
+// mapping would do below it.
+func printAnalysis(w io.Writer, r analysisReport) error {
+	fmt.Fprintf(w, "%s: %s\n", r.Song, (time.Duration(r.Length * float64(time.Second))).Round(time.Millisecond))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	header := "CHANNEL\tNOTES\tRANGE\tAT ONCE\tBEYOND FLOPPIES\tBENDS\tSUSTAIN\tPRESSURE\t"
+	if r.Mapping != "" {
+		header += "DROPPED\tOUT OF RANGE\t"
+	}
+	fmt.Fprintln(tw, header)
+	for _, c := range r.Channels {
+		span := "-"
+		if c.Notes > 0 {
+			span = fmt.Sprintf("%s-%s", c.Low, c.High)
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%s\t%d\t%d\t%d\t%d\t%d\t", c.Channel, c.Notes, span, c.MaxPolyphony, c.OutOfRange, c.Bends, c.Sustain, c.Pressure)
+		if c.Dropped != nil {
+			fmt.Fprintf(tw, "%d\t%d\t", *c.Dropped, *c.Outside)
+		}
+		fmt.Fprintln(tw)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if r.Mapping == "" {
+		return nil
+	}
+	fmt.Fprintf(w, "arranged by %s: %s\n", r.Mapping, r.Arrangement)
+	for _, s := range r.Suggested {
+		fmt.Fprintf(w, "suggest channel %d on %s: %d dropped\n", s.Channel, s.Device, s.Dropped)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestAnalyze analyses controller/testdata/seek/overlap.mid, chords of
+// five notes up to C5 with a bend on channel 1 and a bass C2 on channel 2,
+// through a rig of a bass device and a three-voice device above it.
+func TestAnalyze(t *testing.T) {
+	const song = "controller/testdata/seek/overlap.mid"
+	mapFile := filepath.Join(t.TempDir(), "rig.yaml")
+	rig := "channels:\n  1: 1/1\n  2: 2/1\nranges:\n  1: 24-47\n  2: 48-83\nvoices:\n  1: 1\n  2: 3\n"
+	if err := os.WriteFile(mapFile, []byte(rig), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := analyze(song, mapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := printAnalysis(&b, r); err != nil {
+		t.Fatal(err)
+	}
+	want := "overlap.mid: 8s\n" +
+		"  CHANNEL  NOTES  RANGE  AT ONCE  BEYOND FLOPPIES  BENDS  SUSTAIN  PRESSURE  DROPPED  OUT OF RANGE\n" +
+		"        1      5  C4-C5        3                1      1        0         0        0             1\n" +
+		"        2      1  C2-C2        1                0      0        0         0        0             0\n" +
+		"arranged by rig.yaml: none: 6 notes, 0 moved, 0 dropped, 1 still out of range\n" +
+		"suggest channel 1 on 0x02: 0 dropped\n" +
+		"suggest channel 2 on 0x01: 0 dropped\n"
+	if got := b.String(); got != want {
+		t.Errorf("printed\n%s\nwant\n%s", got, want)
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back struct {
+		Channels []struct {
+			Channel      int
+			Low          string
+			HighNote     int `json:"high_note"`
+			MaxPolyphony int `json:"max_polyphony"`
+			Bends        int
+		}
+		Suggested []struct {
+			Channel int
+			Device  string
+		}
+	}
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if c := back.Channels[0]; c.Channel != 1 || c.Low != "C4" || c.HighNote != 72 || c.MaxPolyphony != 3 || c.Bends != 1 {
+		t.Errorf("JSON channel 1 = %+v", c)
+	}
+	if s := back.Suggested[1]; s.Channel != 2 || s.Device != "0x01" {
+		t.Errorf("JSON suggestion for channel 2 = %+v", s)
+	}
+
+	// Without a mapping, no prediction.
+	if r, err = analyze(song, ""); err != nil {
+		t.Fatal(err)
+	}
+	if r.Arrangement != "" || r.Suggested != nil || r.Channels[0].Dropped != nil {
+		t.Errorf("predicted without a mapping: %+v", r)
+	}
+}
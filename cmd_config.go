@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ystepanoff/goppy/internal/protocol"
+)
+
+func cmdConfig(args []string) error {
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	pf := addPortFlags(fs)
+	timeout := fs.Duration("timeout", 2*time.Second, "how long to wait for replies")
+	positions := fs.Bool("positions", false, "report head and carriage positions instead of settings")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	port, err := pf.open()
+	if err != nil {
+		return err
+	}
+	defer port.Close()
+
+	if err := port.SetReadTimeout(*timeout); err != nil {
+		return fmt.Errorf("set read timeout: %w", err)
+	}
+	if *positions {
+		return printPositions(port)
+	}
+	if _, err := port.Write(protocol.GetConfig()); err != nil {
+		return fmt.Errorf("write config query: %w", err)
+	}
+
+	// The device sends one reply per drive, then one per route if it
+	// routes sub addresses to more than one instrument; a read timeout
+	// ends the list.
+	r := timeoutReader{port}
+	n := 0
+	var routes []protocol.Route
+	for {
+		f, err := protocol.ReadFrame(r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read config: %w", err)
+		}
+		if f.Command == protocol.CmdRoute {
+			rt, err := protocol.DecodeRoute(f)
+			if err != nil {
+				return err
+			}
+			routes = append(routes, rt)
+			continue
+		}
+		if f.Command != protocol.CmdConfig {
+			continue
+		}
+		c, err := protocol.DecodeDriveConfig(f)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			fmt.Println("device drive transpose detune cadence calibration bend sounding delay  travel")
+		}
+		travel := fmt.Sprintf("%d-%d", c.TravelMin, c.TravelMax)
+		fmt.Printf("0x%02X   %5d %+9d %+6d %7d %11d %4d %8s %5s %7s\n",
+			c.DeviceAddress, c.Drive, c.Transpose, c.Detune, c.DirCadence, c.Calibration, c.BendRange,
+			c.Sounding.Round(time.Second), c.StartDelay, travel)
+		n++
+	}
+	if len(routes) > 0 {
+		if n > 0 {
+			fmt.Println()
+		}
+		fmt.Println("device route subs  instrument")
+		for _, rt := range routes {
+			fmt.Printf("0x%02X   %5d %5s  %s\n",
+				rt.DeviceAddress, rt.Number, fmt.Sprintf("%d-%d", rt.First, rt.Last), protocol.InstrumentName(rt.Instrument))
+		}
+	}
+	if n == 0 && len(routes) == 0 {
+		return fmt.Errorf("no config received (firmware too old?)")
+	}
+	return nil
+}
+
+// printPositions asks for and prints every drive's position.
+func printPositions(port io.ReadWriter) error {
+	if _, err := port.Write(protocol.GetPositions()); err != nil {
+		return fmt.Errorf("write position query: %w", err)
+	}
+
+	// The device sends one reply per drive; a read timeout ends the list.
+	r := timeoutReader{port}
+	n := 0
+	for {
+		f, err := protocol.ReadFrame(r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read positions: %w", err)
+		}
+		if f.Command != protocol.CmdPosition {
+			continue
+		}
+		p, err := protocol.DecodePosition(f)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			fmt.Println("device drive position")
+		}
+		fmt.Printf("0x%02X   %5d %8d\n", p.DeviceAddress, p.Drive, p.Steps)
+		n++
+	}
+	if n == 0 {
+		return fmt.Errorf("no positions received (firmware too old?)")
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller"
+)
+
+// cmdDiscover pings every USB serial port at once and prints a table of
+// which device answers on which port, and which ports it couldn't open.
+func cmdDiscover(args []string) error {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	bauds := fs.String("bauds", strconv.Itoa(defaultBaud), "comma-separated baud rates to try on each port, in order")
+	timeout := fs.Duration("timeout", 500*time.Millisecond, "how long to wait for pongs at each baud")
+	all := fs.Bool("all", false, "try every serial port, not just USB ones from Arduino and common USB serial chips")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	opts := controller.ScanOptions{Timeout: *timeout}
+	for _, b := range strings.Split(*bauds, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(b))
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid baud rate %q", b)
+		}
+		opts.Bauds = append(opts.Bauds, n)
+	}
+	if *all {
+		opts.VIDs = []string{}
+		opts.NonUSB = true
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Fprintln(os.Stderr, "scanning serial ports...")
+	found, err := controller.ScanAll(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("no devices answered")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PORT\tBAUD\tDEVICE\tDRIVES\tTAKES")
+	for _, f := range found {
+		if f.Err != nil {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t%v\n", f.Port, f.Err)
+			continue
+		}
+		takes := "Moppy's commands only"
+		if len(f.Extra) > 0 {
+			takes = f.Caps.String()
+		}
+		fmt.Fprintf(w, "%s\t%d\t0x%02X\t%d..%d\t%s\n", f.Port, f.Baud, f.Address, f.FirstDrive, f.LastDrive, takes)
+	}
+	return w.Flush()
+}
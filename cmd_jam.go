@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ystepanoff/goppy/controller"
+	"github.com/ystepanoff/goppy/controller/mapping"
+)
+
+// cmdJam plays a MIDI keyboard on the drives live: each mapped channel on
+// its own drive, channel 1 on --first-drive and up, or as --map says.
+// --bend-rate thins the pitch bends a wheel sends to what the link keeps
+// up with. Enter silences every drive, as does the keyboard's own panic
+// button; Ctrl-C stops, silencing them too.
+func cmdJam(args []string) error {
+	fs := flag.NewFlagSet("jam", flag.ExitOnError)
+	pf := addPortFlags(fs)
+	midiIn := fs.String("midi", "", "raw MIDI input device, e.g. /dev/snd/midiC1D0 — required")
+	device := fs.Uint("device", 0x01, "target device address")
+	first := fs.Uint("first-drive", 1, "drive MIDI channel 1 plays on; later channels take the drives after it")
+	last := fs.Uint("last-drive", 8, "last drive to map a channel to")
+	mapFile := fs.String("map", "", "mapping file; overrides --device, --first-drive and --last-drive")
+	bendRate := fs.Int("bend-rate", 100, "most pitch bends a second to send for each channel; 0 for any")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *midiIn == "" {
+		return fmt.Errorf("--midi is required")
+	}
+	if *first == 0 || *last < *first || *last > 255 {
+		return fmt.Errorf("invalid drive range %d..%d", *first, *last)
+	}
+	if *bendRate < 0 {
+		return fmt.Errorf("--bend-rate %d is negative", *bendRate)
+	}
+
+	m := mapping.Channels(byte(*device), byte(*first), byte(*last))
+	if *mapFile != "" {
+		var err error
+		if m, err = mapping.Load(*mapFile); err != nil {
+			return err
+		}
+	}
+
+	in, err := controller.OpenRawMIDI(*midiIn)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	port, err := pf.open()
+	if err != nil {
+		return err
+	}
+	dev := controller.New(port)
+	defer dev.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	bridge := controller.NewBridge(in, dev, m)
+	bridge.Bends.Rate = *bendRate
+	go func() {
+		// Drain what the device sends back, so its reader never waits.
+		for range dev.Messages() {
+		}
+	}()
+	go func() {
+		lines := bufio.NewScanner(os.Stdin)
+		for lines.Scan() {
+			if err := bridge.Panic(); err != nil {
+				fmt.Fprintln(os.Stderr, "panic:", err)
+			}
+		}
+	}()
+
+	fmt.Fprintf(os.Stderr, "jamming %s into %s; Enter silences the drives, Ctrl-C stops\n", *midiIn, pf.port)
+	if err := bridge.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
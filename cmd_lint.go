@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/networks/capture"
+	"github.com/ystepanoff/goppy/internal/lint"
+)
+
+// cmdLint checks a byte stream sent to a device against the protocol,
+// frame by frame, with the firmware's own parser: from a capture, or live
+// from a serial port tapping the line until interrupted. It prints each
+// violation with its byte offset, or with --json the whole result for
+// other tools' tests, and fails if any is an error.
+func cmdLint(args []string) error {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	pf := addPortFlags(fs)
+	asJSON := fs.Bool("json", false, "print the result as JSON: bytes, frames and violations")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var result lint.Result
+	switch {
+	case fs.NArg() == 1 && pf.port == "":
+		chunks, err := capture.ReadFile(fs.Arg(0))
+		if err != nil {
+			return fmt.Errorf("read capture: %w", err)
+		}
+		result = lint.Check(capture.Stream(chunks))
+		if !*asJSON {
+			for _, v := range result.Violations {
+				fmt.Println(v)
+			}
+		}
+	case fs.NArg() == 0 && pf.port != "":
+		var err error
+		if result, err = lintLive(pf, !*asJSON); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("usage: goppy lint [--json] <capture.hex>, or goppy lint [--json] --port ... to listen live")
+	}
+
+	if *asJSON {
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	} else {
+		fmt.Printf("%d bytes, %d frames: %d errors, %d warnings, %d notes\n", result.Bytes, result.Frames,
+			result.Count(lint.Error), result.Count(lint.Warning), result.Count(lint.Info))
+	}
+	if n := result.Count(lint.Error); n > 0 {
+		return fmt.Errorf("%d protocol errors", n)
+	}
+	return nil
+}
+
+// lintLive lints what arrives on the port until Ctrl-C, printing each
+// violation as it is found if show is set.
+func lintLive(pf *portFlags, show bool) (lint.Result, error) {
+	result := lint.Result{Violations: []lint.Violation{}}
+	port, err := pf.open()
+	if err != nil {
+		return result, err
+	}
+	defer port.Close()
+	if err := port.SetReadTimeout(100 * time.Millisecond); err != nil {
+		return result, fmt.Errorf("set read timeout: %w", err)
+	}
+
+	stopCh := make(chan os.Signal, 1)
+	signal.Notify(stopCh, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stopCh)
+
+	l := lint.New(func(v lint.Violation) {
+		result.Violations = append(result.Violations, v)
+		if show {
+			fmt.Println(v)
+		}
+	})
+	fmt.Fprintf(os.Stderr, "listening on %s; Ctrl-C to stop\n", pf.port)
+	buf := make([]byte, 256)
+	for {
+		select {
+		case <-stopCh:
+			l.End()
+			result.Bytes, result.Frames = l.Bytes, l.Frames
+			return result, nil
+		default:
+		}
+		n, err := port.Read(buf)
+		if err != nil {
+			return result, fmt.Errorf("read: %w", err)
+		}
+		l.Write(buf[:n])
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller"
+	"github.com/ystepanoff/goppy/controller/mapping"
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/instruments"
+	"github.com/ystepanoff/goppy/firmware/notes"
+)
+
+// cmdMap works with mapping files. Its one subcommand, check, plays a
+// song through a mapping without a device and reports the notes that
+// would be dropped, by the mapping or by the drives, or folded into the
+// drives' range.
+func cmdMap(args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return fmt.Errorf("usage: goppy map check [--policy drop|fold|clamp] song.mid mapping.yaml")
+	}
+	fs := flag.NewFlagSet("map check", flag.ExitOnError)
+	policy := fs.String("policy", policyName(config.NoteRangePolicy), "the firmware's NoteRangePolicy for notes above the drives' range: drop, fold or clamp")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: goppy map check [--policy drop|fold|clamp] song.mid mapping.yaml")
+	}
+	p := slices.IndexFunc([]byte{config.RangeDrop, config.RangeClamp, config.RangeFold}, func(p byte) bool {
+		return policyName(p) == *policy
+	})
+	if p < 0 {
+		return fmt.Errorf("unknown --policy %q: want drop, fold or clamp", *policy)
+	}
+	song, mapFile := fs.Arg(0), fs.Arg(1)
+	events, err := controller.ReadSMF(song)
+	if err != nil {
+		return err
+	}
+	m, err := mapping.Load(mapFile)
+	if err != nil {
+		return err
+	}
+	checkMap(os.Stdout, controller.CheckMapping(events, m), byte(p))
+	return nil
+}
+
+func policyName(p byte) string {
+	switch p {
+	case config.RangeClamp:
+		return "clamp"
+	case config.RangeFold:
+		return "fold"
+	}
+	return "drop"
+}
+
+// mapFinding is what happens to every strike of one note on one channel.
+type mapFinding struct {
+	channel, note byte
+	what          string
+	count         int
+	first         time.Duration
+}
+
+// checkMap prints what checks found: a line per channel, note and fate
+// for notes not played as written, in channel and note order, and a
+// total. The drives' own transpose setting isn't known here, so is taken
+// as 0.
+func checkMap(w io.Writer, checks []controller.NoteCheck, policy byte) {
+	var findings []*mapFinding
+	played, dropped, moved := 0, 0, 0
+	for _, c := range checks {
+		what := ""
+		switch {
+		case c.Dropped != "":
+			what = "dropped: " + c.Dropped
+			dropped++
+		case c.Reset:
+		case c.Sent > instruments.MaxFloppyNote:
+			switch policy {
+			case config.RangeFold:
+				n := c.Sent
+				for n > instruments.MaxFloppyNote {
+					n -= 12
+				}
+				what = "folded to " + noteName(n) + " on " + c.To.String()
+				moved++
+			case config.RangeClamp:
+				what = "clamped to " + noteName(instruments.MaxFloppyNote) + " on " + c.To.String()
+				moved++
+			default:
+				what = "dropped by the drives: " + noteName(c.Sent) + " is above " + noteName(instruments.MaxFloppyNote)
+				dropped++
+			}
+		}
+		if what == "" {
+			played++
+			continue
+		}
+		i := slices.IndexFunc(findings, func(f *mapFinding) bool {
+			return f.channel == c.Channel && f.note == c.Note && f.what == what
+		})
+		if i < 0 {
+			findings = append(findings, &mapFinding{channel: c.Channel, note: c.Note, what: what, first: c.At})
+			i = len(findings) - 1
+		}
+		findings[i].count++
+	}
+	slices.SortStableFunc(findings, func(a, b *mapFinding) int {
+		return cmp.Or(cmp.Compare(a.channel, b.channel), cmp.Compare(a.note, b.note))
+	})
+	for _, f := range findings {
+		fmt.Fprintf(w, "channel %2d %-4s x%-4d from %-8s %s\n", f.channel+1, noteName(f.note), f.count, f.first.Round(time.Millisecond), f.what)
+	}
+	fmt.Fprintf(w, "%d notes: %d played, %d folded or clamped, %d dropped\n", len(checks), played, moved, dropped)
+}
+
+func noteName(n byte) string { return string(notes.Name(nil, n)) }
@@ -14,14 +14,32 @@ func cmdNote(args []string) error {
 	device := fs.Uint("device", 0x01, "target device address (1..127)")
 	drive := fs.Uint("drive", 1, "target drive sub-address (1..8)")
 	note := fs.Int("note", 60, "MIDI note number (0..127, 60 = middle C)")
+	velocity := fs.Uint("velocity", uint(protocol.DefaultVelocity), "note-on velocity (1..127); 100 and up is accented")
 	duration := fs.Duration("duration", 500*time.Millisecond,
 		"hold time before sending NOTE_OFF; 0 leaves the note ringing")
+	glissTo := fs.Int("gliss-to", -1, "slide from --note to this note instead of playing it steadily")
+	glissTime := fs.Duration("gliss-time", 500*time.Millisecond, "length of the --gliss-to slide")
+	smooth := fs.Bool("smooth", false, "slide continuously rather than in semitone steps")
+	trillWith := fs.Int("trill-with", -1, "alternate --note with this note instead of playing it steadily")
+	trillRate := fs.Duration("trill-rate", 60*time.Millisecond, "how long each --trill-with note lasts (1ms..255ms)")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
 	if *note < 0 || *note > 127 {
 		return fmt.Errorf("note out of range: %d (must be 0..127)", *note)
 	}
+	if *velocity == 0 || *velocity > 127 {
+		return fmt.Errorf("velocity out of range: %d (must be 1..127)", *velocity)
+	}
+	if *glissTo > 127 {
+		return fmt.Errorf("gliss target out of range: %d (must be 0..127)", *glissTo)
+	}
+	if *trillWith > 127 {
+		return fmt.Errorf("trill note out of range: %d (must be 0..127)", *trillWith)
+	}
+	if *trillWith >= 0 && *glissTo >= 0 {
+		return fmt.Errorf("--trill-with and --gliss-to can't be combined")
+	}
 	if *device == 0 || *device > 127 {
 		return fmt.Errorf("device address out of range: %d", *device)
 	}
@@ -38,14 +56,28 @@ func cmdNote(args []string) error {
 	dev := byte(*device)
 	sub := byte(*drive)
 
-	if _, err := port.Write(protocol.NoteOn(dev, sub, byte(*note))); err != nil {
-		return fmt.Errorf("write note on: %w", err)
+	off := byte(*note)
+	if *glissTo >= 0 {
+		off = byte(*glissTo)
+		if _, err := port.Write(protocol.Gliss(dev, sub, byte(*note), off, *glissTime, *smooth)); err != nil {
+			return fmt.Errorf("write gliss: %w", err)
+		}
+		fmt.Printf("gliss    → device=0x%02X drive=%d note=%d..%d over %s\n", dev, sub, *note, off, *glissTime)
+	} else if *trillWith >= 0 {
+		if _, err := port.Write(protocol.Trill(dev, sub, byte(*note), byte(*trillWith), *trillRate)); err != nil {
+			return fmt.Errorf("write trill: %w", err)
+		}
+		fmt.Printf("trill    → device=0x%02X drive=%d notes=%d/%d every %s\n", dev, sub, *note, *trillWith, *trillRate)
+	} else {
+		if _, err := port.Write(protocol.NoteOn(dev, sub, byte(*note), byte(*velocity))); err != nil {
+			return fmt.Errorf("write note on: %w", err)
+		}
+		fmt.Printf("note on  → device=0x%02X drive=%d note=%d\n", dev, sub, *note)
 	}
-	fmt.Printf("note on  → device=0x%02X drive=%d note=%d\n", dev, sub, *note)
 
 	if *duration > 0 {
 		time.Sleep(*duration)
-		if _, err := port.Write(protocol.NoteOff(dev, sub)); err != nil {
+		if _, err := port.Write(protocol.NoteOff(dev, sub, off)); err != nil {
 			return fmt.Errorf("write note off: %w", err)
 		}
 		fmt.Printf("note off → device=0x%02X drive=%d\n", dev, sub)
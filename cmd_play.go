@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"slices"
 	"sort"
 	"syscall"
 	"time"
@@ -21,6 +22,9 @@ func cmdPlay(args []string) error {
 	minDrive := fs.Uint("min-drive", 1, "first drive sub-address available for note allocation")
 	maxDrive := fs.Uint("max-drive", 8, "last drive sub-address available for note allocation")
 	noPing := fs.Bool("no-ping", false, "skip the discovery ping before playback")
+	lru := fs.Bool("lru", false, "give each note the drive idle longest instead of taking turns, to even out wear")
+	arp := fs.Bool("arp", false, "arpeggiate notes that don't fit on a free drive instead of dropping them")
+	arpRate := fs.Duration("arp-rate", 30*time.Millisecond, "how long each arpeggiated note sounds before the next")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
@@ -30,6 +34,9 @@ func cmdPlay(args []string) error {
 	if *minDrive == 0 || *maxDrive < *minDrive || *maxDrive > 255 {
 		return fmt.Errorf("invalid drive range %d..%d", *minDrive, *maxDrive)
 	}
+	if *arp && *arpRate <= 0 {
+		return fmt.Errorf("arp rate must be positive, got %s", *arpRate)
+	}
 	path := fs.Arg(0)
 
 	events, err := smf.Read(path)
@@ -55,6 +62,8 @@ func cmdPlay(args []string) error {
 
 	dev := byte(*device)
 	allocator := newDriveAllocator(byte(*minDrive), byte(*maxDrive))
+	allocator.arpEnabled = *arp
+	allocator.lru = *lru
 
 	stopCh := make(chan os.Signal, 1)
 	signal.Notify(stopCh, os.Interrupt, syscall.SIGTERM)
@@ -64,6 +73,7 @@ func cmdPlay(args []string) error {
 		return fmt.Errorf("send SEQ_START: %w", err)
 	}
 	defer func() {
+		_, _ = port.Write(protocol.AllNotesOff(dev))
 		_, _ = port.Write(protocol.SequenceStop())
 		_, _ = port.Write(protocol.Reset())
 	}()
@@ -72,42 +82,131 @@ func cmdPlay(args []string) error {
 		path, len(events), events[len(events)-1].At.Round(time.Millisecond))
 
 	start := time.Now()
-	for i, ev := range events {
-		select {
-		case <-stopCh:
-			fmt.Fprintln(os.Stderr, "interrupted, stopping")
-			return nil
-		default:
+	wait := func(at time.Duration) bool { return waitUntil(start, at, stopCh) }
+	write := func(frame []byte) error {
+		_, err := port.Write(frame)
+		return err
+	}
+	done, err := playEvents(events, dev, allocator, *arpRate, wait, write)
+	if err != nil {
+		return err
+	}
+	if !done {
+		fmt.Fprintln(os.Stderr, "interrupted, stopping")
+	}
+	return nil
+}
+
+// playEvents turns a sorted song into frames for device dev, allocating
+// drives with allocator, and hands each to write once wait says it is due.
+// wait is given each frame's offset from the start of the song and
+// returns false to stop early, in which case playEvents reports done as
+// false. cmdPlay waits on the clock; the simulator doesn't wait at all.
+func playEvents(events []smf.NoteEvent, dev byte, allocator *driveAllocator, arpRate time.Duration,
+	wait func(at time.Duration) bool, write func(frame []byte) error) (done bool, err error) {
+	var nextArp time.Duration // offset of the next arpeggio step; 0 while no arpeggio runs
+	for i := 0; i < len(events); {
+		ev := events[i]
+		due := ev.At
+		arpDue := nextArp > 0 && nextArp < due
+		if arpDue {
+			due = nextArp
+		}
+		if !wait(due) {
+			return false, nil
 		}
 
-		wait := ev.At - time.Since(start)
-		if wait > 0 {
-			timer := time.NewTimer(wait)
-			select {
-			case <-timer.C:
-			case <-stopCh:
-				timer.Stop()
-				fmt.Fprintln(os.Stderr, "interrupted, stopping")
-				return nil
+		var cmds []driveCmd
+		if arpDue {
+			cmds = allocator.arpStep()
+			nextArp += arpRate
+		} else {
+			switch ev.Kind {
+			case smf.EventNoteOn:
+				cmds = allocator.assign(ev.Channel, ev.Note)
+				for j := range cmds {
+					if cmds[j].on && cmds[j].note == ev.Note {
+						cmds[j].velocity = ev.Velocity
+					}
+				}
+			case smf.EventNoteOff:
+				cmds = allocator.release(ev.Channel, ev.Note)
+			case smf.EventSustain:
+				if allocator.setPedal(ev.Channel, ev.Velocity >= 64) {
+					if err := write(protocol.Sustain(dev, 0x00, allocator.sustaining())); err != nil {
+						return false, fmt.Errorf("event %d: write SUSTAIN: %w", i, err)
+					}
+				}
+			case smf.EventPressure:
+				for _, d := range allocator.channelDrives(ev.Channel) {
+					if err := write(protocol.ChannelPressure(dev, d, ev.Velocity)); err != nil {
+						return false, fmt.Errorf("event %d: write PRESSURE: %w", i, err)
+					}
+				}
+			case smf.EventPitchBend:
+				for _, d := range allocator.channelDrives(ev.Channel) {
+					if err := write(protocol.PitchBend(dev, d, ev.Bend)); err != nil {
+						return false, fmt.Errorf("event %d: write BEND: %w", i, err)
+					}
+				}
+			case smf.EventBendRange:
+				// Drives aren't tied to channels, so the range is device-wide.
+				semis := max(1, min(ev.Velocity, 24))
+				if err := write(protocol.BendRange(dev, 0x00, semis)); err != nil {
+					return false, fmt.Errorf("event %d: write BEND_RANGE: %w", i, err)
+				}
 			}
+			i++
+		}
+		if allocator.arpDrive == 0 {
+			nextArp = 0
+		} else if nextArp == 0 {
+			nextArp = due + arpRate
 		}
 
-		switch ev.Kind {
-		case smf.EventNoteOn:
-			drive, ok := allocator.assign(ev.Channel, ev.Note)
-			if !ok {
-				continue
-			}
-			if _, err := port.Write(protocol.NoteOn(dev, drive, ev.Note)); err != nil {
-				return fmt.Errorf("event %d: write NOTE_ON: %w", i, err)
+		if err := sendDriveCmds(write, dev, cmds); err != nil {
+			return false, fmt.Errorf("event %d: %w", i, err)
+		}
+	}
+	return true, nil
+}
+
+// waitUntil sleeps until offset at from start. It returns false if a stop
+// signal arrives first.
+func waitUntil(start time.Time, at time.Duration, stopCh <-chan os.Signal) bool {
+	select {
+	case <-stopCh:
+		return false
+	default:
+	}
+
+	wait := at - time.Since(start)
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stopCh:
+		return false
+	}
+}
+
+func sendDriveCmds(write func(frame []byte) error, dev byte, cmds []driveCmd) error {
+	for _, c := range cmds {
+		if c.on {
+			v := c.velocity
+			if v == 0 {
+				v = protocol.DefaultVelocity
 			}
-		case smf.EventNoteOff:
-			drive, ok := allocator.release(ev.Channel, ev.Note)
-			if !ok {
-				continue
+			if err := write(protocol.NoteOn(dev, c.drive, c.note, v)); err != nil {
+				return fmt.Errorf("write NOTE_ON: %w", err)
 			}
-			if _, err := port.Write(protocol.NoteOff(dev, drive)); err != nil {
-				return fmt.Errorf("event %d: write NOTE_OFF: %w", i, err)
+		} else {
+			if err := write(protocol.NoteOff(dev, c.drive, c.note)); err != nil {
+				return fmt.Errorf("write NOTE_OFF: %w", err)
 			}
 		}
 	}
@@ -130,33 +229,119 @@ func pingAndPrint(port serial.Port) error {
 	return port.SetReadTimeout(serial.NoTimeout)
 }
 
+// driveCmd is a single NOTE_ON (on=true) or NOTE_OFF the allocator wants sent.
+type driveCmd struct {
+	drive    byte
+	note     byte
+	on       bool
+	velocity byte // note-ons only; 0 sends protocol.DefaultVelocity
+}
+
 // driveAllocator hands out drive sub-addresses for active notes.
 // Each (channel, note) maps to at most one drive; round-robin across the
-// configured range when notes overlap. If all drives are in use, new notes
-// are dropped silently.
+// configured range when notes overlap (least recently used with lru). If
+// all drives are in use, a drive still ringing under the sustain pedal is
+// stolen; failing that, new notes are dropped silently unless arpEnabled is
+// set, in which case the last drive in the range is turned over to cycling
+// through the overflow notes.
+//
+// The sustain pedal is tracked per channel but applied device-wide: the
+// firmware holds every drive while any channel has its pedal down.
 type driveAllocator struct {
 	min, max byte
 	next     byte
 	active   map[uint16]byte
 	used     map[byte]bool
+
+	// lru picks the free drive idle longest rather than the next in turn.
+	// lastUsed holds each drive's note-on count at its latest note.
+	lru      bool
+	lastUsed map[byte]uint64
+	notes    uint64
+
+	// held marks drives whose note was released under the sustain pedal.
+	// They stay used until the pedal lifts.
+	pedal [16]bool
+	held  map[byte]bool
+
+	// Arpeggio fallback. arpNotes holds the (channel, note) keys sharing
+	// arpDrive, oldest first; arpPos indexes the one currently sounding.
+	arpEnabled bool
+	arpDrive   byte // 0 while no arpeggio is running
+	arpNotes   []uint16
+	arpPos     int
 }
 
 func newDriveAllocator(min, max byte) *driveAllocator {
 	return &driveAllocator{
-		min:    min,
-		max:    max,
-		next:   min,
-		active: make(map[uint16]byte),
-		used:   make(map[byte]bool),
+		min:      min,
+		max:      max,
+		next:     min,
+		active:   make(map[uint16]byte),
+		used:     make(map[byte]bool),
+		lastUsed: make(map[byte]uint64),
+		held:     make(map[byte]bool),
 	}
 }
 
 func noteKey(channel, note byte) uint16 { return uint16(channel)<<8 | uint16(note) }
 
-func (a *driveAllocator) assign(channel, note byte) (byte, bool) {
+func keyNote(k uint16) byte { return byte(k) }
+
+func (a *driveAllocator) assign(channel, note byte) []driveCmd {
 	k := noteKey(channel, note)
 	if d, ok := a.active[k]; ok {
-		return d, true
+		return []driveCmd{{drive: d, note: note, on: true}}
+	}
+	if a.arpIndex(k) >= 0 {
+		return nil
+	}
+	if d := a.freeDrive(); d != 0 {
+		a.used[d] = true
+		a.active[k] = d
+		a.notes++
+		a.lastUsed[d] = a.notes
+		return []driveCmd{{drive: d, note: note, on: true}}
+	}
+	for d := a.min; len(a.held) > 0; d++ {
+		if a.held[d] {
+			// The new note-on replaces the sustained one in the firmware.
+			delete(a.held, d)
+			a.active[k] = d
+			return []driveCmd{{drive: d, note: note, on: true}}
+		}
+	}
+	if !a.arpEnabled {
+		return nil
+	}
+
+	if a.arpDrive == 0 {
+		// Every drive is busy: fold the last drive's note into a new arpeggio.
+		for owner, d := range a.active {
+			if d == a.max {
+				delete(a.active, owner)
+				a.arpNotes = append(a.arpNotes[:0], owner)
+				break
+			}
+		}
+		a.arpDrive = a.max
+	}
+	a.arpNotes = append(a.arpNotes, k)
+	a.arpPos = len(a.arpNotes) - 1
+	return []driveCmd{{drive: a.arpDrive, note: note, on: true}}
+}
+
+// freeDrive returns an unused drive, or 0 if there is none: the next one
+// round-robin, or with lru set the one whose last note is oldest.
+func (a *driveAllocator) freeDrive() byte {
+	if a.lru {
+		var best byte
+		for d := int(a.min); d <= int(a.max); d++ {
+			if !a.used[byte(d)] && (best == 0 || a.lastUsed[byte(d)] < a.lastUsed[best]) {
+				best = byte(d)
+			}
+		}
+		return best
 	}
 	for i := 0; i <= int(a.max-a.min); i++ {
 		d := a.next
@@ -165,21 +350,122 @@ func (a *driveAllocator) assign(channel, note byte) (byte, bool) {
 			a.next = a.min
 		}
 		if !a.used[d] {
-			a.used[d] = true
-			a.active[k] = d
-			return d, true
+			return d
 		}
 	}
-	return 0, false
+	return 0
 }
 
-func (a *driveAllocator) release(channel, note byte) (byte, bool) {
+func (a *driveAllocator) release(channel, note byte) []driveCmd {
 	k := noteKey(channel, note)
+	if i := a.arpIndex(k); i >= 0 {
+		return a.removeArpNote(i)
+	}
 	d, ok := a.active[k]
 	if !ok {
-		return 0, false
+		return nil
 	}
 	delete(a.active, k)
-	delete(a.used, d)
-	return d, true
+
+	if a.arpDrive != 0 {
+		// Promote the longest-waiting arpeggio note to the freed drive.
+		p := a.arpNotes[0]
+		a.active[p] = d
+		cmds := []driveCmd{{drive: d, note: keyNote(p), on: true}}
+		return append(cmds, a.removeArpNote(0)...)
+	}
+	if a.sustaining() {
+		a.held[d] = true
+	} else {
+		delete(a.used, d)
+	}
+	return []driveCmd{{drive: d, note: note}}
+}
+
+// setPedal records a channel's sustain pedal and reports whether that changed
+// the device-wide pedal state.
+func (a *driveAllocator) setPedal(channel byte, down bool) bool {
+	was := a.sustaining()
+	a.pedal[channel&0x0F] = down
+	if was == a.sustaining() {
+		return false
+	}
+	if !was {
+		return true
+	}
+	// Pedal lifted: the firmware silences the held drives itself.
+	for d := range a.held {
+		delete(a.used, d)
+	}
+	clear(a.held)
+	return true
+}
+
+func (a *driveAllocator) sustaining() bool {
+	for _, down := range a.pedal {
+		if down {
+			return true
+		}
+	}
+	return false
+}
+
+// arpStep advances the arpeggio drive to its next note.
+// channelDrives returns the drives sounding a note from channel, in
+// drive order.
+func (a *driveAllocator) channelDrives(channel byte) []byte {
+	var drives []byte
+	for k, d := range a.active {
+		if byte(k>>8) == channel && !slices.Contains(drives, d) {
+			drives = append(drives, d)
+		}
+	}
+	slices.Sort(drives)
+	return drives
+}
+
+func (a *driveAllocator) arpStep() []driveCmd {
+	if a.arpDrive == 0 {
+		return nil
+	}
+	a.arpPos = (a.arpPos + 1) % len(a.arpNotes)
+	return []driveCmd{{drive: a.arpDrive, note: keyNote(a.arpNotes[a.arpPos]), on: true}}
+}
+
+func (a *driveAllocator) arpIndex(k uint16) int {
+	for i, n := range a.arpNotes {
+		if n == k {
+			return i
+		}
+	}
+	return -1
+}
+
+// removeArpNote drops arpNotes[i]. Once a single note is left the arpeggio
+// ends and that note keeps the drive as an ordinary assignment.
+func (a *driveAllocator) removeArpNote(i int) []driveCmd {
+	removed := keyNote(a.arpNotes[i])
+	a.arpNotes = append(a.arpNotes[:i], a.arpNotes[i+1:]...)
+	switch len(a.arpNotes) {
+	case 0:
+		d := a.arpDrive
+		a.arpDrive = 0
+		delete(a.used, d)
+		return []driveCmd{{drive: d, note: removed}}
+	case 1:
+		d, k := a.arpDrive, a.arpNotes[0]
+		a.active[k] = d
+		a.arpDrive = 0
+		a.arpNotes = a.arpNotes[:0]
+		return []driveCmd{{drive: d, note: keyNote(k), on: true}}
+	}
+
+	if i < a.arpPos {
+		a.arpPos--
+	} else if i == a.arpPos {
+		// The sounding note went away; move straight on to its successor.
+		a.arpPos %= len(a.arpNotes)
+		return []driveCmd{{drive: a.arpDrive, note: keyNote(a.arpNotes[a.arpPos]), on: true}}
+	}
+	return nil
 }
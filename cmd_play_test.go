@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/fakeclock"
+	"github.com/ystepanoff/goppy/internal/protocol"
+	"github.com/ystepanoff/goppy/internal/smf"
+)
+
+// timeline plays song through playEvents on a fake clock and returns what
+// it sent, one "at drive on|off note" line per frame.
+func timeline(t *testing.T, song []smf.NoteEvent, allocator *driveAllocator, arpRate time.Duration) []string {
+	t.Helper()
+	clock := fakeclock.New()
+	var got []string
+	wait := func(at time.Duration) bool {
+		clock.Advance(at - clock.Now())
+		return true
+	}
+	write := func(frame []byte) error {
+		f, err := protocol.ReadFrame(bytes.NewReader(frame))
+		if err != nil {
+			return err
+		}
+		what := "off"
+		if f.Command == config.DevCmdNoteOn {
+			what = "on"
+		}
+		got = append(got, fmt.Sprintf("%v %d %s %d", clock.Now(), f.SubAddress, what, f.Payload[0]))
+		return nil
+	}
+	if _, err := playEvents(song, 1, allocator, arpRate, wait, write); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+// TestArpeggio plays a six-note chord on four drives: the fourth drive
+// cycles through the three notes that don't fit, every 30ms, until a
+// note-off frees a drive for the longest-waiting one and another leaves a
+// single note on the arpeggio drive.
+func TestArpeggio(t *testing.T) {
+	chord := []byte{60, 64, 67, 71, 74, 77}
+	var song []smf.NoteEvent
+	for _, n := range chord {
+		song = append(song, smf.NoteEvent{Kind: smf.EventNoteOn, Note: n, Velocity: 100})
+	}
+	off := func(at time.Duration, note byte) {
+		song = append(song, smf.NoteEvent{At: at, Kind: smf.EventNoteOff, Note: note})
+	}
+	off(100*time.Millisecond, 64)
+	off(200*time.Millisecond, 74)
+	for _, n := range []byte{60, 67, 71, 77} {
+		off(300*time.Millisecond, n)
+	}
+
+	allocator := newDriveAllocator(1, 4)
+	allocator.arpEnabled = true
+	got := timeline(t, song, allocator, 30*time.Millisecond)
+	want := []string{
+		"0s 1 on 60",
+		"0s 2 on 64",
+		"0s 3 on 67",
+		"0s 4 on 71",
+		"0s 4 on 74", // 71 and 74 share drive 4
+		"0s 4 on 77",
+		"30ms 4 on 71",
+		"60ms 4 on 74",
+		"90ms 4 on 77",
+		"100ms 2 on 71", // 64's drive goes to 71, waiting longest
+		"120ms 4 on 74",
+		"150ms 4 on 77",
+		"180ms 4 on 74",
+		"200ms 4 on 77", // 77 alone keeps drive 4
+		"300ms 1 off 60",
+		"300ms 3 off 67",
+		"300ms 2 off 71",
+		"300ms 4 off 77",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("timeline:\n%q\nwant:\n%q", got, want)
+	}
+	if allocator.arpDrive != 0 || len(allocator.used) != 0 {
+		t.Errorf("arpeggio drive %d, drives used %v after the chord", allocator.arpDrive, allocator.used)
+	}
+}
+
+// TestArpeggioOff drops the notes that don't fit with the arpeggio off.
+func TestArpeggioOff(t *testing.T) {
+	var song []smf.NoteEvent
+	for _, n := range []byte{60, 64, 67} {
+		song = append(song, smf.NoteEvent{Kind: smf.EventNoteOn, Note: n, Velocity: 100})
+	}
+	got := timeline(t, song, newDriveAllocator(1, 2), 30*time.Millisecond)
+	want := []string{"0s 1 on 60", "0s 2 on 64"}
+	if !slices.Equal(got, want) {
+		t.Errorf("timeline %q, want %q", got, want)
+	}
+}
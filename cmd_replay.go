@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/networks"
+	"github.com/ystepanoff/goppy/firmware/networks/capture"
+	"github.com/ystepanoff/goppy/firmware/networks/networkstest"
+	wire "github.com/ystepanoff/goppy/firmware/protocol"
+	"github.com/ystepanoff/goppy/internal/protocol"
+)
+
+// cmdReplay feeds a capture, as --record writes it, through the
+// firmware's own parser, built with the current firmware config, and logs
+// every message it dispatches and every reply it sends. With --assert it
+// checks them against a golden file, as the conformance tests do.
+func cmdReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "replay speed: 1 keeps the capture's timing, 4 is four times as fast, 0 doesn't wait at all")
+	assert := fs.String("assert", "", "golden JSON file the dispatched messages and replies must match")
+	update := fs.Bool("update", false, "rewrite the --assert file from this replay instead of checking it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return fmt.Errorf("usage: goppy replay [flags] <capture.hex>")
+	}
+	if *speed < 0 {
+		return fmt.Errorf("speed must not be negative, got %g", *speed)
+	}
+	if *update && *assert == "" {
+		return fmt.Errorf("--update needs the golden file to write in --assert")
+	}
+
+	chunks, err := capture.ReadFile(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("read capture: %w", err)
+	}
+
+	port := networkstest.NewMockPort()
+	rec := &networkstest.Recorder{}
+	s := networks.NewSerialPort(rec, port)
+
+	start := time.Now()
+	var (
+		calls, written int
+		describer      protocol.Describer
+	)
+	for _, c := range chunks {
+		if *speed > 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(float64(c.At) / *speed))))
+		}
+		port.Feed(c.Data...)
+		s.ReadMessages()
+
+		for _, call := range rec.Calls[calls:] {
+			fmt.Printf("%s  %s\n", protocol.Stamp(c.At), describer.Describe(callMessage(call)))
+		}
+		calls = len(rec.Calls)
+		for _, frame := range capture.NewOutcome(nil, port.Written[written:]).Written {
+			fmt.Printf("%s  reply % x\n", protocol.Stamp(c.At), []byte(frame))
+		}
+		written = len(port.Written)
+	}
+
+	st := s.Stats
+	fmt.Printf("parser: %d frames, %d bytes skipped, %d for other devices, %d bad sub addresses, %d empty frames\n",
+		st.Frames, st.SkippedBytes, st.OtherDevice, st.BadSubAddress, st.EmptyFrames)
+
+	if *assert == "" {
+		return nil
+	}
+	got := capture.NewOutcome(rec.Calls, port.Written)
+	if *update {
+		if err := capture.WriteOutcome(*assert, got); err != nil {
+			return fmt.Errorf("write golden: %w", err)
+		}
+		fmt.Printf("wrote %s\n", *assert)
+		return nil
+	}
+	want, err := capture.ReadOutcome(*assert)
+	if err != nil {
+		return fmt.Errorf("read golden: %w", err)
+	}
+	if err := compareOutcome(got, want); err != nil {
+		return fmt.Errorf("%s: %w", *assert, err)
+	}
+	fmt.Printf("matches %s\n", *assert)
+	return nil
+}
+
+// compareOutcome reports the first call or reply where got and want part.
+func compareOutcome(got, want capture.Outcome) error {
+	if err := compareList("call", got.Calls, want.Calls); err != nil {
+		return err
+	}
+	return compareList("reply", got.Written, want.Written)
+}
+
+func compareList[T any](what string, got, want []T) error {
+	for i := range min(len(got), len(want)) {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			return fmt.Errorf("%s %d differs\n got: %s\nwant: %s", what, i+1, showJSON(got[i]), showJSON(want[i]))
+		}
+	}
+	switch {
+	case len(got) > len(want):
+		return fmt.Errorf("%d %ss, want %d; the first extra: %s", len(got), what, len(want), showJSON(got[len(want)]))
+	case len(got) < len(want):
+		return fmt.Errorf("%d %ss, want %d; the first missing: %s", len(got), what, len(want), showJSON(want[len(got)]))
+	}
+	return nil
+}
+
+// showJSON renders v as the golden files do.
+func showJSON(v any) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// callMessage is the message a dispatched call was, for the replay log:
+// a system message, or one for the device the firmware is built as.
+func callMessage(c networkstest.Call) wire.Message {
+	m := wire.Message{Device: config.DeviceAddress, Sub: c.SubAddress, Command: c.Command, Payload: c.Payload}
+	if c.System {
+		m.Device = protocol.SystemAddress
+	}
+	return m
+}
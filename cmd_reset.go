@@ -10,8 +10,9 @@ import (
 func cmdReset(args []string) error {
 	fs := flag.NewFlagSet("reset", flag.ExitOnError)
 	pf := addPortFlags(fs)
-	device := fs.Uint("device", 0x01, "target device address (only used with --drive)")
+	device := fs.Uint("device", 0x01, "target device address (only used with --drive or --factory)")
 	drive := fs.Int("drive", -1, "specific drive to reset; omit to broadcast a system RESET to all devices")
+	factory := fs.Bool("factory", false, "erase saved settings and restore defaults on --device (or just --drive) instead of homing")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
@@ -22,6 +23,20 @@ func cmdReset(args []string) error {
 	}
 	defer port.Close()
 
+	if *factory {
+		sub := 0
+		if *drive >= 0 {
+			sub = *drive
+		}
+		if sub > 255 {
+			return fmt.Errorf("drive sub-address out of range: %d", sub)
+		}
+		if _, err := port.Write(protocol.FactoryReset(byte(*device), byte(sub))); err != nil {
+			return fmt.Errorf("write factory reset: %w", err)
+		}
+		fmt.Printf("factory reset → device=0x%02X drive=%d\n", *device, sub)
+		return nil
+	}
 	if *drive < 0 {
 		if _, err := port.Write(protocol.Reset()); err != nil {
 			return fmt.Errorf("write system reset: %w", err)
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/ystepanoff/goppy/internal/protocol"
+)
+
+func cmdSet(args []string) error {
+	fs := flag.NewFlagSet("set", flag.ExitOnError)
+	pf := addPortFlags(fs)
+	device := fs.Uint("device", 0x01, "target device address (1..127)")
+	drive := fs.Uint("drive", 0, "drive sub-address to configure; 0 applies to every drive")
+	transpose := fs.Int("transpose", 0, "signed semitone offset applied to later notes (-127..127)")
+	detune := fs.Int("detune", 0, "fine tuning in cents (-127..127)")
+	bendRange := fs.Uint("bend-range", 2, "semitones a full pitch bend reaches (1..24)")
+	tremolo := fs.Uint("tremolo", 0, "tremolo rate in Hz (0..255); 0 turns tremolo off")
+	tremoloDuty := fs.Uint("tremolo-duty", 50, "percentage of each --tremolo cycle the note sounds (0..100)")
+	accentMs := fs.Uint("accent-ms", 0, "length of the attack on accented notes (velocity >= 100) in ms; 0 disables accents")
+	accentStyle := fs.String("accent-style", "octave", "accented attack: octave (one octave down) or double (twice the step rate)")
+	vibratoRate := fs.Uint("vibrato-rate", 6, "speed of aftertouch vibrato in Hz (0..255); 0 disables it")
+	vibratoDepth := fs.Uint("vibrato-depth", 50, "aftertouch vibrato depth in cents at full pressure (0..255)")
+	registerTravel := fs.Bool("register-travel", false, "narrow head travel for higher notes (half from --split-low, a quarter from --split-high)")
+	splitLow := fs.Uint("split-low", 48, "lowest note given half head travel with --register-travel")
+	splitHigh := fs.Uint("split-high", 72, "lowest note given quarter head travel with --register-travel")
+	legato := fs.Bool("legato", false, "mono legato: a note-off returns to the most recent note still held instead of stopping")
+	startDelay := fs.Duration("start-delay", 0, "hold every note-on back this long (0..20ms) to line up with faster instruments")
+	cadence := fs.Uint("cadence", 0, "reverse head direction every N steps; 0 bounces only at the travel limits")
+	calibration := fs.Uint("calibration", 0, "steps from the end stop to position 0 after a reset (0..255)")
+	zone := fs.Uint("zone", 0, "zone number to define (1..4); its alias sub-address is 0x0F+zone")
+	travel := fs.String("travel", "", "head travel window in steps, e.g. 40-80 (0..158)")
+	travelSteps := fs.String("travel-steps", "", "scanner carriage travel window in steps, e.g. 200-2800")
+	phrase := fs.Bool("phrase", false, "scanners: reverse the carriage only between notes")
+	pulseWidth := fs.Duration("pulse-width", 0, "Tesla coil interrupters: pulse width in 10µs steps (0..2.55ms); the firmware's safety limits still apply")
+	zoneDrives := fs.String("zone-drives", "", "drive range for --zone, e.g. 3-6; empty clears the zone")
+	zoneMode := fs.String("zone-mode", "pool", "--zone mode: pool (one drive per note, taking turns), lru (one drive per note, idlest first) or unison (all drives)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *device == 0 || *device > 127 {
+		return fmt.Errorf("device address out of range: %d", *device)
+	}
+	if *drive > 255 {
+		return fmt.Errorf("drive sub-address out of range: %d", *drive)
+	}
+
+	dev := byte(*device)
+	sub := byte(*drive)
+
+	// Only send the settings that were given on the command line.
+	var frames [][]byte
+	var errs []error
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "transpose":
+			if *transpose < -127 || *transpose > 127 {
+				errs = append(errs, fmt.Errorf("transpose out of range: %d", *transpose))
+				return
+			}
+			frames = append(frames, protocol.Transpose(dev, sub, int8(*transpose)))
+		case "detune":
+			if *detune < -127 || *detune > 127 {
+				errs = append(errs, fmt.Errorf("detune out of range: %d", *detune))
+				return
+			}
+			frames = append(frames, protocol.Detune(dev, sub, int8(*detune)))
+		case "bend-range":
+			if *bendRange < 1 || *bendRange > 24 {
+				errs = append(errs, fmt.Errorf("bend range out of range: %d (must be 1..24)", *bendRange))
+				return
+			}
+			frames = append(frames, protocol.BendRange(dev, sub, byte(*bendRange)))
+		case "tremolo":
+			if *tremolo > 255 {
+				errs = append(errs, fmt.Errorf("tremolo rate out of range: %d", *tremolo))
+				return
+			}
+			if *tremoloDuty > 100 {
+				errs = append(errs, fmt.Errorf("tremolo duty out of range: %d (must be 0..100)", *tremoloDuty))
+				return
+			}
+			frames = append(frames, protocol.Tremolo(dev, sub, byte(*tremolo), byte(*tremoloDuty)))
+		case "accent-ms":
+			if *accentMs > 255 {
+				errs = append(errs, fmt.Errorf("accent length out of range: %d (must be 0..255)", *accentMs))
+				return
+			}
+			frames = append(frames, protocol.SetOption(dev, sub, protocol.OptAccentMs, byte(*accentMs)))
+		case "accent-style":
+			var style byte
+			switch *accentStyle {
+			case "octave":
+				style = protocol.AccentOctaveDown
+			case "double":
+				style = protocol.AccentDoubleRate
+			default:
+				errs = append(errs, fmt.Errorf("unknown accent style %q (want octave or double)", *accentStyle))
+				return
+			}
+			frames = append(frames, protocol.SetOption(dev, sub, protocol.OptAccentStyle, style))
+		case "vibrato-rate":
+			if *vibratoRate > 255 {
+				errs = append(errs, fmt.Errorf("vibrato rate out of range: %d", *vibratoRate))
+				return
+			}
+			frames = append(frames, protocol.SetOption(dev, sub, protocol.OptVibratoRate, byte(*vibratoRate)))
+		case "vibrato-depth":
+			if *vibratoDepth > 255 {
+				errs = append(errs, fmt.Errorf("vibrato depth out of range: %d", *vibratoDepth))
+				return
+			}
+			frames = append(frames, protocol.SetOption(dev, sub, protocol.OptVibratoDepth, byte(*vibratoDepth)))
+		case "register-travel":
+			var on byte
+			if *registerTravel {
+				on = 1
+			}
+			frames = append(frames, protocol.SetOption(dev, sub, protocol.OptRegisterTravel, on))
+		case "split-low":
+			if *splitLow > 127 {
+				errs = append(errs, fmt.Errorf("split note out of range: %d", *splitLow))
+				return
+			}
+			frames = append(frames, protocol.SetOption(dev, sub, protocol.OptTravelSplitLow, byte(*splitLow)))
+		case "split-high":
+			if *splitHigh > 127 {
+				errs = append(errs, fmt.Errorf("split note out of range: %d", *splitHigh))
+				return
+			}
+			frames = append(frames, protocol.SetOption(dev, sub, protocol.OptTravelSplitHigh, byte(*splitHigh)))
+		case "legato":
+			var on byte
+			if *legato {
+				on = 1
+			}
+			frames = append(frames, protocol.SetOption(dev, sub, protocol.OptLegato, on))
+		case "start-delay":
+			if *startDelay < 0 || *startDelay > 20*time.Millisecond {
+				errs = append(errs, fmt.Errorf("start delay out of range: %s (must be 0..20ms)", *startDelay))
+				return
+			}
+			frames = append(frames, protocol.SetOption(dev, sub, protocol.OptStartDelay, byte(startDelay.Milliseconds())))
+		case "cadence":
+			if *cadence > 255 {
+				errs = append(errs, fmt.Errorf("cadence out of range: %d", *cadence))
+				return
+			}
+			frames = append(frames, protocol.SetOption(dev, sub, protocol.OptDirCadence, byte(*cadence)))
+		case "calibration":
+			if *calibration > 255 {
+				errs = append(errs, fmt.Errorf("calibration out of range: %d", *calibration))
+				return
+			}
+			frames = append(frames, protocol.SetOption(dev, sub, protocol.OptCalibration, byte(*calibration)))
+		case "travel":
+			var lo, hi uint
+			if _, err := fmt.Sscanf(*travel, "%d-%d", &lo, &hi); err != nil {
+				errs = append(errs, fmt.Errorf("bad --travel %q (want e.g. 40-80)", *travel))
+				return
+			}
+			if lo >= hi || hi > protocol.MaxPosition {
+				errs = append(errs, fmt.Errorf("invalid travel window %d-%d (want min < max <= %d)", lo, hi, protocol.MaxPosition))
+				return
+			}
+			frames = append(frames, protocol.SetTravel(dev, sub, byte(lo), byte(hi)))
+		case "travel-steps":
+			var lo, hi uint
+			if _, err := fmt.Sscanf(*travelSteps, "%d-%d", &lo, &hi); err != nil {
+				errs = append(errs, fmt.Errorf("bad --travel-steps %q (want e.g. 200-2800)", *travelSteps))
+				return
+			}
+			if lo >= hi || hi > 0xFFFF {
+				errs = append(errs, fmt.Errorf("invalid travel window %d-%d", lo, hi))
+				return
+			}
+			frames = append(frames, protocol.SetTravelSteps(dev, sub, uint16(lo), uint16(hi)))
+		case "phrase":
+			var on byte
+			if *phrase {
+				on = 1
+			}
+			frames = append(frames, protocol.SetOption(dev, sub, protocol.OptPhraseMode, on))
+		case "pulse-width":
+			if *pulseWidth < 0 || *pulseWidth > 2550*time.Microsecond {
+				errs = append(errs, fmt.Errorf("pulse width out of range: %s (must be 0..2.55ms)", *pulseWidth))
+				return
+			}
+			frames = append(frames, protocol.SetOption(dev, sub, protocol.OptPulseWidth, byte(*pulseWidth/(10*time.Microsecond))))
+		case "zone":
+			f, err := zoneFrame(dev, *zone, *zoneDrives, *zoneMode)
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			frames = append(frames, f)
+		}
+	})
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	if len(frames) == 0 {
+		return fmt.Errorf("nothing to set (try `goppy set -h`)")
+	}
+
+	port, err := pf.open()
+	if err != nil {
+		return err
+	}
+	defer port.Close()
+
+	for _, f := range frames {
+		if _, err := port.Write(f); err != nil {
+			return fmt.Errorf("write setting: %w", err)
+		}
+	}
+	fmt.Printf("%d setting(s) sent → device=0x%02X drive=%d\n", len(frames), dev, sub)
+	return nil
+}
+
+func zoneFrame(dev byte, zone uint, drives, mode string) ([]byte, error) {
+	if zone == 0 || zone > 4 {
+		return nil, fmt.Errorf("zone out of range: %d (must be 1..4)", zone)
+	}
+	var m byte
+	switch mode {
+	case "pool":
+		m = protocol.ZonePool
+	case "lru":
+		m = protocol.ZonePoolLRU
+	case "unison":
+		m = protocol.ZoneUnison
+	default:
+		return nil, fmt.Errorf("unknown zone mode %q (want pool, lru or unison)", mode)
+	}
+	if drives == "" {
+		return protocol.SetZone(dev, byte(zone), 0, 0, m), nil
+	}
+	var first, last uint
+	if _, err := fmt.Sscanf(drives, "%d-%d", &first, &last); err != nil {
+		return nil, fmt.Errorf("bad --zone-drives %q (want e.g. 3-6)", drives)
+	}
+	if first == 0 || last < first || last > 255 {
+		return nil, fmt.Errorf("invalid zone drive range %d-%d", first, last)
+	}
+	return protocol.SetZone(dev, byte(zone), byte(first), byte(last), m), nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/sim"
+	"github.com/ystepanoff/goppy/firmware/simview"
+	"github.com/ystepanoff/goppy/internal/protocol"
+	"github.com/ystepanoff/goppy/internal/smf"
+)
+
+// cmdSim renders a MIDI file to a WAV file through the firmware's own
+// drive code, as built with the current firmware config, so a song can be
+// heard before the rig is set up.
+func cmdSim(args []string) error {
+	fs := flag.NewFlagSet("sim", flag.ExitOnError)
+	minDrive := fs.Uint("min-drive", 1, "first drive sub-address available for note allocation")
+	maxDrive := fs.Uint("max-drive", config.NumDrives, "last drive sub-address available for note allocation")
+	lru := fs.Bool("lru", false, "give each note the drive idle longest instead of taking turns")
+	arp := fs.Bool("arp", false, "arpeggiate notes that don't fit on a free drive instead of dropping them")
+	arpRate := fs.Duration("arp-rate", 30*time.Millisecond, "how long each arpeggiated note sounds before the next")
+	tail := fs.Duration("tail", time.Second, "silence rendered after the last event")
+	view := fs.Bool("view", false, "play in real time with a dashboard of the drives; type p or space then Enter to pause, s then Enter to step one tick")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		return fmt.Errorf("usage: goppy sim [flags] <song.mid> <out.wav>")
+	}
+	if *minDrive == 0 || *maxDrive < *minDrive || *maxDrive > config.NumDrives {
+		return fmt.Errorf("invalid drive range %d..%d (the firmware has %d drives)", *minDrive, *maxDrive, config.NumDrives)
+	}
+	if *arp && *arpRate <= 0 {
+		return fmt.Errorf("arp rate must be positive, got %s", *arpRate)
+	}
+	if *tail < 0 {
+		return fmt.Errorf("tail must not be negative, got %s", *tail)
+	}
+	in, out := fs.Arg(0), fs.Arg(1)
+
+	events, err := smf.Read(in)
+	if err != nil {
+		return fmt.Errorf("read midi: %w", err)
+	}
+	if len(events) == 0 {
+		return fmt.Errorf("midi file contains no note events")
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At < events[j].At })
+
+	dev := config.DeviceAddress
+	allocator := newDriveAllocator(byte(*minDrive), byte(*maxDrive))
+	allocator.arpEnabled = *arp
+	allocator.lru = *lru
+
+	// Play the song without waiting, stamping each frame with the time it
+	// would have gone out.
+	frames := []sim.Event{{Frame: protocol.SequenceStart()}}
+	var now time.Duration
+	wait := func(at time.Duration) bool {
+		now = at
+		return true
+	}
+	write := func(frame []byte) error {
+		frames = append(frames, sim.Event{At: now, Frame: frame})
+		return nil
+	}
+	if _, err := playEvents(events, dev, allocator, *arpRate, wait, write); err != nil {
+		return err
+	}
+	frames = append(frames,
+		sim.Event{At: now, Frame: protocol.AllNotesOff(dev)},
+		sim.Event{At: now, Frame: protocol.SequenceStop()})
+
+	s := sim.New()
+	var v *simview.View
+	if *view {
+		drives := s.Drives()
+		v = simview.New(os.Stdout, drives, &drives.Stats, drives)
+		s.SetConsumer(v)
+		clock := simview.NewClock()
+		go readKeys(os.Stdin, clock)
+		s.BeforeTick = func(now time.Duration) {
+			stepped := clock.Wait(now)
+			_ = v.Tick(now, stepped)
+		}
+	}
+	samples := s.Render(frames, *tail)
+	if v != nil {
+		v.Close()
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := sim.WriteWAV(w, samples); err != nil {
+		f.Close()
+		return fmt.Errorf("write wav: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("write wav: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("rendered %s → %s (%s)\n", in, out,
+		(time.Duration(len(samples)/2) * time.Second / sim.SampleRate).Round(time.Millisecond))
+	return nil
+}
+
+// readKeys hands every byte read from r to clock until r runs dry.
+func readKeys(r io.Reader, clock *simview.Clock) {
+	var b [64]byte
+	for {
+		n, err := r.Read(b[:])
+		for _, k := range b[:n] {
+			clock.Key(k)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/sim"
+)
+
+// TestSimWAV renders testdata/sim.mid, half a second with a note, a chord
+// and a pitch bend, through cmdSim and checks the WAV's header and that
+// its SHA-256 matches testdata/sim.wav.sha256. The samples come from
+// floating point, but rounding to 16 bits absorbs any last-bit difference
+// between platforms, so the hash holds everywhere.
+//
+// After a deliberate change to the drives or the mixing, rewrite the hash
+// with
+//
+//	go test -run TestSimWAV -update
+//
+// and listen to the new render before committing it.
+func TestSimWAV(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "sim.wav")
+	const tail = 100 * time.Millisecond
+	if err := cmdSim([]string{"-tail", tail.String(), "testdata/sim.mid", out}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 0.5s of song and the tail, stereo, 16 bits.
+	frames := int((500*time.Millisecond + tail) * sim.SampleRate / time.Second)
+	if len(data) != 44+4*frames {
+		t.Fatalf("%d bytes, want a 44-byte header and %d frames", len(data), frames)
+	}
+	if string(data[:4]) != "RIFF" || string(data[8:16]) != "WAVEfmt " || string(data[36:40]) != "data" {
+		t.Fatalf("bad header % X", data[:44])
+	}
+	if rate := binary.LittleEndian.Uint32(data[24:]); rate != sim.SampleRate {
+		t.Errorf("sample rate %d, want %d", rate, sim.SampleRate)
+	}
+	silent := true
+	for i := 44; i < len(data); i += 2 {
+		if data[i] != 0 || data[i+1] != 0 {
+			silent = false
+			break
+		}
+	}
+	if silent {
+		t.Fatal("render is silent")
+	}
+
+	got := fmt.Sprintf("%x", sha256.Sum256(data))
+	const golden = "testdata/sim.wav.sha256"
+	if *update {
+		if err := os.WriteFile(golden, []byte(got+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := strings.TrimSpace(string(want)); got != w {
+		t.Errorf("render hashes to %s, %s has %s", got, golden, w)
+	}
+}
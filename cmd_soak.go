@@ -0,0 +1,565 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/fakeclock"
+	"github.com/ystepanoff/goppy/firmware/instruments"
+	"github.com/ystepanoff/goppy/firmware/networks"
+	"github.com/ystepanoff/goppy/firmware/notes"
+	"github.com/ystepanoff/goppy/internal/protocol"
+)
+
+// Soak timing. Traffic events come soakMinGap to soakMaxGap apart; a
+// system reset is followed by soakResetSettle of quiet while the heads
+// re-home.
+const (
+	soakMinGap      = 20 * time.Millisecond
+	soakMaxGap      = 250 * time.Millisecond
+	soakResetSettle = 3 * time.Second
+	soakReadTimeout = 500 * time.Millisecond
+)
+
+// Sounding time tolerance: a drive's reported sounding time may differ
+// from the host's reckoning by soakNoteSlack per note started or stopped
+// since the last check (link latency and tick rounding), plus
+// soakClockSlack of the time between checks (the board's clock against
+// the host's; a ceramic resonator is good to about 0.5%).
+const (
+	soakNoteSlack  = 5 * time.Millisecond
+	soakClockSlack = 0.01
+)
+
+// cmdSoak plays hours of pseudo-random but valid traffic at a device, or
+// with --dry-run at the firmware built for the host on a fake clock, to
+// shake out the failures that take that long to show: counters that
+// wrap, settings saved too eagerly, state that slowly drifts. It keeps a
+// model of what each drive should be doing and checks it against the
+// device's replies at intervals, then writes a summary report.
+func cmdSoak(args []string) error {
+	fs := flag.NewFlagSet("soak", flag.ExitOnError)
+	pf := addPortFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "soak the firmware built for the host, on a fake clock, instead of a device")
+	hours := fs.Float64("hours", 8, "how long to soak, in (simulated, with --dry-run) hours")
+	seed := fs.Uint64("seed", 0, "seed for the traffic, to repeat a soak; 0 picks one")
+	device := fs.Uint("device", uint(config.DeviceAddress), "device address to soak")
+	pingEvery := fs.Duration("ping-every", time.Minute, "how often to ping the device")
+	checkEvery := fs.Duration("check-every", 5*time.Minute, "how often to check the device's config and positions against the model")
+	resetEvery := fs.Duration("reset-every", 30*time.Minute, "how often to reset the device; 0 never does")
+	report := fs.String("report", "soak-report.json", "file to write the summary report to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *hours <= 0 {
+		return fmt.Errorf("hours must be positive, got %g", *hours)
+	}
+	if *pingEvery <= 0 || *checkEvery <= 0 || *resetEvery < 0 {
+		return fmt.Errorf("--ping-every and --check-every must be positive and --reset-every not negative")
+	}
+	if *dryRun == (pf.port != "") {
+		return fmt.Errorf("give either --port or --dry-run")
+	}
+	if *seed == 0 {
+		*seed = uint64(time.Now().UnixNano())
+	}
+	fmt.Printf("soak seed %d (rerun with --seed %d)\n", *seed, *seed)
+
+	var link soakLink
+	if *dryRun {
+		link = newDryLink()
+	} else {
+		port, err := pf.open()
+		if err != nil {
+			return err
+		}
+		defer port.Close()
+		if err := port.SetReadTimeout(soakReadTimeout); err != nil {
+			return fmt.Errorf("set read timeout: %w", err)
+		}
+		link = &portLink{port: port, start: time.Now()}
+	}
+
+	s := &soak{
+		link:   link,
+		rng:    rand.New(rand.NewPCG(*seed, *seed)),
+		dev:    byte(*device),
+		report: soakReport{Seed: *seed, DryRun: *dryRun, Failures: []string{}},
+	}
+	stopCh := make(chan os.Signal, 1)
+	signal.Notify(stopCh, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stopCh)
+
+	err := s.run(time.Duration(*hours*float64(time.Hour)), *pingEvery, *checkEvery, *resetEvery, stopCh)
+	s.report.Duration = s.link.now().Round(time.Second).String()
+	s.report.Failed = len(s.report.Failures)
+
+	data, jerr := json.MarshalIndent(s.report, "", "  ")
+	if jerr != nil {
+		return jerr
+	}
+	if werr := os.WriteFile(*report, append(data, '\n'), 0o644); werr != nil {
+		return fmt.Errorf("write report: %w", werr)
+	}
+	r := s.report
+	fmt.Printf("soaked %s: %d frames, %d notes, %d bends, %d transposes, %d pings, %d checks, %d resets; report in %s\n",
+		r.Duration, r.Frames, r.Notes, r.Bends, r.Transposes, r.Pings, r.Checks, r.Resets, *report)
+	if err != nil {
+		return err
+	}
+	if r.Failed > 0 {
+		return fmt.Errorf("%d checks failed", r.Failed)
+	}
+	return nil
+}
+
+// soakReport is the summary cmdSoak writes.
+type soakReport struct {
+	Seed       uint64   `json:"seed"`
+	DryRun     bool     `json:"dry_run"`
+	Duration   string   `json:"duration"`
+	Frames     int      `json:"frames"`
+	Notes      int      `json:"notes"`
+	Bends      int      `json:"bends"`
+	Transposes int      `json:"transposes"`
+	Pings      int      `json:"pings"`
+	Checks     int      `json:"checks"`
+	Resets     int      `json:"resets"`
+	Failed     int      `json:"failed"`
+	Failures   []string `json:"failures"`
+
+	// Sounding is how long each drive played, as it last reported.
+	Sounding map[byte]string `json:"sounding"`
+}
+
+// soakLink is what the soak talks to: a device, or the firmware on a
+// fake clock.
+type soakLink interface {
+	io.ReadWriter
+	// now is how long the soak has run.
+	now() time.Duration
+	// waitUntil waits until the soak has run at long.
+	waitUntil(at time.Duration)
+	// verify checks the firmware's own counters after frames frames, where
+	// they can be seen, returning what is wrong.
+	verify(frames int) []string
+}
+
+// portLink soaks a device on a serial port, in real time. A read times out
+// after soakReadTimeout.
+type portLink struct {
+	port  io.ReadWriter
+	start time.Time
+}
+
+func (l *portLink) Read(b []byte) (int, error)  { return timeoutReader{l.port}.Read(b) }
+func (l *portLink) Write(b []byte) (int, error) { return l.port.Write(b) }
+func (l *portLink) now() time.Duration          { return time.Since(l.start) }
+func (l *portLink) waitUntil(at time.Duration)  { time.Sleep(time.Until(l.start.Add(at))) }
+func (l *portLink) verify(int) []string         { return nil }
+
+// dryLink is the firmware built for the host, FloppyDrives behind the real
+// parser, ticked by a fake clock. A read with nothing to return runs the
+// firmware for up to a millisecond first, then reports io.EOF.
+type dryLink struct {
+	drives *instruments.FloppyDrives
+	serial *networks.Serial
+	clock  *fakeclock.Clock
+
+	toDevice []byte
+	toHost   []byte
+}
+
+func newDryLink() *dryLink {
+	l := &dryLink{drives: instruments.NewFloppyDrives(), clock: fakeclock.New()}
+	l.serial = networks.NewSerialPort(l.drives, (*dryFirmwarePort)(l))
+	l.drives.SetTicker(l.clock)
+	l.clock.Start(config.TimerResolution, l.drives.Tick)
+	return l
+}
+
+func (l *dryLink) Read(b []byte) (int, error) {
+	for i := 0; len(l.toHost) == 0 && i < notes.TicksPerMs; i++ {
+		l.clock.AdvanceTicks(1)
+		l.serial.ReadMessages()
+	}
+	if len(l.toHost) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, l.toHost)
+	l.toHost = l.toHost[n:]
+	return n, nil
+}
+
+func (l *dryLink) Write(b []byte) (int, error) {
+	l.toDevice = append(l.toDevice, b...)
+	return len(b), nil
+}
+
+func (l *dryLink) now() time.Duration { return l.clock.Now() }
+
+func (l *dryLink) waitUntil(at time.Duration) {
+	l.serial.ReadMessages()
+	for l.clock.Now() < at {
+		l.clock.AdvanceTicks(1)
+		l.serial.ReadMessages()
+	}
+}
+
+func (l *dryLink) verify(frames int) []string {
+	l.serial.ReadMessages()
+	var failures []string
+	st := l.serial.Stats
+	if st.Frames != uint16(frames) {
+		failures = append(failures, fmt.Sprintf("parser counted %d frames (mod 65536), sent %d", st.Frames, frames))
+	}
+	if n := st.SkippedBytes + st.OtherDevice + st.BadSubAddress + st.EmptyFrames; n != 0 {
+		failures = append(failures, fmt.Sprintf("parser dropped input: %+v", st))
+	}
+	ds := l.drives.Stats
+	if ds.InvalidPayloads != 0 || ds.UnknownCommands != 0 || ds.LinkTimeouts != 0 || ds.BadSubAddress != 0 {
+		failures = append(failures, fmt.Sprintf("drives rejected messages or timed out: %+v", ds))
+	}
+	return failures
+}
+
+// dryFirmwarePort is the dryLink seen by the firmware's parser.
+type dryFirmwarePort dryLink
+
+func (p *dryFirmwarePort) Buffered() int { return len(p.toDevice) }
+
+func (p *dryFirmwarePort) Read(b []byte) (int, error) {
+	n := copy(b, p.toDevice)
+	p.toDevice = p.toDevice[n:]
+	return n, nil
+}
+
+func (p *dryFirmwarePort) Write(b []byte) (int, error) {
+	p.toHost = append(p.toHost, b...)
+	return len(b), nil
+}
+
+// soakDrive is the model of one drive.
+type soakDrive struct {
+	note      byte // sounding, or 0 with sounding false
+	sounding  bool // a note-on is in force
+	sure      bool // and the note is certain to play after transpose
+	since     time.Duration
+	transpose int8
+
+	// What the drive should have played since the last check: at least
+	// soundMin, at most soundMax (notes that may not play only count
+	// toward the latter), and the notes started or stopped.
+	soundMin, soundMax time.Duration
+	edges              int
+}
+
+// soak generates traffic and keeps the model in step with it.
+type soak struct {
+	link   soakLink
+	rng    *rand.Rand
+	dev    byte
+	report soakReport
+
+	drives     [config.NumDrives + 1]soakDrive
+	pong       *protocol.Pong
+	sounding   [config.NumDrives + 1]uint32 // ticks, as last reported
+	baseline   bool                         // sounding holds a report
+	lastCheck  time.Duration
+	lastReport time.Duration
+}
+
+func (s *soak) run(length, pingEvery, checkEvery, resetEvery time.Duration, stop <-chan os.Signal) error {
+	if err := s.send(protocol.Reset()); err != nil {
+		return err
+	}
+	s.link.waitUntil(soakResetSettle)
+	if err := s.send(protocol.SequenceStart()); err != nil {
+		return err
+	}
+	s.ping()
+	s.check()
+
+	nextPing, nextCheck, nextReset := pingEvery, checkEvery, resetEvery
+	at := s.link.now()
+	for at < length {
+		select {
+		case <-stop:
+			fmt.Println("interrupted")
+			length = at
+			continue
+		default:
+		}
+		at += soakMinGap + time.Duration(s.rng.Int64N(int64(soakMaxGap-soakMinGap)))
+		s.link.waitUntil(at)
+
+		var err error
+		switch {
+		case at >= nextReset && resetEvery > 0:
+			nextReset += resetEvery
+			err = s.reset()
+			at = s.link.now()
+		case at >= nextCheck:
+			nextCheck += checkEvery
+			s.check()
+		case at >= nextPing:
+			nextPing += pingEvery
+			s.ping()
+		default:
+			err = s.traffic()
+		}
+		if err != nil {
+			return err
+		}
+		if now := s.link.now(); now-s.lastReport >= 10*time.Minute {
+			s.lastReport = now
+			fmt.Printf("%s: %d frames, %d failures\n", now.Round(time.Second), s.report.Frames, len(s.report.Failures))
+		}
+	}
+
+	if err := s.send(protocol.AllNotesOff(s.dev)); err != nil {
+		return err
+	}
+	s.stopAll()
+	s.check()
+	return s.send(protocol.SequenceStop())
+}
+
+// send writes a frame to the device, counting it.
+func (s *soak) send(frame []byte) error {
+	if _, err := s.link.Write(frame); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	s.report.Frames++
+	return nil
+}
+
+func (s *soak) fail(format string, args ...any) {
+	msg := fmt.Sprintf("%s: ", s.link.now().Round(time.Millisecond)) + fmt.Sprintf(format, args...)
+	fmt.Println("FAIL", msg)
+	s.report.Failures = append(s.report.Failures, msg)
+}
+
+// traffic sends one random message: mostly notes starting and stopping,
+// with the odd bend and, rarely, a transpose, which the device saves.
+func (s *soak) traffic() error {
+	var free, busy []byte
+	for d := byte(1); d <= config.NumDrives; d++ {
+		if s.drives[d].sounding {
+			busy = append(busy, d)
+		} else {
+			free = append(free, d)
+		}
+	}
+	r := s.rng.IntN(1000)
+	switch {
+	case r < 450 && len(free) > 0 || len(busy) == 0:
+		d := free[s.rng.IntN(len(free))]
+		note := s.note()
+		if err := s.send(protocol.NoteOn(s.dev, d, note, byte(1+s.rng.IntN(127)))); err != nil {
+			return err
+		}
+		s.start(d, note)
+	case r < 850:
+		d := busy[s.rng.IntN(len(busy))]
+		if err := s.send(protocol.NoteOff(s.dev, d, s.drives[d].note)); err != nil {
+			return err
+		}
+		s.stop(d)
+	case r < 990:
+		d := busy[s.rng.IntN(len(busy))]
+		bend := protocol.PitchBendCenter
+		if r < 950 {
+			bend = uint16(s.rng.IntN(16384))
+		}
+		s.report.Bends++
+		return s.send(protocol.PitchBend(s.dev, d, bend))
+	case r == 999:
+		d := byte(1 + s.rng.IntN(config.NumDrives))
+		t := int8(s.rng.IntN(7) - 3)
+		s.drives[d].transpose = t
+		s.report.Transposes++
+		return s.send(protocol.Transpose(s.dev, d, t))
+	}
+	return nil
+}
+
+// note picks a note: nine in ten from the drives' comfortable range,
+// favouring its middle, and the rest from anywhere in MIDI.
+func (s *soak) note() byte {
+	if s.rng.IntN(10) == 0 {
+		return byte(s.rng.IntN(128))
+	}
+	return byte(36 + (s.rng.IntN(36)+s.rng.IntN(36))/2)
+}
+
+// start and stop keep the model's sounding time as notes start and stop.
+func (s *soak) start(d, note byte) {
+	dr := &s.drives[d]
+	n := int(note) + int(dr.transpose)
+	dr.note, dr.sounding, dr.since = note, true, s.link.now()
+	dr.sure = n >= 0 && n <= instruments.MaxFloppyNote
+	dr.edges++
+	s.report.Notes++
+}
+
+func (s *soak) stop(d byte) {
+	dr := &s.drives[d]
+	if !dr.sounding {
+		return
+	}
+	s.account(d)
+	dr.sounding = false
+	dr.edges++
+}
+
+func (s *soak) stopAll() {
+	for d := byte(1); d <= config.NumDrives; d++ {
+		s.stop(d)
+	}
+}
+
+// account adds what drive d has sounded since it was last accounted for.
+func (s *soak) account(d byte) {
+	dr := &s.drives[d]
+	if !dr.sounding {
+		return
+	}
+	now := s.link.now()
+	if dr.sure {
+		dr.soundMin += now - dr.since
+	}
+	dr.soundMax += now - dr.since
+	dr.since = now
+}
+
+// reset resets the device, which silences every drive, and starts a new
+// sequence once the heads are home.
+func (s *soak) reset() error {
+	if err := s.send(protocol.Reset()); err != nil {
+		return err
+	}
+	s.stopAll()
+	s.report.Resets++
+	s.link.waitUntil(s.link.now() + soakResetSettle)
+	return s.send(protocol.SequenceStart())
+}
+
+// ping checks the device answers, the same way every time.
+func (s *soak) ping() {
+	s.report.Pings++
+	if err := s.send(protocol.Ping()); err != nil {
+		s.fail("ping: %v", err)
+		return
+	}
+	pong, err := protocol.ReadPong(s.link)
+	switch {
+	case err != nil:
+		s.fail("no pong: %v", err)
+	case s.pong == nil:
+		s.pong = &pong
+	case pong != *s.pong:
+		s.fail("pong changed from %+v to %+v", *s.pong, pong)
+	}
+}
+
+// check asks for every drive's config and position and checks them
+// against the model: the transpose set, the sounding time to within the
+// tolerance, and the head within its travel.
+func (s *soak) check() {
+	s.report.Checks++
+	now := s.link.now()
+	for d := byte(1); d <= config.NumDrives; d++ {
+		s.account(d)
+	}
+	for _, f := range s.link.verify(s.report.Frames) {
+		s.fail("%s", f)
+	}
+
+	configs, err := s.query(protocol.GetConfig(), protocol.CmdConfig)
+	if err != nil {
+		s.fail("config: %v", err)
+	}
+	travel := map[byte]byte{}
+	s.report.Sounding = map[byte]string{}
+	for _, f := range configs {
+		c, err := protocol.DecodeDriveConfig(f)
+		if err != nil || c.Drive < 1 || c.Drive > config.NumDrives {
+			s.fail("bad config reply % x: %v", f.Payload, err)
+			continue
+		}
+		dr := &s.drives[c.Drive]
+		travel[c.Drive] = c.TravelMax
+		if c.Transpose != dr.transpose {
+			s.fail("drive %d transpose %d, set to %d", c.Drive, c.Transpose, dr.transpose)
+		}
+		ticks := uint32(c.Sounding / protocol.TickDuration)
+		s.report.Sounding[c.Drive] = c.Sounding.Round(time.Second).String()
+		if s.baseline {
+			got := time.Duration(ticks-s.sounding[c.Drive]) * protocol.TickDuration // wraps
+			slack := time.Duration(dr.edges)*soakNoteSlack + time.Duration(float64(now-s.lastCheck)*soakClockSlack)
+			if got < dr.soundMin-slack || got > dr.soundMax+slack {
+				s.fail("drive %d sounded %s since the last check, want %s..%s give or take %s",
+					c.Drive, got, dr.soundMin, dr.soundMax, slack)
+			}
+		}
+		s.sounding[c.Drive] = ticks
+		dr.soundMin, dr.soundMax, dr.edges = 0, 0, 0
+	}
+	if len(configs) != config.NumDrives {
+		s.fail("%d config replies, want %d", len(configs), config.NumDrives)
+		s.baseline = false
+	} else {
+		s.baseline = true
+	}
+	s.lastCheck = now
+
+	positions, err := s.query(protocol.GetPositions(), protocol.CmdPosition)
+	if err != nil {
+		s.fail("positions: %v", err)
+	}
+	for _, f := range positions {
+		p, err := protocol.DecodePosition(f)
+		if err != nil {
+			s.fail("bad position reply: %v", err)
+			continue
+		}
+		limit := uint16(protocol.MaxPosition)
+		if t := travel[p.Drive]; t != 0 {
+			limit = uint16(t)
+		}
+		if p.Steps > limit {
+			s.fail("drive %d head at %d, past its travel (%d)", p.Drive, p.Steps, limit)
+		}
+	}
+}
+
+// query sends frame and collects the replies with command until the
+// device goes quiet.
+func (s *soak) query(frame []byte, command byte) ([]protocol.Frame, error) {
+	if err := s.send(frame); err != nil {
+		return nil, err
+	}
+	var replies []protocol.Frame
+	for {
+		f, err := protocol.ReadFrame(s.link)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return replies, nil
+		}
+		if err != nil {
+			return replies, err
+		}
+		if f.Command == command {
+			replies = append(replies, f)
+		}
+	}
+}
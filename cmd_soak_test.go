@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+)
+
+// TestSoakDryRun soaks the host firmware for 108 simulated seconds, with
+// pings, checks and a reset inside that, and checks the report shows
+// every kind of traffic and no failures.
+func TestSoakDryRun(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "soak.json")
+	err := cmdSoak([]string{"--dry-run", "--hours", "0.03", "--seed", "1426",
+		"--ping-every", "10s", "--check-every", "30s", "--reset-every", "1m", "--report", out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r soakReport
+	if err := json.Unmarshal(data, &r); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := time.ParseDuration(r.Duration); err != nil || d < 108*time.Second || d > 110*time.Second {
+		t.Errorf("soaked %s, want 108s and the last gap", r.Duration)
+	}
+	if r.Seed != 1426 || !r.DryRun {
+		t.Errorf("report of seed %d, dry run %v; want seed 1426 and a dry run", r.Seed, r.DryRun)
+	}
+	// A ping every 10s, a check every 30s and at either end, and a reset.
+	if r.Notes == 0 || r.Bends == 0 || r.Pings < 10 || r.Checks != 5 || r.Resets != 1 {
+		t.Errorf("%d notes, %d bends, %d pings, %d checks, %d resets; want notes and bends, 10 pings, 5 checks and a reset",
+			r.Notes, r.Bends, r.Pings, r.Checks, r.Resets)
+	}
+	if r.Failed != 0 {
+		t.Errorf("%d failures:\n%s", r.Failed, strings.Join(r.Failures, "\n"))
+	}
+}
+
+// TestSoakCatchesDrift lets the model and the firmware disagree, with a
+// transpose the firmware never heard of, and checks the next check fails.
+func TestSoakCatchesDrift(t *testing.T) {
+	s := &soak{link: newDryLink(), dev: config.DeviceAddress}
+	s.check()
+	if len(s.report.Failures) != 0 {
+		t.Fatalf("failures in step with the firmware: %v", s.report.Failures)
+	}
+	s.drives[2].transpose = 3
+	s.check()
+	if len(s.report.Failures) != 1 || !strings.Contains(s.report.Failures[0], "drive 2 transpose 0, set to 3") {
+		t.Errorf("failures %q, want drive 2's transpose", s.report.Failures)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ystepanoff/goppy/internal/protocol"
+)
+
+func cmdStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	pf := addPortFlags(fs)
+	timeout := fs.Duration("timeout", 2*time.Second, "how long to wait for replies")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	port, err := pf.open()
+	if err != nil {
+		return err
+	}
+	defer port.Close()
+
+	if err := port.SetReadTimeout(*timeout); err != nil {
+		return fmt.Errorf("set read timeout: %w", err)
+	}
+	statuses, err := readStatus(port)
+	if err != nil {
+		return err
+	}
+	fmt.Println("device uptime     sequence sounding drives          last fault")
+	for _, s := range statuses {
+		drives := "-"
+		if len(s.Drives) > 0 {
+			drives = strings.Trim(fmt.Sprint(s.Drives), "[]")
+		}
+		fmt.Printf("0x%02X   %-10s %-8s %8d %-15s %s\n",
+			s.DeviceAddress, s.Uptime, protocol.SequenceName(s.Sequence), s.Sounding, drives, protocol.FaultName(s.Fault))
+	}
+	return nil
+}
+
+// readStatus asks every device how it is and returns their replies.
+func readStatus(port io.ReadWriter) ([]protocol.Status, error) {
+	if _, err := port.Write(protocol.GetStatus()); err != nil {
+		return nil, fmt.Errorf("write status query: %w", err)
+	}
+
+	// Each device sends one reply; a read timeout ends the list.
+	r := timeoutReader{port}
+	var statuses []protocol.Status
+	for {
+		f, err := protocol.ReadFrame(r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read status: %w", err)
+		}
+		if f.Command != protocol.CmdStatus {
+			continue
+		}
+		s, err := protocol.DecodeStatus(f)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, s)
+	}
+	if len(statuses) == 0 {
+		return nil, fmt.Errorf("no status received (firmware too old?)")
+	}
+	return statuses, nil
+}
@@ -0,0 +1,253 @@
+package controller
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+)
+
+// Voicing is how Allocate shares out a song's notes among the voices of
+// the devices that play them.
+type Voicing struct {
+	Strategy mapping.VoiceStrategy
+
+	// Voices is how many notes every device sounds at once, in place of
+	// the mapping's; 0 for the mapping's.
+	Voices int
+
+	// MinHold is how long a note keeps its voice before a note of a
+	// channel of no higher priority may take it, so that a voice isn't
+	// passed from note to note as fast as the song strikes them.
+	MinHold time.Duration
+}
+
+// Allocation is what Allocate took out of a song, by channel.
+type Allocation struct {
+	Strategy mapping.VoiceStrategy
+	Notes    [16]int // note-ons on the channels m plays notes on
+	Dropped  [16]int // of those, dropped when struck, with no voice for them
+	Stolen   [16]int // released early, their voice taken by another note
+}
+
+func (a Allocation) String() string {
+	total := func(n [16]int) string {
+		sum := 0
+		var by []string
+		for ch, c := range n {
+			if c > 0 {
+				sum += c
+				by = append(by, fmt.Sprintf("%d: %d", ch+1, c))
+			}
+		}
+		if sum == 0 {
+			return "0"
+		}
+		return fmt.Sprintf("%d (channel %s)", sum, strings.Join(by, ", "))
+	}
+	notes := 0
+	for _, n := range a.Notes {
+		notes += n
+	}
+	return fmt.Sprintf("%s: %d notes, %s dropped, %s stolen", a.Strategy, notes, total(a.Dropped), total(a.Stolen))
+}
+
+// Allocate returns events with no more notes sounding on each device at
+// once than it has voices, chosen as v says, and what it took out. A
+// device's voices are v.Voices, else m's Voices for it, else the drives
+// m's channels play on there. Notes on the percussion channel and on
+// channels m doesn't play are left alone, as is events; with VoicesNone
+// nothing is taken out. Thin limits the notes of each channel; Allocate
+// those of each device, over all its channels.
+//
+// Each time notes are struck on a device with too few voices free for
+// them, they and the notes it holds are ranked: first by their channel's
+// Priority, then notes struck less than v.MinHold before, then by the
+// strategy. VoicesFirst keeps the notes held, oldest first, then the
+// loudest struck and, at one velocity, the highest. VoicesOuter keeps the
+// highest note sounding, the lowest, the next highest and so on inwards,
+// so that the melody and bass go on whatever else is lost. Those past the
+// device's voices go: a note just struck is dropped, and a note held is
+// released there and then, its voice stolen.
+func Allocate(events []Event, m *mapping.Map, v Voicing) ([]Event, Allocation) {
+	a := Allocation{Strategy: v.Strategy}
+	plays := func(ev Event) bool {
+		return (ev.Kind == NoteOn || ev.Kind == NoteOff) && m.Channels[ev.Channel].Mapped() && !m.Drums(ev.Channel)
+	}
+	for _, ev := range events {
+		if ev.Kind == NoteOn && plays(ev) {
+			a.Notes[ev.Channel]++
+		}
+	}
+	if v.Strategy == mapping.VoicesNone {
+		return events, a
+	}
+	voices := deviceVoices(m, v.Voices)
+	off := pairNotes(events)
+	drop := make([]bool, len(events))
+
+	// cuts are the note-offs ending stolen notes, by the index of the
+	// event they go before.
+	cuts := make(map[int][]Event)
+	held := make(map[byte][]int) // note-ons still sounding, by device
+	for start := 0; start < len(events); {
+		end := start
+		for end < len(events) && events[end].At == events[start].At {
+			end++
+		}
+		struck := make(map[byte][]int)
+		for i := start; i < end; i++ {
+			ev := events[i]
+			if !plays(ev) || drop[i] {
+				continue
+			}
+			d := channelDevice(m.Channels[ev.Channel])
+			switch ev.Kind {
+			case NoteOff:
+				held[d] = slices.DeleteFunc(held[d], func(on int) bool { return off[on] == i })
+			case NoteOn:
+				struck[d] = append(struck[d], i)
+			}
+		}
+		for _, d := range slices.Sorted(maps.Keys(struck)) {
+			notes := slices.Concat(held[d], struck[d])
+			if limit := voices[d]; len(notes) > limit {
+				rankVoices(notes, events, start, m, v)
+				for _, on := range notes[limit:] {
+					ev := events[on]
+					if on >= start {
+						a.Dropped[ev.Channel]++
+						drop[on] = true
+						if off[on] >= 0 {
+							drop[off[on]] = true
+						}
+						continue
+					}
+					a.Stolen[ev.Channel]++
+					if off[on] >= 0 {
+						drop[off[on]] = true
+					}
+					cuts[start] = append(cuts[start], Event{At: events[start].At, Kind: NoteOff, Channel: ev.Channel, Note: ev.Note})
+				}
+				notes = notes[:limit]
+				slices.Sort(notes)
+			}
+			held[d] = notes
+		}
+		start = end
+	}
+
+	out := make([]Event, 0, len(events))
+	for i, ev := range events {
+		out = append(out, cuts[i]...)
+		if !drop[i] {
+			out = append(out, ev)
+		}
+	}
+	return out, a
+}
+
+// rankVoices sorts notes, the indexes in events of the note-ons held and
+// struck on a device at events[start], best first, as Allocate has it.
+func rankVoices(notes []int, events []Event, start int, m *mapping.Map, v Voicing) {
+	pitch := func(on int) int {
+		ev := events[on]
+		return int(ev.Note) + m.Channels[ev.Channel].Transpose
+	}
+	guarded := func(on int) bool {
+		return on < start && events[start].At-events[on].At < v.MinHold
+	}
+	// outer ranks each pitch by how far in from the edges of the chord it
+	// is: the highest 0, the lowest 1, the next highest 2...
+	outer := make(map[int]int)
+	if v.Strategy == mapping.VoicesOuter {
+		var pitches []int
+		for _, on := range notes {
+			pitches = append(pitches, pitch(on))
+		}
+		slices.Sort(pitches)
+		pitches = slices.Compact(pitches)
+		for i, lo, hi := 0, 0, len(pitches)-1; lo <= hi; i++ {
+			if i%2 == 0 {
+				outer[pitches[hi]] = i
+				hi--
+			} else {
+				outer[pitches[lo]] = i
+				lo++
+			}
+		}
+	}
+	slices.SortStableFunc(notes, func(a, b int) int {
+		ea, eb := events[a], events[b]
+		if c := cmp.Compare(m.Channels[eb.Channel].Priority, m.Channels[ea.Channel].Priority); c != 0 {
+			return c
+		}
+		if ga, gb := guarded(a), guarded(b); ga != gb {
+			if ga {
+				return -1
+			}
+			return 1
+		}
+		if v.Strategy == mapping.VoicesOuter {
+			// Of two notes at one pitch, the one held keeps its voice.
+			return cmp.Or(cmp.Compare(outer[pitch(a)], outer[pitch(b)]), cmp.Compare(a, b))
+		}
+		if ha, hb := a < start, b < start; ha || hb {
+			if ha && hb {
+				return cmp.Compare(a, b)
+			}
+			if ha {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Or(cmp.Compare(eb.Value, ea.Value), cmp.Compare(eb.Note, ea.Note))
+	})
+}
+
+// deviceVoices returns the voices of each device m plays notes on:
+// voices, else m's Voices for it, else the drives its channels there
+// play on.
+func deviceVoices(m *mapping.Map, voices int) map[byte]int {
+	drives := make(map[byte]map[mapping.Target]bool)
+	for ch, c := range m.Channels {
+		if !c.Mapped() || m.Drums(byte(ch)) {
+			continue
+		}
+		d := channelDevice(c)
+		if drives[d] == nil {
+			drives[d] = make(map[mapping.Target]bool)
+		}
+		for _, t := range c.Targets() {
+			drives[d][t] = true
+		}
+	}
+	n := make(map[byte]int, len(drives))
+	for d, ts := range drives {
+		switch {
+		case voices > 0:
+			n[d] = voices
+		case m.Voices[d] > 0:
+			n[d] = m.Voices[d]
+		default:
+			n[d] = len(ts)
+		}
+	}
+	return n
+}
+
+// channelDevice returns the device c plays on. A stripe's notes count
+// against its first device, with the voices of the stripe's drives.
+func channelDevice(c mapping.Channel) byte {
+	if len(c.Stripe) > 0 {
+		return c.Stripe[0].Device
+	}
+	if c.Pool != (mapping.Pool{}) {
+		return c.Pool.Device
+	}
+	return c.Target.Device
+}
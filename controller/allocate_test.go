@@ -0,0 +1,142 @@
+package controller
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+)
+
+// voiceRig is a device of sixteen drives, four to a channel, as
+// testdata/voices/sixteen.mid, two bars at 120 BPM, needs to play it all:
+//
+//	channel 1  a melody in four-note chords, each on the beat, v100 to v70
+//	channel 2  a four-note chord to each bar, v80
+//	channel 3  a four-note chord held a beat and a half from each
+//	           off-beat half, v60 to v75
+//	channel 4  a bass in four-note stacks on the beat, v90
+func voiceRig() *mapping.Map {
+	m := &mapping.Map{Percussion: mapping.Percussion{Channel: 9}}
+	for ch := range 4 {
+		first := byte(1 + 4*ch)
+		m.Channels[ch] = mapping.Channel{Pool: mapping.Pool{Device: 0x01, First: first, Last: first + 3}}
+	}
+	return m
+}
+
+// TestAllocate reduces testdata/voices/sixteen.mid to six voices by each
+// strategy, and compares what is kept with testdata/voices/STRATEGY.txt;
+// go test -update rewrites them.
+func TestAllocate(t *testing.T) {
+	song, err := ReadSMF("testdata/voices/sixteen.mid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := maxSounding(song); got != 16 {
+		t.Fatalf("fixture sounds %d notes at most, want 16", got)
+	}
+	if all, a := Allocate(song, voiceRig(), Voicing{Strategy: mapping.VoicesOuter}); !slices.Equal(all, song) || a.Dropped != [16]int{} {
+		t.Errorf("16 drives dropped notes: %v", a)
+	}
+
+	for _, s := range []mapping.VoiceStrategy{mapping.VoicesFirst, mapping.VoicesOuter} {
+		t.Run(s.String(), func(t *testing.T) {
+			m := voiceRig()
+			m.Channels[3].Priority = 1 // the bass
+			before := slices.Clone(song)
+			got, a := Allocate(song, m, Voicing{Strategy: s, Voices: 6, MinHold: 100 * time.Millisecond})
+			if !slices.Equal(song, before) {
+				t.Error("Allocate changed the events it was given")
+			}
+			if n := maxSounding(got); n > 6 {
+				t.Errorf("sounds %d notes at once, want at most 6", n)
+			}
+			if a.Notes != [16]int{32, 8, 16, 32} {
+				t.Errorf("counted notes %v", a.Notes)
+			}
+			if a.Dropped[3]+a.Stolen[3] != 0 {
+				t.Errorf("took notes from the bass, of the highest priority: %v", a)
+			}
+			var b strings.Builder
+			fmt.Fprintf(&b, "# %v\n", a)
+			for _, ev := range got {
+				switch ev.Kind {
+				case NoteOn:
+					fmt.Fprintf(&b, "%6dms  %2d on  %3d\n", ev.At.Milliseconds(), ev.Channel+1, ev.Note)
+				case NoteOff:
+					fmt.Fprintf(&b, "%6dms  %2d off %3d\n", ev.At.Milliseconds(), ev.Channel+1, ev.Note)
+				}
+			}
+			golden := "testdata/voices/" + s.String() + ".txt"
+			if *update {
+				if err := os.WriteFile(golden, []byte(b.String()), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != string(want) {
+				t.Errorf("reduction differs from %s:\n%s", golden, b.String())
+			}
+		})
+	}
+}
+
+// maxSounding returns the most notes events holds at once, counting
+// notes released at one time before those struck then.
+func maxSounding(events []Event) int {
+	held, most := 0, 0
+	for i, ev := range events {
+		switch ev.Kind {
+		case NoteOn:
+			held++
+		case NoteOff:
+			held--
+		}
+		if i+1 == len(events) || events[i+1].At != ev.At {
+			most = max(most, held)
+		}
+	}
+	return most
+}
+
+// TestAllocateSteal strikes a note over a full device: VoicesFirst drops
+// it, VoicesOuter steals an inner voice for it unless MinHold guards it.
+func TestAllocateSteal(t *testing.T) {
+	m := mapping.Channels(0x01, 1, 2)
+	events := []Event{
+		{At: 0, Kind: NoteOn, Channel: 0, Note: 60, Value: 100},
+		{At: 0, Kind: NoteOn, Channel: 1, Note: 48, Value: 100},
+		{At: 100 * time.Millisecond, Kind: NoteOn, Channel: 0, Note: 67, Value: 100},
+		{At: 200 * time.Millisecond, Kind: NoteOff, Channel: 0, Note: 67},
+		{At: time.Second, Kind: NoteOff, Channel: 0, Note: 60},
+		{At: time.Second, Kind: NoteOff, Channel: 1, Note: 48},
+	}
+	tests := []struct {
+		v    Voicing
+		want []Event
+	}{
+		{Voicing{Strategy: mapping.VoicesFirst}, []Event{events[0], events[1], events[4], events[5]}},
+		{Voicing{Strategy: mapping.VoicesOuter}, []Event{
+			events[0], events[1],
+			{At: 100 * time.Millisecond, Kind: NoteOff, Channel: 0, Note: 60},
+			events[2], events[3], events[5],
+		}},
+		{Voicing{Strategy: mapping.VoicesOuter, MinHold: 150 * time.Millisecond}, []Event{events[0], events[1], events[4], events[5]}},
+	}
+	for _, tt := range tests {
+		got, a := Allocate(events, m, tt.v)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%+v: got %v, want %v", tt.v, got, tt.want)
+		}
+		if a.Dropped[0]+a.Stolen[0] != 1 {
+			t.Errorf("%+v: %v, want one note taken from channel 1", tt.v, a)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package controller
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+)
+
+// ChannelAnalysis is what Analyze finds on one channel of a song.
+type ChannelAnalysis struct {
+	Channel      byte
+	Notes        int  // note-ons
+	Low, High    byte // the lowest and highest notes struck
+	MaxPolyphony int  // the most notes sounding at once
+	OutOfRange   int  // notes outside mapping.FloppyRange
+
+	// Events of each kind: what the drives can't do as a synth would.
+	Bends, Sustain, Pressure int
+
+	// With a mapping, what it does with the channel's notes: those it or
+	// the drives drop, as CheckMapping finds, and of the rest those
+	// outside the range of the channel's drives, after its transpose, for
+	// its arrange strategy to move or drop.
+	Dropped, Outside int
+}
+
+// Analysis is what Analyze finds in a song.
+type Analysis struct {
+	Channels []ChannelAnalysis // with notes, bends or the like, in order
+
+	// With a mapping, what Arrange does with the song by the mapping's
+	// strategy, and the devices Suggest would play each channel on.
+	Arrangement *Arrangement
+	Suggested   []Assignment
+}
+
+// Analyze returns what a song holds on each channel, and, if m isn't
+// nil, what m would make of it.
+func Analyze(events []Event, m *mapping.Map) Analysis {
+	var chans [16]*ChannelAnalysis
+	var sounding [16]int
+	get := func(ch byte) *ChannelAnalysis {
+		if chans[ch] == nil {
+			chans[ch] = &ChannelAnalysis{Channel: ch, Low: 127}
+		}
+		return chans[ch]
+	}
+	held := make(map[heldNote]int)
+	for _, ev := range events {
+		switch ev.Kind {
+		case NoteOn:
+			c := get(ev.Channel)
+			c.Notes++
+			c.Low, c.High = min(c.Low, ev.Note), max(c.High, ev.Note)
+			if !mapping.FloppyRange.Contains(int(ev.Note)) {
+				c.OutOfRange++
+			}
+			held[heldNote{ev.Channel, ev.Note}]++
+			sounding[ev.Channel]++
+			c.MaxPolyphony = max(c.MaxPolyphony, sounding[ev.Channel])
+		case NoteOff:
+			if k := (heldNote{ev.Channel, ev.Note}); held[k] > 0 {
+				held[k]--
+				sounding[ev.Channel]--
+			}
+		case PitchBend:
+			get(ev.Channel).Bends++
+		case Sustain:
+			get(ev.Channel).Sustain++
+		case Pressure:
+			get(ev.Channel).Pressure++
+		}
+	}
+
+	var a Analysis
+	if m != nil {
+		for _, c := range CheckMapping(events, m) {
+			switch {
+			case c.Dropped != "":
+				get(c.Channel).Dropped++
+			case !c.Reset && !m.Drums(c.Channel) && !m.Channels[c.Channel].NoteRange().Contains(int(c.Sent)):
+				get(c.Channel).Outside++
+			}
+		}
+		_, arr := Arrange(events, m, m.Strategy)
+		a.Arrangement = &arr
+		a.Suggested = Suggest(events, m)
+	}
+	for _, c := range chans {
+		if c != nil {
+			if c.Notes == 0 {
+				c.Low = 0
+			}
+			a.Channels = append(a.Channels, *c)
+		}
+	}
+	return a
+}
+
+// Assignment is a device suggested for a channel, and the notes it would
+// drop there.
+type Assignment struct {
+	Channel, Device byte
+	Dropped         int
+}
+
+// Suggest returns a device of m for each channel of a song with notes,
+// bar the percussion channel, chosen to drop as few notes as it can: the
+// notes outside the device's range, its Ranges entry or else the floppy
+// range, and those struck while all its voices are sounding notes of the
+// channels already given it. A device has m's Voices for it, or the
+// drives m's channels play on there. The busiest channels are placed
+// first, so that the voices go where the notes are.
+func Suggest(events []Event, m *mapping.Map) []Assignment {
+	voices := deviceVoices(m, 0)
+	devices := slices.Sorted(maps.Keys(voices))
+	var notes [16]int
+	for _, ev := range events {
+		if ev.Kind == NoteOn && !m.Drums(ev.Channel) {
+			notes[ev.Channel]++
+		}
+	}
+	var order []byte
+	for ch, n := range notes {
+		if n > 0 {
+			order = append(order, byte(ch))
+		}
+	}
+	slices.SortStableFunc(order, func(a, b byte) int { return cmp.Compare(notes[b], notes[a]) })
+	if len(devices) == 0 {
+		return nil
+	}
+
+	placed := make(map[byte][]byte) // channels, by device
+	var out []Assignment
+	for _, ch := range order {
+		best := Assignment{Channel: ch, Dropped: -1}
+		for _, d := range devices {
+			r := m.Ranges[d]
+			if r == (mapping.Range{}) {
+				r = mapping.FloppyRange
+			}
+			drops := 0
+			for _, ev := range events {
+				if ev.Kind == NoteOn && ev.Channel == ch && !r.Contains(int(ev.Note)+m.Channels[ch].Transpose) {
+					drops++
+				}
+			}
+			with := append(slices.Clone(placed[d]), ch)
+			drops += voiceDrops(events, with, voices[d]) - voiceDrops(events, placed[d], voices[d])
+			if best.Dropped < 0 || drops < best.Dropped {
+				best.Device, best.Dropped = d, drops
+			}
+		}
+		placed[best.Device] = append(placed[best.Device], ch)
+		out = append(out, best)
+	}
+	slices.SortFunc(out, func(a, b Assignment) int { return cmp.Compare(a.Channel, b.Channel) })
+	return out
+}
+
+// voiceDrops returns how many notes of channels are struck with voices
+// notes of theirs already sounding.
+func voiceDrops(events []Event, channels []byte, voices int) int {
+	held := make(map[heldNote]int)
+	sounding, drops := 0, 0
+	for _, ev := range events {
+		if !slices.Contains(channels, ev.Channel) {
+			continue
+		}
+		k := heldNote{ev.Channel, ev.Note}
+		switch {
+		case ev.Kind == NoteOn && sounding >= voices:
+			drops++
+		case ev.Kind == NoteOn:
+			held[k]++
+			sounding++
+		case ev.Kind == NoteOff && held[k] > 0:
+			held[k]--
+			sounding--
+		}
+	}
+	return drops
+}
@@ -0,0 +1,67 @@
+package controller
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+)
+
+// TestAnalyze analyses testdata/seek/overlap.mid, whose notes readOverlap
+// lists.
+func TestAnalyze(t *testing.T) {
+	events := readOverlap(t)
+	a := Analyze(events, nil)
+	want := []ChannelAnalysis{
+		{Channel: 0, Notes: 5, Low: 60, High: 72, MaxPolyphony: 3, OutOfRange: 1, Bends: 1},
+		{Channel: 1, Notes: 1, Low: 36, High: 36, MaxPolyphony: 1},
+	}
+	if !slices.Equal(a.Channels, want) {
+		t.Errorf("Analyze =\n%+v\nwant\n%+v", a.Channels, want)
+	}
+	if a.Arrangement != nil || a.Suggested != nil {
+		t.Errorf("Analyze without a mapping predicted %+v, %+v", a.Arrangement, a.Suggested)
+	}
+
+	// Channel 1 on drives that stop at 67, which 72 is outside, and
+	// channel 2 not mapped.
+	m, err := mapping.Parse(strings.NewReader("channels:\n  1:\n    target: 1/1\n    range: 24-67\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = Analyze(events, m)
+	if c := a.Channels[0]; c.Dropped != 0 || c.Outside != 1 {
+		t.Errorf("channel 1: %d dropped, %d outside, want 0 and 1", c.Dropped, c.Outside)
+	}
+	if c := a.Channels[1]; c.Dropped != 1 {
+		t.Errorf("channel 2: %d dropped, want its one note", c.Dropped)
+	}
+	if a.Arrangement == nil || a.Arrangement.Notes != 5 || a.Arrangement.Outside != 1 {
+		t.Errorf("Arrangement = %+v, want 5 notes, 1 outside", a.Arrangement)
+	}
+}
+
+// TestSuggest places the chords of overlap.mid on the device with the
+// voices for them and the range for 72, and the bass on the other.
+func TestSuggest(t *testing.T) {
+	events := readOverlap(t)
+	m, err := mapping.Parse(strings.NewReader("channels:\n  1: 1/1\n  2: 2/1\nranges:\n  1: 24-47\n  2: 48-83\nvoices:\n  1: 1\n  2: 3\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := Suggest(events, m)
+	want := []Assignment{{Channel: 0, Device: 2}, {Channel: 1, Device: 1}}
+	if !slices.Equal(got, want) {
+		t.Errorf("Suggest = %+v, want %+v", got, want)
+	}
+
+	// With one voice each, the chords lose 64 and 67, and 60 struck again
+	// while it sounds, wherever they go.
+	m.Voices = map[byte]int{1: 1, 2: 1}
+	got = Suggest(events, m)
+	want = []Assignment{{Channel: 0, Device: 2, Dropped: 3}, {Channel: 1, Device: 1}}
+	if !slices.Equal(got, want) {
+		t.Errorf("one voice each: Suggest = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,482 @@
+// Package api serves an HTTP API controlling a player, for a phone, a
+// Stream Deck or a script. Every answer is JSON: the player's Status, or
+// {"error": "..."} with the status code saying what went wrong.
+//
+//	GET  /status                   the Status
+//	POST /play                     play, after a pause or a stop
+//	POST /play?file=fanfare.mid    or play a song of the player's in place
+//	POST /pause
+//	POST /stop                     silence the drives and stop the show
+//	POST /panic                    stop, and all notes off on every device
+//	POST /next                     skip to the playlist's next song
+//	POST /prev                     or back to the one before
+//	POST /seek?to=1m30s            move the song to an offset
+//	POST /seek?bar=12              or to the start of a bar
+//	POST /channels/{n}/mute        mute MIDI channel n, 1 to 16
+//	POST /channels/{n}/unmute
+//	POST /channels/{n}/solo        silence every channel not soloed
+//	POST /channels/{n}/unsolo
+//	GET  /mappings                 the mapping files in Server.Maps
+//	POST /mapping?file=stage.yaml  route channels by one of them
+//	PUT  /mapping                  or by the mapping file in the body
+//	POST /devices/{d}/offset?ms=12 send to device d, as 0x04, 12ms early
+//	POST /devices/{d}/offset?by=-1 or move its offset by 1ms, later
+//	POST /devices/{d}/mute         mute device d, as 0x04, whatever plays on it
+//	POST /devices/{d}/unmute
+//	POST /devices/{d}/solo         silence every device not soloed
+//	POST /devices/{d}/unsolo
+//	POST /tempo?percent=103        play at 103% of the song's tempo
+//	POST /tempo?by=-1              or 1% slower than now
+//	POST /transpose?semitones=-2   play the song a tone lower
+//	POST /transpose?by=1           or a semitone higher than now
+//	GET  /events                   the Events WebSocket, if set: see package feed
+//
+// Commands answer with the Status after them. Nothing is done to the
+// player from the API's goroutines: each command goes to the Transport,
+// which hands it to whatever owns the player.
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+)
+
+// Op is a command's kind.
+type Op string
+
+const (
+	OpPlay      Op = "play"
+	OpPause     Op = "pause"
+	OpStop      Op = "stop"
+	OpNext      Op = "next"
+	OpPrev      Op = "prev"
+	OpSeek      Op = "seek"
+	OpMute      Op = "mute"
+	OpSolo      Op = "solo"
+	OpMapping   Op = "mapping"
+	OpPanic     Op = "panic"
+	OpOffset    Op = "offset"
+	OpTempo     Op = "tempo"
+	OpTranspose Op = "transpose"
+
+	OpMuteDevice Op = "mute-device"
+	OpSoloDevice Op = "solo-device"
+)
+
+// Command is one thing to do to the player.
+type Command struct {
+	Op Op
+
+	// OpSeek's offset, or if Bar isn't 0 the bar to go to, from 1.
+	At  time.Duration
+	Bar int
+
+	// OpMute's and OpSolo's channel, from 0, and whether to mute or
+	// unmute it, or solo or unsolo it. OpMuteDevice and OpSoloDevice
+	// take Device in place of Channel.
+	Channel byte
+	Mute    bool
+	Solo    bool
+
+	// OpMapping's mapping, and the file it came from, or "" if uploaded.
+	Mapping     *mapping.Map
+	MappingFile string
+
+	// OpPlay's song, the name of a file among the player's songs, to play
+	// in place of what is playing; "" to play on.
+	Song string
+
+	// OpOffset's device, and how much earlier to send to it, or with
+	// Nudge how much to move its offset by; and OpMuteDevice's and
+	// OpSoloDevice's.
+	Device byte
+	Offset time.Duration
+	Nudge  bool
+
+	// OpTempo's percent of the song's tempo, and OpTranspose's semitones;
+	// with Nudge, how much to move them by.
+	Tempo     int
+	Transpose int
+}
+
+// Transport is the player as the API sees it. Do carries out a command,
+// or says why it can't be done now, as next without a playlist; its error
+// is answered with 409 Conflict. Both are called from the API's
+// goroutines.
+type Transport interface {
+	Status() Status
+	Do(c Command) error
+}
+
+// Player states.
+const (
+	Playing = "playing"
+	Paused  = "paused"
+	Stopped = "stopped"
+)
+
+// Status is where the player is.
+type Status struct {
+	State     string   `json:"state"` // Playing, Paused or Stopped
+	Song      string   `json:"song,omitempty"`
+	Position  float64  `json:"position"` // seconds into the song
+	Length    float64  `json:"length"`   // seconds
+	Index     int      `json:"index"`    // of the song in the playlist, from 0
+	Songs     int      `json:"songs"`    // in the playlist
+	Mapping   string   `json:"mapping,omitempty"`
+	Muted     []int    `json:"muted"`               // MIDI channels, from 1
+	Soloed    []int    `json:"soloed"`              // MIDI channels, from 1
+	Tempo     int      `json:"tempo,omitempty"`     // percent of the song's
+	Transpose int      `json:"transpose,omitempty"` // semitones
+	Devices   []Device `json:"devices"`
+}
+
+// Device is a device the player plays on, and the health of its link.
+type Device struct {
+	Address    string  `json:"address"` // 0x01
+	FirstDrive int     `json:"first_drive,omitempty"`
+	LastDrive  int     `json:"last_drive,omitempty"`
+	Port       string  `json:"port,omitempty"`
+	Connected  bool    `json:"connected"`
+	Error      string  `json:"error,omitempty"`
+	Latency    float64 `json:"latency_ms,omitempty"` // measured, of its port
+	Offset     int     `json:"offset_ms,omitempty"`  // how much earlier it is sent to
+	Warning    string  `json:"warning,omitempty"`    // as that it can't be sent early enough
+	Muted      bool    `json:"muted,omitempty"`
+	Soloed     bool    `json:"soloed,omitempty"`
+
+	// What the device last said of itself when asked how it is; nothing
+	// from firmware that can't say.
+	Uptime    int    `json:"uptime_s,omitempty"`
+	Sequence  string `json:"sequence,omitempty"`   // idle, playing or paused
+	Sounding  []int  `json:"sounding,omitempty"`   // its drives sounding
+	LastFault string `json:"last_fault,omitempty"` // as "link timeout"; none if none
+}
+
+// Server answers the API's requests.
+type Server struct {
+	Transport Transport
+
+	// Token, if set, must come with each request, as an "Authorization:
+	// Bearer" header or a token query parameter.
+	Token string
+
+	// Maps is the directory of mapping files POST /mapping chooses from;
+	// "" for none.
+	Maps string
+
+	// Events, if set, serves GET /events: a feed.Feed, streaming what the
+	// player does to a WebSocket.
+	Events http.Handler
+}
+
+// maxMapping is the largest mapping file PUT /mapping takes.
+const maxMapping = 1 << 20
+
+// Handler returns the API's handler.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, http.StatusOK, s.Transport.Status())
+	})
+	mux.HandleFunc("POST /play", s.play)
+	for _, op := range []Op{OpPause, OpStop, OpNext, OpPrev, OpPanic} {
+		mux.HandleFunc("POST /"+string(op), func(w http.ResponseWriter, r *http.Request) {
+			s.do(w, Command{Op: op})
+		})
+	}
+	mux.HandleFunc("POST /seek", s.seek)
+	mux.HandleFunc("POST /channels/{channel}/{action}", s.mute)
+	mux.HandleFunc("GET /mappings", s.mappings)
+	mux.HandleFunc("POST /mapping", s.chooseMapping)
+	mux.HandleFunc("PUT /mapping", s.uploadMapping)
+	mux.HandleFunc("POST /devices/{device}/offset", s.offset)
+	mux.HandleFunc("POST /devices/{device}/{action}", s.muteDevice)
+	mux.HandleFunc("POST /tempo", s.tempo)
+	mux.HandleFunc("POST /transpose", s.transpose)
+	if s.Events != nil {
+		mux.Handle("GET /events", s.Events)
+	}
+	return s.authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); pattern == "" {
+			w = &errorWriter{ResponseWriter: w} // the mux's 404 or 405, in JSON
+		}
+		mux.ServeHTTP(w, r)
+	}))
+}
+
+// errorWriter answers with the error http.Error writes to it as JSON.
+type errorWriter struct {
+	http.ResponseWriter
+	code    int
+	written bool
+}
+
+func (e *errorWriter) WriteHeader(code int) { e.code = code }
+
+func (e *errorWriter) Write(b []byte) (int, error) {
+	if !e.written {
+		e.written = true
+		fail(e.ResponseWriter, e.code, "%s", strings.TrimSpace(string(b)))
+	}
+	return len(b), nil
+}
+
+// authorize turns away requests without the token.
+func (s *Server) authorize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Token != "" {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok {
+				got = r.URL.Query().Get("token")
+			}
+			if subtle.ConstantTimeCompare([]byte(got), []byte(s.Token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="goppy"`)
+				fail(w, http.StatusUnauthorized, "missing or wrong token")
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// do hands c to the Transport and answers with the Status after it.
+func (s *Server) do(w http.ResponseWriter, c Command) {
+	if err := s.Transport.Do(c); err != nil {
+		fail(w, http.StatusConflict, "%s: %v", c.Op, err)
+		return
+	}
+	reply(w, http.StatusOK, s.Transport.Status())
+}
+
+func (s *Server) play(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("file")
+	if name != "" && (name != filepath.Base(name) || strings.HasPrefix(name, ".")) {
+		fail(w, http.StatusBadRequest, "file=%s: want the name of a song", name)
+		return
+	}
+	s.do(w, Command{Op: OpPlay, Song: name})
+}
+
+func (s *Server) seek(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	c := Command{Op: OpSeek}
+	switch to, bar := q.Get("to"), q.Get("bar"); {
+	case to != "" && bar == "":
+		d, err := time.ParseDuration(to)
+		if err != nil || d < 0 {
+			fail(w, http.StatusBadRequest, "to=%s: want an offset such as 1m30s", to)
+			return
+		}
+		c.At = d
+	case bar != "" && to == "":
+		n, err := strconv.Atoi(bar)
+		if err != nil || n < 1 {
+			fail(w, http.StatusBadRequest, "bar=%s: want a bar from 1", bar)
+			return
+		}
+		c.Bar = n
+	default:
+		fail(w, http.StatusBadRequest, "want one of to or bar")
+		return
+	}
+	s.do(w, c)
+}
+
+func (s *Server) mute(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(r.PathValue("channel"))
+	if err != nil || n < 1 || n > 16 {
+		fail(w, http.StatusBadRequest, "channel %s: want 1 to 16", r.PathValue("channel"))
+		return
+	}
+	c, ok := silence(w, r.PathValue("action"), OpMute, OpSolo)
+	if ok {
+		c.Channel = byte(n - 1)
+		s.do(w, c)
+	}
+}
+
+func (s *Server) muteDevice(w http.ResponseWriter, r *http.Request) {
+	d, err := strconv.ParseUint(r.PathValue("device"), 0, 8)
+	if err != nil || d == 0 {
+		fail(w, http.StatusBadRequest, "device %s: want 1 to 255, as 0x01", r.PathValue("device"))
+		return
+	}
+	c, ok := silence(w, r.PathValue("action"), OpMuteDevice, OpSoloDevice)
+	if ok {
+		c.Device = byte(d)
+		s.do(w, c)
+	}
+}
+
+// silence returns the command for action, mute, unmute, solo or unsolo,
+// as mute or solo; or it answers that there is no such action, and
+// returns false.
+func silence(w http.ResponseWriter, action string, mute, solo Op) (Command, bool) {
+	switch action {
+	case "mute":
+		return Command{Op: mute, Mute: true}, true
+	case "unmute":
+		return Command{Op: mute}, true
+	case "solo":
+		return Command{Op: solo, Solo: true}, true
+	case "unsolo":
+		return Command{Op: solo}, true
+	}
+	fail(w, http.StatusNotFound, "%s: want mute, unmute, solo or unsolo", action)
+	return Command{}, false
+}
+
+func (s *Server) offset(w http.ResponseWriter, r *http.Request) {
+	d, err := strconv.ParseUint(r.PathValue("device"), 0, 8)
+	if err != nil || d == 0 {
+		fail(w, http.StatusBadRequest, "device %s: want 1 to 255, as 0x01", r.PathValue("device"))
+		return
+	}
+	c := Command{Op: OpOffset, Device: byte(d)}
+	q := r.URL.Query()
+	switch ms, by := q.Get("ms"), q.Get("by"); {
+	case ms != "" && by == "":
+		n, err := strconv.Atoi(ms)
+		if err != nil || n < -maxOffset || n > maxOffset {
+			fail(w, http.StatusBadRequest, "ms=%s: want milliseconds, %d to %d", ms, -maxOffset, maxOffset)
+			return
+		}
+		c.Offset = time.Duration(n) * time.Millisecond
+	case by != "" && ms == "":
+		n, err := strconv.Atoi(by)
+		if err != nil || n < -maxOffset || n > maxOffset {
+			fail(w, http.StatusBadRequest, "by=%s: want milliseconds, %d to %d", by, -maxOffset, maxOffset)
+			return
+		}
+		c.Offset, c.Nudge = time.Duration(n)*time.Millisecond, true
+	default:
+		fail(w, http.StatusBadRequest, "want one of ms or by")
+		return
+	}
+	s.do(w, c)
+}
+
+// maxOffset is the most milliseconds a device's offset may be, either way.
+const maxOffset = int(mapping.MaxOffset / time.Millisecond)
+
+// The tempo and transpose a player takes, as controller.Player's.
+const (
+	minTempo, maxTempo = 25, 400 // percent
+	maxTranspose       = 24      // semitones, either way
+)
+
+func (s *Server) tempo(w http.ResponseWriter, r *http.Request) {
+	n, nudge, ok := setting(w, r.URL.Query(), "percent", minTempo, maxTempo)
+	if ok {
+		s.do(w, Command{Op: OpTempo, Tempo: n, Nudge: nudge})
+	}
+}
+
+func (s *Server) transpose(w http.ResponseWriter, r *http.Request) {
+	n, nudge, ok := setting(w, r.URL.Query(), "semitones", -maxTranspose, maxTranspose)
+	if ok {
+		s.do(w, Command{Op: OpTranspose, Transpose: n, Nudge: nudge})
+	}
+}
+
+// setting reads the query parameter named to, a setting's new value from
+// lo to hi, or by, how much to move it, and reports which; or it answers
+// why it can't, and returns false.
+func setting(w http.ResponseWriter, q url.Values, to string, lo, hi int) (n int, nudge, ok bool) {
+	switch v, by := q.Get(to), q.Get("by"); {
+	case v != "" && by == "":
+		n, err := strconv.Atoi(v)
+		if err != nil || n < lo || n > hi {
+			fail(w, http.StatusBadRequest, "%s=%s: want %d to %d", to, v, lo, hi)
+			return 0, false, false
+		}
+		return n, false, true
+	case by != "" && v == "":
+		n, err := strconv.Atoi(by)
+		if err != nil || n < lo-hi || n > hi-lo {
+			fail(w, http.StatusBadRequest, "by=%s: want %d to %d", by, lo-hi, hi-lo)
+			return 0, false, false
+		}
+		return n, true, true
+	}
+	fail(w, http.StatusBadRequest, "want one of %s or by", to)
+	return 0, false, false
+}
+
+func (s *Server) mappings(w http.ResponseWriter, r *http.Request) {
+	files := []string{}
+	if s.Maps != "" {
+		entries, err := os.ReadDir(s.Maps)
+		if err != nil {
+			fail(w, http.StatusInternalServerError, "mapping files: %v", err)
+			return
+		}
+		for _, e := range entries {
+			if ext := filepath.Ext(e.Name()); !e.IsDir() && (ext == ".yaml" || ext == ".yml") {
+				files = append(files, e.Name())
+			}
+		}
+	}
+	slices.Sort(files)
+	reply(w, http.StatusOK, map[string][]string{"mappings": files})
+}
+
+func (s *Server) chooseMapping(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("file")
+	switch {
+	case s.Maps == "":
+		fail(w, http.StatusNotFound, "no mapping files to choose from")
+		return
+	case name == "" || name != filepath.Base(name) || strings.HasPrefix(name, "."):
+		fail(w, http.StatusBadRequest, "file=%s: want the name of one of GET /mappings", name)
+		return
+	}
+	m, err := mapping.Load(filepath.Join(s.Maps, name))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		fail(w, http.StatusNotFound, "no mapping file %s", name)
+		return
+	case err != nil:
+		fail(w, http.StatusUnprocessableEntity, "%v", err)
+		return
+	}
+	s.do(w, Command{Op: OpMapping, Mapping: m, MappingFile: name})
+}
+
+func (s *Server) uploadMapping(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMapping))
+	if err != nil {
+		fail(w, http.StatusRequestEntityTooLarge, "mapping file: %v", err)
+		return
+	}
+	m, err := mapping.Parse(strings.NewReader(string(body)))
+	if err != nil {
+		fail(w, http.StatusUnprocessableEntity, "%v", err)
+		return
+	}
+	s.do(w, Command{Op: OpMapping, Mapping: m})
+}
+
+func reply(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func fail(w http.ResponseWriter, code int, format string, args ...any) {
+	reply(w, code, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
@@ -0,0 +1,278 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakePlayer is a Transport noting the commands it is given, refusing
+// next and prev, as a player of one song would.
+type fakePlayer struct {
+	mu     sync.Mutex
+	status Status
+	got    []Command
+}
+
+func (p *fakePlayer) Status() Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+func (p *fakePlayer) Do(c Command) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch c.Op {
+	case OpNext, OpPrev:
+		return errors.New("no playlist")
+	case OpPause:
+		p.status.State = Paused
+	case OpMapping:
+		p.status.Mapping = c.MappingFile
+	}
+	p.got = append(p.got, c)
+	return nil
+}
+
+func (p *fakePlayer) commands() []Command {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.got
+}
+
+// newServer serves the API on a fakePlayer, with mapping files in a
+// directory of their own.
+func newServer(t *testing.T, token string) (*httptest.Server, *fakePlayer) {
+	t.Helper()
+	maps := t.TempDir()
+	for name, body := range map[string]string{
+		"stage.yaml": "channels:\n  1: 0x02/3\n",
+		"bad.yaml":   "channels:\n  17: 1\n",
+		"notes.txt":  "not a mapping",
+	} {
+		if err := os.WriteFile(filepath.Join(maps, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := &fakePlayer{status: Status{
+		State:    Playing,
+		Song:     "song.mid",
+		Position: 1.5,
+		Length:   90,
+		Songs:    1,
+		Muted:    []int{},
+		Soloed:   []int{},
+		Tempo:    100,
+		Devices:  []Device{{Address: "0x01", FirstDrive: 1, LastDrive: 8, Port: "/dev/ttyUSB0", Connected: true}},
+	}}
+	srv := httptest.NewServer((&Server{Transport: p, Token: token, Maps: maps}).Handler())
+	t.Cleanup(srv.Close)
+	return srv, p
+}
+
+// call makes a request and returns the status code and the JSON answer,
+// checking it is JSON.
+func call(t *testing.T, srv *httptest.Server, method, path, body string, header ...string) (int, map[string]any) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s %s: Content-Type %q", method, path, ct)
+	}
+	var v map[string]any
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("%s %s: answered %q: %v", method, path, data, err)
+	}
+	return resp.StatusCode, v
+}
+
+func TestStatus(t *testing.T) {
+	srv, _ := newServer(t, "")
+	code, v := call(t, srv, "GET", "/status", "")
+	if code != http.StatusOK {
+		t.Fatalf("status %d: %v", code, v)
+	}
+	got, _ := json.Marshal(v)
+	want := `{"devices":[{"address":"0x01","connected":true,"first_drive":1,"last_drive":8,"port":"/dev/ttyUSB0"}],` +
+		`"index":0,"length":90,"muted":[],"position":1.5,"soloed":[],"song":"song.mid","songs":1,"state":"playing","tempo":100}`
+	if string(got) != want {
+		t.Errorf("status\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	srv, p := newServer(t, "")
+	tests := []struct {
+		method, path, body string
+		code               int
+		want               string // the command given, if any
+	}{
+		{"POST", "/play", "", 200, "{play 0s 0 0 false false <nil>   0 0s false 0 0}"},
+		{"POST", "/play?file=fanfare.mid", "", 200, "{play 0s 0 0 false false <nil>  fanfare.mid 0 0s false 0 0}"},
+		{"POST", "/play?file=../fanfare.mid", "", 400, ""},
+		{"POST", "/panic", "", 200, "{panic 0s 0 0 false false <nil>   0 0s false 0 0}"},
+		{"POST", "/pause", "", 200, "{pause 0s 0 0 false false <nil>   0 0s false 0 0}"},
+		{"POST", "/stop", "", 200, "{stop 0s 0 0 false false <nil>   0 0s false 0 0}"},
+		{"POST", "/next", "", 409, ""},
+		{"POST", "/prev", "", 409, ""},
+		{"POST", "/seek?to=1m30s", "", 200, "{seek 1m30s 0 0 false false <nil>   0 0s false 0 0}"},
+		{"POST", "/seek?bar=12", "", 200, "{seek 0s 12 0 false false <nil>   0 0s false 0 0}"},
+		{"POST", "/seek?to=soon", "", 400, ""},
+		{"POST", "/seek?bar=0", "", 400, ""},
+		{"POST", "/seek?to=1s&bar=2", "", 400, ""},
+		{"POST", "/seek", "", 400, ""},
+		{"POST", "/channels/3/mute", "", 200, "{mute 0s 0 2 true false <nil>   0 0s false 0 0}"},
+		{"POST", "/channels/16/unmute", "", 200, "{mute 0s 0 15 false false <nil>   0 0s false 0 0}"},
+		{"POST", "/channels/17/mute", "", 400, ""},
+		{"POST", "/channels/1/solo", "", 200, "{solo 0s 0 0 false true <nil>   0 0s false 0 0}"},
+		{"POST", "/channels/1/unsolo", "", 200, "{solo 0s 0 0 false false <nil>   0 0s false 0 0}"},
+		{"POST", "/channels/1/loud", "", 404, ""},
+		{"POST", "/devices/0x04/offset?ms=12", "", 200, "{offset 0s 0 0 false false <nil>   4 12ms false 0 0}"},
+		{"POST", "/devices/2/offset?by=-1", "", 200, "{offset 0s 0 0 false false <nil>   2 -1ms true 0 0}"},
+		{"POST", "/devices/0x04/offset?ms=1001", "", 400, ""},
+		{"POST", "/devices/0/offset?ms=1", "", 400, ""},
+		{"POST", "/devices/0x04/offset?ms=1&by=1", "", 400, ""},
+		{"POST", "/devices/0x04/offset", "", 400, ""},
+		{"POST", "/devices/0x04/mute", "", 200, "{mute-device 0s 0 0 true false <nil>   4 0s false 0 0}"},
+		{"POST", "/devices/2/unsolo", "", 200, "{solo-device 0s 0 0 false false <nil>   2 0s false 0 0}"},
+		{"POST", "/devices/0x04/solo", "", 200, "{solo-device 0s 0 0 false true <nil>   4 0s false 0 0}"},
+		{"POST", "/devices/0/mute", "", 400, ""},
+		{"POST", "/devices/0x04/loud", "", 404, ""},
+		{"POST", "/tempo?percent=103", "", 200, "{tempo 0s 0 0 false false <nil>   0 0s false 103 0}"},
+		{"POST", "/tempo?by=-1", "", 200, "{tempo 0s 0 0 false false <nil>   0 0s true -1 0}"},
+		{"POST", "/tempo?percent=10", "", 400, ""},
+		{"POST", "/tempo?by=fast", "", 400, ""},
+		{"POST", "/transpose?semitones=-2", "", 200, "{transpose 0s 0 0 false false <nil>   0 0s false 0 -2}"},
+		{"POST", "/transpose?by=1", "", 200, "{transpose 0s 0 0 false false <nil>   0 0s true 0 1}"},
+		{"POST", "/transpose?semitones=25", "", 400, ""},
+		{"POST", "/transpose", "", 400, ""},
+		{"GET", "/pause", "", 405, ""},
+		{"GET", "/nosuch", "", 404, ""},
+	}
+	for _, tt := range tests {
+		before := len(p.commands())
+		code, v := call(t, srv, tt.method, tt.path, tt.body)
+		if code != tt.code {
+			t.Errorf("%s %s: status %d, want %d: %v", tt.method, tt.path, code, tt.code, v)
+			continue
+		}
+		if code != 200 {
+			if _, ok := v["error"].(string); !ok {
+				t.Errorf("%s %s: answered %v, want an error", tt.method, tt.path, v)
+			}
+		} else if v["state"] == nil {
+			t.Errorf("%s %s: answered %v, want the status", tt.method, tt.path, v)
+		}
+		got := p.commands()[before:]
+		switch {
+		case tt.want == "" && len(got) != 0:
+			t.Errorf("%s %s: gave the player %v", tt.method, tt.path, got)
+		case tt.want != "" && (len(got) != 1 || fmt.Sprint(got[0]) != tt.want):
+			t.Errorf("%s %s: gave the player %v, want %s", tt.method, tt.path, got, tt.want)
+		}
+	}
+	if code, v := call(t, srv, "GET", "/status", ""); code != 200 || v["state"] != Paused {
+		t.Errorf("status after pausing: %d %v", code, v)
+	}
+}
+
+func TestMappings(t *testing.T) {
+	srv, p := newServer(t, "")
+	if code, v := call(t, srv, "GET", "/mappings", ""); code != 200 || fmt.Sprint(v["mappings"]) != "[bad.yaml stage.yaml]" {
+		t.Errorf("mappings: %d %v", code, v)
+	}
+	tests := []struct {
+		method, path, body string
+		code               int
+	}{
+		{"POST", "/mapping?file=stage.yaml", "", 200},
+		{"POST", "/mapping?file=bad.yaml", "", 422},
+		{"POST", "/mapping?file=nosuch.yaml", "", 404},
+		{"POST", "/mapping?file=../stage.yaml", "", 400},
+		{"POST", "/mapping", "", 400},
+		{"PUT", "/mapping", "channels:\n  2: 0x03/1\n", 200},
+		{"PUT", "/mapping", "channels:\n  2: 0x00/1\n", 422},
+	}
+	for _, tt := range tests {
+		if code, v := call(t, srv, tt.method, tt.path, tt.body); code != tt.code {
+			t.Errorf("%s %s: status %d, want %d: %v", tt.method, tt.path, code, tt.code, v)
+		}
+	}
+	got := p.commands()
+	if len(got) != 2 {
+		t.Fatalf("gave the player %v, want two mappings", got)
+	}
+	if c := got[0]; c.MappingFile != "stage.yaml" || c.Mapping.Channels[0].Target.Device != 0x02 {
+		t.Errorf("chose %+v, want stage.yaml", c)
+	}
+	if c := got[1]; c.MappingFile != "" || c.Mapping.Channels[1].Target.Device != 0x03 {
+		t.Errorf("uploaded %+v, want channel 2 on device 3", c)
+	}
+}
+
+func TestToken(t *testing.T) {
+	srv, p := newServer(t, "s3cret")
+	tests := []struct {
+		path   string
+		header []string
+		code   int
+	}{
+		{"/status", nil, 401},
+		{"/status", []string{"Authorization", "Bearer nope"}, 401},
+		{"/status", []string{"Authorization", "Bearer s3cret"}, 200},
+		{"/status?token=s3cret", nil, 200},
+		{"/status?token=s3cre", nil, 401},
+		{"/events", nil, 401},
+	}
+	for _, tt := range tests {
+		if code, v := call(t, srv, "GET", tt.path, "", tt.header...); code != tt.code {
+			t.Errorf("GET %s %v: status %d, want %d: %v", tt.path, tt.header, code, tt.code, v)
+		}
+	}
+	if code, _ := call(t, srv, "POST", "/stop", ""); code != 401 || len(p.commands()) != 0 {
+		t.Errorf("stopped without the token: %d, %v", code, p.commands())
+	}
+}
+
+// TestEvents serves GET /events by Server.Events, behind the token, and
+// answers 404 without it.
+func TestEvents(t *testing.T) {
+	srv, _ := newServer(t, "")
+	if code, v := call(t, srv, "GET", "/events", ""); code != http.StatusNotFound {
+		t.Errorf("GET /events without Events: status %d, want 404: %v", code, v)
+	}
+	events := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reply(w, http.StatusOK, map[string]string{"events": "here"})
+	})
+	srv = httptest.NewServer((&Server{Transport: &fakePlayer{}, Token: "s3cret", Events: events}).Handler())
+	defer srv.Close()
+	if code, v := call(t, srv, "GET", "/events?token=s3cret", ""); code != http.StatusOK || v["events"] != "here" {
+		t.Errorf("GET /events: status %d, %v", code, v)
+	}
+	if code, _ := call(t, srv, "GET", "/events", ""); code != http.StatusUnauthorized {
+		t.Errorf("GET /events without the token: status %d, want 401", code)
+	}
+}
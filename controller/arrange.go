@@ -0,0 +1,134 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+)
+
+// Arrangement is what Arrange did to a song.
+type Arrangement struct {
+	Strategy mapping.Strategy
+	Shift    int // semitones StrategyShift moved the song by
+	Notes    int // note-ons on the channels m plays notes on
+	Moved    int // of those, moved into range
+	Dropped  int // dropped, being out of range
+	Outside  int // left out of range, for the firmware to drop or fold
+}
+
+func (a Arrangement) String() string {
+	s := fmt.Sprintf("%s: %d notes, %d moved, %d dropped", a.Strategy, a.Notes, a.Moved, a.Dropped)
+	if a.Strategy == mapping.StrategyShift {
+		s += fmt.Sprintf(", song shifted %+d", a.Shift)
+	}
+	if a.Outside > 0 {
+		s += fmt.Sprintf(", %d still out of range", a.Outside)
+	}
+	return s
+}
+
+// maxShift is the furthest StrategyShift shifts a song, in semitones.
+const maxShift = 36
+
+// Arrange returns events with the notes outside their channel's range
+// brought in by strategy s, and what it did. A note's range is its
+// channel's mapping.Channel.NoteRange, after the channel's transpose;
+// notes on the percussion channel and on channels m doesn't play are left
+// alone. A note-off follows its note-on, so a note moved is released
+// where it sounds and a note dropped isn't released. events is left as it
+// was.
+//
+// StrategyFold moves each note by octaves into range, dropping it if its
+// range is too narrow for that. StrategyShift scans the song first for
+// the interval, up to three octaves either way, putting the most notes in
+// range, and shifts every note by it, the smallest interval winning ties;
+// notes still out of range are left to the firmware. StrategyDrop drops
+// them, and StrategyNone leaves them all to the firmware.
+func Arrange(events []Event, m *mapping.Map, s mapping.Strategy) ([]Event, Arrangement) {
+	a := Arrangement{Strategy: s}
+	plays := func(ev Event) bool {
+		return (ev.Kind == NoteOn || ev.Kind == NoteOff) && m.Channels[ev.Channel].Mapped() && !m.Drums(ev.Channel)
+	}
+	inRange := func(ev Event, shift int) bool {
+		c := m.Channels[ev.Channel]
+		return c.NoteRange().Contains(int(ev.Note) + shift + c.Transpose)
+	}
+	if s == mapping.StrategyShift {
+		best := -1
+		for _, shift := range shifts() {
+			n := 0
+			for _, ev := range events {
+				if ev.Kind == NoteOn && plays(ev) && inRange(ev, shift) {
+					n++
+				}
+			}
+			if n > best {
+				best, a.Shift = n, shift
+			}
+		}
+	}
+
+	out := make([]Event, 0, len(events))
+	for _, ev := range events {
+		if !plays(ev) {
+			out = append(out, ev)
+			continue
+		}
+		note, moved, ok := arrangeNote(ev, m.Channels[ev.Channel], s, a.Shift)
+		if ev.Kind == NoteOn {
+			a.Notes++
+			switch {
+			case !ok:
+				a.Dropped++
+			case moved:
+				a.Moved++
+			}
+			if ok && !inRange(Event{Channel: ev.Channel, Note: note}, 0) {
+				a.Outside++
+			}
+		}
+		if ok {
+			ev.Note = note
+			out = append(out, ev)
+		}
+	}
+	return out, a
+}
+
+// shifts returns the intervals StrategyShift tries, smallest first.
+func shifts() []int {
+	s := []int{0}
+	for i := 1; i <= maxShift; i++ {
+		s = append(s, i, -i)
+	}
+	return s
+}
+
+// arrangeNote returns where strategy s puts ev's note on channel c, and
+// whether it moved it, or false if it drops it.
+func arrangeNote(ev Event, c mapping.Channel, s mapping.Strategy, shift int) (note byte, moved, ok bool) {
+	r := c.NoteRange()
+	n := int(ev.Note)
+	switch s {
+	case mapping.StrategyShift:
+		n += shift
+	case mapping.StrategyFold:
+		for n+c.Transpose > int(r.High) {
+			n -= 12
+		}
+		for n+c.Transpose < int(r.Low) {
+			n += 12
+		}
+		if !r.Contains(n + c.Transpose) {
+			return 0, false, false
+		}
+	case mapping.StrategyDrop:
+		if !r.Contains(n + c.Transpose) {
+			return 0, false, false
+		}
+	}
+	if n < 0 || n > 127 {
+		return 0, false, false
+	}
+	return byte(n), n != int(ev.Note), true
+}
@@ -0,0 +1,125 @@
+package controller
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+)
+
+// notesOf returns the notes struck on channel, in order.
+func notesOf(events []Event, channel byte) []byte {
+	var notes []byte
+	for _, ev := range events {
+		if ev.Kind == NoteOn && ev.Channel == channel {
+			notes = append(notes, ev.Note)
+		}
+	}
+	return notes
+}
+
+// TestArrange arranges testdata/arrange/basspiccolo.mid, a bass line
+// reaching down to E0 on channel 1 and a piccolo part up to G7 on channel
+// 2, for two drives playing C1 to B4, 24 to 71.
+func TestArrange(t *testing.T) {
+	song, err := ReadSMF("testdata/arrange/basspiccolo.mid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bass, piccolo := []byte{28, 23, 16, 21, 33}, []byte{86, 91, 98, 103, 74}
+	if !slices.Equal(notesOf(song, 0), bass) || !slices.Equal(notesOf(song, 1), piccolo) {
+		t.Fatalf("fixture has bass %v and piccolo %v", notesOf(song, 0), notesOf(song, 1))
+	}
+	tests := []struct {
+		strategy      mapping.Strategy
+		bass, piccolo []byte
+		want          Arrangement
+	}{
+		{
+			strategy: mapping.StrategyNone,
+			bass:     bass,
+			piccolo:  piccolo,
+			want:     Arrangement{Notes: 10, Outside: 8},
+		},
+		{
+			// Up an octave at a time into range, or down.
+			strategy: mapping.StrategyFold,
+			bass:     []byte{28, 35, 28, 33, 33},
+			piccolo:  []byte{62, 67, 62, 67, 62},
+			want:     Arrangement{Notes: 10, Moved: 8},
+		},
+		{
+			// Up 8 or more semitones puts the whole bass line in range; down
+			// 32 to 36 the whole piccolo part, and no shift does better than
+			// five notes. 8 is the smallest.
+			strategy: mapping.StrategyShift,
+			bass:     []byte{36, 31, 24, 29, 41},
+			piccolo:  []byte{94, 99, 106, 111, 82},
+			want:     Arrangement{Shift: 8, Notes: 10, Moved: 10, Outside: 5},
+		},
+		{
+			strategy: mapping.StrategyDrop,
+			bass:     []byte{28, 33},
+			want:     Arrangement{Notes: 10, Dropped: 8},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy.String(), func(t *testing.T) {
+			before := slices.Clone(song)
+			got, a := Arrange(song, mapping.Channels(0x01, 1, 2), tt.strategy)
+			tt.want.Strategy = tt.strategy
+			if a != tt.want {
+				t.Errorf("got %+v, want %+v", a, tt.want)
+			}
+			if b := notesOf(got, 0); !slices.Equal(b, tt.bass) {
+				t.Errorf("bass %v, want %v", b, tt.bass)
+			}
+			if p := notesOf(got, 1); !slices.Equal(p, tt.piccolo) {
+				t.Errorf("piccolo %v, want %v", p, tt.piccolo)
+			}
+			// Each note struck is released, where it was struck.
+			held := map[[2]byte]int{}
+			for _, ev := range got {
+				switch ev.Kind {
+				case NoteOn:
+					held[[2]byte{ev.Channel, ev.Note}]++
+				case NoteOff:
+					held[[2]byte{ev.Channel, ev.Note}]--
+				}
+			}
+			for n, h := range held {
+				if h != 0 {
+					t.Errorf("channel %d note %d struck %d more times than released", n[0]+1, n[1], h)
+				}
+			}
+			if !slices.Equal(song, before) {
+				t.Error("Arrange changed the events it was given")
+			}
+		})
+	}
+}
+
+// TestArrangeMapping arranges through a mapping's own ranges and
+// transposes, leaving the percussion channel and unmapped channels be.
+func TestArrangeMapping(t *testing.T) {
+	m := mapping.Channels(0x01, 1, 1)
+	m.Channels[0].Range = mapping.Range{Low: 48, High: 59}
+	m.Channels[0].Transpose = -12
+	m.Percussion.Hits = map[byte]mapping.Hit{36: {Target: mapping.Target{Device: 0x02, Sub: 1}, Reset: true}}
+	events := []Event{
+		{Kind: NoteOn, Channel: 0, Note: 60, Value: 100}, // sounds 48: in range
+		{Kind: NoteOn, Channel: 0, Note: 84, Value: 100}, // sounds 72: folds to 60, then 48
+		{Kind: NoteOn, Channel: 9, Note: 36, Value: 100},
+		{Kind: NoteOn, Channel: 4, Note: 100, Value: 100},
+	}
+	got, a := Arrange(events, m, mapping.StrategyFold)
+	if want := []byte{60, 60}; !slices.Equal(notesOf(got, 0), want) {
+		t.Errorf("channel 1 plays %v, want %v", notesOf(got, 0), want)
+	}
+	if notesOf(got, 9)[0] != 36 || notesOf(got, 4)[0] != 100 {
+		t.Error("arranged a channel it should have left be")
+	}
+	if a.Notes != 2 || a.Moved != 1 {
+		t.Errorf("got %+v", a)
+	}
+}
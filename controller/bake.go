@@ -0,0 +1,125 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// Bake plays events as Play would, through the Player's mapping, devices,
+// bends, preset rate, loop, arrange, mutes, solos, tempo and transpose, but
+// without waiting, and writes each message sent to w at the offset Play
+// would have sent it: a baked file in package protocol's format, at
+// tickRate ticks a second, or protocol.BakedTickRate if 0. Its header
+// names the optional commands the messages use. A loop played until
+// stopped can't be baked.
+func (p *Player) Bake(w io.Writer, events []Event, tickRate uint32) error {
+	if tickRate == 0 {
+		tickRate = protocol.BakedTickRate
+	}
+	if p.Loop.On() && p.Loop.Count == 0 {
+		return errors.New("controller: bake: the loop plays until stopped")
+	}
+	b := &baker{rate: tickRate}
+	p.mu.Lock()
+	m := p.mapping
+	if p.remap != nil {
+		m = p.remap
+	}
+	q := &Player{
+		Bends:      p.Bends,
+		PresetRate: p.PresetRate,
+		Loop:       p.Loop,
+		Devices:    p.Devices,
+		Arrange:    p.Arrange,
+		out:        b,
+		mapping:    m,
+		clock:      b,
+		muted:      p.muted,
+		soloed:     p.soloed,
+		devMuted:   p.devMuted,
+		devSoloed:  p.devSoloed,
+		tempo:      p.tempo,
+		shift:      p.shift,
+		wake:       make(chan struct{}, 1),
+	}
+	p.mu.Unlock()
+	if err := q.Play(context.Background(), events); err != nil {
+		return fmt.Errorf("controller: bake: %w", err)
+	}
+	h := protocol.AppendBakedHeader(nil, protocol.BakedHeader{TickRate: tickRate, Caps: uint16(b.caps)})
+	if _, err := w.Write(h); err != nil {
+		return err
+	}
+	_, err := w.Write(b.entries)
+	return err
+}
+
+// baker is the Sender and the clock a Bake plays through: the clock jumps
+// to each event as it is slept until, and each message sent is appended
+// as an entry at it.
+type baker struct {
+	t       time.Time
+	rate    uint32
+	ticks   uint64       // to the entry before
+	caps    Capabilities // of the messages sent
+	frame   []byte
+	entries []byte
+}
+
+func (b *baker) now() time.Time { return b.t }
+
+func (b *baker) sleepUntil(ctx context.Context, t time.Time, _ <-chan struct{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if t.After(b.t) {
+		b.t = t
+	}
+	return nil
+}
+
+func (b *baker) Send(m protocol.Message) error {
+	b.frame = append(b.frame[:0], make([]byte, m.Len())...)
+	if _, err := m.Encode(b.frame); err != nil {
+		return err
+	}
+	b.caps |= needs(m)
+	at := b.t.Sub(time.Time{})
+	rate := time.Duration(b.rate)
+	ticks := uint64(at/time.Second)*uint64(b.rate) + uint64((at%time.Second*rate+time.Second/2)/time.Second)
+	b.entries = protocol.AppendBakedEntry(b.entries, ticks-b.ticks, b.frame)
+	b.ticks = ticks
+	return nil
+}
+
+// ReadBaked reads a baked file written by Bake, as frames for Replay to
+// play.
+func ReadBaked(r io.Reader) (protocol.BakedHeader, []CapturedFrame, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return protocol.BakedHeader{}, nil, err
+	}
+	h, n, err := protocol.DecodeBakedHeader(data)
+	if err != nil {
+		return h, nil, err
+	}
+	var frames []CapturedFrame
+	var ticks uint64
+	rate := uint64(h.TickRate)
+	for pos := n; pos < len(data); pos += n {
+		var delta uint64
+		var frame []byte
+		if delta, frame, n, err = protocol.DecodeBakedEntry(data[pos:]); err != nil {
+			return h, frames, fmt.Errorf("baked entry %d: %w", len(frames), err)
+		}
+		ticks += delta
+		at := time.Duration(ticks/rate)*time.Second + time.Duration(ticks%rate)*time.Second/time.Duration(rate)
+		frames = append(frames, CapturedFrame{At: at, Frame: frame})
+	}
+	return h, frames, nil
+}
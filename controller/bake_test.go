@@ -0,0 +1,120 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// TestBakeRoundTrip bakes each testdata/*.mid as TestFixtures plays it,
+// transposed and at another tempo, then replays the baked file: the
+// replay sends what playing the song live does, when it does, to the
+// microsecond the file keeps, and at milliseconds to within half of one.
+func TestBakeRoundTrip(t *testing.T) {
+	songs, err := filepath.Glob("testdata/*.mid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, song := range songs {
+		t.Run(filepath.Base(song), func(t *testing.T) {
+			events, err := ReadSMF(song)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := mapping.Channels(0x01, 1, 8)
+			setUp := func(p *Player) {
+				p.Bends.Rate = 50
+				p.SetTempo(150)
+				p.Transpose(2)
+			}
+			live, r := newRecorder(m)
+			setUp(live)
+			if err := live.Play(context.Background(), events); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, rate := range []uint32{1000000, 1000} {
+				baker := NewPlayer(nil, m)
+				setUp(baker)
+				var file bytes.Buffer
+				if err := baker.Bake(&file, events, rate); err != nil {
+					t.Fatal(err)
+				}
+				h, frames, err := ReadBaked(&file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if h.TickRate != rate || Capabilities(h.Caps) != CapVelocity {
+					t.Errorf("at %d: header %+v, want velocity", rate, h)
+				}
+				p, replayed := newRecorder(nil)
+				if err := p.Replay(context.Background(), frames); err != nil {
+					t.Fatal(err)
+				}
+				if len(replayed.sent) != len(r.sent) {
+					t.Fatalf("at %d: replayed\n%s\nwant\n%s", rate, fmtSent(replayed.sent), fmtSent(r.sent))
+				}
+				tick := time.Second / time.Duration(rate)
+				for i, s := range replayed.sent {
+					want := r.sent[i]
+					if fmt.Sprint(s.m) != fmt.Sprint(want.m) || (s.at-want.at).Abs() > tick/2 {
+						t.Errorf("at %d: message %d: %v, want %v", rate, i, s, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestBakeForDevices bakes for a device answering as Moppy's firmware
+// does: the notes lose their velocity, and the file needs nothing
+// optional. A loop played until stopped has no end to bake to.
+func TestBakeForDevices(t *testing.T) {
+	events := []Event{
+		{Kind: NoteOn, Note: 60, Value: 100},
+		{At: 100 * time.Millisecond, Kind: NoteOff, Note: 60},
+	}
+	p := NewPlayer(nil, mapping.Channels(0x01, 1, 1))
+	p.Devices = NewDeviceRegistry()
+	p.Devices.Add(DeviceInfo{Address: 0x01, FirstDrive: 1, LastDrive: 1})
+	var file bytes.Buffer
+	if err := p.Bake(&file, events, 0); err != nil {
+		t.Fatal(err)
+	}
+	h, frames, err := ReadBaked(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != (protocol.BakedHeader{Version: protocol.BakedVersion, TickRate: protocol.BakedTickRate}) {
+		t.Errorf("header %+v, want milliseconds and no caps", h)
+	}
+	replay, r := newRecorder(nil)
+	if err := replay.Replay(context.Background(), frames); err != nil {
+		t.Fatal(err)
+	}
+	checkSent(t, sentOf(r), []protocol.Message{
+		protocol.SequenceStart(),
+		protocol.NoteOn(0x01, 1, 60),
+		protocol.NoteOff(0x01, 1, 60),
+		protocol.SequenceStop(),
+	})
+	if r.sent[2].at != 100*time.Millisecond {
+		t.Errorf("note-off at %v, want 100ms", r.sent[2].at)
+	}
+
+	p.Loop = Loop{End: 50 * time.Millisecond}
+	if err := p.Bake(&file, events, 0); err == nil {
+		t.Error("baked a loop played until stopped")
+	}
+	capture := protocol.AppendCaptureEntry(protocol.AppendCaptureHeader(nil, protocol.CaptureHeader{}), 0, nil)
+	if _, _, err := ReadBaked(bytes.NewReader(capture)); !errors.Is(err, protocol.ErrNotBaked) {
+		t.Errorf("read a capture as baked: %v", err)
+	}
+}
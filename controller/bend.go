@@ -0,0 +1,77 @@
+package controller
+
+import "time"
+
+// BendOptions says how a Player or a Bridge passes pitch bends and bend
+// ranges on. The zero value passes every bend on, and every bend range to
+// every device.
+type BendOptions struct {
+	// Rate is the most pitch bends a second sent for each channel. A bend
+	// sooner than that after the last is held back, and the latest held
+	// back is sent once the rate allows, or before the channel's next
+	// note-on if that is sooner, so a note starts at the bend its channel
+	// settled on. 0 for no limit.
+	Rate int
+
+	// BendRange reports whether a device takes DevCmdBendRange, which
+	// goppy firmware does and Moppy's doesn't. A channel's RPN 0 is sent
+	// as a bend range only to the devices it reports true for; nil for
+	// every device.
+	BendRange func(device byte) bool
+}
+
+// DefaultPresetRate is the most presets a second a Player sends each
+// channel's drives, unless its PresetRate says otherwise.
+const DefaultPresetRate = 4
+
+// bendLimiter holds each channel's pitch bends to a rate, keeping the
+// latest of those held back. A translator holds program changes to theirs
+// with another.
+type bendLimiter struct {
+	interval time.Duration // between bends on a channel; 0 for no limit
+	last     [16]time.Duration
+	sent     [16]bool // whether last is set
+	pending  [16]*Event
+}
+
+func newBendLimiter(rate int) bendLimiter {
+	var l bendLimiter
+	if rate > 0 {
+		l.interval = time.Second / time.Duration(rate)
+	}
+	return l
+}
+
+// allow reports whether the bend ev may go now, holding it back if not.
+func (l *bendLimiter) allow(ev Event) bool {
+	ch := ev.Channel
+	if l.interval == 0 || !l.sent[ch] || ev.At-l.last[ch] >= l.interval {
+		l.last[ch], l.sent[ch], l.pending[ch] = ev.At, true, nil
+		return true
+	}
+	l.pending[ch] = &ev
+	return false
+}
+
+// next returns when the first bend held back may go.
+func (l *bendLimiter) next() (time.Duration, bool) {
+	var at time.Duration
+	found := false
+	for ch, p := range l.pending {
+		if p != nil && (!found || l.last[ch]+l.interval < at) {
+			at, found = l.last[ch]+l.interval, true
+		}
+	}
+	return at, found
+}
+
+// take returns the bend held back on channel ch, if any, as sent at at.
+// Unless early, it is only returned once the rate allows.
+func (l *bendLimiter) take(ch byte, at time.Duration, early bool) (Event, bool) {
+	p := l.pending[ch]
+	if p == nil || !early && at-l.last[ch] < l.interval {
+		return Event{}, false
+	}
+	l.last[ch], l.pending[ch] = at, nil
+	return *p, true
+}
@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+func bendAt(ms int, bend int) Event {
+	return Event{At: time.Duration(ms) * time.Millisecond, Kind: PitchBend, Bend: uint16(8192 + bend)}
+}
+
+// TestBendRate plays a stream of bends at 10 a second: bends held back
+// go 100ms after the last sent, the latest of them only, or with the next
+// note-on if that is sooner.
+func TestBendRate(t *testing.T) {
+	events := []Event{
+		bendAt(0, 100),
+		bendAt(20, 200), // held back, then replaced
+		bendAt(50, 300),
+		bendAt(90, 400), // goes at 100ms
+		bendAt(150, 500),
+		{At: 160 * time.Millisecond, Kind: NoteOn, Note: 60, Value: 100}, // takes 500 with it
+		bendAt(400, 600),
+		bendAt(420, 700), // goes at 500ms
+		{At: 450 * time.Millisecond, Kind: NoteOff, Note: 60},
+		{At: 600 * time.Millisecond, Kind: NoteOn, Note: 62, Value: 100},
+		{At: 700 * time.Millisecond, Kind: NoteOff, Note: 62},
+	}
+	p, r := newRecorder(mapping.Channels(0x01, 1, 1))
+	p.Bends.Rate = 10
+	if err := p.Play(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+	want := []protocol.Message{
+		protocol.SequenceStart(),
+		protocol.PitchBend(0x01, 1, 100),
+		protocol.PitchBend(0x01, 1, 400),
+		protocol.PitchBend(0x01, 1, 500),
+		protocol.NoteOnVelocity(0x01, 1, 60, 100),
+		protocol.PitchBend(0x01, 1, 600),
+		protocol.NoteOff(0x01, 1, 60),
+		protocol.PitchBend(0x01, 1, 700),
+		protocol.NoteOnVelocity(0x01, 1, 62, 100),
+		protocol.NoteOff(0x01, 1, 62),
+		protocol.SequenceStop(),
+	}
+	var got []protocol.Message
+	var at []int64
+	for _, s := range r.sent {
+		got = append(got, s.m)
+		at = append(at, s.at.Milliseconds())
+	}
+	checkSent(t, got, want)
+	if wantAt := []int64{0, 0, 100, 160, 160, 400, 450, 500, 600, 700, 700}; !slices.Equal(at, wantAt) {
+		t.Errorf("sent at %v ms, want %v", at, wantAt)
+	}
+}
+
+func TestBendLimiter(t *testing.T) {
+	l := newBendLimiter(0)
+	for ms := range 5 {
+		if !l.allow(bendAt(ms, 0)) {
+			t.Fatal("no rate, but a bend was held back")
+		}
+	}
+
+	l = newBendLimiter(100) // 10ms apart
+	ch1 := bendAt(3, 1)
+	ch1.Channel = 1
+	for _, ev := range []Event{bendAt(0, 0), ch1, bendAt(4, 5), bendAt(6, 7)} {
+		l.allow(ev)
+	}
+	if at, ok := l.next(); !ok || at != 10*time.Millisecond {
+		t.Fatalf("next bend at %v, %v; want 10ms", at, ok)
+	}
+	if _, ok := l.take(0, 9*time.Millisecond, false); ok {
+		t.Error("took a bend before it was due")
+	}
+	if ev, ok := l.take(0, 10*time.Millisecond, false); !ok || ev.Bend != 8192+7 {
+		t.Errorf("took %+v, %v; want the last bend held back", ev, ok)
+	}
+	if _, ok := l.next(); ok {
+		t.Error("a bend is still held back")
+	}
+	if l.allow(bendAt(15, 9)) {
+		t.Error("a bend 5ms after the last went")
+	}
+	if ev, ok := l.take(0, 16*time.Millisecond, true); !ok || ev.Bend != 8192+9 {
+		t.Errorf("took %+v, %v early; want the bend held back", ev, ok)
+	}
+}
+
+// TestBendPool bends a pool channel: only the drives holding its notes
+// are bent, and a drive taking a note is brought to the channel's bend.
+func TestBendPool(t *testing.T) {
+	m := &mapping.Map{}
+	m.Channels[0].Pool = mapping.Pool{Device: 0x01, First: 1, Last: 3}
+	tr := newTranslator(m, BendOptions{})
+	steps := []struct {
+		ev      Event
+		want    []protocol.Message
+		holding []byte // the drives the translator has holding notes
+	}{
+		{Event{Kind: NoteOn, Note: 60, Value: 100}, []protocol.Message{protocol.NoteOnVelocity(0x01, 1, 60, 100)}, []byte{1}},
+		{Event{Kind: NoteOn, Note: 64, Value: 100}, []protocol.Message{protocol.NoteOnVelocity(0x01, 2, 64, 100)}, []byte{1, 2}},
+		{bendAt(0, 1000), []protocol.Message{protocol.PitchBend(0x01, 1, 1000), protocol.PitchBend(0x01, 2, 1000)}, []byte{1, 2}},
+		{Event{Kind: NoteOn, Note: 67, Value: 100}, []protocol.Message{
+			protocol.PitchBend(0x01, 3, 1000),
+			protocol.NoteOnVelocity(0x01, 3, 67, 100),
+		}, []byte{1, 2, 3}},
+		{Event{Kind: NoteOff, Note: 60}, []protocol.Message{protocol.NoteOff(0x01, 1, 60)}, []byte{2, 3}},
+		{bendAt(0, 0), []protocol.Message{protocol.PitchBend(0x01, 2, 0), protocol.PitchBend(0x01, 3, 0)}, []byte{2, 3}},
+		{Event{Kind: NoteOn, Note: 72, Value: 100}, []protocol.Message{
+			protocol.PitchBend(0x01, 1, 0), // still at 1000 from before
+			protocol.NoteOnVelocity(0x01, 1, 72, 100),
+		}, []byte{1, 2, 3}},
+		{Event{Kind: NoteOff, Note: 64}, []protocol.Message{protocol.NoteOff(0x01, 2, 64)}, []byte{1, 3}},
+		{Event{Kind: NoteOn, Note: 76, Value: 100}, []protocol.Message{protocol.NoteOnVelocity(0x01, 2, 76, 100)}, []byte{1, 2, 3}},
+	}
+	for i, s := range steps {
+		checkSent(t, tr.messages(s.ev), s.want)
+		var holding []byte
+		for _, d := range tr.holding(0) {
+			holding = append(holding, d.Sub)
+		}
+		if !slices.Equal(holding, s.holding) {
+			t.Errorf("step %d: drives %v holding notes, want %v", i, holding, s.holding)
+		}
+	}
+}
+
+func TestBendRange(t *testing.T) {
+	m := &mapping.Map{}
+	m.Channels[0].Target = mapping.Target{Device: 0x01, Sub: 1}
+	m.Channels[1].Target = mapping.Target{Device: 0x02, Sub: 1}
+	tr := newTranslator(m, BendOptions{BendRange: func(device byte) bool { return device == 0x01 }})
+	var got []protocol.Message
+	for ch := range byte(2) {
+		got = append(got, tr.messages(Event{Kind: BendRange, Channel: ch, Value: 12})...)
+	}
+	checkSent(t, got, []protocol.Message{protocol.BendRange(0x01, 1, 12)})
+
+	// The Bridge follows RPN 0 to its data entry.
+	b := NewBridge(nil, nil, m)
+	var evs []Event
+	for _, raw := range [][]byte{
+		{0xB0, 6, 2},                   // no parameter selected
+		{0xB0, 101, 0}, {0xB0, 100, 0}, // RPN 0
+		{0xB0, 6, 12},
+		{0xB0, 99, 1}, {0xB0, 98, 0}, // an NRPN
+		{0xB0, 6, 3},
+		{0xB1, 101, 0}, {0xB1, 100, 1}, // RPN 1, fine tuning
+		{0xB1, 6, 4},
+	} {
+		if ev, ok := b.parse(raw); ok {
+			evs = append(evs, ev)
+		}
+	}
+	if want := []Event{{Kind: BendRange, Value: 12}}; !slices.Equal(evs, want) {
+		t.Errorf("got %+v, want %+v", evs, want)
+	}
+}
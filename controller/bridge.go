@@ -0,0 +1,440 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// MIDIIn is a live MIDI input, such as a keyboard, for a Bridge. Backends
+// for rtmidi, portmidi and the like implement it outside this package;
+// OpenRawMIDI is one for raw MIDI devices.
+type MIDIIn interface {
+	// Messages returns the channel complete MIDI messages arrive on, status
+	// byte first even where the keyboard used running status. It is closed
+	// when the input closes or fails.
+	Messages() <-chan []byte
+
+	// Err returns why Messages was closed: nil after Close or at the end
+	// of the input, else what failed.
+	Err() error
+
+	Close() error
+}
+
+// Bridge plays a MIDIIn on the drives as it is played, through the same
+// kind of mapping a Player uses. It handles note on and off, pitch bend, the
+// sustain pedal (CC64), the bend range (RPN 0) and channel pressure on the
+// mapped channels, and treats All Sound Off and All Notes Off (CC120 and
+// CC123), which most keyboards send from a panic button, as a call to
+// Panic.
+type Bridge struct {
+	// Bends says how pitch bends and bend ranges are passed on. Set it
+	// before Run.
+	Bends BendOptions
+
+	// Devices, if set, says what each device takes, as a Player's does.
+	// Set it before Run.
+	Devices *DeviceRegistry
+
+	in  MIDIIn
+	out Sender
+
+	mu    sync.Mutex // guards tr, start and rpn, and orders sends between Run and Panic
+	tr    *translator
+	start time.Time   // when Run started, which bends are timed from
+	rpn   [16][2]byte // each channel's registered parameter, as [MSB, LSB]
+}
+
+// NewBridge returns a Bridge from in to out, with channels mapped by m.
+func NewBridge(in MIDIIn, out Sender, m *mapping.Map) *Bridge {
+	b := &Bridge{in: in, out: out, tr: newTranslator(m, BendOptions{})}
+	for ch := range b.rpn {
+		b.rpn[ch] = nullRPN
+	}
+	return b
+}
+
+// nullRPN is the registered parameter selected when none is.
+var nullRPN = [2]byte{0x7F, 0x7F}
+
+// Run sends what arrives on the input until the input closes or ctx is
+// done, then calls Panic. Each message is sent as soon as it arrives;
+// of messages that arrived together, note-offs go first, unless a
+// note-on for the same note came before them.
+//
+// Run returns ctx's error if ctx ended it, the input's if it failed, or
+// the Sender's if a send failed.
+func (b *Bridge) Run(ctx context.Context) error {
+	b.mu.Lock()
+	b.tr = newTranslator(b.tr.mapping, b.Bends)
+	b.tr.registry = b.Devices
+	b.start = time.Now()
+	b.mu.Unlock()
+
+	msgs := b.in.Messages()
+	for {
+		var batch [][]byte
+		var bend <-chan time.Time
+		b.mu.Lock()
+		if at, ok := b.tr.nextHeld(); ok {
+			bend = time.After(time.Until(b.start.Add(at)))
+		}
+		b.mu.Unlock()
+		select {
+		case <-bend:
+			if err := b.sendDueBends(); err != nil {
+				return err
+			}
+			continue
+		case <-ctx.Done():
+			if err := b.Panic(); err != nil {
+				return err
+			}
+			return ctx.Err()
+		case msg, ok := <-msgs:
+			if !ok {
+				return b.closed()
+			}
+			batch = append(batch, msg)
+		}
+	drain:
+		for {
+			select {
+			case msg, ok := <-msgs:
+				if !ok {
+					msgs = nil // closed: stop after this batch
+					break drain
+				}
+				batch = append(batch, msg)
+			default:
+				break drain
+			}
+		}
+		if err := b.send(batch); err != nil {
+			return err
+		}
+		if msgs == nil {
+			return b.closed()
+		}
+	}
+}
+
+// closed calls Panic once the input has closed, and returns the input's
+// error if it failed.
+func (b *Bridge) closed() error {
+	if err := b.Panic(); err != nil {
+		return err
+	}
+	if err := b.in.Err(); err != nil {
+		return fmt.Errorf("MIDI input: %w", err)
+	}
+	return nil
+}
+
+// Panic silences every drive the Bridge plays on: a note-off for each
+// note it left sounding, then all notes off on each device.
+func (b *Bridge) Panic() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.panicLocked()
+}
+
+func (b *Bridge) panicLocked() error {
+	msgs := b.tr.release()
+	for _, dev := range b.tr.devices() {
+		msgs = append(msgs, protocol.AllNotesOff(dev))
+	}
+	for _, m := range msgs {
+		if err := b.out.Send(m); err != nil {
+			return fmt.Errorf("panic: %w", err)
+		}
+	}
+	return nil
+}
+
+// send sends the messages for a batch of MIDI messages, note-offs first.
+func (b *Bridge) send(batch [][]byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	type pending struct {
+		ev    Event
+		panic bool
+		sent  bool
+	}
+	evs := make([]pending, 0, len(batch))
+	for _, raw := range batch {
+		if isPanic(raw) {
+			evs = append(evs, pending{panic: true})
+		} else if ev, ok := b.parse(raw); ok {
+			evs = append(evs, pending{ev: ev})
+		}
+	}
+
+	// Note-offs first, but not past a panic or a strike of the same note.
+	for i := range evs {
+		if evs[i].panic {
+			break
+		}
+		ev := evs[i].ev
+		if ev.Kind != NoteOff {
+			continue
+		}
+		struck := false
+		for _, p := range evs[:i] {
+			if p.ev.Kind == NoteOn && p.ev.Channel == ev.Channel && p.ev.Note == ev.Note {
+				struck = true
+				break
+			}
+		}
+		if struck {
+			continue
+		}
+		evs[i].sent = true
+		if err := b.sendEvent(ev); err != nil {
+			return err
+		}
+	}
+	for _, p := range evs {
+		var err error
+		switch {
+		case p.sent:
+			continue
+		case p.panic:
+			err = b.panicLocked()
+		default:
+			err = b.sendEvent(p.ev)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Bridge) sendEvent(ev Event) error {
+	ev.At = time.Since(b.start)
+	for _, m := range b.tr.messages(ev) {
+		if err := b.out.Send(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendDueBends sends the bends the rate limit held back that may go now.
+func (b *Bridge) sendDueBends() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, m := range b.tr.due(time.Since(b.start)) {
+		if err := b.out.Send(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parse returns the Event for the MIDI message raw, as ParseMIDI does,
+// but following each channel's registered parameter, so that data entry
+// (CC6) for RPN 0 is a BendRange.
+func (b *Bridge) parse(raw []byte) (Event, bool) {
+	if len(raw) == 3 && raw[0]&0xF0 == 0xB0 {
+		ch := raw[0] & 0x0F
+		switch raw[1] {
+		case 101:
+			b.rpn[ch][0] = raw[2]
+		case 100:
+			b.rpn[ch][1] = raw[2]
+		case 98, 99:
+			b.rpn[ch] = nullRPN // a non-registered parameter
+		case 6:
+			if b.rpn[ch] == [2]byte{0, 0} {
+				return Event{Kind: BendRange, Channel: ch, Value: raw[2]}, true
+			}
+		}
+	}
+	return ParseMIDI(raw)
+}
+
+// isPanic reports whether msg is All Sound Off or All Notes Off.
+func isPanic(msg []byte) bool {
+	return len(msg) == 3 && msg[0]&0xF0 == 0xB0 && (msg[1] == 120 || msg[1] == 123)
+}
+
+// ParseMIDI returns the Event for one complete MIDI channel message, with
+// At zero: a note-on at velocity 0 is a NoteOff, CC64 is Sustain. It
+// reports false for messages Event has no kind for.
+func ParseMIDI(msg []byte) (Event, bool) {
+	if len(msg) < 2 {
+		return Event{}, false
+	}
+	ev := Event{Channel: msg[0] & 0x0F}
+	switch msg[0] & 0xF0 {
+	case 0x80, 0x90:
+		if len(msg) < 3 {
+			return Event{}, false
+		}
+		ev.Note = msg[1]
+		if msg[0]&0xF0 == 0x90 && msg[2] != 0 {
+			ev.Kind, ev.Value = NoteOn, msg[2]
+		} else {
+			ev.Kind = NoteOff
+		}
+	case 0xB0:
+		if len(msg) < 3 || msg[1] != 64 {
+			return Event{}, false
+		}
+		ev.Kind, ev.Value = Sustain, msg[2]
+	case 0xD0:
+		ev.Kind, ev.Value = Pressure, msg[1]
+	case 0xE0:
+		if len(msg) < 3 {
+			return Event{}, false
+		}
+		ev.Kind, ev.Bend = PitchBend, uint16(msg[2]&0x7F)<<7|uint16(msg[1]&0x7F)
+	default:
+		return Event{}, false
+	}
+	return ev, true
+}
+
+// midiSplitter cuts a raw MIDI byte stream into complete channel
+// messages, expanding running status and dropping real-time, SysEx and
+// other system messages: but for the clock, start, continue, stop and
+// song position pointer, with clock, for a ClockSync.
+type midiSplitter struct {
+	running byte // status of the message being read, 0 if none
+	msg     []byte
+	sysex   bool
+	clock   bool
+}
+
+// feed adds b to the stream and returns the message it completes, if any.
+func (s *midiSplitter) feed(b byte) ([]byte, bool) {
+	switch {
+	case b >= 0xF8:
+		// Real-time messages may come anywhere, even inside others.
+		if s.clock && (b == midiClock || b >= midiStart && b <= midiStop) {
+			return []byte{b}, true
+		}
+		return nil, false
+	case b == 0xF0:
+		s.sysex, s.running = true, 0
+		return nil, false
+	case b == midiSongPosition && s.clock:
+		s.sysex, s.running = false, b
+		s.msg = append(s.msg[:0], b)
+		return nil, false
+	case b >= 0xF1:
+		// End of SysEx, or a system common message: no running status
+		// survives it, and its data bytes are dropped below.
+		s.sysex, s.running = false, 0
+		return nil, false
+	case b >= 0x80:
+		s.sysex, s.running = false, b
+		s.msg = append(s.msg[:0], b)
+		return nil, false
+	case s.sysex || s.running == 0:
+		return nil, false
+	}
+	if len(s.msg) == 0 {
+		s.msg = append(s.msg, s.running)
+	}
+	s.msg = append(s.msg, b)
+	size := 3
+	if hi := s.running & 0xF0; hi == 0xC0 || hi == 0xD0 {
+		size = 2
+	}
+	if len(s.msg) < size {
+		return nil, false
+	}
+	msg := append([]byte(nil), s.msg...)
+	s.msg = s.msg[:0]
+	if s.running == midiSongPosition {
+		s.running = 0 // system common messages have no running status
+	}
+	return msg, true
+}
+
+// rawMIDI is a MIDIIn reading a raw MIDI byte stream.
+type rawMIDI struct {
+	r        io.ReadCloser
+	messages chan []byte
+	clock    bool // passing on the clock, as OpenMIDIClock's does
+
+	mu     sync.Mutex
+	err    error
+	closed bool
+}
+
+// OpenRawMIDI opens a raw MIDI device, as Linux has at /dev/snd/midiC1D0
+// or /dev/midi1, as a MIDIIn.
+func OpenRawMIDI(path string) (MIDIIn, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("controller: open MIDI input: %w", err)
+	}
+	return newRawMIDI(f, false), nil
+}
+
+// OpenMIDIClock opens a raw MIDI device as OpenRawMIDI does, as a MIDIIn
+// that also delivers the clock, start, continue, stop and song position
+// pointer a sequencer sends, for a ClockSync.
+func OpenMIDIClock(path string) (MIDIIn, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("controller: open MIDI clock: %w", err)
+	}
+	return newRawMIDI(f, true), nil
+}
+
+func newRawMIDI(r io.ReadCloser, clock bool) *rawMIDI {
+	m := &rawMIDI{r: r, messages: make(chan []byte, 64), clock: clock}
+	go m.read()
+	return m
+}
+
+func (m *rawMIDI) Messages() <-chan []byte { return m.messages }
+
+func (m *rawMIDI) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+func (m *rawMIDI) Close() error {
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+	return m.r.Close()
+}
+
+func (m *rawMIDI) read() {
+	defer close(m.messages)
+	s := midiSplitter{clock: m.clock}
+	buf := make([]byte, 64)
+	for {
+		n, err := m.r.Read(buf)
+		for _, b := range buf[:n] {
+			if msg, ok := s.feed(b); ok {
+				m.messages <- msg
+			}
+		}
+		if err != nil {
+			m.mu.Lock()
+			if !m.closed && !errors.Is(err, io.EOF) {
+				m.err = err
+			}
+			m.mu.Unlock()
+			return
+		}
+	}
+}
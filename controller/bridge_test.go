@@ -0,0 +1,253 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// fakeMIDI is a MIDIIn fed by the test.
+type fakeMIDI struct {
+	messages chan []byte
+	err      error
+}
+
+func newFakeMIDI(msgs ...[]byte) *fakeMIDI {
+	m := &fakeMIDI{messages: make(chan []byte, len(msgs))}
+	for _, msg := range msgs {
+		m.messages <- msg
+	}
+	return m
+}
+
+func (m *fakeMIDI) Messages() <-chan []byte { return m.messages }
+func (m *fakeMIDI) Err() error              { return m.err }
+func (m *fakeMIDI) Close() error            { close(m.messages); return nil }
+
+// sentOf returns the messages r sent, without their times.
+func sentOf(r *recorder) []protocol.Message {
+	var msgs []protocol.Message
+	for _, s := range r.sent {
+		msgs = append(msgs, s.m)
+	}
+	return msgs
+}
+
+func checkSent(t *testing.T, got, want []protocol.Message) {
+	t.Helper()
+	same := func(a, b protocol.Message) bool {
+		return a.Device == b.Device && a.Sub == b.Sub && a.Command == b.Command && slices.Equal(a.Payload, b.Payload)
+	}
+	if !slices.EqualFunc(got, want, same) {
+		t.Errorf("sent\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestParseMIDI(t *testing.T) {
+	tests := []struct {
+		msg  []byte
+		want Event
+		ok   bool
+	}{
+		{[]byte{0x92, 60, 100}, Event{Kind: NoteOn, Channel: 2, Note: 60, Value: 100}, true},
+		{[]byte{0x92, 60, 0}, Event{Kind: NoteOff, Channel: 2, Note: 60}, true},
+		{[]byte{0x82, 60, 64}, Event{Kind: NoteOff, Channel: 2, Note: 60}, true},
+		{[]byte{0xE0, 0x00, 0x40}, Event{Kind: PitchBend, Bend: 8192}, true},
+		{[]byte{0xE1, 0x7F, 0x7F}, Event{Kind: PitchBend, Channel: 1, Bend: 16383}, true},
+		{[]byte{0xB3, 64, 127}, Event{Kind: Sustain, Channel: 3, Value: 127}, true},
+		{[]byte{0xD4, 90}, Event{Kind: Pressure, Channel: 4, Value: 90}, true},
+		{[]byte{0xB0, 7, 100}, Event{}, false}, // volume
+		{[]byte{0xC0, 5}, Event{}, false},      // program change
+		{[]byte{0x90, 60}, Event{}, false},     // short
+		{[]byte{0xF8}, Event{}, false},         // clock
+		{[]byte{0xB0, 123, 0}, Event{}, false}, // panic is the Bridge's
+		{[]byte{0xA0, 60, 10}, Event{}, false}, // poly pressure
+		{[]byte{0xE0, 0x00}, Event{}, false},   // short bend
+		{[]byte{0xB0, 64}, Event{}, false},     // short CC
+		{nil, Event{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := ParseMIDI(tt.msg)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("ParseMIDI(% X) = %+v, %v; want %+v, %v", tt.msg, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSplitter(t *testing.T) {
+	stream := []byte{
+		0x3C,          // data before any status: dropped
+		0x90, 60, 100, // note on
+		62, 100, // running status
+		0xF8,        // clock inside the next message
+		64, 0xFE, 0, // and active sensing
+		0xF0, 1, 2, 0xF7, // SysEx
+		70, 1, // no running status after SysEx: dropped
+		0xD0, 80, 81, // pressure, with running status
+		0xF2, 1, 2, // song position: dropped
+		0xE0, 0, 0x40,
+	}
+	want := [][]byte{
+		{0x90, 60, 100}, {0x90, 62, 100}, {0x90, 64, 0},
+		{0xD0, 80}, {0xD0, 81}, {0xE0, 0, 0x40},
+	}
+	split := func(s midiSplitter) [][]byte {
+		var got [][]byte
+		for _, b := range stream {
+			if msg, ok := s.feed(b); ok {
+				got = append(got, msg)
+			}
+		}
+		return got
+	}
+	if got := split(midiSplitter{}); !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("got % X\nwant % X", got, want)
+	}
+
+	// For a ClockSync, the clock and song position come through too.
+	want = [][]byte{
+		{0x90, 60, 100}, {0x90, 62, 100}, {0xF8}, {0x90, 64, 0},
+		{0xD0, 80}, {0xD0, 81}, {0xF2, 1, 2}, {0xE0, 0, 0x40},
+	}
+	if got := split(midiSplitter{clock: true}); !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("with the clock, got % X\nwant % X", got, want)
+	}
+}
+
+func TestBridge(t *testing.T) {
+	in := newFakeMIDI(
+		[]byte{0x90, 60, 100}, // ch0 on drive 1
+		[]byte{0xE0, 0x00, 0x50},
+		[]byte{0xB0, 64, 127},
+		[]byte{0xD0, 40},
+		[]byte{0x99, 36, 127}, // ch9 unmapped
+		[]byte{0x91, 64, 90},
+		[]byte{0x90, 60, 0},
+		[]byte{0xB0, 7, 100}, // volume: ignored
+	)
+	in.Close()
+	_, r := newRecorder(nil)
+	b := NewBridge(in, r, mapping.Channels(0x01, 1, 4))
+	if err := b.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkSent(t, sentOf(r), []protocol.Message{
+		// All arrived together, but the note-off follows a strike of its
+		// note, so it keeps its place.
+		protocol.NoteOnVelocity(0x01, 1, 60, 100),
+		protocol.PitchBend(0x01, 1, 0x800),
+		protocol.Sustain(0x01, 1, true),
+		protocol.ChannelPressure(0x01, 1, 40),
+		protocol.NoteOnVelocity(0x01, 2, 64, 90),
+		protocol.NoteOff(0x01, 1, 60),
+		// The input closed: panic.
+		protocol.NoteOff(0x01, 2, 64),
+		protocol.AllNotesOff(0x01),
+	})
+}
+
+func TestBridgeNoteOffsFirst(t *testing.T) {
+	_, r := newRecorder(nil)
+	b := NewBridge(newFakeMIDI(), r, mapping.Channels(0x01, 1, 4))
+	if err := b.send([][]byte{{0x90, 60, 100}, {0x91, 62, 100}}); err != nil {
+		t.Fatal(err)
+	}
+	r.sent = nil
+	err := b.send([][]byte{
+		{0x92, 67, 100},
+		{0x80, 60, 0},
+		{0x90, 60, 100},
+		{0x81, 62, 0},
+		{0x80, 60, 0}, // after a strike of the same note: stays in order
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSent(t, sentOf(r), []protocol.Message{
+		protocol.NoteOff(0x01, 1, 60),
+		protocol.NoteOff(0x01, 2, 62),
+		protocol.NoteOnVelocity(0x01, 3, 67, 100),
+		protocol.NoteOnVelocity(0x01, 1, 60, 100),
+		protocol.NoteOff(0x01, 1, 60),
+	})
+}
+
+func TestBridgePanicButton(t *testing.T) {
+	_, r := newRecorder(nil)
+	m := mapping.Channels(0x01, 1, 2)
+	m.Channels[2] = mapping.Channel{Target: mapping.Target{Device: 0x02, Sub: 1}}
+	b := NewBridge(newFakeMIDI(), r, m)
+	err := b.send([][]byte{
+		{0x90, 60, 100},
+		{0x92, 48, 100},
+		{0xB5, 123, 0}, // All Notes Off, on any channel
+		{0x81, 62, 0},  // not sounding: nothing to send
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSent(t, sentOf(r), []protocol.Message{
+		protocol.NoteOnVelocity(0x01, 1, 60, 100),
+		protocol.NoteOnVelocity(0x02, 1, 48, 100),
+		protocol.NoteOff(0x01, 1, 60),
+		protocol.NoteOff(0x02, 1, 48),
+		protocol.AllNotesOff(0x01),
+		protocol.AllNotesOff(0x02),
+	})
+}
+
+func TestBridgeCancel(t *testing.T) {
+	in := newFakeMIDI()
+	_, r := newRecorder(nil)
+	b := NewBridge(in, r, mapping.Channels(0x01, 1, 1))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := b.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	checkSent(t, sentOf(r), []protocol.Message{protocol.AllNotesOff(0x01)})
+}
+
+func TestBridgeInputFails(t *testing.T) {
+	in := newFakeMIDI()
+	in.err = errors.New("unplugged")
+	in.Close()
+	_, r := newRecorder(nil)
+	if err := NewBridge(in, r, mapping.Channels(0x01, 1, 1)).Run(context.Background()); !errors.Is(err, in.err) {
+		t.Errorf("got %v, want the input's error", err)
+	}
+}
+
+func TestRawMIDI(t *testing.T) {
+	pr, pw := io.Pipe()
+	in := newRawMIDI(pr, false)
+	go func() {
+		pw.Write([]byte{0x90, 60})
+		pw.Write([]byte{100, 61, 0})
+		pw.Close()
+	}()
+	var got [][]byte
+	for msg := range in.Messages() {
+		got = append(got, msg)
+	}
+	if want := [][]byte{{0x90, 60, 100}, {0x90, 61, 0}}; !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("got % X, want % X", got, want)
+	}
+	if err := in.Err(); err != nil {
+		t.Errorf("Err after the end of input: %v", err)
+	}
+
+	pr, pw = io.Pipe()
+	in = newRawMIDI(pr, false)
+	pw.CloseWithError(errors.New("unplugged"))
+	for range in.Messages() {
+	}
+	if in.Err() == nil {
+		t.Error("Err is nil after the input failed")
+	}
+}
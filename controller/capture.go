@@ -0,0 +1,154 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// CaptureWriter writes a capture file of frames sent, as Device.Record
+// has a Device do, in package protocol's format. Its methods may be
+// called from several goroutines.
+type CaptureWriter struct {
+	mu    sync.Mutex
+	w     *bufio.Writer
+	last  time.Time // when the frame before was sent
+	entry []byte
+	err   error
+}
+
+// NewCaptureWriter writes a capture's header, h, to w, and returns a
+// CaptureWriter appending to it. Writes go through a buffer: call Flush
+// when done.
+func NewCaptureWriter(w io.Writer, h protocol.CaptureHeader) (*CaptureWriter, error) {
+	c := &CaptureWriter{w: bufio.NewWriter(w)}
+	if _, err := c.w.Write(protocol.AppendCaptureHeader(nil, h)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// WriteFrame appends frame, sent at t. The capture starts with its first
+// frame; a frame sent before the one before counts as sent with it.
+func (c *CaptureWriter) WriteFrame(t time.Time, frame []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	var delta time.Duration
+	if !c.last.IsZero() {
+		delta = max(t.Sub(c.last), 0)
+	}
+	if t.After(c.last) {
+		c.last = t
+	}
+	c.entry = protocol.AppendCaptureEntry(c.entry[:0], delta, frame)
+	_, c.err = c.w.Write(c.entry)
+	return c.err
+}
+
+// Flush writes what is buffered, and returns the first error of any
+// write.
+func (c *CaptureWriter) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.err = c.w.Flush()
+	return c.err
+}
+
+// Record appends each frame d writes to its port from now on to c, until
+// Record(nil): every message sent, and the pings Supervise sends. A
+// failure to write c doesn't fail the send; c's Flush reports it.
+func (d *Device) Record(c *CaptureWriter) {
+	d.mu.Lock()
+	d.capture = c
+	d.mu.Unlock()
+}
+
+// CapturedFrame is a frame read from a capture.
+type CapturedFrame struct {
+	At    time.Duration // from the capture's start
+	Frame []byte
+}
+
+// ReadCapture reads a capture file written by a CaptureWriter.
+func ReadCapture(r io.Reader) (protocol.CaptureHeader, []CapturedFrame, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return protocol.CaptureHeader{}, nil, err
+	}
+	h, n, err := protocol.DecodeCaptureHeader(data)
+	if err != nil {
+		return h, nil, err
+	}
+	var frames []CapturedFrame
+	var at time.Duration
+	for pos := n; pos < len(data); pos += n {
+		var delta time.Duration
+		var frame []byte
+		if delta, frame, n, err = protocol.DecodeCaptureEntry(data[pos:]); err != nil {
+			return h, frames, fmt.Errorf("capture entry %d: %w", len(frames), err)
+		}
+		at += delta
+		frames = append(frames, CapturedFrame{At: at, Frame: frame})
+	}
+	return h, frames, nil
+}
+
+// Replay sends the messages of a capture's frames, each at its offset
+// from when Replay started, as Play does a song's events. If ctx is done
+// first, it sends all notes off to each device the capture sent to and
+// SequenceStop, and returns ctx's error. A capture holds no song, so
+// Pause, Seek and Mute don't apply, nor does the Player's mapping.
+func (p *Player) Replay(ctx context.Context, frames []CapturedFrame) error {
+	var devices []byte
+	stop := func() error {
+		slices.Sort(devices)
+		for _, dev := range devices {
+			if err := p.out.Send(protocol.AllNotesOff(dev)); err != nil {
+				return err
+			}
+		}
+		return p.out.Send(protocol.SequenceStop())
+	}
+	start := p.clock.now()
+	for i, f := range frames {
+		if err := p.clock.sleepUntil(ctx, start.Add(f.At), nil); err != nil {
+			if ctx.Err() != nil {
+				if serr := stop(); serr != nil {
+					return serr
+				}
+			}
+			return err
+		}
+		for src := f.Frame; len(src) > 0; {
+			m, n, err := protocol.Decode(src)
+			if errors.Is(err, protocol.ErrIncomplete) {
+				return fmt.Errorf("frame %d: % X: %w", i, src, err)
+			}
+			src = src[n:]
+			if err != nil {
+				continue // as the firmware would skip it
+			}
+			if m.Device != config.SystemAddress && !slices.Contains(devices, m.Device) {
+				devices = append(devices, m.Device)
+			}
+			if err := p.out.Send(m); err != nil {
+				return fmt.Errorf("frame %d: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
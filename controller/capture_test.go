@@ -0,0 +1,133 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// TestCaptureRoundTrip records a song played in real time on a Device,
+// then replays the capture: the capture holds each message as sent and
+// when, within a scheduling tolerance, and the replay sends them again on
+// the capture's timing.
+func TestCaptureRoundTrip(t *testing.T) {
+	const tolerance = 15 * time.Millisecond
+	d, b := newFakeBus(t)
+	go func() {
+		for range b.got {
+		}
+	}()
+	var file bytes.Buffer
+	c, err := NewCaptureWriter(&file, protocol.CaptureHeader{Transport: protocol.CaptureSerial, Baud: 57600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Record(c)
+
+	song := []Event{
+		{At: 0, Kind: NoteOn, Channel: 0, Note: 60, Value: 100},
+		{At: 40 * time.Millisecond, Kind: PitchBend, Channel: 0, Bend: 8192 + 1000},
+		{At: 80 * time.Millisecond, Kind: NoteOn, Channel: 1, Note: 64, Value: 90},
+		{At: 120 * time.Millisecond, Kind: NoteOff, Channel: 0, Note: 60},
+		{At: 160 * time.Millisecond, Kind: NoteOff, Channel: 1, Note: 64},
+	}
+	want := []sentMessage{
+		{0, protocol.SequenceStart()},
+		{0, protocol.NoteOnVelocity(0x01, 1, 60, 100)},
+		{40 * time.Millisecond, protocol.PitchBend(0x01, 1, 1000)},
+		{80 * time.Millisecond, protocol.NoteOnVelocity(0x01, 2, 64, 90)},
+		{120 * time.Millisecond, protocol.NoteOff(0x01, 1, 60)},
+		{160 * time.Millisecond, protocol.NoteOff(0x01, 2, 64)},
+		{160 * time.Millisecond, protocol.SequenceStop()},
+	}
+	if err := NewPlayer(d, mapping.Channels(0x01, 1, 2)).Play(context.Background(), song); err != nil {
+		t.Fatal(err)
+	}
+	d.Record(nil)
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, frames, err := ReadCapture(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != (protocol.CaptureHeader{Version: protocol.CaptureVersion, Transport: protocol.CaptureSerial, Baud: 57600}) {
+		t.Errorf("header %+v", h)
+	}
+	if len(frames) != len(want) {
+		t.Fatalf("captured %d frames, want %d", len(frames), len(want))
+	}
+	for i, f := range frames {
+		frame := make([]byte, want[i].m.Len())
+		want[i].m.Encode(frame)
+		if !bytes.Equal(f.Frame, frame) {
+			t.Errorf("frame %d: % X, want % X", i, f.Frame, frame)
+		}
+		if f.At < want[i].at || f.At > want[i].at+tolerance {
+			t.Errorf("frame %d at %v, want %v", i, f.At, want[i].at)
+		}
+	}
+
+	p, r := newRecorder(mapping.Channels(0x09, 1, 1)) // a capture ignores the mapping
+	if err := p.Replay(context.Background(), frames); err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range frames {
+		want[i].at = f.At
+	}
+	if got := r.sent; len(got) != len(want) || fmtSent(got) != fmtSent(want) {
+		t.Errorf("replayed\n%v\nwant\n%v", got, want)
+	}
+}
+
+func fmtSent(s []sentMessage) string {
+	var b bytes.Buffer
+	for _, m := range s {
+		b.WriteString(m.String() + "\n")
+	}
+	return b.String()
+}
+
+// TestReplayCancel stops a replay after its first note: the devices it
+// played on are silenced and the sequence stopped.
+func TestReplayCancel(t *testing.T) {
+	frame := func(m protocol.Message) []byte {
+		b := make([]byte, m.Len())
+		m.Encode(b)
+		return b
+	}
+	frames := []CapturedFrame{
+		{0, frame(protocol.SequenceStart())},
+		{0, append(frame(protocol.NoteOn(0x02, 1, 60)), frame(protocol.NoteOn(0x01, 1, 62))...)}, // written together
+		{time.Second, frame(protocol.NoteOff(0x02, 1, 60))},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, r := newRecorder(mapping.Channels(0x01, 1, 1))
+	r.onSend = func(n int) {
+		if n == 3 {
+			cancel()
+		}
+	}
+	if err := p.Replay(ctx, frames); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	var got []protocol.Message
+	for _, s := range r.sent {
+		got = append(got, s.m)
+	}
+	checkSent(t, got, []protocol.Message{
+		protocol.SequenceStart(),
+		protocol.NoteOn(0x02, 1, 60),
+		protocol.NoteOn(0x01, 1, 62),
+		protocol.AllNotesOff(0x01),
+		protocol.AllNotesOff(0x02),
+		protocol.SequenceStop(),
+	})
+}
@@ -0,0 +1,252 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// The MIDI messages a ClockSync follows.
+const (
+	midiSongPosition = 0xF2
+	midiClock        = 0xF8
+	midiStart        = 0xFA
+	midiContinue     = 0xFB
+	midiStop         = 0xFC
+)
+
+// ClocksPerQuarter is how many MIDI clocks make a quarter note.
+const ClocksPerQuarter = 24
+
+// How hard a ClockSync pulls towards each clock: when the clock is taken
+// to have come moves by 1/clockPhaseGain of how far from expected it
+// came, and the time between clocks by 1/clockPeriodGain of it.
+const (
+	clockPhaseGain  = 4
+	clockPeriodGain = 16
+)
+
+// ClockSync follows the MIDI clock a sequencer or drum machine sends, for
+// a Player to play to in place of the wall clock: see Player.Follow. Each
+// clock moves the song on a 24th of a quarter note, through the song's
+// tempo changes, so the song goes at the clock's tempo and drifts with
+// it. Between clocks the song moves on at the rate they have been coming,
+// smoothed, so the events between come when they should and a jittery
+// clock doesn't jitter them; it never gets ahead of the next clock.
+//
+// Start plays the song from its start at the next clock, Stop pauses it,
+// and Continue plays on at the next clock. A song position pointer seeks
+// to the 16th note it gives, through the song's tempo changes. Until the
+// first start or continue, the song waits.
+type ClockSync struct {
+	in    MIDIIn
+	wall  clock                                // the wall clock, but in tests
+	after func(time.Duration) <-chan time.Time // time.After, but in tests
+
+	mu      sync.Mutex
+	player  *Player
+	tempos  []Event       // the song's tempo changes
+	clocks  int           // from the start of the song to the last clock
+	running bool          // from the clock after a start or continue to a stop
+	armed   bool          // started or continued, until the next clock
+	last    time.Time     // when the last clock came, as smoothed
+	period  time.Duration // between clocks, as smoothed; 0 until measured
+	changed chan struct{} // closed, and made again, by each message
+}
+
+// NewClockSync returns a ClockSync following the clock in delivers, as
+// OpenMIDIClock's does. Run reads it.
+func NewClockSync(in MIDIIn) *ClockSync {
+	return &ClockSync{in: in, wall: wallClock{}, after: time.After, changed: make(chan struct{})}
+}
+
+// Run follows the clock until the input closes, returning its error if
+// it failed, or until ctx is done.
+func (cs *ClockSync) Run(ctx context.Context) error {
+	for {
+		select {
+		case msg, ok := <-cs.in.Messages():
+			if !ok {
+				if err := cs.in.Err(); err != nil {
+					return fmt.Errorf("MIDI clock: %w", err)
+				}
+				return nil
+			}
+			if len(msg) > 0 {
+				cs.feed(msg, cs.wall.now())
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Tempo returns the clock's tempo in quarter notes a minute, as smoothed,
+// or 0 until it has been measured.
+func (cs *ClockSync) Tempo() float64 {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.period <= 0 {
+		return 0
+	}
+	return float64(time.Minute) / float64(cs.period*ClocksPerQuarter)
+}
+
+// Follow has Play time the songs it plays by cs's clock in place of the
+// wall clock, from the start of each. SetTempo has no say while it does:
+// the clock's tempo is the song's. Call it before Play.
+func (p *Player) Follow(cs *ClockSync) {
+	cs.mu.Lock()
+	cs.player = p
+	cs.mu.Unlock()
+	p.clock, p.follow = cs, cs
+}
+
+// load takes up the tempo changes of a song Play is to play, from its
+// start.
+func (cs *ClockSync) load(events []Event) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.tempos = cs.tempos[:0]
+	for _, ev := range events {
+		if ev.Kind == Tempo {
+			cs.tempos = append(cs.tempos, ev)
+		}
+	}
+	cs.clocks, cs.last = 0, cs.wall.now()
+}
+
+// feed follows msg, come at w.
+func (cs *ClockSync) feed(msg []byte, w time.Time) {
+	cs.mu.Lock()
+	var move func(p *Player) // what the message does to the Player
+	switch msg[0] {
+	case midiClock:
+		switch {
+		case cs.armed:
+			cs.armed, cs.running, cs.last = false, true, w
+		case cs.running:
+			cs.clocks++
+			cs.tick(w)
+		}
+	case midiStart:
+		moved := cs.clocks != 0 || cs.running
+		cs.clocks, cs.armed, cs.running = 0, true, false
+		move = func(p *Player) {
+			if moved {
+				p.Seek(0)
+			}
+			p.Resume()
+		}
+	case midiContinue:
+		cs.armed, cs.running = true, false
+		move = (*Player).Resume
+	case midiStop:
+		cs.armed, cs.running = false, false
+		move = (*Player).Pause
+	case midiSongPosition:
+		if len(msg) < 3 {
+			break
+		}
+		sixteenths := int(msg[2]&0x7F)<<7 | int(msg[1]&0x7F)
+		cs.clocks = sixteenths * ClocksPerQuarter / 4
+		at := cs.songTime(cs.clocks)
+		move = func(p *Player) { p.Seek(at) }
+	}
+	p := cs.player
+	close(cs.changed)
+	cs.changed = make(chan struct{})
+	cs.mu.Unlock()
+	if move != nil && p != nil {
+		move(p) // without cs.mu, which Play takes under p.mu
+	}
+}
+
+// tick takes in a clock come at w, the one after cs.last's. cs.mu must be
+// held.
+func (cs *ClockSync) tick(w time.Time) {
+	if cs.period > 0 {
+		miss := w.Sub(cs.last.Add(cs.period))
+		if miss.Abs() < cs.period {
+			cs.last = cs.last.Add(cs.period + miss/clockPhaseGain)
+			cs.period += miss / clockPeriodGain
+			return
+		}
+	}
+	// The first measured, or come too far from when expected, as after
+	// a dropped clock or a jump in tempo: measured afresh.
+	cs.period, cs.last = max(w.Sub(cs.last), 0), w
+}
+
+// songTime returns the offset into the song of clocks clocks from its
+// start. cs.mu must be held.
+func (cs *ClockSync) songTime(clocks int) time.Duration {
+	return QuarterTime(cs.tempos, float64(clocks)/ClocksPerQuarter)
+}
+
+// at returns how far into the song it is at w: where the last clock put
+// it, and on towards the next as long as the clocks take. cs.mu must be
+// held.
+func (cs *ClockSync) at(w time.Time) time.Duration {
+	at := cs.songTime(cs.clocks)
+	since := w.Sub(cs.last)
+	if !cs.running || cs.period <= 0 || since <= 0 {
+		return at
+	}
+	next := cs.songTime(cs.clocks + 1)
+	if since >= cs.period {
+		return next
+	}
+	return at + time.Duration(float64(next-at)*float64(since)/float64(cs.period))
+}
+
+// now returns how far into the song it is, as a time from the zero time.
+func (cs *ClockSync) now() time.Time {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return time.Time{}.Add(cs.at(cs.wall.now()))
+}
+
+// sleepUntil returns once the clock is running and the song at t, as now
+// has it: at a clock, or between two when the time since the last has
+// brought it there.
+func (cs *ClockSync) sleepUntil(ctx context.Context, t time.Time, wake <-chan struct{}) error {
+	want := t.Sub(time.Time{})
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		select {
+		case <-wake:
+			return errWoken
+		default:
+		}
+		cs.mu.Lock()
+		w := cs.wall.now()
+		if cs.running && cs.at(w) >= want {
+			cs.mu.Unlock()
+			return nil
+		}
+		var timer <-chan time.Time
+		if cs.running && cs.period > 0 {
+			at, next := cs.songTime(cs.clocks), cs.songTime(cs.clocks+1)
+			if want < next && next > at {
+				frac := float64(want-at) / float64(next-at)
+				until := cs.last.Add(time.Duration(math.Ceil(float64(cs.period) * frac)))
+				timer = cs.after(until.Sub(w))
+			}
+		}
+		changed := cs.changed
+		cs.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timer:
+		case <-wake:
+			return errWoken
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package controller
+
+import (
+	"context"
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// newClockSync returns a ClockSync fed by hand, its wall clock stopped at
+// the zero time and its timers never firing.
+func newClockSync() *ClockSync {
+	cs := NewClockSync(newFakeMIDI())
+	cs.wall = &fakeClock{}
+	cs.after = func(time.Duration) <-chan time.Time { return nil }
+	return cs
+}
+
+// TestClockTracking feeds a clock speeding up from 120 to 140 BPM over
+// eight bars, each clock up to a millisecond early or late, to a song at
+// 120 BPM. Each clock puts the song at its 24th of a quarter note, or
+// within the next; half way between two the song is within a tenth of a
+// clock of half way, whatever the jitter; it never goes back; and the
+// tempo measured ends within 1% of the clock's.
+func TestClockTracking(t *testing.T) {
+	cs := newClockSync()
+	rng := rand.New(rand.NewPCG(1, 2))
+	const clocks = 8 * 4 * ClocksPerQuarter
+	bpm := func(n int) float64 { return 120 + 20*float64(n)/clocks }
+	interval := func(n int) time.Duration {
+		return time.Duration(float64(time.Minute) / (bpm(n) * ClocksPerQuarter))
+	}
+	span := QuarterTime(nil, 1.0/ClocksPerQuarter)
+
+	cs.feed([]byte{midiStart}, time.Time{})
+	var beat time.Time // when clock n is due, without jitter
+	var last time.Duration
+	for n := 0; n <= clocks; n++ {
+		if n > 0 {
+			beat = beat.Add(interval(n))
+		}
+		jitter := time.Duration(rng.IntN(2001)-1000) * time.Microsecond
+		came := beat.Add(jitter)
+		if n == 0 {
+			came = beat
+		}
+		cs.feed([]byte{midiClock}, came)
+
+		want := QuarterTime(nil, float64(n)/ClocksPerQuarter)
+		if at := cs.at(came); at < want || at > want+span || at < last {
+			t.Fatalf("clock %d: at %v, want %v to %v, after %v", n, at, want, want+span, last)
+		}
+		mid := beat.Add(interval(n+1) / 2)
+		if n < 1 {
+			continue // no time between clocks measured yet
+		}
+		at := cs.at(mid)
+		if miss := (at - want - span/2).Abs(); n >= 2*ClocksPerQuarter && miss > span/10 {
+			t.Errorf("clock %d: half way at %v, %v from %v", n, at, miss, want+span/2)
+		}
+		last = at
+	}
+	if got, want := cs.Tempo(), bpm(clocks); got < want*0.99 || got > want*1.01 {
+		t.Errorf("tempo %.2f, want %.2f", got, want)
+	}
+}
+
+// TestClockTransport starts, stops, continues and moves the song by song
+// position pointer through a tempo change: the song waits for the clock
+// after a start or continue, stands still when stopped, and 24 16th notes
+// in, six quarter notes, is four seconds into the song, at its fourth
+// event.
+func TestClockTransport(t *testing.T) {
+	events := []Event{
+		{Kind: Tempo, Tempo: 500000},
+		{At: 2 * time.Second, Kind: Tempo, Tempo: 1000000}, // 60 BPM from the fourth quarter note
+		{At: 3 * time.Second, Kind: NoteOn, Note: 60},
+		{At: 4 * time.Second, Kind: NoteOn, Note: 62},
+	}
+	cs := newClockSync()
+	cs.load(events)
+	tick := func(n int) {
+		for range n {
+			cs.feed([]byte{midiClock}, time.Time{})
+		}
+	}
+	at := func() time.Duration { return cs.at(time.Time{}) }
+
+	tick(3)
+	if at() != 0 || cs.running {
+		t.Fatalf("before a start: at %v, running %v", at(), cs.running)
+	}
+	cs.feed([]byte{midiStart}, time.Time{})
+	tick(1)
+	if at() != 0 || !cs.running {
+		t.Fatalf("at the clock after start: at %v, running %v", at(), cs.running)
+	}
+	tick(2 * ClocksPerQuarter)
+	if at() != time.Second {
+		t.Errorf("two quarter notes in: at %v, want 1s", at())
+	}
+	cs.feed([]byte{midiStop}, time.Time{})
+	tick(5)
+	if at() != time.Second || cs.running {
+		t.Errorf("stopped: at %v, running %v", at(), cs.running)
+	}
+	cs.feed([]byte{midiSongPosition, 24, 0}, time.Time{})
+	if at() != 4*time.Second || firstAt(events, at()) != 3 {
+		t.Errorf("song position 24: at %v, event %d, want 4s, event 3", at(), firstAt(events, at()))
+	}
+	cs.feed([]byte{midiContinue}, time.Time{})
+	tick(1)
+	if at() != 4*time.Second || !cs.running {
+		t.Errorf("at the clock after continue: at %v, running %v", at(), cs.running)
+	}
+	tick(ClocksPerQuarter / 2)
+	if at() != 4500*time.Millisecond {
+		t.Errorf("an 8th note on at 60 BPM: at %v, want 4.5s", at())
+	}
+}
+
+// TestFollowClock plays a song of a note a quarter note, struck as the
+// clock gets to it: nothing until the clock after start, the second note
+// 24 clocks later, stop silencing the drives, and after a song position
+// pointer to the third note, continue picking the song up there at the
+// next clock, and start again playing it from its start.
+func TestFollowClock(t *testing.T) {
+	events := []Event{
+		{Kind: NoteOn, Note: 60, Value: 100},
+		{At: 500 * time.Millisecond, Kind: NoteOff, Note: 60},
+		{At: 500 * time.Millisecond, Kind: NoteOn, Note: 62, Value: 100},
+		{At: time.Second, Kind: NoteOff, Note: 62},
+		{At: time.Second, Kind: NoteOn, Note: 64, Value: 100},
+		{At: 1500 * time.Millisecond, Kind: NoteOff, Note: 64},
+	}
+	p, r := newRecorder(mapping.Channels(0x01, 1, 1))
+	sent := make(chan protocol.Message, 64)
+	r.onSend = func(n int) { sent <- r.sent[n-1].m }
+	cs := newClockSync()
+	p.Follow(cs)
+	p.SetTempo(200) // no say: the clock's tempo is the song's
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- p.Play(ctx, events) }()
+	expect := func(when string, want ...protocol.Message) {
+		t.Helper()
+		var got []protocol.Message
+		for range want {
+			select {
+			case m := <-sent:
+				got = append(got, m)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: sent %v, want %v", when, got, want)
+			}
+		}
+		checkSent(t, got, want)
+	}
+	feed := func(msg ...byte) { cs.feed(msg, time.Time{}) }
+
+	expect("before start", protocol.SequenceStart())
+	feed(midiStart)
+	feed(midiClock)
+	expect("at the clock after start", protocol.NoteOnVelocity(0x01, 1, 60, 100))
+	for range ClocksPerQuarter {
+		feed(midiClock)
+	}
+	expect("a quarter note in", protocol.NoteOff(0x01, 1, 60), protocol.NoteOnVelocity(0x01, 1, 62, 100))
+	feed(midiStop)
+	expect("stopped", protocol.NoteOff(0x01, 1, 62), protocol.AllNotesOff(0x01))
+	feed(midiSongPosition, 8, 0)
+	feed(midiContinue)
+	feed(midiClock)
+	expect("continued at the third note",
+		protocol.NoteOnVelocity(0x01, 1, 62, 100), // sounding up to 1s, as a seek has it
+		protocol.NoteOff(0x01, 1, 62),
+		protocol.NoteOnVelocity(0x01, 1, 64, 100),
+	)
+
+	feed(midiStart)
+	feed(midiClock)
+	expect("started again", protocol.NoteOff(0x01, 1, 64), protocol.AllNotesOff(0x01), protocol.NoteOnVelocity(0x01, 1, 60, 100))
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Play: %v", err)
+	}
+	expect("cancelled", protocol.NoteOff(0x01, 1, 60), protocol.AllNotesOff(0x01), protocol.SequenceStop())
+	select {
+	case m := <-sent:
+		t.Errorf("sent %v besides", m)
+	default:
+	}
+}
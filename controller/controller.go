@@ -0,0 +1,359 @@
+// Package controller talks to goppy and Moppy devices from desktop Go
+// programs, over a serial port:
+//
+//	dev, err := controller.OpenSerial("/dev/ttyUSB0", 57600)
+//	...
+//	defer dev.Close()
+//	devices, err := dev.Discover(time.Second)
+//	err = dev.Send(protocol.NoteOn(devices[0].Address, 1, 60))
+//
+// or to network-attached devices over UDP multicast, with OpenUDP; a
+// Device works the same either way.
+//
+// Frames are encoded and decoded by firmware/protocol, the code the
+// firmware itself uses. A background reader decodes what the devices send
+// back (pongs, config and position reports) onto Messages. When the port
+// goes away, as when the USB cable is pulled, the reader stops and Send,
+// Receive and Err report a *DisconnectedError; a Device under Supervise
+// reopens the port instead, and a Player waits for it.
+//
+// ReadSMF and Player play MIDI files through a Device:
+//
+//	song, err := controller.ReadSMF("song.mid")
+//	...
+//	err = controller.NewPlayer(dev, mapping.Channels(0x01, 1, 8)).Play(ctx, song)
+//
+// or through a Scheduler, to play the devices on several ports in step,
+// each port's measured latency made up for.
+package controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+	"go.bug.st/serial"
+)
+
+// Port is what a Device talks over: a serial.Port, or anything else that
+// reads and writes the byte stream, such as one end of a net.Pipe in
+// tests. Read should block until there is data, and fail once the port is
+// gone or closed.
+type Port interface {
+	io.ReadWriteCloser
+}
+
+// bootWait is how long OpenSerial waits after opening the port: an
+// Arduino Uno reboots on DTR, and its bootloader takes this long to hand
+// over to the firmware.
+const bootWait = 2 * time.Second
+
+// ErrClosed is returned once the Device has been closed.
+var ErrClosed = errors.New("controller: device closed")
+
+// DisconnectedError reports that the port failed under the Device, as a
+// serial port does when its USB adapter is unplugged.
+type DisconnectedError struct {
+	Port string // the port's name, if known
+	Err  error  // what the port returned
+}
+
+func (e *DisconnectedError) Error() string {
+	if e.Port == "" {
+		return "controller: port disconnected: " + e.Err.Error()
+	}
+	return fmt.Sprintf("controller: %s disconnected: %v", e.Port, e.Err)
+}
+
+func (e *DisconnectedError) Unwrap() error { return e.Err }
+
+// DeviceInfo is what a device says about itself in its pong.
+type DeviceInfo struct {
+	Address    byte
+	FirstDrive byte
+	LastDrive  byte
+
+	// Extra holds pong payload bytes past the drive range: the caps goppy
+	// firmware sends, and whatever newer firmware may add; nil from
+	// Moppy's firmware.
+	Extra []byte
+
+	// Caps are the optional commands the device takes, decoded from
+	// Extra: LegacyCapabilities without caps.
+	Caps Capabilities
+}
+
+// DeviceStatus is what a device says of how it is, in reply to
+// protocol.GetStatus: see config.CmdStatus.
+type DeviceStatus struct {
+	Uptime   time.Duration // to the second
+	Sounding int           // drives sounding
+	Drives   []byte        // which, by sub address
+	Sequence byte          // config.SequenceIdle, SequencePlaying or SequencePaused
+	Fault    byte          // the last config.Fault it ran into; FaultNone for none
+	At       time.Time     // when it said so
+}
+
+// Device is a connection to the devices on one port. Its methods may be
+// called from several goroutines.
+type Device struct {
+	name string
+	baud int // set by OpenSerial, for Supervise to reopen the port
+
+	writeMu  sync.Mutex
+	messages chan protocol.Message
+	stop     chan struct{} // closed by Close
+	done     chan struct{} // closed when the reader stops
+
+	mu       sync.Mutex
+	port     Port
+	err      error // why the reader stopped, or why the link is down
+	closed   bool
+	sup      *Supervision  // set by Supervise
+	up       chan struct{} // closed while the link is up
+	lastRead time.Time     // when the reader last had bytes, under Supervise
+	capture  *CaptureWriter
+}
+
+// OpenSerial opens the named serial port at baud and waits for the board
+// to boot.
+func OpenSerial(portName string, baud int) (*Device, error) {
+	p, err := serial.Open(portName, &serial.Mode{BaudRate: baud})
+	if err != nil {
+		return nil, fmt.Errorf("controller: open %s: %w", portName, err)
+	}
+	time.Sleep(bootWait)
+	d := New(p)
+	d.name, d.baud = portName, baud
+	return d, nil
+}
+
+// New returns a Device talking over port, and starts its reader.
+func New(port Port) *Device {
+	d := &Device{
+		port:     port,
+		messages: make(chan protocol.Message, 64),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		up:       make(chan struct{}),
+	}
+	close(d.up)
+	go d.read()
+	return d
+}
+
+// Send encodes m and writes it to the port.
+func (d *Device) Send(m protocol.Message) error {
+	if err := d.Err(); err != nil {
+		return err
+	}
+	var buf [config.MessageBufferSize]byte
+	n, err := m.Encode(buf[:])
+	if err != nil {
+		return err
+	}
+	return d.write(buf[:n])
+}
+
+// write writes an encoded frame to the port.
+func (d *Device) write(frame []byte) error {
+	d.mu.Lock()
+	port, capture := d.port, d.capture
+	d.mu.Unlock()
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	if _, err := port.Write(frame); err != nil {
+		return d.fail(err)
+	}
+	if capture != nil {
+		capture.WriteFrame(time.Now(), frame)
+	}
+	return nil
+}
+
+// Messages returns the channel the reader delivers decoded messages on,
+// in order. It is closed when the reader stops; Err says why. Under
+// Supervise the reader only stops at Close. Read it,
+// or with Receive: once 64 messages are waiting the reader waits too.
+func (d *Device) Messages() <-chan protocol.Message {
+	return d.messages
+}
+
+// Receive returns the next message, or an error once ctx is done or the
+// reader has stopped.
+func (d *Device) Receive(ctx context.Context) (protocol.Message, error) {
+	select {
+	case m, ok := <-d.messages:
+		if !ok {
+			return protocol.Message{}, d.Err()
+		}
+		return m, nil
+	case <-ctx.Done():
+		return protocol.Message{}, ctx.Err()
+	}
+}
+
+// Discover pings every device on the port and collects the pongs that
+// arrive within timeout.
+func (d *Device) Discover(timeout time.Duration) ([]DeviceInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.DiscoverContext(ctx)
+}
+
+// DiscoverContext pings every device on the port and collects pongs until
+// ctx is done. Messages other than pongs that arrive meanwhile are
+// dropped. A ctx that ends by its deadline ends discovery normally; one
+// cancelled returns the pongs so far and ctx's error.
+func (d *Device) DiscoverContext(ctx context.Context) ([]DeviceInfo, error) {
+	if err := d.Send(protocol.Ping()); err != nil {
+		return nil, err
+	}
+	var found []DeviceInfo
+	for {
+		m, err := d.Receive(ctx)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return found, nil
+		}
+		if err != nil {
+			return found, err
+		}
+		if info, ok := pongInfo(m); ok {
+			found = append(found, info)
+		}
+	}
+}
+
+// pongInfo returns what a device said of itself in m, if m is a pong.
+func pongInfo(m protocol.Message) (DeviceInfo, bool) {
+	if m.Device != config.SystemAddress || m.Command != config.CmdPong || len(m.Payload) < 3 {
+		return DeviceInfo{}, false
+	}
+	info := DeviceInfo{Address: m.Payload[0], FirstDrive: m.Payload[1], LastDrive: m.Payload[2]}
+	if len(m.Payload) > 3 {
+		info.Extra = m.Payload[3:]
+	}
+	info.Caps = DecodeCapabilities(info.Extra)
+	return info, true
+}
+
+// statusInfo decodes a status, if m is one. At is left to the caller.
+func statusInfo(m protocol.Message) (DeviceStatus, bool) {
+	p := m.Payload
+	if m.Device != config.SystemAddress || m.Command != config.CmdStatus || len(p) < 10 {
+		return DeviceStatus{}, false
+	}
+	st := DeviceStatus{
+		Uptime:   time.Duration(uint32(p[1])<<24|uint32(p[2])<<16|uint32(p[3])<<8|uint32(p[4])) * time.Second,
+		Sounding: int(p[5]),
+		Sequence: p[8],
+		Fault:    p[9],
+	}
+	for d, mask := 0, uint16(p[6])<<8|uint16(p[7]); d < 16; d++ {
+		if mask&(1<<d) != 0 {
+			st.Drives = append(st.Drives, byte(d+1))
+		}
+	}
+	return st, true
+}
+
+// Err returns why the Device stopped working: ErrClosed, a
+// *DisconnectedError, or nil while it works. Under Supervise a
+// *DisconnectedError lasts until the port is back.
+func (d *Device) Err() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
+}
+
+// Close closes the port and stops the reader.
+func (d *Device) Close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return ErrClosed
+	}
+	d.closed = true
+	if d.err == nil {
+		d.err = ErrClosed
+	}
+	port := d.port
+	d.mu.Unlock()
+	close(d.stop)
+	err := port.Close()
+	<-d.done
+	return err
+}
+
+// fail records that the port returned err, unless the Device was closed,
+// and returns what the Device now reports. Under Supervise it also closes
+// the port, so the reader stops reading it and reconnects.
+func (d *Device) fail(err error) error {
+	d.mu.Lock()
+	if d.err != nil || d.closed {
+		defer d.mu.Unlock()
+		return d.err
+	}
+	d.err = &DisconnectedError{Port: d.name, Err: err}
+	derr, sup, port := d.err, d.sup, d.port
+	if sup != nil {
+		d.up = make(chan struct{})
+	}
+	d.mu.Unlock()
+	if sup != nil {
+		port.Close()
+		if sup.Notify != nil {
+			sup.Notify(derr)
+		}
+	}
+	return derr
+}
+
+// read decodes frames from the port onto messages until the port fails,
+// or under Supervise until Close, reading each port reconnect opens.
+func (d *Device) read() {
+	defer close(d.done)
+	defer close(d.messages)
+	d.mu.Lock()
+	port := d.port
+	d.mu.Unlock()
+	var pending []byte
+	buf := make([]byte, 256)
+	for {
+		n, err := port.Read(buf)
+		if n > 0 {
+			d.mu.Lock()
+			d.lastRead = time.Now()
+			d.mu.Unlock()
+		}
+		pending = append(pending, buf[:n]...)
+		for len(pending) > 0 {
+			m, used, derr := protocol.Decode(pending)
+			if errors.Is(derr, protocol.ErrIncomplete) {
+				break
+			}
+			if derr == nil {
+				m.Payload = bytes.Clone(m.Payload)
+				select {
+				case d.messages <- m:
+				case <-d.stop:
+					return
+				}
+			}
+			pending = pending[used:]
+		}
+		if err != nil {
+			d.fail(err)
+			if port = d.reconnect(); port == nil {
+				return
+			}
+			pending = nil
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// fakeBus stands in for the devices on the far end of a port: it decodes
+// what the Device sends onto got and answers each Ping with pongs. With
+// hangUp set it closes the conn once it has heard that many messages, as
+// when the cable is pulled.
+type fakeBus struct {
+	conn   net.Conn
+	got    chan protocol.Message
+	pongs  []protocol.Message
+	hangUp int
+}
+
+func newFakeBus(t *testing.T, pongs ...protocol.Message) (*Device, *fakeBus) {
+	t.Helper()
+	host, dev := net.Pipe()
+	b := &fakeBus{conn: dev, got: make(chan protocol.Message, 16), pongs: pongs}
+	go b.serve()
+	d := New(host)
+	t.Cleanup(func() { d.Close(); dev.Close() })
+	return d, b
+}
+
+func (b *fakeBus) serve() {
+	var pending []byte
+	buf := make([]byte, 64)
+	for {
+		n, err := b.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		pending = append(pending, buf[:n]...)
+		for {
+			m, used, err := protocol.Decode(pending)
+			if errors.Is(err, protocol.ErrIncomplete) {
+				break
+			}
+			pending = pending[used:]
+			if err != nil {
+				continue
+			}
+			m.Payload = bytes.Clone(m.Payload)
+			b.got <- m
+			if b.hangUp--; b.hangUp == 0 {
+				b.conn.Close()
+				return
+			}
+			if m.Device == config.SystemAddress && m.Command == config.CmdPing {
+				for _, p := range b.pongs {
+					b.write(p)
+				}
+			}
+		}
+	}
+}
+
+func (b *fakeBus) write(m protocol.Message) {
+	buf := make([]byte, m.Len())
+	m.Encode(buf)
+	b.conn.Write(buf)
+}
+
+func TestSend(t *testing.T) {
+	d, b := newFakeBus(t)
+	want := protocol.NoteOnVelocity(config.DeviceAddress, 2, 60, 100)
+	if err := d.Send(want); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-b.got:
+		if got.Device != want.Device || got.Sub != want.Sub || got.Command != want.Command ||
+			!bytes.Equal(got.Payload, want.Payload) {
+			t.Errorf("sent %+v, want %+v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("nothing arrived")
+	}
+}
+
+func TestReceive(t *testing.T) {
+	d, b := newFakeBus(t)
+	// Noise and a frame split across writes come out as one message.
+	go func() {
+		frame := make([]byte, 16)
+		n, _ := protocol.Position(config.DeviceAddress, 3, 0x0102).Encode(frame)
+		b.conn.Write([]byte{0x00, 0x12})
+		b.conn.Write(frame[:3])
+		b.conn.Write(frame[3:n])
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	m, err := d.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Command != config.CmdPosition || m.Sub != 3 || !bytes.Equal(m.Payload, []byte{config.DeviceAddress, 1, 2}) {
+		t.Errorf("received %+v", m)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	d, _ := newFakeBus(t,
+		protocol.Pong(0x01, 1, 8),
+		protocol.Position(0x01, 1, 5), // not a pong: skipped
+		protocol.Message{Device: config.SystemAddress, Command: config.CmdPong, Payload: []byte{0x02, 1, 4, 9, 9}},
+	)
+	found, err := d.Discover(100 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 {
+		t.Fatalf("found %d devices, want 2: %+v", len(found), found)
+	}
+	if f := found[0]; f.Address != 0x01 || f.FirstDrive != 1 || f.LastDrive != 8 || f.Extra != nil {
+		t.Errorf("first device %+v", f)
+	}
+	if f := found[1]; f.Address != 0x02 || f.LastDrive != 4 || !bytes.Equal(f.Extra, []byte{9, 9}) {
+		t.Errorf("second device %+v", f)
+	}
+}
+
+func TestDiscoverCancel(t *testing.T) {
+	d, _ := newFakeBus(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := d.DiscoverContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	d, b := newFakeBus(t)
+	b.conn.Close() // the cable is pulled
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := d.Receive(ctx)
+	var de *DisconnectedError
+	if !errors.As(err, &de) {
+		t.Fatalf("Receive: got %v, want a *DisconnectedError", err)
+	}
+	if err := d.Send(protocol.Ping()); !errors.As(err, &de) {
+		t.Errorf("Send: got %v, want a *DisconnectedError", err)
+	}
+	if _, err := d.Discover(10 * time.Millisecond); !errors.As(err, &de) {
+		t.Errorf("Discover: got %v, want a *DisconnectedError", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	d, _ := newFakeBus(t)
+	d.Close()
+	if err := d.Send(protocol.Ping()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Send after Close: got %v, want ErrClosed", err)
+	}
+	if _, ok := <-d.Messages(); ok {
+		t.Error("Messages still open after Close")
+	}
+}
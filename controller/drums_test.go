@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+	"github.com/ystepanoff/goppy/firmware/config"
+)
+
+const rockKit = `channels:
+  1: 0x01/2
+percussion:
+  kit:
+    kick: 0x05/1     # HDDs
+    snare: 0x05/2
+    hihat: 0x06/1    # relays
+    cymbal: 0x06/2
+  notes:
+    56: 0x01/1 note 84   # cowbell as a high blip on a floppy
+`
+
+// TestRockBeat plays testdata/drums/rock.mid, two bars of a rock beat on
+// channel 10: eighth-note hi-hats, the last open, kick on 1 and 3 and the
+// and of 3 in bar 2, snare on 2 and 4, a crash at the start, cowbell on
+// the beats of bar 2, and a GM2 high Q (27), which isn't a GM drum.
+func TestRockBeat(t *testing.T) {
+	m, err := mapping.Parse(strings.NewReader(rockKit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	song, err := ReadSMF("testdata/drums/rock.mid")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hits := map[string]int{}
+	dropped := map[byte]int{}
+	for _, c := range CheckMapping(song, m) {
+		if c.Dropped != "" {
+			dropped[c.Note]++
+			continue
+		}
+		hits[fmt.Sprintf("%s note %d", c.To, c.Sent)]++
+	}
+	want := map[string]int{
+		"0x06/1 note 42": 15,
+		"0x06/1 note 46": 1,
+		"0x05/1 note 36": 5,
+		"0x05/2 note 38": 4,
+		"0x06/2 note 49": 1,
+		"0x01/1 note 84": 4,
+	}
+	if !maps.Equal(hits, want) {
+		t.Errorf("hits %v, want %v", hits, want)
+	}
+	if !maps.Equal(dropped, map[byte]int{27: 1}) {
+		t.Errorf("dropped %v, want note 27 once", dropped)
+	}
+
+	// Played, each drum note is struck on its drive with the note kept,
+	// and released.
+	p, r := newRecorder(m)
+	if err := p.Play(context.Background(), song); err != nil {
+		t.Fatal(err)
+	}
+	held := map[string]int{}
+	for _, s := range r.sent {
+		if s.m.Sub == 0 || len(s.m.Payload) == 0 {
+			continue
+		}
+		held[fmt.Sprintf("0x%02X/%d note %d", s.m.Device, s.m.Sub, s.m.Payload[0])] += map[byte]int{config.DevCmdNoteOn: 1, config.DevCmdNoteOff: -1}[s.m.Command]
+	}
+	for _, k := range slices.Sorted(maps.Keys(want)) {
+		if held[k] != 0 {
+			t.Errorf("%s left held %d times", k, held[k])
+		}
+	}
+	if first := r.sent[1].m; first.Device != 0x06 || first.Sub != 1 || first.Payload[0] != 42 {
+		t.Errorf("first message %+v, want the hi-hat on 0x06/1", first)
+	}
+}
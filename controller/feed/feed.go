@@ -0,0 +1,532 @@
+// Package feed streams what a player does over a WebSocket, for a
+// dashboard in a browser showing the drives at work. A Feed pushes each
+// client a line of JSON an event:
+//
+//	{"type":"note-on","device":"0x01","drive":3,"note":60,"name":"C4","velocity":100}
+//	{"type":"note-off","device":"0x01","drive":3,"note":60,"name":"C4"}
+//	{"type":"note-off","device":"0x01","drive":0}         all notes off
+//	{"type":"bend","device":"0x01","drive":3,"bend":4096} -8192 to 8191
+//	{"type":"transport","state":"paused","song":"fanfare.mid"}
+//	{"type":"connected","device":"0x01"}
+//	{"type":"disconnected","device":"0x01","error":"..."}
+//	{"type":"stats","status":{...}}                        the api.Status
+//
+// A drive's bends come at most every BendEvery, the latest of those sent
+// since the last; stats come every StatsEvery, and as a client connects.
+// Transport and device events come as the Status changes.
+//
+// A client may send commands on the same socket, as JSON:
+//
+//	{"action": "play"}                        or pause, stop, next, prev, panic
+//	{"action": "play", "file": "fanfare.mid"} play a song of the player's
+//	{"action": "seek", "to": "1m30s"}         or "bar": 12
+//	{"action": "mute", "channel": 10}         or unmute, solo, unsolo, 1 to 16
+//	{"action": "mute", "device": "0x02"}      a device, in place of a channel
+//	{"action": "status"}
+//
+// and is answered with {"type":"status","status":{...}}, the Status after
+// it, or {"type":"error","error":"..."}. Commands go to an api.Transport,
+// as the HTTP API's do, so that whatever owns the player hears of them
+// from one place.
+//
+// Nothing a client does holds playback up. Events wait in a queue of
+// Buffer for each client; a bend or stats event that finds it full is
+// dropped, the next bringing the client up to date, and a client whose
+// queue fills with anything else is disconnected, with close code 1008.
+package feed
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller"
+	"github.com/ystepanoff/goppy/controller/api"
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/notes"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// Feed streams a player's events to its clients. It is an http.Handler
+// to serve at the WebSocket's path; it learns what the player sends from
+// Sent, or a Sender Tap returns, and its Status from Run.
+type Feed struct {
+	Transport api.Transport
+
+	// BendEvery is the least time between a drive's bend events; 0 for
+	// 50ms.
+	BendEvery time.Duration
+
+	// StatsEvery is how often the Status is sent; 0 for a second.
+	StatsEvery time.Duration
+
+	// Buffer is how many events wait for each client; 0 for 256.
+	Buffer int
+
+	// Logf, if set, is told of each client dropped for falling behind.
+	Logf func(format string, args ...any)
+
+	poll time.Duration // how often to look for a change of status
+
+	mu      sync.Mutex
+	clients map[*client]bool
+	bends   map[[2]byte]*bend // by device and drive
+}
+
+const (
+	pollEvery    = 250 * time.Millisecond
+	writeTimeout = 10 * time.Second // for a client to take a frame
+)
+
+// bend is a drive's last bend event sent, and the one waiting to be.
+type bend struct {
+	sent    time.Time
+	pending []byte // a frame, or nil
+}
+
+// client is a connected client.
+type client struct {
+	conn net.Conn
+	out  chan []byte   // frames to write
+	gone chan struct{} // closed once it is dropped
+	bye  []byte        // the close frame to end with
+}
+
+// Event kinds.
+const (
+	evNoteOn       = "note-on"
+	evNoteOff      = "note-off"
+	evBend         = "bend"
+	evTransport    = "transport"
+	evConnected    = "connected"
+	evDisconnected = "disconnected"
+	evStats        = "stats"
+	evStatus       = "status"
+	evError        = "error"
+)
+
+// note is a note-on or note-off event: with no Name, every note off.
+type note struct {
+	Type     string `json:"type"`
+	Device   string `json:"device"`
+	Drive    int    `json:"drive"`
+	Note     int    `json:"note,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Velocity int    `json:"velocity,omitempty"`
+}
+
+type bendEvent struct {
+	Type   string `json:"type"`
+	Device string `json:"device"`
+	Drive  int    `json:"drive"`
+	Bend   int    `json:"bend"`
+}
+
+type transport struct {
+	Type  string `json:"type"`
+	State string `json:"state"`
+	Song  string `json:"song,omitempty"`
+}
+
+type device struct {
+	Type   string `json:"type"`
+	Device string `json:"device"`
+	Error  string `json:"error,omitempty"`
+}
+
+type status struct {
+	Type   string     `json:"type"`
+	Status api.Status `json:"status"`
+}
+
+type failure struct {
+	Type  string `json:"type"`
+	Error string `json:"error"`
+}
+
+// encode returns ev as a text frame.
+func encode(ev any) []byte {
+	b, _ := json.Marshal(ev)
+	return appendFrame(nil, opText, b)
+}
+
+// Sent tells the feed of a message sent to the devices. It never waits
+// on a client.
+func (f *Feed) Sent(m protocol.Message) {
+	if m.Device == config.SystemAddress {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.clients) == 0 {
+		return
+	}
+	key := [2]byte{m.Device, m.Sub}
+	addr := fmt.Sprintf("0x%02X", m.Device)
+	switch p := m.Payload; {
+	case m.Command == config.DevCmdBendPitch && len(p) >= 2:
+		frame := encode(bendEvent{evBend, addr, int(m.Sub), int(int16(uint16(p[0])<<8 | uint16(p[1])))})
+		b := f.bends[key]
+		if b == nil {
+			b = &bend{}
+			f.bends[key] = b
+		}
+		if now := time.Now(); now.Sub(b.sent) >= f.bendEvery() {
+			b.sent, b.pending = now, nil
+			f.broadcast(frame, true)
+		} else {
+			b.pending = frame
+		}
+	case m.Command == config.DevCmdNoteOn && len(p) >= 1, m.Command == config.DevCmdNoteOff:
+		// The drive's bend first, to keep them in order.
+		if b := f.bends[key]; b != nil && b.pending != nil {
+			f.broadcast(b.pending, true)
+			b.sent, b.pending = time.Now(), nil
+		}
+		ev := note{Type: evNoteOff, Device: addr, Drive: int(m.Sub)}
+		if m.Command == config.DevCmdNoteOn {
+			ev.Type = evNoteOn
+			if len(p) >= 2 {
+				ev.Velocity = int(p[1])
+			}
+		}
+		if len(p) >= 1 {
+			ev.Note, ev.Name = int(p[0]), string(notes.Name(nil, p[0]))
+		}
+		f.broadcast(encode(ev), false)
+	}
+}
+
+// broadcast queues frame for each client. A client without room for it
+// is dropped, unless droppable says the frame may be dropped in its
+// place. f.mu is held.
+func (f *Feed) broadcast(frame []byte, droppable bool) {
+	for c := range f.clients {
+		if !f.queue(c, frame) && !droppable {
+			f.drop(c, closeTooSlow, "too slow")
+			f.logf("%s fell behind; dropped", c.conn.RemoteAddr())
+		}
+	}
+}
+
+// queue queues frame for c, and reports whether there was room.
+func (f *Feed) queue(c *client, frame []byte) bool {
+	select {
+	case c.out <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+// drop disconnects c, with code and reason. f.mu is held.
+func (f *Feed) drop(c *client, code uint16, reason string) {
+	if !f.clients[c] {
+		return
+	}
+	delete(f.clients, c)
+	c.bye = appendFrame(nil, opClose, closePayload(code, reason))
+	close(c.gone)
+}
+
+// Clients returns how many clients are connected.
+func (f *Feed) Clients() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.clients)
+}
+
+// Tap returns a Sender sending to out, and telling f of each message
+// sent. It waits for a lost link as out does, if out can.
+func (f *Feed) Tap(out controller.Sender) controller.Sender {
+	t := tap{out: out, f: f}
+	if rc, ok := out.(reconnector); ok {
+		return reconnectingTap{t, rc}
+	}
+	return t
+}
+
+type tap struct {
+	out controller.Sender
+	f   *Feed
+}
+
+func (t tap) Send(m protocol.Message) error {
+	if err := t.out.Send(m); err != nil {
+		return err
+	}
+	t.f.Sent(m)
+	return nil
+}
+
+// reconnector is a Sender that can get a lost link back, as a
+// controller.Player looks for.
+type reconnector interface {
+	WaitConnected(ctx context.Context) error
+}
+
+type reconnectingTap struct {
+	tap
+	reconnector
+}
+
+// Run sends bends held back, stats and changes of the Status until ctx is
+// done, then disconnects the clients and returns ctx's error.
+func (f *Feed) Run(ctx context.Context) error {
+	bends := time.NewTicker(f.bendEvery())
+	defer bends.Stop()
+	stats := time.NewTicker(cmp.Or(f.StatsEvery, time.Second))
+	defer stats.Stop()
+	poll := time.NewTicker(cmp.Or(f.poll, pollEvery))
+	defer poll.Stop()
+	last := f.Transport.Status()
+	for {
+		select {
+		case <-bends.C:
+			f.mu.Lock()
+			now := time.Now()
+			for _, b := range f.bends {
+				if b.pending != nil && now.Sub(b.sent) >= f.bendEvery() {
+					f.broadcast(b.pending, true)
+					b.sent, b.pending = now, nil
+				}
+			}
+			f.mu.Unlock()
+		case <-stats.C:
+			f.send(encode(status{evStats, f.Transport.Status()}), true)
+		case <-poll.C:
+			st := f.Transport.Status()
+			for _, frame := range changes(last, st) {
+				f.send(frame, false)
+			}
+			last = st
+		case <-ctx.Done():
+			f.mu.Lock()
+			for c := range f.clients {
+				f.drop(c, closeGoingAway, "")
+			}
+			f.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+}
+
+// send broadcasts frame, taking f.mu.
+func (f *Feed) send(frame []byte, droppable bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.broadcast(frame, droppable)
+}
+
+// changes returns the transport and device events from was to now.
+func changes(was, now api.Status) [][]byte {
+	var out [][]byte
+	if now.State != was.State || now.Song != was.Song {
+		out = append(out, encode(transport{evTransport, now.State, now.Song}))
+	}
+	connected := make(map[string]bool)
+	for _, d := range was.Devices {
+		connected[d.Address] = d.Connected
+	}
+	for _, d := range now.Devices {
+		if c, ok := connected[d.Address]; ok && c == d.Connected {
+			continue
+		}
+		if d.Connected {
+			out = append(out, encode(device{Type: evConnected, Device: d.Address}))
+		} else {
+			out = append(out, encode(device{Type: evDisconnected, Device: d.Address, Error: d.Error}))
+		}
+	}
+	return out
+}
+
+// ServeHTTP takes a WebSocket client, sends it the Status, and serves its
+// commands until it goes or is dropped.
+func (f *Feed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, br := upgrade(w, r)
+	if conn != nil {
+		f.serve(conn, br)
+	}
+}
+
+// serve serves a client on conn, read through r, once upgraded.
+func (f *Feed) serve(conn net.Conn, r *bufio.Reader) {
+	c := &client{conn: conn, out: make(chan []byte, cmp.Or(f.Buffer, 256)), gone: make(chan struct{})}
+	c.out <- encode(status{evStats, f.Transport.Status()})
+	f.mu.Lock()
+	if f.clients == nil {
+		f.clients = make(map[*client]bool)
+		f.bends = make(map[[2]byte]*bend)
+	}
+	f.clients[c] = true
+	f.mu.Unlock()
+	go c.write()
+	f.read(c, r)
+}
+
+// write writes c's frames until it is dropped, then says why and hangs
+// up.
+func (c *client) write() {
+	defer c.conn.Close()
+	for {
+		select {
+		case frame := <-c.out:
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if _, err := c.conn.Write(frame); err != nil {
+				return
+			}
+		case <-c.gone:
+			c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+			c.conn.Write(c.bye)
+			return
+		}
+	}
+}
+
+// read serves c's commands until it goes or is dropped.
+func (f *Feed) read(c *client, r *bufio.Reader) {
+	var msg []byte
+	for {
+		fr, err := readFrame(r)
+		code := uint16(closeProtocol)
+		switch {
+		case errors.Is(err, errTooBig):
+			code = closeTooBig
+		case err != nil && !errors.Is(err, errMalformed):
+			// Gone, or dropped and hung up on.
+			f.mu.Lock()
+			f.drop(c, closeNormal, "")
+			f.mu.Unlock()
+			return
+		case err != nil:
+		case fr.op == opPing:
+			f.reply(c, appendFrame(nil, opPong, fr.payload))
+			continue
+		case fr.op == opPong:
+			continue
+		case fr.op == opClose:
+			code = closeNormal
+		case fr.op == opText && msg == nil, fr.op == opContinuation && msg != nil:
+			if msg = append(msg, fr.payload...); len(msg) > maxMessage {
+				code = closeTooBig
+				break
+			}
+			if !fr.fin {
+				continue
+			}
+			f.reply(c, f.do(msg))
+			msg = nil
+			continue
+		case fr.op == opBinary:
+			code = closeUnsupported
+		}
+		f.mu.Lock()
+		f.drop(c, code, "")
+		f.mu.Unlock()
+		return
+	}
+}
+
+// reply queues frame for c alone, dropping it if it has no room.
+func (f *Feed) reply(c *client, frame []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.clients[c] && !f.queue(c, frame) {
+		f.drop(c, closeTooSlow, "too slow")
+	}
+}
+
+// command is a command a client sends.
+type command struct {
+	Action  string `json:"action"`
+	File    string `json:"file"`
+	To      string `json:"to"`
+	Bar     int    `json:"bar"`
+	Channel int    `json:"channel"`
+	Device  string `json:"device"`
+}
+
+// do carries out the command in msg, and returns the answer to it.
+func (f *Feed) do(msg []byte) []byte {
+	c, err := parse(msg)
+	if err == nil && c.Op != "" {
+		err = f.Transport.Do(c)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", c.Op, err)
+		}
+	}
+	if err != nil {
+		return encode(failure{evError, err.Error()})
+	}
+	return encode(status{evStatus, f.Transport.Status()})
+}
+
+// parse returns the api.Command msg asks for, with no Op for a status.
+func parse(msg []byte) (api.Command, error) {
+	var cmd command
+	if err := json.Unmarshal(msg, &cmd); err != nil {
+		return api.Command{}, err
+	}
+	switch op := api.Op(cmd.Action); op {
+	case "status":
+		return api.Command{}, nil
+	case api.OpPlay:
+		return api.Command{Op: op, Song: cmd.File}, nil
+	case api.OpPause, api.OpStop, api.OpNext, api.OpPrev, api.OpPanic:
+		return api.Command{Op: op}, nil
+	case api.OpSeek:
+		c := api.Command{Op: op, Bar: cmd.Bar}
+		switch {
+		case cmd.To != "" && cmd.Bar == 0:
+			d, err := time.ParseDuration(cmd.To)
+			if err != nil || d < 0 {
+				return api.Command{}, fmt.Errorf("seek to %s: want an offset such as 1m30s", cmd.To)
+			}
+			c.At = d
+		case cmd.Bar < 1 || cmd.To != "":
+			return api.Command{}, errors.New("seek: want one of to, or bar from 1")
+		}
+		return c, nil
+	case "mute", "unmute", "solo", "unsolo":
+		c := api.Command{Op: api.OpMute, Mute: op == "mute"}
+		if op == "solo" || op == "unsolo" {
+			c = api.Command{Op: api.OpSolo, Solo: op == "solo"}
+		}
+		switch {
+		case cmd.Device != "" && cmd.Channel == 0:
+			d, err := strconv.ParseUint(cmd.Device, 0, 8)
+			if err != nil || d == 0 {
+				return api.Command{}, fmt.Errorf("%s device %s: want 1 to 255, as 0x01", op, cmd.Device)
+			}
+			c.Device = byte(d)
+			if c.Op == api.OpMute {
+				c.Op = api.OpMuteDevice
+			} else {
+				c.Op = api.OpSoloDevice
+			}
+		case cmd.Channel >= 1 && cmd.Channel <= 16 && cmd.Device == "":
+			c.Channel = byte(cmd.Channel - 1)
+		default:
+			return api.Command{}, fmt.Errorf("%s: want a channel, 1 to 16, or a device", op)
+		}
+		return c, nil
+	}
+	return api.Command{}, fmt.Errorf("unknown action %q", cmd.Action)
+}
+
+func (f *Feed) bendEvery() time.Duration { return cmp.Or(f.BendEvery, 50*time.Millisecond) }
+
+func (f *Feed) logf(format string, args ...any) {
+	if f.Logf != nil {
+		f.Logf(format, args...)
+	}
+}
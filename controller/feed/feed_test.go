@@ -0,0 +1,337 @@
+package feed
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/api"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+	"github.com/ystepanoff/goppy/internal/wstest"
+)
+
+// fakePlayer is a Transport noting the commands it is given.
+type fakePlayer struct {
+	mu     sync.Mutex
+	status api.Status
+	got    []api.Command
+}
+
+func (p *fakePlayer) Status() api.Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+func (p *fakePlayer) Do(c api.Command) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.got = append(p.got, c)
+	switch c.Op {
+	case api.OpNext:
+		return errors.New("no playlist")
+	case api.OpPause:
+		p.status.State = api.Paused
+	}
+	return nil
+}
+
+func (p *fakePlayer) set(f func(s *api.Status)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f(&p.status)
+}
+
+func (p *fakePlayer) commands() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var out []string
+	for _, c := range p.got {
+		out = append(out, fmt.Sprintf("%+v", c))
+	}
+	return out
+}
+
+// serve runs f on a test server, and returns its URL.
+func serve(t *testing.T, f *Feed) string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.Run(ctx)
+	}()
+	srv := httptest.NewServer(f)
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		srv.Close()
+	})
+	return srv.URL
+}
+
+// next returns the next message c gets, as sent.
+func next(t *testing.T, c *wstest.Conn) string {
+	t.Helper()
+	fr, err := c.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.Op != wstest.OpText {
+		t.Fatalf("got a frame of opcode %#x, %q; want a message", fr.Op, fr.Payload)
+	}
+	return string(fr.Payload)
+}
+
+// waitClients waits for f to have n clients.
+func waitClients(t *testing.T, f *Feed, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(wstest.Timeout); f.Clients() != n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients, want %d", f.Clients(), n)
+		}
+	}
+}
+
+// TestFeed streams notes, commands' answers and changes of status to a
+// client.
+func TestFeed(t *testing.T) {
+	p := &fakePlayer{status: api.Status{State: api.Playing, Song: "a.mid", Devices: []api.Device{{Address: "0x01", Connected: true}}}}
+	f := &Feed{Transport: p, StatsEvery: time.Hour, poll: time.Millisecond}
+	c := wstest.Dial(t, serve(t, f))
+	if got, want := next(t, c), `{"type":"stats","status":{"state":"playing","song":"a.mid","position":0,"length":0,"index":0,"songs":0,"muted":null,"soloed":null,"devices":[{"address":"0x01","connected":true}]}}`; got != want {
+		t.Errorf("on connecting, got\n%s\nwant\n%s", got, want)
+	}
+	waitClients(t, f, 1)
+
+	for _, m := range []protocol.Message{
+		protocol.SequenceStart(),
+		protocol.NoteOnVelocity(0x01, 3, 60, 100),
+		protocol.NoteOff(0x01, 3, 60),
+		protocol.AllNotesOff(0x02),
+	} {
+		f.Sent(m)
+	}
+	for _, want := range []string{
+		`{"type":"note-on","device":"0x01","drive":3,"note":60,"name":"C4","velocity":100}`,
+		`{"type":"note-off","device":"0x01","drive":3,"note":60,"name":"C4"}`,
+		`{"type":"note-off","device":"0x02","drive":0}`,
+	} {
+		if got := next(t, c); got != want {
+			t.Errorf("got\n%s\nwant\n%s", got, want)
+		}
+	}
+
+	// A command is answered with the Status after it, and the change of
+	// state it makes goes to every client.
+	c.Send(t, `{"action":"pause"}`)
+	if got := c.Next(t); got["type"] != "status" || got["status"].(map[string]any)["state"] != api.Paused {
+		t.Errorf("pause answered %v", got)
+	}
+	if got, want := next(t, c), `{"type":"transport","state":"paused","song":"a.mid"}`; got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	for _, tt := range []struct{ send, want string }{
+		{`{"action":"next"}`, "next: no playlist"},
+		{`{"action":"mute","channel":17}`, "mute: want a channel, 1 to 16, or a device"},
+		{`{"action":"seek"}`, "seek: want one of to, or bar from 1"},
+		{`{"action":"dance"}`, `unknown action "dance"`},
+	} {
+		c.Send(t, tt.send)
+		if got := c.Next(t); got["type"] != "error" || got["error"] != tt.want {
+			t.Errorf("%s answered %v, want the error %q", tt.send, got, tt.want)
+		}
+	}
+	for _, send := range []string{
+		`{"action":"mute","channel":10}`,
+		`{"action":"unsolo","device":"0x02"}`,
+		`{"action":"seek","bar":3}`,
+		`{"action":"play","file":"b.mid"}`,
+	} {
+		c.Send(t, send)
+		if got := c.Next(t); got["type"] != "status" {
+			t.Errorf("%s answered %v", send, got)
+		}
+	}
+	want := []string{
+		fmt.Sprintf("%+v", api.Command{Op: api.OpPause}),
+		fmt.Sprintf("%+v", api.Command{Op: api.OpNext}),
+		fmt.Sprintf("%+v", api.Command{Op: api.OpMute, Channel: 9, Mute: true}),
+		fmt.Sprintf("%+v", api.Command{Op: api.OpSoloDevice, Device: 0x02}),
+		fmt.Sprintf("%+v", api.Command{Op: api.OpSeek, Bar: 3}),
+		fmt.Sprintf("%+v", api.Command{Op: api.OpPlay, Song: "b.mid"}),
+	}
+	if got := p.commands(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	p.set(func(s *api.Status) { s.Devices = []api.Device{{Address: "0x01", Error: "link lost"}} })
+	if got, want := next(t, c), `{"type":"disconnected","device":"0x01","error":"link lost"}`; got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	p.set(func(s *api.Status) { s.Devices = []api.Device{{Address: "0x01", Connected: true}} })
+	if got, want := next(t, c), `{"type":"connected","device":"0x01"}`; got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// Pinged, it answers; closed, it closes.
+	if err := c.WriteFrame(wstest.OpPing, true, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if fr, err := c.Read(); err != nil || fr.Op != wstest.OpPong || string(fr.Payload) != "hi" {
+		t.Errorf("a ping answered %+v, %v", fr, err)
+	}
+	if err := c.WriteFrame(wstest.OpClose, true, []byte{0x03, 0xE8}); err != nil {
+		t.Fatal(err)
+	}
+	if fr, err := c.Read(); err != nil || fr.CloseCode() != closeNormal {
+		t.Errorf("a close answered %+v, %v", fr, err)
+	}
+	waitClients(t, f, 0)
+}
+
+// TestBendThrottle sends a drive's bends at most every BendEvery, the
+// first at once and the latest after; another drive's aren't held up by
+// them, and a drive's note follows its bend held back.
+func TestBendThrottle(t *testing.T) {
+	f := &Feed{Transport: &fakePlayer{}, BendEvery: 50 * time.Millisecond, StatsEvery: time.Hour}
+	c := wstest.Dial(t, serve(t, f))
+	next(t, c)
+	waitClients(t, f, 1)
+
+	for i := range 100 {
+		f.Sent(protocol.PitchBend(0x01, 1, int16(i)))
+	}
+	f.Sent(protocol.PitchBend(0x01, 2, -8192))
+	var got []string
+	for {
+		got = append(got, next(t, c))
+		if got[len(got)-1] == `{"type":"bend","device":"0x01","drive":1,"bend":99}` {
+			break
+		}
+	}
+	want := []string{
+		`{"type":"bend","device":"0x01","drive":1,"bend":0}`,
+		`{"type":"bend","device":"0x01","drive":2,"bend":-8192}`,
+		`{"type":"bend","device":"0x01","drive":1,"bend":99}`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("100 bends sent\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	f.Sent(protocol.PitchBend(0x01, 1, 200))
+	f.Sent(protocol.NoteOnVelocity(0x01, 1, 62, 90))
+	for _, want := range []string{
+		`{"type":"bend","device":"0x01","drive":1,"bend":200}`,
+		`{"type":"note-on","device":"0x01","drive":1,"note":62,"name":"D4","velocity":90}`,
+	} {
+		if got := next(t, c); got != want {
+			t.Errorf("got\n%s\nwant\n%s", got, want)
+		}
+	}
+}
+
+// TestSlowClient never holds up Sent for a client that doesn't read: its
+// bends are dropped while its queue is full, and a note that finds it full
+// drops the client, after the events queued before it, with close code
+// 1008.
+func TestSlowClient(t *testing.T) {
+	var logged []string
+	f := &Feed{Transport: &fakePlayer{}, Buffer: 4, Logf: func(format string, args ...any) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}}
+	server, pipe := net.Pipe()
+	defer pipe.Close()
+	go f.serve(server, bufio.NewReader(server))
+	waitClients(t, f, 1)
+
+	// Nothing reads the pipe: the stats sent on connecting hold up the
+	// client's writer, and four notes fill its queue.
+	for i := range 4 {
+		f.Sent(protocol.NoteOnVelocity(0x01, 1, byte(60+i), 100))
+	}
+	for i := range 10 {
+		f.Sent(protocol.PitchBend(0x01, byte(2+i), 100))
+	}
+	if f.Clients() != 1 {
+		t.Fatal("bends to a full queue dropped the client")
+	}
+	f.Sent(protocol.NoteOff(0x01, 1, 63))
+	if f.Clients() != 0 {
+		t.Fatal("a note to a full queue didn't drop the client")
+	}
+	if len(logged) != 1 || !strings.Contains(logged[0], "fell behind") {
+		t.Errorf("logged %q", logged)
+	}
+
+	c := wstest.New(pipe)
+	if ev := c.Next(t); ev["type"] != "stats" {
+		t.Errorf("first %v, want the stats", ev)
+	}
+	for i := 0; ; i++ {
+		fr, err := c.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fr.Op == wstest.OpClose {
+			if fr.CloseCode() != closeTooSlow {
+				t.Errorf("closed with %d, want %d", fr.CloseCode(), closeTooSlow)
+			}
+			break
+		}
+		if want := fmt.Sprintf(`"note":%d,`, 60+i); i >= 4 || !strings.Contains(string(fr.Payload), want) {
+			t.Fatalf("event %d %s, want the note-on of %d", i, fr.Payload, 60+i)
+		}
+	}
+}
+
+// TestHandshake turns away what isn't a WebSocket handshake, and a client
+// sending what isn't a command.
+func TestHandshake(t *testing.T) {
+	f := &Feed{Transport: &fakePlayer{}}
+	url := serve(t, f)
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("a GET answered %s, want 426", resp.Status)
+	}
+	for _, tt := range []struct {
+		op   byte
+		fin  bool
+		data []byte
+		code int
+	}{
+		{0x2, true, []byte{1, 2, 3}, closeUnsupported},
+		{wstest.OpText, true, make([]byte, maxMessage+1), closeTooBig},
+		{wstest.OpPing, false, nil, closeProtocol},
+	} {
+		c := wstest.Dial(t, url)
+		next(t, c)
+		if err := c.WriteFrame(tt.op, tt.fin, tt.data); err != nil {
+			t.Fatal(err)
+		}
+		if fr, err := c.Read(); err != nil || fr.CloseCode() != tt.code {
+			t.Errorf("opcode %#x, %d bytes: got %+v, %v; want close code %d", tt.op, len(tt.data), fr.Op, err, tt.code)
+		}
+	}
+
+	// A message may come in fragments.
+	c := wstest.Dial(t, url)
+	next(t, c)
+	c.WriteFrame(wstest.OpText, false, []byte(`{"action":`))
+	c.WriteFrame(0x0, true, []byte(`"status"}`))
+	if ev := c.Next(t); ev["type"] != "status" {
+		t.Errorf("a fragmented status answered %v", ev)
+	}
+}
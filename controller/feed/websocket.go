@@ -0,0 +1,166 @@
+package feed
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Opcodes, the low nibble of a frame's first byte.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Close codes a Feed ends a connection with.
+const (
+	closeNormal      = 1000
+	closeGoingAway   = 1001
+	closeProtocol    = 1002
+	closeUnsupported = 1003
+	closeTooSlow     = 1008 // policy violation: it fell behind
+	closeTooBig      = 1009
+)
+
+// maxMessage is the largest message read: commands are small, and a
+// client sending more is taken as broken.
+const maxMessage = 1 << 16
+
+// acceptGUID is what RFC 6455 appends to the client's key to answer it.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var errMalformed = errors.New("feed: malformed frame")
+
+// upgrade answers a WebSocket handshake and takes over its connection.
+// It answers a request that isn't one itself, and returns nil.
+func upgrade(w http.ResponseWriter, r *http.Request) (net.Conn, *bufio.Reader) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerHas(r.Header, "Connection", "upgrade") || !headerHas(r.Header, "Upgrade", "websocket") || key == "" {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "want a WebSocket handshake", http.StatusUpgradeRequired)
+		return nil, nil
+	}
+	if v := r.Header.Get("Sec-WebSocket-Version"); v != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, fmt.Sprintf("WebSocket version %q: want 13", v), http.StatusBadRequest)
+		return nil, nil
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "can't take over the connection", http.StatusInternalServerError)
+		return nil, nil
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, nil
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", acceptKey(key))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, nil
+	}
+	return conn, rw.Reader
+}
+
+// acceptKey returns the Sec-WebSocket-Accept answering key.
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHas reports whether the comma-separated header name lists token.
+func headerHas(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// frame is a frame as read, unmasked.
+type frame struct {
+	fin     bool
+	op      byte
+	payload []byte
+}
+
+// readFrame reads a frame from a client, which must mask it.
+func readFrame(r *bufio.Reader) (frame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return frame{}, err
+	}
+	f := frame{fin: head[0]&0x80 != 0, op: head[0] & 0x0F}
+	if head[0]&0x70 != 0 || head[1]&0x80 == 0 {
+		return frame{}, errMalformed // extension bits, or unmasked
+	}
+	size := uint64(head[1] & 0x7F)
+	switch size {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return frame{}, err
+		}
+		size = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return frame{}, err
+		}
+		size = binary.BigEndian.Uint64(b[:])
+	}
+	if size > maxMessage {
+		return frame{}, errTooBig
+	}
+	if f.op >= opClose && (size > 125 || !f.fin) {
+		return frame{}, errMalformed
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return frame{}, err
+	}
+	f.payload = make([]byte, size)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return frame{}, err
+	}
+	for i := range f.payload {
+		f.payload[i] ^= mask[i%4]
+	}
+	return f, nil
+}
+
+var errTooBig = fmt.Errorf("feed: message over %d bytes", maxMessage)
+
+// appendFrame appends a whole, unmasked frame, as a server sends.
+func appendFrame(dst []byte, op byte, payload []byte) []byte {
+	dst = append(dst, 0x80|op)
+	switch n := len(payload); {
+	case n < 126:
+		dst = append(dst, byte(n))
+	case n <= 0xFFFF:
+		dst = binary.BigEndian.AppendUint16(append(dst, 126), uint16(n))
+	default:
+		dst = binary.BigEndian.AppendUint64(append(dst, 127), uint64(n))
+	}
+	return append(dst, payload...)
+}
+
+// closePayload returns a close frame's payload: code, and why.
+func closePayload(code uint16, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, code), reason...)
+}
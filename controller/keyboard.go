@@ -0,0 +1,378 @@
+package controller
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keyboard is a MIDIIn played from a computer's keyboard in a terminal,
+// for demos without a MIDI keyboard: a Bridge plays it as it would one.
+// The keys are laid out as a piano's, on the home row and the one above:
+//
+//	 W E   T Y U
+//	A S D F G H J K    C to C; with Shift, the octave above
+//
+// Z and X take the octave down and up, and the number keys 1 to 9 and 0
+// choose MIDI channel 1 to 10 to play on, and so the drive or pool the
+// mapping has for it. Space sends All Notes Off, which the Bridge takes
+// as its panic button, and Ctrl-C or Ctrl-D close the Keyboard.
+//
+// A note sounds as long as its key is held if the terminal reports keys
+// being released, as it does once it answers the query of the kitty
+// keyboard protocol that KeyboardProtocol turns on. Until then, each
+// note sounds for NoteLength, and longer while the key repeats.
+type Keyboard struct {
+	in       io.Reader
+	opts     KeyboardOptions
+	messages chan []byte
+	done     chan struct{}
+
+	mu     sync.Mutex
+	err    error
+	closed bool
+}
+
+// KeyboardOptions says how a Keyboard plays.
+type KeyboardOptions struct {
+	// NoteLength is how long a note sounds where the terminal doesn't
+	// report keys being released; 0 for 300ms.
+	NoteLength time.Duration
+
+	// Velocity is every note's; 0 for 100.
+	Velocity byte
+
+	// Changed, if set, is called with the Keyboard's state when it
+	// starts and whenever the octave, channel or key-up support changes.
+	Changed func(KeyboardState)
+}
+
+// KeyboardState is what the keys play.
+type KeyboardState struct {
+	Octave  int  // of the A key's C, where middle C, note 60, is in octave 4
+	Channel byte // from 0
+	KeyUp   bool // the terminal reports keys being released
+}
+
+// KeyboardProtocol turns on the kitty keyboard protocol, with every key
+// reported as an escape code with its releases, and queries it, so that
+// a Keyboard learns from the answer whether keys held sustain. Write it
+// to the terminal after putting it in raw mode, and KeyboardProtocolOff
+// before restoring it. Terminals without the protocol ignore both.
+const (
+	KeyboardProtocol    = "\x1b[>11u\x1b[?u"
+	KeyboardProtocolOff = "\x1b[<u"
+)
+
+// NewKeyboard returns a Keyboard reading keys from in, a terminal in raw
+// mode. Close doesn't interrupt a read of in under way.
+func NewKeyboard(in io.Reader, opts KeyboardOptions) *Keyboard {
+	if opts.NoteLength <= 0 {
+		opts.NoteLength = 300 * time.Millisecond
+	}
+	if opts.Velocity == 0 {
+		opts.Velocity = 100
+	}
+	k := &Keyboard{in: in, opts: opts, messages: make(chan []byte, 64), done: make(chan struct{})}
+	go k.run()
+	return k
+}
+
+func (k *Keyboard) Messages() <-chan []byte { return k.messages }
+
+func (k *Keyboard) Err() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.err
+}
+
+func (k *Keyboard) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if !k.closed {
+		k.closed = true
+		close(k.done)
+	}
+	return nil
+}
+
+// run plays the keys read until the input ends, Ctrl-C or Close.
+func (k *Keyboard) run() {
+	defer close(k.messages)
+	chunks := make(chan []byte)
+	failed := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := k.in.Read(buf)
+			if n > 0 {
+				select {
+				case chunks <- append([]byte(nil), buf[:n]...):
+				case <-k.done:
+					return
+				}
+			}
+			if err != nil {
+				failed <- err
+				return
+			}
+		}
+	}()
+
+	kp := newKeyPlayer(k.opts)
+	var pending []byte
+	for {
+		var expire <-chan time.Time
+		if at, ok := kp.nextOff(); ok {
+			expire = time.After(time.Until(at))
+		}
+		var msgs [][]byte
+		quit := false
+		select {
+		case chunk := <-chunks:
+			var keys []keyEvent
+			keys, pending = decodeKeys(append(pending, chunk...))
+			for _, key := range keys {
+				var m [][]byte
+				m, quit = kp.key(key, time.Now())
+				msgs = append(msgs, m...)
+				if quit {
+					break
+				}
+			}
+		case <-expire:
+			msgs = kp.expire(time.Now())
+		case err := <-failed:
+			if !errors.Is(err, io.EOF) {
+				k.mu.Lock()
+				if !k.closed {
+					k.err = err
+				}
+				k.mu.Unlock()
+			}
+			return
+		case <-k.done:
+			return
+		}
+		for _, m := range msgs {
+			select {
+			case k.messages <- m:
+			case <-k.done:
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// keyEvent is a key pressed, repeating or released, or the terminal's
+// answer to the protocol query.
+type keyEvent struct {
+	code         rune // the key's unshifted character, as 'a' for A
+	shift, ctrl  bool
+	repeat, up   bool
+	reply        bool // the answer to the query, code holding its flags
+	unrecognised bool
+}
+
+// decodeKeys decodes the keys in src, from a terminal in raw mode with or
+// without the kitty keyboard protocol, and returns them with what is left
+// of an escape code src ends inside.
+func decodeKeys(src []byte) ([]keyEvent, []byte) {
+	var keys []keyEvent
+	for len(src) > 0 {
+		b := src[0]
+		if b != 0x1b {
+			src = src[1:]
+			switch {
+			case b == 0x03:
+				keys = append(keys, keyEvent{code: 'c', ctrl: true})
+			case b == 0x04:
+				keys = append(keys, keyEvent{code: 'd', ctrl: true})
+			case b >= 'A' && b <= 'Z':
+				keys = append(keys, keyEvent{code: rune(b - 'A' + 'a'), shift: true})
+			default:
+				keys = append(keys, keyEvent{code: rune(b)})
+			}
+			continue
+		}
+		if len(src) == 1 {
+			return keys, src // an escape on its own, or the start of a code
+		}
+		if src[1] != '[' {
+			src = src[1:] // Alt and a key: taken as the key
+			continue
+		}
+		end := 2
+		for end < len(src) && (src[end] < 0x40 || src[end] > 0x7E) {
+			end++
+		}
+		if end == len(src) {
+			return keys, src
+		}
+		keys = append(keys, decodeCSI(string(src[2:end]), src[end]))
+		src = src[end+1:]
+	}
+	return keys, nil
+}
+
+// decodeCSI decodes the escape code ESC [ params final: a kitty protocol
+// key, CSI code;mods:event u, or the answer to its query, CSI ? flags u.
+func decodeCSI(params string, final byte) keyEvent {
+	if final != 'u' {
+		return keyEvent{unrecognised: true} // arrows and the like
+	}
+	if flags, ok := strings.CutPrefix(params, "?"); ok {
+		n, err := strconv.Atoi(flags)
+		return keyEvent{reply: true, code: rune(n), unrecognised: err != nil}
+	}
+	field := strings.Split(params, ";")
+	code, err := strconv.Atoi(strings.Split(field[0], ":")[0])
+	if err != nil {
+		return keyEvent{unrecognised: true}
+	}
+	ev := keyEvent{code: rune(code)}
+	if len(field) > 1 {
+		mods, event, _ := strings.Cut(field[1], ":")
+		if m, err := strconv.Atoi(mods); err == nil && m > 0 {
+			ev.shift, ev.ctrl = (m-1)&1 != 0, (m-1)&4 != 0
+		}
+		ev.repeat, ev.up = event == "2", event == "3"
+	}
+	return ev
+}
+
+// pianoKeys are the keys played, by semitone up from the A key's C.
+var pianoKeys = map[rune]int{
+	'a': 0, 'w': 1, 's': 2, 'e': 3, 'd': 4, 'f': 5, 't': 6,
+	'g': 7, 'y': 8, 'h': 9, 'u': 10, 'j': 11, 'k': 12,
+}
+
+// keyPlayer is what the keys of a Keyboard play: the MIDI messages for
+// each key, apart from reading and timing them.
+type keyPlayer struct {
+	opts  KeyboardOptions
+	state KeyboardState
+	held  []heldKey // in the order struck
+}
+
+// heldKey is a note sounding for a key, until off if the terminal doesn't
+// report its release.
+type heldKey struct {
+	code          rune
+	channel, note byte
+	off           time.Time
+}
+
+func newKeyPlayer(opts KeyboardOptions) *keyPlayer {
+	kp := &keyPlayer{opts: opts, state: KeyboardState{Octave: 4}}
+	kp.changed()
+	return kp
+}
+
+func (kp *keyPlayer) changed() {
+	if kp.opts.Changed != nil {
+		kp.opts.Changed(kp.state)
+	}
+}
+
+// key returns the MIDI messages for key, at now, and whether it closes
+// the Keyboard.
+func (kp *keyPlayer) key(key keyEvent, now time.Time) ([][]byte, bool) {
+	switch {
+	case key.unrecognised:
+		return nil, false
+	case key.reply:
+		if up := key.code&2 != 0; up != kp.state.KeyUp {
+			kp.state.KeyUp = up
+			kp.changed()
+		}
+		return nil, false
+	case key.ctrl:
+		return nil, key.code == 'c' || key.code == 'd'
+	}
+	i := slices.IndexFunc(kp.held, func(h heldKey) bool { return h.code == key.code })
+	if key.up {
+		if i < 0 {
+			return nil, false
+		}
+		h := kp.held[i]
+		kp.held = slices.Delete(kp.held, i, i+1)
+		return [][]byte{{0x80 | h.channel, h.note, 0}}, false
+	}
+	if semitone, ok := pianoKeys[key.code]; ok {
+		if i >= 0 {
+			// Held, or repeating where the terminal doesn't say which.
+			if !kp.held[i].off.IsZero() {
+				kp.held[i].off = now.Add(kp.opts.NoteLength)
+			}
+			return nil, false
+		}
+		if key.repeat {
+			return nil, false
+		}
+		n := 12*(kp.state.Octave+1) + semitone
+		if key.shift {
+			n += 12
+		}
+		if n > 127 {
+			return nil, false
+		}
+		h := heldKey{code: key.code, channel: kp.state.Channel, note: byte(n)}
+		if !kp.state.KeyUp {
+			h.off = now.Add(kp.opts.NoteLength)
+		}
+		kp.held = append(kp.held, h)
+		return [][]byte{{0x90 | h.channel, h.note, kp.opts.Velocity}}, false
+	}
+	if key.repeat {
+		return nil, false
+	}
+	switch c := key.code; {
+	case c == 'z' && kp.state.Octave > -1:
+		kp.state.Octave--
+	case c == 'x' && 12*(kp.state.Octave+2)+24 <= 127:
+		kp.state.Octave++
+	case c >= '1' && c <= '9':
+		kp.state.Channel = byte(c - '1')
+	case c == '0':
+		kp.state.Channel = 9
+	case c == ' ':
+		kp.held = nil
+		return [][]byte{{0xB0 | kp.state.Channel, 123, 0}}, false
+	default:
+		return nil, false
+	}
+	kp.changed()
+	return nil, false
+}
+
+// nextOff returns when the next note without a key-up is to end.
+func (kp *keyPlayer) nextOff() (time.Time, bool) {
+	var next time.Time
+	for _, h := range kp.held {
+		if !h.off.IsZero() && (next.IsZero() || h.off.Before(next)) {
+			next = h.off
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// expire returns the note-offs for the notes due to end by now.
+func (kp *keyPlayer) expire(now time.Time) [][]byte {
+	var msgs [][]byte
+	kp.held = slices.DeleteFunc(kp.held, func(h heldKey) bool {
+		if h.off.IsZero() || h.off.After(now) {
+			return false
+		}
+		msgs = append(msgs, []byte{0x80 | h.channel, h.note, 0})
+		return true
+	})
+	return msgs
+}
@@ -0,0 +1,130 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+func TestDecodeKeys(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []keyEvent
+		rest string
+	}{
+		{"aW 1", []keyEvent{{code: 'a'}, {code: 'w', shift: true}, {code: ' '}, {code: '1'}}, ""},
+		{"\x03", []keyEvent{{code: 'c', ctrl: true}}, ""},
+		{"\x1b[?11u", []keyEvent{{reply: true, code: 11}}, ""},
+		{"\x1b[97u\x1b[97;1:2u\x1b[97;1:3u", []keyEvent{{code: 'a'}, {code: 'a', repeat: true}, {code: 'a', up: true}}, ""},
+		{"\x1b[103;2u\x1b[99;5u", []keyEvent{{code: 'g', shift: true}, {code: 'c', ctrl: true}}, ""},
+		{"\x1b[Aa", []keyEvent{{unrecognised: true}, {code: 'a'}}, ""}, // an arrow
+		{"s\x1b[97;1", []keyEvent{{code: 's'}}, "\x1b[97;1"},
+		{"s\x1b", []keyEvent{{code: 's'}}, "\x1b"},
+	}
+	for _, tt := range tests {
+		got, rest := decodeKeys([]byte(tt.in))
+		if !slices.Equal(got, tt.want) || string(rest) != tt.rest {
+			t.Errorf("decodeKeys(%q) = %+v, %q, want %+v, %q", tt.in, got, rest, tt.want, tt.rest)
+		}
+	}
+}
+
+// play presses the keys in, decoded as decodeKeys does, on kp, a
+// millisecond apart from the zero time, expiring the notes due first,
+// and returns the messages as "on 0/60", "off 0/60" and "panic 0".
+func play(kp *keyPlayer, in string, until time.Duration) []string {
+	var got []string
+	record := func(msgs [][]byte) {
+		for _, m := range msgs {
+			kind := map[byte]string{0x80: "off", 0x90: "on", 0xB0: "panic"}[m[0]&0xF0]
+			if kind == "panic" {
+				got = append(got, fmt.Sprintf("panic %d", m[0]&0x0F))
+			} else {
+				got = append(got, fmt.Sprintf("%s %d/%d", kind, m[0]&0x0F, m[1]))
+			}
+		}
+	}
+	keys, _ := decodeKeys([]byte(in))
+	now := time.Time{}
+	for _, key := range keys {
+		now = now.Add(time.Millisecond)
+		record(kp.expire(now))
+		msgs, _ := kp.key(key, now)
+		record(msgs)
+	}
+	record(kp.expire(time.Time{}.Add(until)))
+	return got
+}
+
+func TestKeyPlayer(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"layout", "awsedftgyhujk", "on 0/60 on 0/61 on 0/62 on 0/63 on 0/64 on 0/65 on 0/66 on 0/67 on 0/68 on 0/69 on 0/70 on 0/71 on 0/72 " +
+			"off 0/60 off 0/61 off 0/62 off 0/63 off 0/64 off 0/65 off 0/66 off 0/67 off 0/68 off 0/69 off 0/70 off 0/71 off 0/72"},
+		{"shift and octaves", "AzszzzzzdxxxxxxxxxK", "on 0/72 on 0/50 on 0/4 on 0/120 off 0/72 off 0/50 off 0/4 off 0/120"},
+		{"channels", "a3s0d", "on 0/60 on 2/62 on 9/64 off 0/60 off 2/62 off 9/64"},
+		{"repeat sustains", "aa a", "on 0/60 panic 0 on 0/60 off 0/60"},
+		{"key-up", "\x1b[?11u\x1b[97u\x1b[97;1:2u\x1b[115u\x1b[97;1:3u\x1b[115;1:3u", "on 0/60 on 0/62 off 0/60 off 0/62"},
+		{"released after a shift change", "\x1b[?11u\x1b[97;2u\x1b[97;1:3u", "on 0/72 off 0/72"},
+	}
+	for _, tt := range tests {
+		kp := newKeyPlayer(KeyboardOptions{NoteLength: 100 * time.Millisecond, Velocity: 100})
+		got := strings.Join(play(kp, tt.in, time.Second), " ")
+		if got != tt.want {
+			t.Errorf("%s: %q played\n%s\nwant\n%s", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestKeyPlayerNoteLength ends a note NoteLength after its key, or after
+// the key last repeated where the terminal doesn't report releases.
+func TestKeyPlayerNoteLength(t *testing.T) {
+	kp := newKeyPlayer(KeyboardOptions{NoteLength: 100 * time.Millisecond, Velocity: 100})
+	if got := play(kp, "aaa", 50*time.Millisecond); strings.Join(got, " ") != "on 0/60" {
+		t.Errorf("after 50ms: %v, want the note held", got)
+	}
+	due := time.Time{}.Add(103 * time.Millisecond)
+	if at, ok := kp.nextOff(); !ok || at != due {
+		t.Errorf("nextOff = %v, %v, want 103ms in", at, ok)
+	}
+	if got := kp.expire(due); len(got) != 1 {
+		t.Errorf("at 103ms: %v, want the note ended", got)
+	}
+}
+
+func TestKeyboard(t *testing.T) {
+	var states []KeyboardState
+	k := NewKeyboard(strings.NewReader("\x1b[?11u\x1b[97u2\x1b[103;2u\x1b[97;1:3uxa\x03ignored"), KeyboardOptions{
+		Changed: func(s KeyboardState) { states = append(states, s) },
+	})
+	_, r := newRecorder(nil)
+	if err := NewBridge(k, r, mapping.Channels(0x01, 1, 4)).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkSent(t, sentOf(r), []protocol.Message{
+		protocol.NoteOnVelocity(0x01, 1, 60, 100),
+		protocol.NoteOnVelocity(0x01, 2, 79, 100),
+		protocol.NoteOff(0x01, 1, 60),
+		protocol.NoteOnVelocity(0x01, 2, 72, 100),
+		// Ctrl-C closed the Keyboard: panic.
+		protocol.NoteOff(0x01, 2, 72),
+		protocol.NoteOff(0x01, 2, 79),
+		protocol.AllNotesOff(0x01),
+	})
+	want := []KeyboardState{{Octave: 4}, {Octave: 4, KeyUp: true}, {Octave: 4, Channel: 1, KeyUp: true}, {Octave: 5, Channel: 1, KeyUp: true}}
+	if !slices.Equal(states, want) {
+		t.Errorf("states %+v, want %+v", states, want)
+	}
+	if err := k.Err(); err != nil {
+		t.Errorf("Err = %v after Ctrl-C", err)
+	}
+}
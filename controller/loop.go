@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Loop is a section of a song for a Player to play over and over, from
+// Start until End: events at End are past it.
+type Loop struct {
+	Start, End time.Duration
+
+	// Count is how many times the section is played before the song
+	// plays on past it; 0 for until Play is stopped.
+	Count int
+
+	// Gap is a silence between the end of the section and its start
+	// again; 0 to go straight back.
+	Gap time.Duration
+}
+
+// On reports whether l is a section to loop: End after Start.
+func (l Loop) On() bool { return l.End > l.Start }
+
+// LoopBars returns the Loop over bars first to last of a song, counting
+// from 1, as BarTime has them.
+func LoopBars(events []Event, first, last int) Loop {
+	return Loop{Start: BarTime(events, first), End: BarTime(events, last+1)}
+}
+
+// LoopMarkers returns the Loop between a song's first loopStart marker
+// and the first loopEnd marker after it, or false if it has neither. A
+// song with no loopStart loops from its start; one with no loopEnd after
+// it, to its last event.
+func LoopMarkers(events []Event) (Loop, bool) {
+	var l Loop
+	start, end := false, false
+	for _, ev := range events {
+		switch {
+		case ev.Kind == LoopStart && !start && !end:
+			l.Start, start = ev.At, true
+		case ev.Kind == LoopEnd && !end:
+			l.End, end = ev.At, true
+		}
+	}
+	if !start && !end {
+		return Loop{}, false
+	}
+	if !end && len(events) > 0 {
+		l.End = events[len(events)-1].At
+	}
+	return l, true
+}
+
+// looping reports whether the playback goes back to its loop's start at
+// its end, having passes to go.
+func (pb *playback) looping() bool {
+	return pb.loop.On() && (pb.loop.Count == 0 || pb.pass < pb.loop.Count)
+}
+
+// jump goes back from the end of the loop to its start: it releases the
+// notes sounding, waits out the loop's Gap, then puts the drives as they
+// would be at the start, striking again the notes held across it, so the
+// loop plays on without a seam. The song's clock goes back with it, so
+// the loop's events are as far apart each time round, at whatever tempo.
+func (pb *playback) jump(ctx context.Context) error {
+	if _, err := pb.send(ctx, pb.tr.release()); err != nil {
+		return err
+	}
+	if pb.loop.Gap > 0 {
+		// Pause, seek and the like wait for the gap to end.
+		woken := false
+		for {
+			err := pb.clock.sleepUntil(ctx, pb.start.Add(pb.wall(pb.loop.End+pb.loop.Gap)), pb.wake)
+			if errors.Is(err, errWoken) {
+				woken = true
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			break
+		}
+		if woken {
+			pb.signal()
+		}
+	}
+	pb.pass++
+	pb.next = firstAt(pb.events, pb.loop.Start)
+	// What comes at the start before its notes is put in place with the
+	// rest, so a note ending there isn't struck only to be released.
+	for pb.next < len(pb.events) && pb.events[pb.next].At == pb.loop.Start && pb.events[pb.next].Kind != NoteOn {
+		pb.next++
+	}
+	pb.start = pb.start.Add(pb.wall(pb.loop.End - pb.loop.Start + pb.loop.Gap))
+	pb.mu.Lock()
+	pb.at = pb.loop.Start
+	pb.mu.Unlock()
+	_, err := pb.send(ctx, pb.restore())
+	return err
+}
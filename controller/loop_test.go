@@ -0,0 +1,111 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+)
+
+// testdata/loop/markers.mid is at 120 BPM, then 100 BPM from beat 2, with
+// a loopStart marker at beat 1 and a LOOPEND at beat 3:
+//
+//	   0ms  on  1/60, 1/55 from 250ms: held across the loop's start
+//	 500ms  loopStart; off 1/60, on 1/62, 2/48
+//	 750ms  off 1/55
+//	1000ms  tempo 600000; off 1/62, on 1/64
+//	1600ms  LOOPEND; off 1/64, 2/48, on 1/65
+//	2200ms  off 1/65
+func readLoop(t *testing.T) []Event {
+	t.Helper()
+	events, err := ReadSMF("testdata/loop/markers.mid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestLoopMarkers(t *testing.T) {
+	events := readLoop(t)
+	l, ok := LoopMarkers(events)
+	if want := (Loop{Start: 500 * time.Millisecond, End: 1600 * time.Millisecond}); !ok || l != want {
+		t.Errorf("LoopMarkers = %+v, %v, want %+v", l, ok, want)
+	}
+	if l, ok := LoopMarkers(events[len(events)-1:]); ok {
+		t.Errorf("LoopMarkers without markers = %+v, true", l)
+	}
+	var noEnd []Event
+	for _, ev := range events {
+		if ev.Kind != LoopEnd {
+			noEnd = append(noEnd, ev)
+		}
+	}
+	if l, _ := LoopMarkers(noEnd); l.End != 2200*time.Millisecond {
+		t.Errorf("LoopMarkers without loopEnd ends at %v, want the last event's 2.2s", l.End)
+	}
+	if got, want := LoopBars(events, 1, 1), (Loop{End: 2200 * time.Millisecond}); got != want {
+		t.Errorf("LoopBars(1, 1) = %+v, want %+v", got, want)
+	}
+}
+
+// TestLoop plays the loop of markers.mid three times, and the song on
+// past it, and checks the messages sent against testdata/loop/*.txt: each
+// pass the notes held at the loop's start are struck again, and those
+// sounding at its end released, with the tempo change at the same offset
+// into each pass. With a gap, the passes are that much further apart.
+func TestLoop(t *testing.T) {
+	events := readLoop(t)
+	loop, _ := LoopMarkers(events)
+	for name, gap := range map[string]time.Duration{"markers": 0, "gap": 250 * time.Millisecond} {
+		t.Run(name, func(t *testing.T) {
+			p, r := newRecorder(mapping.Channels(0x01, 1, 2))
+			p.Loop = loop
+			p.Loop.Count, p.Loop.Gap = 3, gap
+			if err := p.Play(context.Background(), events); err != nil {
+				t.Fatal(err)
+			}
+			var b strings.Builder
+			for _, s := range r.sent {
+				fmt.Fprintln(&b, strings.TrimRight(s.String(), " "))
+			}
+			got := b.String()
+			golden := "testdata/loop/" + name + ".txt"
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("timeline differs from %s\n got:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
+
+// TestLoopForever loops until Play is stopped, and releases the notes.
+func TestLoopForever(t *testing.T) {
+	events := readLoop(t)
+	p, r := newRecorder(mapping.Channels(0x01, 1, 2))
+	p.Loop, _ = LoopMarkers(events)
+	ctx, cancel := context.WithCancel(context.Background())
+	r.onSend = func(int) {
+		if r.clock.t.Sub(time.Time{}) > 10*time.Second {
+			cancel()
+		}
+	}
+	if err := p.Play(ctx, events); err != context.Canceled {
+		t.Fatalf("Play = %v, want context.Canceled", err)
+	}
+	if last := r.sent[len(r.sent)-1]; last.at < 10*time.Second {
+		t.Errorf("stopped at %v, before 10s of looping", last.at)
+	}
+}
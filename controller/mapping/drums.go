@@ -0,0 +1,83 @@
+package mapping
+
+import "fmt"
+
+// Drum is a group of General MIDI drums, which a kit sends to one
+// percussion drive.
+type Drum int
+
+const (
+	DrumNone   Drum = iota // not a General MIDI drum
+	DrumKick               // bass drums
+	DrumSnare              // snares, side stick and hand clap
+	DrumHiHat              // closed, pedal and open hi-hat
+	DrumTom                // the six toms
+	DrumCymbal             // crash, ride, china and splash cymbals
+	DrumOther              // the rest: cowbell, congas, woodblocks and so on
+)
+
+var drumNames = [...]string{"none", "kick", "snare", "hihat", "tom", "cymbal", "other"}
+
+func (d Drum) String() string {
+	if d < 0 || int(d) >= len(drumNames) {
+		return fmt.Sprintf("Drum(%d)", int(d))
+	}
+	return drumNames[d]
+}
+
+// parseDrum returns the Drum named s in a kit.
+func parseDrum(s string) (Drum, bool) {
+	for d, name := range drumNames[DrumKick:] {
+		if s == name {
+			return Drum(d) + DrumKick, true
+		}
+	}
+	return DrumNone, false
+}
+
+// GMDrum returns the group of General MIDI drum note, 35 to 81, or
+// DrumNone for a note that isn't one. The groups follow the firmware's HDD
+// and relay pulse tables, so a drum sent to a kit's drive with its note
+// kept gets the right stroke.
+func GMDrum(note byte) Drum {
+	switch note {
+	case 35, 36:
+		return DrumKick
+	case 37, 38, 39, 40:
+		return DrumSnare
+	case 42, 44, 46:
+		return DrumHiHat
+	case 41, 43, 45, 47, 48, 50:
+		return DrumTom
+	case 49, 51, 52, 53, 55, 57, 59:
+		return DrumCymbal
+	}
+	if note >= 35 && note <= 81 {
+		return DrumOther
+	}
+	return DrumNone
+}
+
+// DefaultKit returns a kit sending each drum group to its own drive of
+// device: kick on drive 1, then snare, hi-hat, tom, cymbal and the rest
+// on drives 2 to 6.
+func DefaultKit(device byte) map[Drum]Target {
+	kit := make(map[Drum]Target)
+	for d := DrumKick; d <= DrumOther; d++ {
+		kit[d] = Target{device, byte(d)}
+	}
+	return kit
+}
+
+// Hit returns what the percussion note does: its hit in p.Hits if it has
+// one, else a hit of p.Kit's drive for its GM drum group, playing the note
+// itself. It reports false for a note with neither, which is dropped.
+func (p Percussion) Hit(note byte) (Hit, bool) {
+	if h, ok := p.Hits[note]; ok {
+		return h, true
+	}
+	if t, ok := p.Kit[GMDrum(note)]; ok {
+		return Hit{Target: t, Note: note}, true
+	}
+	return Hit{}, false
+}
@@ -0,0 +1,171 @@
+package mapping
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Encode writes m in the form Parse reads, every setting spelled out on
+// its channel rather than in defaults, which hold only the Strategy and
+// Voicing.
+// Parse reads back the same Map, but for its Line fields.
+func (m *Map) Encode(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	if m.Strategy != StrategyNone || m.Voicing != VoicesNone {
+		fmt.Fprintln(b, "defaults:")
+	}
+	if m.Strategy != StrategyNone {
+		fmt.Fprintf(b, "  arrange: %s\n", m.Strategy)
+	}
+	if m.Voicing != VoicesNone {
+		fmt.Fprintf(b, "  allocate: %s\n", m.Voicing)
+	}
+	fmt.Fprintln(b, "channels:")
+	for i, c := range m.Channels {
+		if reflect.DeepEqual(c, Channel{Line: c.Line}) {
+			continue
+		}
+		if !c.Shared() && c.Transpose == 0 && c.MinVelocity == 0 && c.MaxNotes == 0 && c.MinLength == 0 && c.Quantise == (Quantise{}) && c.Humanise == 0 && c.Range == (Range{}) && c.Priority == 0 && !c.Ignore && len(c.Programs) == 0 && c.DefaultPreset == "" {
+			fmt.Fprintf(b, "  %d: %s\n", i+1, c.Target)
+			continue
+		}
+		fmt.Fprintf(b, "  %d:\n", i+1)
+		if c.Pool != (Pool{}) {
+			fmt.Fprintf(b, "    pool: %s\n", c.Pool)
+		}
+		if len(c.Stripe) > 0 {
+			pools := make([]string, len(c.Stripe))
+			for i, p := range c.Stripe {
+				pools[i] = p.String()
+			}
+			fmt.Fprintf(b, "    stripe: %s\n", strings.Join(pools, ", "))
+			if c.Balance != BalanceRoundRobin {
+				fmt.Fprintf(b, "    balance: %s\n", c.Balance)
+			}
+		}
+		if c.Target != (Target{}) {
+			fmt.Fprintf(b, "    target: %s\n", c.Target)
+		}
+		if c.Transpose != 0 {
+			fmt.Fprintf(b, "    transpose: %d\n", c.Transpose)
+		}
+		if c.MinVelocity != 0 {
+			fmt.Fprintf(b, "    min-velocity: %d\n", c.MinVelocity)
+		}
+		if c.MaxNotes != 0 {
+			fmt.Fprintf(b, "    max-notes: %d\n", c.MaxNotes)
+		}
+		if c.MinLength != 0 {
+			fmt.Fprintf(b, "    min-length: %v\n", c.MinLength)
+		}
+		if c.Quantise != (Quantise{}) {
+			fmt.Fprintf(b, "    quantise: %s\n", c.Quantise)
+		}
+		if c.Humanise != 0 {
+			fmt.Fprintf(b, "    humanise: %v\n", c.Humanise)
+		}
+		if c.Range != (Range{}) {
+			fmt.Fprintf(b, "    range: %s\n", c.Range)
+		}
+		if c.Priority != 0 {
+			fmt.Fprintf(b, "    priority: %d\n", c.Priority)
+		}
+		if c.Ignore {
+			fmt.Fprintln(b, "    ignore: true")
+		}
+		if len(c.Programs) > 0 || c.DefaultPreset != "" {
+			fmt.Fprintln(b, "    programs:")
+		}
+		for _, prog := range slices.Sorted(maps.Keys(c.Programs)) {
+			fmt.Fprintf(b, "      %d: %s\n", prog, c.Programs[prog])
+		}
+		if c.DefaultPreset != "" {
+			fmt.Fprintf(b, "      default: %s\n", c.DefaultPreset)
+		}
+	}
+	if p := m.Percussion; p.routes() {
+		fmt.Fprintf(b, "percussion:\n  channel: %d\n", p.Channel+1)
+		if len(p.Kit) > 0 {
+			fmt.Fprintln(b, "  kit:")
+			for _, d := range slices.Sorted(maps.Keys(p.Kit)) {
+				fmt.Fprintf(b, "    %s: %s\n", d, p.Kit[d])
+			}
+		}
+		if len(p.Hits) > 0 {
+			fmt.Fprintln(b, "  notes:")
+		}
+		for _, note := range slices.Sorted(maps.Keys(m.Percussion.Hits)) {
+			h := m.Percussion.Hits[note]
+			if h.Reset {
+				fmt.Fprintf(b, "    %d: %s reset\n", note, h.Target)
+			} else {
+				fmt.Fprintf(b, "    %d: %s note %d\n", note, h.Target, h.Note)
+			}
+		}
+	}
+	if mt := m.Metronome; mt.On() {
+		fmt.Fprintf(b, "metronome:\n  click: %s\n", mt.Click)
+		if mt.Accent != (Click{}) {
+			fmt.Fprintf(b, "  accent: %s\n", mt.Accent)
+		}
+	}
+	if len(m.Ranges) > 0 {
+		fmt.Fprintln(b, "ranges:")
+		for _, d := range slices.Sorted(maps.Keys(m.Ranges)) {
+			fmt.Fprintf(b, "  0x%02X: %s\n", d, m.Ranges[d])
+		}
+	}
+	if len(m.Voices) > 0 {
+		fmt.Fprintln(b, "voices:")
+		for _, d := range slices.Sorted(maps.Keys(m.Voices)) {
+			fmt.Fprintf(b, "  0x%02X: %d\n", d, m.Voices[d])
+		}
+	}
+	if len(m.Offsets) > 0 {
+		fmt.Fprintln(b, "offsets:")
+		for _, d := range slices.Sorted(maps.Keys(m.Offsets)) {
+			fmt.Fprintf(b, "  0x%02X: %d\n", d, m.Offsets[d].Milliseconds())
+		}
+	}
+	if len(m.Transports) > 0 {
+		fmt.Fprintln(b, "transports:")
+		for _, d := range slices.Sorted(maps.Keys(m.Transports)) {
+			fmt.Fprintf(b, "  0x%02X: %s\n", d, m.Transports[d])
+		}
+	}
+	if len(m.Presets) > 0 {
+		fmt.Fprintln(b, "presets:")
+	}
+	for _, name := range slices.Sorted(maps.Keys(m.Presets)) {
+		p := m.Presets[name]
+		fmt.Fprintf(b, "  %s:\n", name)
+		if p.Transpose != nil {
+			fmt.Fprintf(b, "    transpose: %d\n", *p.Transpose)
+		}
+		if p.Detune != nil {
+			fmt.Fprintf(b, "    detune: %d\n", *p.Detune)
+		}
+		if p.Spread != 0 {
+			fmt.Fprintf(b, "    spread: %d\n", p.Spread)
+		}
+		if p.Clamp != nil {
+			head := "full"
+			if *p.Clamp {
+				head = "clamp"
+			}
+			fmt.Fprintf(b, "    head: %s\n", head)
+		}
+		if p.Tremolo != nil {
+			fmt.Fprintf(b, "    tremolo: %s\n", *p.Tremolo)
+		}
+		if p.BendRange != nil {
+			fmt.Fprintf(b, "    bend-range: %d\n", *p.BendRange)
+		}
+	}
+	return b.Flush()
+}
@@ -0,0 +1,1307 @@
+// Package mapping is the mapping file goppy-play and goppy jam read: which
+// device and drive each MIDI channel plays on, how, and where the
+// percussion channel's drums go. It is YAML, of this form:
+//
+//	defaults:              # apply to every channel below
+//	  device: 0x01
+//	  transpose: 0
+//	  min-velocity: 0
+//	  max-notes: 0         # thin chords to this many notes at once; 0 for any
+//	  min-length: 0s       # drop notes released sooner
+//	  range: 24-71         # the notes the drives play; see Range
+//	  arrange: fold        # what the player does with notes outside it
+//	  allocate: outer      # how it shares a device's drives; see VoiceStrategy
+//	channels:              # MIDI channels, 1 to 16
+//	  1: 1                 # drive 1 of the default device
+//	  2: 0x01/0x11         # a zone alias on device 1
+//	  3:
+//	    pool: 0x02/1-4     # each note takes whichever of drives 1..4 is free
+//	    transpose: -12
+//	    min-velocity: 20   # drop notes struck softer
+//	    max-notes: 4       # keep the loudest four of a chord
+//	    min-length: 30ms   # drop grace notes, which only click
+//	    range: 36-71
+//	    priority: 1        # keep its notes over lower channels' for drives
+//	    quantise: 1/16 75% # move notes 75% of the way to the nearest 16th
+//	    humanise: 8ms      # then each up to 8ms either way; see Retime
+//	  4:
+//	    ignore: true
+//	  5:                   # share the notes out over the drives of devices
+//	    stripe: 0x01/1-8, 0x02/1-8, 0x03/1
+//	    balance: least-busy # or round-robin, the default; see Balance
+//	  6:
+//	    pool: 0x04/1-4
+//	    programs:          # the preset each program change sends, 0 to 127
+//	      0: clean
+//	      30: growl
+//	      default: clean   # for the programs not listed; else the preset
+//	                       # named default, if there is one
+//	percussion:
+//	  channel: 10          # the default
+//	  kit:                 # General MIDI drums by group; see GMDrum, and
+//	                       # DefaultKit for kit: 0x05
+//	    kick: 0x05/1       # an HDD: the drum's note goes as it is
+//	    snare: 0x05/2
+//	    hihat: 0x06/1      # a relay
+//	    tom: 0x05/3
+//	    cymbal: 0x06/2
+//	    other: 0x06/3
+//	  notes:               # MIDI note: target and what the hit does
+//	    36: 0x01/8 reset   # re-home the drive; the seek is the sound
+//	    56: 0x01/7 note 84 # play note 84 while the hit is held
+//	metronome:             # where the player's clicks go; see controller.Clicks
+//	  click: 0x06/4 note 96 # a hit, as a percussion note's: reset or note N
+//	  accent: channel 3 note 84
+//	                       # the first beat of each bar's, if not the
+//	                       # click's: note 84, as channel 3's notes go
+//	voices:                # notes each device sounds at once, for allocate;
+//	  0x02: 3              # by default, the drives its channels play on
+//	ranges:                # notes each device plays, where not all; a
+//	  0x03: 48-71          # striped note only goes to one whose range has it
+//	offsets:               # milliseconds to send to each device early, for
+//	  0x04: 12             # one that sounds late; negative for later
+//	transports:            # how to reach each device, where it answers on
+//	  0x05: udp            # more than one: serial, udp or mdns; see Transport
+//	presets:               # firmware settings sent to a channel's drives on
+//	  clean:               # a program change; those left out stay as they are
+//	    transpose: 0
+//	    detune: 0          # cents
+//	    head: full         # or clamp, to a wiggle
+//	    tremolo: off
+//	    bend-range: 2
+//	  growl:
+//	    transpose: -12
+//	    spread: 20         # cents the drives are detuned over, first lowest
+//	    head: clamp
+//	    tremolo: 12/60     # Hz, and the percent of each cycle sounding
+//	    bend-range: 12
+//
+// Channels left out are dropped. Only this much YAML is read: nested maps
+// indented with spaces, scalars, and # comments.
+package mapping
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+)
+
+// Target is a device and one of its drives, or a zone alias.
+type Target struct {
+	Device byte
+	Sub    byte
+}
+
+func (t Target) String() string { return fmt.Sprintf("0x%02X/%d", t.Device, t.Sub) }
+
+// Pool is a run of drives on a device that a channel's notes share, each
+// taking one that is free.
+type Pool struct {
+	Device      byte
+	First, Last byte
+}
+
+func (p Pool) String() string { return fmt.Sprintf("0x%02X/%d-%d", p.Device, p.First, p.Last) }
+
+// Range is the notes a channel's or a device's drives play, Low to High.
+type Range struct {
+	Low, High byte
+}
+
+// FloppyRange is a channel's Range when the mapping doesn't give one: the
+// firmware plays up to B4 (instruments.MaxFloppyNote), and below C1 the
+// drives step too slowly to be heard as pitch.
+var FloppyRange = Range{Low: 24, High: 71}
+
+func (r Range) String() string { return fmt.Sprintf("%d-%d", r.Low, r.High) }
+
+// Contains reports whether note is in r.
+func (r Range) Contains(note int) bool { return note >= int(r.Low) && note <= int(r.High) }
+
+// Strategy is what a player does with notes outside a channel's Range
+// before playing a song.
+type Strategy int
+
+const (
+	StrategyNone  Strategy = iota // leave them to the firmware's NoteRangePolicy
+	StrategyFold                  // move each by octaves into range
+	StrategyShift                 // shift the song by the interval putting the most notes in range
+	StrategyDrop                  // drop them
+)
+
+var strategyNames = [...]string{"none", "fold", "shift", "drop"}
+
+func (s Strategy) String() string {
+	if s < 0 || int(s) >= len(strategyNames) {
+		return fmt.Sprintf("Strategy(%d)", int(s))
+	}
+	return strategyNames[s]
+}
+
+// ParseStrategy returns the Strategy named s: none, fold, shift or drop.
+func ParseStrategy(s string) (Strategy, error) {
+	if i := slices.Index(strategyNames[:], s); i >= 0 {
+		return Strategy(i), nil
+	}
+	return 0, fmt.Errorf("unknown strategy %q: want none, fold, shift or drop", s)
+}
+
+// VoiceStrategy is how a player shares out a device's voices, the notes
+// it sounds at once, when a song strikes more than it has: see
+// controller.Allocate.
+type VoiceStrategy int
+
+const (
+	VoicesNone  VoiceStrategy = iota // share none out: the firmware drops what it can't play
+	VoicesFirst                      // a note keeps its voice until released; one struck with none free is dropped
+	VoicesOuter                      // keep the melody and bass, the highest and lowest notes, over inner ones
+)
+
+var voiceStrategyNames = [...]string{"none", "first", "outer"}
+
+func (s VoiceStrategy) String() string {
+	if s < 0 || int(s) >= len(voiceStrategyNames) {
+		return fmt.Sprintf("VoiceStrategy(%d)", int(s))
+	}
+	return voiceStrategyNames[s]
+}
+
+// ParseVoiceStrategy returns the VoiceStrategy named s: none, first or
+// outer.
+func ParseVoiceStrategy(s string) (VoiceStrategy, error) {
+	if i := slices.Index(voiceStrategyNames[:], s); i >= 0 {
+		return VoiceStrategy(i), nil
+	}
+	return 0, fmt.Errorf("unknown voice strategy %q: want none, first or outer", s)
+}
+
+// Transport is how the controller reaches a device: a mapping's hint,
+// for a device that answers on more than one, of the one to play it
+// through. See controller.DeviceRegistry.
+type Transport int
+
+const (
+	TransportAny    Transport = iota // no hint: the first to answer
+	TransportSerial                  // a serial port, as ScanAll finds
+	TransportUDP                     // UDP multicast, as OpenUDP sends
+	TransportMDNS                    // a device advertised over mDNS
+)
+
+var transportNames = [...]string{"any", "serial", "udp", "mdns"}
+
+func (t Transport) String() string {
+	if t < 0 || int(t) >= len(transportNames) {
+		return fmt.Sprintf("Transport(%d)", int(t))
+	}
+	return transportNames[t]
+}
+
+// ParseTransport returns the Transport named s: any, serial, udp or
+// mdns.
+func ParseTransport(s string) (Transport, error) {
+	if i := slices.Index(transportNames[:], s); i >= 0 {
+		return Transport(i), nil
+	}
+	return 0, fmt.Errorf("unknown transport %q: want any, serial, udp or mdns", s)
+}
+
+// Balance is how a striped channel's notes are shared out over its
+// stripe.
+type Balance int
+
+const (
+	BalanceRoundRobin Balance = iota // each note to the next pool of the stripe
+	BalanceLeastBusy                 // each note to the pool holding fewest notes
+)
+
+var balanceNames = [...]string{"round-robin", "least-busy"}
+
+func (b Balance) String() string {
+	if b < 0 || int(b) >= len(balanceNames) {
+		return fmt.Sprintf("Balance(%d)", int(b))
+	}
+	return balanceNames[b]
+}
+
+// ParseBalance returns the Balance named s: round-robin or least-busy.
+func ParseBalance(s string) (Balance, error) {
+	if i := slices.Index(balanceNames[:], s); i >= 0 {
+		return Balance(i), nil
+	}
+	return 0, fmt.Errorf("unknown balance %q: want round-robin or least-busy", s)
+}
+
+// Quantise is how far a channel's notes are moved toward a grid: see
+// controller.Retime. The zero Quantise leaves them be.
+type Quantise struct {
+	Grid     int // the note value of the grid, as 16 for 16ths, 12 for 8th triplets
+	Strength int // percent of the way to the grid, 1 to 100
+}
+
+// MaxGrid is the finest Quantise grid, 128th notes.
+const MaxGrid = 128
+
+// MaxHumanise is the most a channel's Humanise may be.
+const MaxHumanise = 100 * time.Millisecond
+
+// String returns q as a mapping file has it: "1/16", or "1/16 75%" short
+// of all the way.
+func (q Quantise) String() string {
+	if q.Strength == 100 {
+		return fmt.Sprintf("1/%d", q.Grid)
+	}
+	return fmt.Sprintf("1/%d %d%%", q.Grid, q.Strength)
+}
+
+// Channel is where one MIDI channel's notes go: a Target, or a Pool or a
+// Stripe if it has one. The zero Channel is unmapped.
+type Channel struct {
+	Target      Target
+	Pool        Pool
+	Stripe      []Pool        // pools on several devices, each note taking a drive of one
+	Balance     Balance       // how the Stripe's notes are shared out
+	Transpose   int           // semitones
+	MinVelocity byte          // notes struck softer are dropped
+	MaxNotes    int           // most notes held at once, 0 for any; see controller.Thin
+	MinLength   time.Duration // notes released sooner are dropped
+	Quantise    Quantise      // the grid notes are moved toward
+	Humanise    time.Duration // most a note is moved either way, at random
+	Range       Range         // zero for FloppyRange
+	Priority    int           // 0 to 127: higher channels' notes keep voices first
+	Ignore      bool
+
+	Programs      map[byte]string // preset names by program number
+	DefaultPreset string          // for the programs not in Programs
+
+	Line int // where the channel is in the file, 0 if not from one
+}
+
+// Mapped reports whether notes on c are played.
+func (c Channel) Mapped() bool {
+	return !c.Ignore && (c.Pool != Pool{} || c.Target != Target{} || len(c.Stripe) > 0)
+}
+
+// Shared reports whether c's notes each take whichever of its drives is
+// free, those of its Pool or Stripe.
+func (c Channel) Shared() bool {
+	return c.Pool != (Pool{}) || len(c.Stripe) > 0
+}
+
+// Targets returns the drives c plays on: its stripe's, its pool's, or its
+// target.
+func (c Channel) Targets() []Target {
+	switch {
+	case len(c.Stripe) > 0:
+		var ts []Target
+		for _, p := range c.Stripe {
+			ts = append(ts, p.Targets()...)
+		}
+		return ts
+	case c.Pool != (Pool{}):
+		return c.Pool.Targets()
+	case c.Target != (Target{}):
+		return []Target{c.Target}
+	}
+	return nil
+}
+
+// Targets returns p's drives, in order.
+func (p Pool) Targets() []Target {
+	var ts []Target
+	for d := int(p.First); d <= int(p.Last); d++ {
+		ts = append(ts, Target{p.Device, byte(d)})
+	}
+	return ts
+}
+
+// NoteRange returns the notes c's drives play: its Range, or FloppyRange.
+func (c Channel) NoteRange() Range {
+	if c.Range == (Range{}) {
+		return FloppyRange
+	}
+	return c.Range
+}
+
+// Hit is what a percussion note does.
+type Hit struct {
+	Target Target
+	Reset  bool // re-home the drive
+	Note   byte // unless Reset, the note played while the hit is held
+
+	Line int
+}
+
+// Percussion routes one channel's notes to drums: see Percussion.Hit.
+type Percussion struct {
+	Channel byte            // 0..15; 9 is MIDI channel 10
+	Kit     map[Drum]Target // by General MIDI drum group
+	Hits    map[byte]Hit    // by MIDI note, before Kit
+	Line    int
+}
+
+// Click is where a metronome click goes: a drive, as a percussion note's
+// Hit goes, or, with Channel set, Hit.Note played as that channel's notes
+// are, on its drives or by the percussion hits.
+type Click struct {
+	Hit
+	Channel byte // 1 to 16, or 0 for Hit's target
+}
+
+func (c Click) String() string {
+	switch {
+	case c.Channel != 0:
+		return fmt.Sprintf("channel %d note %d", c.Channel, c.Note)
+	case c.Reset:
+		return c.Target.String() + " reset"
+	}
+	return fmt.Sprintf("%s note %d", c.Target, c.Note)
+}
+
+// Metronome is where a player's metronome and count-in clicks go: see
+// controller.Clicks.
+type Metronome struct {
+	Click  Click
+	Accent Click // the first beat of each bar's; the zero Click for Click's
+	Line   int
+}
+
+// On reports whether m sends its clicks anywhere.
+func (m Metronome) On() bool {
+	return m.Click.Channel != 0 || m.Click.Target != (Target{})
+}
+
+// For returns where a click goes: Accent, if m has one, for the first
+// beat of a bar.
+func (m Metronome) For(accent bool) Click {
+	if accent && (m.Accent.Channel != 0 || m.Accent.Target != (Target{})) {
+		return m.Accent
+	}
+	return m.Click
+}
+
+// Preset is a bundle of firmware settings a channel's drives are sent on a
+// program change: see Map.Preset. Settings left nil aren't sent, and stay
+// as they were.
+type Preset struct {
+	Transpose *int     // semitones
+	Detune    *int     // cents; the middle of the Spread
+	Spread    int      // cents the drives are detuned over, the first lowest
+	Clamp     *bool    // whether the head is clamped to a wiggle, or has full travel
+	Tremolo   *Tremolo // Rate 0 for none
+	BendRange *int     // semitones, 1 to 24
+
+	Line int
+}
+
+// Tremolo gates a drive Rate times a second, sounding for Duty percent of
+// each cycle.
+type Tremolo struct {
+	Rate, Duty int
+}
+
+func (t Tremolo) String() string {
+	if t == (Tremolo{}) {
+		return "off"
+	}
+	return fmt.Sprintf("%d/%d", t.Rate, t.Duty)
+}
+
+// Detunes returns the detune of each of n drives, in cents, Spread evenly
+// around Detune, and whether p sets them at all.
+func (p Preset) Detunes(n int) ([]int, bool) {
+	if p.Detune == nil && p.Spread == 0 {
+		return nil, false
+	}
+	mid := 0
+	if p.Detune != nil {
+		mid = *p.Detune
+	}
+	cents := make([]int, n)
+	for i := range cents {
+		cents[i] = mid
+		if n > 1 {
+			cents[i] += i*p.Spread/(n-1) - p.Spread/2
+		}
+	}
+	return cents, true
+}
+
+// Map is a whole mapping. Notes on the percussion channel go by its hits,
+// if it has any, and on other channels by Channels.
+type Map struct {
+	Channels   [16]Channel
+	Percussion Percussion
+	Metronome  Metronome
+	Strategy   Strategy      // for notes outside a channel's range
+	Voicing    VoiceStrategy // for more notes at once than a device has voices
+	Voices     map[byte]int  // voices by device, where not the drives it plays on
+	Ranges     map[byte]Range
+	Offsets    map[byte]time.Duration // how much earlier to send to each device
+	Transports map[byte]Transport     // how to reach each device, where hinted
+	Presets    map[string]Preset      // by name
+}
+
+// MaxOffset is the most a device's offset may be, either way.
+const MaxOffset = time.Second
+
+// DeviceRange returns the notes device plays: its Ranges entry, or all.
+func (m *Map) DeviceRange(device byte) Range {
+	if r, ok := m.Ranges[device]; ok {
+		return r
+	}
+	return Range{0, 127}
+}
+
+// Preset returns the preset channel's drives are sent on a program change
+// to program: the one its Programs name, else its DefaultPreset, else the
+// preset named default, if there is one.
+func (m *Map) Preset(channel, program byte) (Preset, bool) {
+	c := m.Channels[channel&0x0F]
+	name, ok := c.Programs[program]
+	switch {
+	case ok:
+	case c.DefaultPreset != "":
+		name = c.DefaultPreset
+	default:
+		name = "default"
+	}
+	p, ok := m.Presets[name]
+	return p, ok
+}
+
+// Channels maps channel 1 to drive first of device, channel 2 to the next
+// drive, and so on up to drive last.
+func Channels(device, first, last byte) *Map {
+	m := &Map{Percussion: Percussion{Channel: 9}}
+	for ch := 0; ch < 16 && int(first)+ch <= int(last); ch++ {
+		m.Channels[ch] = Channel{Target: Target{device, first + byte(ch)}}
+	}
+	return m
+}
+
+// Drums reports whether channel plays m's percussion hits.
+func (m *Map) Drums(channel byte) bool {
+	return m.Percussion.routes() && channel == m.Percussion.Channel
+}
+
+// routes reports whether p sends any note anywhere.
+func (p Percussion) routes() bool { return len(p.Hits) > 0 || len(p.Kit) > 0 }
+
+// Devices returns the devices m sends to, in order.
+func (m *Map) Devices() []byte {
+	var devs []byte
+	add := func(d byte) {
+		if !slices.Contains(devs, d) {
+			devs = append(devs, d)
+		}
+	}
+	for _, c := range m.Channels {
+		if c.Mapped() {
+			for _, t := range c.Targets() {
+				add(t.Device)
+			}
+		}
+	}
+	for _, h := range m.Percussion.Hits {
+		add(h.Target.Device)
+	}
+	for _, t := range m.Percussion.Kit {
+		add(t.Device)
+	}
+	for _, c := range []Click{m.Metronome.Click, m.Metronome.Accent} {
+		if c.Channel == 0 && c.Target != (Target{}) {
+			add(c.Target.Device)
+		}
+	}
+	slices.Sort(devs)
+	return devs
+}
+
+// Error is a problem with a mapping, at a line of its file if Line isn't
+// 0.
+type Error struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.Line == 0:
+		return e.Msg
+	case e.File == "":
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// errorList collects a mapping's problems, to report them all at once.
+type errorList []error
+
+func (l *errorList) add(line int, format string, args ...any) {
+	*l = append(*l, &Error{Line: line, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (l errorList) err() error { return errors.Join(l...) }
+
+// Validate reports every problem with m, each an *Error, joined.
+func (m *Map) Validate() error {
+	var errs errorList
+	for i, c := range m.Channels {
+		if c.Ignore {
+			continue
+		}
+		name := fmt.Sprintf("channel %d", i+1)
+		if len(c.Stripe) > 0 {
+			if c.Target != (Target{}) || c.Pool != (Pool{}) {
+				errs.add(c.Line, "%s has a stripe and a target or pool", name)
+			}
+			for _, p := range c.Stripe {
+				validDevice(&errs, c.Line, name, p.Device)
+				if p.First == 0 || p.Last < p.First {
+					errs.add(c.Line, "%s: stripe drives %d-%d aren't a range from 1 up", name, p.First, p.Last)
+				}
+			}
+		} else if c.Pool != (Pool{}) {
+			if c.Target != (Target{}) {
+				errs.add(c.Line, "%s has both a target and a pool", name)
+			}
+			validDevice(&errs, c.Line, name, c.Pool.Device)
+			if c.Pool.First == 0 || c.Pool.Last < c.Pool.First {
+				errs.add(c.Line, "%s: pool drives %d-%d aren't a range from 1 up", name, c.Pool.First, c.Pool.Last)
+			}
+		} else if c.Target != (Target{}) {
+			validDevice(&errs, c.Line, name, c.Target.Device)
+		}
+		if c.Transpose < -127 || c.Transpose > 127 {
+			errs.add(c.Line, "%s: transpose %d isn't -127 to 127", name, c.Transpose)
+		}
+		if c.MinVelocity > 127 {
+			errs.add(c.Line, "%s: min-velocity %d isn't 0 to 127", name, c.MinVelocity)
+		}
+		if c.MaxNotes < 0 {
+			errs.add(c.Line, "%s: max-notes %d is negative", name, c.MaxNotes)
+		}
+		if c.MinLength < 0 {
+			errs.add(c.Line, "%s: min-length %v is negative", name, c.MinLength)
+		}
+		if q := c.Quantise; q != (Quantise{}) && (q.Grid < 1 || q.Grid > MaxGrid || q.Strength < 1 || q.Strength > 100) {
+			errs.add(c.Line, "%s: quantise %s isn't 1/1 to 1/%d, 1%% to 100%%", name, q, MaxGrid)
+		}
+		if c.Humanise < 0 || c.Humanise > MaxHumanise {
+			errs.add(c.Line, "%s: humanise %v isn't 0 to %v", name, c.Humanise, MaxHumanise)
+		}
+		if c.Range != (Range{}) && (c.Range.High < c.Range.Low || c.Range.High > 127) {
+			errs.add(c.Line, "%s: range %s isn't low-high within 0-127", name, c.Range)
+		}
+		if c.Priority < 0 || c.Priority > 127 {
+			errs.add(c.Line, "%s: priority %d isn't 0 to 127", name, c.Priority)
+		}
+		for _, prog := range slices.Sorted(maps.Keys(c.Programs)) {
+			if prog > 127 {
+				errs.add(c.Line, "%s: program %d isn't 0 to 127", name, prog)
+			}
+			if _, ok := m.Presets[c.Programs[prog]]; !ok {
+				errs.add(c.Line, "%s: program %d is preset %q, which isn't in presets", name, prog, c.Programs[prog])
+			}
+		}
+		if _, ok := m.Presets[c.DefaultPreset]; c.DefaultPreset != "" && !ok {
+			errs.add(c.Line, "%s: default preset %q isn't in presets", name, c.DefaultPreset)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(m.Presets)) {
+		validPreset(&errs, name, m.Presets[name])
+	}
+	for _, d := range slices.Sorted(maps.Keys(m.Ranges)) {
+		validDevice(&errs, 0, "ranges", d)
+		if r := m.Ranges[d]; r.High < r.Low || r.High > 127 {
+			errs.add(0, "ranges: device 0x%02X plays %s, not low-high within 0-127", d, r)
+		}
+	}
+	for _, d := range slices.Sorted(maps.Keys(m.Voices)) {
+		validDevice(&errs, 0, "voices", d)
+		if n := m.Voices[d]; n < 1 || n > 255 {
+			errs.add(0, "voices: device 0x%02X has %d voices, not 1 to 255", d, n)
+		}
+	}
+	for _, d := range slices.Sorted(maps.Keys(m.Offsets)) {
+		validDevice(&errs, 0, "offsets", d)
+		if o := m.Offsets[d]; o < -MaxOffset || o > MaxOffset {
+			errs.add(0, "offsets: device 0x%02X is %v early, not within %v either way", d, o, MaxOffset)
+		}
+	}
+	for _, d := range slices.Sorted(maps.Keys(m.Transports)) {
+		validDevice(&errs, 0, "transports", d)
+		if t := m.Transports[d]; t < 0 || int(t) >= len(transportNames) {
+			errs.add(0, "transports: device 0x%02X has %v", d, t)
+		}
+	}
+	p := m.Percussion
+	if p.routes() {
+		if p.Channel > 15 {
+			errs.add(p.Line, "percussion channel %d isn't 1 to 16", p.Channel+1)
+		} else if c := m.Channels[p.Channel]; c.Mapped() {
+			errs.add(c.Line, "channel %d is the percussion channel, so can't be mapped too", p.Channel+1)
+		}
+		for _, note := range slices.Sorted(maps.Keys(p.Hits)) {
+			h := p.Hits[note]
+			name := fmt.Sprintf("percussion note %d", note)
+			if note > 127 {
+				errs.add(h.Line, "%s isn't a MIDI note", name)
+			}
+			validDevice(&errs, h.Line, name, h.Target.Device)
+			if !h.Reset && h.Note > 127 {
+				errs.add(h.Line, "%s plays note %d, which isn't a MIDI note", name, h.Note)
+			}
+		}
+		for _, d := range slices.Sorted(maps.Keys(p.Kit)) {
+			if d <= DrumNone || d > DrumOther {
+				errs.add(p.Line, "percussion kit has %v, which isn't a drum group", d)
+			}
+			validDevice(&errs, p.Line, "percussion "+d.String(), p.Kit[d].Device)
+		}
+	}
+	if mt := m.Metronome; mt.On() {
+		m.validClick(&errs, "metronome click", mt.Click)
+		if mt.Accent != (Click{}) {
+			m.validClick(&errs, "metronome accent", mt.Accent)
+		}
+	} else if mt.Accent != (Click{}) {
+		errs.add(mt.Line, "metronome has an accent but no click")
+	}
+	return errs.err()
+}
+
+func (m *Map) validClick(errs *errorList, name string, c Click) {
+	switch {
+	case c.Channel > 16:
+		errs.add(c.Line, "%s: channel %d isn't 1 to 16", name, c.Channel)
+	case c.Channel != 0:
+		if ch := c.Channel - 1; !m.Drums(ch) && !m.Channels[ch].Mapped() {
+			errs.add(c.Line, "%s: channel %d isn't mapped", name, c.Channel)
+		}
+	default:
+		validDevice(errs, c.Line, name, c.Target.Device)
+	}
+	if !c.Reset && c.Note > 127 {
+		errs.add(c.Line, "%s plays note %d, which isn't a MIDI note", name, c.Note)
+	}
+}
+
+func validPreset(errs *errorList, name string, p Preset) {
+	if p.Transpose != nil && (*p.Transpose < -127 || *p.Transpose > 127) {
+		errs.add(p.Line, "preset %s: transpose %d isn't -127 to 127", name, *p.Transpose)
+	}
+	if cents, ok := p.Detunes(2); ok && (p.Spread < 0 || cents[0] < -127 || cents[1] > 127) {
+		errs.add(p.Line, "preset %s: detune and spread go past -127 to 127 cents", name)
+	}
+	if t := p.Tremolo; t != nil && (t.Rate < 0 || t.Rate > 255 || t.Duty < 0 || t.Duty > 100) {
+		errs.add(p.Line, "preset %s: tremolo %s isn't a rate 0 to 255 and a duty 0 to 100", name, t)
+	}
+	if r := p.BendRange; r != nil && (*r < 1 || *r > config.MaxBendRange) {
+		errs.add(p.Line, "preset %s: bend-range %d isn't 1 to %d", name, *r, config.MaxBendRange)
+	}
+}
+
+func validDevice(errs *errorList, line int, name string, device byte) {
+	if device == config.SystemAddress {
+		errs.add(line, "%s: device 0x00 is the system address, not a device", name)
+	}
+}
+
+// Load reads the mapping file at path: see Parse. Its errors name the
+// file.
+func Load(path string) (*Map, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := Parse(f)
+	if err != nil {
+		return nil, nameFile(err, path)
+	}
+	return m, nil
+}
+
+// nameFile sets File on each *Error in err.
+func nameFile(err error, path string) error {
+	var errs []error
+	if j, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = j.Unwrap()
+	} else {
+		errs = []error{err}
+	}
+	for _, e := range errs {
+		var me *Error
+		if errors.As(e, &me) {
+			me.File = path
+		}
+	}
+	return err
+}
+
+// Parse reads a mapping and validates it. Its error lists every problem
+// found, each an *Error with the line it is on.
+func Parse(r io.Reader) (*Map, error) {
+	root, err := parseTree(r)
+	if err != nil {
+		return nil, err
+	}
+	m := &Map{Percussion: Percussion{Channel: 9}}
+	var errs errorList
+	var defaults Channel
+	if n := root.child("defaults"); n != nil {
+		defaults = parseDefaults(&errs, n, m)
+	}
+	for _, n := range root.kids {
+		if n.value != "" {
+			errs.add(n.line, "%s has a value: put its settings on the lines under it", n.key)
+			continue
+		}
+		switch n.key {
+		case "defaults":
+		case "channels":
+			for _, c := range n.kids {
+				ch, ok := parseNumber(&errs, c.line, "channel", c.key, 1, 16)
+				if ok {
+					m.Channels[ch-1] = parseChannel(&errs, c, defaults)
+				}
+			}
+		case "percussion":
+			m.Percussion = parsePercussion(&errs, n, defaults.Target.Device)
+		case "metronome":
+			m.Metronome = parseMetronome(&errs, n, defaults.Target.Device)
+		case "voices":
+			m.Voices = make(map[byte]int)
+			for _, k := range n.kids {
+				d, ok := parseDevice(&errs, k, k.key, 0)
+				v, vok := parseNumber(&errs, k.line, "voices", k.value, 1, 255)
+				if ok && vok {
+					m.Voices[d] = v
+				}
+			}
+		case "ranges":
+			m.Ranges = make(map[byte]Range)
+			for _, k := range n.kids {
+				d, ok := parseDevice(&errs, k, k.key, 0)
+				r, rok := parseRange(&errs, k)
+				if ok && rok {
+					m.Ranges[d] = r
+				}
+			}
+		case "offsets":
+			m.Offsets = make(map[byte]time.Duration)
+			for _, k := range n.kids {
+				d, ok := parseDevice(&errs, k, k.key, 0)
+				ms, mok := parseNumber(&errs, k.line, "offset", k.value, -int(MaxOffset/time.Millisecond), int(MaxOffset/time.Millisecond))
+				if ok && mok {
+					m.Offsets[d] = time.Duration(ms) * time.Millisecond
+				}
+			}
+		case "transports":
+			m.Transports = make(map[byte]Transport)
+			for _, k := range n.kids {
+				d, ok := parseDevice(&errs, k, k.key, 0)
+				t, err := ParseTransport(k.value)
+				if err != nil {
+					errs.add(k.line, "%v", err)
+				} else if ok {
+					m.Transports[d] = t
+				}
+			}
+		case "presets":
+			m.Presets = make(map[string]Preset)
+			for _, k := range n.kids {
+				if p, ok := parsePreset(&errs, k); ok {
+					m.Presets[k.key] = p
+				}
+			}
+		default:
+			errs.add(n.line, "unknown section %q: want defaults, channels, percussion, metronome, voices, ranges, offsets, transports or presets", n.key)
+		}
+	}
+	if len(errs) == 0 {
+		if err := m.Validate(); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	return nil, errs.err()
+}
+
+// parseDefaults reads the defaults section: the settings it returns for
+// each channel to start from, and m's Strategy.
+func parseDefaults(errs *errorList, n *node, m *Map) Channel {
+	var c Channel
+	for _, k := range n.kids {
+		switch k.key {
+		case "device":
+			if d, ok := parseNumber(errs, k.line, "device", k.value, 1, 255); ok {
+				c.Target.Device = byte(d)
+			}
+		case "transpose":
+			if t, ok := parseNumber(errs, k.line, "transpose", k.value, -127, 127); ok {
+				c.Transpose = t
+			}
+		case "min-velocity":
+			if v, ok := parseNumber(errs, k.line, "min-velocity", k.value, 0, 127); ok {
+				c.MinVelocity = byte(v)
+			}
+		case "max-notes", "min-length":
+			parseThinning(errs, k, &c)
+		case "quantise", "humanise":
+			parseTiming(errs, k, &c)
+		case "range":
+			if r, ok := parseRange(errs, k); ok {
+				c.Range = r
+			}
+		case "arrange":
+			s, err := ParseStrategy(k.value)
+			if err != nil {
+				errs.add(k.line, "%v", err)
+			}
+			m.Strategy = s
+		case "allocate":
+			s, err := ParseVoiceStrategy(k.value)
+			if err != nil {
+				errs.add(k.line, "%v", err)
+			}
+			m.Voicing = s
+		default:
+			errs.add(k.line, "unknown default %q: want device, transpose, min-velocity, max-notes, min-length, quantise, humanise, range, arrange or allocate", k.key)
+		}
+	}
+	return c
+}
+
+func parseChannel(errs *errorList, n *node, defaults Channel) Channel {
+	c := defaults
+	c.Target.Device, c.Line = 0, n.line
+	before := len(*errs)
+	if len(n.kids) == 0 {
+		if t, ok := parseTarget(errs, n, n.value, defaults.Target.Device); ok {
+			c.Target = t
+		}
+		return c
+	}
+	for _, k := range n.kids {
+		switch k.key {
+		case "target":
+			if t, ok := parseTarget(errs, k, k.value, defaults.Target.Device); ok {
+				c.Target = t
+			}
+		case "pool":
+			if p, ok := parsePool(errs, k, defaults.Target.Device); ok {
+				c.Pool = p
+			}
+		case "transpose":
+			if t, ok := parseNumber(errs, k.line, "transpose", k.value, -127, 127); ok {
+				c.Transpose = t
+			}
+		case "min-velocity":
+			if v, ok := parseNumber(errs, k.line, "min-velocity", k.value, 0, 127); ok {
+				c.MinVelocity = byte(v)
+			}
+		case "max-notes", "min-length":
+			parseThinning(errs, k, &c)
+		case "quantise", "humanise":
+			parseTiming(errs, k, &c)
+		case "range":
+			if r, ok := parseRange(errs, k); ok {
+				c.Range = r
+			}
+		case "stripe":
+			c.Stripe = nil
+			for _, member := range strings.Split(k.value, ",") {
+				if p, ok := parseStripe(errs, k, strings.TrimSpace(member), defaults.Target.Device); ok {
+					c.Stripe = append(c.Stripe, p)
+				}
+			}
+		case "balance":
+			b, err := ParseBalance(k.value)
+			if err != nil {
+				errs.add(k.line, "%v", err)
+			}
+			c.Balance = b
+		case "priority":
+			if p, ok := parseNumber(errs, k.line, "priority", k.value, 0, 127); ok {
+				c.Priority = p
+			}
+		case "ignore":
+			switch k.value {
+			case "true":
+				c.Ignore = true
+			case "false":
+			default:
+				errs.add(k.line, "ignore is %q: want true or false", k.value)
+			}
+		case "programs":
+			parsePrograms(errs, k, &c)
+		default:
+			errs.add(k.line, "unknown channel setting %q: want target, pool, stripe, balance, transpose, min-velocity, max-notes, min-length, quantise, humanise, range, priority, programs or ignore", k.key)
+		}
+	}
+	if !c.Ignore && !c.Mapped() && len(*errs) == before {
+		errs.add(n.line, "channel %s has no target, pool or stripe", n.key)
+	}
+	return c
+}
+
+// parseThinning reads a channel's max-notes or min-length into c.
+func parseThinning(errs *errorList, k *node, c *Channel) {
+	switch k.key {
+	case "max-notes":
+		if n, ok := parseNumber(errs, k.line, "max-notes", k.value, 0, 127); ok {
+			c.MaxNotes = n
+		}
+	case "min-length":
+		d, err := time.ParseDuration(k.value)
+		if err != nil || d < 0 {
+			errs.add(k.line, "min-length is %q: want a duration such as 30ms", k.value)
+			return
+		}
+		c.MinLength = d
+	}
+}
+
+// parseTiming reads a channel's quantise, as "1/16" or "1/16 75%", or
+// its humanise into c.
+func parseTiming(errs *errorList, k *node, c *Channel) {
+	switch k.key {
+	case "quantise":
+		grid, strength, _ := strings.Cut(k.value, " ")
+		q := Quantise{Strength: 100}
+		n, gok := strings.CutPrefix(grid, "1/")
+		g, err := strconv.Atoi(n)
+		if !gok || err != nil || g < 1 || g > MaxGrid {
+			errs.add(k.line, "quantise is %q: want a grid from 1/1 to 1/%d, as 1/16, and a strength, as 75%%", k.value, MaxGrid)
+			return
+		}
+		q.Grid = g
+		if strength = strings.TrimSpace(strength); strength != "" {
+			pct, ok := strings.CutSuffix(strength, "%")
+			if !ok {
+				errs.add(k.line, "quantise strength is %q: want a percentage, as 75%%", strength)
+				return
+			}
+			p, ok := parseNumber(errs, k.line, "quantise strength", pct, 1, 100)
+			if !ok {
+				return
+			}
+			q.Strength = p
+		}
+		c.Quantise = q
+	case "humanise":
+		d, err := time.ParseDuration(k.value)
+		if err != nil || d < 0 || d > MaxHumanise {
+			errs.add(k.line, "humanise is %q: want a duration up to %v, as 8ms", k.value, MaxHumanise)
+			return
+		}
+		c.Humanise = d
+	}
+}
+
+// parsePrograms reads a channel's programs: a preset name for each program
+// number, and for default.
+func parsePrograms(errs *errorList, n *node, c *Channel) {
+	if len(n.kids) == 0 {
+		errs.add(n.line, "programs: put a preset for each program on the lines under it")
+		return
+	}
+	c.Programs = make(map[byte]string)
+	for _, k := range n.kids {
+		if k.value == "" {
+			errs.add(k.line, "program %s has no preset", k.key)
+			continue
+		}
+		if k.key == "default" {
+			c.DefaultPreset = k.value
+			continue
+		}
+		if prog, ok := parseNumber(errs, k.line, "program", k.key, 0, 127); ok {
+			c.Programs[byte(prog)] = k.value
+		}
+	}
+}
+
+// parsePreset reads one preset of the presets section.
+func parsePreset(errs *errorList, n *node) (Preset, bool) {
+	if len(n.kids) == 0 {
+		errs.add(n.line, "preset %s has no settings: put them on the lines under it", n.key)
+		return Preset{}, false
+	}
+	p := Preset{Line: n.line}
+	before := len(*errs)
+	for _, k := range n.kids {
+		switch k.key {
+		case "transpose":
+			if t, ok := parseNumber(errs, k.line, "transpose", k.value, -127, 127); ok {
+				p.Transpose = &t
+			}
+		case "detune":
+			if d, ok := parseNumber(errs, k.line, "detune", k.value, -127, 127); ok {
+				p.Detune = &d
+			}
+		case "spread":
+			if s, ok := parseNumber(errs, k.line, "spread", k.value, 0, 254); ok {
+				p.Spread = s
+			}
+		case "head":
+			var clamp bool
+			switch k.value {
+			case "full":
+			case "clamp":
+				clamp = true
+			default:
+				errs.add(k.line, "head is %q: want full or clamp", k.value)
+				continue
+			}
+			p.Clamp = &clamp
+		case "tremolo":
+			var t Tremolo
+			if k.value != "off" {
+				rate, duty, ok := strings.Cut(k.value, "/")
+				r, rerr := strconv.ParseUint(rate, 10, 8)
+				d, derr := strconv.ParseUint(duty, 10, 8)
+				if !ok || rerr != nil || derr != nil || d > 100 {
+					errs.add(k.line, "tremolo %q: want rate/duty, as 12/60, or off", k.value)
+					continue
+				}
+				t = Tremolo{int(r), int(d)}
+			}
+			p.Tremolo = &t
+		case "bend-range":
+			if r, ok := parseNumber(errs, k.line, "bend-range", k.value, 1, config.MaxBendRange); ok {
+				p.BendRange = &r
+			}
+		default:
+			errs.add(k.line, "unknown preset setting %q: want transpose, detune, spread, head, tremolo or bend-range", k.key)
+		}
+	}
+	return p, len(*errs) == before
+}
+
+func parsePercussion(errs *errorList, n *node, device byte) Percussion {
+	p := Percussion{Channel: 9, Line: n.line}
+	for _, k := range n.kids {
+		switch k.key {
+		case "channel":
+			if ch, ok := parseNumber(errs, k.line, "channel", k.value, 1, 16); ok {
+				p.Channel = byte(ch - 1)
+			}
+		case "kit":
+			p.Kit = make(map[Drum]Target)
+			if k.value != "" {
+				if d, ok := parseDevice(errs, k, k.value, device); ok {
+					p.Kit = DefaultKit(d)
+				}
+			}
+			for _, d := range k.kids {
+				drum, ok := parseDrum(d.key)
+				if !ok {
+					errs.add(d.line, "unknown drum %q: want kick, snare, hihat, tom, cymbal or other", d.key)
+					continue
+				}
+				if t, ok := parseTarget(errs, d, d.value, device); ok {
+					p.Kit[drum] = t
+				}
+			}
+		case "notes":
+			p.Hits = make(map[byte]Hit)
+			for _, h := range k.kids {
+				note, ok := parseNumber(errs, h.line, "percussion note", h.key, 0, 127)
+				if !ok {
+					continue
+				}
+				if hit, ok := parseHit(errs, h, "percussion note "+h.key, device); ok {
+					p.Hits[byte(note)] = hit
+				}
+			}
+		default:
+			errs.add(k.line, "unknown percussion setting %q: want channel, kit or notes", k.key)
+		}
+	}
+	return p
+}
+
+func parseMetronome(errs *errorList, n *node, device byte) Metronome {
+	m := Metronome{Line: n.line}
+	for _, k := range n.kids {
+		var c *Click
+		switch k.key {
+		case "click":
+			c = &m.Click
+		case "accent":
+			c = &m.Accent
+		default:
+			errs.add(k.line, "unknown metronome setting %q: want click or accent", k.key)
+			continue
+		}
+		if click, ok := parseClick(errs, k, device); ok {
+			*c = click
+		}
+	}
+	return m
+}
+
+// parseClick reads "channel C note N", or a hit as parseHit does.
+func parseClick(errs *errorList, n *node, device byte) (Click, bool) {
+	fields := strings.Fields(n.value)
+	if len(fields) == 0 || fields[0] != "channel" {
+		h, ok := parseHit(errs, n, "metronome "+n.key, device)
+		return Click{Hit: h}, ok
+	}
+	if len(fields) != 4 || fields[2] != "note" {
+		errs.add(n.line, "metronome %s: want \"channel C note N\", got %q", n.key, n.value)
+		return Click{}, false
+	}
+	ch, ok := parseNumber(errs, n.line, "metronome channel", fields[1], 1, 16)
+	note, nok := parseNumber(errs, n.line, "metronome note", fields[3], 0, 127)
+	if !ok || !nok {
+		return Click{}, false
+	}
+	return Click{Hit: Hit{Note: byte(note), Line: n.line}, Channel: byte(ch)}, true
+}
+
+// parseHit reads "target reset" or "target note N", for what; a target
+// alone resets.
+func parseHit(errs *errorList, n *node, what string, device byte) (Hit, bool) {
+	fields := strings.Fields(n.value)
+	if len(fields) == 0 {
+		errs.add(n.line, "%s has no target", what)
+		return Hit{}, false
+	}
+	t, ok := parseTarget(errs, n, fields[0], device)
+	if !ok {
+		return Hit{}, false
+	}
+	h := Hit{Target: t, Reset: true, Line: n.line}
+	switch {
+	case len(fields) == 1 || len(fields) == 2 && fields[1] == "reset":
+	case len(fields) == 3 && fields[1] == "note":
+		v, err := strconv.ParseInt(fields[2], 0, 16)
+		if err != nil || v < 0 || v > 127 {
+			errs.add(n.line, "%s plays %q, which isn't a MIDI note", what, fields[2])
+			return Hit{}, false
+		}
+		h.Reset, h.Note = false, byte(v)
+	default:
+		errs.add(n.line, "%s: want \"device/sub reset\" or \"device/sub note N\", got %q", what, n.value)
+		return Hit{}, false
+	}
+	return h, true
+}
+
+// parseTarget reads "device/sub", or "sub" on the default device.
+func parseTarget(errs *errorList, n *node, s string, device byte) (Target, bool) {
+	if s == "" {
+		errs.add(n.line, "%s: want a target, as 0x01/3", n.key)
+		return Target{}, false
+	}
+	dev, sub, hasDev := strings.Cut(s, "/")
+	if !hasDev {
+		dev, sub = "", s
+	}
+	d, ok := parseDevice(errs, n, dev, device)
+	if !ok {
+		return Target{}, false
+	}
+	v, err := strconv.ParseInt(sub, 0, 16)
+	if err != nil || v < 0 || v > 255 {
+		errs.add(n.line, "target %q: want device/sub, as 0x01/3", s)
+		return Target{}, false
+	}
+	return Target{d, byte(v)}, true
+}
+
+// parsePool reads "device/first-last", or "first-last" on the default
+// device.
+func parsePool(errs *errorList, n *node, device byte) (Pool, bool) {
+	dev, drives, hasDev := strings.Cut(n.value, "/")
+	if !hasDev {
+		dev, drives = "", n.value
+	}
+	d, ok := parseDevice(errs, n, dev, device)
+	if !ok {
+		return Pool{}, false
+	}
+	first, last, ok := strings.Cut(drives, "-")
+	f, ferr := strconv.ParseUint(first, 0, 8)
+	l, lerr := strconv.ParseUint(last, 0, 8)
+	if !ok || ferr != nil || lerr != nil {
+		errs.add(n.line, "pool %q: want device/first-last, as 0x01/1-4", n.value)
+		return Pool{}, false
+	}
+	return Pool{d, byte(f), byte(l)}, true
+}
+
+// parseStripe reads one pool of a stripe: "device/first-last" or
+// "device/sub", either without the device for one on the default device.
+func parseStripe(errs *errorList, n *node, s string, device byte) (Pool, bool) {
+	dev, drives, hasDev := strings.Cut(s, "/")
+	if !hasDev {
+		dev, drives = "", s
+	}
+	d, ok := parseDevice(errs, n, dev, device)
+	if !ok {
+		return Pool{}, false
+	}
+	first, last, isPool := strings.Cut(drives, "-")
+	if !isPool {
+		last = first
+	}
+	f, ferr := strconv.ParseUint(first, 0, 8)
+	l, lerr := strconv.ParseUint(last, 0, 8)
+	if ferr != nil || lerr != nil {
+		errs.add(n.line, "stripe %q: want pools and drives, as 0x01/1-8, 0x02/3", s)
+		return Pool{}, false
+	}
+	return Pool{d, byte(f), byte(l)}, true
+}
+
+// parseRange reads "low-high", two MIDI notes.
+func parseRange(errs *errorList, n *node) (Range, bool) {
+	low, high, ok := strings.Cut(n.value, "-")
+	l, lerr := strconv.ParseUint(strings.TrimSpace(low), 0, 8)
+	h, herr := strconv.ParseUint(strings.TrimSpace(high), 0, 8)
+	if !ok || lerr != nil || herr != nil || l > h || h > 127 {
+		errs.add(n.line, "range %q: want low-high, two MIDI notes, as 24-71", n.value)
+		return Range{}, false
+	}
+	return Range{byte(l), byte(h)}, true
+}
+
+func parseDevice(errs *errorList, n *node, s string, device byte) (byte, bool) {
+	if s == "" {
+		if device == 0 {
+			errs.add(n.line, "%s: no device; write device/sub, or set defaults.device", n.key)
+			return 0, false
+		}
+		return device, true
+	}
+	v, err := strconv.ParseInt(s, 0, 16)
+	if err != nil || v < 1 || v > 255 {
+		errs.add(n.line, "device %q isn't 1 to 255", s)
+		return 0, false
+	}
+	return byte(v), true
+}
+
+// parseNumber reads s as a number from lo to hi.
+func parseNumber(errs *errorList, line int, what, s string, lo, hi int) (int, bool) {
+	v, err := strconv.ParseInt(s, 0, 16)
+	if err != nil || int(v) < lo || int(v) > hi {
+		errs.add(line, "%s %q isn't %d to %d", what, s, lo, hi)
+		return 0, false
+	}
+	return int(v), true
+}
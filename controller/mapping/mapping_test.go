@@ -0,0 +1,377 @@
+package mapping
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const full = `# a rig of two devices
+defaults:
+  device: 0x01
+  min-velocity: 5
+  arrange: fold
+  allocate: outer
+
+channels:
+  1: 1                  # drive 1 of the default device
+  2: 0x01/0x11
+  3:
+    pool: 0x02/1-4
+    transpose: -12
+    min-velocity: 20
+    max-notes: 2
+    min-length: 30ms
+    range: 36-71
+    quantise: 1/16 75%
+    humanise: 8ms
+  4:
+    target: "2/8"
+    transpose: 7
+    priority: 2
+  5:
+    ignore: true
+  6:
+    stripe: 1-4, 0x02/5-8, 0x03/1
+    balance: least-busy
+    programs:
+      0: clean
+      30: growl
+      default: clean
+percussion:
+  channel: 10
+  notes:
+    36: 0x01/8 reset
+    38: 7 note 40
+    42: '0x02/5'
+metronome:
+  click: 0x02/6 note 96
+  accent: channel 3 note 84
+voices:
+  0x02: 3
+ranges:
+  0x03: 48-71
+offsets:
+  0x02: 12
+  0x03: -5
+presets:
+  clean:
+    transpose: 0
+    head: full
+    tremolo: off
+  growl:
+    transpose: -12
+    detune: 3
+    spread: 20
+    head: clamp
+    tremolo: 12/60
+    bend-range: 12
+transports:
+  0x02: udp
+  0x03: serial
+`
+
+// withoutLines clears m's Line fields, which Encode doesn't keep.
+func withoutLines(m *Map) *Map {
+	c := *m
+	for i := range c.Channels {
+		c.Channels[i].Line = 0
+	}
+	c.Percussion.Line = 0
+	c.Metronome.Line, c.Metronome.Click.Line, c.Metronome.Accent.Line = 0, 0, 0
+	c.Percussion.Hits = make(map[byte]Hit)
+	for n, h := range m.Percussion.Hits {
+		h.Line = 0
+		c.Percussion.Hits[n] = h
+	}
+	if m.Presets != nil {
+		c.Presets = make(map[string]Preset)
+		for name, p := range m.Presets {
+			p.Line = 0
+			c.Presets[name] = p
+		}
+	}
+	return &c
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func TestParse(t *testing.T) {
+	m, err := Parse(strings.NewReader(full))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Map{Strategy: StrategyFold, Voicing: VoicesOuter, Voices: map[byte]int{2: 3}, Ranges: map[byte]Range{3: {48, 71}}, Percussion: Percussion{Channel: 9, Line: 33, Hits: map[byte]Hit{
+		36: {Target: Target{1, 8}, Reset: true, Line: 36},
+		38: {Target: Target{1, 7}, Note: 40, Line: 37},
+		42: {Target: Target{2, 5}, Reset: true, Line: 38},
+	}}}
+	want.Metronome = Metronome{
+		Click:  Click{Hit: Hit{Target: Target{2, 6}, Note: 96, Line: 40}},
+		Accent: Click{Hit: Hit{Note: 84, Line: 41}, Channel: 3},
+		Line:   39,
+	}
+	want.Offsets = map[byte]time.Duration{2: 12 * time.Millisecond, 3: -5 * time.Millisecond}
+	want.Transports = map[byte]Transport{2: TransportUDP, 3: TransportSerial}
+	want.Channels[0] = Channel{Target: Target{1, 1}, MinVelocity: 5, Line: 9}
+	want.Channels[1] = Channel{Target: Target{1, 0x11}, MinVelocity: 5, Line: 10}
+	want.Channels[2] = Channel{Pool: Pool{2, 1, 4}, Transpose: -12, MinVelocity: 20, MaxNotes: 2, MinLength: 30 * time.Millisecond, Quantise: Quantise{16, 75}, Humanise: 8 * time.Millisecond, Range: Range{36, 71}, Line: 11}
+	want.Channels[3] = Channel{Target: Target{2, 8}, Transpose: 7, MinVelocity: 5, Priority: 2, Line: 20}
+	want.Channels[4] = Channel{Ignore: true, MinVelocity: 5, Line: 24}
+	want.Channels[5] = Channel{Stripe: []Pool{{1, 1, 4}, {2, 5, 8}, {3, 1, 1}}, Balance: BalanceLeastBusy, MinVelocity: 5,
+		Programs: map[byte]string{0: "clean", 30: "growl"}, DefaultPreset: "clean", Line: 26}
+	want.Presets = map[string]Preset{
+		"clean": {Transpose: ptr(0), Clamp: ptr(false), Tremolo: &Tremolo{}, Line: 50},
+		"growl": {Transpose: ptr(-12), Detune: ptr(3), Spread: 20, Clamp: ptr(true), Tremolo: &Tremolo{12, 60}, BendRange: ptr(12), Line: 54},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("got\n%+v\nwant\n%+v", m, want)
+	}
+	if got := m.Devices(); !reflect.DeepEqual(got, []byte{1, 2, 3}) {
+		t.Errorf("devices %v, want [1 2 3]", got)
+	}
+	if !m.Drums(9) || m.Drums(0) {
+		t.Error("channel 10 should be the only drum channel")
+	}
+}
+
+// TestPreset picks a channel's preset for each program, and detunes a
+// pool's drives over the spread.
+func TestPreset(t *testing.T) {
+	m, err := Parse(strings.NewReader(full))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		channel, program byte
+		want             string
+	}{
+		{5, 30, "growl"},
+		{5, 0, "clean"},
+		{5, 99, "clean"}, // the channel's default
+		{0, 30, ""},      // no programs, and no preset named default
+	} {
+		p, ok := m.Preset(tt.channel, tt.program)
+		if want, wok := m.Presets[tt.want]; ok != wok || !reflect.DeepEqual(p, want) {
+			t.Errorf("channel %d, program %d: %+v, %v; want %s", tt.channel+1, tt.program, p, ok, tt.want)
+		}
+	}
+	m.Presets["default"] = m.Presets["clean"]
+	if _, ok := m.Preset(0, 30); !ok {
+		t.Error("a channel without programs doesn't fall back to the preset named default")
+	}
+
+	if cents, _ := m.Presets["growl"].Detunes(5); !reflect.DeepEqual(cents, []int{-7, -2, 3, 8, 13}) {
+		t.Errorf("detunes %v, want 20 cents around 3", cents)
+	}
+	if cents, _ := m.Presets["growl"].Detunes(1); !reflect.DeepEqual(cents, []int{3}) {
+		t.Errorf("one drive detuned %v, want 3", cents)
+	}
+	if _, ok := m.Presets["clean"].Detunes(4); ok {
+		t.Error("clean detunes")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	maps := map[string]*Map{"channels": Channels(0x03, 2, 5)}
+	m, err := Parse(strings.NewReader(full))
+	if err != nil {
+		t.Fatal(err)
+	}
+	maps["full"] = m
+	for name, m := range maps {
+		t.Run(name, func(t *testing.T) {
+			var b strings.Builder
+			if err := m.Encode(&b); err != nil {
+				t.Fatal(err)
+			}
+			back, err := Parse(strings.NewReader(b.String()))
+			if err != nil {
+				t.Fatalf("%v reading back\n%s", err, b.String())
+			}
+			if !reflect.DeepEqual(withoutLines(back), withoutLines(m)) {
+				t.Errorf("read back\n%+v\nwant\n%+v\nfrom\n%s", back, m, b.String())
+			}
+			var again strings.Builder
+			back.Encode(&again)
+			if again.String() != b.String() {
+				t.Errorf("encoded again as\n%s\nwant\n%s", again.String(), b.String())
+			}
+		})
+	}
+}
+
+// TestKit routes drums by General MIDI group, a note's own hit going
+// first.
+func TestKit(t *testing.T) {
+	m, err := Parse(strings.NewReader(`percussion:
+  kit:
+    kick: 0x05/1
+    hihat: 0x06/1
+  notes:
+    42: 0x01/1 note 84
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		note byte
+		want Hit
+		ok   bool
+	}{
+		{35, Hit{Target: Target{5, 1}, Note: 35}, true},
+		{36, Hit{Target: Target{5, 1}, Note: 36}, true},
+		{46, Hit{Target: Target{6, 1}, Note: 46}, true},
+		{42, Hit{Target: Target{1, 1}, Note: 84, Line: 6}, true},
+		{38, Hit{}, false}, // no snare in the kit
+		{20, Hit{}, false}, // not a GM drum
+	}
+	for _, tt := range tests {
+		if h, ok := m.Percussion.Hit(tt.note); h != tt.want || ok != tt.ok {
+			t.Errorf("note %d: %+v, %v; want %+v, %v", tt.note, h, ok, tt.want, tt.ok)
+		}
+	}
+	if got := m.Devices(); !reflect.DeepEqual(got, []byte{1, 5, 6}) {
+		t.Errorf("devices %v, want [1 5 6]", got)
+	}
+	if !m.Drums(9) {
+		t.Error("channel 10 isn't drums")
+	}
+
+	m, err = Parse(strings.NewReader("percussion:\n  kit: 0x07\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.Percussion.Kit, DefaultKit(7)) || m.Percussion.Kit[DrumCymbal] != (Target{7, 5}) {
+		t.Errorf("kit: 0x07 is %v", m.Percussion.Kit)
+	}
+	var b strings.Builder
+	m.Encode(&b)
+	if back, err := Parse(strings.NewReader(b.String())); err != nil || !reflect.DeepEqual(back.Percussion.Kit, m.Percussion.Kit) {
+		t.Errorf("read back %v, %v from\n%s", back, err, b.String())
+	}
+}
+
+func TestValidation(t *testing.T) {
+	tests := []struct {
+		name, file string
+		want       []string // each error, in order
+	}{
+		{"unknown section", "channel:\n  1: 1/1\n", []string{`line 1: unknown section "channel"`}},
+		{"channel range", "channels:\n  1: 1/1\n  17: 1/2\n", []string{`line 3: channel "17" isn't 1 to 16`}},
+		{"no device", "channels:\n  1: 3\n", []string{"line 2: 1: no device"}},
+		{"system device", "channels:\n  1: 0/1\n", []string{`line 2: device "0" isn't 1 to 255`}},
+		{"bad target", "channels:\n  1: 1/one\n", []string{`line 2: target "1/one"`}},
+		{"no target", "channels:\n  2:\n    transpose: 3\n", []string{"line 2: channel 2 has no target, pool or stripe"}},
+		{"bad pool", "channels:\n  1:\n    pool: 1/4-2\n", []string{"line 2: channel 1: pool drives 4-2"}},
+		{"both", "channels:\n  1:\n    target: 1/1\n    pool: 1/2-3\n", []string{"line 2: channel 1 has both a target and a pool"}},
+		{"bad transpose", "channels:\n  1:\n    target: 1/1\n    transpose: 200\n", []string{`line 4: transpose "200" isn't -127 to 127`}},
+		{"bad ignore", "channels:\n  1:\n    ignore: yes\n", []string{`line 3: ignore is "yes"`}},
+		{"bad range", "channels:\n  1:\n    target: 1/1\n    range: 71-24\n", []string{`line 4: range "71-24": want low-high`}},
+		{"bad max-notes", "channels:\n  1:\n    target: 1/1\n    max-notes: 200\n", []string{`line 4: max-notes "200" isn't 0 to 127`}},
+		{"bad min-length", "defaults:\n  min-length: 30\nchannels:\n  1: 1/1\n", []string{`line 2: min-length is "30": want a duration`}},
+		{"bad arrange", "defaults:\n  arrange: squash\n", []string{`line 2: unknown strategy "squash"`}},
+		{"bad allocate", "defaults:\n  allocate: loudest\n", []string{`line 2: unknown voice strategy "loudest"`}},
+		{"bad stripe", "channels:\n  1:\n    stripe: 1/1-4, 2/x\n", []string{`line 3: stripe "2/x"`}},
+		{"stripe and pool", "channels:\n  1:\n    stripe: 1/1-4\n    pool: 2/1-4\n", []string{"line 2: channel 1 has a stripe and a target or pool"}},
+		{"bad balance", "channels:\n  1:\n    stripe: 1/1-4\n    balance: random\n", []string{`line 4: unknown balance "random"`}},
+		{"bad ranges", "ranges:\n  1: 71-24\n", []string{`line 2: range "71-24"`}},
+		{"bad priority", "channels:\n  1:\n    target: 1/1\n    priority: 200\n", []string{`line 4: priority "200" isn't 0 to 127`}},
+		{"bad voices", "voices:\n  0x01: 0\n  0: 2\n", []string{`line 2: voices "0" isn't 1 to 255`, `line 3: device "0" isn't 1 to 255`}},
+		{"bad offsets", "offsets:\n  0x01: 1001\n  0x02: 12ms\n", []string{`line 2: offset "1001" isn't -1000 to 1000`, `line 3: offset "12ms" isn't -1000 to 1000`}},
+		{"bad quantise", "channels:\n  1:\n    target: 1/1\n    quantise: 1/0\n  2:\n    target: 1/2\n    quantise: 1/16 120%\n  3:\n    target: 1/3\n    quantise: 1/8 half\n", []string{
+			`line 4: quantise is "1/0"`,
+			`line 7: quantise strength "120" isn't 1 to 100`,
+			`line 10: quantise strength is "half"`,
+		}},
+		{"bad humanise", "defaults:\n  humanise: 1s\n", []string{`line 2: humanise is "1s": want a duration up to 100ms`}},
+		{"bad transports", "transports:\n  0x01: bluetooth\n  0: udp\n", []string{`line 2: unknown transport "bluetooth"`, `line 3: device "0" isn't 1 to 255`}},
+		{"unknown preset", "channels:\n  1:\n    target: 1/1\n    programs:\n      3: lead\n      default: pad\n", []string{
+			`line 2: channel 1: program 3 is preset "lead", which isn't in presets`,
+			`line 2: channel 1: default preset "pad" isn't in presets`,
+		}},
+		{"bad program", "channels:\n  1:\n    target: 1/1\n    programs:\n      128: lead\npresets:\n  lead:\n    transpose: 1\n", []string{`line 5: program "128" isn't 0 to 127`}},
+		{"bad preset", "presets:\n  lead:\n    head: wobble\n    tremolo: 12\n    bend-range: 30\n    volume: 3\n  pad:\n", []string{
+			`line 3: head is "wobble": want full or clamp`,
+			`line 4: tremolo "12": want rate/duty`,
+			`line 5: bend-range "30" isn't 1 to 24`,
+			`line 6: unknown preset setting "volume"`,
+			`line 7: preset pad has no settings`,
+		}},
+		{"detune past", "presets:\n  lead:\n    detune: 120\n    spread: 20\n", []string{"line 2: preset lead: detune and spread go past -127 to 127 cents"}},
+		{"unknown setting", "channels:\n  1:\n    target: 1/1\n    volume: 3\n", []string{`line 4: unknown channel setting "volume"`}},
+		{"twice", "channels:\n  1: 1/1\n  1: 1/2\n", []string{`line 3: "1" given twice; the first is on line 2`}},
+		{"indent", "channels:\n    1: 1/1\n  2: 1/2\n", []string{`line 3: "2" is indented 2 spaces, unlike the 4`}},
+		{"under a value", "channels:\n  1: 1/1\n   2: 1/2\n", []string{`line 3: "2" is indented under "1", which has a value`}},
+		{"tab", "channels:\n\t1: 1/1\n", []string{"line 2: indented with a tab"}},
+		{"nested value", "channels: 1\n  1: 1/1\n", []string{`line 2: "1" is indented under "channels", which has a value`}},
+		{"list", "channels:\n  - 1/1\n", []string{"line 2: lists aren't read"}},
+		{"drum channel mapped", "channels:\n  10: 1/1\npercussion:\n  notes:\n    36: 1/2\n", []string{"line 2: channel 10 is the percussion channel"}},
+		{"bad hit", "percussion:\n  notes:\n    36: 1/2 bang\n", []string{`line 3: percussion note 36: want "device/sub reset" or "device/sub note N"`}},
+		{"bad drum", "percussion:\n  kit:\n    cowbell: 1/1\n", []string{`line 3: unknown drum "cowbell"`}},
+		{"bad hit note", "percussion:\n  notes:\n    36: 1/2 note 130\n", []string{`line 3: percussion note 36 plays "130"`}},
+		{"bad click", "metronome:\n  click: 1/2 bang\n  beat: 1/3\n", []string{
+			`line 2: metronome click: want "device/sub reset" or "device/sub note N"`,
+			`line 3: unknown metronome setting "beat"`,
+		}},
+		{"bad click channel", "metronome:\n  click: channel 17 note 80\n  accent: channel 1\n", []string{
+			`line 2: metronome channel "17" isn't 1 to 16`,
+			`line 3: metronome accent: want "channel C note N"`,
+		}},
+		{"click unmapped", "channels:\n  1: 1/1\nmetronome:\n  click: channel 2 note 80\n", []string{"line 4: metronome click: channel 2 isn't mapped"}},
+		{"accent alone", "metronome:\n  accent: 1/2 note 90\n", []string{"line 1: metronome has an accent but no click"}},
+		{"several", "defaults:\n  device: 300\nchannels:\n  0: 1/1\n  2:\n    min-velocity: -1\n", []string{
+			`line 2: device "300" isn't 1 to 255`,
+			`line 4: channel "0" isn't 1 to 16`,
+			`line 6: min-velocity "-1" isn't 0 to 127`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.file))
+			if err == nil {
+				t.Fatal("no error")
+			}
+			got := strings.Split(err.Error(), "\n")
+			if len(got) != len(tt.want) {
+				t.Fatalf("got errors\n%v\nwant %d", err, len(tt.want))
+			}
+			for i, w := range tt.want {
+				if !strings.HasPrefix(got[i], w) {
+					t.Errorf("error %d is %q, want it to start %q", i, got[i], w)
+				}
+			}
+			var me *Error
+			if !errors.As(err, &me) || me.Line == 0 {
+				t.Errorf("%v isn't an *Error with a line", err)
+			}
+		})
+	}
+}
+
+func TestValidateBuilt(t *testing.T) {
+	m := Channels(0x01, 1, 2)
+	m.Channels[5] = Channel{Target: Target{0, 3}}
+	err := m.Validate()
+	if err == nil || err.Error() != "channel 6: device 0x00 is the system address, not a device" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rig.yaml")
+	if err := os.WriteFile(path, []byte("channels:\n  1: 1/1\n  2: 4\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Load(path)
+	if want := path + ":3: 2: no device; write device/sub, or set defaults.device"; err == nil || err.Error() != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "none.yaml")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v for a missing file", err)
+	}
+}
@@ -0,0 +1,120 @@
+package mapping
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// node is a line of a mapping file, "key: value", with the lines indented
+// under it.
+type node struct {
+	key    string
+	value  string // unquoted; "" if the key has lines under it instead
+	line   int
+	indent int
+	kids   []*node
+}
+
+func (n *node) child(key string) *node {
+	for _, k := range n.kids {
+		if k.key == key {
+			return k
+		}
+	}
+	return nil
+}
+
+// parseTree reads the subset of YAML a mapping is written in: maps nested
+// by indenting with spaces, scalar values, and comments.
+func parseTree(r io.Reader) (*node, error) {
+	root := &node{indent: -1}
+	stack := []*node{root}
+	var errs errorList
+	lines := bufio.NewScanner(r)
+	for n := 1; lines.Scan(); n++ {
+		text := stripComment(lines.Text())
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		body := strings.TrimLeft(text, " ")
+		indent := len(text) - len(body)
+		if strings.HasPrefix(body, "\t") {
+			errs.add(n, "indented with a tab: indent with spaces")
+			continue
+		}
+		if strings.HasPrefix(body, "- ") || body == "-" {
+			errs.add(n, "lists aren't read: write a map")
+			continue
+		}
+		key, value, ok := strings.Cut(body, ":")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" {
+			errs.add(n, "want key: value, got %q", strings.TrimSpace(body))
+			continue
+		}
+		for indent <= stack[len(stack)-1].indent {
+			stack = stack[:len(stack)-1]
+		}
+		parent := stack[len(stack)-1]
+		if len(parent.kids) > 0 && indent != parent.kids[0].indent {
+			errs.add(n, "%q is indented %d spaces, unlike the %d of the keys beside it", key, indent, parent.kids[0].indent)
+			continue
+		}
+		if parent.value != "" {
+			errs.add(n, "%q is indented under %q, which has a value", key, parent.key)
+			continue
+		}
+		if parent.child(key) != nil {
+			errs.add(n, "%q given twice; the first is on line %d", key, parent.child(key).line)
+			continue
+		}
+		value, err := unquote(value)
+		if err != nil {
+			errs.add(n, "%v", err)
+			continue
+		}
+		k := &node{key: key, value: value, line: n, indent: indent}
+		parent.kids = append(parent.kids, k)
+		stack = append(stack, k)
+	}
+	if err := lines.Err(); err != nil {
+		return nil, err
+	}
+	return root, errs.err()
+}
+
+// stripComment cuts s at a # starting a comment: at the start of the line
+// or after a space, and outside quotes.
+func stripComment(s string) string {
+	var quote rune
+	for i, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+func unquote(s string) (string, error) {
+	switch {
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		u, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("bad quoted string %s", s)
+		}
+		return u, nil
+	case len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'':
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+	return s, nil
+}
@@ -0,0 +1,169 @@
+package controller
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+// MetronomeMode is what a Metronome clicks on as the song plays.
+type MetronomeMode int
+
+const (
+	MetronomeOff       MetronomeMode = iota // nothing: only the count-in clicks
+	MetronomeBeats                          // every beat
+	MetronomeDownbeats                      // the first beat of each bar
+)
+
+var metronomeModeNames = [...]string{"off", "beats", "downbeats"}
+
+func (m MetronomeMode) String() string {
+	if m < 0 || int(m) >= len(metronomeModeNames) {
+		return fmt.Sprintf("MetronomeMode(%d)", int(m))
+	}
+	return metronomeModeNames[m]
+}
+
+// ParseMetronomeMode returns the MetronomeMode named s: off, beats or
+// downbeats.
+func ParseMetronomeMode(s string) (MetronomeMode, error) {
+	if i := slices.Index(metronomeModeNames[:], s); i >= 0 {
+		return MetronomeMode(i), nil
+	}
+	return 0, fmt.Errorf("unknown metronome %q: want off, beats or downbeats", s)
+}
+
+// DefaultClickLength is how long a click is held if a Metronome doesn't
+// say.
+const DefaultClickLength = 30 * time.Millisecond
+
+// Metronome is the clicks Clicks adds to a song, for the mapping's
+// metronome to send where it says: see mapping.Metronome.
+type Metronome struct {
+	CountIn int           // beats clicked before the song starts
+	Mode    MetronomeMode // what is clicked as it plays
+	Length  time.Duration // how long each click is held; 0 for DefaultClickLength
+}
+
+// On reports whether m adds any clicks.
+func (m Metronome) On() bool { return m.CountIn > 0 || m.Mode != MetronomeOff }
+
+// beat is one of a song's beats, and whether it starts a bar.
+type beat struct {
+	at   time.Duration
+	down bool
+}
+
+// Clicks returns events with m's clicks added, each a Click and, Length
+// later or half way to the next click if that is sooner, its ClickOff.
+//
+// The count-in is CountIn beats at the song's starting tempo and time
+// signature, before its start, at offsets below 0: Play starts the song
+// once they have played. Counting back from the song's first beat, each
+// bar's first is accented. As the song plays, the clicks are on its
+// beats, or its downbeats, through its tempo changes and time
+// signatures, bars as BarTime has them; a beat is the time signature's
+// denominator, so 6/8 has six. Being events of the song, clicks are
+// scaled with it by SetTempo, and by anything that scales its offsets
+// before Clicks.
+func Clicks(events []Event, m Metronome) []Event {
+	var clicks []beat
+	if m.CountIn > 0 {
+		tempo, num, den := 500000.0, 4, 4
+		for _, ev := range events {
+			if ev.At > 0 {
+				break
+			}
+			switch {
+			case ev.Kind == Tempo && ev.Tempo > 0:
+				tempo = float64(ev.Tempo)
+			case ev.Kind == Meter && ev.Note > 0 && ev.Value > 0:
+				num, den = int(ev.Note), int(ev.Value)
+			}
+		}
+		length := tempo * 1000 * 4 / float64(den) // ns
+		for b := m.CountIn; b > 0; b-- {
+			clicks = append(clicks, beat{-time.Duration(float64(b)*length + 0.5), b%num == 0})
+		}
+	}
+	if m.Mode != MetronomeOff && len(events) > 0 {
+		for _, b := range beats(events, events[len(events)-1].At) {
+			if m.Mode == MetronomeBeats || b.down {
+				clicks = append(clicks, b)
+			}
+		}
+	}
+	if len(clicks) == 0 {
+		return events
+	}
+
+	hold := m.Length
+	if hold <= 0 {
+		hold = DefaultClickLength
+	}
+	out := slices.Grow(slices.Clone(events), 2*len(clicks))
+	for i, c := range clicks {
+		length := hold
+		if i+1 < len(clicks) {
+			length = min(length, (clicks[i+1].at-c.at)/2)
+		}
+		var accent byte
+		if c.down {
+			accent = 1
+		}
+		out = append(out, Event{At: c.at, Kind: Click, Value: accent}, Event{At: c.at + length, Kind: ClickOff})
+	}
+	// Stable, so a click comes after the song's events at its time.
+	slices.SortStableFunc(out, func(a, b Event) int {
+		return int(min(max(a.At-b.At, -1), 1))
+	})
+	return out
+}
+
+// beats returns the beats of a song before end, from its start, through
+// its tempo changes and time signatures: 4/4 at 120 BPM until it says
+// otherwise. As in BarTime, a time signature starts a new bar, and its
+// beats, where it is.
+func beats(events []Event, end time.Duration) []beat {
+	const eps = 1e-9
+	var (
+		at       time.Duration
+		quarters float64          // quarter notes to at
+		tempo    float64 = 500000 // µs per quarter note
+		barStart float64          // quarter notes to the bar's start
+		barLen   float64 = 4      // in quarter notes
+		beatLen  float64 = 1      // in quarter notes
+		next     float64          // quarter notes to the next beat
+		out      []beat
+	)
+	i := 0
+	for {
+		for ; i < len(events); i++ {
+			ev := events[i]
+			if ev.Kind != Tempo && ev.Kind != Meter {
+				continue
+			}
+			q := quarters + float64(ev.At-at)/1000/tempo
+			if q > next+eps {
+				break
+			}
+			at, quarters = ev.At, q
+			switch {
+			case ev.Kind == Tempo && ev.Tempo > 0:
+				tempo = float64(ev.Tempo)
+			case ev.Kind == Meter && ev.Note > 0 && ev.Value > 0:
+				barStart, next = q, q
+				barLen = float64(ev.Note) * 4 / float64(ev.Value)
+				beatLen = 4 / float64(ev.Value)
+			}
+		}
+		t := at + time.Duration((next-quarters)*tempo*1000+0.5)
+		if t >= end {
+			return out
+		}
+		bars := (next - barStart) / barLen
+		out = append(out, beat{t, math.Abs(bars-math.Round(bars))*barLen < eps})
+		next += beatLen
+	}
+}
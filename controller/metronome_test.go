@@ -0,0 +1,180 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// clickSong is two bars of 4/4, the first at 120 BPM and the second at
+// 60, then a bar of 6/8 at 60 BPM a quarter note, ending at 9s.
+var clickSong = []Event{
+	{Kind: Tempo, Tempo: 500000},
+	{Kind: Meter, Note: 4, Value: 4},
+	{Kind: NoteOn, Note: 60, Value: 100},
+	{At: 2 * time.Second, Kind: Tempo, Tempo: 1000000},
+	{At: 6 * time.Second, Kind: Meter, Note: 6, Value: 8},
+	{At: 9 * time.Second, Kind: NoteOff, Note: 60},
+}
+
+// clicksOf returns the clicks of events as "at" or "at!" for an accent,
+// in milliseconds, and checks each is released before the next.
+func clicksOf(t *testing.T, events []Event) string {
+	t.Helper()
+	var b strings.Builder
+	on := false
+	for _, ev := range events {
+		switch ev.Kind {
+		case Click:
+			if on {
+				t.Errorf("click at %v before the last is released", ev.At)
+			}
+			on = true
+			fmt.Fprintf(&b, " %d", ev.At.Milliseconds())
+			if ev.Value != 0 {
+				b.WriteString("!")
+			}
+		case ClickOff:
+			on = false
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// TestClicks counts in four beats at the song's starting tempo, each the
+// bar's first accented, then clicks the beats through the tempo change
+// and into the 6/8 bar, an eighth note a beat, stopping short of the
+// song's end. On downbeats, the clicks are where BarTime puts each bar.
+func TestClicks(t *testing.T) {
+	events := Clicks(clickSong, Metronome{CountIn: 4, Mode: MetronomeBeats})
+	want := "-2000! -1500 -1000 -500 0! 500 1000 1500 2000! 3000 4000 5000 6000! 6500 7000 7500 8000 8500"
+	if got := clicksOf(t, events); got != want {
+		t.Errorf("clicks\n got %s\nwant %s", got, want)
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].At < events[i-1].At {
+			t.Fatalf("event %d at %v, after one at %v", i, events[i].At, events[i-1].At)
+		}
+	}
+	if events[10].Kind != NoteOn || events[11].Kind != Click {
+		t.Errorf("at 0, %v then %v; want the song's note, then the click", events[10].Kind, events[11].Kind)
+	}
+	if off := events[1]; off.Kind != ClickOff || off.At != -2000*time.Millisecond+DefaultClickLength {
+		t.Errorf("the first click released by %+v, want %v after it", off, DefaultClickLength)
+	}
+
+	var bars []string
+	for bar := 1; bar <= 3; bar++ {
+		bars = append(bars, fmt.Sprintf("%d!", BarTime(clickSong, bar).Milliseconds()))
+	}
+	if got := clicksOf(t, Clicks(clickSong, Metronome{Mode: MetronomeDownbeats})); got != strings.Join(bars, " ") {
+		t.Errorf("downbeats %s, want the bars' starts %s", got, strings.Join(bars, " "))
+	}
+
+	// Two beats of 3/4 count in without an accent; long clicks are held
+	// half way to the next.
+	waltz := []Event{{Kind: Meter, Note: 3, Value: 4}, {At: time.Second, Kind: NoteOn, Note: 60}}
+	events = Clicks(waltz, Metronome{CountIn: 2, Length: time.Second})
+	if got := clicksOf(t, events); got != "-1000 -500" {
+		t.Errorf("3/4 count-in %s, want -1000 -500", got)
+	}
+	if events[1].At != -750*time.Millisecond {
+		t.Errorf("a long click released at %v, want half way to the next", events[1].At)
+	}
+	if got := Clicks(waltz, Metronome{}); len(got) != len(waltz) {
+		t.Errorf("no metronome added %d events", len(got)-len(waltz))
+	}
+}
+
+// TestCountIn plays a song counted in at double the tempo: the four
+// clicks go a quarter second apart, the song's first note after them,
+// and its clicks on the beats at its scaled tempo.
+func TestCountIn(t *testing.T) {
+	m := mapping.Channels(0x01, 1, 1)
+	m.Metronome = mapping.Metronome{
+		Click:  mapping.Click{Hit: mapping.Hit{Target: mapping.Target{Device: 0x02, Sub: 1}, Note: 90}},
+		Accent: mapping.Click{Hit: mapping.Hit{Target: mapping.Target{Device: 0x02, Sub: 1}, Note: 102}},
+	}
+	song := []Event{
+		{Kind: NoteOn, Note: 60, Value: 100},
+		{At: time.Second, Kind: NoteOff, Note: 60},
+	}
+	p, r := newRecorder(m)
+	p.SetTempo(200)
+	var positions []time.Duration
+	p.Progress = func(ev Event) { positions = append(positions, ev.At) }
+	if err := p.Play(context.Background(), Clicks(song, Metronome{CountIn: 4, Mode: MetronomeBeats})); err != nil {
+		t.Fatal(err)
+	}
+	want := []sentMessage{
+		{0, protocol.SequenceStart()},
+		{0, protocol.NoteOnVelocity(0x02, 1, 102, accentVelocity)},
+		{15 * time.Millisecond, protocol.NoteOff(0x02, 1, 102)},
+		{250 * time.Millisecond, protocol.NoteOnVelocity(0x02, 1, 90, clickVelocity)},
+		{265 * time.Millisecond, protocol.NoteOff(0x02, 1, 90)},
+		{500 * time.Millisecond, protocol.NoteOnVelocity(0x02, 1, 90, clickVelocity)},
+		{515 * time.Millisecond, protocol.NoteOff(0x02, 1, 90)},
+		{750 * time.Millisecond, protocol.NoteOnVelocity(0x02, 1, 90, clickVelocity)},
+		{765 * time.Millisecond, protocol.NoteOff(0x02, 1, 90)},
+		{time.Second, protocol.NoteOnVelocity(0x01, 1, 60, 100)},
+		{time.Second, protocol.NoteOnVelocity(0x02, 1, 102, accentVelocity)},
+		{1015 * time.Millisecond, protocol.NoteOff(0x02, 1, 102)},
+		{1250 * time.Millisecond, protocol.NoteOnVelocity(0x02, 1, 90, clickVelocity)},
+		{1265 * time.Millisecond, protocol.NoteOff(0x02, 1, 90)},
+		{1500 * time.Millisecond, protocol.NoteOff(0x01, 1, 60)},
+		{1500 * time.Millisecond, protocol.SequenceStop()},
+	}
+	if got, want := fmt.Sprint(r.sent), fmt.Sprint(want); got != want {
+		t.Errorf("sent\n%v\nwant\n%v", got, want)
+	}
+	if positions[0] != -2*time.Second {
+		t.Errorf("first position %v, want -2s, the count-in's start", positions[0])
+	}
+}
+
+// TestClickTargets sends clicks as a channel's notes: on a pool, the
+// drive free, at the channel's transpose but not the Player's, and unbent
+// from the channel's last note there; on the percussion channel, by its
+// hit. A click sounding drops the next.
+func TestClickTargets(t *testing.T) {
+	m := &mapping.Map{Percussion: mapping.Percussion{Channel: 9, Hits: map[byte]mapping.Hit{
+		37: {Target: mapping.Target{Device: 0x03, Sub: 2}, Reset: true},
+	}}}
+	m.Channels[2] = mapping.Channel{Pool: mapping.Pool{Device: 0x02, First: 1, Last: 2}, Transpose: -12}
+	m.Metronome = mapping.Metronome{
+		Click:  mapping.Click{Hit: mapping.Hit{Note: 84}, Channel: 3},
+		Accent: mapping.Click{Hit: mapping.Hit{Note: 37}, Channel: 10},
+	}
+	tr := newTranslator(m, BendOptions{})
+	tr.shift = 5
+	var got []protocol.Message
+	for _, ev := range []Event{
+		{Kind: NoteOn, Channel: 2, Note: 60, Value: 100},
+		{Kind: PitchBend, Channel: 2, Bend: 8192 + 1000},
+		{Kind: NoteOff, Channel: 2, Note: 60},
+		{Kind: Click},
+		{Kind: Click},
+		{Kind: NoteOn, Channel: 2, Note: 62, Value: 100},
+		{Kind: ClickOff},
+		{Kind: Click, Value: 1},
+		{Kind: ClickOff},
+	} {
+		got = append(got, tr.messages(ev)...)
+	}
+	checkSent(t, got, []protocol.Message{
+		protocol.NoteOnVelocity(0x02, 1, 53, 100),
+		protocol.PitchBend(0x02, 1, 1000),
+		protocol.NoteOff(0x02, 1, 53),
+		protocol.PitchBend(0x02, 1, 0),
+		protocol.NoteOnVelocity(0x02, 1, 72, clickVelocity),
+		protocol.PitchBend(0x02, 2, 1000),
+		protocol.NoteOnVelocity(0x02, 2, 55, 100),
+		protocol.NoteOff(0x02, 1, 72),
+		protocol.DriveReset(0x03, 2),
+	})
+}
@@ -0,0 +1,263 @@
+// Package mqtt connects a player to an MQTT broker, for home automation:
+// a doorbell can start a fanfare. The Client subscribes to a command topic
+// taking JSON such as
+//
+//	{"action": "play", "file": "fanfare.mid"}   play a song of the player's
+//	{"action": "play"}                          play on, after a pause or stop
+//	{"action": "pause"}                         pause, stop, next or prev
+//	{"action": "panic"}                         stop, and all notes off
+//	{"action": "status"}                        publish the status now
+//
+// and publishes the player's api.Status, its devices' health included, to
+// a state topic, retained: when it changes, and every heartbeat besides.
+// The broker publishes {"state": "offline"} there for a player that goes
+// away, and the Client does as it leaves. Commands go to an api.Transport,
+// as the HTTP API's do, so that whatever owns the player hears of them
+// from one place. A lost broker is dialled again, waiting longer after
+// each failure. It speaks MQTT 3.1.1 at QoS 0, all a command needs.
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/api"
+)
+
+// Client takes commands for a player from a broker, and publishes its
+// status there.
+type Client struct {
+	Transport api.Transport
+
+	// Dial connects to the broker.
+	Dial func(ctx context.Context) (net.Conn, error)
+
+	// ClientID is the client identifier to connect with; "" for one the
+	// broker chooses. Username and Password, if set, go with it.
+	ClientID           string
+	Username, Password string
+
+	// Commands and State are the topics to take commands from and
+	// publish the status to; "" for goppy/command and goppy/state.
+	Commands, State string
+
+	// Heartbeat is how often the status is published, changed or not, and
+	// the broker pinged; 0 for 30s. A broker that doesn't answer a ping by
+	// the next heartbeat is taken as lost.
+	Heartbeat time.Duration
+
+	// Backoff is the wait before dialling a lost broker again, doubled for
+	// each attempt that fails, up to a minute; 0 for 1s.
+	Backoff time.Duration
+
+	// Logf, if set, is told of each command that fails and each time the
+	// broker is lost.
+	Logf func(format string, args ...any)
+
+	poll time.Duration // how often to look for a change of status
+}
+
+const (
+	maxBackoff  = time.Minute
+	dialTimeout = 10 * time.Second // for the broker to answer, and take what is sent
+	pollEvery   = 250 * time.Millisecond
+)
+
+// offline is the state published for a player gone.
+var offline = []byte(`{"state":"offline"}`)
+
+// Run connects to the broker and serves the player's commands until ctx
+// is done, dialling again whenever the broker is lost. It returns ctx's
+// error.
+func (c *Client) Run(ctx context.Context) error {
+	wait := c.backoff()
+	for {
+		connected, err := c.session(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if connected {
+			wait = c.backoff()
+		}
+		c.logf("%v; connecting again in %v", err, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if !connected {
+			wait = min(2*wait, maxBackoff)
+		}
+	}
+}
+
+// command is a command published to the command topic.
+type command struct {
+	Action string `json:"action"`
+	File   string `json:"file"`
+}
+
+// session connects to the broker and serves commands until ctx is done or
+// the broker is lost, and reports whether the broker accepted it.
+func (c *Client) session(ctx context.Context) (connected bool, err error) {
+	conn, err := c.Dial(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	write := func(p packet) error {
+		conn.SetWriteDeadline(time.Now().Add(dialTimeout))
+		_, err := conn.Write(p.encode())
+		return err
+	}
+	r := bufio.NewReader(conn)
+	keepAlive := uint16(min(65535, (2*c.heartbeat()+time.Second-1)/time.Second))
+	if err := write(connectPacket(c.ClientID, c.Username, c.Password, keepAlive, will{c.state(), offline})); err != nil {
+		return false, err
+	}
+	conn.SetReadDeadline(time.Now().Add(dialTimeout))
+	ack, err := readPacket(r)
+	if err != nil {
+		return false, err
+	}
+	if err := connackError(ack); err != nil {
+		return false, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	if err := write(subscribePacket(1, c.commands())); err != nil {
+		return true, err
+	}
+
+	packets := make(chan packet)
+	failed := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			p, err := readPacket(r)
+			if err != nil {
+				failed <- err
+				return
+			}
+			select {
+			case packets <- p:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var last []byte // the status published last, at position 0
+	publish := func(always bool) error {
+		st := c.Transport.Status()
+		payload, _ := json.Marshal(st)
+		st.Position = 0 // that it moves on isn't a change
+		key, _ := json.Marshal(st)
+		if !always && bytes.Equal(key, last) {
+			return nil
+		}
+		last = key
+		return write(publishPacket(c.state(), payload, true))
+	}
+	if err := publish(true); err != nil {
+		return true, err
+	}
+	heartbeat := time.NewTicker(c.heartbeat())
+	defer heartbeat.Stop()
+	poll := time.NewTicker(cmp.Or(c.poll, pollEvery))
+	defer poll.Stop()
+	pinged := false
+	for {
+		select {
+		case p := <-packets:
+			switch p.kind {
+			case typePublish:
+				topic, payload, id, err := parsePublish(p)
+				if err != nil {
+					return true, err
+				}
+				if id != 0 {
+					if err := write(packet{kind: typePuback, body: binary.BigEndian.AppendUint16(nil, id)}); err != nil {
+						return true, err
+					}
+				}
+				if topic != c.commands() {
+					continue
+				}
+				always, err := c.do(payload)
+				if err != nil {
+					c.logf("%s: %v", payload, err)
+				}
+				if err := publish(always); err != nil {
+					return true, err
+				}
+			case typeSuback:
+				if len(p.body) != 3 || p.body[2] == 0x80 {
+					return true, fmt.Errorf("mqtt: broker refused the subscription to %s", c.commands())
+				}
+			case typePingresp:
+				pinged = false
+			}
+		case <-poll.C:
+			if err := publish(false); err != nil {
+				return true, err
+			}
+		case <-heartbeat.C:
+			if pinged {
+				return true, errors.New("mqtt: broker stopped answering")
+			}
+			pinged = true
+			if err := write(packet{kind: typePingreq}); err != nil {
+				return true, err
+			}
+			if err := publish(true); err != nil {
+				return true, err
+			}
+		case err := <-failed:
+			return true, err
+		case <-ctx.Done():
+			// A clean disconnect doesn't publish the will.
+			write(publishPacket(c.state(), offline, true))
+			write(packet{kind: typeDisconnect})
+			return true, ctx.Err()
+		}
+	}
+}
+
+// do carries out the command in payload, and reports whether the status
+// is to be published even if unchanged.
+func (c *Client) do(payload []byte) (bool, error) {
+	var cmd command
+	if err := json.Unmarshal(payload, &cmd); err != nil {
+		return false, err
+	}
+	switch op := api.Op(cmd.Action); op {
+	case "status":
+		return true, nil
+	case api.OpPlay:
+		return false, c.Transport.Do(api.Command{Op: op, Song: cmd.File})
+	case api.OpPause, api.OpStop, api.OpNext, api.OpPrev, api.OpPanic:
+		return false, c.Transport.Do(api.Command{Op: op})
+	}
+	return false, fmt.Errorf("unknown action %q", cmd.Action)
+}
+
+func (c *Client) commands() string { return cmp.Or(c.Commands, "goppy/command") }
+func (c *Client) state() string    { return cmp.Or(c.State, "goppy/state") }
+
+func (c *Client) heartbeat() time.Duration { return cmp.Or(c.Heartbeat, 30*time.Second) }
+func (c *Client) backoff() time.Duration   { return cmp.Or(c.Backoff, time.Second) }
+
+func (c *Client) logf(format string, args ...any) {
+	if c.Logf != nil {
+		c.Logf(format, args...)
+	}
+}
@@ -0,0 +1,279 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/api"
+	"github.com/ystepanoff/goppy/internal/mqtttest"
+)
+
+// fakePlayer is a Transport noting the commands it is given, and playing
+// the song a play names.
+type fakePlayer struct {
+	mu     sync.Mutex
+	status api.Status
+	got    []api.Command
+}
+
+func (p *fakePlayer) Status() api.Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+func (p *fakePlayer) Do(c api.Command) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.got = append(p.got, c)
+	switch c.Op {
+	case api.OpNext:
+		return errors.New("no playlist")
+	case api.OpPlay:
+		p.status.State = api.Playing
+		if c.Song != "" {
+			p.status.Song = c.Song
+		}
+	case api.OpStop, api.OpPanic:
+		p.status.State = api.Stopped
+	}
+	return nil
+}
+
+func (p *fakePlayer) set(f func(s *api.Status)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f(&p.status)
+}
+
+func (p *fakePlayer) commands() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var out []string
+	for _, c := range p.got {
+		out = append(out, strings.TrimSpace(fmt.Sprintf("%s %s", c.Op, c.Song)))
+	}
+	return out
+}
+
+// logs collects what a Client logs.
+type logs struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *logs) logf(format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func (l *logs) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.lines, "\n")
+}
+
+// state returns a match for a state payload with the given JSON fields.
+func state(want map[string]any) func([]byte) bool {
+	return func(payload []byte) bool {
+		var v map[string]any
+		if json.Unmarshal(payload, &v) != nil {
+			return false
+		}
+		for k, w := range want {
+			if fmt.Sprint(v[k]) != fmt.Sprint(w) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func TestClient(t *testing.T) {
+	b := mqtttest.New()
+	p := &fakePlayer{status: api.Status{State: api.Stopped, Muted: []int{}, Soloed: []int{}, Devices: []api.Device{{Address: "0x01", Connected: true}}}}
+	var l logs
+	c := &Client{
+		Transport: p, Dial: b.Dial, ClientID: "hall", Username: "goppy", Password: "s3cret",
+		Commands: "house/goppy/set", State: "house/goppy", Heartbeat: time.Hour, Logf: l.logf, poll: 5 * time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	b.WaitSubscribed(t, "house/goppy/set")
+	first := b.Wait(t, "house/goppy", nil)
+	if want := `{"state":"stopped","position":0,"length":0,"index":0,"songs":0,"muted":[],"soloed":[],"devices":[{"address":"0x01","connected":true}]}`; string(first) != want {
+		t.Errorf("first state\n%s\nwant\n%s", first, want)
+	}
+	cn := b.Connects()[0]
+	if cn.ClientID != "hall" || cn.Username != "goppy" || cn.Password != "s3cret" || cn.KeepAlive != 7200 || !cn.CleanSession ||
+		cn.Will == nil || cn.Will.Topic != "house/goppy" || string(cn.Will.Payload) != `{"state":"offline"}` || !cn.Will.Retain {
+		t.Errorf("connected with %+v, will %+v", cn, cn.Will)
+	}
+
+	b.Publish("house/goppy/set", []byte(`{"action":"play","file":"fanfare.mid"}`))
+	b.Wait(t, "house/goppy", state(map[string]any{"state": "playing", "song": "fanfare.mid"}))
+	b.Publish("house/goppy/set", []byte(`{"action":"next"}`))
+	b.Publish("house/goppy/set", []byte(`{"action":"dance"}`))
+	b.Publish("house/goppy/set", []byte(`not json`))
+	b.Publish("house/goppy/set", []byte(`{"action":"panic"}`))
+	b.Wait(t, "house/goppy", state(map[string]any{"state": "stopped", "song": "fanfare.mid"}))
+
+	// A status asked for is published unchanged; a position moving on
+	// isn't a change, but a device lost is.
+	n := len(b.Published("house/goppy"))
+	b.Publish("house/goppy/set", []byte(`{"action":"status"}`))
+	b.WaitPublished(t, "house/goppy", n+1)
+	p.set(func(s *api.Status) { s.Position = 12 })
+	time.Sleep(30 * time.Millisecond)
+	if got := len(b.Published("house/goppy")); got != n+1 {
+		t.Errorf("published %d states, want %d: the position isn't a change", got, n+1)
+	}
+	p.set(func(s *api.Status) { s.Devices = []api.Device{{Address: "0x01", Error: "port closed"}} })
+	b.Wait(t, "house/goppy", state(map[string]any{"devices": []map[string]any{{"address": "0x01", "connected": false, "error": "port closed"}}}))
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Run = %v", err)
+	}
+	states := b.Published("house/goppy")
+	if last := states[len(states)-1]; string(last.Payload) != `{"state":"offline"}` || last.Will || !last.Retain {
+		t.Errorf("last state %+v, want offline, published by the client", last)
+	}
+	for _, s := range states {
+		if !s.Retain {
+			t.Errorf("state %s not retained", s.Payload)
+		}
+	}
+	if want := []string{"play fanfare.mid", "next", "panic"}; !slices.Equal(p.commands(), want) {
+		t.Errorf("commands %q, want %q", p.commands(), want)
+	}
+	for _, want := range []string{`{"action":"next"}: no playlist`, `{"action":"dance"}: unknown action "dance"`, "not json: "} {
+		if !strings.Contains(l.String(), want) {
+			t.Errorf("logged\n%s\nwant %q", l.String(), want)
+		}
+	}
+}
+
+// TestReconnect loses the broker, which publishes the Client's will, and
+// fails to dial it twice: the Client must wait longer each time, then
+// connect and publish its state again.
+func TestReconnect(t *testing.T) {
+	b := mqtttest.New()
+	p := &fakePlayer{status: api.Status{State: api.Playing, Muted: []int{}}}
+	var (
+		mu    sync.Mutex
+		dials []time.Time
+	)
+	c := &Client{
+		Transport: p, Heartbeat: time.Hour, Backoff: 20 * time.Millisecond,
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			dials = append(dials, time.Now())
+			if n := len(dials); n == 2 || n == 3 {
+				return nil, errors.New("connection refused")
+			}
+			return b.Dial(ctx)
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	b.WaitPublished(t, "goppy/state", 1)
+	b.Drop()
+	b.Wait(t, "goppy/state", func(p []byte) bool { return string(p) == `{"state":"offline"}` })
+	b.WaitPublished(t, "goppy/state", 3) // online, the will, online again
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dials) != 4 {
+		t.Fatalf("dialled %d times, want 4", len(dials))
+	}
+	for i, want := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond} {
+		if got := dials[i+2].Sub(dials[i+1]); got < want || got > want+50*time.Millisecond {
+			t.Errorf("waited %v before dial %d, want %v", got, i+3, want)
+		}
+	}
+	var wills, online int
+	for _, m := range b.Published("goppy/state") {
+		switch {
+		case m.Will:
+			wills++
+		case bytes.Contains(m.Payload, []byte(`"state":"playing"`)):
+			online++
+		}
+	}
+	if wills != 1 || online != 2 {
+		t.Errorf("published %d wills and %d states, want 1 and 2", wills, online)
+	}
+}
+
+// TestHeartbeat: a broker that stops answering pings is taken as lost.
+func TestHeartbeat(t *testing.T) {
+	b := mqtttest.New()
+	b.Deaf = true
+	p := &fakePlayer{status: api.Status{State: api.Playing, Muted: []int{}}}
+	var l logs
+	c := &Client{Transport: p, Dial: b.Dial, Heartbeat: 20 * time.Millisecond, Backoff: time.Millisecond, Logf: l.logf}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	b.WaitConnects(t, 2)
+	cancel()
+	<-done
+	if !strings.Contains(l.String(), "broker stopped answering") {
+		t.Errorf("logged %q", l.String())
+	}
+	// Each heartbeat publishes the state, changed or not.
+	if n := len(b.Published("goppy/state")); n < 2 {
+		t.Errorf("published %d states", n)
+	}
+}
+
+func TestRefused(t *testing.T) {
+	b := mqtttest.New()
+	b.Refuse = 4
+	var l logs
+	c := &Client{Transport: &fakePlayer{}, Dial: b.Dial, Backoff: time.Millisecond, Logf: l.logf}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	b.WaitConnects(t, 3)
+	cancel()
+	<-done
+	if !strings.Contains(l.String(), "mqtt: broker refused: bad user name or password; connecting again in 2ms") {
+		t.Errorf("logged %q", l.String())
+	}
+}
+
+func TestPacket(t *testing.T) {
+	for _, size := range []int{0, 127, 128, 16383, 16384, maxPacket} {
+		p := packet{kind: typePublish, flags: 1, body: bytes.Repeat([]byte{'x'}, size)}
+		got, err := readPacket(bufio.NewReader(bytes.NewReader(p.encode())))
+		if err != nil || got.kind != p.kind || got.flags != p.flags || !bytes.Equal(got.body, p.body) {
+			t.Errorf("%d bytes: read %d %d %d bytes, %v", size, got.kind, got.flags, len(got.body), err)
+		}
+	}
+	if _, err := readPacket(bufio.NewReader(bytes.NewReader([]byte{0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}))); err == nil {
+		t.Error("read a remaining length of five bytes")
+	}
+	topic, payload, id, err := parsePublish(packet{kind: typePublish, flags: 0x02, body: []byte("\x00\x01a\x00\x07hi")})
+	if topic != "a" || string(payload) != "hi" || id != 7 || err != nil {
+		t.Errorf("parsePublish at QoS 1 = %q %q %d %v", topic, payload, id, err)
+	}
+}
@@ -0,0 +1,187 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Control packet types, the high nibble of a packet's first byte.
+const (
+	typeConnect    = 1
+	typeConnack    = 2
+	typePublish    = 3
+	typePuback     = 4
+	typeSubscribe  = 8
+	typeSuback     = 9
+	typePingreq    = 12
+	typePingresp   = 13
+	typeDisconnect = 14
+)
+
+// packet is a control packet: its type, the flags of its first byte, and
+// what follows the remaining length.
+type packet struct {
+	kind, flags byte
+	body        []byte
+}
+
+// maxPacket is the largest packet read: commands are small, and a broker
+// sending more is taken as broken.
+const maxPacket = 1 << 16
+
+var errMalformed = errors.New("mqtt: malformed packet")
+
+// readPacket reads a control packet.
+func readPacket(r *bufio.Reader) (packet, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+	size, shift := 0, 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		size |= int(b&0x7F) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return packet{}, errMalformed
+		}
+	}
+	if size > maxPacket {
+		return packet{}, fmt.Errorf("mqtt: packet of %d bytes", size)
+	}
+	p := packet{kind: first >> 4, flags: first & 0x0F, body: make([]byte, size)}
+	if _, err := io.ReadFull(r, p.body); err != nil {
+		return packet{}, err
+	}
+	return p, nil
+}
+
+// encode returns p as sent, with its fixed header.
+func (p packet) encode() []byte {
+	out := []byte{p.kind<<4 | p.flags}
+	n := len(p.body)
+	for {
+		b := byte(n & 0x7F)
+		if n >>= 7; n > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(out, p.body...)
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(s)))
+	return append(dst, s...)
+}
+
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 2 || len(b)-2 < int(binary.BigEndian.Uint16(b)) {
+		return "", nil, errMalformed
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
+
+// will is the message a broker publishes for a client that goes away
+// without a DISCONNECT.
+type will struct {
+	topic   string
+	payload []byte
+}
+
+// connectPacket returns a CONNECT for a clean session of MQTT 3.1.1.
+func connectPacket(clientID, username, password string, keepAlive uint16, w will) packet {
+	flags := byte(0x02) // clean session
+	body := appendString(nil, "MQTT")
+	body = append(body, 4) // protocol level 3.1.1
+	if w.topic != "" {
+		flags |= 0x04 | 0x20 // a will, retained
+	}
+	if username != "" {
+		flags |= 0x80
+		if password != "" {
+			flags |= 0x40
+		}
+	}
+	body = append(body, flags)
+	body = binary.BigEndian.AppendUint16(body, keepAlive)
+	body = appendString(body, clientID)
+	if w.topic != "" {
+		body = appendString(body, w.topic)
+		body = appendString(body, string(w.payload))
+	}
+	if username != "" {
+		body = appendString(body, username)
+		if password != "" {
+			body = appendString(body, password)
+		}
+	}
+	return packet{kind: typeConnect, body: body}
+}
+
+// connackError returns the error for a CONNACK, or nil if it accepts.
+func connackError(p packet) error {
+	if p.kind != typeConnack || len(p.body) != 2 {
+		return fmt.Errorf("mqtt: want CONNACK, got packet type %d", p.kind)
+	}
+	switch code := p.body[1]; code {
+	case 0:
+		return nil
+	case 1:
+		return errors.New("mqtt: broker refused: protocol version")
+	case 2:
+		return errors.New("mqtt: broker refused: client identifier")
+	case 3:
+		return errors.New("mqtt: broker refused: server unavailable")
+	case 4:
+		return errors.New("mqtt: broker refused: bad user name or password")
+	case 5:
+		return errors.New("mqtt: broker refused: not authorised")
+	default:
+		return fmt.Errorf("mqtt: broker refused: code %d", code)
+	}
+}
+
+// subscribePacket returns a SUBSCRIBE to topic at QoS 0.
+func subscribePacket(id uint16, topic string) packet {
+	body := binary.BigEndian.AppendUint16(nil, id)
+	body = appendString(body, topic)
+	return packet{kind: typeSubscribe, flags: 0x02, body: append(body, 0)}
+}
+
+// publishPacket returns a PUBLISH at QoS 0.
+func publishPacket(topic string, payload []byte, retain bool) packet {
+	p := packet{kind: typePublish, body: append(appendString(nil, topic), payload...)}
+	if retain {
+		p.flags |= 0x01
+	}
+	return p
+}
+
+// parsePublish returns the topic and payload of a PUBLISH, and its packet
+// identifier if its QoS is above 0, to acknowledge.
+func parsePublish(p packet) (topic string, payload []byte, id uint16, err error) {
+	topic, rest, err := readString(p.body)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	if qos := p.flags >> 1 & 0x03; qos > 0 {
+		if len(rest) < 2 {
+			return "", nil, 0, errMalformed
+		}
+		id, rest = binary.BigEndian.Uint16(rest), rest[2:]
+	}
+	return topic, rest, id, nil
+}
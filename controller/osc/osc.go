@@ -0,0 +1,256 @@
+// Package osc serves Open Sound Control over UDP, so that live-coding
+// environments such as TidalCycles and SuperCollider can play the drives
+// from their patterns without speaking Moppy:
+//
+//	/goppy/note  device sub note [duration-ms [velocity]]
+//	/goppy/bend  device sub bend      -8192 to 8191, or -1.0 to 1.0
+//	/goppy/stop  [device [sub]]       release the notes struck here
+//	/goppy/panic [device]             all notes off, and forget what's pending
+//
+// Arguments may be ints or floats, as patterns send either. A note with
+// a duration is released that long after it is struck, and one without
+// holds until a stop. A bundle's messages are carried out at its timetag,
+// not as they arrive, so that a pattern sent ahead keeps its timing.
+// Messages that can't be decoded or carried out are logged and dropped.
+package osc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Message is an OSC message: an address and its arguments, each an int32,
+// float32, string, []byte, int64, float64, bool, nil or time.Time.
+type Message struct {
+	Address string
+	Args    []any
+
+	// At is when the message's bundle says to carry it out, or zero for
+	// at once.
+	At time.Time
+}
+
+var (
+	errShort  = errors.New("osc: packet ends early")
+	errString = errors.New("osc: string not terminated")
+)
+
+// Parse decodes an OSC packet, a message or a bundle of them, into its
+// messages, each with the time of the bundle holding it.
+func Parse(packet []byte) ([]Message, error) {
+	return parse(packet, time.Time{})
+}
+
+func parse(packet []byte, at time.Time) ([]Message, error) {
+	if len(packet) == 0 || len(packet)%4 != 0 {
+		return nil, fmt.Errorf("osc: packet of %d bytes, not a multiple of 4", len(packet))
+	}
+	if packet[0] == '#' {
+		return parseBundle(packet)
+	}
+	m, err := parseMessage(packet)
+	if err != nil {
+		return nil, err
+	}
+	m.At = at
+	return []Message{m}, nil
+}
+
+func parseBundle(packet []byte) ([]Message, error) {
+	tag, rest, err := readString(packet)
+	if err != nil {
+		return nil, err
+	}
+	if tag != "#bundle" {
+		return nil, fmt.Errorf("osc: %q is neither a message nor a bundle", tag)
+	}
+	if len(rest) < 8 {
+		return nil, errShort
+	}
+	at := Time(binary.BigEndian.Uint64(rest))
+	rest = rest[8:]
+	var msgs []Message
+	for len(rest) > 0 {
+		if len(rest) < 4 {
+			return nil, errShort
+		}
+		size := binary.BigEndian.Uint32(rest)
+		if uint32(len(rest)-4) < size {
+			return nil, errShort
+		}
+		inner, err := parse(rest[4:4+size], at)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, inner...)
+		rest = rest[4+size:]
+	}
+	return msgs, nil
+}
+
+func parseMessage(packet []byte) (Message, error) {
+	addr, rest, err := readString(packet)
+	if err != nil {
+		return Message{}, err
+	}
+	if !strings.HasPrefix(addr, "/") {
+		return Message{}, fmt.Errorf("osc: address %q doesn't start with /", addr)
+	}
+	m := Message{Address: addr}
+	if len(rest) == 0 {
+		return m, nil // no type tags, as old senders do for no arguments
+	}
+	tags, rest, err := readString(rest)
+	if err != nil {
+		return Message{}, err
+	}
+	tags, ok := strings.CutPrefix(tags, ",")
+	if !ok {
+		return Message{}, fmt.Errorf("osc: %s: type tags %q don't start with ,", addr, tags)
+	}
+	for _, tag := range tags {
+		need := map[rune]int{'i': 4, 'f': 4, 'h': 8, 'd': 8, 't': 8}[tag]
+		if len(rest) < need {
+			return Message{}, errShort
+		}
+		var arg any
+		switch tag {
+		case 'i':
+			arg = int32(binary.BigEndian.Uint32(rest))
+		case 'f':
+			arg = math.Float32frombits(binary.BigEndian.Uint32(rest))
+		case 'h':
+			arg = int64(binary.BigEndian.Uint64(rest))
+		case 'd':
+			arg = math.Float64frombits(binary.BigEndian.Uint64(rest))
+		case 't':
+			arg = Time(binary.BigEndian.Uint64(rest))
+		case 's', 'S':
+			if arg, rest, err = readString(rest); err != nil {
+				return Message{}, err
+			}
+		case 'b':
+			if len(rest) < 4 {
+				return Message{}, errShort
+			}
+			size := binary.BigEndian.Uint32(rest)
+			if uint32(len(rest)-4) < size {
+				return Message{}, errShort
+			}
+			arg = rest[4 : 4+size]
+			rest = rest[min(len(rest), 4+pad(int(size))):]
+		case 'T', 'F':
+			arg = tag == 'T'
+		case 'N', 'I':
+		default:
+			return Message{}, fmt.Errorf("osc: %s: unknown type tag %q", addr, tag)
+		}
+		rest = rest[need:]
+		m.Args = append(m.Args, arg)
+	}
+	return m, nil
+}
+
+// readString reads a string padded with NULs to a multiple of 4 bytes.
+func readString(b []byte) (string, []byte, error) {
+	end := 0
+	for end < len(b) && b[end] != 0 {
+		end++
+	}
+	if end == len(b) {
+		return "", nil, errString
+	}
+	return string(b[:end]), b[min(len(b), pad(end+1)):], nil
+}
+
+// pad rounds n up to a multiple of 4.
+func pad(n int) int { return (n + 3) &^ 3 }
+
+// ntpEpoch is the Unix time of OSC's, and NTP's, epoch: 1 January 1900.
+const ntpEpoch = -2208988800
+
+// Time returns the time of an OSC timetag, seconds since 1900 and a
+// fraction of one in 32 bits, or zero for the tag 1, at once.
+func Time(tag uint64) time.Time {
+	if tag == 1 {
+		return time.Time{}
+	}
+	secs, frac := int64(tag>>32), tag&0xFFFFFFFF
+	return time.Unix(secs+ntpEpoch, int64((frac*uint64(time.Second))>>32))
+}
+
+// Timetag returns the OSC timetag for t, or 1, at once, for zero.
+func Timetag(t time.Time) uint64 {
+	if t.IsZero() {
+		return 1
+	}
+	secs := uint64(t.Unix() - ntpEpoch)
+	frac := (uint64(t.Nanosecond()) << 32) / uint64(time.Second)
+	return secs<<32 | frac
+}
+
+// AppendMessage appends the packet of an OSC message, with args of the
+// types Message has, to dst: for tests, and for whatever sends to a
+// Server.
+func AppendMessage(dst []byte, address string, args ...any) []byte {
+	dst = appendString(dst, address)
+	tags := ","
+	var data []byte
+	for _, a := range args {
+		switch a := a.(type) {
+		case int32:
+			tags += "i"
+			data = binary.BigEndian.AppendUint32(data, uint32(a))
+		case int:
+			tags += "i"
+			data = binary.BigEndian.AppendUint32(data, uint32(int32(a)))
+		case float32:
+			tags += "f"
+			data = binary.BigEndian.AppendUint32(data, math.Float32bits(a))
+		case float64:
+			tags += "d"
+			data = binary.BigEndian.AppendUint64(data, math.Float64bits(a))
+		case int64:
+			tags += "h"
+			data = binary.BigEndian.AppendUint64(data, uint64(a))
+		case string:
+			tags += "s"
+			data = appendString(data, a)
+		case []byte:
+			tags += "b"
+			data = binary.BigEndian.AppendUint32(data, uint32(len(a)))
+			data = append(data, a...)
+			data = append(data, make([]byte, pad(len(a))-len(a))...)
+		case bool:
+			tags += map[bool]string{true: "T", false: "F"}[a]
+		case time.Time:
+			tags += "t"
+			data = binary.BigEndian.AppendUint64(data, Timetag(a))
+		case nil:
+			tags += "N"
+		}
+	}
+	dst = appendString(dst, tags)
+	return append(dst, data...)
+}
+
+// AppendBundle appends a bundle of packets, to be carried out at at, to
+// dst.
+func AppendBundle(dst []byte, at time.Time, packets ...[]byte) []byte {
+	dst = appendString(dst, "#bundle")
+	dst = binary.BigEndian.AppendUint64(dst, Timetag(at))
+	for _, p := range packets {
+		dst = binary.BigEndian.AppendUint32(dst, uint32(len(p)))
+		dst = append(dst, p...)
+	}
+	return dst
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = append(dst, s...)
+	return append(dst, make([]byte, pad(len(s)+1)-len(s))...)
+}
@@ -0,0 +1,223 @@
+package osc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+func TestParse(t *testing.T) {
+	// The OSC 1.0 specification's example message.
+	freq := []byte("/oscillator/4/frequency\x00,f\x00\x00\x43\xdc\x00\x00")
+	// A bundle for 1 January 2000 holding /goppy/note 1 2 60 and, in a
+	// bundle of its own for at once, /goppy/panic.
+	bundle := []byte("#bundle\x00\xbc\x17\xc2\x00\x80\x00\x00\x00" +
+		"\x00\x00\x00\x20" + "/goppy/note\x00" + ",iii\x00\x00\x00\x00" +
+		"\x00\x00\x00\x01" + "\x00\x00\x00\x02" + "\x00\x00\x00\x3c" +
+		"\x00\x00\x00\x24" + "#bundle\x00" + "\x00\x00\x00\x00\x00\x00\x00\x01" +
+		"\x00\x00\x00\x10" + "/goppy/panic\x00\x00\x00\x00")
+	at := time.Date(2000, 1, 1, 0, 0, 0, 500_000_000, time.UTC)
+	tests := []struct {
+		name   string
+		packet []byte
+		want   []Message
+	}{
+		{"message", freq, []Message{{Address: "/oscillator/4/frequency", Args: []any{float32(440)}}}},
+		{"bundle", bundle, []Message{
+			{Address: "/goppy/note", Args: []any{int32(1), int32(2), int32(60)}, At: at},
+			{Address: "/goppy/panic"},
+		}},
+		{"every type", AppendMessage(nil, "/all", int32(-1), float32(0.5), "hi", []byte{1, 2, 3}, int64(1<<40), 2.5, true, false, nil, at),
+			[]Message{{Address: "/all", Args: []any{int32(-1), float32(0.5), "hi", []byte{1, 2, 3}, int64(1 << 40), 2.5, true, false, nil, at}}}},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.packet)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		for i := range got {
+			if a, ok := got[i].At, !got[i].At.IsZero(); ok {
+				got[i].At = a.UTC()
+			}
+			for j, arg := range got[i].Args {
+				if tm, ok := arg.(time.Time); ok {
+					got[i].Args[j] = tm.UTC()
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Parse = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+	for _, bad := range [][]byte{
+		[]byte("/goppy"),                          // not padded
+		[]byte("/goppy/note\x00,i\x00\x00"),       // no int
+		[]byte("goppy\x00\x00\x00"),               // no slash
+		[]byte("/goppy/note\x00,x\x00\x00"),       // unknown type
+		[]byte("#bundle\x00\x00\x00\x00\x00\x00"), // no timetag
+		[]byte("#bundle\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x10/a\x00\x00"),
+	} {
+		if msgs, err := Parse(bad); err == nil {
+			t.Errorf("Parse(%q) = %+v, want an error", bad, msgs)
+		}
+	}
+}
+
+func TestTimetag(t *testing.T) {
+	at := time.Date(2026, 10, 16, 12, 0, 0, 250_000_000, time.UTC)
+	if got := Time(Timetag(at)); !got.Equal(at) {
+		t.Errorf("Time(Timetag(%v)) = %v", at, got)
+	}
+	if !Time(1).IsZero() || Timetag(time.Time{}) != 1 {
+		t.Error("timetag 1 isn't at once")
+	}
+}
+
+// sent is a Sender noting when each message went.
+type sent struct {
+	mu   sync.Mutex
+	msgs []sentMessage
+	now  func() time.Time
+}
+
+type sentMessage struct {
+	at time.Time
+	m  protocol.Message
+}
+
+func (s *sent) Send(m protocol.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.msgs = append(s.msgs, sentMessage{s.now(), m})
+	return nil
+}
+
+func (s *sent) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var b strings.Builder
+	for _, m := range s.msgs {
+		fmt.Fprintf(&b, "%02X/%02X %02X % X\n", m.m.Device, m.m.Sub, m.m.Command, m.m.Payload)
+	}
+	return b.String()
+}
+
+// TestServer feeds the Server canned packets at set times, a millisecond
+// apart, and checks what it sends when.
+func TestServer(t *testing.T) {
+	t0 := time.Date(2026, 10, 16, 20, 0, 0, 0, time.UTC)
+	ms := func(n int) time.Time { return t0.Add(time.Duration(n) * time.Millisecond) }
+	var now time.Time
+	out := &sent{now: func() time.Time { return now }}
+	var logged []string
+	s := &Server{Out: out, Logf: func(format string, args ...any) { logged = append(logged, fmt.Sprintf(format, args...)) }}
+	feed := func(at int, packet []byte) {
+		now = ms(at)
+		s.packet(packet, now)
+		s.runDue(now)
+	}
+	advance := func(to int) {
+		for ; now.Before(ms(to)); now = now.Add(time.Millisecond) {
+			s.runDue(now)
+		}
+	}
+	note := func(args ...any) []byte { return AppendMessage(nil, "/goppy/note", args...) }
+
+	feed(0, note(int32(1), int32(1), int32(60), int32(50)))
+	// A bundle for 100ms in: a note for 30ms, and a bend as floats.
+	feed(1, AppendBundle(nil, ms(100),
+		note(float32(1), float32(2), float32(64), float32(30), float32(90)),
+		AppendMessage(nil, "/goppy/bend", int32(1), int32(2), float32(-0.5))))
+	// 60 struck again before its first duration ends: held the second's.
+	feed(40, note(int32(1), int32(1), int32(60), int32(100)))
+	feed(41, note(int32(1), int32(3), int32(67)))                   // held until stopped
+	feed(42, []byte("/goppy/nope\x00,\x00\x00\x00"))                // unknown
+	feed(43, note(int32(1), int32(1), int32(200)))                  // bad note
+	feed(44, []byte("/goppy/note\x00,ii"))                          // malformed
+	feed(45, AppendMessage(nil, "/goppy/bend", int32(1), int32(2))) // too few
+	advance(200)
+	feed(200, AppendMessage(nil, "/goppy/stop", int32(1)))
+	feed(201, AppendBundle(nil, ms(500), note(int32(2), int32(1), int32(48))))
+	feed(202, AppendMessage(nil, "/goppy/panic"))
+	advance(600)
+
+	want := []sentMessage{
+		{ms(0), protocol.NoteOn(1, 1, 60)},
+		{ms(40), protocol.NoteOn(1, 1, 60)},
+		{ms(41), protocol.NoteOn(1, 3, 67)},
+		{ms(100), protocol.NoteOnVelocity(1, 2, 64, 90)},
+		{ms(100), protocol.PitchBend(1, 2, -4096)},
+		{ms(130), protocol.NoteOff(1, 2, 64)},
+		{ms(140), protocol.NoteOff(1, 1, 60)},
+		{ms(200), protocol.NoteOff(1, 3, 67)},
+		// The panic forgot the note pending for 500ms.
+		{ms(202), protocol.AllNotesOff(1)},
+	}
+	if !reflect.DeepEqual(out.msgs, want) {
+		t.Errorf("sent\n%v\nwant\n%v", out.msgs, want)
+	}
+	if len(logged) != 4 {
+		t.Errorf("logged %q, want the 4 messages dropped", logged)
+	}
+}
+
+// TestServe sends packets over UDP: a bundle ahead of time must be played
+// at its timetag, and its note released after its duration, near enough.
+func TestServe(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &sent{now: time.Now}
+	s := &Server{Out: out, Logf: t.Logf}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ctx, conn) }()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	at := time.Now().Add(80 * time.Millisecond)
+	client.Write(AppendBundle(nil, at, AppendMessage(nil, "/goppy/note", int32(1), int32(1), int32(60), int32(40))))
+	client.Write(AppendMessage(nil, "/goppy/note", int32(1), int32(2), int32(62)))
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Serve = %v, want context.Canceled", err)
+	}
+
+	const tolerance = 15 * time.Millisecond
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	var got bytes.Buffer
+	for _, m := range out.msgs {
+		fmt.Fprintf(&got, "%v ", m.m)
+	}
+	if len(out.msgs) != 4 {
+		t.Fatalf("sent %s, want 62 struck, 60 struck and released, and 62 released at the end", got.String())
+	}
+	on, off := out.msgs[1], out.msgs[2]
+	if !reflect.DeepEqual(on.m, protocol.NoteOn(1, 1, 60)) || !reflect.DeepEqual(off.m, protocol.NoteOff(1, 1, 60)) {
+		t.Fatalf("sent %s", got.String())
+	}
+	if d := on.at.Sub(at); d < -tolerance || d > tolerance {
+		t.Errorf("note struck %v from its timetag", d)
+	}
+	if d := off.at.Sub(at.Add(40 * time.Millisecond)); d < -tolerance || d > tolerance {
+		t.Errorf("note released %v from its timetag and duration", d)
+	}
+	if !reflect.DeepEqual(out.msgs[3].m, protocol.NoteOff(1, 2, 62)) {
+		t.Errorf("Serve left 62 held: %s", got.String())
+	}
+}
@@ -0,0 +1,316 @@
+package osc
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// Server carries out the OSC messages sent to it on the drives, through
+// Out.
+type Server struct {
+	Out controller.Sender
+
+	// Logf, if set, is told of each message dropped and each send that
+	// failed.
+	Logf func(format string, args ...any)
+
+	pending []job // by time, then arrival
+	seq     uint64
+	held    map[heldNote]uint64 // the job striking each note held, by its seq
+	devices []byte              // played on, for a panic
+}
+
+// heldNote is a note struck on a drive by the Server.
+type heldNote struct {
+	device, sub, note byte
+}
+
+// job is a message to carry out at a time, or a note to release then.
+type job struct {
+	at  time.Time
+	seq uint64
+	m   Message
+
+	// A note-off for a note struck by the job numbered by, if it is
+	// still held from then.
+	off *heldNote
+	by  uint64
+}
+
+// Serve reads packets from conn and carries out their messages until ctx
+// is done or conn fails, then releases the notes it holds. It returns
+// ctx's error, or the error reading conn.
+func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
+	packets := make(chan []byte)
+	failed := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				failed <- err
+				return
+			}
+			select {
+			case packets <- append([]byte(nil), buf[:n]...):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	defer conn.Close()
+	defer s.release()
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		var due <-chan time.Time
+		if len(s.pending) > 0 {
+			timer.Reset(time.Until(s.pending[0].at))
+			due = timer.C
+		}
+		select {
+		case p := <-packets:
+			s.packet(p, time.Now())
+		case <-due:
+		case err := <-failed:
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		s.runDue(time.Now())
+	}
+}
+
+// packet queues the messages of a packet that arrived at now, dropping it
+// if it can't be decoded.
+func (s *Server) packet(p []byte, now time.Time) {
+	msgs, err := Parse(p)
+	if err != nil {
+		s.logf("dropped a packet: %v", err)
+		return
+	}
+	for _, m := range msgs {
+		at := m.At
+		if at.IsZero() || at.Before(now) {
+			at = now
+		}
+		s.schedule(job{at: at, m: m})
+	}
+}
+
+func (s *Server) schedule(j job) {
+	s.seq++
+	j.seq = s.seq
+	i, _ := slices.BinarySearchFunc(s.pending, j, func(a, b job) int {
+		return cmp.Or(a.at.Compare(b.at), cmp.Compare(a.seq, b.seq))
+	})
+	s.pending = slices.Insert(s.pending, i, j)
+}
+
+// runDue carries out the jobs due by now, in order.
+func (s *Server) runDue(now time.Time) {
+	for len(s.pending) > 0 && !s.pending[0].at.After(now) {
+		j := s.pending[0]
+		s.pending = s.pending[1:]
+		if j.off != nil {
+			if s.held[*j.off] == j.by {
+				delete(s.held, *j.off)
+				s.send(protocol.NoteOff(j.off.device, j.off.sub, j.off.note))
+			}
+			continue
+		}
+		if err := s.do(j); err != nil {
+			s.logf("dropped %s %v: %v", j.m.Address, j.m.Args, err)
+		}
+	}
+}
+
+// do carries out the message of j, run at j.at.
+func (s *Server) do(j job) error {
+	m := j.m
+	switch m.Address {
+	case "/goppy/note":
+		if len(m.Args) < 3 || len(m.Args) > 5 {
+			return errors.New("want device, sub, note, and a duration and velocity if any")
+		}
+		dev, sub, err := drive(m.Args)
+		if err != nil {
+			return err
+		}
+		note, err := byteArg(m.Args[2], "note", 0, 127)
+		if err != nil {
+			return err
+		}
+		var dur, vel float64
+		if len(m.Args) > 3 {
+			if dur, err = number(m.Args[3]); err != nil || dur < 0 {
+				return fmt.Errorf("duration: want milliseconds, not %v", m.Args[3])
+			}
+		}
+		msg := protocol.NoteOn(dev, sub, note)
+		if len(m.Args) > 4 {
+			if vel, err = number(m.Args[4]); err != nil || vel < 1 || vel > 127 {
+				return fmt.Errorf("velocity: want 1 to 127, not %v", m.Args[4])
+			}
+			msg = protocol.NoteOnVelocity(dev, sub, note, byte(vel))
+		}
+		h := heldNote{dev, sub, note}
+		if s.held == nil {
+			s.held = make(map[heldNote]uint64)
+		}
+		s.held[h] = j.seq
+		s.played(dev)
+		s.send(msg)
+		if dur > 0 {
+			s.schedule(job{at: j.at.Add(time.Duration(dur * float64(time.Millisecond))), off: &h, by: j.seq})
+		}
+	case "/goppy/bend":
+		if len(m.Args) != 3 {
+			return errors.New("want device, sub and bend")
+		}
+		dev, sub, err := drive(m.Args)
+		if err != nil {
+			return err
+		}
+		b, err := number(m.Args[2])
+		if err != nil {
+			return err
+		}
+		switch m.Args[2].(type) {
+		case float32, float64:
+			b *= 8192 // -1.0 to 1.0
+		}
+		s.played(dev)
+		s.send(protocol.PitchBend(dev, sub, int16(max(-8192, min(8191, math.Round(b))))))
+	case "/goppy/stop":
+		if len(m.Args) > 2 {
+			return errors.New("want a device and sub, if any")
+		}
+		var match func(heldNote) bool
+		switch len(m.Args) {
+		case 0:
+			match = func(heldNote) bool { return true }
+		case 1:
+			dev, err := byteArg(m.Args[0], "device", 0, 255)
+			if err != nil {
+				return err
+			}
+			match = func(h heldNote) bool { return h.device == dev }
+		case 2:
+			dev, sub, err := drive(m.Args)
+			if err != nil {
+				return err
+			}
+			match = func(h heldNote) bool { return h.device == dev && h.sub == sub }
+		}
+		var stop []heldNote
+		for h := range s.held {
+			if match(h) {
+				stop = append(stop, h)
+			}
+		}
+		slices.SortFunc(stop, func(a, b heldNote) int {
+			return cmp.Or(cmp.Compare(a.device, b.device), cmp.Compare(a.sub, b.sub), cmp.Compare(a.note, b.note))
+		})
+		for _, h := range stop {
+			delete(s.held, h)
+			s.send(protocol.NoteOff(h.device, h.sub, h.note))
+		}
+	case "/goppy/panic":
+		s.forget()
+		devs := s.devices
+		if len(m.Args) > 0 {
+			dev, err := byteArg(m.Args[0], "device", 0, 255)
+			if err != nil {
+				return err
+			}
+			devs = []byte{dev}
+		}
+		for _, d := range devs {
+			s.send(protocol.AllNotesOff(d))
+		}
+	default:
+		return errors.New("unknown address")
+	}
+	return nil
+}
+
+// forget forgets the notes held and the messages pending.
+func (s *Server) forget() {
+	clear(s.held)
+	s.pending = nil
+}
+
+// release sends a note-off for each note held, as Serve returns.
+func (s *Server) release() {
+	s.do(job{m: Message{Address: "/goppy/stop"}})
+	s.pending = nil
+}
+
+func (s *Server) played(dev byte) {
+	if i, ok := slices.BinarySearch(s.devices, dev); !ok {
+		s.devices = slices.Insert(s.devices, i, dev)
+	}
+}
+
+func (s *Server) send(m protocol.Message) {
+	if err := s.Out.Send(m); err != nil {
+		s.logf("send: %v", err)
+	}
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+	}
+}
+
+// drive reads the device and sub address args start with.
+func drive(args []any) (dev, sub byte, err error) {
+	if dev, err = byteArg(args[0], "device", 0, 255); err != nil {
+		return 0, 0, err
+	}
+	if sub, err = byteArg(args[1], "sub", 0, 255); err != nil {
+		return 0, 0, err
+	}
+	if !protocol.SubAddressOK(sub) {
+		return 0, 0, fmt.Errorf("sub %d isn't a drive's address", sub)
+	}
+	return dev, sub, nil
+}
+
+func byteArg(a any, what string, lo, hi float64) (byte, error) {
+	n, err := number(a)
+	if err != nil || n != math.Trunc(n) || n < lo || n > hi {
+		return 0, fmt.Errorf("%s: want %v to %v, not %v", what, lo, hi, a)
+	}
+	return byte(n), nil
+}
+
+// number returns the value of a numeric argument.
+func number(a any) (float64, error) {
+	switch a := a.(type) {
+	case int32:
+		return float64(a), nil
+	case int64:
+		return float64(a), nil
+	case float32:
+		return float64(a), nil
+	case float64:
+		return a, nil
+	}
+	return 0, fmt.Errorf("%v isn't a number", a)
+}
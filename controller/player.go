@@ -0,0 +1,813 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// Sender is where a Player or a Bridge sends its messages: a *Device, or
+// a recorder in tests.
+type Sender interface {
+	Send(m protocol.Message) error
+}
+
+// Player plays songs through a Sender in real time. Pause, Resume, Seek,
+// SeekBar, Mute, Solo, MuteDevice, SoloDevice, SetMapping, SetTempo and
+// Transpose may be called from any goroutine while Play runs, Progress
+// included, and Position, Paused, Muted, Soloed, Silenced, DeviceMuted,
+// DeviceSoloed, Tempo and Transposed to see where it is.
+type Player struct {
+	// Progress, if set, is called from Play with each event once it is
+	// played, whether or not it sent anything.
+	Progress func(ev Event)
+
+	// Bends says how pitch bends and bend ranges are passed on.
+	Bends BendOptions
+
+	// PresetRate is the most presets a second sent each channel's drives
+	// on its program changes: see mapping.Map.Preset. A program change
+	// sooner than that after the last is held back, as a bend is, and the
+	// latest held back sent once the rate allows, or before the channel's
+	// next note-on if that is sooner. 0 for DefaultPresetRate.
+	PresetRate int
+
+	// Loop, if On, is a section of the song Play plays over and over.
+	Loop Loop
+
+	// Devices, if set, says what each device takes: each is sent only the
+	// messages it does, a note-on without its velocity to a device that
+	// doesn't take velocity. nil sends every device everything.
+	Devices *DeviceRegistry
+
+	// Arrange is what Transpose does with the notes it moves outside
+	// their channel's range, as Arrange does for a song: StrategyShift
+	// leaves them to the firmware, as StrategyNone does, the song being
+	// shifted already.
+	Arrange mapping.Strategy
+
+	out     Sender
+	mapping *mapping.Map
+	clock   clock
+	follow  *ClockSync // Follow's, if any
+
+	mu        sync.Mutex
+	paused    bool
+	seek      *seekTarget   // where to go next, if anywhere
+	muted     [16]bool      // channels muted
+	soloed    [16]bool      // channels soloed
+	devMuted  [256]bool     // devices muted, by address
+	devSoloed [256]bool     // devices soloed, by address
+	remap     *mapping.Map  // SetMapping's, until Play takes it up
+	tempo     int           // percent of the song's tempo to play at
+	shift     int           // semitones to transpose by
+	at        time.Duration // the last event played, or seeked to
+	length    time.Duration // of the song playing
+	wake      chan struct{} // tells Play to look at paused, seek, mutes, solos, remap, tempo and shift
+}
+
+// The most a Player's tempo and transpose may be moved by.
+const (
+	MinTempo     = 25  // percent
+	MaxTempo     = 400 // percent
+	MaxTranspose = 24  // semitones, either way
+)
+
+// seekTarget is where a Seek or SeekBar goes.
+type seekTarget struct {
+	at  time.Duration
+	bar int // if not 0, at is worked out from it
+}
+
+// NewPlayer returns a Player sending to out, with channels mapped by m.
+func NewPlayer(out Sender, m *mapping.Map) *Player {
+	return &Player{out: out, mapping: m, clock: wallClock{}, tempo: 100, wake: make(chan struct{}, 1)}
+}
+
+// Pause silences the drives and holds the song where it is until Resume.
+// The firmware has no pause command, so the drives are silenced by
+// releasing the notes sounding and sending all notes off to each device.
+func (p *Player) Pause() {
+	p.mu.Lock()
+	p.paused = true
+	p.mu.Unlock()
+	p.signal()
+}
+
+// Resume plays on from where the song was paused, striking again the
+// notes that would still be sounding there.
+func (p *Player) Resume() {
+	p.mu.Lock()
+	p.paused = false
+	p.mu.Unlock()
+	p.signal()
+}
+
+// Seek moves the song to the offset to from its start. The drives are
+// silenced, then sent each channel's pitch bend, bend range, pedal and
+// pressure as they would be at to, and the notes that would be sounding
+// there, so the song plays on from mid-phrase. A paused song stays
+// paused, and is picked up at to when resumed.
+func (p *Player) Seek(to time.Duration) {
+	p.mu.Lock()
+	p.seek = &seekTarget{at: max(to, 0)}
+	p.mu.Unlock()
+	p.signal()
+}
+
+// SeekBar is Seek to the start of bar, counting from 1, as BarTime has it.
+func (p *Player) SeekBar(bar int) {
+	p.mu.Lock()
+	p.seek = &seekTarget{bar: max(bar, 1)}
+	p.mu.Unlock()
+	p.signal()
+}
+
+// Mute mutes a MIDI channel, from 0, or unmutes it. A muted channel's
+// notes sounding are released at once, and its notes to come dropped;
+// unmuted, it sounds again from its next note. Mutes last from song to
+// song.
+func (p *Player) Mute(channel byte, on bool) {
+	p.mu.Lock()
+	p.muted[channel&0x0F] = on
+	p.mu.Unlock()
+	p.signal()
+}
+
+// Muted reports whether channel is muted.
+func (p *Player) Muted(channel byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.muted[channel&0x0F]
+}
+
+// Solo solos a MIDI channel, from 0, or unsolos it. While any channel is
+// soloed, those that aren't are silenced as if muted, and sound again,
+// unless muted, once the last solo is cleared. A channel both muted and
+// soloed stays silent. Solos last from song to song, as mutes do.
+func (p *Player) Solo(channel byte, on bool) {
+	p.mu.Lock()
+	p.soloed[channel&0x0F] = on
+	p.mu.Unlock()
+	p.signal()
+}
+
+// Soloed reports whether channel is soloed.
+func (p *Player) Soloed(channel byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.soloed[channel&0x0F]
+}
+
+// Silenced reports whether channel's notes are dropped: it is muted, or
+// another channel is soloed and it isn't.
+func (p *Player) Silenced(channel byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	channels, _ := p.silenced()
+	return channels[channel&0x0F]
+}
+
+// MuteDevice mutes the device at address, or unmutes it, as Mute does a
+// channel: the notes sounding on its drives are released at once, and
+// those that would go to it after dropped, whatever their channel,
+// metronome clicks too. A note of a pool or stripe is dropped, not moved
+// to another device.
+func (p *Player) MuteDevice(address byte, on bool) {
+	p.mu.Lock()
+	p.devMuted[address] = on
+	p.mu.Unlock()
+	p.signal()
+}
+
+// DeviceMuted reports whether the device at address is muted.
+func (p *Player) DeviceMuted(address byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.devMuted[address]
+}
+
+// SoloDevice solos the device at address, or unsolos it, as Solo does a
+// channel: while any device is soloed, the others are silenced. Channel
+// and device solos stack: a note sounds only if neither its channel nor
+// its device is silenced.
+func (p *Player) SoloDevice(address byte, on bool) {
+	p.mu.Lock()
+	p.devSoloed[address] = on
+	p.mu.Unlock()
+	p.signal()
+}
+
+// DeviceSoloed reports whether the device at address is soloed.
+func (p *Player) DeviceSoloed(address byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.devSoloed[address]
+}
+
+// silenced returns the channels and devices whose notes are dropped, for
+// their mutes and solos. p.mu must be held.
+func (p *Player) silenced() (channels [16]bool, devices [256]bool) {
+	soloing := slices.Contains(p.soloed[:], true)
+	for ch := range channels {
+		channels[ch] = p.muted[ch] || soloing && !p.soloed[ch]
+	}
+	soloing = slices.Contains(p.devSoloed[:], true)
+	for d := range devices {
+		devices[d] = p.devMuted[d] || soloing && !p.devSoloed[d]
+	}
+	return channels, devices
+}
+
+// SetTempo plays on at percent of the song's tempo, 100 as written, from
+// the next event: on top of the song's own tempo changes, which still
+// come where they did. It is held to MinTempo to MaxTempo, and lasts from
+// song to song. Following a ClockSync, the song goes at the clock's tempo
+// whatever SetTempo says.
+func (p *Player) SetTempo(percent int) {
+	p.mu.Lock()
+	p.tempo = max(MinTempo, min(percent, MaxTempo))
+	p.mu.Unlock()
+	p.signal()
+}
+
+// Tempo returns the percent of the song's tempo it plays at.
+func (p *Player) Tempo() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.tempo
+}
+
+// Transpose moves the notes of every channel but the percussion's by
+// semitones from the next note-on, held to MaxTranspose either way. A
+// note it moves outside its channel's range goes as Arrange has it. The
+// notes sounding play on at their pitch until struck again. It lasts from
+// song to song.
+func (p *Player) Transpose(semitones int) {
+	p.mu.Lock()
+	p.shift = max(-MaxTranspose, min(semitones, MaxTranspose))
+	p.mu.Unlock()
+	p.signal()
+}
+
+// Transposed returns the semitones Transpose moves notes by.
+func (p *Player) Transposed() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.shift
+}
+
+// SetMapping routes channels by m from now on. Mid-song, the drives are
+// silenced, and the notes sounding struck again where m sends them, as
+// a seek to where the song is does. The song isn't arranged afresh for
+// m's drives.
+func (p *Player) SetMapping(m *mapping.Map) {
+	p.mu.Lock()
+	p.remap = m
+	p.mu.Unlock()
+	p.signal()
+}
+
+// Paused reports whether Pause holds the song.
+func (p *Player) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// Position returns how far Play is into its song, by the last event
+// played or the last seek, and the song's length, to its last event.
+func (p *Player) Position() (at, length time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.at, p.length
+}
+
+func (p *Player) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Play sends SequenceStart, then each event's message when it is due,
+// then SequenceStop. Events must be in time order, as ParseSMF returns
+// them. Each is due at its offset from when Play started, not from the
+// event before, so time spent sending, and a sleep that ran long, don't
+// add up over the song; an event already late is sent at once. Time
+// spent paused doesn't count, and a seek moves the song's start to suit.
+// At another tempo, SetTempo's, the offsets are scaled from where it was
+// set. Following a ClockSync, the offsets are taken by its clock, and
+// its start, stop, continue and song position pointer pause and seek the
+// song.
+//
+// A note struck again before it is released keeps sounding until the
+// last of its note-offs. Notes go where m sends them: see package
+// mapping. If ctx is done first, Play releases the notes still sounding,
+// sends all notes off to each device and SequenceStop, and returns ctx's
+// error.
+//
+// With a Loop, reaching its end the song goes back to its start, as jump
+// has it, until the loop's passes are done.
+//
+// Events at offsets below 0, as a count-in Clicks adds, play before the
+// song's start, which waits for them; following a ClockSync, which
+// counts from the song's start, they are skipped.
+func (p *Player) Play(ctx context.Context, events []Event) error {
+	if p.follow != nil {
+		p.follow.load(events)
+	}
+	p.mu.Lock()
+	p.paused, p.seek, p.at, p.length = false, nil, 0, 0
+	if len(events) > 0 {
+		p.length = events[len(events)-1].At
+	}
+	p.takeMapping()
+	scale := p.tempo
+	if p.follow != nil {
+		scale = 100
+	}
+	p.mu.Unlock()
+
+	pb := &playback{Player: p, events: events, loop: p.Loop, pass: 1, scale: scale}
+	pb.tr = pb.newTranslator()
+	stop := func(interrupted bool) error {
+		if interrupted {
+			if err := pb.silence(ctx); err != nil {
+				return err
+			}
+		} else {
+			for _, m := range pb.tr.release() {
+				if err := p.out.Send(m); err != nil {
+					return err
+				}
+			}
+		}
+		return p.out.Send(protocol.SequenceStop())
+	}
+	fail := func(err error) error {
+		if ctx.Err() != nil {
+			if serr := stop(true); serr != nil {
+				return serr
+			}
+		}
+		return err
+	}
+
+	if err := p.out.Send(protocol.SequenceStart()); err != nil {
+		return err
+	}
+	pb.start = p.clock.now()
+	if len(events) > 0 && events[0].At < 0 {
+		if p.follow != nil {
+			pb.next = firstAt(events, 0) // the clock counts from the song's start
+		} else {
+			pb.lead = events[0].At
+			pb.start = pb.start.Add(pb.wall(-pb.lead))
+		}
+	}
+	for {
+		i := pb.next
+		jump := pb.looping() && (i == len(events) || events[i].At >= pb.loop.End)
+		if i == len(events) && !jump {
+			break
+		}
+		var ev Event
+		at := pb.loop.End
+		if !jump {
+			ev = events[i]
+			at = ev.At
+		}
+		held := false
+		if t, ok := pb.tr.nextHeld(); ok && t < at {
+			at, held = t, true // a bend or preset held back by its rate limit goes first
+		}
+		err := p.clock.sleepUntil(ctx, pb.start.Add(pb.wall(at)), p.wake)
+		if errors.Is(err, errWoken) {
+			if err = pb.transport(ctx); err == nil {
+				continue // the next event may have changed
+			}
+		}
+		if err != nil {
+			return fail(err)
+		}
+		if held {
+			if _, err := pb.send(ctx, pb.tr.due(at)); err != nil {
+				return err
+			}
+			continue
+		}
+		if jump {
+			if err := pb.jump(ctx); err != nil {
+				return fail(err)
+			}
+			continue
+		}
+		resynced, err := pb.send(ctx, pb.tr.messages(ev))
+		if err != nil {
+			return fmt.Errorf("event %d: %w", i, err)
+		}
+		if resynced {
+			continue // play ev from the state rebuilt
+		}
+		pb.next++
+		p.mu.Lock()
+		p.at = ev.At
+		p.mu.Unlock()
+		if p.Progress != nil {
+			p.Progress(ev)
+		}
+	}
+	return stop(false)
+}
+
+// playback is where one call of Play is in its song.
+type playback struct {
+	*Player
+	events []Event
+	tr     *translator
+	start  time.Time     // when the song started, or would have, at scale
+	lead   time.Duration // where the song's count-in starts, below 0, or 0
+	scale  int           // the percent of the song's tempo it plays at
+	next   int           // the event to play next
+	loop   Loop
+	pass   int // through the loop, from 1
+}
+
+// wall returns how long d of the song takes to play, at its scale.
+func (pb *playback) wall(d time.Duration) time.Duration {
+	return d * 100 / time.Duration(pb.scale)
+}
+
+// songAt returns how far into the song it is at t.
+func (pb *playback) songAt(t time.Time) time.Duration {
+	return t.Sub(pb.start) * time.Duration(pb.scale) / 100
+}
+
+// transport applies the Pause, Resume, Seek, SeekBar, Mute, Solo,
+// MuteDevice, SoloDevice, SetMapping, SetTempo and Transpose calls made
+// since it last ran. Paused, it waits
+// until resumed or ctx is done.
+func (pb *playback) transport(ctx context.Context) error {
+	at := max(pb.songAt(pb.clock.now()), pb.lead)
+	seeked, moved, silent := false, false, false
+	for {
+		pb.mu.Lock()
+		paused, seek, remap := pb.paused, pb.seek, pb.remap != nil
+		channels, devices := pb.silenced()
+		tempo, shift := pb.tempo, pb.shift
+		pb.seek = nil
+		pb.mu.Unlock()
+		if pb.follow != nil {
+			tempo = 100 // the clock's tempo is the song's
+		}
+		pb.tr.shift = shift
+		if tempo != pb.scale {
+			// The song goes on from where it is, at the new tempo.
+			pb.scale = tempo
+			pb.start = pb.clock.now().Add(-pb.wall(at))
+		}
+		var lifted []protocol.Message
+		for ch, on := range channels {
+			if pb.tr.muted[ch] != on {
+				lifted = append(lifted, pb.tr.mute(byte(ch), on)...)
+			}
+		}
+		for d, on := range devices {
+			if pb.tr.devMuted[d] != on {
+				lifted = append(lifted, pb.tr.muteDevice(byte(d), on)...)
+			}
+		}
+		if _, err := pb.send(ctx, lifted); err != nil {
+			return err
+		}
+		if seek != nil {
+			at, seeked = seek.at, true
+			if seek.bar != 0 {
+				at = BarTime(pb.events, seek.bar)
+			}
+		}
+		if (paused || seek != nil || remap) && !silent {
+			if err := pb.silence(ctx); err != nil {
+				return err
+			}
+			moved, silent = true, true
+		}
+		if remap {
+			pb.mu.Lock()
+			pb.takeMapping()
+			pb.mu.Unlock()
+		}
+		if !paused {
+			break
+		}
+		select {
+		case <-pb.wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if !moved {
+		return nil
+	}
+
+	if seeked {
+		pb.next = firstAt(pb.events, at)
+		pb.mu.Lock()
+		pb.at = at
+		pb.mu.Unlock()
+	} // else pick up after the events already played
+	if _, err := pb.send(ctx, pb.restore()); err != nil {
+		return err
+	}
+	pb.start = pb.clock.now().Add(-pb.wall(at))
+	return nil
+}
+
+// restore starts a fresh translator and returns what puts the drives as
+// they would be after the events played so far: each channel's controls,
+// then the notes held.
+func (pb *playback) restore() []protocol.Message {
+	pb.tr = pb.newTranslator()
+	struck := make(map[heldNote]bool)
+	var msgs []protocol.Message
+	for _, ev := range stateAt(pb.events[:pb.next]) {
+		if ev.Kind == NoteOn {
+			k := heldNote{ev.Channel, ev.Note}
+			if struck[k] {
+				pb.tr.strike(ev) // held twice over: counted, not struck again
+				continue
+			}
+			struck[k] = true
+		}
+		msgs = append(msgs, pb.tr.messages(ev)...)
+	}
+	return msgs
+}
+
+// newTranslator returns a translator for the Player's mapping, devices,
+// bends, preset rate, mutes, solos and transpose.
+func (pb *playback) newTranslator() *translator {
+	tr := newTranslator(pb.mapping, pb.Bends)
+	tr.registry = pb.Devices
+	if pb.PresetRate > 0 {
+		tr.presets = newBendLimiter(pb.PresetRate)
+	}
+	tr.arrange = pb.Arrange
+	pb.mu.Lock()
+	tr.muted, tr.devMuted = pb.silenced()
+	tr.shift = pb.shift
+	pb.mu.Unlock()
+	return tr
+}
+
+// takeMapping puts SetMapping's mapping in place, if there is one. p.mu
+// must be held.
+func (p *Player) takeMapping() {
+	if p.remap != nil {
+		p.mapping, p.remap = p.remap, nil
+	}
+}
+
+// reconnector is a Sender that can get a lost link back, as a *Device
+// under Supervise does.
+type reconnector interface {
+	WaitConnected(ctx context.Context) error
+}
+
+// send sends msgs in order. If the link drops and out can get it back,
+// it waits for it with the song's clock stopped, then resyncs the
+// rebooted devices, SequenceStart and restore, and reports true: what
+// msgs were for is to be played again from there.
+func (pb *playback) send(ctx context.Context, msgs []protocol.Message) (resynced bool, err error) {
+	for _, m := range msgs {
+		if err := pb.out.Send(m); err != nil {
+			if err := pb.reconnect(ctx, err); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// reconnect waits out the lost link err reports and resyncs, returning
+// err if the link isn't one that comes back.
+func (pb *playback) reconnect(ctx context.Context, err error) error {
+	rc, ok := pb.out.(reconnector)
+	var lost *DisconnectedError
+	if !ok || !errors.As(err, &lost) {
+		return err
+	}
+	down := pb.clock.now()
+	for {
+		if err := rc.WaitConnected(ctx); err != nil {
+			return err
+		}
+		err = pb.out.Send(protocol.SequenceStart())
+		for _, m := range pb.restore() {
+			if err != nil {
+				break
+			}
+			err = pb.out.Send(m)
+		}
+		if err == nil {
+			break
+		}
+		if !errors.As(err, &lost) {
+			return err
+		}
+	}
+	if pb.follow == nil {
+		// Following a clock, the song keeps with it, and plays what it
+		// missed at once.
+		pb.start = pb.start.Add(pb.clock.now().Sub(down))
+	}
+	return nil
+}
+
+// silence releases the notes sounding and sends all notes off to each
+// device, again if the link was lost and resynced on the way.
+func (pb *playback) silence(ctx context.Context) error {
+	for {
+		msgs := pb.tr.release()
+		for _, dev := range pb.tr.devices() {
+			msgs = append(msgs, protocol.AllNotesOff(dev))
+		}
+		resynced, err := pb.send(ctx, msgs)
+		if err != nil || !resynced {
+			return err
+		}
+	}
+}
+
+// ActiveAt returns the notes of a song sounding at the offset at: the
+// note-ons before at not released before at, in the order struck. A note
+// struck again before it is released is in it once for each strike, and
+// each of its note-offs releases the earliest strike still held.
+func ActiveAt(events []Event, at time.Duration) []Event {
+	return holding(events[:firstAt(events, at)])
+}
+
+// firstAt returns the index of the first of events at or after at.
+func firstAt(events []Event, at time.Duration) int {
+	return sort.Search(len(events), func(i int) bool { return events[i].At >= at })
+}
+
+// holding returns the notes still held after events, as ActiveAt.
+func holding(events []Event) []Event {
+	var held []Event
+	for _, ev := range events {
+		switch ev.Kind {
+		case NoteOn:
+			held = append(held, ev)
+		case NoteOff:
+			for i, h := range held {
+				if h.Channel == ev.Channel && h.Note == ev.Note {
+					held = append(held[:i], held[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	return held
+}
+
+// stateAt returns what to send to pick a song up after played: each
+// channel's last program change, bend range, pitch bend, pedal and
+// pressure, then the notes still held.
+func stateAt(played []Event) []Event {
+	kinds := []EventKind{Program, BendRange, PitchBend, Sustain, Pressure}
+	var last [16][Program + 1]*Event
+	for i, ev := range played {
+		switch ev.Kind {
+		case Program, BendRange, PitchBend, Sustain, Pressure:
+			last[ev.Channel][ev.Kind] = &played[i]
+		}
+	}
+	var state []Event
+	for ch := range last {
+		for _, kind := range kinds {
+			if ev := last[ch][kind]; ev != nil {
+				state = append(state, *ev)
+			}
+		}
+	}
+	return append(state, holding(played)...)
+}
+
+// BarTime returns the offset of the start of bar, counting from 1, in a
+// song, through its tempo changes and time signatures: 4/4 at 120 BPM
+// until it says otherwise. A time signature part way through a bar starts
+// a new bar. Past the song's last tempo change or time signature, bars go
+// on at its tempo and in its time.
+func BarTime(events []Event, bar int) time.Duration {
+	const eps = 1e-9
+	var (
+		at       time.Duration
+		quarters float64          // quarter notes to at
+		tempo    float64 = 500000 // µs per quarter note
+		barNum           = 1
+		barStart float64     // quarter notes to barNum
+		barLen   float64 = 4 // in quarter notes
+	)
+	for _, ev := range events {
+		if ev.Kind != Tempo && ev.Kind != Meter {
+			continue
+		}
+		q := quarters + float64(ev.At-at)/1000/tempo
+		if barStart+float64(bar-barNum)*barLen <= q+eps {
+			break
+		}
+		at, quarters = ev.At, q
+		switch ev.Kind {
+		case Tempo:
+			if ev.Tempo > 0 {
+				tempo = float64(ev.Tempo)
+			}
+		case Meter:
+			if ev.Note == 0 || ev.Value == 0 {
+				continue
+			}
+			bars := int((quarters - barStart + eps) / barLen)
+			barNum += bars
+			barStart += float64(bars) * barLen
+			if quarters > barStart+eps {
+				barNum++
+				barStart = quarters
+			}
+			barLen = float64(ev.Note) * 4 / float64(ev.Value)
+		}
+	}
+	target := barStart + float64(bar-barNum)*barLen
+	return at + time.Duration((target-quarters)*tempo*1000+0.5)
+}
+
+// QuarterTime returns the offset of quarter note q, from 0, in a song,
+// through its tempo changes: 120 BPM until it says otherwise.
+func QuarterTime(events []Event, q float64) time.Duration {
+	var (
+		at       time.Duration
+		quarters float64          // quarter notes to at
+		tempo    float64 = 500000 // µs per quarter note
+	)
+	for _, ev := range events {
+		if ev.Kind != Tempo || ev.Tempo == 0 {
+			continue
+		}
+		next := quarters + float64(ev.At-at)/1000/tempo
+		if next > q {
+			break
+		}
+		at, quarters, tempo = ev.At, next, float64(ev.Tempo)
+	}
+	return at + time.Duration((q-quarters)*tempo*1000+0.5)
+}
+
+// errWoken is what clock.sleepUntil returns when woken early.
+var errWoken = errors.New("controller: woken")
+
+// clock is what a Player times events by: the wall clock, or a fake one
+// in tests.
+type clock interface {
+	now() time.Time
+	// sleepUntil returns at t, with errWoken if wake is signalled first,
+	// or with ctx's error once ctx is done.
+	sleepUntil(ctx context.Context, t time.Time, wake <-chan struct{}) error
+}
+
+type wallClock struct{}
+
+func (wallClock) now() time.Time { return time.Now() }
+
+func (wallClock) sleepUntil(ctx context.Context, t time.Time, wake <-chan struct{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-wake:
+		return errWoken
+	default:
+	}
+	d := time.Until(t)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-wake:
+		return errWoken
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
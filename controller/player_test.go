@@ -0,0 +1,296 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden timelines in testdata")
+
+// fakeClock only moves when slept on, or when a recorder's sends cost
+// time, so a song plays in no time and to the nanosecond. A sleep woken
+// returns at once, the clock where it was.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) sleepUntil(ctx context.Context, t time.Time, wake <-chan struct{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-wake:
+		return errWoken
+	default:
+	}
+	if t.After(c.t) {
+		c.t = t
+	}
+	return nil
+}
+
+// recorder is a Sender noting when each message went, each send taking
+// cost on the clock.
+type recorder struct {
+	clock  *fakeClock
+	cost   time.Duration
+	sent   []sentMessage
+	onSend func(n int)
+}
+
+type sentMessage struct {
+	at time.Duration
+	m  protocol.Message
+}
+
+func (r *recorder) Send(m protocol.Message) error {
+	r.sent = append(r.sent, sentMessage{r.clock.t.Sub(time.Time{}), m})
+	r.clock.t = r.clock.t.Add(r.cost)
+	if r.onSend != nil {
+		r.onSend(len(r.sent))
+	}
+	return nil
+}
+
+func newRecorder(m *mapping.Map) (*Player, *recorder) {
+	c := &fakeClock{}
+	r := &recorder{clock: c}
+	p := NewPlayer(r, m)
+	p.clock = c
+	return p, r
+}
+
+func (s sentMessage) String() string {
+	return fmt.Sprintf("%6dms  %02X/%02X %02X % X", s.at.Milliseconds(), s.m.Device, s.m.Sub, s.m.Command, s.m.Payload)
+}
+
+// TestFixtures plays each testdata/*.mid on channels 0..7 mapped to
+// drives 1..8 of device 1, and checks the messages sent and when against
+// the .txt beside it, one per line: milliseconds, device/sub, command and
+// payload. format0.mid has a note-on at velocity 0 ending a note, a pitch
+// bend and a channel left unmapped; format1.mid merges three tracks
+// through a tempo change, strikes a note again before releasing it, and
+// has a note after one track's end-of-track. Rewrite them with
+//
+//	go test -run TestFixtures -update
+func TestFixtures(t *testing.T) {
+	songs, err := filepath.Glob("testdata/*.mid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, song := range songs {
+		t.Run(filepath.Base(song), func(t *testing.T) {
+			events, err := ReadSMF(song)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, r := newRecorder(mapping.Channels(0x01, 1, 8))
+			if err := p.Play(context.Background(), events); err != nil {
+				t.Fatal(err)
+			}
+			var b strings.Builder
+			for _, s := range r.sent {
+				fmt.Fprintln(&b, strings.TrimRight(s.String(), " "))
+			}
+			got := b.String()
+
+			golden := strings.TrimSuffix(song, ".mid") + ".txt"
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("timeline differs from %s\n got:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
+
+// TestPresets plays testdata/presets/programs.mid through rig.yaml beside
+// it and checks the timeline against programs.txt, as TestFixtures does.
+// Channel 1 changes to program 30, growl, and strikes a note; at 500ms to
+// program 0, the default clean, then to 5 and 30 sooner than the 4 presets
+// a second allowed, so only growl goes, just before the note at 700ms. At
+// 1000ms program 7 goes at once, and 99, 100ms later, waits until 1250ms.
+// Channel 2's pool has growl spread over its two drives, then at 1100ms
+// program 12 takes the preset named default. Channel 3 has no drives.
+func TestPresets(t *testing.T) {
+	events, err := ReadSMF("testdata/presets/programs.mid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mapping.Load("testdata/presets/rig.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, r := newRecorder(m)
+	if err := p.Play(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	for _, s := range r.sent {
+		fmt.Fprintln(&b, strings.TrimRight(s.String(), " "))
+	}
+	got := b.String()
+
+	const golden = "testdata/presets/programs.txt"
+	if *update {
+		if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("timeline differs from %s\n got:\n%s\nwant:\n%s", golden, got, want)
+	}
+}
+
+// TestTempoTranspose doubles the tempo and moves up a tone 100ms in: the
+// song plays on from there twice as fast, its notes a tone higher and
+// folded into channel 2's range, but the note channel 1 holds sounds on at
+// its pitch until struck again.
+func TestTempoTranspose(t *testing.T) {
+	on := func(ms int, ch, note byte) Event {
+		return Event{At: time.Duration(ms) * time.Millisecond, Kind: NoteOn, Channel: ch, Note: note, Value: 100}
+	}
+	off := func(ms int, ch, note byte) Event {
+		return Event{At: time.Duration(ms) * time.Millisecond, Kind: NoteOff, Channel: ch, Note: note}
+	}
+	events := []Event{
+		on(0, 0, 48), on(0, 1, 60),
+		off(100, 1, 60),
+		on(200, 1, 62), off(300, 1, 62),
+		on(400, 1, 71),                  // 73 folds to 61
+		off(500, 1, 71), on(500, 0, 48), // struck again: at the new pitch
+		on(600, 1, 72), off(600, 0, 48),
+		off(650, 0, 48),
+		off(700, 1, 72),
+	}
+	m := mapping.Channels(0x01, 1, 2)
+	m.Channels[1].Range = mapping.Range{Low: 48, High: 72}
+	p, r := newRecorder(m)
+	p.Arrange = mapping.StrategyFold
+	r.onSend = func(n int) {
+		if n == 4 {
+			p.SetTempo(200)
+			p.Transpose(2)
+		}
+	}
+	if err := p.Play(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+	want := []sentMessage{
+		{0, protocol.SequenceStart()},
+		{0, protocol.NoteOnVelocity(0x01, 1, 48, 100)},
+		{0, protocol.NoteOnVelocity(0x01, 2, 60, 100)},
+		{100, protocol.NoteOff(0x01, 2, 60)},
+		{150, protocol.NoteOnVelocity(0x01, 2, 64, 100)},
+		{200, protocol.NoteOff(0x01, 2, 64)},
+		{250, protocol.NoteOnVelocity(0x01, 2, 61, 100)},
+		{300, protocol.NoteOff(0x01, 2, 61)},
+		{300, protocol.NoteOnVelocity(0x01, 1, 50, 100)},
+		{350, protocol.NoteOnVelocity(0x01, 2, 62, 100)},
+		{375, protocol.NoteOff(0x01, 1, 50)},
+		{400, protocol.NoteOff(0x01, 2, 62)},
+		{400, protocol.SequenceStop()},
+	}
+	for i := range want {
+		want[i].at *= time.Millisecond
+	}
+	if fmt.Sprint(r.sent) != fmt.Sprint(want) {
+		t.Errorf("sent\n%v\nwant\n%v", r.sent, want)
+	}
+
+	p.SetTempo(1000)
+	p.Transpose(-30)
+	if p.Tempo() != MaxTempo || p.Transposed() != -MaxTranspose {
+		t.Errorf("tempo %d%%, transposed %d: want them held to %d%% and %d", p.Tempo(), p.Transposed(), MaxTempo, -MaxTranspose)
+	}
+}
+
+// TestNoDrift sends a note every 10ms with each send taking 3ms: the
+// notes must still go out on the 10ms grid, not 3ms later each time.
+func TestNoDrift(t *testing.T) {
+	var events []Event
+	for i := range 1000 {
+		at := time.Duration(i) * 10 * time.Millisecond
+		events = append(events,
+			Event{At: at, Kind: NoteOn, Note: 60, Value: 100},
+			Event{At: at + 5*time.Millisecond, Kind: NoteOff, Note: 60})
+	}
+	p, r := newRecorder(mapping.Channels(0x01, 1, 1))
+	r.cost = 3 * time.Millisecond
+	if err := p.Play(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+	start := r.sent[0].at + r.cost // after SequenceStart
+	for i, s := range r.sent[1 : len(r.sent)-1] {
+		if want := start + events[i].At; s.at != want {
+			t.Fatalf("message %d sent at %v, want %v", i, s.at-start, want-start)
+		}
+	}
+}
+
+// TestCancel stops a song part way: the notes sounding are released, the
+// device silenced and the sequence stopped.
+func TestCancel(t *testing.T) {
+	events := []Event{
+		{At: 0, Kind: NoteOn, Channel: 0, Note: 60, Value: 100},
+		{At: 0, Kind: NoteOn, Channel: 1, Note: 64, Value: 100},
+		{At: time.Second, Kind: NoteOff, Channel: 0, Note: 60},
+		{At: time.Second, Kind: NoteOff, Channel: 1, Note: 64},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, r := newRecorder(mapping.Channels(0x01, 1, 2))
+	r.onSend = func(n int) {
+		if n == 3 {
+			cancel()
+		}
+	}
+	if err := p.Play(ctx, events); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	want := []protocol.Message{
+		protocol.SequenceStart(),
+		protocol.NoteOnVelocity(0x01, 1, 60, 100),
+		protocol.NoteOnVelocity(0x01, 2, 64, 100),
+		protocol.NoteOff(0x01, 1, 60),
+		protocol.NoteOff(0x01, 2, 64),
+		protocol.AllNotesOff(0x01),
+		protocol.SequenceStop(),
+	}
+	if len(r.sent) != len(want) {
+		t.Fatalf("sent %d messages, want %d: %v", len(r.sent), len(want), r.sent)
+	}
+	for i, s := range r.sent {
+		w := want[i]
+		if s.m.Device != w.Device || s.m.Sub != w.Sub || s.m.Command != w.Command || string(s.m.Payload) != string(w.Payload) {
+			t.Errorf("message %d: got %s, want %02X/%02X %02X % X", i, s, w.Device, w.Sub, w.Command, w.Payload)
+		}
+	}
+	if r.sent[len(r.sent)-1].m.Command != config.CmdSequenceStop {
+		t.Error("the sequence wasn't stopped")
+	}
+}
@@ -0,0 +1,428 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// Repeat says what a Playlist does at the end of a song.
+type Repeat byte
+
+const (
+	// RepeatNone plays each song once, then stops.
+	RepeatNone Repeat = iota
+	// RepeatAll starts the list again after its last song, reshuffled if
+	// shuffling.
+	RepeatAll
+	// RepeatOne plays the same song again until skipped.
+	RepeatOne
+)
+
+// ParseRepeat reads a Repeat from its name: none, all or one.
+func ParseRepeat(s string) (Repeat, error) {
+	switch s {
+	case "none":
+		return RepeatNone, nil
+	case "all":
+		return RepeatAll, nil
+	case "one":
+		return RepeatOne, nil
+	}
+	return 0, fmt.Errorf("unknown repeat mode %q: want none, all or one", s)
+}
+
+// Playlist plays songs one after another through a Player, for a show
+// left running. Next and Prev may be called from any goroutine while
+// Play runs, and State to see where it is.
+type Playlist struct {
+	// Gap is the wait between songs. Before it the drives are silenced:
+	// the Player has sent SequenceStop, and each device is sent all notes
+	// off.
+	Gap time.Duration
+
+	// Rehome re-homes every drive in the gap, so heads left at the end of
+	// their travel start the next song from the middle.
+	Rehome bool
+
+	// Shuffle plays the songs in an order drawn from Seed, drawn afresh
+	// for each pass under RepeatAll; the same Seed, the same orders.
+	Shuffle bool
+	Seed    uint64
+
+	Repeat Repeat
+
+	// Load reads a song; nil is ReadSMF. It may prepare the events for
+	// the Player too, as an arrangement does.
+	Load func(song string) ([]Event, error)
+
+	// Metronome, if On, is added to each song Load returns, as Clicks
+	// adds it, but for its count-in on the entries marked NoCountIn.
+	Metronome Metronome
+
+	// Started, if set, is called as each song starts, with the events
+	// Load returned. Skipped, if set, is called with each song that can't
+	// be loaded, and is passed over.
+	Started func(song string, events []Event)
+	Skipped func(song string, err error)
+
+	songs []PlaylistEntry
+
+	mu     sync.Mutex
+	rng    *rand.Rand
+	order  []int // indexes into songs, this pass
+	pos    int   // into order
+	pass   int
+	skip   int                // Next and Prev calls not acted on yet
+	cancel context.CancelFunc // stops the song playing, if one is
+	wake   chan struct{}      // cuts the gap short
+}
+
+// PlaylistState is where a Playlist is.
+type PlaylistState struct {
+	Song     string // being played, or just played, in the gap
+	Index    int    // of Song in the list as given
+	Position int    // of Song in this pass's order, the same as Index without Shuffle
+	Len      int    // songs in the list
+	Pass     int    // from 1; passes after the first are RepeatAll's
+}
+
+// PlaylistEntry is a song of a Playlist, and how it is played.
+type PlaylistEntry struct {
+	Song      string
+	NoCountIn bool // played without the Metronome's count-in
+}
+
+// NewPlaylist returns a Playlist of songs, played in the order given; see
+// ExpandPlaylist to build one from directories and M3U files.
+func NewPlaylist(songs []string) *Playlist {
+	entries := make([]PlaylistEntry, len(songs))
+	for i, song := range songs {
+		entries[i].Song = song
+	}
+	return NewPlaylistEntries(entries)
+}
+
+// NewPlaylistEntries returns a Playlist of entries, played in the order
+// given; see ExpandPlaylistEntries.
+func NewPlaylistEntries(entries []PlaylistEntry) *Playlist {
+	return &Playlist{songs: slices.Clone(entries), wake: make(chan struct{}, 1)}
+}
+
+// ExpandPlaylist returns the songs paths name, in order:
+//
+//   - a directory, its .mid and .midi files in name order;
+//   - a glob pattern, such as shows/*.mid, the files it matches in name
+//     order;
+//   - an .m3u or .m3u8 file, the songs it lists one to a line, paths
+//     relative to the file's directory, blank lines and # comments
+//     skipped;
+//   - anything else, itself.
+//
+// A file that doesn't exist is kept, to be skipped when played.
+func ExpandPlaylist(paths ...string) ([]string, error) {
+	entries, err := ExpandPlaylistEntries(paths...)
+	if err != nil {
+		return nil, err
+	}
+	songs := make([]string, len(entries))
+	for i, e := range entries {
+		songs[i] = e.Song
+	}
+	return songs, nil
+}
+
+// ExpandPlaylistEntries is ExpandPlaylist, but for the entries of M3U
+// files a line reading
+//
+//	#GOPPY:no-count-in
+//
+// marks as played without a count-in: the song on the next line.
+func ExpandPlaylistEntries(paths ...string) ([]PlaylistEntry, error) {
+	var songs []PlaylistEntry
+	add := func(paths ...string) {
+		for _, p := range paths {
+			songs = append(songs, PlaylistEntry{Song: p})
+		}
+	}
+	for _, path := range paths {
+		if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				if ext := strings.ToLower(filepath.Ext(e.Name())); !e.IsDir() && (ext == ".mid" || ext == ".midi") {
+					add(filepath.Join(path, e.Name()))
+				}
+			}
+			continue
+		}
+		if strings.ContainsAny(path, "*?[") {
+			matches, err := filepath.Glob(path)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("%s: no songs match", path)
+			}
+			add(matches...) // sorted by Glob
+			continue
+		}
+		if ext := strings.ToLower(filepath.Ext(path)); ext == ".m3u" || ext == ".m3u8" {
+			listed, err := readM3U(path)
+			if err != nil {
+				return nil, err
+			}
+			songs = append(songs, listed...)
+			continue
+		}
+		add(path)
+	}
+	return songs, nil
+}
+
+// noCountIn is the M3U line marking the next entry to play without a
+// count-in.
+const noCountIn = "#GOPPY:no-count-in"
+
+func readM3U(path string) ([]PlaylistEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var songs []PlaylistEntry
+	var next PlaylistEntry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(s.Text(), "\ufeff"))
+		if line == noCountIn {
+			next.NoCountIn = true
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(filepath.Dir(path), line)
+		}
+		next.Song = line
+		songs = append(songs, next)
+		next = PlaylistEntry{}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return songs, nil
+}
+
+// Next stops the song playing and moves on to the next, or cuts the gap
+// short and starts the song after the one just played.
+func (pl *Playlist) Next() { pl.move(1) }
+
+// Prev stops the song playing and goes back to the one before it, or
+// plays the first song again from the start.
+func (pl *Playlist) Prev() { pl.move(-1) }
+
+func (pl *Playlist) move(by int) {
+	pl.mu.Lock()
+	pl.skip += by
+	if pl.cancel != nil {
+		pl.cancel()
+	}
+	pl.mu.Unlock()
+	select {
+	case pl.wake <- struct{}{}:
+	default:
+	}
+}
+
+// State returns where the playlist is. Before Play it is at the first
+// song of the first pass.
+func (pl *Playlist) State() PlaylistState {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	s := PlaylistState{Index: pl.pos, Position: pl.pos, Len: len(pl.songs), Pass: max(pl.pass, 1)}
+	if pl.order != nil && pl.pos < len(pl.order) {
+		s.Index = pl.order[pl.pos]
+	}
+	if s.Index < len(pl.songs) {
+		s.Song = pl.songs[s.Index].Song
+	}
+	return s
+}
+
+// Play plays the songs through p until the last has played, or forever
+// under RepeatAll, with the Gap between songs. A song that can't be
+// loaded is reported to Skipped and passed over; Play fails if none can.
+// If ctx is done first, the song playing is stopped as Player.Play stops
+// it, and Play returns ctx's error; if the Player fails, Play returns its
+// error.
+func (pl *Playlist) Play(ctx context.Context, p *Player) error {
+	if len(pl.songs) == 0 {
+		return errors.New("controller: empty playlist")
+	}
+	load := pl.Load
+	if load == nil {
+		load = ReadSMF
+	}
+	pl.mu.Lock()
+	pl.rng = rand.New(rand.NewPCG(pl.Seed, pl.Seed))
+	pl.pos, pl.pass, pl.skip = 0, 0, 0
+	pl.shuffle()
+	pl.mu.Unlock()
+
+	dir, failed := 1, 0 // failed: songs in a row that wouldn't load
+	for {
+		pl.mu.Lock()
+		pl.pos += pl.skip // skipped while loading, or in the gap
+		if pl.skip != 0 {
+			dir = sign(pl.skip)
+		}
+		pl.skip = 0
+		if !pl.wrap() {
+			pl.mu.Unlock()
+			return nil
+		}
+		entry := pl.songs[pl.order[pl.pos]]
+		song := entry.Song
+		pl.mu.Unlock()
+
+		events, err := load(song)
+		if err != nil {
+			if pl.Skipped != nil {
+				pl.Skipped(song, err)
+			}
+			if failed++; failed >= len(pl.songs) {
+				return errors.New("controller: no song in the playlist can be played")
+			}
+			pl.mu.Lock()
+			if pl.pos+dir < 0 {
+				dir = 1 // nothing before the first song: on to the next
+			}
+			pl.pos += dir
+			pl.mu.Unlock()
+			continue
+		}
+		failed = 0
+		if mt := pl.Metronome; mt.On() {
+			if entry.NoCountIn {
+				mt.CountIn = 0
+			}
+			events = Clicks(events, mt)
+		}
+
+		songCtx, cancel := context.WithCancel(ctx)
+		pl.mu.Lock()
+		pl.cancel = cancel
+		if pl.skip != 0 {
+			cancel() // skipped before it started
+		}
+		pl.mu.Unlock()
+		if pl.Started != nil {
+			pl.Started(song, events)
+		}
+		err = p.Play(songCtx, events)
+		pl.mu.Lock()
+		pl.cancel = nil
+		pl.mu.Unlock()
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return fmt.Errorf("%s: %w", song, err)
+		}
+		pl.mu.Lock()
+		last := pl.Repeat == RepeatNone && pl.skip == 0 && pl.pos == len(pl.order)-1
+		pl.mu.Unlock()
+		if err := pl.gap(ctx, p, !last); err != nil {
+			return err
+		}
+
+		pl.mu.Lock()
+		if pl.skip == 0 && pl.Repeat != RepeatOne {
+			pl.pos++
+			dir = 1
+		}
+		pl.mu.Unlock()
+	}
+}
+
+// wrap keeps pos in the list: before the first song it is the first, and
+// past the last it starts a new pass under RepeatAll. It reports false,
+// at the last song, if the list is done.
+func (pl *Playlist) wrap() bool {
+	pl.pos = max(pl.pos, 0)
+	if pl.pos < len(pl.order) {
+		return true
+	}
+	if pl.Repeat != RepeatAll {
+		pl.pos = len(pl.order) - 1 // where the show ended
+		return false
+	}
+	pl.pos = 0
+	pl.shuffle()
+	return true
+}
+
+// shuffle starts a pass: the songs in order, or shuffled.
+func (pl *Playlist) shuffle() {
+	pl.pass++
+	pl.order = make([]int, len(pl.songs))
+	for i := range pl.order {
+		pl.order[i] = i
+	}
+	if pl.Shuffle {
+		pl.rng.Shuffle(len(pl.order), func(i, j int) {
+			pl.order[i], pl.order[j] = pl.order[j], pl.order[i]
+		})
+	}
+}
+
+// gap silences every device p plays on, re-homes their drives if asked
+// to, and if wait, waits out the Gap, or until Next or Prev.
+func (pl *Playlist) gap(ctx context.Context, p *Player, wait bool) error {
+	for _, dev := range p.mapping.Devices() {
+		if err := p.out.Send(protocol.AllNotesOff(dev)); err != nil {
+			return err
+		}
+		if pl.Rehome {
+			if err := p.out.Send(protocol.DriveReset(dev, 0)); err != nil {
+				return err
+			}
+		}
+	}
+	select {
+	case <-pl.wake: // from a skip acted on already
+	default:
+	}
+	pl.mu.Lock()
+	skipped := pl.skip != 0
+	pl.mu.Unlock()
+	if !wait || skipped || pl.Gap <= 0 {
+		return nil
+	}
+	err := p.clock.sleepUntil(ctx, p.clock.now().Add(pl.Gap), pl.wake)
+	if errors.Is(err, errWoken) {
+		return nil
+	}
+	return err
+}
+
+func sign(n int) int {
+	if n < 0 {
+		return -1
+	}
+	return 1
+}
@@ -0,0 +1,248 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+func TestExpandPlaylist(t *testing.T) {
+	dir := t.TempDir()
+	show := filepath.Join(dir, "show")
+	if err := os.Mkdir(show, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"show/b.mid", "show/a.MID", "show/c.midi", "show/notes.txt", "d.mid", "e.mid"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := filepath.Join(dir, "list.m3u")
+	m3u := "\ufeff#EXTM3U\n# encores\ne.mid\n\n#GOPPY:no-count-in\n  show/b.mid  \n/songs/abs.mid\n"
+	if err := os.WriteFile(list, []byte(m3u), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ExpandPlaylist(show, filepath.Join(dir, "*.mid"), list, "nosuch.mid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(show, "a.MID"), filepath.Join(show, "b.mid"), filepath.Join(show, "c.midi"),
+		filepath.Join(dir, "d.mid"), filepath.Join(dir, "e.mid"),
+		filepath.Join(dir, "e.mid"), filepath.Join(show, "b.mid"), "/songs/abs.mid",
+		"nosuch.mid",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got\n%q\nwant\n%q", got, want)
+	}
+	entries, err := ExpandPlaylistEntries(list, "d.mid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var marked []string
+	for _, e := range entries {
+		if e.NoCountIn {
+			marked = append(marked, e.Song)
+		}
+	}
+	if len(entries) != 4 || !slices.Equal(marked, []string{filepath.Join(show, "b.mid")}) {
+		t.Errorf("entries %+v, want only show/b.mid without a count-in", entries)
+	}
+	if _, err := ExpandPlaylist(filepath.Join(dir, "*.xm")); err == nil {
+		t.Error("a glob matching nothing expanded")
+	}
+	if _, err := ExpandPlaylist(filepath.Join(dir, "nosuch.m3u")); err == nil {
+		t.Error("a missing M3U file expanded")
+	}
+}
+
+// showSongs loads each song as a one-second note, a different note for
+// each, and fails to load songs named bad.
+func showSongs(song string) ([]Event, error) {
+	if strings.HasPrefix(song, "bad") {
+		return nil, errors.New("not a MIDI file")
+	}
+	note := 60 + song[0] - 'a'
+	return []Event{
+		{At: 0, Kind: NoteOn, Note: note, Value: 100},
+		{At: time.Second, Kind: NoteOff, Note: note},
+	}, nil
+}
+
+// newShow returns a Playlist of songs loaded by showSongs, noting the
+// songs started and skipped, and a Player on a recorder for it.
+func newShow(songs ...string) (*Playlist, *Player, *recorder, *[]string) {
+	pl := NewPlaylist(songs)
+	pl.Load = showSongs
+	var log []string
+	pl.Started = func(song string, _ []Event) { log = append(log, song) }
+	pl.Skipped = func(song string, err error) { log = append(log, fmt.Sprintf("skipped %s: %v", song, err)) }
+	p, r := newRecorder(mapping.Channels(0x01, 1, 1))
+	return pl, p, r, &log
+}
+
+// TestPlaylistGap plays two songs in order with a gap that silences and
+// re-homes the drives.
+func TestPlaylistGap(t *testing.T) {
+	pl, p, r, log := newShow("a.mid", "b.mid")
+	pl.Gap = 3 * time.Second
+	pl.Rehome = true
+	if err := pl.Play(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(*log, []string{"a.mid", "b.mid"}) {
+		t.Errorf("played %q", *log)
+	}
+	song := func(at time.Duration, note byte) []sentMessage {
+		return []sentMessage{
+			{at, protocol.SequenceStart()},
+			{at, protocol.NoteOnVelocity(0x01, 1, note, 100)},
+			{at + time.Second, protocol.NoteOff(0x01, 1, note)},
+			{at + time.Second, protocol.SequenceStop()},
+			{at + time.Second, protocol.AllNotesOff(0x01)},
+			{at + time.Second, protocol.DriveReset(0x01, 0)},
+		}
+	}
+	want := append(song(0, 60), song(4*time.Second, 61)...)
+	if fmt.Sprint(r.sent) != fmt.Sprint(want) {
+		t.Errorf("sent:\n%v\nwant:\n%v", r.sent, want)
+	}
+	if s := pl.State(); s.Song != "b.mid" || s.Index != 1 || s.Len != 2 || s.Pass != 1 {
+		t.Errorf("state at the end %+v, want on b.mid, the second of 2", s)
+	}
+}
+
+// TestPlaylistCountIn counts in each song of the playlist but the one
+// marked not to be: two beats at 120 BPM, delaying its start a second.
+func TestPlaylistCountIn(t *testing.T) {
+	pl := NewPlaylistEntries([]PlaylistEntry{{Song: "a.mid"}, {Song: "b.mid", NoCountIn: true}, {Song: "c.mid"}})
+	pl.Load = showSongs
+	pl.Metronome = Metronome{CountIn: 2}
+	m := mapping.Channels(0x01, 1, 1)
+	m.Metronome.Click = mapping.Click{Hit: mapping.Hit{Target: mapping.Target{Device: 0x02, Sub: 1}, Reset: true}}
+	p, r := newRecorder(m)
+	if err := pl.Play(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range r.sent {
+		switch s.m.Command {
+		case config.DevCmdReset:
+			got = append(got, fmt.Sprintf("click %v", s.at))
+		case config.DevCmdNoteOn:
+			got = append(got, fmt.Sprintf("note %d %v", s.m.Payload[0], s.at))
+		}
+	}
+	want := []string{
+		"click 0s", "click 500ms", "note 60 1s",
+		"note 61 2s",
+		"click 3s", "click 3.5s", "note 62 4s",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("played %q, want %q", got, want)
+	}
+}
+
+// TestPlaylistShuffle plays two passes of a shuffled list under
+// RepeatAll: each pass plays every song once, and the same seed plays
+// the same orders.
+func TestPlaylistShuffle(t *testing.T) {
+	songs := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	passes := func(seed uint64) []string {
+		pl, p, _, log := newShow(songs...)
+		pl.Shuffle, pl.Seed, pl.Repeat = true, seed, RepeatAll
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		pl.Started = func(song string, _ []Event) {
+			*log = append(*log, song)
+			if len(*log) == 2*len(songs) {
+				cancel()
+			}
+		}
+		if err := pl.Play(ctx, p); !errors.Is(err, context.Canceled) {
+			t.Fatalf("seed %d: %v, want it stopped", seed, err)
+		}
+		if s := pl.State(); s.Pass != 2 || s.Position != len(songs)-1 {
+			t.Errorf("seed %d: stopped at %+v, want the last of pass 2", seed, s)
+		}
+		return *log
+	}
+
+	got := passes(1442)
+	for i := 0; i < len(got); i += len(songs) {
+		pass := slices.Sorted(slices.Values(got[i : i+len(songs)]))
+		if !slices.Equal(pass, songs) {
+			t.Errorf("pass %d played %q, want each song once", i/len(songs)+1, got[i:i+len(songs)])
+		}
+	}
+	if slices.Equal(got[:len(songs)], songs) || slices.Equal(got[:len(songs)], got[len(songs):]) {
+		t.Errorf("played %q: want each pass shuffled afresh", got)
+	}
+	if again := passes(1442); !slices.Equal(again, got) {
+		t.Errorf("seed 1442 played\n%q\nthen\n%q", got, again)
+	}
+	if other := passes(1443); slices.Equal(other, got) {
+		t.Errorf("seeds 1442 and 1443 both played %q", got)
+	}
+}
+
+// TestPlaylistSkipsBadSongs passes over songs that don't load, and stops
+// a show of none that do.
+func TestPlaylistSkipsBadSongs(t *testing.T) {
+	pl, p, r, log := newShow("a.mid", "bad.mid", "bad2.mid", "b.mid")
+	if err := pl.Play(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a.mid", "skipped bad.mid: not a MIDI file", "skipped bad2.mid: not a MIDI file", "b.mid"}
+	if !slices.Equal(*log, want) {
+		t.Errorf("got\n%q\nwant\n%q", *log, want)
+	}
+	if n := len(r.sent); n != 10 {
+		t.Errorf("sent %d messages, want 10 for two songs", n)
+	}
+
+	pl, p, _, _ = newShow("bad.mid", "bad2.mid")
+	pl.Repeat = RepeatAll
+	if err := pl.Play(context.Background(), p); err == nil {
+		t.Error("played a show of songs that don't load")
+	}
+}
+
+// TestPlaylistSkip skips forward out of the first song as it starts, back
+// out of the second, and then lets the show play to the end.
+func TestPlaylistSkip(t *testing.T) {
+	pl, p, r, log := newShow("a.mid", "b.mid", "c.mid")
+	pl.Gap = time.Second
+	starts := 0
+	pl.Started = func(song string, _ []Event) {
+		*log = append(*log, song)
+		switch starts++; starts {
+		case 1:
+			pl.Next()
+		case 2:
+			pl.Prev()
+		}
+	}
+	if err := pl.Play(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.mid", "b.mid", "a.mid", "b.mid", "c.mid"}; !slices.Equal(*log, want) {
+		t.Errorf("played %q, want %q", *log, want)
+	}
+	// The two songs skipped are silenced with no gap, the three played
+	// through have one each but the last.
+	if end := r.sent[len(r.sent)-1].at; end != 5*time.Second {
+		t.Errorf("show ended at %v, want 5s", end)
+	}
+}
@@ -0,0 +1,582 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// Capabilities are the optional commands a device takes, as the caps of
+// its pong name them: see config.CmdPong.
+type Capabilities uint16
+
+// The optional commands, as config's Cap bits.
+const (
+	CapVelocity  = Capabilities(config.CapVelocity)
+	CapBendRange = Capabilities(config.CapBendRange)
+	CapTuning    = Capabilities(config.CapTuning)
+	CapTremolo   = Capabilities(config.CapTremolo)
+	CapPressure  = Capabilities(config.CapPressure)
+	CapSustain   = Capabilities(config.CapSustain)
+	CapGliss     = Capabilities(config.CapGliss)
+	CapTrill     = Capabilities(config.CapTrill)
+	CapZones     = Capabilities(config.CapZones)
+	CapTravel    = Capabilities(config.CapTravel)
+	CapOptions   = Capabilities(config.CapOptions)
+	CapConfig    = Capabilities(config.CapConfig)
+	CapPositions = Capabilities(config.CapPositions)
+	CapStatus    = Capabilities(config.CapStatus)
+)
+
+// LegacyCapabilities are what a device answering with a pong without caps,
+// as Moppy's firmware does, is taken to take: none of the optional
+// commands.
+const LegacyCapabilities Capabilities = 0
+
+// AllCapabilities are every optional command, what a device no ping has
+// been answered for is taken to take.
+const AllCapabilities = CapVelocity | CapBendRange | CapTuning | CapTremolo | CapPressure | CapSustain |
+	CapGliss | CapTrill | CapZones | CapTravel | CapOptions | CapConfig | CapPositions | CapStatus
+
+var capNames = []struct {
+	cap  Capabilities
+	name string
+}{
+	{CapVelocity, "velocity"},
+	{CapBendRange, "bend range"},
+	{CapTuning, "tuning"},
+	{CapTremolo, "tremolo"},
+	{CapPressure, "pressure"},
+	{CapSustain, "sustain"},
+	{CapGliss, "gliss"},
+	{CapTrill, "trill"},
+	{CapZones, "zones"},
+	{CapTravel, "travel"},
+	{CapOptions, "options"},
+	{CapConfig, "config"},
+	{CapPositions, "positions"},
+	{CapStatus, "status"},
+}
+
+// DecodeCapabilities decodes the caps in a pong's payload past the drive
+// range, DeviceInfo.Extra: LegacyCapabilities if there are none.
+func DecodeCapabilities(extra []byte) Capabilities {
+	if len(extra) < 2 {
+		return LegacyCapabilities
+	}
+	return Capabilities(extra[0])<<8 | Capabilities(extra[1])
+}
+
+// Has reports whether c takes every command of want.
+func (c Capabilities) Has(want Capabilities) bool { return c&want == want }
+
+// String lists the commands c takes, as "velocity, tremolo", or says
+// "none".
+func (c Capabilities) String() string {
+	var names []string
+	for _, n := range capNames {
+		if c.Has(n.cap) {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// capOf is the Capabilities a device command needs, if it is optional.
+var capOf = map[byte]Capabilities{
+	config.DevCmdBendRange:       CapBendRange,
+	config.DevCmdTranspose:       CapTuning,
+	config.DevCmdDetune:          CapTuning,
+	config.DevCmdTremolo:         CapTremolo,
+	config.DevCmdChannelPressure: CapPressure,
+	config.DevCmdSustain:         CapSustain,
+	config.DevCmdGliss:           CapGliss,
+	config.DevCmdTrill:           CapTrill,
+	config.DevCmdSetZone:         CapZones,
+	config.DevCmdSetTravel:       CapTravel,
+	config.DevCmdSetOption:       CapOptions,
+}
+
+// adapt returns m as a device with c takes it, or false if it doesn't: a
+// note-on loses its velocity, and an optional command it doesn't take is
+// dropped.
+func (c Capabilities) adapt(m protocol.Message) (protocol.Message, bool) {
+	if m.Device == config.SystemAddress {
+		return m, true
+	}
+	if m.Command == config.DevCmdNoteOn && len(m.Payload) > 1 && !c.Has(CapVelocity) {
+		m.Payload = m.Payload[:1]
+	}
+	need, ok := capOf[m.Command]
+	return m, !ok || c.Has(need)
+}
+
+// needs returns the optional commands a device must take to be sent m as
+// it is: none for a system message.
+func needs(m protocol.Message) Capabilities {
+	if m.Device == config.SystemAddress {
+		return 0
+	}
+	need := capOf[m.Command]
+	if m.Command == config.DevCmdNoteOn && len(m.Payload) > 1 {
+		need |= CapVelocity
+	}
+	return need
+}
+
+// DeviceRegistry holds every device found, by address, merging what
+// serial scans, UDP discovery and mDNS report of them into one view, so
+// that a Player or a Bridge sends each device only what it takes, and
+// through whichever link reaches it. Its methods may be called from
+// several goroutines.
+//
+// An address belongs to one claim at a time, the Sighting it was first
+// heard through. When another transport, or another port, claims the
+// same address, the claim holding it keeps it: the other is kept in
+// Conflicts, and reported once as a DeviceConflict. It takes the address
+// over, and is reported again, only if Prefer names its transport and not
+// the holder's, or once the holder is lost and it answers.
+type DeviceRegistry struct {
+	mu      sync.Mutex
+	devices map[byte]*RegisteredDevice
+	hints   map[byte]mapping.Transport
+	links   map[*Device]Sighting // the Transport and Where of each link merged
+	status  map[byte]DeviceStatus
+	subs    map[int]func(RegistryEvent)
+	nextSub int
+	now     func() time.Time
+}
+
+// NewDeviceRegistry returns an empty DeviceRegistry.
+func NewDeviceRegistry() *DeviceRegistry {
+	return &DeviceRegistry{
+		devices: make(map[byte]*RegisteredDevice),
+		hints:   make(map[byte]mapping.Transport),
+		links:   make(map[*Device]Sighting),
+		status:  make(map[byte]DeviceStatus),
+		subs:    make(map[int]func(RegistryEvent)),
+		now:     time.Now,
+	}
+}
+
+// Sighting is a device's answer to a ping, and where it came from.
+type Sighting struct {
+	DeviceInfo
+	Transport mapping.Transport
+	Where     string  // the port or group it answered on, as "/dev/ttyUSB0"
+	Link      *Device // what reaches it; nil for one only heard of, as over mDNS
+}
+
+// sameClaim reports whether s and o are the same device heard again.
+func (s Sighting) sameClaim(o Sighting) bool {
+	return s.Transport == o.Transport && s.Where == o.Where
+}
+
+// Sightings returns the devices that answered over link, as Discover
+// returns them, as Sightings for Merge.
+func Sightings(t mapping.Transport, where string, link *Device, found ...DeviceInfo) []Sighting {
+	s := make([]Sighting, len(found))
+	for i, d := range found {
+		s[i] = Sighting{DeviceInfo: d, Transport: t, Where: where, Link: link}
+	}
+	return s
+}
+
+// ScanSightings returns the devices ScanAll found as Sightings for Merge,
+// leaving out the ports it couldn't open. A scan closes the ports it
+// pings, so they have no Link.
+func ScanSightings(found []FoundDevice) []Sighting {
+	var s []Sighting
+	for _, f := range found {
+		if f.Err == nil {
+			s = append(s, Sighting{DeviceInfo: f.DeviceInfo, Transport: mapping.TransportSerial, Where: f.Port})
+		}
+	}
+	return s
+}
+
+// RegisteredDevice is what a DeviceRegistry knows of an address.
+type RegisteredDevice struct {
+	Sighting // the claim holding the address
+
+	// Alive is cleared once the holder misses its pings: see Watch.
+	Alive    bool
+	LastSeen time.Time
+
+	// Conflicts are the other claims to the address, by other transports
+	// or ports, as last heard.
+	Conflicts []Sighting
+}
+
+func (d *RegisteredDevice) clone() RegisteredDevice {
+	c := *d
+	c.Conflicts = slices.Clone(d.Conflicts)
+	return c
+}
+
+// RegistryEventKind is what changed of a device in a DeviceRegistry.
+type RegistryEventKind int
+
+const (
+	DeviceFound    RegistryEventKind = iota // an address answered for the first time
+	DeviceLost                              // its holder missed its pings
+	DeviceBack                              // a lost holder answered again
+	DeviceConflict                          // another claim to the address: see DeviceRegistry
+)
+
+var registryEventNames = [...]string{"found", "lost", "back", "conflict"}
+
+func (k RegistryEventKind) String() string {
+	if k < 0 || int(k) >= len(registryEventNames) {
+		return fmt.Sprintf("RegistryEventKind(%d)", int(k))
+	}
+	return registryEventNames[k]
+}
+
+// RegistryEvent is a change Subscribe reports.
+type RegistryEvent struct {
+	Kind   RegistryEventKind
+	Device RegisteredDevice // as it is after the change
+
+	// Other is, for a DeviceConflict, the claim not holding the address:
+	// the newcomer, or the holder it took the address from.
+	Other Sighting
+}
+
+// Add notes the devices that answered a ping, in place of what was known
+// of the same addresses. It leaves which claim holds each address as it
+// was: a device only Added is taken over by the first Sighting merged.
+func (r *DeviceRegistry) Add(found ...DeviceInfo) {
+	r.mu.Lock()
+	var events []RegistryEvent
+	for _, info := range found {
+		if d, ok := r.devices[info.Address]; ok {
+			d.DeviceInfo = info
+			continue
+		}
+		d := &RegisteredDevice{Sighting: Sighting{DeviceInfo: info}, Alive: true, LastSeen: r.now()}
+		r.devices[info.Address] = d
+		events = append(events, RegistryEvent{Kind: DeviceFound, Device: d.clone()})
+	}
+	r.mu.Unlock()
+	r.notify(events)
+}
+
+// Merge notes the devices seen, by any transport, resolving two claims to
+// one address as DeviceRegistry says. A claim heard again refreshes it.
+func (r *DeviceRegistry) Merge(found ...Sighting) {
+	r.mu.Lock()
+	var events []RegistryEvent
+	for _, s := range found {
+		events = append(events, r.merge(s)...)
+	}
+	r.mu.Unlock()
+	r.notify(events)
+}
+
+// merge notes s, with r.mu held, and returns what changed.
+func (r *DeviceRegistry) merge(s Sighting) []RegistryEvent {
+	now := r.now()
+	if s.Link != nil {
+		r.links[s.Link] = Sighting{Transport: s.Transport, Where: s.Where}
+	}
+	d, ok := r.devices[s.Address]
+	switch {
+	case !ok:
+		d = &RegisteredDevice{Sighting: s, Alive: true, LastSeen: now}
+		r.devices[s.Address] = d
+		return []RegistryEvent{{Kind: DeviceFound, Device: d.clone()}}
+	case d.sameClaim(s) || d.Transport == mapping.TransportAny && d.Where == "":
+		back := !d.Alive
+		d.Sighting, d.Alive, d.LastSeen = s, true, now
+		if back {
+			return []RegistryEvent{{Kind: DeviceBack, Device: d.clone()}}
+		}
+		return nil
+	}
+	i := slices.IndexFunc(d.Conflicts, s.sameClaim)
+	known := i >= 0
+	if known {
+		d.Conflicts[i] = s
+	} else {
+		i = len(d.Conflicts)
+		d.Conflicts = append(d.Conflicts, s)
+	}
+	if r.takesOver(d, s) {
+		held := d.Sighting
+		d.Sighting, d.Alive, d.LastSeen = s, true, now
+		d.Conflicts[i] = held
+		return []RegistryEvent{{Kind: DeviceConflict, Device: d.clone(), Other: held}}
+	}
+	if !known {
+		return []RegistryEvent{{Kind: DeviceConflict, Device: d.clone(), Other: s}}
+	}
+	return nil
+}
+
+// takesOver reports whether s, another claim to d's address, takes it
+// from d's holder.
+func (r *DeviceRegistry) takesOver(d *RegisteredDevice, s Sighting) bool {
+	if h := r.hints[d.Address]; h != mapping.TransportAny && (s.Transport == h) != (d.Transport == h) {
+		return s.Transport == h
+	}
+	return !d.Alive
+}
+
+// Prefer hints that the device at address is to be reached over t, as a
+// mapping's transports section says, or over whichever claims it first
+// for TransportAny. A claim over t already in Conflicts takes the address
+// over at once.
+func (r *DeviceRegistry) Prefer(address byte, t mapping.Transport) {
+	r.mu.Lock()
+	var events []RegistryEvent
+	if t == mapping.TransportAny {
+		delete(r.hints, address)
+	} else {
+		r.hints[address] = t
+	}
+	if d, ok := r.devices[address]; ok && t != mapping.TransportAny && d.Transport != t {
+		if i := slices.IndexFunc(d.Conflicts, func(s Sighting) bool { return s.Transport == t }); i >= 0 {
+			held := d.Sighting
+			d.Sighting, d.Conflicts[i] = d.Conflicts[i], held
+			events = append(events, RegistryEvent{Kind: DeviceConflict, Device: d.clone(), Other: held})
+		}
+	}
+	r.mu.Unlock()
+	r.notify(events)
+}
+
+// Heard notes m, a message read from link, as one of the Devices merged
+// with it: a pong refreshes its device, a status is kept for Status, and
+// anything else is ignored. Whoever reads a link's Messages passes them
+// here for Watch to see devices answer.
+func (r *DeviceRegistry) Heard(link *Device, m protocol.Message) {
+	if st, ok := statusInfo(m); ok {
+		r.mu.Lock()
+		st.At = r.now()
+		r.status[m.Payload[0]] = st
+		r.mu.Unlock()
+		return
+	}
+	info, ok := pongInfo(m)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	where, known := r.links[link]
+	var events []RegistryEvent
+	if known {
+		where.DeviceInfo, where.Link = info, link
+		events = r.merge(where)
+	}
+	r.mu.Unlock()
+	r.notify(events)
+}
+
+// Watch pings every link merged each interval, and marks lost each device
+// whose holder hasn't answered, as passed to Heard, within timeout. It
+// returns ctx's error once ctx is done.
+func (r *DeviceRegistry) Watch(ctx context.Context, every, timeout time.Duration) error {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		r.ping()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+		r.expire(timeout)
+	}
+}
+
+// ping pings every link merged. One that fails has its devices lost in
+// time.
+func (r *DeviceRegistry) ping() {
+	r.mu.Lock()
+	links := slices.Collect(maps.Keys(r.links))
+	r.mu.Unlock()
+	for _, l := range links {
+		l.Send(protocol.Ping())
+	}
+}
+
+// expire marks lost the devices with a link not heard from within
+// timeout.
+func (r *DeviceRegistry) expire(timeout time.Duration) {
+	r.mu.Lock()
+	now := r.now()
+	var events []RegistryEvent
+	for _, a := range slices.Sorted(maps.Keys(r.devices)) {
+		if d := r.devices[a]; d.Link != nil && d.Alive && now.Sub(d.LastSeen) > timeout {
+			d.Alive = false
+			events = append(events, RegistryEvent{Kind: DeviceLost, Device: d.clone()})
+		}
+	}
+	r.mu.Unlock()
+	r.notify(events)
+}
+
+// Subscribe calls fn with every change from now on, in order, until
+// cancel is called. fn is called on the goroutine that noted the change,
+// and mustn't call the DeviceRegistry's methods that change it.
+func (r *DeviceRegistry) Subscribe(fn func(RegistryEvent)) (cancel func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id := r.nextSub
+	r.nextSub++
+	r.subs[id] = fn
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.subs, id)
+	}
+}
+
+func (r *DeviceRegistry) notify(events []RegistryEvent) {
+	if len(events) == 0 {
+		return
+	}
+	r.mu.Lock()
+	subs := make([]func(RegistryEvent), 0, len(r.subs))
+	for _, id := range slices.Sorted(maps.Keys(r.subs)) {
+		subs = append(subs, r.subs[id])
+	}
+	r.mu.Unlock()
+	for _, ev := range events {
+		for _, fn := range subs {
+			fn(ev)
+		}
+	}
+}
+
+// Device returns what the device at address said of itself, if it has
+// answered.
+func (r *DeviceRegistry) Device(address byte) (DeviceInfo, bool) {
+	d, ok := r.Registered(address)
+	return d.DeviceInfo, ok
+}
+
+// Registered returns all the DeviceRegistry knows of the device at
+// address, if it has answered.
+func (r *DeviceRegistry) Registered(address byte) (RegisteredDevice, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.devices[address]
+	if !ok {
+		return RegisteredDevice{}, false
+	}
+	return d.clone(), true
+}
+
+// Status returns the last status the device at address reported, as
+// passed to Heard, if it has reported one: see protocol.GetStatus. A
+// device, merged or not, reports it when asked on a link.
+func (r *DeviceRegistry) Status(address byte) (DeviceStatus, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st, ok := r.status[address]
+	st.Drives = slices.Clone(st.Drives)
+	return st, ok
+}
+
+// Devices returns every device known, by address.
+func (r *DeviceRegistry) Devices() []RegisteredDevice {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	devices := make([]RegisteredDevice, 0, len(r.devices))
+	for _, a := range slices.Sorted(maps.Keys(r.devices)) {
+		devices = append(devices, r.devices[a].clone())
+	}
+	return devices
+}
+
+// Capabilities returns what the device at address takes, as its pong
+// said. A device that hasn't answered, as one known only from a mapping,
+// is taken to take everything, as is every device with no registry.
+func (r *DeviceRegistry) Capabilities(address byte) Capabilities {
+	if r == nil {
+		return AllCapabilities
+	}
+	d, ok := r.Device(address)
+	if !ok {
+		return AllCapabilities
+	}
+	return d.Caps
+}
+
+// ErrUnreachable is what a DeviceHandle's Send returns while no link
+// reaches its device.
+var ErrUnreachable = errors.New("controller: no link reaches the device")
+
+// Handle returns a Sender for the device at address, whichever transport
+// reaches it: each Send goes over the link of the claim holding the
+// address then, so a Player sending through it plays on after a conflict
+// moves the device.
+func (r *DeviceRegistry) Handle(address byte) *DeviceHandle {
+	return &DeviceHandle{r: r, address: address}
+}
+
+// DeviceHandle is a device's Sender, from DeviceRegistry.Handle.
+type DeviceHandle struct {
+	r       *DeviceRegistry
+	address byte
+}
+
+// Address returns the address of h's device.
+func (h *DeviceHandle) Address() byte { return h.address }
+
+// link returns the link reaching h's device now, or nil.
+func (h *DeviceHandle) link() *Device {
+	d, ok := h.r.Registered(h.address)
+	if !ok {
+		return nil
+	}
+	return d.Link
+}
+
+// Send sends m over the link reaching h's device now.
+func (h *DeviceHandle) Send(m protocol.Message) error {
+	l := h.link()
+	if l == nil {
+		return fmt.Errorf("%w: 0x%02X", ErrUnreachable, h.address)
+	}
+	return l.Send(m)
+}
+
+// WaitConnected waits for the link reaching h's device, as
+// Device.WaitConnected does, so that a Player sending through h waits
+// out a lost link.
+func (h *DeviceHandle) WaitConnected(ctx context.Context) error {
+	l := h.link()
+	if l == nil {
+		return fmt.Errorf("%w: 0x%02X", ErrUnreachable, h.address)
+	}
+	return l.WaitConnected(ctx)
+}
+
+// adapt returns msgs as their devices take them: see Capabilities.adapt.
+func (r *DeviceRegistry) adapt(msgs []protocol.Message) []protocol.Message {
+	if r == nil {
+		return msgs
+	}
+	kept := msgs[:0]
+	for _, m := range msgs {
+		if m, ok := r.Capabilities(m.Device).adapt(m); ok {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,308 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+func TestDecodeCapabilities(t *testing.T) {
+	for _, n := range capNames {
+		caps := DecodeCapabilities([]byte{byte(n.cap >> 8), byte(n.cap)})
+		if caps != n.cap || !caps.Has(n.cap) || caps.String() != n.name {
+			t.Errorf("%s: decoded %04X, %q", n.name, uint16(caps), caps)
+		}
+		if others := AllCapabilities &^ n.cap; caps&others != 0 {
+			t.Errorf("%s: decoded %04X, with other bits", n.name, uint16(caps))
+		}
+	}
+	for _, extra := range [][]byte{nil, {0x01}} {
+		if caps := DecodeCapabilities(extra); caps != LegacyCapabilities || caps.String() != "none" {
+			t.Errorf("% X: decoded %04X, want the legacy set", extra, uint16(caps))
+		}
+	}
+	if caps := DecodeCapabilities([]byte{0x00, 0x09, 0xFF}); caps.String() != "velocity, tremolo" {
+		t.Errorf("decoded %q, want velocity and tremolo", caps)
+	}
+
+	// As the firmware's pong carries them, and Discover decodes them.
+	d, _ := newFakeBus(t,
+		protocol.PongCaps(0x01, 1, 8, config.CapVelocity|config.CapSustain),
+		protocol.Pong(0x02, 1, 4),
+	)
+	found, err := d.Discover(100 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || found[0].Caps != CapVelocity|CapSustain || found[1].Caps != LegacyCapabilities {
+		t.Errorf("found %+v, want velocity and sustain, then the legacy set", found)
+	}
+}
+
+// TestNegotiatePlayer plays a program change and a note on a device
+// taking everything and on one answering as Moppy's firmware does: the
+// first gets the preset and the velocity, the second only the head
+// movement and a note without velocity.
+func TestNegotiatePlayer(t *testing.T) {
+	m, err := mapping.Load("testdata/presets/rig.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []Event{
+		{Kind: Program, Channel: 0, Value: 30},
+		{Kind: Program, Channel: 1, Value: 30},
+		{Kind: NoteOn, Channel: 0, Note: 60, Value: 100},
+		{Kind: NoteOn, Channel: 1, Note: 60, Value: 100},
+		{At: 100 * time.Millisecond, Kind: NoteOff, Channel: 0, Note: 60},
+		{At: 100 * time.Millisecond, Kind: NoteOff, Channel: 1, Note: 60},
+	}
+	play := func(devices *DeviceRegistry) map[byte][]protocol.Message {
+		p, r := newRecorder(m)
+		p.Devices = devices
+		if err := p.Play(context.Background(), events); err != nil {
+			t.Fatal(err)
+		}
+		sent := make(map[byte][]protocol.Message)
+		for _, m := range sentOf(r) {
+			sent[m.Device] = append(sent[m.Device], m)
+		}
+		return sent
+	}
+	all := play(nil)
+	devices := NewDeviceRegistry()
+	devices.Add(DeviceInfo{Address: 0x01, Caps: AllCapabilities}, DeviceInfo{Address: 0x02, Caps: LegacyCapabilities})
+	got := play(devices)
+
+	checkSent(t, got[0x01], all[0x01])
+	if !slices.ContainsFunc(got[0x01], func(m protocol.Message) bool { return m.Command == config.DevCmdTremolo }) {
+		t.Errorf("device 1 sent %v, want the preset's tremolo", got[0x01])
+	}
+	checkSent(t, got[0x02], []protocol.Message{
+		protocol.SetMovement(0x02, 1, true),
+		protocol.SetMovement(0x02, 2, true),
+		protocol.NoteOn(0x02, 1, 60),
+		protocol.NoteOff(0x02, 1, 60),
+	})
+	checkSent(t, got[0x00], all[0x00])
+}
+
+// TestNegotiateBridge plays live on a device answering as Moppy's firmware
+// does: notes go without velocity, and the pedal and pressure not at all.
+func TestNegotiateBridge(t *testing.T) {
+	in := newFakeMIDI(
+		[]byte{0x90, 60, 100},
+		[]byte{0xE0, 0x00, 0x50},
+		[]byte{0xB0, 64, 127},
+		[]byte{0xD0, 40},
+		[]byte{0x90, 60, 0},
+	)
+	in.Close()
+	_, r := newRecorder(nil)
+	b := NewBridge(in, r, mapping.Channels(0x01, 1, 4))
+	b.Devices = NewDeviceRegistry()
+	b.Devices.Add(DeviceInfo{Address: 0x01, FirstDrive: 1, LastDrive: 4})
+	if err := b.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkSent(t, sentOf(r), []protocol.Message{
+		protocol.NoteOn(0x01, 1, 60),
+		protocol.PitchBend(0x01, 1, 0x800),
+		protocol.NoteOff(0x01, 1, 60),
+		protocol.AllNotesOff(0x01),
+	})
+
+	// A device not in the registry is sent everything.
+	if caps := b.Devices.Capabilities(0x05); caps != AllCapabilities {
+		t.Errorf("unknown device takes %q, want everything", caps)
+	}
+}
+
+// TestRegistryConflict claims device 1 over a serial port and over UDP,
+// and checks the documented resolution: the first claim keeps the address
+// and the other is reported once, unless the mapping hints at the other's
+// transport, or the holder is lost.
+func TestRegistryConflict(t *testing.T) {
+	info := DeviceInfo{Address: 0x01, FirstDrive: 1, LastDrive: 8}
+	claims := func(t *testing.T) (serial, udp Sighting, sb, ub *fakeBus) {
+		sd, sb := newFakeBus(t)
+		ud, ub := newFakeBus(t)
+		serial = Sightings(mapping.TransportSerial, "/dev/ttyUSB0", sd, info)[0]
+		udp = Sightings(mapping.TransportUDP, "udp:239.255.0.1:30994", ud, info)[0]
+		return serial, udp, sb, ub
+	}
+	record := func(r *DeviceRegistry) *[]RegistryEvent {
+		var events []RegistryEvent
+		r.Subscribe(func(ev RegistryEvent) { events = append(events, ev) })
+		return &events
+	}
+	// sendsOver checks a note sent through device 1's handle reaches want
+	// and not other.
+	sendsOver := func(t *testing.T, r *DeviceRegistry, want, other *fakeBus) {
+		t.Helper()
+		if err := r.Handle(0x01).Send(protocol.NoteOn(0x01, 1, 60)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-want.got:
+		case <-other.got:
+			t.Fatal("the note went over the claim not holding the address")
+		case <-time.After(time.Second):
+			t.Fatal("the note went nowhere")
+		}
+	}
+
+	t.Run("first holds", func(t *testing.T) {
+		serial, udp, sb, ub := claims(t)
+		r := NewDeviceRegistry()
+		events := record(r)
+		r.Merge(serial)
+		r.Merge(udp)
+		r.Merge(udp, serial) // heard again: nothing new
+		d, _ := r.Registered(0x01)
+		if d.Transport != mapping.TransportSerial || len(d.Conflicts) != 1 || d.Conflicts[0].Transport != mapping.TransportUDP {
+			t.Errorf("registered %+v, want serial holding and UDP conflicting", d)
+		}
+		if len(*events) != 2 || (*events)[0].Kind != DeviceFound || (*events)[1].Kind != DeviceConflict || (*events)[1].Other.Transport != mapping.TransportUDP {
+			t.Errorf("events %+v, want found, then one conflict naming UDP", *events)
+		}
+		sendsOver(t, r, sb, ub)
+	})
+	t.Run("hinted", func(t *testing.T) {
+		serial, udp, sb, ub := claims(t)
+		r := NewDeviceRegistry()
+		r.Prefer(0x01, mapping.TransportUDP)
+		events := record(r)
+		r.Merge(serial)
+		r.Merge(udp)
+		d, _ := r.Registered(0x01)
+		if d.Transport != mapping.TransportUDP || len(d.Conflicts) != 1 || d.Conflicts[0].Transport != mapping.TransportSerial {
+			t.Errorf("registered %+v, want UDP holding and serial conflicting", d)
+		}
+		if len(*events) != 2 || (*events)[1].Kind != DeviceConflict || (*events)[1].Other.Transport != mapping.TransportSerial {
+			t.Errorf("events %+v, want found, then a conflict naming serial, displaced", *events)
+		}
+		// The hinted claim keeps it, whatever answers after.
+		r.Merge(serial)
+		if d, _ := r.Registered(0x01); d.Transport != mapping.TransportUDP {
+			t.Errorf("serial took the address back from the hinted UDP")
+		}
+		sendsOver(t, r, ub, sb)
+	})
+	t.Run("hinted later", func(t *testing.T) {
+		serial, udp, sb, ub := claims(t)
+		r := NewDeviceRegistry()
+		r.Merge(serial, udp)
+		events := record(r)
+		r.Prefer(0x01, mapping.TransportUDP)
+		if d, _ := r.Registered(0x01); d.Transport != mapping.TransportUDP {
+			t.Errorf("registered %+v, want UDP holding once hinted", d)
+		}
+		if len(*events) != 1 || (*events)[0].Kind != DeviceConflict {
+			t.Errorf("events %+v, want a conflict", *events)
+		}
+		sendsOver(t, r, ub, sb)
+	})
+	t.Run("holder lost", func(t *testing.T) {
+		serial, udp, sb, ub := claims(t)
+		r := NewDeviceRegistry()
+		now := time.Unix(0, 0)
+		r.now = func() time.Time { return now }
+		r.Merge(serial, udp)
+		events := record(r)
+		now = now.Add(time.Minute)
+		r.expire(time.Second)
+		// The UDP claim answers a ping; the serial one doesn't.
+		r.Heard(udp.Link, protocol.Pong(0x01, 1, 8))
+		d, _ := r.Registered(0x01)
+		if d.Transport != mapping.TransportUDP || !d.Alive || d.Conflicts[0].Transport != mapping.TransportSerial {
+			t.Errorf("registered %+v, want UDP holding, alive", d)
+		}
+		if len(*events) != 2 || (*events)[0].Kind != DeviceLost || (*events)[1].Kind != DeviceConflict {
+			t.Errorf("events %+v, want lost, then a conflict", *events)
+		}
+		sendsOver(t, r, ub, sb)
+	})
+}
+
+// TestRegistryWatch pings two links, one whose device answers and one
+// whose device has gone quiet, and checks only the quiet one is lost, and
+// is back once it answers.
+func TestRegistryWatch(t *testing.T) {
+	alive, _ := newFakeBus(t, protocol.Pong(0x01, 1, 8))
+	quiet, _ := newFakeBus(t)
+	r := NewDeviceRegistry()
+	var (
+		mu  sync.Mutex
+		now = time.Unix(0, 0)
+	)
+	r.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	r.Merge(Sightings(mapping.TransportSerial, "/dev/ttyUSB0", alive, DeviceInfo{Address: 0x01})...)
+	r.Merge(Sightings(mapping.TransportUDP, "udp:239.255.0.1:30994", quiet, DeviceInfo{Address: 0x02})...)
+	for _, l := range []*Device{alive, quiet} {
+		go func() {
+			for m := range l.Messages() {
+				r.Heard(l, m)
+			}
+		}()
+	}
+	events := make(chan RegistryEvent, 8)
+	r.Subscribe(func(ev RegistryEvent) { events <- ev })
+
+	mu.Lock()
+	now = now.Add(time.Minute)
+	mu.Unlock()
+	r.ping()
+	deadline := time.Now().Add(time.Second)
+	for d, _ := r.Registered(0x01); !d.LastSeen.Equal(r.now()); d, _ = r.Registered(0x01) {
+		if time.Now().After(deadline) {
+			t.Fatal("device 1 never answered the ping")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	r.expire(time.Second)
+	if ev := <-events; ev.Kind != DeviceLost || ev.Device.Address != 0x02 {
+		t.Errorf("got %v of 0x%02X, want device 2 lost", ev.Kind, ev.Device.Address)
+	}
+	if d, _ := r.Registered(0x01); !d.Alive {
+		t.Error("device 1 lost, though it answered")
+	}
+	if err := r.Handle(0x03).Send(protocol.Ping()); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("sent to an unknown device: %v, want ErrUnreachable", err)
+	}
+
+	r.Heard(quiet, protocol.Pong(0x02, 1, 4))
+	if ev := <-events; ev.Kind != DeviceBack || ev.Device.Address != 0x02 || !ev.Device.Alive || ev.Device.LastDrive != 4 {
+		t.Errorf("got %v of %+v, want device 2 back", ev.Kind, ev.Device)
+	}
+}
+
+// TestRegistryStatus keeps each device's last status, whether or not its
+// link was merged.
+func TestRegistryStatus(t *testing.T) {
+	r := NewDeviceRegistry()
+	r.now = func() time.Time { return time.Unix(60, 0) }
+	if _, ok := r.Status(0x02); ok {
+		t.Error("a status before any was heard")
+	}
+	r.Heard(nil, protocol.Status(0x02, 3723, 3, 0b1011, config.SequencePlaying, config.FaultNone))
+	r.Heard(nil, protocol.Status(0x02, 3724, 1, 0b1000, config.SequencePaused, config.FaultLinkTimeout))
+	want := DeviceStatus{Uptime: 3724 * time.Second, Sounding: 1, Drives: []byte{4}, Sequence: config.SequencePaused, Fault: config.FaultLinkTimeout, At: time.Unix(60, 0)}
+	if st, ok := r.Status(0x02); !ok || !reflect.DeepEqual(st, want) {
+		t.Errorf("status %+v, want %+v", st, want)
+	}
+	if _, ok := r.Registered(0x02); ok {
+		t.Error("a status registered its device")
+	}
+}
@@ -0,0 +1,215 @@
+package controller
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+)
+
+// Retiming is what Retime did to a song.
+type Retiming struct {
+	Notes     int // note-ons on the channels m retimes
+	Quantised int // of those, moved toward the grid
+	Humanised int // moved at random
+	Held      int // kept from moving past a neighbour: see Retime
+}
+
+func (r Retiming) String() string {
+	return fmt.Sprintf("%d notes, %d quantised, %d humanised, %d held back", r.Notes, r.Quantised, r.Humanised, r.Held)
+}
+
+// Retime returns events with the notes of each channel moved as its
+// mapping.Channel's Quantise and Humanise say, and what it did. It works
+// on the song's time as the tempo map resolves it, before a Player
+// schedules it; events is left alone.
+//
+// Quantise moves a note's start Strength percent of the way to the
+// nearest line of its grid, the grid's lines counted in quarter notes
+// through the song's tempo changes from the start of the song, or of its
+// last time signature, which starts a bar. Humanise then moves it at
+// random, by up to Humanise either way, drawn from seed: the same seed,
+// the same song and mapping, the same offsets. A note moves whole, its
+// release with it, so it keeps its length.
+//
+// No note is moved before the start of the song, nor before its
+// channel's last program change, nor before the note of its pitch on
+// its channel struck before it; a note moved later than the next of its
+// pitch is struck is released as it is, so no note-off comes before its
+// note-on, nor ends the note after it. Events other than notes stay
+// where they are.
+func Retime(events []Event, m *mapping.Map, seed uint64) ([]Event, Retiming) {
+	var r Retiming
+	retimes := func(ev Event) bool {
+		c := m.Channels[ev.Channel]
+		return c.Quantise != (mapping.Quantise{}) || c.Humanise > 0
+	}
+	if !slices.ContainsFunc(events, func(ev Event) bool { return ev.Kind == NoteOn && retimes(ev) }) {
+		return events, r
+	}
+	tm := newTempoMap(events)
+	rng := rand.New(rand.NewPCG(seed, seed))
+	off := pairNotes(events)
+	out := slices.Clone(events)
+
+	var (
+		floor [16]time.Duration        // each channel's last program change
+		prev  = make(map[heldNote]int) // the last note-on of each pitch, by index
+	)
+	for i, ev := range events {
+		switch {
+		case ev.Kind == Program:
+			floor[ev.Channel] = ev.At
+			continue
+		case ev.Kind != NoteOn || !retimes(ev):
+			continue
+		}
+		c := m.Channels[ev.Channel]
+		r.Notes++
+		at := ev.At
+		if q := c.Quantise; q.Grid > 0 {
+			at = tm.quantise(at, q)
+			if at != ev.At {
+				r.Quantised++
+			}
+		}
+		if c.Humanise > 0 {
+			if d := time.Duration(rng.Int64N(2*int64(c.Humanise)+1)) - c.Humanise; d != 0 {
+				at += d
+				r.Humanised++
+			}
+		}
+		k := heldNote{ev.Channel, ev.Note}
+		lo := max(floor[ev.Channel], min(ev.At, 0))
+		if p, ok := prev[k]; ok {
+			lo = max(lo, out[p].At)
+		}
+		if at < lo {
+			at = lo
+			r.Held++
+		}
+		prev[k] = i
+		shift := at - ev.At
+		out[i].At = at
+		if off[i] >= 0 {
+			out[off[i]].At += shift
+		}
+	}
+
+	// A note moved past the next of its pitch is released where that one
+	// is struck, just before it. Events otherwise keep their order at
+	// one time: a note's note-on before its note-off.
+	seq := make([]float64, len(out))
+	for i := range seq {
+		seq[i] = float64(i)
+	}
+	next := make(map[heldNote]int)
+	for i := len(events) - 1; i >= 0; i-- {
+		ev := events[i]
+		if ev.Kind != NoteOn {
+			continue
+		}
+		k := heldNote{ev.Channel, ev.Note}
+		if j, ok := next[k]; ok && off[i] >= 0 && out[off[i]].At > out[j].At {
+			out[off[i]].At, seq[off[i]] = out[j].At, float64(j)-0.5
+		}
+		next[k] = i
+	}
+	order := make([]int, len(out))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int {
+		return cmp.Or(cmp.Compare(out[a].At, out[b].At), cmp.Compare(seq[a], seq[b]))
+	})
+	sorted := make([]Event, len(out))
+	for i, o := range order {
+		sorted[i] = out[o]
+	}
+	return sorted, r
+}
+
+// tempoMap turns a song's offsets into quarter notes and back, through its
+// tempo changes: 120 BPM until it says otherwise.
+type tempoMap []tempoSpan
+
+// tempoSpan is a stretch of a song at one tempo.
+type tempoSpan struct {
+	at       time.Duration
+	quarters float64 // quarter notes to at
+	tempo    float64 // µs per quarter note
+	bar      float64 // quarter notes to the last time signature
+}
+
+func newTempoMap(events []Event) tempoMap {
+	tm := tempoMap{{tempo: 500000}}
+	for _, ev := range events {
+		if ev.Kind != Tempo && ev.Kind != Meter {
+			continue
+		}
+		last := tm[len(tm)-1]
+		s := tempoSpan{at: ev.At, quarters: last.quarters + float64(ev.At-last.at)/1000/last.tempo, tempo: last.tempo, bar: last.bar}
+		switch {
+		case ev.Kind == Tempo && ev.Tempo > 0:
+			s.tempo = float64(ev.Tempo)
+		case ev.Kind == Meter && ev.Note > 0 && ev.Value > 0:
+			s.bar = s.quarters
+		default:
+			continue
+		}
+		if ev.At == last.at {
+			tm[len(tm)-1] = s
+		} else {
+			tm = append(tm, s)
+		}
+	}
+	return tm
+}
+
+// span returns the span at, or past the start of the song, at goes in.
+func (tm tempoMap) span(at time.Duration) tempoSpan {
+	i, _ := slices.BinarySearchFunc(tm, at, func(s tempoSpan, at time.Duration) int {
+		return int(min(max(s.at-at, -1), 1))
+	})
+	if i < len(tm) && tm[i].at == at {
+		return tm[i]
+	}
+	return tm[max(i-1, 0)]
+}
+
+// quarters returns the quarter notes to at.
+func (tm tempoMap) quarters(at time.Duration) float64 {
+	s := tm.span(at)
+	return s.quarters + float64(at-s.at)/1000/s.tempo
+}
+
+// time returns the offset of quarter note q.
+func (tm tempoMap) time(q float64) time.Duration {
+	i, _ := slices.BinarySearchFunc(tm, q, func(s tempoSpan, q float64) int {
+		switch {
+		case s.quarters < q:
+			return -1
+		case s.quarters > q:
+			return 1
+		}
+		return 0
+	})
+	if i == len(tm) || tm[i].quarters > q {
+		i = max(i-1, 0)
+	}
+	s := tm[i]
+	return s.at + time.Duration(math.Round((q-s.quarters)*s.tempo*1000))
+}
+
+// quantise returns at moved toward the nearest line of q's grid.
+func (tm tempoMap) quantise(at time.Duration, q mapping.Quantise) time.Duration {
+	s := tm.span(at)
+	pos := tm.quarters(at)
+	grid := 4 / float64(q.Grid)
+	line := s.bar + math.Round((pos-s.bar)/grid)*grid
+	return tm.time(pos + (line-pos)*float64(q.Strength)/100)
+}
@@ -0,0 +1,186 @@
+package controller
+
+import (
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+)
+
+// note returns a note on channel 1, struck at on and released at off.
+func note(key byte, on, off time.Duration) []Event {
+	return []Event{{At: on, Kind: NoteOn, Note: key, Value: 100}, {At: off, Kind: NoteOff, Note: key}}
+}
+
+// TestQuantise snaps single notes, at 120 BPM until 1s, a quarter note in,
+// where the tempo halves and the time goes to 3/4.
+func TestQuantise(t *testing.T) {
+	meter := []Event{
+		{At: time.Second, Kind: Tempo, Tempo: 1000000},
+		{At: time.Second, Kind: Meter, Note: 3, Value: 4},
+	}
+	tests := []struct {
+		name     string
+		quantise mapping.Quantise
+		on, want time.Duration
+	}{
+		{"to the 16th before", mapping.Quantise{Grid: 16, Strength: 100}, 140 * time.Millisecond, 125 * time.Millisecond},
+		{"to the 16th after", mapping.Quantise{Grid: 16, Strength: 100}, 190 * time.Millisecond, 250 * time.Millisecond},
+		{"half way", mapping.Quantise{Grid: 16, Strength: 50}, 140 * time.Millisecond, 132500 * time.Microsecond},
+		{"a quarter of the way", mapping.Quantise{Grid: 8, Strength: 25}, 200 * time.Millisecond, 212500 * time.Microsecond},
+		{"8th triplets", mapping.Quantise{Grid: 12, Strength: 100}, 180 * time.Millisecond, 166666667 * time.Nanosecond},
+		{"on the grid", mapping.Quantise{Grid: 4, Strength: 100}, 500 * time.Millisecond, 500 * time.Millisecond},
+		// At 60 BPM a 16th is 250ms.
+		{"after the tempo change", mapping.Quantise{Grid: 16, Strength: 100}, 1300 * time.Millisecond, 1250 * time.Millisecond},
+		// Back over the tempo change, to the 8th before it.
+		{"across the tempo change", mapping.Quantise{Grid: 8, Strength: 100}, 1100 * time.Millisecond, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := mapping.Channels(0x01, 1, 1)
+			m.Channels[0].Quantise = tt.quantise
+			song := append(slices.Clone(meter), note(60, tt.on, tt.on+2*time.Second)...)
+			slices.SortStableFunc(song, func(a, b Event) int { return int(min(max(a.At-b.At, -1), 1)) })
+			got, rt := Retime(song, m, 1)
+			i := slices.IndexFunc(got, func(ev Event) bool { return ev.Kind == NoteOn })
+			j := slices.IndexFunc(got, func(ev Event) bool { return ev.Kind == NoteOff })
+			if got[i].At != tt.want || got[j].At-got[i].At != 2*time.Second {
+				t.Errorf("struck at %v, released %v later; want %v, 2s later", got[i].At, got[j].At-got[i].At, tt.want)
+			}
+			if moved := tt.on != tt.want; moved != (rt.Quantised == 1) {
+				t.Errorf("got %+v", rt)
+			}
+		})
+	}
+
+	// The grid starts again at a time signature part way through a bar.
+	m := mapping.Channels(0x01, 1, 1)
+	m.Channels[0].Quantise = mapping.Quantise{Grid: 4, Strength: 100}
+	song := append([]Event{{At: 600 * time.Millisecond, Kind: Meter, Note: 4, Value: 4}}, note(60, 700*time.Millisecond, time.Second)...)
+	if got, _ := Retime(song, m, 1); got[1].At != 600*time.Millisecond {
+		t.Errorf("struck at %v, want 600ms, on the time signature's beat", got[1].At)
+	}
+}
+
+// TestHumanise humanises 500 notes by up to 5ms, and checks each moves
+// within it, the same for the same seed.
+func TestHumanise(t *testing.T) {
+	const bound = 5 * time.Millisecond
+	var song []Event
+	for i := range 500 {
+		song = append(song, note(byte(i%64), time.Duration(i)*20*time.Millisecond+bound, time.Duration(i)*20*time.Millisecond+bound+10*time.Millisecond)...)
+	}
+	m := mapping.Channels(0x01, 1, 1)
+	m.Channels[0].Humanise = bound
+	got, rt := Retime(song, m, 7)
+	if rt.Notes != 500 || rt.Humanised < 450 || rt.Quantised != 0 || rt.Held != 0 {
+		t.Errorf("got %+v, want nearly all 500 humanised", rt)
+	}
+	var early, late bool
+	ons := struckOf(got)
+	for i, on := range struckOf(song) {
+		d := ons[i].At - on.At
+		if d < -bound || d > bound {
+			t.Fatalf("note %d moved %v, over %v", i, d, bound)
+		}
+		early, late = early || d < 0, late || d > 0
+	}
+	if !early || !late {
+		t.Error("notes only moved one way")
+	}
+	if again, _ := Retime(song, m, 7); !slices.Equal(again, got) {
+		t.Error("the same seed moved the notes otherwise")
+	}
+	if other, _ := Retime(song, m, 8); slices.Equal(other, got) {
+		t.Error("another seed moved the notes the same")
+	}
+}
+
+// struckOf returns the note-ons of events, by note and time struck, as
+// TestHumanise strikes each once.
+func struckOf(events []Event) []Event {
+	var ons []Event
+	for _, ev := range events {
+		if ev.Kind == NoteOn {
+			ons = append(ons, ev)
+		}
+	}
+	slices.SortStableFunc(ons, func(a, b Event) int { return int(a.Note) - int(b.Note) })
+	return ons
+}
+
+// TestRetimeOrder retimes a dense random song, repeated and overlapping
+// notes of a few pitches, and checks no note-off comes before its
+// note-on or ends another note, and that notes of a pitch keep their
+// order.
+func TestRetimeOrder(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	var song []Event
+	for i := range 400 {
+		on := time.Duration(i) * 7 * time.Millisecond
+		ch := byte(i % 2)
+		song = append(song, Event{At: on, Kind: NoteOn, Channel: ch, Note: 60 + byte(rng.IntN(3)), Value: 100})
+		if i%50 == 0 {
+			song = append(song, Event{At: on, Kind: Program, Channel: ch, Value: byte(i / 50)})
+		}
+	}
+	// Each note is released 1 to 30ms after it is struck, or as the next
+	// of its pitch is.
+	for i, ev := range slices.Clone(song) {
+		if ev.Kind != NoteOn {
+			continue
+		}
+		off := ev.At + time.Duration(1+rng.IntN(30))*time.Millisecond
+		for _, n := range song[i+1:] {
+			if n.Kind == NoteOn && n.Channel == ev.Channel && n.Note == ev.Note {
+				off = min(off, n.At)
+				break
+			}
+		}
+		song = append(song, Event{At: off, Kind: NoteOff, Channel: ev.Channel, Note: ev.Note})
+	}
+	slices.SortStableFunc(song, func(a, b Event) int { return int(min(max(a.At-b.At, -1), 1)) })
+
+	m := mapping.Channels(0x01, 1, 2)
+	m.Channels[0].Quantise = mapping.Quantise{Grid: 32, Strength: 60}
+	m.Channels[0].Humanise = 20 * time.Millisecond
+	m.Channels[1].Humanise = 50 * time.Millisecond
+	before := slices.Clone(song)
+	got, rt := Retime(song, m, 3)
+	if !slices.Equal(song, before) {
+		t.Error("Retime changed the events it was given")
+	}
+	if len(got) != len(song) || rt.Notes != 400 || rt.Held == 0 {
+		t.Fatalf("%d events, %+v; want %d, all 400 notes retimed, some held", len(got), rt, len(song))
+	}
+	if !slices.IsSortedFunc(got, func(a, b Event) int { return int(min(max(a.At-b.At, -1), 1)) }) {
+		t.Error("events out of time order")
+	}
+	var (
+		sounding  = make(map[heldNote]bool)
+		programAt [16]time.Duration
+		lastOn    = make(map[heldNote]time.Duration)
+	)
+	for i, ev := range got {
+		k := heldNote{ev.Channel, ev.Note}
+		switch ev.Kind {
+		case Program:
+			programAt[ev.Channel] = ev.At
+		case NoteOn:
+			if sounding[k] {
+				t.Fatalf("event %d: %v struck while sounding", i, k)
+			}
+			if ev.At < 0 || ev.At < programAt[ev.Channel] || ev.At < lastOn[k] {
+				t.Fatalf("event %d: %v struck at %v, before the song, its program change or its last", i, k, ev.At)
+			}
+			sounding[k], lastOn[k] = true, ev.At
+		case NoteOff:
+			if !sounding[k] {
+				t.Fatalf("event %d: %v released before it was struck", i, k)
+			}
+			sounding[k] = false
+		}
+	}
+}
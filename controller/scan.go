@@ -0,0 +1,229 @@
+package controller
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
+)
+
+// PortInfo describes a serial port a scan may try.
+type PortInfo struct {
+	Name string
+
+	// Detailed is set when the system reported the fields below; without
+	// it, ScanAll can't filter the port out and tries it.
+	Detailed bool
+	IsUSB    bool
+	VID, PID string // hex, as "2341"
+	Product  string
+}
+
+// DefaultVIDs are the USB vendor IDs ScanAll tries by default: Arduino,
+// and the USB serial chips on common clones (WCH CH340, FTDI, Silicon
+// Labs CP210x).
+var DefaultVIDs = []string{"2341", "2A03", "1A86", "0403", "10C4"}
+
+// ScanOptions configures ScanAll. The zero value scans every USB serial
+// port from a DefaultVIDs vendor at 57600 baud.
+type ScanOptions struct {
+	// Bauds are the rates to try each port at, in order, until one
+	// answers. Default 57600.
+	Bauds []int
+
+	// VIDs, or VID:PID pairs, filter the USB ports scanned: nil for
+	// DefaultVIDs, empty for every USB port. Ports the system has no
+	// details for are always tried.
+	VIDs []string
+
+	// NonUSB tries ports the system knows aren't USB, such as built-in
+	// RS-232 ports, too.
+	NonUSB bool
+
+	// Timeout is how long to wait for pongs at each baud. Default 500ms.
+	Timeout time.Duration
+
+	// BootWait is how long to wait after opening a port before pinging:
+	// see OpenSerial. Default 2s.
+	BootWait time.Duration
+
+	// Enumerate lists the candidate ports, and Open opens one. They
+	// default to the system's serial ports; tests replace them.
+	Enumerate func() ([]PortInfo, error)
+	Open      func(name string, baud int) (Port, error)
+}
+
+// FoundDevice is a device that answered a scan's ping, or a port the scan
+// couldn't open.
+type FoundDevice struct {
+	Port string
+	Baud int
+	DeviceInfo
+
+	// Err is why Port couldn't be opened, as when it is busy or the user
+	// lacks permission; the other fields are then unset.
+	Err error
+}
+
+// ScanAll pings every candidate serial port and returns the devices that
+// answered, and the ports it couldn't open, ordered by port and device
+// address. Ports are scanned at once, so the scan takes about one port's
+// BootWait and Timeout per baud. Ports that don't answer are closed and
+// left out.
+//
+// It fails only if the ports can't be listed, or ctx is done first.
+func ScanAll(ctx context.Context, opts ScanOptions) ([]FoundDevice, error) {
+	if len(opts.Bauds) == 0 {
+		opts.Bauds = []int{57600}
+	}
+	if opts.VIDs == nil {
+		opts.VIDs = DefaultVIDs
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 500 * time.Millisecond
+	}
+	if opts.BootWait == 0 {
+		opts.BootWait = bootWait
+	}
+	if opts.Enumerate == nil {
+		opts.Enumerate = systemPorts
+	}
+	if opts.Open == nil {
+		opts.Open = openSystemPort
+	}
+
+	ports, err := opts.Enumerate()
+	if err != nil {
+		return nil, fmt.Errorf("controller: list serial ports: %w", err)
+	}
+	var (
+		mu    sync.Mutex
+		found []FoundDevice
+		wg    sync.WaitGroup
+	)
+	for _, p := range ports {
+		if !opts.wants(p) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			devs := scanPort(ctx, p.Name, opts)
+			mu.Lock()
+			found = append(found, devs...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(found, func(a, b FoundDevice) int {
+		return cmp.Or(strings.Compare(a.Port, b.Port), cmp.Compare(a.Address, b.Address))
+	})
+	return found, nil
+}
+
+// wants reports whether the options let a scan try p.
+func (o *ScanOptions) wants(p PortInfo) bool {
+	if !p.Detailed {
+		return true
+	}
+	if !p.IsUSB {
+		return o.NonUSB
+	}
+	if len(o.VIDs) == 0 {
+		return true
+	}
+	for _, id := range o.VIDs {
+		vid, pid, hasPID := strings.Cut(id, ":")
+		if strings.EqualFold(vid, p.VID) && (!hasPID || strings.EqualFold(pid, p.PID)) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanPort pings the port at each baud in turn, and returns the devices
+// that answer at the first that any do.
+func scanPort(ctx context.Context, name string, opts ScanOptions) []FoundDevice {
+	for _, baud := range opts.Bauds {
+		port, err := opts.Open(name, baud)
+		if err != nil {
+			return []FoundDevice{{Port: name, Err: err}}
+		}
+		infos := pingPort(ctx, port, opts)
+		if len(infos) == 0 {
+			continue
+		}
+		devs := make([]FoundDevice, len(infos))
+		for i, info := range infos {
+			devs[i] = FoundDevice{Port: name, Baud: baud, DeviceInfo: info}
+		}
+		return devs
+	}
+	return nil
+}
+
+// pingPort waits for the board to boot, discovers the devices on port
+// and closes it.
+func pingPort(ctx context.Context, port Port, opts ScanOptions) []DeviceInfo {
+	d := New(port)
+	defer d.Close()
+	select {
+	case <-time.After(opts.BootWait):
+	case <-ctx.Done():
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+	infos, _ := d.DiscoverContext(ctx)
+	return infos
+}
+
+// systemPorts lists the system's serial ports, with USB details where the
+// system has them.
+func systemPorts() ([]PortInfo, error) {
+	details, err := enumerator.GetDetailedPortsList()
+	if err == nil {
+		ports := make([]PortInfo, len(details))
+		for i, d := range details {
+			ports[i] = PortInfo{Name: d.Name, Detailed: true, IsUSB: d.IsUSB,
+				VID: d.VID, PID: d.PID, Product: d.Product}
+		}
+		return ports, nil
+	}
+	names, err := serial.GetPortsList()
+	if err != nil {
+		return nil, err
+	}
+	ports := make([]PortInfo, len(names))
+	for i, name := range names {
+		ports[i] = PortInfo{Name: name}
+	}
+	return ports, nil
+}
+
+func openSystemPort(name string, baud int) (Port, error) {
+	p, err := serial.Open(name, &serial.Mode{BaudRate: baud})
+	var perr *serial.PortError
+	if errors.As(err, &perr) {
+		switch perr.Code() {
+		case serial.PortBusy:
+			return nil, fmt.Errorf("%s is busy: %w", name, err)
+		case serial.PermissionDenied:
+			return nil, fmt.Errorf("no permission to open %s: %w", name, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
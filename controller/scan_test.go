@@ -0,0 +1,159 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// scriptedPorts are a fake system's serial ports: each name answers a
+// ping, at the bauds listed, with its pongs.
+type scriptedPorts struct {
+	t     *testing.T
+	pongs map[string]map[int][]protocol.Message
+	fail  map[string]error
+
+	mu     sync.Mutex
+	opened map[string]int
+	closed map[string]int
+}
+
+func (s *scriptedPorts) open(name string, baud int) (Port, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fail[name]; err != nil {
+		return nil, err
+	}
+	bauds, ok := s.pongs[name]
+	if !ok {
+		s.t.Errorf("scan opened %s", name)
+		return nil, errors.New("unexpected port")
+	}
+	s.opened[name]++
+	host, dev := net.Pipe()
+	b := &fakeBus{conn: dev, got: make(chan protocol.Message, 16), pongs: bauds[baud]}
+	go b.serve()
+	return &closeCounter{Conn: host, name: name, s: s}, nil
+}
+
+type closeCounter struct {
+	net.Conn
+	name string
+	s    *scriptedPorts
+	once sync.Once
+}
+
+func (c *closeCounter) Close() error {
+	c.once.Do(func() {
+		c.s.mu.Lock()
+		c.s.closed[c.name]++
+		c.s.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+func TestScanAll(t *testing.T) {
+	busy := errors.New("serial port busy")
+	s := &scriptedPorts{
+		t: t,
+		pongs: map[string]map[int][]protocol.Message{
+			"/dev/ttyUSB0": {57600: {protocol.Pong(0x01, 1, 8)}},
+			"/dev/ttyUSB1": {115200: {protocol.Pong(0x03, 1, 4), protocol.Pong(0x02, 1, 2)}},
+			"/dev/ttyACM9": {}, // silent
+		},
+		fail:   map[string]error{"/dev/ttyUSB2": busy},
+		opened: map[string]int{},
+		closed: map[string]int{},
+	}
+	ports := []PortInfo{
+		{Name: "/dev/ttyUSB1", Detailed: true, IsUSB: true, VID: "1a86", PID: "7523"},
+		{Name: "/dev/ttyUSB0", Detailed: true, IsUSB: true, VID: "2341", PID: "0043"},
+		{Name: "/dev/ttyUSB2", Detailed: true, IsUSB: true, VID: "2341", PID: "0043"},
+		{Name: "/dev/ttyUSB3", Detailed: true, IsUSB: true, VID: "046D", PID: "C52B"}, // a mouse receiver
+		{Name: "/dev/ttyS0", Detailed: true},
+		{Name: "/dev/ttyACM9"}, // no details: tried
+	}
+	found, err := ScanAll(context.Background(), ScanOptions{
+		Bauds:     []int{57600, 115200},
+		Timeout:   50 * time.Millisecond,
+		BootWait:  time.Millisecond,
+		Enumerate: func() ([]PortInfo, error) { return ports, nil },
+		Open:      s.open,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []FoundDevice{
+		{Port: "/dev/ttyUSB0", Baud: 57600, DeviceInfo: DeviceInfo{Address: 0x01, FirstDrive: 1, LastDrive: 8}},
+		{Port: "/dev/ttyUSB1", Baud: 115200, DeviceInfo: DeviceInfo{Address: 0x02, FirstDrive: 1, LastDrive: 2}},
+		{Port: "/dev/ttyUSB1", Baud: 115200, DeviceInfo: DeviceInfo{Address: 0x03, FirstDrive: 1, LastDrive: 4}},
+		{Port: "/dev/ttyUSB2", Err: busy},
+	}
+	if len(found) != len(want) {
+		t.Fatalf("found %+v\nwant %+v", found, want)
+	}
+	for i, f := range found {
+		w := want[i]
+		if f.Port != w.Port || f.Baud != w.Baud || f.Address != w.Address || f.FirstDrive != w.FirstDrive ||
+			f.LastDrive != w.LastDrive || !errors.Is(f.Err, w.Err) {
+			t.Errorf("found[%d] = %+v, want %+v", i, f, w)
+		}
+	}
+	for name, n := range s.opened {
+		if s.closed[name] != n {
+			t.Errorf("%s opened %d times, closed %d", name, n, s.closed[name])
+		}
+	}
+	if s.opened["/dev/ttyACM9"] != 2 {
+		t.Errorf("silent port tried at %d bauds, want 2", s.opened["/dev/ttyACM9"])
+	}
+}
+
+func TestScanFilter(t *testing.T) {
+	o := ScanOptions{VIDs: []string{"2341", "1a86:7523"}}
+	tests := []struct {
+		p    PortInfo
+		want bool
+	}{
+		{PortInfo{Detailed: true, IsUSB: true, VID: "2341", PID: "0043"}, true},
+		{PortInfo{Detailed: true, IsUSB: true, VID: "1A86", PID: "7523"}, true},
+		{PortInfo{Detailed: true, IsUSB: true, VID: "1A86", PID: "5523"}, false},
+		{PortInfo{Detailed: true, IsUSB: true, VID: "0403", PID: "6001"}, false},
+		{PortInfo{Detailed: true}, false},
+		{PortInfo{}, true},
+	}
+	for _, tt := range tests {
+		if got := o.wants(tt.p); got != tt.want {
+			t.Errorf("wants(%+v) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+	o.NonUSB = true
+	if !o.wants(PortInfo{Detailed: true}) {
+		t.Error("NonUSB doesn't let a built-in port through")
+	}
+	o.VIDs = []string{}
+	if !o.wants(PortInfo{Detailed: true, IsUSB: true, VID: "0403", PID: "6001"}) {
+		t.Error("empty VIDs doesn't let every USB port through")
+	}
+}
+
+func TestScanCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := ScanAll(ctx, ScanOptions{
+		Enumerate: func() ([]PortInfo, error) { return []PortInfo{{Name: "/dev/ttyUSB0"}}, nil },
+		Open: func(string, int) (Port, error) {
+			host, dev := net.Pipe()
+			go (&fakeBus{conn: dev, got: make(chan protocol.Message, 16)}).serve()
+			return host, nil
+		},
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
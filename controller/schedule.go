@@ -0,0 +1,609 @@
+package controller
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// Link is a port a Scheduler sends to: its Device, and what Calibrate
+// finds of it, the devices answering on it and how late what is written
+// to it arrives.
+type Link struct {
+	Name      string // the port's, for reports
+	Device    *Device
+	Addresses []byte
+	Latency   time.Duration
+
+	// Baud is the port's rate, which what is written to it is kept to: 0
+	// for the rate OpenSerial opened the Device at. A Device with none,
+	// as over UDP, is written as fast as it takes.
+	Baud int
+
+	// Throttling is what keeping to Baud has done so far, as Links
+	// reports it.
+	Throttling Throttling
+}
+
+// Throttling is what a Scheduler's writer did to keep a port to its
+// Baud.
+type Throttling struct {
+	Written int           // messages written
+	Delayed int           // of those, written more than Scheduler.Late after they were due
+	Dropped int           // pitch bends dropped for a later one to the same drive
+	Worst   time.Duration // the latest a message was written
+}
+
+func (t Throttling) String() string {
+	return fmt.Sprintf("%d written, %d delayed, %d bends dropped, %v late at worst", t.Written, t.Delayed, t.Dropped, t.Worst)
+}
+
+// Scheduler is a Sender playing on the devices on several ports at once,
+// such as three Arduinos on three USB ports, so that notes struck
+// together sound together. Each message goes to the port its device
+// answered Calibrate's pings on, or to every port for the system
+// address; a Scheduler of one port sends everything there. It is written
+// Lookahead less the port's latency after it was sent, and less its
+// device's offset, set by hand for a device that sounds late, as one
+// behind a WiFi bridge does: every device's notes sound Lookahead late,
+// and so in time. Each port has a queue and a goroutine of its own
+// writing it, so a slow port doesn't hold up Send or the others. What is
+// sent to a device is written in the order it was sent, whatever its
+// offset did meanwhile, and what is sent to the system address after
+// what came before it.
+//
+// A port with a Baud is written no faster than it carries what is
+// written, ten bits a byte, with no more than a few milliseconds of it
+// waiting in the port's buffers. The budget is the port's, not a
+// device's: the devices chained or bridged on one cable share it. When
+// more is due than the port carries, what goes next is picked by how
+// much it matters: note-offs and system messages, such as SequenceStop,
+// first, then note-ons and the rest, then pitch bends, a bend dropped
+// if a later one to the same drive is waiting too. No message goes
+// before an earlier one to its drive, or to all its device's drives or
+// a zone of them, or to the system address, so nothing sounds
+// otherwise than it was sent, only late; a message one more urgent
+// waits for goes as soon as that would. A note-off is never dropped.
+// Each port's Throttling counts what came late, and what was dropped.
+//
+// Send fails at once with the error of a port whose link is down; write
+// errors after are the Device's to report. The Player waits for a
+// Scheduler's lost links to come back as it does for a Device's.
+type Scheduler struct {
+	// Lookahead is how late every message is written, less its port's
+	// latency and its device's offset. Calibrate sets it to the largest
+	// they add up to; a device they add up to more for has its messages
+	// written at once, and sounds late.
+	Lookahead time.Duration
+
+	// Late is how long after it was due a message may be written before
+	// Throttling counts it delayed. 0 for DefaultLate.
+	Late time.Duration
+
+	mu      sync.Mutex
+	links   []*link
+	offsets map[byte]time.Duration
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// LookaheadError reports a device whose port's latency and offset add up
+// to more than a Scheduler's Lookahead: what is sent to it can't be
+// written early enough, and sounds late by the difference.
+type LookaheadError struct {
+	Device          byte
+	Need, Lookahead time.Duration
+}
+
+func (e *LookaheadError) Error() string {
+	return fmt.Sprintf("controller: device 0x%02X needs %v of lookahead, more than %v: it sounds %v late",
+		e.Device, e.Need, e.Lookahead, e.Need-e.Lookahead)
+}
+
+// DefaultLate is the Scheduler's Late when it has none.
+const DefaultLate = 5 * time.Millisecond
+
+// backlog is how much a port with a Baud is let have waiting in its
+// buffers: a message is written once what was written before it goes
+// out, at the Baud, within backlog of it.
+const backlog = 5 * time.Millisecond
+
+// link is a Link and its queue.
+type link struct {
+	Link
+	s       *Scheduler
+	wake    chan struct{}
+	perByte time.Duration // how long a byte takes at Baud, or 0 for none
+
+	mu      sync.Mutex
+	queue   []scheduled // by when, then by seq
+	seq     uint64
+	last    map[byte]time.Time // when the last message for each device is due
+	latest  time.Time          // and the last of all
+	closing bool
+}
+
+// scheduled is a message queued for a port.
+type scheduled struct {
+	at  time.Time
+	seq uint64
+	m   protocol.Message
+}
+
+// NewScheduler returns a Scheduler sending to links, and starts their
+// writers. Calibrate learns which devices are on each, unless their
+// Addresses are given.
+func NewScheduler(links ...Link) *Scheduler {
+	s := &Scheduler{offsets: make(map[byte]time.Duration)}
+	for _, l := range links {
+		ln := &link{Link: l, s: s, wake: make(chan struct{}, 1), last: make(map[byte]time.Time)}
+		ln.Addresses = slices.Clone(l.Addresses)
+		if ln.Baud == 0 && l.Device != nil {
+			ln.Baud = l.Device.baud
+		}
+		if ln.Baud > 0 {
+			ln.perByte = 10 * time.Second / time.Duration(ln.Baud)
+		}
+		s.links = append(s.links, ln)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			ln.write()
+		}()
+	}
+	return s
+}
+
+// calibrateWait is how long Calibrate waits for a port's pongs, and
+// settle how long, at least, for another once one has come: the devices
+// chained on a port answer one after another.
+const (
+	calibrateWait = time.Second
+	settle        = 20 * time.Millisecond
+)
+
+// Calibrate pings each port rounds times, all of them at once, before
+// anything is sent through s and while nothing else reads the Devices'
+// Messages. The first ping learns which devices answer on each port, and
+// the rest time the first pong to come back: half the median round trip
+// is the port's latency. Lookahead becomes Need.
+func (s *Scheduler) Calibrate(ctx context.Context, rounds int) error {
+	errs := make([]error, len(s.links))
+	var wg sync.WaitGroup
+	for i, l := range s.links {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = l.calibrate(ctx, max(rounds, 1))
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	need := s.Need()
+	s.mu.Lock()
+	s.Lookahead = need
+	s.mu.Unlock()
+	return nil
+}
+
+func (l *link) calibrate(ctx context.Context, rounds int) error {
+	var trips []time.Duration
+	for round := range rounds + 1 {
+		trip, found, err := l.ping(ctx, round == 0)
+		if err != nil {
+			return fmt.Errorf("controller: calibrate %s: %w", l.Name, err)
+		}
+		if len(found) == 0 {
+			return fmt.Errorf("controller: calibrate %s: no device answered", l.Name)
+		}
+		if round == 0 {
+			l.mu.Lock()
+			for _, a := range found {
+				if !slices.Contains(l.Addresses, a) {
+					l.Addresses = append(l.Addresses, a)
+				}
+			}
+			l.mu.Unlock()
+			continue
+		}
+		trips = append(trips, trip)
+	}
+	slices.Sort(trips)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Latency = trips[len(trips)/2] / 2
+	return nil
+}
+
+// ping pings the port and returns how long the first pong took and the
+// addresses that answered. It waits for every device known to answer, or
+// with discover for pongs until none comes for a while.
+func (l *link) ping(ctx context.Context, discover bool) (time.Duration, []byte, error) {
+	l.mu.Lock()
+	known := len(l.Addresses)
+	l.mu.Unlock()
+	start := time.Now()
+	if err := l.Device.Send(protocol.Ping()); err != nil {
+		return 0, nil, err
+	}
+	deadline := start.Add(calibrateWait)
+	var (
+		trip  time.Duration
+		found []byte
+	)
+	for discover || len(found) == 0 || len(found) < known {
+		wait, cancel := context.WithDeadline(ctx, deadline)
+		m, err := l.Device.Receive(wait)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, nil, ctx.Err()
+			}
+			if errors.Is(err, context.DeadlineExceeded) {
+				break
+			}
+			return 0, nil, err
+		}
+		if m.Device != config.SystemAddress || m.Command != config.CmdPong || len(m.Payload) < 3 {
+			continue
+		}
+		if len(found) == 0 {
+			trip = time.Since(start)
+		}
+		found = append(found, m.Payload[0])
+		if discover {
+			if next := time.Now().Add(max(settle, 2*trip)); next.Before(deadline) {
+				deadline = next
+			}
+		}
+	}
+	return trip, found, nil
+}
+
+// Links returns the ports s sends to, with what Calibrate found.
+func (s *Scheduler) Links() []Link {
+	var out []Link
+	for _, l := range s.links {
+		l.mu.Lock()
+		ln := l.Link
+		ln.Addresses = slices.Clone(l.Addresses)
+		l.mu.Unlock()
+		out = append(out, ln)
+	}
+	return out
+}
+
+// SetOffset sets how much earlier than the rest what is sent to device
+// is written, from the next message on; negative for later. If its
+// port's latency and the offset add up to more than Lookahead, it returns
+// a *LookaheadError, but sets the offset all the same.
+func (s *Scheduler) SetOffset(device byte, offset time.Duration) error {
+	s.mu.Lock()
+	if offset == 0 {
+		delete(s.offsets, device)
+	} else {
+		s.offsets[device] = offset
+	}
+	s.mu.Unlock()
+	return s.CheckDevice(device)
+}
+
+// Offset returns device's offset.
+func (s *Scheduler) Offset(device byte) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.offsets[device]
+}
+
+// Need returns the Lookahead every device needs to sound in time: the
+// largest a port's latency and the offset of a device on it add up to.
+func (s *Scheduler) Need() time.Duration {
+	s.mu.Lock()
+	offsets := maps.Clone(s.offsets)
+	s.mu.Unlock()
+	var need time.Duration
+	for _, l := range s.links {
+		l.mu.Lock()
+		need = max(need, l.Latency)
+		for d, o := range offsets {
+			if s.carries(l, d) {
+				need = max(need, l.Latency+o)
+			}
+		}
+		l.mu.Unlock()
+	}
+	return need
+}
+
+// CheckDevice returns a *LookaheadError if device needs more than
+// Lookahead to sound in time.
+func (s *Scheduler) CheckDevice(device byte) error {
+	s.mu.Lock()
+	lookahead, need := s.Lookahead, s.offsets[device]
+	s.mu.Unlock()
+	for _, l := range s.links {
+		l.mu.Lock()
+		if s.carries(l, device) {
+			need += l.Latency
+			l.mu.Unlock()
+			break
+		}
+		l.mu.Unlock()
+	}
+	if need > lookahead {
+		return &LookaheadError{Device: device, Need: need, Lookahead: lookahead}
+	}
+	return nil
+}
+
+// Check returns a *LookaheadError, joined, for each device found on a
+// port or given an offset that needs more than Lookahead.
+func (s *Scheduler) Check() error {
+	s.mu.Lock()
+	devices := slices.Collect(maps.Keys(s.offsets))
+	s.mu.Unlock()
+	for _, l := range s.Links() {
+		devices = append(devices, l.Addresses...)
+	}
+	slices.Sort(devices)
+	var errs []error
+	for _, d := range slices.Compact(devices) {
+		errs = append(errs, s.CheckDevice(d))
+	}
+	return errors.Join(errs...)
+}
+
+// carries reports whether l is the port for device, with l.mu held.
+func (s *Scheduler) carries(l *link, device byte) bool {
+	return len(s.links) == 1 || slices.Contains(l.Addresses, device)
+}
+
+// Send queues m for the port of its device, or for every port if it is
+// for the system address.
+func (s *Scheduler) Send(m protocol.Message) error {
+	s.mu.Lock()
+	closed, lookahead, offset := s.closed, s.Lookahead, s.offsets[m.Device]
+	s.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	now := time.Now()
+	sent := false
+	for _, l := range s.links {
+		l.mu.Lock()
+		ok := m.Device == config.SystemAddress || s.carries(l, m.Device)
+		latency := l.Latency
+		l.mu.Unlock()
+		if !ok {
+			continue
+		}
+		if err := l.Device.Err(); err != nil {
+			return err
+		}
+		l.push(now.Add(lookahead-latency-offset), m)
+		sent = true
+	}
+	if !sent {
+		return fmt.Errorf("controller: no port has device 0x%02X", m.Device)
+	}
+	return nil
+}
+
+// WaitConnected returns once every port's link is up, as Device's does.
+func (s *Scheduler) WaitConnected(ctx context.Context) error {
+	for _, l := range s.links {
+		if err := l.Device.WaitConnected(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close writes what is queued, when it is due, and stops the writers.
+// It leaves the Devices open.
+func (s *Scheduler) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	s.closed = true
+	s.mu.Unlock()
+	for _, l := range s.links {
+		l.mu.Lock()
+		l.closing = true
+		l.mu.Unlock()
+		l.signal()
+	}
+	s.wg.Wait()
+	return nil
+}
+
+// push queues m to be written at, or once what came before it for its
+// device is.
+func (l *link) push(at time.Time, m protocol.Message) {
+	l.mu.Lock()
+	if m.Device == config.SystemAddress {
+		at = latest(at, l.latest)
+	} else {
+		at = latest(at, l.last[m.Device], l.last[config.SystemAddress])
+	}
+	l.last[m.Device], l.latest = at, latest(at, l.latest)
+	l.seq++
+	j := scheduled{at: at, seq: l.seq, m: m}
+	i, _ := slices.BinarySearchFunc(l.queue, j, func(a, b scheduled) int {
+		if c := a.at.Compare(b.at); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.seq, b.seq)
+	})
+	l.queue = slices.Insert(l.queue, i, j)
+	first := i == 0
+	l.mu.Unlock()
+	if first {
+		l.signal()
+	}
+}
+
+func latest(t time.Time, ts ...time.Time) time.Time {
+	for _, u := range ts {
+		if u.After(t) {
+			t = u
+		}
+	}
+	return t
+}
+
+func (l *link) signal() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// write writes each queued message to the port when it is due, and with
+// a Baud when the port has room for it, until the Scheduler closes and
+// the queue is empty.
+func (l *link) write() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	var wire time.Time // when what has been written is out of the port
+	for {
+		l.mu.Lock()
+		if len(l.queue) == 0 {
+			closing := l.closing
+			l.mu.Unlock()
+			if closing {
+				return
+			}
+			<-l.wake
+			continue
+		}
+		if wait := time.Until(l.queue[0].at); wait > 0 {
+			l.mu.Unlock()
+			l.sleep(timer, wait)
+			continue
+		}
+		now := time.Now()
+		i := 0
+		if l.perByte > 0 {
+			i = l.pick(now)
+			took := time.Duration(l.queue[i].m.Len()) * l.perByte
+			if ahead := wire.Sub(now); ahead > 0 && ahead+took > backlog {
+				l.mu.Unlock()
+				l.sleep(timer, ahead+took-backlog)
+				continue
+			}
+			wire = latest(now, wire).Add(took)
+		}
+		next := l.queue[i]
+		l.queue = slices.Delete(l.queue, i, i+1)
+		t := &l.Throttling
+		t.Written++
+		late := now.Sub(next.at)
+		t.Worst = max(t.Worst, late)
+		if late > l.s.late() {
+			t.Delayed++
+		}
+		l.mu.Unlock()
+		l.Device.Send(next.m)
+	}
+}
+
+// sleep waits for d, or for a push to wake the writer.
+func (l *link) sleep(timer *time.Timer, d time.Duration) {
+	timer.Reset(d)
+	select {
+	case <-timer.C:
+	case <-l.wake:
+	}
+}
+
+// late returns how late a message may be written before it counts as
+// delayed.
+func (s *Scheduler) late() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return cmp.Or(s.Late, DefaultLate)
+}
+
+// pick returns the index in the queue of the message to write next of
+// those due at now, with l.mu held: the first of the most urgent that no
+// message before it must precede, a message as urgent as the most urgent
+// waiting for it. A pitch bend a later one to its drive would overwrite
+// before anything else reached the drive is dropped.
+func (l *link) pick(now time.Time) int {
+	due, _ := slices.BinarySearchFunc(l.queue, now, func(q scheduled, now time.Time) int {
+		return cmp.Or(q.at.Compare(now), -1)
+	})
+	for {
+		best, most := -1, 0
+		for i, q := range l.queue[:due] {
+			if slices.ContainsFunc(l.queue[:i], func(p scheduled) bool { return touches(p.m, q.m) }) {
+				continue
+			}
+			u := urgency(q.m)
+			for _, r := range l.queue[i+1 : due] {
+				if touches(q.m, r.m) {
+					u = min(u, urgency(r.m))
+				}
+			}
+			if best < 0 || u < most {
+				best, most = i, u
+			}
+			if most == 0 {
+				break
+			}
+		}
+		m := l.queue[best].m
+		if m.Device == config.SystemAddress || m.Command != config.DevCmdBendPitch {
+			return best
+		}
+		j := slices.IndexFunc(l.queue[best+1:due], func(q scheduled) bool { return touches(m, q.m) })
+		if j < 0 {
+			return best
+		}
+		if q := l.queue[best+1+j].m; q.Device != m.Device || q.Sub != m.Sub || q.Command != m.Command {
+			return best
+		}
+		l.queue = slices.Delete(l.queue, best, best+1)
+		l.Throttling.Dropped++
+		due--
+	}
+}
+
+// urgency ranks m for a port short of room: 0 goes first.
+func urgency(m protocol.Message) int {
+	switch {
+	case m.Device == config.SystemAddress, m.Command == config.DevCmdNoteOff, m.Command == config.DevCmdReset:
+		return 0
+	case m.Command == config.DevCmdBendPitch:
+		return 2
+	}
+	return 1
+}
+
+// touches reports whether a and b could change what the other does, so
+// must be written in the order they were sent: either is for the system
+// address, or both for one device and one drive, or one for all of the
+// device's drives or a zone of them.
+func touches(a, b protocol.Message) bool {
+	switch {
+	case a.Device == config.SystemAddress || b.Device == config.SystemAddress:
+		return true
+	case a.Device != b.Device:
+		return false
+	}
+	drive := func(sub byte) bool { return sub > 0 && sub < config.ZoneSubAddress }
+	return a.Sub == b.Sub || !drive(a.Sub) || !drive(b.Sub)
+}
@@ -0,0 +1,370 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// latePort is a port whose frames take latency to reach its devices, and
+// their pongs as long to come back, as over a slow USB adapter. It notes
+// when each note arrives.
+type latePort struct {
+	latency time.Duration
+	pongs   []protocol.Message
+	frames  chan sent
+	r       *io.PipeReader
+	w       *io.PipeWriter
+
+	mu      sync.Mutex
+	arrived []arrival
+}
+
+type sent struct {
+	at    time.Time
+	frame []byte
+}
+
+type arrival struct {
+	at time.Time
+	m  protocol.Message
+}
+
+func newLatePort(latency time.Duration, pongs ...protocol.Message) *latePort {
+	p := &latePort{latency: latency, pongs: pongs, frames: make(chan sent, 256)}
+	p.r, p.w = io.Pipe()
+	go p.deliver()
+	return p
+}
+
+func (p *latePort) Read(b []byte) (int, error) { return p.r.Read(b) }
+
+func (p *latePort) Write(b []byte) (int, error) {
+	p.frames <- sent{time.Now(), bytes.Clone(b)}
+	return len(b), nil
+}
+
+func (p *latePort) Close() error {
+	p.w.Close()
+	return p.r.Close()
+}
+
+// deliver hands each frame to the devices once it has arrived, and sends
+// back their pongs to a ping.
+func (p *latePort) deliver() {
+	var pending []byte
+	for s := range p.frames {
+		time.Sleep(time.Until(s.at.Add(p.latency)))
+		now := time.Now()
+		pending = append(pending, s.frame...)
+		for {
+			m, used, err := protocol.Decode(pending)
+			if errors.Is(err, protocol.ErrIncomplete) {
+				break
+			}
+			pending = pending[used:]
+			if err != nil {
+				continue
+			}
+			if m.Device == config.SystemAddress && m.Command == config.CmdPing {
+				time.AfterFunc(p.latency, func() {
+					for _, pong := range p.pongs {
+						buf := make([]byte, pong.Len())
+						pong.Encode(buf)
+						p.w.Write(buf)
+					}
+				})
+				continue
+			}
+			p.mu.Lock()
+			p.arrived = append(p.arrived, arrival{now, m})
+			p.mu.Unlock()
+		}
+	}
+}
+
+// arrivals waits for n messages to have arrived, and returns them.
+func (p *latePort) arrivals(t *testing.T, n int) []arrival {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		p.mu.Lock()
+		got := append([]arrival(nil), p.arrived...)
+		p.mu.Unlock()
+		if len(got) >= n {
+			return got
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages arrived, want %d", len(got), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	near := newLatePort(2*time.Millisecond, protocol.Pong(0x01, 1, 8))
+	far := newLatePort(30*time.Millisecond, protocol.Pong(0x02, 1, 4), protocol.Pong(0x03, 1, 4))
+	nearDev, farDev := New(near), New(far)
+	defer nearDev.Close()
+	defer farDev.Close()
+
+	s := NewScheduler(Link{Name: "near", Device: nearDev}, Link{Name: "far", Device: farDev})
+	if err := s.Calibrate(context.Background(), 5); err != nil {
+		t.Fatal(err)
+	}
+	links := s.Links()
+	if !bytes.Equal(links[0].Addresses, []byte{0x01}) || !bytes.Equal(links[1].Addresses, []byte{0x02, 0x03}) {
+		t.Errorf("addresses %v and %v", links[0].Addresses, links[1].Addresses)
+	}
+	for i, want := range []time.Duration{2 * time.Millisecond, 30 * time.Millisecond} {
+		if got := links[i].Latency; got < want || got > want+10*time.Millisecond {
+			t.Errorf("%s: latency %v, want %v", links[i].Name, got, want)
+		}
+	}
+	if s.Lookahead != links[1].Latency {
+		t.Errorf("lookahead %v, want the far port's %v", s.Lookahead, links[1].Latency)
+	}
+
+	// A chord struck at once sounds at once, though its notes go out on
+	// ports 28ms apart; sent straight to the Devices they wouldn't.
+	for _, m := range []protocol.Message{protocol.NoteOn(0x02, 1, 60), protocol.NoteOn(0x01, 1, 64), protocol.NoteOn(0x03, 1, 67)} {
+		if err := s.Send(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nearGot, farGot := near.arrivals(t, 1), far.arrivals(t, 2)
+	for _, a := range append([]arrival{nearGot[0]}, farGot...) {
+		if skew := a.at.Sub(nearGot[0].at).Abs(); skew > 5*time.Millisecond {
+			t.Errorf("%v arrived %v from the near port's note", a.m, skew)
+		}
+	}
+	nearDev.Send(protocol.NoteOff(0x01, 1, 64))
+	farDev.Send(protocol.NoteOff(0x02, 1, 60))
+	nearOff, farOff := near.arrivals(t, 2)[1], far.arrivals(t, 3)[2]
+	if skew := farOff.at.Sub(nearOff.at); skew < 20*time.Millisecond {
+		t.Errorf("sent straight, the far port was only %v late", skew)
+	}
+
+	// The system address goes to every port; one no port has is an error.
+	if err := s.Send(protocol.AllNotesOff(config.SystemAddress)); err != nil {
+		t.Error(err)
+	}
+	if err := s.Send(protocol.NoteOn(0x09, 1, 60)); err == nil {
+		t.Error("sent to a device no port has")
+	}
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+	if got := near.arrivals(t, 3)[2].m; got.Device != config.SystemAddress {
+		t.Errorf("near port got %v last, want all notes off: Close writes what is queued", got)
+	}
+	far.arrivals(t, 4)
+	if err := s.Send(protocol.NoteOn(0x01, 1, 60)); err != ErrClosed {
+		t.Errorf("Send after Close = %v", err)
+	}
+}
+
+// TestSchedulerOffsets gives a device on the far port an offset, on top of
+// its port's latency: its notes must arrive that much before the rest.
+func TestSchedulerOffsets(t *testing.T) {
+	near := newLatePort(2*time.Millisecond, protocol.Pong(0x01, 1, 8))
+	far := newLatePort(20*time.Millisecond, protocol.Pong(0x02, 1, 4), protocol.Pong(0x03, 1, 4))
+	nearDev, farDev := New(near), New(far)
+	defer nearDev.Close()
+	defer farDev.Close()
+
+	s := NewScheduler(Link{Name: "near", Device: nearDev}, Link{Name: "far", Device: farDev})
+	defer s.Close()
+	s.SetOffset(0x02, 10*time.Millisecond)
+	if err := s.Calibrate(context.Background(), 5); err != nil {
+		t.Fatal(err)
+	}
+	if far := s.Links()[1].Latency; s.Lookahead != far+10*time.Millisecond {
+		t.Errorf("lookahead %v, want the far port's %v and the offset", s.Lookahead, far)
+	}
+	if err := s.Check(); err != nil {
+		t.Error(err)
+	}
+	for _, d := range []byte{0x01, 0x02, 0x03} {
+		if err := s.Send(protocol.NoteOn(d, 1, 60)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	at := map[byte]time.Time{}
+	for _, a := range append(near.arrivals(t, 1), far.arrivals(t, 2)...) {
+		at[a.m.Device] = a.at
+	}
+	if skew := at[0x03].Sub(at[0x01]).Abs(); skew > 3*time.Millisecond {
+		t.Errorf("0x03 arrived %v from 0x01", skew)
+	}
+	if early := at[0x01].Sub(at[0x02]); early < 7*time.Millisecond || early > 13*time.Millisecond {
+		t.Errorf("0x02 arrived %v early, want 10ms", early)
+	}
+
+	// An offset changed mid-note doesn't let the note-off overtake it.
+	s.Send(protocol.NoteOn(0x03, 1, 62))
+	s.SetOffset(0x03, 8*time.Millisecond)
+	s.Send(protocol.NoteOff(0x03, 1, 62))
+	got := far.arrivals(t, 4)
+	if got[2].m.Command != config.DevCmdNoteOn || got[3].m.Command != config.DevCmdNoteOff {
+		t.Errorf("0x03 got %v then %v", got[2].m, got[3].m)
+	}
+
+	err := s.SetOffset(0x01, s.Lookahead)
+	var le *LookaheadError
+	if !errors.As(err, &le) || le.Device != 0x01 || le.Need <= le.Lookahead {
+		t.Errorf("SetOffset past the lookahead = %v", err)
+	}
+	if s.Offset(0x01) != s.Lookahead || !errors.As(s.Check(), &le) {
+		t.Errorf("offset %v, and Check %v", s.Offset(0x01), s.Check())
+	}
+}
+
+func TestSchedulerDisconnected(t *testing.T) {
+	p := newLatePort(time.Millisecond, protocol.Pong(0x01, 1, 8))
+	d := New(p)
+	s := NewScheduler(Link{Name: "p", Device: d, Addresses: []byte{0x01}})
+	defer s.Close()
+	d.Close()
+	if err := s.Send(protocol.NoteOn(0x01, 1, 60)); err != ErrClosed {
+		t.Errorf("Send = %v, want the Device's error", err)
+	}
+}
+
+// TestSchedulerBaud sends a burst, all due at once, to a port at 9600
+// baud, which carries a frame in about 7ms, and checks what was written
+// first, that the port was never written faster than it carries, and
+// that only bends were dropped.
+func TestSchedulerBaud(t *testing.T) {
+	p := newLatePort(0)
+	d := New(p)
+	defer d.Close()
+	s := NewScheduler(Link{Name: "slow", Device: d, Baud: 9600})
+	s.Lookahead = 20 * time.Millisecond
+
+	// The sequence start goes first, before everything after it: a
+	// system message holds up the rest.
+	burst := []protocol.Message{protocol.SequenceStart()}
+	for v := range 10 {
+		burst = append(burst, protocol.PitchBend(0x01, 2, int16(v*100)))
+	}
+	burst = append(burst,
+		protocol.NoteOn(0x01, 3, 60),
+		protocol.NoteOff(0x01, 1, 50),
+		protocol.NoteOn(0x01, 4, 62),
+		protocol.PitchBend(0x01, 3, 500),
+		protocol.NoteOff(0x01, 5, 55),
+		protocol.NoteOff(0x01, 3, 60),
+	)
+	for _, m := range burst {
+		if err := s.Send(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	// Drive 3's note-on and bend go early, as its note-off waits for
+	// them, the other note-on after the note-offs, and drive 2's bends
+	// last, only the last of them.
+	want := []protocol.Message{
+		protocol.SequenceStart(),
+		protocol.NoteOn(0x01, 3, 60),
+		protocol.NoteOff(0x01, 1, 50),
+		protocol.PitchBend(0x01, 3, 500),
+		protocol.NoteOff(0x01, 5, 55),
+		protocol.NoteOff(0x01, 3, 60),
+		protocol.NoteOn(0x01, 4, 62),
+		protocol.PitchBend(0x01, 2, 900),
+	}
+	got := p.arrivals(t, len(want))
+	if len(got) != len(want) {
+		t.Fatalf("%d messages arrived, want %d", len(got), len(want))
+	}
+	n := 0
+	for i, a := range got {
+		if a.m.Device != want[i].Device || a.m.Sub != want[i].Sub || a.m.Command != want[i].Command || string(a.m.Payload) != string(want[i].Payload) {
+			t.Errorf("message %d: got %v, want %v", i, a.m, want[i])
+		}
+		if i > 0 {
+			n += a.m.Len()
+		}
+	}
+	// What came after the first frame took the port's time to carry, but
+	// for the backlog it let wait.
+	perByte := 10 * time.Second / 9600
+	if took, least := got[len(got)-1].at.Sub(got[0].at), time.Duration(n)*perByte-backlog; took < least {
+		t.Errorf("written in %v, faster than 9600 baud carries it, %v", took, least)
+	}
+	th := s.Links()[0].Throttling
+	if th.Written != len(want) || th.Dropped != 9 || th.Delayed == 0 || th.Worst < 40*time.Millisecond {
+		t.Errorf("throttling %v, want %d written, 9 dropped, some delayed", th, len(want))
+	}
+}
+
+// TestSchedulerBaudOrder sends a dense random stream of notes and bends
+// on four drives to a port too slow for it, and checks every note-off
+// arrives, and each drive's notes in the order they were sent.
+func TestSchedulerBaudOrder(t *testing.T) {
+	p := newLatePort(0)
+	d := New(p)
+	defer d.Close()
+	s := NewScheduler(Link{Name: "slow", Device: d, Baud: 57600})
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	var notes [5][]protocol.Message
+	var sounding [5]bool
+	sent := 0
+	for range 300 {
+		drive := byte(1 + rng.IntN(4))
+		var m protocol.Message
+		switch {
+		case rng.IntN(3) > 0:
+			m = protocol.PitchBend(0x01, drive, int16(rng.IntN(8192)))
+		case sounding[drive]:
+			m = protocol.NoteOff(0x01, drive, 60)
+		default:
+			m = protocol.NoteOn(0x01, drive, 60)
+		}
+		if m.Command != config.DevCmdBendPitch {
+			sounding[drive] = !sounding[drive]
+			notes[drive] = append(notes[drive], m)
+		}
+		if err := s.Send(m); err != nil {
+			t.Fatal(err)
+		}
+		sent++
+		if rng.IntN(10) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	s.Close()
+
+	th := s.Links()[0].Throttling
+	if th.Written+th.Dropped != sent || th.Dropped == 0 {
+		t.Fatalf("throttling %v of %d sent, want some bends dropped", th, sent)
+	}
+	var got [5][]protocol.Message
+	for _, a := range p.arrivals(t, th.Written) {
+		if a.m.Command != config.DevCmdBendPitch {
+			got[a.m.Sub] = append(got[a.m.Sub], a.m)
+		}
+	}
+	for drive := 1; drive <= 4; drive++ {
+		if len(got[drive]) != len(notes[drive]) {
+			t.Fatalf("drive %d: %d notes on and off arrived, want %d", drive, len(got[drive]), len(notes[drive]))
+		}
+		for i, m := range got[drive] {
+			if m.Command != notes[drive][i].Command {
+				t.Errorf("drive %d: message %d is %v, want %v", drive, i, m, notes[drive][i])
+			}
+		}
+	}
+}
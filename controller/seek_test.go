@@ -0,0 +1,418 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// testdata/seek/overlap.mid is in 4/4 at 120 BPM on channels 1 and 2,
+// then 2/4 at 60 BPM from bar 3, 4s in:
+//
+//	   0ms  on  1/60 v100
+//	 500ms  on  1/64
+//	1000ms  on  1/67
+//	1500ms  off 1/64, on 1/60 v80: struck again, still held
+//	1750ms  pitch bend 1 +1000
+//	2000ms  off 1/60, on 2/36
+//	2500ms  off 1/60
+//	3000ms  off 1/67
+//	4000ms  tempo 1000000, 2/4
+//	6000ms  on  1/72
+//	7000ms  off 1/72
+//	8000ms  off 2/36
+func readOverlap(t *testing.T) []Event {
+	t.Helper()
+	events, err := ReadSMF("testdata/seek/overlap.mid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+// notes lists note-ons as channel/note, with their velocity if not 100.
+func notes(events []Event) string {
+	var s []string
+	for _, ev := range events {
+		n := fmt.Sprintf("%d/%d", ev.Channel+1, ev.Note)
+		if ev.Value != 100 {
+			n += fmt.Sprintf("v%d", ev.Value)
+		}
+		s = append(s, n)
+	}
+	return strings.Join(s, " ")
+}
+
+func TestActiveAt(t *testing.T) {
+	events := readOverlap(t)
+	tests := []struct {
+		at   time.Duration
+		want string
+	}{
+		{0, ""},
+		{1200 * time.Millisecond, "1/60 1/64 1/67"},
+		{1500 * time.Millisecond, "1/60 1/64 1/67"}, // what happens at 1500ms hasn't yet
+		{1800 * time.Millisecond, "1/60 1/67 1/60v80"},
+		{2200 * time.Millisecond, "1/67 1/60v80 2/36v90"}, // the first strike of 60 released
+		{3000 * time.Millisecond, "1/67 2/36v90"},
+		{6000 * time.Millisecond, "2/36v90"},
+		{6500 * time.Millisecond, "2/36v90 1/72"},
+		{9 * time.Second, ""},
+	}
+	for _, tt := range tests {
+		if got := notes(ActiveAt(events, tt.at)); got != tt.want {
+			t.Errorf("at %v: %q, want %q", tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestBarTime(t *testing.T) {
+	events := readOverlap(t)
+	for bar, want := range map[int]time.Duration{
+		1: 0,
+		2: 2 * time.Second,
+		3: 4 * time.Second,
+		4: 6 * time.Second, // 2/4 at 60 BPM from bar 3
+		5: 8 * time.Second,
+		9: 16 * time.Second, // past the end
+	} {
+		if got := BarTime(events, bar); got != want {
+			t.Errorf("bar %d at %v, want %v", bar, got, want)
+		}
+	}
+
+	// 3/4 from half way through bar 2 starts bar 3 there.
+	events = []Event{{At: 3 * time.Second, Kind: Meter, Note: 3, Value: 4}}
+	if got := BarTime(events, 3); got != 3*time.Second {
+		t.Errorf("bar 3 at %v, want 3s", got)
+	}
+	if got := BarTime(events, 4); got != 4500*time.Millisecond {
+		t.Errorf("bar 4 at %v, want 4.5s", got)
+	}
+}
+
+// checkPlayed checks the messages sent from the first on, and when the
+// last went.
+func checkPlayed(t *testing.T, r *recorder, first int, want []protocol.Message, last time.Duration) {
+	t.Helper()
+	var got []protocol.Message
+	for _, s := range r.sent[first:] {
+		got = append(got, s.m)
+	}
+	checkSent(t, got, want)
+	if end := r.sent[len(r.sent)-1]; end.at != last {
+		t.Errorf("song ended at %v, want %v", end.at, last)
+	}
+}
+
+// TestSeek seeks forward into the overlapping notes, and back to them by
+// bar, checking what is silenced and struck again, and that the song plays
+// on in time from there.
+func TestSeek(t *testing.T) {
+	tests := []struct {
+		name  string
+		from  byte // the note whose playing starts the seek
+		seek  func(p *Player)
+		first int // the message the seek silences from
+		want  []protocol.Message
+		last  time.Duration
+	}{
+		{
+			name:  "forward",
+			from:  60,
+			seek:  func(p *Player) { p.Seek(2200 * time.Millisecond) },
+			first: 2,
+			want: []protocol.Message{
+				protocol.NoteOff(0x01, 1, 60),
+				protocol.AllNotesOff(0x01),
+				protocol.PitchBend(0x01, 1, 1000),
+				protocol.NoteOnVelocity(0x01, 1, 67, 100),
+				protocol.NoteOnVelocity(0x01, 1, 60, 80),
+				protocol.NoteOnVelocity(0x01, 2, 36, 90),
+				protocol.NoteOff(0x01, 1, 60),
+				protocol.NoteOff(0x01, 1, 67),
+				protocol.NoteOnVelocity(0x01, 1, 72, 100),
+				protocol.NoteOff(0x01, 1, 72),
+				protocol.NoteOff(0x01, 2, 36),
+				protocol.SequenceStop(),
+			},
+			last: 5800 * time.Millisecond, // 8000ms, less 2200
+		},
+		{
+			name:  "back",
+			from:  72,
+			seek:  func(p *Player) { p.SeekBar(2) },
+			first: 11,
+			want: []protocol.Message{
+				protocol.NoteOff(0x01, 1, 72),
+				protocol.NoteOff(0x01, 2, 36),
+				protocol.AllNotesOff(0x01),
+				protocol.PitchBend(0x01, 1, 1000),
+				protocol.NoteOnVelocity(0x01, 1, 60, 100), // 60 held twice, struck once
+				protocol.NoteOnVelocity(0x01, 1, 67, 100),
+				protocol.NoteOnVelocity(0x01, 2, 36, 90), // at 2000ms; 60 still held once
+				protocol.NoteOff(0x01, 1, 60),
+				protocol.NoteOff(0x01, 1, 67),
+				protocol.NoteOnVelocity(0x01, 1, 72, 100),
+				protocol.NoteOff(0x01, 1, 72),
+				protocol.NoteOff(0x01, 2, 36),
+				protocol.SequenceStop(),
+			},
+			last: 12 * time.Second, // from 6000ms to bar 2 at 2000ms, then to 8000ms
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, r := newRecorder(mapping.Channels(0x01, 1, 2))
+			seeked := false
+			p.Progress = func(ev Event) {
+				if ev.Kind == NoteOn && ev.Note == tt.from && !seeked {
+					tt.seek(p)
+					seeked = true
+				}
+			}
+			if err := p.Play(context.Background(), readOverlap(t)); err != nil {
+				t.Fatal(err)
+			}
+			checkPlayed(t, r, tt.first, tt.want, tt.last)
+		})
+	}
+}
+
+// TestPause pauses on the third note for 10s: the notes sounding are
+// silenced, struck again on resuming, and the rest of the song is 10s
+// later.
+func TestPause(t *testing.T) {
+	p, r := newRecorder(mapping.Channels(0x01, 1, 2))
+	p.Progress = func(ev Event) {
+		if ev.Kind == NoteOn && ev.Note == 67 {
+			p.Pause()
+		}
+	}
+	r.onSend = func(n int) {
+		if m := r.sent[n-1].m; m.Sub == 0 && m.Command == config.DevCmdNoteOff {
+			r.clock.t = r.clock.t.Add(10 * time.Second)
+			go p.Resume()
+		}
+	}
+	if err := p.Play(context.Background(), readOverlap(t)); err != nil {
+		t.Fatal(err)
+	}
+	checkPlayed(t, r, 4, []protocol.Message{
+		protocol.NoteOff(0x01, 1, 60),
+		protocol.NoteOff(0x01, 1, 64),
+		protocol.NoteOff(0x01, 1, 67),
+		protocol.AllNotesOff(0x01),
+		protocol.NoteOnVelocity(0x01, 1, 60, 100),
+		protocol.NoteOnVelocity(0x01, 1, 64, 100),
+		protocol.NoteOnVelocity(0x01, 1, 67, 100),
+		protocol.NoteOff(0x01, 1, 64),
+		protocol.NoteOnVelocity(0x01, 1, 60, 80),
+		protocol.PitchBend(0x01, 1, 1000),
+		protocol.NoteOnVelocity(0x01, 2, 36, 90),
+		protocol.NoteOff(0x01, 1, 60),
+		protocol.NoteOff(0x01, 1, 67),
+		protocol.NoteOnVelocity(0x01, 1, 72, 100),
+		protocol.NoteOff(0x01, 1, 72),
+		protocol.NoteOff(0x01, 2, 36),
+		protocol.SequenceStop(),
+	}, 18*time.Second)
+	if at := r.sent[11].at; at != 11500*time.Millisecond {
+		t.Errorf("note after the pause at %v, want 11.5s", at)
+	}
+}
+
+// TestMute mutes channel 1 on its third note and unmutes it with channel
+// 2's note: its notes sounding are released at once, and the notes and
+// note-offs it plays muted go nowhere.
+func TestMute(t *testing.T) {
+	p, r := newRecorder(mapping.Channels(0x01, 1, 2))
+	p.Progress = func(ev Event) {
+		switch {
+		case ev.Kind == NoteOn && ev.Note == 67:
+			p.Mute(0, true)
+		case ev.Kind == NoteOn && ev.Channel == 1:
+			if !p.Muted(0) {
+				t.Error("channel 1 unmuted early")
+			}
+			p.Mute(0, false)
+		}
+	}
+	if err := p.Play(context.Background(), readOverlap(t)); err != nil {
+		t.Fatal(err)
+	}
+	checkPlayed(t, r, 4, []protocol.Message{
+		protocol.NoteOff(0x01, 1, 60),
+		protocol.NoteOff(0x01, 1, 64),
+		protocol.NoteOff(0x01, 1, 67),
+		protocol.PitchBend(0x01, 1, 1000),
+		protocol.NoteOnVelocity(0x01, 2, 36, 90),
+		protocol.NoteOnVelocity(0x01, 1, 72, 100),
+		protocol.NoteOff(0x01, 1, 72),
+		protocol.NoteOff(0x01, 2, 36),
+		protocol.SequenceStop(),
+	}, 8*time.Second)
+	if at, length := p.Position(); at != 8*time.Second || length != 8*time.Second {
+		t.Errorf("ended at %v of %v, want 8s of 8s", at, length)
+	}
+}
+
+// TestSolo solos channel 2 on channel 1's third note, mutes channel 1
+// while it is soloed out, and clears the solo on channel 2's note:
+// channel 1 stays silent for its own mute, and sounds again from its next
+// note once that is cleared too.
+func TestSolo(t *testing.T) {
+	p, r := newRecorder(mapping.Channels(0x01, 1, 2))
+	p.Progress = func(ev Event) {
+		switch {
+		case ev.Kind == NoteOn && ev.Note == 67:
+			p.Solo(1, true)
+		case ev.Kind == NoteOn && ev.Value == 80:
+			if !p.Silenced(0) || p.Silenced(1) {
+				t.Error("solo didn't silence channel 1 alone")
+			}
+			p.Mute(0, true)
+		case ev.Kind == NoteOn && ev.Channel == 1:
+			p.Solo(1, false)
+			if !p.Silenced(0) || p.Soloed(1) {
+				t.Error("clearing the solo unmuted channel 1")
+			}
+		case ev.Kind == Tempo && ev.At > 0:
+			p.Mute(0, false)
+		}
+	}
+	if err := p.Play(context.Background(), readOverlap(t)); err != nil {
+		t.Fatal(err)
+	}
+	checkPlayed(t, r, 4, []protocol.Message{
+		protocol.NoteOff(0x01, 1, 60),
+		protocol.NoteOff(0x01, 1, 64),
+		protocol.NoteOff(0x01, 1, 67),
+		protocol.PitchBend(0x01, 1, 1000),
+		protocol.NoteOnVelocity(0x01, 2, 36, 90),
+		protocol.NoteOnVelocity(0x01, 1, 72, 100),
+		protocol.NoteOff(0x01, 1, 72),
+		protocol.NoteOff(0x01, 2, 36),
+		protocol.SequenceStop(),
+	}, 8*time.Second)
+}
+
+// TestMuteDevice plays channel 2 on a second device, solos it on channel
+// 1's third note, then mutes it mid-note and clears the solo: its note is
+// released at once, and the first device sounds again from its next note.
+func TestMuteDevice(t *testing.T) {
+	m := mapping.Channels(0x01, 1, 1)
+	m.Channels[1] = mapping.Channel{Target: mapping.Target{Device: 0x02, Sub: 1}}
+	p, r := newRecorder(m)
+	p.Progress = func(ev Event) {
+		switch {
+		case ev.Kind == NoteOn && ev.Note == 67:
+			p.SoloDevice(0x02, true)
+		case ev.Kind == NoteOn && ev.Channel == 1:
+			p.MuteDevice(0x02, true)
+			p.SoloDevice(0x02, false)
+		case ev.Kind == Tempo && ev.At > 0:
+			if !p.DeviceMuted(0x02) || p.DeviceSoloed(0x02) {
+				t.Error("device 0x02 not muted alone")
+			}
+		}
+	}
+	if err := p.Play(context.Background(), readOverlap(t)); err != nil {
+		t.Fatal(err)
+	}
+	checkPlayed(t, r, 4, []protocol.Message{
+		protocol.NoteOff(0x01, 1, 60),
+		protocol.NoteOff(0x01, 1, 64),
+		protocol.NoteOff(0x01, 1, 67),
+		protocol.PitchBend(0x01, 1, 1000),
+		protocol.NoteOnVelocity(0x02, 1, 36, 90),
+		protocol.NoteOff(0x02, 1, 36),
+		protocol.NoteOnVelocity(0x01, 1, 72, 100),
+		protocol.NoteOff(0x01, 1, 72),
+		protocol.SequenceStop(),
+	}, 8*time.Second)
+}
+
+// TestMuteSoloStuck mutes and solos channels and devices at random as the
+// song plays, channel 1 on a pool of two devices' drives, and checks that
+// every note struck on a drive is released by the end.
+func TestMuteSoloStuck(t *testing.T) {
+	m := &mapping.Map{}
+	m.Channels[0] = mapping.Channel{Stripe: []mapping.Pool{{Device: 0x01, First: 1, Last: 2}, {Device: 0x02, First: 1, Last: 2}}}
+	m.Channels[1] = mapping.Channel{Target: mapping.Target{Device: 0x02, Sub: 3}}
+	events := readOverlap(t)
+	for seed := range uint64(200) {
+		rng := rand.New(rand.NewPCG(seed, 0))
+		p, r := newRecorder(m)
+		p.Progress = func(Event) {
+			on := rng.IntN(2) == 0
+			switch rng.IntN(5) {
+			case 0:
+				p.Mute(byte(rng.IntN(2)), on)
+			case 1:
+				p.Solo(byte(rng.IntN(2)), on)
+			case 2:
+				p.MuteDevice(byte(1+rng.IntN(2)), on)
+			case 3:
+				p.SoloDevice(byte(1+rng.IntN(2)), on)
+			}
+		}
+		if err := p.Play(context.Background(), events); err != nil {
+			t.Fatal(err)
+		}
+		sounding := make(map[soundingNote]bool)
+		for _, s := range r.sent {
+			switch n := (soundingNote{mapping.Target{Device: s.m.Device, Sub: s.m.Sub}, 0}); {
+			case s.m.Command == config.DevCmdNoteOn:
+				n.note = s.m.Payload[0]
+				sounding[n] = true
+			case s.m.Command == config.DevCmdNoteOff && len(s.m.Payload) > 0:
+				n.note = s.m.Payload[0]
+				delete(sounding, n)
+			}
+		}
+		for n := range sounding {
+			t.Errorf("seed %d: %d on 0x%02X/%d never released", seed, n.note, n.Device, n.Sub)
+		}
+	}
+}
+
+// TestSetMapping moves the song to another device on its third note: the
+// notes sounding are silenced where they were and struck again there.
+func TestSetMapping(t *testing.T) {
+	p, r := newRecorder(mapping.Channels(0x01, 1, 2))
+	p.Progress = func(ev Event) {
+		if ev.Kind == NoteOn && ev.Note == 67 {
+			p.SetMapping(mapping.Channels(0x02, 3, 4))
+		}
+	}
+	if err := p.Play(context.Background(), readOverlap(t)); err != nil {
+		t.Fatal(err)
+	}
+	checkPlayed(t, r, 4, []protocol.Message{
+		protocol.NoteOff(0x01, 1, 60),
+		protocol.NoteOff(0x01, 1, 64),
+		protocol.NoteOff(0x01, 1, 67),
+		protocol.AllNotesOff(0x01),
+		protocol.NoteOnVelocity(0x02, 3, 60, 100),
+		protocol.NoteOnVelocity(0x02, 3, 64, 100),
+		protocol.NoteOnVelocity(0x02, 3, 67, 100),
+		protocol.NoteOff(0x02, 3, 64),
+		protocol.NoteOnVelocity(0x02, 3, 60, 80),
+		protocol.PitchBend(0x02, 3, 1000),
+		protocol.NoteOnVelocity(0x02, 4, 36, 90),
+		protocol.NoteOff(0x02, 3, 60),
+		protocol.NoteOff(0x02, 3, 67),
+		protocol.NoteOnVelocity(0x02, 3, 72, 100),
+		protocol.NoteOff(0x02, 3, 72),
+		protocol.NoteOff(0x02, 4, 36),
+		protocol.SequenceStop(),
+	}, 8*time.Second)
+}
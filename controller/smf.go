@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"io"
+	"time"
+
+	"github.com/ystepanoff/goppy/internal/smf"
+)
+
+// EventKind says what an Event does.
+type EventKind int
+
+const (
+	NoteOn    EventKind = iota
+	NoteOff             // also a note-on at velocity 0 in the file
+	Sustain             // CC64; Value is the pedal, >= 64 down
+	BendRange           // RPN 0; Value is the range in semitones
+	Pressure            // channel aftertouch; Value is the pressure
+	PitchBend           // Bend is the 14-bit bend, 8192 at the centre
+	Tempo               // Tempo is the new tempo
+	Meter               // time signature; Note is the numerator, Value the denominator
+	LoopStart           // a loopStart marker: see LoopMarkers
+	LoopEnd             // a loopEnd marker
+	Program             // program change; Value is the program, 0 to 127
+	Click               // a metronome click: see Clicks; Value is 1 on the first beat of a bar
+	ClickOff            // the end of a click
+)
+
+// Event is one MIDI event of a song, timed from the song's start.
+type Event struct {
+	At      time.Duration
+	Kind    EventKind
+	Channel byte // 0..15
+	Note    byte // NoteOn and NoteOff
+	Value   byte // velocity for NoteOn, else as Kind says
+	Bend    uint16
+	Tempo   uint32 // microseconds per quarter note
+}
+
+// ReadSMF reads the Standard MIDI File at path: see ParseSMF.
+func ReadSMF(path string) ([]Event, error) {
+	events, err := smf.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	return fromSMF(events), nil
+}
+
+// ParseSMF reads a Standard MIDI File into the events a Player plays, its
+// tracks merged in time order and timed through the file's tempo changes,
+// or by its SMPTE frames. A format 2 file's patterns play one after
+// another: see ParseSMFPatterns to play one alone. It keeps the tempo
+// changes and time signatures, for working out bars and beats. Events
+// after a track's end-of-track are dropped, as are those Event has no
+// kind for. Of the markers, it keeps those naming a loop's start and end.
+// A track cut short keeps the events before the cut.
+func ParseSMF(r io.Reader) ([]Event, error) {
+	events, err := smf.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+	return fromSMF(events), nil
+}
+
+// ReadSMFPatterns reads the Standard MIDI File at path into its
+// patterns: see ParseSMFPatterns.
+func ReadSMFPatterns(path string) ([][]Event, error) {
+	patterns, err := smf.ReadPatterns(path)
+	if err != nil {
+		return nil, err
+	}
+	return fromPatterns(patterns), nil
+}
+
+// ParseSMFPatterns reads a Standard MIDI File into the events of each of
+// its patterns, as ParseSMF does the whole: each track of a format 2
+// file, timed from its own start, or the one song of a format 0 or 1
+// file.
+func ParseSMFPatterns(r io.Reader) ([][]Event, error) {
+	patterns, err := smf.ParsePatterns(r)
+	if err != nil {
+		return nil, err
+	}
+	return fromPatterns(patterns), nil
+}
+
+func fromPatterns(patterns []smf.Pattern) [][]Event {
+	out := make([][]Event, len(patterns))
+	for i, p := range patterns {
+		out[i] = fromSMF(p.Events)
+	}
+	return out
+}
+
+func fromSMF(events []smf.NoteEvent) []Event {
+	out := make([]Event, 0, len(events))
+	for _, ev := range events {
+		e := Event{At: ev.At, Channel: ev.Channel, Note: ev.Note, Value: ev.Velocity, Bend: ev.Bend, Tempo: ev.Tempo}
+		switch ev.Kind {
+		case smf.EventNoteOn:
+			e.Kind = NoteOn
+		case smf.EventNoteOff:
+			e.Kind = NoteOff
+		case smf.EventSustain:
+			e.Kind = Sustain
+		case smf.EventBendRange:
+			e.Kind = BendRange
+		case smf.EventPressure:
+			e.Kind = Pressure
+		case smf.EventPitchBend:
+			e.Kind = PitchBend
+		case smf.EventTempo:
+			e.Kind = Tempo
+		case smf.EventMeter:
+			e.Kind = Meter
+		case smf.EventLoopStart:
+			e.Kind = LoopStart
+		case smf.EventLoopEnd:
+			e.Kind = LoopEnd
+		case smf.EventProgram:
+			e.Kind = Program
+		default:
+			continue
+		}
+		out = append(out, e)
+	}
+	return out
+}
@@ -0,0 +1,234 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// Supervision says how a Device watches its link and gets it back: see
+// Supervise. The zero value reopens the serial port OpenSerial opened,
+// with the defaults below.
+type Supervision struct {
+	// Open opens the port afresh, as after a USB adapter re-enumerates; it
+	// may scan for the device, if its port can change name. nil reopens
+	// the port OpenSerial opened, at the same baud, and waits for the
+	// board to boot.
+	Open func() (Port, error)
+
+	// Address is the device that must answer a ping on a reopened port
+	// before the link counts as back; 0 for any device.
+	Address byte
+
+	// Silence is how long the link may go without a byte from the devices
+	// before it counts as dead. The Device pings them after half of it,
+	// to draw an answer. 0 only notices a port that fails.
+	Silence time.Duration
+
+	// Backoff is the wait before the first attempt to reconnect, doubling
+	// after each that fails up to MaxBackoff. Default 250ms and 8s.
+	Backoff, MaxBackoff time.Duration
+
+	// Timeout is how long a reopened port has to answer the ping. Default
+	// 1s.
+	Timeout time.Duration
+
+	// Notify, if set, is called with the *DisconnectedError when the link
+	// goes down, and with nil when it is back.
+	Notify func(err error)
+}
+
+// errSilent is why a link that went quiet for Supervision.Silence is
+// dropped.
+var errSilent = errors.New("no reply from the devices")
+
+// Supervise keeps d's link up from now on: when the port fails, or goes
+// quiet for s.Silence, the Device closes it and reopens it with s.Open,
+// again and again with backoff until a device answers or d is closed.
+// While the link is down Send and Err report a *DisconnectedError and
+// WaitConnected waits; Messages stays open. Devices reboot as their port
+// is reopened, so whatever was sending picks up from there: a Player
+// does, resending SequenceStart and the notes sounding.
+//
+// It fails if s.Open is nil and d wasn't opened by OpenSerial, or if d
+// is already closed or supervised.
+func (d *Device) Supervise(s Supervision) error {
+	if s.Open == nil {
+		if d.baud == 0 {
+			return errors.New("controller: nothing to reopen: set Supervision.Open")
+		}
+		name, baud := d.name, d.baud
+		s.Open = func() (Port, error) {
+			p, err := openSystemPort(name, baud)
+			if err != nil {
+				return nil, err
+			}
+			time.Sleep(bootWait)
+			return p, nil
+		}
+	}
+	if s.Backoff <= 0 {
+		s.Backoff = 250 * time.Millisecond
+	}
+	if s.MaxBackoff < s.Backoff {
+		s.MaxBackoff = max(8*time.Second, s.Backoff)
+	}
+	if s.Timeout <= 0 {
+		s.Timeout = time.Second
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case d.closed:
+		return ErrClosed
+	case d.sup != nil:
+		return errors.New("controller: device already supervised")
+	}
+	d.sup = &s
+	d.lastRead = time.Now()
+	if s.Silence > 0 {
+		go d.watch(s.Silence)
+	}
+	return nil
+}
+
+// WaitConnected returns once d's link is up, at once if it is. Without
+// Supervise a lost link never comes back, and it returns the
+// *DisconnectedError; it returns ErrClosed once d is closed, and ctx's
+// error if ctx is done first.
+func (d *Device) WaitConnected(ctx context.Context) error {
+	d.mu.Lock()
+	up, err, sup, closed := d.up, d.err, d.sup, d.closed
+	d.mu.Unlock()
+	switch {
+	case closed:
+		return ErrClosed
+	case err == nil:
+		return nil
+	case sup == nil:
+		return err
+	}
+	select {
+	case <-up:
+		return nil
+	case <-d.stop:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// watch pings the devices once the link has been quiet for half of
+// silence, and drops the link once it has been quiet for all of it.
+func (d *Device) watch(silence time.Duration) {
+	tick := time.NewTicker(silence / 4)
+	defer tick.Stop()
+	var frame [protocol.HeaderSize + 1]byte
+	protocol.Ping().Encode(frame[:])
+	for {
+		select {
+		case <-tick.C:
+		case <-d.stop:
+			return
+		}
+		d.mu.Lock()
+		quiet, down := time.Since(d.lastRead), d.err != nil
+		d.mu.Unlock()
+		switch {
+		case down:
+		case quiet >= silence:
+			d.fail(fmt.Errorf("%w for %v", errSilent, silence))
+		case quiet >= silence/2:
+			d.write(frame[:])
+		}
+	}
+}
+
+// reconnect opens the port afresh until a device answers on it, and puts
+// it in place. It returns nil without Supervise, or once d is closed.
+func (d *Device) reconnect() Port {
+	d.mu.Lock()
+	s := d.sup
+	d.mu.Unlock()
+	if s == nil {
+		return nil
+	}
+	wait := s.Backoff
+	for {
+		select {
+		case <-time.After(wait):
+		case <-d.stop:
+			return nil
+		}
+		wait = min(2*wait, s.MaxBackoff)
+		port, err := s.Open()
+		if err != nil {
+			continue
+		}
+		if !answers(port, s.Address, s.Timeout) {
+			port.Close()
+			continue
+		}
+		d.mu.Lock()
+		if d.closed {
+			d.mu.Unlock()
+			port.Close()
+			return nil
+		}
+		d.port, d.err, d.lastRead = port, nil, time.Now()
+		close(d.up)
+		d.mu.Unlock()
+		if s.Notify != nil {
+			s.Notify(nil)
+		}
+		return port
+	}
+}
+
+// answers pings port and reports whether the device at address, or any
+// device if address is 0, pongs within timeout. It closes port if not.
+func answers(port Port, address byte, timeout time.Duration) bool {
+	found := make(chan bool, 1)
+	go func() {
+		var frame [protocol.HeaderSize + 1]byte
+		protocol.Ping().Encode(frame[:])
+		if _, err := port.Write(frame[:]); err != nil {
+			found <- false
+			return
+		}
+		var pending []byte
+		buf := make([]byte, 64)
+		for {
+			n, err := port.Read(buf)
+			pending = append(pending, buf[:n]...)
+			for len(pending) > 0 {
+				m, used, derr := protocol.Decode(pending)
+				if errors.Is(derr, protocol.ErrIncomplete) {
+					break
+				}
+				pending = pending[used:]
+				if derr == nil && m.Device == config.SystemAddress && m.Command == config.CmdPong &&
+					len(m.Payload) >= 3 && (address == 0 || m.Payload[0] == address) {
+					found <- true
+					return
+				}
+			}
+			if err != nil {
+				found <- false
+				return
+			}
+		}
+	}()
+	select {
+	case ok := <-found:
+		return ok
+	case <-time.After(timeout):
+		port.Close() // and the read fails
+		<-found
+		return false
+	}
+}
@@ -0,0 +1,211 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// timedDevice is a supervised Device that notes when, on a Player's fake
+// clock, each message is handed to it, and moves the clock on by outage
+// while the link is down.
+type timedDevice struct {
+	*Device
+	clock  *fakeClock
+	outage time.Duration
+	sent   []sentMessage
+}
+
+func (d *timedDevice) Send(m protocol.Message) error {
+	d.sent = append(d.sent, sentMessage{d.clock.t.Sub(time.Time{}), m})
+	return d.Device.Send(m)
+}
+
+func (d *timedDevice) WaitConnected(ctx context.Context) error {
+	err := d.Device.WaitConnected(ctx)
+	d.clock.t = d.clock.t.Add(d.outage)
+	return err
+}
+
+// TestReconnectResync pulls the cable after a song's first two notes:
+// the Device reopens its port on a fresh bus, taking five seconds of the
+// song's clock to do it, and the Player resyncs the rebooted device with
+// SequenceStart and the notes held, then plays on five seconds late, the
+// note-off it was sending when the link dropped included.
+func TestReconnectResync(t *testing.T) {
+	host, far := net.Pipe()
+	// The cable is pulled once SequenceStart and two notes are in.
+	go (&fakeBus{conn: far, got: make(chan protocol.Message, 16), hangUp: 3}).serve()
+
+	clock := &fakeClock{}
+	var (
+		mu     sync.Mutex
+		second *fakeBus
+		events []string
+	)
+	late := 5 * time.Second
+	dev := &timedDevice{Device: New(host), clock: clock, outage: late}
+	defer dev.Close()
+	err := dev.Supervise(Supervision{
+		Open: func() (Port, error) {
+			host, far := net.Pipe()
+			mu.Lock()
+			second = &fakeBus{conn: far, got: make(chan protocol.Message, 16), pongs: []protocol.Message{protocol.Pong(0x01, 1, 8)}}
+			mu.Unlock()
+			go second.serve()
+			return host, nil
+		},
+		Address: 0x01,
+		Backoff: time.Millisecond,
+		Notify: func(err error) {
+			mu.Lock()
+			events = append(events, fmt.Sprint(err == nil))
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	song := []Event{
+		{At: 0, Kind: NoteOn, Channel: 0, Note: 60, Value: 100},
+		{At: 100 * time.Millisecond, Kind: NoteOn, Channel: 1, Note: 64, Value: 100},
+		{At: 300 * time.Millisecond, Kind: NoteOff, Channel: 0, Note: 60},
+		{At: 400 * time.Millisecond, Kind: NoteOn, Channel: 0, Note: 67, Value: 100},
+		{At: 500 * time.Millisecond, Kind: NoteOff, Channel: 1, Note: 64},
+		{At: 600 * time.Millisecond, Kind: NoteOff, Channel: 0, Note: 67},
+	}
+	p := NewPlayer(dev, mapping.Channels(0x01, 1, 8))
+	p.clock = clock
+	if err := p.Play(context.Background(), song); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []sentMessage{
+		{300 * time.Millisecond, protocol.NoteOff(0x01, 1, 60)}, // lost
+		{300*time.Millisecond + late, protocol.SequenceStart()},
+		{300*time.Millisecond + late, protocol.NoteOnVelocity(0x01, 1, 60, 100)},
+		{300*time.Millisecond + late, protocol.NoteOnVelocity(0x01, 2, 64, 100)},
+		{300*time.Millisecond + late, protocol.NoteOff(0x01, 1, 60)},
+		{400*time.Millisecond + late, protocol.NoteOnVelocity(0x01, 1, 67, 100)},
+		{500*time.Millisecond + late, protocol.NoteOff(0x01, 2, 64)},
+		{600*time.Millisecond + late, protocol.NoteOff(0x01, 1, 67)},
+		{600*time.Millisecond + late, protocol.SequenceStop()},
+	}
+	got := dev.sent[3:]
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("after the first two notes, sent:\n%v\nwant:\n%v", got, want)
+	}
+
+	// The second bus heard the ping checking it, then all of it but the
+	// message lost.
+	mu.Lock()
+	b := second
+	mu.Unlock()
+	if m := <-b.got; m.Command != config.CmdPing {
+		t.Errorf("reopened port first heard %02X, want a ping", m.Command)
+	}
+	for i, w := range want[1:] {
+		select {
+		case m := <-b.got:
+			if m.Device != w.m.Device || m.Sub != w.m.Sub || m.Command != w.m.Command || string(m.Payload) != string(w.m.Payload) {
+				t.Errorf("reopened port message %d: %02X/%02X %02X % X, want %s", i, m.Device, m.Sub, m.Command, m.Payload, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("reopened port got %d messages, want %d", i, len(want)-1)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(events) != "[false true]" {
+		t.Errorf("notified up %v, want down then up", events)
+	}
+}
+
+// TestSilenceWatchdog has a device stop answering: the Device pings it
+// after half the silence allowed, drops the link after all of it, and
+// keeps trying ports until one answers as the right device.
+func TestSilenceWatchdog(t *testing.T) {
+	host, far := net.Pipe()
+	mute := &fakeBus{conn: far, got: make(chan protocol.Message, 16)}
+	go mute.serve()
+	d := New(host)
+	defer d.Close()
+
+	var opens int
+	err := d.Supervise(Supervision{
+		Open: func() (Port, error) {
+			opens++
+			pong := protocol.Pong(0x02, 1, 8) // the wrong device, at first
+			if opens == 3 {
+				pong = protocol.Pong(0x01, 1, 8)
+			}
+			host, far := net.Pipe()
+			go (&fakeBus{conn: far, got: make(chan protocol.Message, 16), pongs: []protocol.Message{pong}}).serve()
+			return host, nil
+		},
+		Address: 0x01,
+		Silence: 40 * time.Millisecond,
+		Backoff: time.Millisecond,
+		Timeout: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-mute.got:
+		if m.Command != config.CmdPing {
+			t.Errorf("quiet device sent %02X, want a ping", m.Command)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no ping to the quiet device")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for d.Err() == nil {
+		if ctx.Err() != nil {
+			t.Fatal("the quiet link was never dropped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	var lost *DisconnectedError
+	if err := d.Send(protocol.Ping()); !errors.As(err, &lost) || !errors.Is(err, errSilent) {
+		t.Errorf("Send on the dropped link: %v, want a *DisconnectedError for the silence", err)
+	}
+	if err := d.WaitConnected(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if opens != 3 {
+		t.Errorf("opened %d ports, want 3: two with the wrong device", opens)
+	}
+	if err := d.Send(protocol.Ping()); err != nil {
+		t.Errorf("Send once reconnected: %v", err)
+	}
+}
+
+// TestSuperviseNeedsOpen checks a Device on a port OpenSerial didn't open
+// can't be supervised without an Open, and that without Supervise a lost
+// link stays lost.
+func TestSuperviseNeedsOpen(t *testing.T) {
+	d, b := newFakeBus(t)
+	if err := d.Supervise(Supervision{}); err == nil {
+		t.Error("supervised with nothing to reopen")
+	}
+	b.conn.Close()
+	if _, err := d.Receive(context.Background()); err == nil {
+		t.Fatal("received from a closed bus")
+	}
+	var lost *DisconnectedError
+	if err := d.WaitConnected(context.Background()); !errors.As(err, &lost) {
+		t.Errorf("WaitConnected: got %v, want the *DisconnectedError", err)
+	}
+}
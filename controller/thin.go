@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+)
+
+// Thinning is what Thin took out of a song.
+type Thinning struct {
+	Notes   int // note-ons on the channels m plays notes on
+	Soft    int // of those, dropped for being softer than min-velocity
+	Short   int // dropped for being shorter than min-length
+	Crowded int // dropped or cut short for being over max-notes
+}
+
+func (t Thinning) String() string {
+	return fmt.Sprintf("%d notes, %d softer than min-velocity, %d shorter than min-length, %d over max-notes",
+		t.Notes, t.Soft, t.Short, t.Crowded)
+}
+
+// Thin returns events with the notes thinned as each channel's
+// mapping.Channel says, and what it took out. Notes on the percussion
+// channel and on channels m doesn't play are left alone, as is events.
+//
+// A note struck softer than the channel's MinVelocity is dropped, as is a
+// note released less than its MinLength after it is struck; a note never
+// released is kept. Then, if the channel has a MaxNotes, each time notes
+// are struck on it they and the notes still held there are ranked,
+// loudest first and, at the same velocity, highest first, and those past
+// MaxNotes go: a note just struck is dropped, and a note held is released
+// there and then. Notes released at the same time as others are struck
+// make room for them.
+func Thin(events []Event, m *mapping.Map) ([]Event, Thinning) {
+	var t Thinning
+	plays := func(ev Event) bool {
+		return (ev.Kind == NoteOn || ev.Kind == NoteOff) && m.Channels[ev.Channel].Mapped() && !m.Drums(ev.Channel)
+	}
+	off := pairNotes(events)
+	drop := make([]bool, len(events))
+	dropNote := func(on int) {
+		drop[on] = true
+		if off[on] >= 0 {
+			drop[off[on]] = true
+		}
+	}
+	for i, ev := range events {
+		if ev.Kind != NoteOn || !plays(ev) {
+			continue
+		}
+		c := m.Channels[ev.Channel]
+		t.Notes++
+		switch {
+		case ev.Value < c.MinVelocity:
+			t.Soft++
+			dropNote(i)
+		case c.MinLength > 0 && off[i] >= 0 && events[off[i]].At-ev.At < c.MinLength:
+			t.Short++
+			dropNote(i)
+		}
+	}
+
+	// cuts are the note-offs ending held notes early, by the index of the
+	// event they go before.
+	cuts := make(map[int][]Event)
+	var held [16][]int // note-ons still sounding, by channel
+	for start := 0; start < len(events); {
+		end := start
+		for end < len(events) && events[end].At == events[start].At {
+			end++
+		}
+		for i := start; i < end; i++ {
+			if ev := events[i]; ev.Kind == NoteOff && !drop[i] {
+				held[ev.Channel] = slices.DeleteFunc(held[ev.Channel], func(on int) bool { return off[on] == i })
+			}
+		}
+		for ch := range held {
+			limit := m.Channels[ch].MaxNotes
+			var struck []int
+			for i := start; i < end; i++ {
+				if ev := events[i]; ev.Kind == NoteOn && int(ev.Channel) == ch && !drop[i] && plays(ev) {
+					struck = append(struck, i)
+				}
+			}
+			if len(struck) == 0 {
+				continue
+			}
+			notes := append(held[ch], struck...)
+			if limit > 0 && len(notes) > limit {
+				slices.SortStableFunc(notes, func(a, b int) int {
+					return cmp.Or(cmp.Compare(events[b].Value, events[a].Value), cmp.Compare(events[b].Note, events[a].Note))
+				})
+				for _, on := range notes[limit:] {
+					t.Crowded++
+					if on >= start {
+						dropNote(on)
+						continue
+					}
+					if off[on] >= 0 {
+						drop[off[on]] = true
+					}
+					ev := events[on]
+					cuts[start] = append(cuts[start], Event{At: events[start].At, Kind: NoteOff, Channel: ev.Channel, Note: ev.Note})
+				}
+				notes = notes[:limit]
+				slices.Sort(notes)
+			}
+			held[ch] = notes
+		}
+		start = end
+	}
+
+	out := make([]Event, 0, len(events))
+	for i, ev := range events {
+		out = append(out, cuts[i]...)
+		if !drop[i] {
+			out = append(out, ev)
+		}
+	}
+	return out, t
+}
+
+// pairNotes returns, for each note-on in events, the index of the
+// note-off releasing it, or -1: each note-off releases the earliest
+// strike of its note still held, as ActiveAt has it. Other events get -1.
+func pairNotes(events []Event) []int {
+	off := make([]int, len(events))
+	held := make(map[heldNote][]int)
+	for i, ev := range events {
+		off[i] = -1
+		k := heldNote{ev.Channel, ev.Note}
+		switch ev.Kind {
+		case NoteOn:
+			held[k] = append(held[k], i)
+		case NoteOff:
+			if ons := held[k]; len(ons) > 0 {
+				off[ons[0]] = i
+				held[k] = ons[1:]
+			}
+		}
+	}
+	return off
+}
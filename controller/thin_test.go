@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+)
+
+// TestThin thins testdata/thin/chords.mid, on channel 1 at 120 BPM:
+//
+//	   0ms  48 60 64 67, all at velocity 100, to 500ms
+//	 500ms  50 v90, 62 v100, 65 v100, 69 v70, to 1000ms
+//	1000ms  83, a 25ms grace note
+//	1025ms  36 v127 to 2000ms; 52 64 67 72, all v80, to 1500ms
+//	1500ms  55 v100, 59 v100 and 40 v10, to 2000ms
+func TestThin(t *testing.T) {
+	song, err := ReadSMF("testdata/thin/chords.mid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		channel mapping.Channel
+		notes   []byte
+		want    Thinning
+	}{
+		{
+			name:    "none",
+			channel: mapping.Channel{},
+			notes:   []byte{48, 60, 64, 67, 50, 62, 65, 69, 83, 36, 52, 64, 67, 72, 55, 59, 40},
+			want:    Thinning{Notes: 17},
+		},
+		{
+			// Of chords at one velocity the highest two are kept; 36 outranks
+			// 55, and 72 is released as 55 and 59 are struck.
+			name:    "all",
+			channel: mapping.Channel{MinVelocity: 20, MinLength: 50 * time.Millisecond, MaxNotes: 2},
+			notes:   []byte{64, 67, 62, 65, 36, 72, 59},
+			want:    Thinning{Notes: 17, Soft: 1, Short: 1, Crowded: 8},
+		},
+		{
+			// The grace note is struck as the chord before is released.
+			name:    "one",
+			channel: mapping.Channel{MaxNotes: 1},
+			notes:   []byte{67, 65, 83, 36},
+			want:    Thinning{Notes: 17, Crowded: 13},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := mapping.Channels(0x01, 1, 1)
+			tt.channel.Target = m.Channels[0].Target
+			m.Channels[0] = tt.channel
+			before := slices.Clone(song)
+			got, th := Thin(song, m)
+			if th != tt.want {
+				t.Errorf("got %+v, want %+v", th, tt.want)
+			}
+			if n := notesOf(got, 0); !slices.Equal(n, tt.notes) {
+				t.Errorf("kept %v, want %v", n, tt.notes)
+			}
+			held := map[byte]int{}
+			for _, ev := range got {
+				switch ev.Kind {
+				case NoteOn:
+					held[ev.Note]++
+				case NoteOff:
+					held[ev.Note]--
+				}
+			}
+			for n, h := range held {
+				if h != 0 {
+					t.Errorf("note %d struck %d more times than released", n, h)
+				}
+			}
+			if !slices.Equal(song, before) {
+				t.Error("Thin changed the events it was given")
+			}
+
+			// The same chords written in another order thin the same.
+			reversed := slices.Clone(song)
+			for i := 0; i < len(reversed); {
+				j := i
+				for j < len(reversed) && reversed[j].At == reversed[i].At && reversed[j].Kind == reversed[i].Kind {
+					j++
+				}
+				slices.Reverse(reversed[i:j])
+				i = j
+			}
+			again, _ := Thin(reversed, m)
+			if a, b := slices.Sorted(slices.Values(notesOf(again, 0))), slices.Sorted(slices.Values(notesOf(got, 0))); !slices.Equal(a, b) {
+				t.Errorf("reversed chords kept %v, want %v", notesOf(again, 0), notesOf(got, 0))
+			}
+		})
+	}
+}
+
+// TestThinCut strikes a loud note over a soft one held: the soft one is
+// released then, not when the song released it.
+func TestThinCut(t *testing.T) {
+	m := mapping.Channels(0x01, 1, 1)
+	m.Channels[0].MaxNotes = 1
+	events := []Event{
+		{At: 0, Kind: NoteOn, Note: 60, Value: 50},
+		{At: 100 * time.Millisecond, Kind: NoteOn, Note: 64, Value: 100},
+		{At: 200 * time.Millisecond, Kind: NoteOff, Note: 64},
+		{At: time.Second, Kind: NoteOff, Note: 60},
+	}
+	got, th := Thin(events, m)
+	want := []Event{
+		events[0],
+		{At: 100 * time.Millisecond, Kind: NoteOff, Note: 60},
+		events[1],
+		events[2],
+	}
+	if !slices.Equal(got, want) || th.Crowded != 1 {
+		t.Errorf("got %v, %+v; want %v", got, th, want)
+	}
+}
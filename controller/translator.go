@@ -0,0 +1,582 @@
+package controller
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// Why a translator drops a note.
+const (
+	dropUnmapped = "channel not mapped"
+	dropIgnored  = "channel ignored"
+	dropSoft     = "softer than the channel's min-velocity"
+	dropRange    = "transposed out of MIDI's range"
+	dropArranged = "transposed out of the channel's range"
+	dropPoolFull = "every drive of the pool busy"
+	dropStripe   = "every drive of the stripe busy"
+	dropDevices  = "no device of the stripe plays the note"
+	dropNoHit    = "no percussion hit for the note"
+	dropMuted    = "channel muted"
+	dropDevice   = "device muted"
+)
+
+// translator turns events into messages through a mapping, for the Player
+// and the Bridge alike. It counts the strikes of each note sounding, so a
+// note struck again before it is released sounds on until the last of its
+// note-offs. A pool or stripe channel's bends go to the drives holding
+// its notes, and a drive taking a note is sent its channel's bend first.
+// A program change sends the channel's drives its preset, held to a rate
+// as bends are. Each device is sent only what its registry entry says it
+// takes.
+type translator struct {
+	mapping  *mapping.Map
+	registry *DeviceRegistry // nil for every device taking everything
+	bends    BendOptions
+	limit    bendLimiter
+	presets  bendLimiter // program changes, to DefaultPresetRate unless set
+	held     map[heldNote]*strike
+	sounding map[soundingNote]int
+
+	bend      [16]int16                // each channel's bend, as last sent
+	driveBend map[mapping.Target]int16 // each pool drive's bend, as last sent
+	muted     [16]bool
+	devMuted  [256]bool // by address
+	turn      [16]int   // the pool of each channel's stripe to take the next note, round-robin
+
+	shift   int              // semitones the Player's Transpose moves notes by
+	arrange mapping.Strategy // for the notes shift moves out of range
+}
+
+// heldNote is a note held down on a MIDI channel.
+type heldNote struct {
+	channel, note byte
+}
+
+// strike is where a held note went: the drive, and the note sent to it.
+type strike struct {
+	to    mapping.Target
+	note  byte
+	reset bool // a percussion hit re-homing the drive, held by nothing
+	count int
+}
+
+// soundingNote is a note sounding on a drive.
+type soundingNote struct {
+	mapping.Target
+	note byte
+}
+
+func newTranslator(m *mapping.Map, b BendOptions) *translator {
+	return &translator{
+		mapping:   m,
+		bends:     b,
+		limit:     newBendLimiter(b.Rate),
+		presets:   newBendLimiter(DefaultPresetRate),
+		held:      make(map[heldNote]*strike),
+		sounding:  make(map[soundingNote]int),
+		driveBend: make(map[mapping.Target]int16),
+	}
+}
+
+// messages returns the messages for ev, if it needs any, as the devices
+// take them.
+func (tr *translator) messages(ev Event) []protocol.Message {
+	return tr.registry.adapt(tr.translate(ev))
+}
+
+// translate returns the messages for ev, whatever the devices take.
+func (tr *translator) translate(ev Event) []protocol.Message {
+	switch ev.Kind {
+	case NoteOn:
+		var msgs []protocol.Message
+		if p, ok := tr.presets.take(ev.Channel, ev.At, true); ok {
+			msgs = tr.preset(p)
+		}
+		if p, ok := tr.limit.take(ev.Channel, ev.At, true); ok {
+			msgs = append(msgs, tr.bendTo(p)...)
+		}
+		s, dropped := tr.strike(ev)
+		switch {
+		case dropped != "":
+			return msgs
+		case s.reset:
+			return append(msgs, protocol.DriveReset(s.to.Device, s.to.Sub))
+		}
+		if c := tr.mapping.Channels[ev.Channel]; c.Shared() && !tr.mapping.Drums(ev.Channel) {
+			if tr.driveBend[s.to] != tr.bend[ev.Channel] {
+				tr.driveBend[s.to] = tr.bend[ev.Channel]
+				msgs = append(msgs, protocol.PitchBend(s.to.Device, s.to.Sub, tr.bend[ev.Channel]))
+			}
+		}
+		return append(msgs, protocol.NoteOnVelocity(s.to.Device, s.to.Sub, s.note, ev.Value))
+	case NoteOff:
+		return tr.lift(ev)
+	case Click:
+		return tr.click(ev)
+	case ClickOff:
+		return tr.lift(Event{Channel: clickKey.channel, Note: clickKey.note})
+	case PitchBend:
+		if !tr.limit.allow(ev) {
+			return nil
+		}
+		return tr.bendTo(ev)
+	case Program:
+		if !tr.presets.allow(ev) {
+			return nil
+		}
+		return tr.preset(ev)
+	}
+	c := tr.mapping.Channels[ev.Channel]
+	if !c.Mapped() || tr.mapping.Drums(ev.Channel) {
+		return nil
+	}
+	var msgs []protocol.Message
+	for _, t := range c.Targets() {
+		switch ev.Kind {
+		case Sustain:
+			msgs = append(msgs, protocol.Sustain(t.Device, t.Sub, ev.Value >= 64))
+		case Pressure:
+			msgs = append(msgs, protocol.ChannelPressure(t.Device, t.Sub, ev.Value))
+		case BendRange:
+			if tr.bends.BendRange == nil || tr.bends.BendRange(t.Device) {
+				msgs = append(msgs, protocol.BendRange(t.Device, t.Sub, max(1, min(ev.Value, 24))))
+			}
+		}
+	}
+	return msgs
+}
+
+// bendTo returns the messages bending ev's channel: to its drive, or to
+// the drives of its pool or stripe holding its notes.
+func (tr *translator) bendTo(ev Event) []protocol.Message {
+	c := tr.mapping.Channels[ev.Channel]
+	if !c.Mapped() || tr.mapping.Drums(ev.Channel) {
+		return nil
+	}
+	b := int16(ev.Bend) - 8192
+	tr.bend[ev.Channel] = b
+	targets := c.Targets()
+	if c.Shared() {
+		targets = tr.holding(ev.Channel)
+	}
+	msgs := make([]protocol.Message, 0, len(targets))
+	for _, t := range targets {
+		if c.Shared() {
+			tr.driveBend[t] = b
+		}
+		msgs = append(msgs, protocol.PitchBend(t.Device, t.Sub, b))
+	}
+	return msgs
+}
+
+// holding returns the drives holding notes of channel, in order.
+func (tr *translator) holding(channel byte) []mapping.Target {
+	var ts []mapping.Target
+	for k, h := range tr.held {
+		if k.channel == channel && !slices.Contains(ts, h.to) {
+			ts = append(ts, h.to)
+		}
+	}
+	slices.SortFunc(ts, func(a, b mapping.Target) int {
+		return cmp.Or(cmp.Compare(a.Device, b.Device), cmp.Compare(a.Sub, b.Sub))
+	})
+	return ts
+}
+
+// preset returns the messages sending the drives of the program change
+// ev's channel the preset its mapping has for the program, if any: each
+// drive's settings in turn.
+func (tr *translator) preset(ev Event) []protocol.Message {
+	c := tr.mapping.Channels[ev.Channel]
+	p, ok := tr.mapping.Preset(ev.Channel, ev.Value)
+	if !ok || !c.Mapped() || tr.mapping.Drums(ev.Channel) {
+		return nil
+	}
+	targets := c.Targets()
+	cents, detune := p.Detunes(len(targets))
+	var msgs []protocol.Message
+	for i, t := range targets {
+		if p.Transpose != nil {
+			msgs = append(msgs, protocol.Transpose(t.Device, t.Sub, int8(*p.Transpose)))
+		}
+		if detune {
+			msgs = append(msgs, protocol.Detune(t.Device, t.Sub, int8(cents[i])))
+		}
+		if p.Clamp != nil {
+			msgs = append(msgs, protocol.SetMovement(t.Device, t.Sub, *p.Clamp))
+		}
+		if p.Tremolo != nil {
+			msgs = append(msgs, protocol.Tremolo(t.Device, t.Sub, byte(p.Tremolo.Rate), byte(p.Tremolo.Duty)))
+		}
+		if p.BendRange != nil && (tr.bends.BendRange == nil || tr.bends.BendRange(t.Device)) {
+			msgs = append(msgs, protocol.BendRange(t.Device, t.Sub, byte(*p.BendRange)))
+		}
+	}
+	return msgs
+}
+
+// nextHeld returns when the first bend or preset held back by its rate
+// limit may go.
+func (tr *translator) nextHeld() (time.Duration, bool) {
+	at, ok := tr.limit.next()
+	if p, pok := tr.presets.next(); pok && (!ok || p < at) {
+		at, ok = p, true
+	}
+	return at, ok
+}
+
+// due returns the messages for the presets and bends held back that may
+// go at at, each channel's preset before its bend.
+func (tr *translator) due(at time.Duration) []protocol.Message {
+	var msgs []protocol.Message
+	for ch := range byte(16) {
+		if ev, ok := tr.presets.take(ch, at, false); ok {
+			msgs = append(msgs, tr.preset(ev)...)
+		}
+		if ev, ok := tr.limit.take(ch, at, false); ok {
+			msgs = append(msgs, tr.bendTo(ev)...)
+		}
+	}
+	return tr.registry.adapt(msgs)
+}
+
+// strike routes the note-on ev to a drive and holds it there, or returns
+// why it is dropped.
+func (tr *translator) strike(ev Event) (strike, string) {
+	key := heldNote{ev.Channel, ev.Note}
+	var s strike
+	if tr.muted[ev.Channel] {
+		return s, dropMuted
+	}
+	if tr.mapping.Drums(ev.Channel) {
+		h, ok := tr.mapping.Percussion.Hit(ev.Note)
+		if !ok {
+			return s, dropNoHit
+		}
+		s = strike{to: h.Target, note: h.Note, reset: h.Reset}
+		if tr.devMuted[s.to.Device] {
+			return s, dropDevice
+		}
+		if s.reset {
+			return s, ""
+		}
+	} else {
+		c := tr.mapping.Channels[ev.Channel]
+		switch {
+		case c.Ignore:
+			return s, dropIgnored
+		case !c.Mapped():
+			return s, dropUnmapped
+		case ev.Value < c.MinVelocity:
+			return s, dropSoft
+		}
+		note := ev.Note
+		if tr.shift != 0 {
+			n := int(note) + tr.shift
+			if n < 0 || n > 127 {
+				return s, dropRange
+			}
+			arranged, _, ok := arrangeNote(Event{Note: byte(n)}, c, tr.arrange, 0)
+			if !ok {
+				return s, dropArranged
+			}
+			note = arranged
+		}
+		n := int(note) + c.Transpose
+		if n < 0 || n > 127 {
+			return s, dropRange
+		}
+		s.note = byte(n)
+		to, dropped := tr.place(key, ev.Channel, c, s.note)
+		if dropped != "" {
+			return s, dropped
+		}
+		if tr.devMuted[to.Device] {
+			return s, dropDevice
+		}
+		s.to = to
+	}
+	tr.hold(key, s)
+	return s, ""
+}
+
+// place returns the drive to take note, struck under key on channel, c:
+// the one key holds already, else a free one of c's stripe or pool, else
+// c's target; or why there is none.
+func (tr *translator) place(key heldNote, channel byte, c mapping.Channel, note byte) (mapping.Target, string) {
+	if held, ok := tr.held[key]; ok {
+		return held.to, "" // struck again: on the drive it holds
+	}
+	switch {
+	case len(c.Stripe) > 0:
+		return tr.stripe(channel, c, note)
+	case c.Pool != (mapping.Pool{}):
+		free, ok := tr.free(c.Targets())
+		if !ok {
+			return mapping.Target{}, dropPoolFull
+		}
+		return free, ""
+	}
+	return c.Target, ""
+}
+
+// hold holds the strike s under key, one more strike of the note on its
+// drive.
+func (tr *translator) hold(key heldNote, s strike) {
+	held := tr.held[key]
+	if held == nil {
+		held = &strike{to: s.to, note: s.note}
+		tr.held[key] = held
+	} else if held.note != s.note {
+		// Struck again since a transpose: the drive takes the new pitch,
+		// and the strikes still held go with it.
+		old := soundingNote{held.to, held.note}
+		if tr.sounding[old] -= held.count; tr.sounding[old] <= 0 {
+			delete(tr.sounding, old)
+		}
+		tr.sounding[soundingNote{s.to, s.note}] += held.count
+		held.note = s.note
+	}
+	held.count++
+	tr.sounding[soundingNote{s.to, s.note}]++
+}
+
+// clickKey is what a metronome click is held under: no MIDI channel's.
+var clickKey = heldNote{channel: 0xFF}
+
+// The velocities clicks are struck at.
+const (
+	clickVelocity  = 96
+	accentVelocity = 127 // the first beat of a bar's
+)
+
+// click returns the messages for the metronome click ev: a strike where
+// the mapping's metronome sends it, as a percussion hit, or as a note of
+// its channel, but for the channel's mute and the Player's transpose. A
+// click struck before the last is released is dropped, as is one for a
+// muted device.
+func (tr *translator) click(ev Event) []protocol.Message {
+	if _, ok := tr.held[clickKey]; ok || !tr.mapping.Metronome.On() {
+		return nil
+	}
+	c := tr.mapping.Metronome.For(ev.Value != 0)
+	h, channel := c.Hit, c.Channel
+	if channel != 0 && tr.mapping.Drums(channel-1) {
+		var ok bool
+		if h, ok = tr.mapping.Percussion.Hit(c.Note); !ok {
+			return nil
+		}
+		channel = 0
+	}
+	if tr.devMuted[h.Target.Device] && channel == 0 {
+		return nil
+	}
+	if h.Reset {
+		return []protocol.Message{protocol.DriveReset(h.Target.Device, h.Target.Sub)}
+	}
+	s := strike{to: h.Target, note: h.Note}
+	var msgs []protocol.Message
+	if channel != 0 {
+		mc := tr.mapping.Channels[channel-1]
+		n := int(c.Note) + mc.Transpose
+		if n < 0 || n > 127 {
+			return nil
+		}
+		to, dropped := tr.place(clickKey, channel-1, mc, byte(n))
+		if dropped != "" || tr.devMuted[to.Device] {
+			return nil
+		}
+		s = strike{to: to, note: byte(n)}
+		if mc.Shared() && tr.driveBend[to] != 0 {
+			// A drive its channel's notes bent: the click goes unbent.
+			tr.driveBend[to] = 0
+			msgs = append(msgs, protocol.PitchBend(to.Device, to.Sub, 0))
+		}
+	}
+	tr.hold(clickKey, s)
+	velocity := byte(clickVelocity)
+	if ev.Value != 0 {
+		velocity = accentVelocity
+	}
+	return append(msgs, protocol.NoteOnVelocity(s.to.Device, s.to.Sub, s.note, velocity))
+}
+
+// free returns the first of a pool's drives no held note is on.
+func (tr *translator) free(pool []mapping.Target) (mapping.Target, bool) {
+	for _, t := range pool {
+		busy := false
+		for _, h := range tr.held {
+			busy = busy || h.to == t
+		}
+		if !busy {
+			return t, true
+		}
+	}
+	return mapping.Target{}, false
+}
+
+// stripe returns the drive of channel c's stripe to take note: a free
+// one of the pool c's Balance picks, of those on a device whose range
+// has note, or why there is none. Round-robin, the pool after the last
+// one picked, or the next with a drive free; least-busy, the one with
+// fewest drives held, the first of those tied.
+func (tr *translator) stripe(channel byte, c mapping.Channel, note byte) (mapping.Target, string) {
+	picked, fewest, plays := -1, 0, false
+	for k := range c.Stripe {
+		i := k
+		if c.Balance == mapping.BalanceRoundRobin {
+			i = (tr.turn[channel] + k) % len(c.Stripe)
+		}
+		p := c.Stripe[i]
+		if !tr.mapping.DeviceRange(p.Device).Contains(int(note)) {
+			continue
+		}
+		plays = true
+		drives := p.Targets()
+		busy := 0
+		for _, h := range tr.held {
+			if slices.Contains(drives, h.to) {
+				busy++
+			}
+		}
+		if busy == len(drives) || picked >= 0 && busy >= fewest {
+			continue
+		}
+		picked, fewest = i, busy
+		if c.Balance == mapping.BalanceRoundRobin {
+			break
+		}
+	}
+	switch {
+	case !plays:
+		return mapping.Target{}, dropDevices
+	case picked < 0:
+		return mapping.Target{}, dropStripe
+	}
+	tr.turn[channel] = (picked + 1) % len(c.Stripe)
+	to, _ := tr.free(c.Stripe[picked].Targets())
+	return to, ""
+}
+
+// lift releases the note-off ev, returning the note-off to send if the
+// drive's note is no longer held by anything.
+func (tr *translator) lift(ev Event) []protocol.Message {
+	key := heldNote{ev.Channel, ev.Note}
+	h, ok := tr.held[key]
+	if !ok {
+		return nil
+	}
+	if h.count--; h.count == 0 {
+		delete(tr.held, key)
+	}
+	n := soundingNote{h.to, h.note}
+	switch tr.sounding[n] {
+	case 0:
+		return nil
+	case 1:
+		delete(tr.sounding, n)
+		return []protocol.Message{protocol.NoteOff(n.Device, n.Sub, n.note)}
+	default:
+		// Struck again since: the later strike sounds on.
+		tr.sounding[n]--
+		return nil
+	}
+}
+
+// mute mutes channel, or unmutes it. Muted, its notes are dropped, and
+// it returns the note-offs for those it holds, in drive and note order;
+// their note-offs to come are then ignored.
+func (tr *translator) mute(channel byte, on bool) []protocol.Message {
+	tr.muted[channel] = on
+	if !on {
+		return nil
+	}
+	return tr.unhold(func(k heldNote, _ *strike) bool { return k.channel == channel })
+}
+
+// muteDevice mutes the device at address, or unmutes it, as mute does a
+// channel: muted, the notes bound for its drives are dropped, and it
+// returns the note-offs for those they hold.
+func (tr *translator) muteDevice(address byte, on bool) []protocol.Message {
+	tr.devMuted[address] = on
+	if !on {
+		return nil
+	}
+	return tr.unhold(func(_ heldNote, h *strike) bool { return h.to.Device == address })
+}
+
+// unhold forgets the notes held that match, and returns the note-offs
+// for those no other holds, in drive and note order.
+func (tr *translator) unhold(match func(k heldNote, h *strike) bool) []protocol.Message {
+	var lifted []soundingNote
+	for k, h := range tr.held {
+		if !match(k, h) {
+			continue
+		}
+		delete(tr.held, k)
+		n := soundingNote{h.to, h.note}
+		if tr.sounding[n] -= h.count; tr.sounding[n] <= 0 {
+			delete(tr.sounding, n)
+			lifted = append(lifted, n)
+		}
+	}
+	slices.SortFunc(lifted, func(a, b soundingNote) int {
+		return cmp.Or(cmp.Compare(a.Device, b.Device), cmp.Compare(a.Sub, b.Sub), cmp.Compare(a.note, b.note))
+	})
+	msgs := make([]protocol.Message, len(lifted))
+	for i, n := range lifted {
+		msgs[i] = protocol.NoteOff(n.Device, n.Sub, n.note)
+	}
+	return msgs
+}
+
+// release forgets the notes sounding and returns a note-off for each, in
+// device, drive and note order.
+func (tr *translator) release() []protocol.Message {
+	notes := slices.SortedFunc(maps.Keys(tr.sounding), func(a, b soundingNote) int {
+		return cmp.Or(cmp.Compare(a.Device, b.Device), cmp.Compare(a.Sub, b.Sub), cmp.Compare(a.note, b.note))
+	})
+	clear(tr.sounding)
+	clear(tr.held)
+	msgs := make([]protocol.Message, len(notes))
+	for i, n := range notes {
+		msgs[i] = protocol.NoteOff(n.Device, n.Sub, n.note)
+	}
+	return msgs
+}
+
+// devices returns the devices the mapping sends to, in order.
+func (tr *translator) devices() []byte {
+	return tr.mapping.Devices()
+}
+
+// NoteCheck is what a mapping does with one note of a song.
+type NoteCheck struct {
+	Event
+	To      mapping.Target
+	Sent    byte   // the note sent, after the channel's transpose
+	Reset   bool   // a percussion hit re-homing the drive, not a note
+	Dropped string // why the note isn't sent, or "" if it is
+}
+
+// CheckMapping plays events through m without sending anything, and
+// returns what became of each note-on.
+func CheckMapping(events []Event, m *mapping.Map) []NoteCheck {
+	tr := newTranslator(m, BendOptions{})
+	var checks []NoteCheck
+	for _, ev := range events {
+		switch ev.Kind {
+		case NoteOn:
+			s, dropped := tr.strike(ev)
+			checks = append(checks, NoteCheck{Event: ev, To: s.to, Sent: s.note, Reset: s.reset, Dropped: dropped})
+		case NoteOff:
+			tr.lift(ev)
+		}
+	}
+	return checks
+}
@@ -0,0 +1,209 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ystepanoff/goppy/controller/mapping"
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+const rig = `channels:
+  1:
+    pool: 0x01/1-2
+    transpose: 12
+  2:
+    target: 0x02/1
+    min-velocity: 40
+  3:
+    ignore: true
+percussion:
+  notes:
+    36: 0x02/8 reset
+    38: 0x02/7 note 40
+`
+
+func TestTranslator(t *testing.T) {
+	m, err := mapping.Parse(strings.NewReader(rig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := newTranslator(m, BendOptions{})
+	var got []protocol.Message
+	for _, ev := range []Event{
+		{Kind: NoteOn, Channel: 0, Note: 60, Value: 100},
+		{Kind: NoteOn, Channel: 0, Note: 64, Value: 100},
+		{Kind: NoteOn, Channel: 0, Note: 67, Value: 100}, // pool full
+		{Kind: PitchBend, Channel: 0, Bend: 8192 + 100},  // to both drives holding notes
+		{Kind: NoteOff, Channel: 0, Note: 60},
+		{Kind: NoteOff, Channel: 0, Note: 67},
+		{Kind: NoteOn, Channel: 0, Note: 67, Value: 100}, // drive 1 free again
+		{Kind: NoteOn, Channel: 1, Note: 50, Value: 30},  // too soft
+		{Kind: NoteOn, Channel: 1, Note: 50, Value: 50},
+		{Kind: NoteOn, Channel: 2, Note: 50, Value: 50}, // ignored
+		{Kind: NoteOn, Channel: 9, Note: 36, Value: 90},
+		{Kind: NoteOff, Channel: 9, Note: 36},
+		{Kind: NoteOn, Channel: 9, Note: 38, Value: 90},
+		{Kind: NoteOn, Channel: 9, Note: 49, Value: 90}, // no hit
+		{Kind: NoteOff, Channel: 9, Note: 38},
+	} {
+		got = append(got, tr.messages(ev)...)
+	}
+	got = append(got, tr.release()...)
+	checkSent(t, got, []protocol.Message{
+		protocol.NoteOnVelocity(0x01, 1, 72, 100),
+		protocol.NoteOnVelocity(0x01, 2, 76, 100),
+		protocol.PitchBend(0x01, 1, 100),
+		protocol.PitchBend(0x01, 2, 100),
+		protocol.NoteOff(0x01, 1, 72),
+		protocol.NoteOnVelocity(0x01, 1, 79, 100),
+		protocol.NoteOnVelocity(0x02, 1, 50, 50),
+		protocol.DriveReset(0x02, 8),
+		protocol.NoteOnVelocity(0x02, 7, 40, 90),
+		protocol.NoteOff(0x02, 7, 40),
+		protocol.NoteOff(0x01, 1, 79),
+		protocol.NoteOff(0x01, 2, 76),
+		protocol.NoteOff(0x02, 1, 50),
+	})
+}
+
+func TestCheckMapping(t *testing.T) {
+	m, err := mapping.Parse(strings.NewReader(rig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks := CheckMapping([]Event{
+		{Kind: NoteOn, Channel: 0, Note: 120, Value: 100},
+		{Kind: NoteOn, Channel: 1, Note: 50, Value: 10},
+		{Kind: NoteOn, Channel: 3, Note: 50, Value: 100},
+		{Kind: NoteOn, Channel: 9, Note: 38, Value: 100},
+	}, m)
+	want := []NoteCheck{
+		{Dropped: dropRange},
+		{Dropped: dropSoft},
+		{Dropped: dropUnmapped},
+		{To: mapping.Target{Device: 0x02, Sub: 7}, Sent: 40},
+	}
+	if len(checks) != len(want) {
+		t.Fatalf("got %d checks, want %d", len(checks), len(want))
+	}
+	for i, c := range checks {
+		w := want[i]
+		if c.Dropped != w.Dropped || c.To != w.To || c.Sent != w.Sent || c.Reset != w.Reset {
+			t.Errorf("check %d: got %+v, want %+v", i, c, w)
+		}
+	}
+}
+
+const stripeRig = `channels:
+  1:
+    stripe: 0x01/1-2, 0x02/1-2, 0x03/1
+ranges:
+  0x01: 24-71
+  0x02: 24-71
+  0x03: 60-71
+`
+
+// TestStripe plays overlapping notes on a channel striped round-robin over
+// three devices, the third of which plays only 60 to 71 and the others up
+// to 71: each note-off and bend goes where its note went.
+func TestStripe(t *testing.T) {
+	m, err := mapping.Parse(strings.NewReader(stripeRig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := newTranslator(m, BendOptions{})
+	var got []protocol.Message
+	for _, ev := range []Event{
+		{Kind: NoteOn, Note: 48, Value: 100},
+		{Kind: NoteOn, Note: 50, Value: 100},
+		{Kind: NoteOn, Note: 62, Value: 100},
+		{Kind: NoteOn, Note: 52, Value: 100}, // 0x03 doesn't play it: back to 0x01
+		{Kind: NoteOn, Note: 53, Value: 100},
+		{Kind: NoteOn, Note: 55, Value: 100}, // all full
+		{Kind: PitchBend, Bend: 8192 + 100},  // to every drive holding a note
+		{Kind: NoteOff, Note: 50},
+		{Kind: NoteOn, Note: 57, Value: 100}, // on the drive 50 left
+		{Kind: NoteOff, Note: 62},
+		{Kind: NoteOff, Note: 48},
+		{Kind: NoteOff, Note: 57},
+		{Kind: NoteOff, Note: 52},
+		{Kind: NoteOff, Note: 53},
+	} {
+		got = append(got, tr.messages(ev)...)
+	}
+	checkSent(t, got, []protocol.Message{
+		protocol.NoteOnVelocity(0x01, 1, 48, 100),
+		protocol.NoteOnVelocity(0x02, 1, 50, 100),
+		protocol.NoteOnVelocity(0x03, 1, 62, 100),
+		protocol.NoteOnVelocity(0x01, 2, 52, 100),
+		protocol.NoteOnVelocity(0x02, 2, 53, 100),
+		protocol.PitchBend(0x01, 1, 100),
+		protocol.PitchBend(0x01, 2, 100),
+		protocol.PitchBend(0x02, 1, 100),
+		protocol.PitchBend(0x02, 2, 100),
+		protocol.PitchBend(0x03, 1, 100),
+		protocol.NoteOff(0x02, 1, 50),
+		protocol.NoteOnVelocity(0x02, 1, 57, 100),
+		protocol.NoteOff(0x03, 1, 62),
+		protocol.NoteOff(0x01, 1, 48),
+		protocol.NoteOff(0x02, 1, 57),
+		protocol.NoteOff(0x01, 2, 52),
+		protocol.NoteOff(0x02, 2, 53),
+	})
+	if rest := tr.release(); len(rest) != 0 {
+		t.Errorf("notes left sounding: %v", rest)
+	}
+
+	checks := CheckMapping([]Event{{Kind: NoteOn, Note: 100, Value: 100}}, m)
+	if checks[0].Dropped != dropDevices {
+		t.Errorf("note 100 %+v, want it dropped: %s", checks[0], dropDevices)
+	}
+}
+
+// TestStripeBalance plays a long arpeggio, three notes held at once, on a
+// stripe of three devices by each balance: each device gets a third of
+// the notes, and every note it is struck is released.
+func TestStripeBalance(t *testing.T) {
+	for _, b := range []mapping.Balance{mapping.BalanceRoundRobin, mapping.BalanceLeastBusy} {
+		m := &mapping.Map{}
+		m.Channels[0] = mapping.Channel{
+			Stripe:  []mapping.Pool{{Device: 1, First: 1, Last: 8}, {Device: 2, First: 1, Last: 8}, {Device: 3, First: 1, Last: 8}},
+			Balance: b,
+		}
+		var events []Event
+		for i := range 60 {
+			events = append(events, Event{Kind: NoteOn, Note: byte(48 + i%24), Value: 100})
+			if i >= 2 {
+				events = append(events, Event{Kind: NoteOff, Note: byte(48 + (i-2)%24)})
+			}
+		}
+		events = append(events, Event{Kind: NoteOff, Note: 48 + 58%24}, Event{Kind: NoteOff, Note: 48 + 59%24})
+
+		tr := newTranslator(m, BendOptions{})
+		struck := map[byte]int{}
+		sounding := map[soundingNote]bool{}
+		for _, ev := range events {
+			for _, msg := range tr.messages(ev) {
+				n := soundingNote{mapping.Target{Device: msg.Device, Sub: msg.Sub}, msg.Payload[0]}
+				switch msg.Command {
+				case config.DevCmdNoteOn:
+					struck[msg.Device]++
+					sounding[n] = true
+				case config.DevCmdNoteOff:
+					if !sounding[n] {
+						t.Errorf("%v: released %v, which isn't sounding", b, n)
+					}
+					delete(sounding, n)
+				}
+			}
+		}
+		if struck[1] != 20 || struck[2] != 20 || struck[3] != 20 {
+			t.Errorf("%v: struck %v on devices 1 to 3, want 20 each", b, struck)
+		}
+		if len(sounding) != 0 {
+			t.Errorf("%v: left %v sounding", b, sounding)
+		}
+	}
+}
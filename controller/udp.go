@@ -0,0 +1,182 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Moppy's multicast group and port, which network-attached devices listen
+// on.
+const (
+	DefaultGroup   = "239.2.2.7"
+	DefaultUDPPort = 30994
+)
+
+// UDPOptions configures OpenUDPWith. The zero value sends from the
+// interface the system picks, in datagrams of up to 1472 bytes held open
+// for 1ms.
+type UDPOptions struct {
+	// Interface is the network interface to send from, as "eth0", for a
+	// host on several networks.
+	Interface string
+
+	// MTU is the most frame bytes a datagram carries. Default 1472:
+	// Ethernet's 1500 less the IP and UDP headers.
+	MTU int
+
+	// Window is how long a datagram is held open for more frames after
+	// the first, so a chord's notes go out together. Default 1ms.
+	Window time.Duration
+}
+
+// OpenUDP opens a Device sending to the devices listening on the
+// multicast group and port: see OpenUDPWith.
+func OpenUDP(group string, port int) (*Device, error) {
+	return OpenUDPWith(group, port, UDPOptions{})
+}
+
+// OpenUDPWith opens a Device sending its frames as UDP datagrams to group
+// and port. Each device picks out the frames for its address, as on a
+// serial bus, and answers, with pongs for instance, by unicast to the
+// port the frames came from, which the Device reads as it would a serial
+// port's replies. group may also be a unicast address, to talk to one
+// device.
+//
+// Frames sent within opts.Window of each other share a datagram, up to
+// opts.MTU bytes; a frame is never split across two. A Send returns once
+// its frame is queued, so an error sending a datagram is returned by the
+// Send after.
+func OpenUDPWith(group string, port int, opts UDPOptions) (*Device, error) {
+	ip := net.ParseIP(group)
+	if ip == nil || ip.To4() == nil {
+		return nil, fmt.Errorf("controller: group %q isn't an IPv4 address", group)
+	}
+	if opts.MTU == 0 {
+		opts.MTU = 1472
+	}
+	if opts.Window == 0 {
+		opts.Window = time.Millisecond
+	}
+	local := &net.UDPAddr{}
+	if opts.Interface != "" {
+		addr, err := interfaceAddr(opts.Interface)
+		if err != nil {
+			return nil, err
+		}
+		// On Linux and the BSDs, a socket bound to an interface's address
+		// sends its multicast out of that interface.
+		local.IP = addr
+	}
+	conn, err := net.ListenUDP("udp4", local)
+	if err != nil {
+		return nil, fmt.Errorf("controller: open udp: %w", err)
+	}
+	dst := &net.UDPAddr{IP: ip, Port: port}
+	d := New(&udpPort{conn: conn, dst: dst, mtu: opts.MTU, window: opts.Window})
+	d.name = "udp://" + dst.String()
+	return d, nil
+}
+
+// interfaceAddr returns the IPv4 address of the network interface name.
+func interfaceAddr(name string) (net.IP, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("controller: interface %s: %w", name, err)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("controller: interface %s: %w", name, err)
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil {
+			return n.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("controller: interface %s has no IPv4 address", name)
+}
+
+// udpPort is a Port over UDP: writes are batched into datagrams to dst,
+// and reads return the datagrams that arrive, whoever they are from.
+type udpPort struct {
+	conn   *net.UDPConn
+	dst    *net.UDPAddr
+	mtu    int
+	window time.Duration
+
+	mu      sync.Mutex
+	pending []byte      // frames waiting to be sent
+	timer   *time.Timer // sends pending when the window closes
+	err     error       // the last send's failure, for the next Write
+
+	unread []byte // the rest of the datagram Read last returned part of
+	buf    [65536]byte
+}
+
+// Write queues the frame p, sending what is queued first if p would take
+// the datagram past the MTU.
+func (u *udpPort) Write(p []byte) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.err; err != nil {
+		u.err = nil
+		return 0, err
+	}
+	if len(u.pending)+len(p) > u.mtu {
+		if err := u.flush(); err != nil {
+			return 0, err
+		}
+	}
+	u.pending = append(u.pending, p...)
+	if u.timer == nil {
+		u.timer = time.AfterFunc(u.window, func() {
+			u.mu.Lock()
+			defer u.mu.Unlock()
+			u.timer = nil
+			if err := u.flush(); err != nil {
+				u.err = err
+			}
+		})
+	}
+	return len(p), nil
+}
+
+// flush sends the frames queued as one datagram.
+func (u *udpPort) flush() error {
+	if u.timer != nil {
+		u.timer.Stop()
+		u.timer = nil
+	}
+	if len(u.pending) == 0 {
+		return nil
+	}
+	_, err := u.conn.WriteToUDP(u.pending, u.dst)
+	u.pending = u.pending[:0]
+	return err
+}
+
+func (u *udpPort) Read(p []byte) (int, error) {
+	if len(u.unread) == 0 {
+		n, _, err := u.conn.ReadFromUDP(u.buf[:])
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return 0, ErrClosed
+			}
+			return 0, err
+		}
+		u.unread = u.buf[:n]
+	}
+	n := copy(p, u.unread)
+	u.unread = u.unread[n:]
+	return n, nil
+}
+
+// Close sends what is queued, then closes the socket.
+func (u *udpPort) Close() error {
+	u.mu.Lock()
+	err := u.flush()
+	u.mu.Unlock()
+	return errors.Join(err, u.conn.Close())
+}
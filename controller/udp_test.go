@@ -0,0 +1,184 @@
+package controller
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// udpDevice is a network-attached device on a local UDP socket: it
+// records each datagram it gets, and answers pings from their sender with
+// its pongs, one datagram each.
+type udpDevice struct {
+	conn  *net.UDPConn
+	pongs []protocol.Message
+
+	mu        sync.Mutex
+	datagrams [][]protocol.Message
+	arrived   chan struct{} // a token per datagram
+}
+
+func newUDPDevice(t *testing.T, pongs ...protocol.Message) *udpDevice {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip("no local UDP:", err)
+	}
+	d := &udpDevice{conn: conn, pongs: pongs, arrived: make(chan struct{}, 100)}
+	t.Cleanup(func() { conn.Close() })
+	go d.serve()
+	return d
+}
+
+func (d *udpDevice) port() int { return d.conn.LocalAddr().(*net.UDPAddr).Port }
+
+func (d *udpDevice) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var frames []protocol.Message
+		for rest := buf[:n]; len(rest) > 0; {
+			m, used, err := protocol.Decode(rest)
+			if err != nil {
+				break
+			}
+			rest = rest[used:]
+			frames = append(frames, m)
+			if m.Device == config.SystemAddress && m.Command == config.CmdPing {
+				for _, p := range d.pongs {
+					frame := make([]byte, p.Len())
+					p.Encode(frame)
+					d.conn.WriteToUDP(frame, from)
+				}
+			}
+		}
+		d.mu.Lock()
+		d.datagrams = append(d.datagrams, frames)
+		d.mu.Unlock()
+		d.arrived <- struct{}{}
+	}
+}
+
+// wait waits for n datagrams and returns every one so far.
+func (d *udpDevice) wait(t *testing.T, n int) [][]protocol.Message {
+	t.Helper()
+	for range n {
+		select {
+		case <-d.arrived:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("waited for %d datagrams; got %v", n, d.datagrams)
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.datagrams
+}
+
+func TestUDPDiscover(t *testing.T) {
+	fake := newUDPDevice(t, protocol.Pong(0x01, 1, 4), protocol.Pong(0x02, 1, 8))
+	dev, err := OpenUDP("127.0.0.1", fake.port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	found, err := dev.Discover(200 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DeviceInfo{{Address: 0x01, FirstDrive: 1, LastDrive: 4}, {Address: 0x02, FirstDrive: 1, LastDrive: 8}}
+	if len(found) != 2 || found[0].Address != want[0].Address || found[1].LastDrive != want[1].LastDrive {
+		t.Errorf("found %+v, want %+v", found, want)
+	}
+}
+
+// TestUDPBatching sends a chord, which goes in one datagram, then more
+// notes than fit in one, which are split between datagrams.
+func TestUDPBatching(t *testing.T) {
+	fake := newUDPDevice(t)
+	frame := protocol.NoteOn(0x01, 1, 60).Len()
+	dev, err := OpenUDPWith("127.0.0.1", fake.port(), UDPOptions{MTU: 3 * frame, Window: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	for _, n := range []byte{60, 64, 67} {
+		if err := dev.Send(protocol.NoteOn(0x01, 1, n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := fake.wait(t, 1)
+	if len(got) != 1 || len(got[0]) != 3 || got[0][2].Payload[0] != 67 {
+		t.Fatalf("chord arrived as %v, want one datagram of 3 notes", got)
+	}
+
+	for sub := range byte(7) {
+		if err := dev.Send(protocol.NoteOff(0x01, sub+1, 60)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got = fake.wait(t, 3)[1:]
+	sizes := []int{len(got[0]), len(got[1]), len(got[2])}
+	if !slices.Equal(sizes, []int{3, 3, 1}) {
+		t.Errorf("7 frames arrived in datagrams of %v, want 3, 3 and 1", sizes)
+	}
+	for i, frames := range got {
+		for j, m := range frames {
+			if want := byte(3*i + j + 1); m.Sub != want {
+				t.Errorf("datagram %d frame %d is for drive %d, want %d", i, j, m.Sub, want)
+			}
+		}
+	}
+}
+
+// TestUDPClose sends what is queued before closing.
+func TestUDPClose(t *testing.T) {
+	fake := newUDPDevice(t)
+	dev, err := OpenUDPWith("127.0.0.1", fake.port(), UDPOptions{Window: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Send(protocol.SequenceStop()); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.wait(t, 1); got[0][0].Command != config.CmdSequenceStop {
+		t.Errorf("got %v", got)
+	}
+	if err := dev.Send(protocol.Ping()); !errors.Is(err, ErrClosed) {
+		t.Errorf("send after close: %v", err)
+	}
+}
+
+func TestUDPOptions(t *testing.T) {
+	if _, err := OpenUDP("not-an-ip", DefaultUDPPort); err == nil {
+		t.Error("opened a bad group")
+	}
+	if _, err := OpenUDPWith(DefaultGroup, DefaultUDPPort, UDPOptions{Interface: "nosuch0"}); err == nil {
+		t.Error("opened on a missing interface")
+	}
+	lo, err := net.InterfaceByIndex(1)
+	if err != nil || lo.Flags&net.FlagLoopback == 0 {
+		t.Skip("no loopback interface at index 1")
+	}
+	fake := newUDPDevice(t, protocol.Pong(0x03, 1, 2))
+	dev, err := OpenUDPWith("127.0.0.1", fake.port(), UDPOptions{Interface: lo.Name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	if found, err := dev.Discover(200 * time.Millisecond); err != nil || len(found) != 1 {
+		t.Errorf("found %v, %v through %s", found, err, lo.Name)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/instruments"
+	"github.com/ystepanoff/goppy/firmware/notes"
+	"github.com/ystepanoff/goppy/internal/smf"
+)
+
+var update = flag.Bool("update", false, "rewrite the end-to-end golden timeline from this run")
+
+// noteSpan is a stretch of a drive stepping at a steady rate: a note, or
+// part of one when a bend moves it. Note is the MIDI note the rate plays,
+// 0 for a rate between notes; Start and End are the ticks of the first
+// and last step.
+type noteSpan struct {
+	Drive  byte   `json:"drive"`
+	Note   byte   `json:"note"`
+	Period uint16 `json:"period"`
+	Start  uint32 `json:"start"`
+	End    uint32 `json:"end"`
+}
+
+// spans cuts the rig's step timeline into noteSpans, ordered by start and
+// drive. A span ends where the gap between steps changes.
+func (r *rig) spans() []noteSpan {
+	var spans []noteSpan
+	for d := byte(1); d <= config.NumDrives; d++ {
+		steps := r.steps(d, 0, r.ticks())
+		for i := 0; i+1 < len(steps); {
+			gap := steps[i+1] - steps[i]
+			j := i + 1
+			for j+1 < len(steps) && steps[j+1]-steps[j] == gap {
+				j++
+			}
+			span := noteSpan{Drive: d, Period: uint16(gap), Start: steps[i], End: steps[j]}
+			for n := byte(0); n <= instruments.MaxFloppyNote; n++ {
+				if notes.NoteDoubleTicks[n] == span.Period {
+					span.Note = n
+				}
+			}
+			spans = append(spans, span)
+			i = j + 1
+		}
+	}
+	sort.SliceStable(spans, func(i, j int) bool {
+		if spans[i].Start != spans[j].Start {
+			return spans[i].Start < spans[j].Start
+		}
+		return spans[i].Drive < spans[j].Drive
+	})
+	return spans
+}
+
+// TestEndToEnd plays testdata/fourbars.mid through the MIDI reader, the
+// player and its drive allocator, the link and the firmware's parser into
+// the drives, all on the fake clock, and checks what the drives played
+// against testdata/fourbars.json, to a tick either way. The four bars take
+// the song through a tempo change in each of its last two, an overlapping
+// passage across two channels in the second, a pitch bend up a semitone
+// and back in the third, and a chord in the fourth.
+//
+// After a deliberate change to what the drives play, rewrite the golden
+// file with
+//
+//	go test -run TestEndToEnd -update
+//
+// and check the diff makes sense before committing it.
+func TestEndToEnd(t *testing.T) {
+	if testing.Short() {
+		t.Skip("plays eight seconds of song tick by tick")
+	}
+	song, err := smf.Read("testdata/fourbars.mid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.SliceStable(song, func(i, j int) bool { return song[i].At < song[j].At })
+
+	r := newRig(t)
+	r.play(song)
+	r.runUntil(song[len(song)-1].At + 500*time.Millisecond)
+	if n := r.drives.Stats.InvalidPayloads + r.drives.Stats.UnknownCommands; n != 0 {
+		t.Errorf("the drives rejected %d messages", n)
+	}
+	got := r.spans()
+
+	const golden = "testdata/fourbars.json"
+	if *update {
+		data, err := json.MarshalIndent(got, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(golden, append(data, '\n'), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	data, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []noteSpan
+	if err := json.Unmarshal(data, &want); err != nil {
+		t.Fatalf("%s: %v", golden, err)
+	}
+
+	near := func(a, b uint32) bool { return a+1 >= b && b+1 >= a }
+	for i := range min(len(got), len(want)) {
+		g, w := got[i], want[i]
+		if g.Drive != w.Drive || g.Note != w.Note || g.Period != w.Period || !near(g.Start, w.Start) || !near(g.End, w.End) {
+			t.Fatalf("span %d differs from %s\n got: %s\nwant: %s", i, golden, showSpan(g), showSpan(w))
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("%d spans, %s has %d", len(got), golden, len(want))
+	}
+}
+
+func showSpan(s noteSpan) string {
+	return fmt.Sprintf("drive %d note %d (period %d) ticks %d..%d", s.Drive, s.Note, s.Period, s.Start, s.End)
+}
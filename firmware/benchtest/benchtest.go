@@ -0,0 +1,63 @@
+// Package benchtest turns host benchmark timings into rough cycle counts
+// on the ATmega328P, so a change to a hot path can be sanity-checked
+// against the board's budget before it is flashed.
+//
+// The estimates come from one scaling factor, AVRCyclesPerHostNs, and are
+// good to an order of magnitude at best: treat a path that reports half
+// its budget as one that won't fit.
+//
+// To check a change for regressions, run the benchmarks before and after
+// it and compare the two with benchstat:
+//
+//	go test -run '^$' -bench . -count 10 ./... > old.txt
+//	go test -run '^$' -bench . -count 10 ./... > new.txt
+//	benchstat old.txt new.txt
+//
+// Allocations on the hot paths are checked by ordinary tests, which fail
+// on any allocation at all.
+package benchtest
+
+import (
+	"testing"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+)
+
+// AVRCyclesPerHostNs is how many AVR cycles one nanosecond of host time
+// stands for. A host core at around 3GHz runs about three cycles a
+// nanosecond, and on branchy code like the tick handler about one
+// instruction a cycle; each of those instructions is a 16- or 32-bit
+// operation that takes the 8-bit AVR two or three one-cycle instructions.
+// Three host instructions at two and a half AVR cycles each is about 8.
+const AVRCyclesPerHostNs = 8
+
+// AVRClockMHz is the Uno's clock.
+const AVRClockMHz = 16
+
+// TickBudget is the AVR cycles between two timer interrupts. Tick must
+// finish well inside it, or the main loop starves.
+const TickBudget = config.TimerResolution * AVRClockMHz
+
+// ByteBudget is the AVR cycles between two bytes arriving at
+// config.SerialBaudRate, ten bits to a byte. Parsing must keep up with it.
+const ByteBudget = AVRClockMHz * 1000000 * 10 / config.SerialBaudRate
+
+// Cycles returns the estimated AVR cycles per operation of a finished
+// benchmark.
+func Cycles(b *testing.B) float64 {
+	if b.N == 0 {
+		return 0
+	}
+	return float64(b.Elapsed().Nanoseconds()) / float64(b.N) * AVRCyclesPerHostNs
+}
+
+// ReportAVR adds the estimated AVR cycles per operation to b's output, as
+// avr-cycles/op, and the share of budget they use, as %budget. A budget
+// of 0 reports the cycles alone. Call it after the timed loop.
+func ReportAVR(b *testing.B, budget int) {
+	cycles := Cycles(b)
+	b.ReportMetric(cycles, "avr-cycles/op")
+	if budget > 0 {
+		b.ReportMetric(100*cycles/float64(budget), "%budget")
+	}
+}
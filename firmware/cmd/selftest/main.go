@@ -0,0 +1,96 @@
+//go:build tinygo
+
+// Selftest is firmware for commissioning a tower: flashed in place of the
+// Moppy firmware, it walks every drive through its wiring with the
+// production drive code and reports which drives work.
+//
+// For each drive in turn it runs selftest's Check: it toggles the STEP
+// and DIRECTION lines, re-homes the drive and plays a scale. Where
+// config.SenseFirstPin gives the drives a TRACK 0 or current sense input,
+// a drive whose input never changed never moved and fails; without one, a
+// drive is reported as unchecked and the ear has to judge. The summary
+// goes out over the serial port, and the board's LED then stays lit if
+// nothing failed, or blinks the number of each failed drive in turn, with
+// a pause between drives. (On an Uno with 8 drives the LED's pin 13 is
+// also drive 6's DIRECTION line, which the blinking flips harmlessly.)
+//
+// Flash with: tinygo flash -target=arduino ./cmd/selftest
+// and watch with a serial monitor at config.SerialBaudRate.
+package main
+
+import (
+	"machine"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/instruments"
+	"github.com/ystepanoff/goppy/firmware/selftest"
+)
+
+const (
+	blinkOn  = 200 * time.Millisecond
+	blinkOff = 300 * time.Millisecond
+	blinkGap = 1500 * time.Millisecond
+)
+
+func main() {
+	machine.Serial.Configure(machine.UARTConfig{BaudRate: config.SerialBaudRate})
+	led := machine.LED
+	led.Configure(machine.PinConfig{Mode: machine.PinOutput})
+
+	println("goppy self-test:", config.NumDrives, "drives")
+	floppy := instruments.NewFloppyDrives()
+	floppy.Setup()
+	instruments.InitTimer(config.TimerResolution, floppy.Tick)
+
+	checker := selftest.Checker{
+		Floppy:        floppy,
+		Ticker:        instruments.HardwareTicker,
+		SenseFirstPin: config.SenseFirstPin,
+	}
+	var results [config.NumDrives + 1]selftest.Result
+	for d := byte(1); d <= config.NumDrives; d++ {
+		results[d] = checker.Check(d)
+	}
+
+	report(led, &results)
+}
+
+// report prints the summary and shows it on the LED, forever.
+func report(led machine.Pin, results *[config.NumDrives + 1]selftest.Result) {
+	failed := 0
+	for d := byte(1); d <= config.NumDrives; d++ {
+		switch results[d] {
+		case selftest.Moved:
+			println("drive", d, "PASS")
+		case selftest.Stuck:
+			println("drive", d, "FAIL: never moved")
+			failed++
+		default:
+			println("drive", d, "unchecked: no sense input")
+		}
+	}
+	if failed == 0 {
+		println("self-test passed")
+		led.High()
+		for {
+			time.Sleep(time.Hour)
+		}
+	}
+	println("self-test FAILED:", failed, "drives")
+
+	for {
+		for d := byte(1); d <= config.NumDrives; d++ {
+			if results[d] != selftest.Stuck {
+				continue
+			}
+			for i := byte(0); i < d; i++ {
+				led.High()
+				time.Sleep(blinkOn)
+				led.Low()
+				time.Sleep(blinkOff)
+			}
+			time.Sleep(blinkGap)
+		}
+	}
+}
@@ -27,6 +27,64 @@ const MinSubAddress byte = 1
 // Together with MinSubAddress, this defines which drives this device controls.
 const MaxSubAddress byte = 8
 
+// MaxZones is the number of drive zones a device supports.
+// A zone groups a contiguous range of drives behind one alias sub address.
+const MaxZones = 4
+
+// MaxRoutes is the number of sub address ranges an instruments.Router can
+// hand to different instruments, and separately the number of mirrors it
+// can copy every message to.
+const MaxRoutes = 4
+
+// Route hands sub addresses First..Last to an instrument, which counts
+// them from 1 (see instruments.Router).
+type Route struct {
+	First, Last byte
+	Instrument  byte // InstrumentFloppy, InstrumentHDD, ...
+}
+
+// Routes is the board's route table, at most MaxRoutes long. Empty, as by
+// default, FloppyDrives alone answers every sub address. Otherwise the
+// firmware builds an instruments.Router from it, with one instrument of
+// each kind however many routes it has, each on its own pins from this
+// profile: mind they don't overlap. For floppies on 1-6, an HDD kick on 7
+// and a relay snare on 8, with NumDrives = 6:
+//
+//	var Routes = [...]Route{
+//		{1, 6, InstrumentFloppy},
+//		{7, 7, InstrumentHDD},
+//		{8, 8, InstrumentRelay},
+//	}
+//
+// CmdGetConfig reports the table, a CmdRoute message per route.
+var Routes = [...]Route{}
+
+// Instruments, as Routes names them and CmdRoute reports them.
+const (
+	InstrumentOther       byte = iota // a consumer of none of the kinds below
+	InstrumentFloppy                  // instruments.FloppyDrives
+	InstrumentHDD                     // instruments.HDD
+	InstrumentRelay                   // instruments.Relay
+	InstrumentStepper                 // instruments.Stepper
+	InstrumentScanner                 // instruments.Scanner
+	InstrumentInterrupter             // instruments.Interrupter
+)
+
+// ZoneSubAddress is the alias sub address of zone 1.
+// Zone N answers at ZoneSubAddress + N - 1 (0x10..0x13 with 4 zones).
+const ZoneSubAddress byte = 0x10
+
+// Zone modes decide how a message addressed to a zone reaches its drives.
+const (
+	// ZoneUnison fans every message out to all drives in the zone.
+	ZoneUnison byte = iota
+	// ZonePool plays each note on a free drive in the zone, taking turns.
+	ZonePool
+	// ZonePoolLRU plays each note on the zone's free drive that has been
+	// idle longest, spreading wear when some notes ring much longer.
+	ZonePoolLRU
+)
+
 // =============================================================================
 // HARDWARE CONFIGURATION
 // =============================================================================
@@ -50,6 +108,60 @@ const MaxPosition = 158
 //     - Direction pin: FirstPin + (N-1)*2 + 1 = 3, 5, 7, 9, 11, 13, 15, 17
 const FirstPin = 2
 
+// SharedDirPin, when non-zero, wires every drive's DIRECTION line to this
+// single pin and packs the STEP pins onto consecutive pins from FirstPin
+// (drive N steps on FirstPin + N-1). On an Uno that leaves room for 14+
+// drives instead of 8. 0 keeps one direction pin per drive.
+//
+// Musical trade-offs: drives can no longer bounce independently. Whenever
+// a sounding drive reaches the travel limit it is heading for, every head
+// reverses together, so a drive may turn around mid-travel because another
+// drive hit its end, and the direction pattern - and so the timbre -
+// depends on what the other drives are doing. A drive the reversal leaves
+// pinned against its other limit can't move until the line turns back, so
+// it sits out its steps meanwhile: notes of very different pitch drop out
+// in gaps of up to a traversal of the faster drive. Narrow travel windows
+// (DevCmdSetTravel) shorten the gaps. Limits are never exceeded: each
+// drive checks its own limit before every step. Direction cadences
+// (OptDirCadence) are ignored.
+const SharedDirPin = 0
+
+// ShiftRegister clocks the drives' STEP and DIRECTION lines out through a
+// daisy chain of ShiftChainLength 74HC595s on the hardware SPI pins (data
+// on 11, clock on 13 on an Uno) and a latch pin, instead of using a pin
+// per line. FirstPin and SharedDirPin are then unused.
+//
+// Drive N's STEP line is bit (N-1)*2 of the chain and its DIRECTION line
+// the bit after; bit i is output Q(i%8) of chip i/8, chip 0 being the one
+// wired to the board. All changes made in one tick are latched together.
+//
+// Timing: the chain is shifted at most once per tick, and only when a line
+// changed. At the 8 MHz SPI clock each chip costs about 2µs with call
+// overhead, plus the latch pulse; with a 40µs TimerResolution that leaves
+// room for about 4 chips (16 drives) beside the per-drive tick work. These
+// are estimates: watch Stats.Overruns (see MonitorLoad) when adding drives,
+// and raise TimerResolution if it climbs.
+const ShiftRegister = false
+
+// ShiftChainLength is the number of 74HC595s in the chain, 4 drives each.
+const ShiftChainLength = 4
+
+// ShiftLatchPin is wired to every 74HC595's RCLK (storage register clock).
+const ShiftLatchPin = 10
+
+// SenseFirstPin is the first input the self-test firmware (cmd/selftest)
+// reads to tell whether a drive moved: drive N's is SenseFirstPin + N-1,
+// pulled up and active low, such as the drive's TRACK 0 line or a current
+// sensor's comparator output. 0 means there are none, as on an Uno with 8
+// drives; the self-test then reports every drive as unchecked.
+const SenseFirstPin = 0
+
+// StatusLEDPin is the LED package status blinks to show what the firmware
+// is doing (see status.DefaultPatterns). 0 means there is none: on an Uno
+// with 8 drives the LED's pin 13 is drive 6's DIRECTION line. Boards with
+// it free, or with fewer drives, set 13 or their own LED's pin.
+const StatusLEDPin = 0
+
 // =============================================================================
 // TIMING CONFIGURATION
 // =============================================================================
@@ -105,10 +217,90 @@ const SystemAddress byte = 0x00
 const CmdPing byte = 0x80
 
 // CmdPong is the response to a Ping.
-// Contains: [PONG, DeviceAddress, MinSubAddress, MaxSubAddress]
-// Tells the controller what drives this device controls.
+// Contains: [PONG, DeviceAddress, MinSubAddress, MaxSubAddress, (caps MSB,
+// caps LSB)]
+// Tells the controller what drives this device controls, and in caps, which
+// Moppy's firmware doesn't send, which of the Cap commands it takes.
 const CmdPong byte = 0x81
 
+// Cap bits, as the extended pong's caps carries them: each names optional
+// commands a device takes. A device whose pong has no caps takes only
+// Moppy's: note on without velocity, note off, bend, reset and movement,
+// and ping, sequence start and stop and reset.
+const (
+	CapVelocity  uint16 = 1 << iota // DevCmdNoteOn's velocity byte
+	CapBendRange                    // DevCmdBendRange
+	CapTuning                       // DevCmdTranspose and DevCmdDetune
+	CapTremolo                      // DevCmdTremolo
+	CapPressure                     // DevCmdChannelPressure
+	CapSustain                      // DevCmdSustain
+	CapGliss                        // DevCmdGliss
+	CapTrill                        // DevCmdTrill
+	CapZones                        // DevCmdSetZone
+	CapTravel                       // DevCmdSetTravel
+	CapOptions                      // DevCmdSetOption
+	CapConfig                       // CmdGetConfig
+	CapPositions                    // CmdGetPositions
+	CapStatus                       // CmdGetStatus
+)
+
+// CmdGetConfig asks the device to report its per-drive settings.
+// The device answers with one CmdConfig message per drive, then, if it
+// routes its sub addresses to several instruments, one CmdRoute message
+// per route.
+const CmdGetConfig byte = 0x82
+
+// CmdConfig carries one drive's settings in reply to CmdGetConfig.
+// Sent to SystemAddress with the drive number as sub address.
+// Contains: [CONFIG, DeviceAddress, transpose, dir_cadence, calibration, detune,
+// bend_range, sounding_ticks (4 bytes, big-endian), start_delay, travel_min,
+// travel_max]
+const CmdConfig byte = 0x83
+
+// CmdGetPositions asks the device where its heads and carriages are.
+// The device answers with one CmdPosition message per drive.
+const CmdGetPositions byte = 0x84
+
+// CmdPosition carries one drive's position in reply to CmdGetPositions.
+// Sent to SystemAddress with the drive number as sub address.
+// Contains: [POSITION, DeviceAddress, position (2 bytes, big-endian)]
+const CmdPosition byte = 0x85
+
+// CmdGetStatus asks the device whether it is alive and what it is doing.
+// The device answers with one CmdStatus message.
+const CmdGetStatus byte = 0x86
+
+// CmdStatus carries the device's state in reply to CmdGetStatus.
+// Contains: [STATUS, DeviceAddress, uptime_seconds (4 bytes, big-endian),
+// sounding_count, sounding_mask (2 bytes, big-endian, bit 0 for drive 1),
+// sequence_state, last_fault]
+const CmdStatus byte = 0x87
+
+// CmdRoute carries one route of the device's route table in reply to
+// CmdGetConfig, after the CmdConfig messages. Sent to SystemAddress with
+// the route's number, from 1, as sub address.
+// Contains: [ROUTE, DeviceAddress, first_sub, last_sub, instrument]
+const CmdRoute byte = 0x88
+
+// Sequence states, as CmdStatus reports them.
+const (
+	SequenceIdle    byte = 0x00 // no SEQUENCE_START since the last stop or reset
+	SequencePlaying byte = 0x01 // between SEQUENCE_START and SEQUENCE_STOP
+	SequencePaused  byte = 0x02 // playing, but every drive silenced by a note off to sub address 0x00
+)
+
+// Faults, the last of which CmdStatus reports. FaultNone until something
+// goes wrong.
+const (
+	FaultNone           byte = 0x00
+	FaultBadSubAddress  byte = 0x01 // a frame for a sub address no drive or zone answers at
+	FaultEmptyFrame     byte = 0x02 // a frame without a command
+	FaultUnknownCommand byte = 0x03 // a device command the instrument doesn't implement
+	FaultBadPayload     byte = 0x04 // a payload too short or out of range
+	FaultOverrun        byte = 0x05 // a timer tick that ran past its slot
+	FaultLinkTimeout    byte = 0x06 // the link watchdog silenced the drives
+)
+
 // CmdSequenceStart signals that music playback is beginning.
 // Devices can use this to prepare (e.g., enable outputs).
 const CmdSequenceStart byte = 0xFA
@@ -128,32 +320,634 @@ const CmdReset byte = 0xFF
 // These commands control individual drives within a device.
 
 // DevCmdReset resets a specific drive (sub-address).
+// The drive re-homes in the background while the others keep playing;
+// note-ons arriving meanwhile are queued. Sub address 0x00 resets every
+// drive at once, blocking until all heads are home. Either way the reset
+// drives' travel windows return to the full 0..MaxPosition.
 const DevCmdReset byte = 0x00
 
 // DevCmdNoteOff stops the note playing on a drive.
-// The drive stops stepping and goes silent.
+// Payload: [note_number] (optional). With a note, the drive only goes
+// silent if that note is the one sounding; without, it always stops.
+// Sent to sub address 0x00 it is a panic: every drive goes silent at once,
+// dropping sustained notes, bends, slides and accents, without re-homing.
 const DevCmdNoteOff byte = 0x08
 
 // DevCmdNoteOn starts playing a note on a drive.
-// Payload: [note_number] where note_number is MIDI note 0-127.
+// Payload: [note_number, (velocity)] where note_number is MIDI note 0-127.
+// Velocity is optional; at or above AccentVelocity the note is accented
+// (see OptAccentMs).
 // MIDI note 60 = Middle C (261.63 Hz)
+// Sub address 0x00 is refused: a note plays on one drive, or a zone's.
 const DevCmdNoteOn byte = 0x09
 
 // DevCmdBendPitch applies pitch bend to the currently playing note.
-// Payload: [bend_MSB, bend_LSB] - 14-bit value, center = 8192.
-// Allows smooth pitch slides and vibrato effects.
+// Payload: [bend_MSB, bend_LSB] - signed 16-bit deflection, -8192..8191
+// (0 = no bend). Full deflection bends by the drive's DevCmdBendRange.
+// Allows smooth pitch slides and vibrato effects. Sub address 0x00 bends
+// every drive.
 const DevCmdBendPitch byte = 0x0E
 
+// DevCmdGliss slides a drive from one note to another.
+// Payload: [start_note, end_note, duration_ms_MSB, duration_ms_LSB, (flags)].
+// The slide is chromatic unless flags bit 0 is set, which interpolates the
+// period smoothly. The end note is held until note-off; any note-on or
+// note-off during the slide cancels it. Sub address 0x00 is refused.
+const DevCmdGliss byte = 0x10
+
+// GlissFlagSmooth requests smooth period interpolation for DevCmdGliss.
+const GlissFlagSmooth byte = 0x01
+
+// DevCmdTranspose sets a drive's transpose offset.
+// Payload: [semitones] as a signed int8, applied to every later note-on and
+// glissando endpoint. Sub address 0x00 sets every drive.
+const DevCmdTranspose byte = 0x11
+
+// DevCmdDetune sets a drive's fine tuning.
+// Payload: [cents] as a signed int8 (-127..127), applied to every period the
+// drive computes. Sub address 0x00 sets every drive.
+const DevCmdDetune byte = 0x13
+
+// DevCmdBendRange sets how far a full pitch bend reaches on a drive.
+// Payload: [semitones] in 1..24 (default DefaultBendRange), the equivalent
+// of MIDI RPN 0. A bend in progress is recomputed at once. Sub address 0x00
+// sets every drive.
+const DevCmdBendRange byte = 0x14
+
+// DevCmdTremolo gates a drive's stepping on and off for a tremolo effect.
+// Payload: [rate_hz, duty_percent] - the note sounds for duty_percent
+// (0..100) of each 1/rate_hz cycle. Pitch is unaffected. Rate 0 disables.
+// The setting stays until changed, across notes, note-offs and resets;
+// each note-on restarts the cycle in its sounding phase. Sub address 0x00
+// sets every drive.
+const DevCmdTremolo byte = 0x15
+
+// DevCmdChannelPressure applies channel aftertouch to a drive as vibrato.
+// Payload: [pressure] 0..127, scaled to 0..OptVibratoDepth cents of
+// vibrato at OptVibratoRate. 0 stops the vibrato; note-off clears it.
+// Sub address 0x00 applies it to every drive.
+const DevCmdChannelPressure byte = 0x16
+
+// DevCmdTrill alternates a drive between two notes, faking a second voice.
+// Payload: [note_a, note_b, rate_ms] - the drive switches note every rate_ms
+// (1..255) milliseconds, starting on note_a. Pitch bend moves both notes.
+// Any note-on, a note-off for either note, or a reset ends the trill.
+// Sub address 0x00 is refused.
+const DevCmdTrill byte = 0x17
+
+// DevCmdFactoryReset forgets a drive's saved settings and puts transpose,
+// detune, bend range and every DevCmdSetOption setting back to their
+// defaults. No payload. Sub address 0x00 resets every drive, and clears
+// the zones too.
+const DevCmdFactoryReset byte = 0x18
+
+// DevCmdSetTravel sets the window a drive's head bounces in with full
+// movement. Payload: [min, max] with min < max <= MaxPosition, or
+// [min_hi, min_lo, max_hi, max_lo], each end 16 bits big-endian, the form
+// scanners take for their longer travel. A head outside the new window
+// walks into it over the next steps rather than jumping. Sub address 0x00
+// sets every drive. DevCmdReset and factory reset restore the full
+// 0..MaxPosition.
+const DevCmdSetTravel byte = 0x19
+
+// DefaultBendRange is the bend range drives start with, in semitones.
+// 2 matches the General MIDI default pitch bend sensitivity.
+const DefaultBendRange = 2
+
+// MaxBendRange is the largest range DevCmdBendRange accepts, in semitones.
+const MaxBendRange = 24
+
+// DevCmdSetZone defines or clears a drive zone. Any sub address is accepted.
+// Payload: [zone, first_drive, last_drive, mode] where zone is 1..MaxZones
+// and mode is ZoneUnison, ZonePool or ZonePoolLRU. first_drive == 0 clears
+// the zone. Zones are saved with the drives' settings (PersistSettings).
+const DevCmdSetZone byte = 0x12
+
+// DevCmdSustain presses or lifts the sustain pedal (MIDI CC64) on a drive.
+// Payload: [flag] - non-zero holds the pedal down. Sub address 0x00 applies
+// it to every drive. While held, note-offs are deferred until the pedal lifts.
+const DevCmdSustain byte = 0x40
+
 // DevCmdSetMovement toggles full-range head movement on a drive.
 // Payload: [flag] - flag == 0 enables full 0-158 range, any other
 // value clamps the head to a 2-track wiggle around centre. (Inverted
-// polarity, but matches the reference firmware and Moppy UI.)
+// polarity, but matches the reference firmware and Moppy UI.) Sub address
+// 0x00 sets every drive. The clamp is a drive setting, OptMovementClamp:
+// it is saved, and outlasts DevCmdReset.
 const DevCmdSetMovement byte = 0x64
 
+// DevCmdSetOption changes a per-drive option.
+// Payload: [option, value] with option one of the Opt* constants below.
+// Sub address 0x00 sets the option on every drive.
+const DevCmdSetOption byte = 0x65
+
+// =============================================================================
+// DRIVE OPTIONS (DevCmdSetOption)
+// =============================================================================
+
+// OptDirCadence reverses the head direction after every N steps (value = N)
+// for a tighter or hollower tone. 0 keeps the classic full-travel bounce.
+// The travel limits are enforced either way.
+const OptDirCadence byte = 0x01
+
+// OptCalibration is the number of steps (value) a drive moves forward from
+// its end stop after homing. That spot becomes the drive's position 0, for
+// drives whose end stop sits a little beyond track 0.
+const OptCalibration byte = 0x02
+
+// OptAccentMs is how long (value, in milliseconds) an accented note plays
+// its attack before settling to the true pitch. 0 disables accents.
+const OptAccentMs byte = 0x03
+
+// OptAccentStyle selects what an accented attack sounds like (value is
+// AccentOctaveDown or AccentDoubleRate).
+const OptAccentStyle byte = 0x04
+
+// OptVibratoRate is the vibrato speed in Hz (value) used for channel
+// pressure. 0 turns pressure vibrato off.
+const OptVibratoRate byte = 0x05
+
+// OptVibratoDepth is the vibrato depth in cents (value) at full channel
+// pressure.
+const OptVibratoDepth byte = 0x06
+
+// Pressure vibrato defaults, until OptVibratoRate / OptVibratoDepth are set.
+const (
+	DefaultVibratoRate  = 6  // Hz
+	DefaultVibratoDepth = 50 // cents
+)
+
+// Accent styles for OptAccentStyle.
+const (
+	AccentOctaveDown byte = 0x00 // attack one octave below the note
+	AccentDoubleRate byte = 0x01 // attack at twice the step rate
+)
+
+// AccentVelocity is the lowest note-on velocity that gets an accent.
+const AccentVelocity = 100
+
+// OptRegisterTravel turns register-dependent head travel on (value != 0)
+// or off. See REGISTER TRAVEL below.
+const OptRegisterTravel byte = 0x07
+
+// OptTravelSplitLow is the lowest note (value) that gets half travel.
+const OptTravelSplitLow byte = 0x08
+
+// OptTravelSplitHigh is the lowest note (value) that gets quarter travel.
+const OptTravelSplitHigh byte = 0x09
+
+// OptStartDelay holds every note-on back by value milliseconds (0..
+// MaxStartDelayMs), to line a drive's audible onset up with faster
+// instruments. Note-offs are never delayed; one arriving during the delay
+// cancels the note.
+const OptStartDelay byte = 0x0A
+
+// MaxStartDelayMs is the longest OptStartDelay; larger values are clamped.
+const MaxStartDelayMs = 20
+
+// OptLegato turns mono legato note memory on (value non-zero) or off. A
+// legato drive remembers the notes still held under the one it plays, up
+// to four; a fifth forgets the oldest. A note-off for a held note that
+// isn't sounding just forgets it. A note-off for the sounding note is
+// settled in this order: first the drive goes back to the most recent
+// note still held; only when none is held does the sustain pedal, if
+// down, keep the note ringing; otherwise the drive stops. A note-off
+// without a note forgets every held note, then stops the drive or leaves
+// it to the pedal as usual.
+const OptLegato byte = 0x0B
+
+// OptTravelMin and OptTravelMax move one end of the DevCmdSetTravel window.
+// A value that would leave the window empty or past MaxPosition is ignored.
+const (
+	OptTravelMin byte = 0x0C
+	OptTravelMax byte = 0x0D
+)
+
+// OptPhraseMode (scanners only) makes a carriage reverse only between
+// notes, value non-zero, rather than wherever it meets the end of its
+// travel. See instruments.Scanner.
+const OptPhraseMode byte = 0x0E
+
+// OptPulseWidth (Tesla coil interrupters only) sets the pulse width in
+// units of 10µs. The interrupter's safety limits still apply on top of it.
+// See instruments.Interrupter.
+const OptPulseWidth byte = 0x0F
+
+// OptMovementClamp is DevCmdSetMovement's clamp as an option: value
+// non-zero clamps the head to the 2-track wiggle around centre, 0 gives it
+// its travel window back.
+const OptMovementClamp byte = 0x10
+
+// =============================================================================
+// REGISTER TRAVEL
+// =============================================================================
+
+// High notes sound thin when the head flies across the whole disk, low
+// notes weak when it is confined to a few tracks. With register travel on,
+// each note narrows the bounce window to a share of the drive's movement
+// range that depends on the note (after transpose):
+//
+//	note <  TravelSplitLow                    full range
+//	TravelSplitLow <= note < TravelSplitHigh  half
+//	note >= TravelSplitHigh                   quarter
+//
+// The window is centred on the head's current position (shifted to stay
+// inside the movement range), so a note never starts with a jump.
+
+// RegisterTravel is the power-on state of OptRegisterTravel.
+const RegisterTravel = false
+
+// Power-on splits for OptTravelSplitLow / OptTravelSplitHigh.
+const (
+	TravelSplitLow  = 48
+	TravelSplitHigh = 72
+)
+
+// =============================================================================
+// SOFT BOUNCE
+// =============================================================================
+
+// SoftBounce eases the head into each reversal to soften the periodic
+// thunk at the travel limits on long notes. Within SoftBounceSteps of
+// either end of the bounce window the step period is stretched, rising
+// linearly to SoftBounceStretch percent at the limit; the steps in between
+// are shortened to match, so the average period over a traversal stays
+// the note's own to within one tick. Windows too narrow to have any steps
+// in between bounce hard as usual. Off by default for the classic sound.
+const SoftBounce = false
+
+// SoftBounceSteps is how many steps from a limit the stretch starts.
+const SoftBounceSteps = 8
+
+// SoftBounceStretch is the period stretch at the limit itself, in percent.
+const SoftBounceStretch = 10
+
+// =============================================================================
+// HDD PERCUSSION (instruments.HDD)
+// =============================================================================
+
+// A hard drive's voice-coil actuator, driven through an H-bridge (one
+// L293D or L298N channel pair), clicks sharply when pulsed: a good kick,
+// snare or hi-hat next to the floppies.
+
+// NumHDDs is the number of hard drives wired for percussion.
+const NumHDDs = 2
+
+// HDDFirstPin is the first H-bridge input pin. HDD N drives its coil
+// between HDDFirstPin + (N-1)*2 and the pin after it (14-15 and 16-17 by
+// default), so NumDrives must leave those pins to it.
+const HDDFirstPin = 14
+
+// HDDMaxDutyPercent caps how much of each HDDDutyWindowMs window a coil
+// may be driven for. Hits beyond it are shortened or dropped, so a fast
+// roll can't overheat the coil or the H-bridge.
+const HDDMaxDutyPercent = 20
+
+// HDDDutyWindowMs is the window HDDMaxDutyPercent applies to.
+const HDDDutyWindowMs = 100
+
+// =============================================================================
+// STEPPER MOTORS (instruments.Stepper)
+// =============================================================================
+
+// NEMA17 steppers behind A4988 or DRV8825 drivers take the same STEP/DIR
+// signals as floppies, play louder and reach higher notes cleanly.
+
+// NumSteppers is the number of stepper motors connected.
+const NumSteppers = 2
+
+// StepperFirstPin is the first stepper driver pin. Stepper N steps on
+// StepperFirstPin + (N-1)*2 and takes its direction from the pin after.
+const StepperFirstPin = 10
+
+// StepperEnablePin is the drivers' shared active-low ENABLE input. The
+// coils are de-energised after StepperIdleMs with every motor silent, so
+// they don't sit there getting hot. 0 means ENABLE isn't wired and the
+// coils stay energised.
+const StepperEnablePin = 0
+
+// StepperIdleMs is how long every motor must be silent before the coils
+// are de-energised.
+const StepperIdleMs = 1000
+
+// StepperMaxNote is the highest note steppers play; higher ones are
+// dropped.
+const StepperMaxNote = 95
+
+// StepperReverseSteps is how many steps a motor turns before reversing,
+// settable per motor with OptDirCadence. 0 turns continuously.
+const StepperReverseSteps = 0
+
+// StepperStartHz is the fastest step rate a motor can start at without
+// stalling. Notes above it ramp up from it over StepperRampSteps steps.
+const StepperStartHz = 200
+
+// StepperRampSteps is how many steps the ramp up to a fast note takes.
+// 0 starts every note at full speed.
+const StepperRampSteps = 16
+
+// =============================================================================
+// PWM BUZZERS (instruments.Buzzer)
+// =============================================================================
+
+// NumBuzzers is the number of sub addresses a Buzzer answers to. With
+// fewer PWM voices than that, sub addresses share voices round-robin.
+const NumBuzzers = 4
+
+// =============================================================================
+// PWM POLYSYNTH (instruments.PWMSynth)
+// =============================================================================
+
+// A square-wave voice per sub address on boards with plenty of PWM, such
+// as the RP2040's 8 slices, each voice on its own pin into an external
+// resistor mixer.
+
+// NumSynthVoices is the number of sub addresses a PWMSynth answers to.
+// With fewer PWM outputs than that, sub addresses share them round-robin.
+const NumSynthVoices = 8
+
+// SynthMinNote and SynthMaxNote are the range a PWMSynth plays. Notes
+// outside it, after transpose, are handled by NoteRangePolicy.
+const (
+	SynthMinNote = 24
+	SynthMaxNote = 108
+)
+
+// =============================================================================
+// RELAY AND SOLENOID PERCUSSION (instruments.Relay)
+// =============================================================================
+
+// Relays clacking or small solenoids striking a surface, each switched by
+// a transistor or driver board from one pin.
+
+// NumRelays is the number of relay or solenoid outputs.
+const NumRelays = 2
+
+// RelayFirstPin is the first relay output. Relay N is on
+// RelayFirstPin + N-1 (18 and 19, A4 and A5 on an Uno, by default).
+const RelayFirstPin = 18
+
+// RelayMaxPulseMs is the longest a coil is ever energised for one hit,
+// whatever the drum table says, so a solenoid can't overheat.
+const RelayMaxPulseMs = 30
+
+// RelayRetriggerMs is the shortest time between the starts of two hits on
+// one output. Hits sooner than that are dropped rather than making the
+// mechanism chatter.
+const RelayRetriggerMs = 40
+
+// RelayNoteOffCuts makes a NoteOff de-energise a coil mid-hit. Off, every
+// hit runs its full length.
+const RelayNoteOffCuts = false
+
+// =============================================================================
+// SCANNER CARRIAGES (instruments.Scanner)
+// =============================================================================
+
+// A flatbed scanner's carriage stepper, behind a STEP/DIR driver, travels
+// thousands of steps end to end and sounds quite unlike a floppy.
+
+// NumScanners is the number of scanner carriages connected.
+const NumScanners = 1
+
+// ScannerFirstPin is the first scanner driver pin. Scanner N steps on
+// ScannerFirstPin + (N-1)*2 and takes its direction from the pin after.
+const ScannerFirstPin = 6
+
+// ScannerEndStopPin is the first home switch input, closing to ground
+// when the carriage reaches position 0; scanner N uses
+// ScannerEndStopPin + N-1. 0 means there are no switches: homing drives
+// the carriage blindly against the end for the whole travel instead.
+const ScannerEndStopPin = 0
+
+// ScannerTravelSteps is the carriage travel, in steps, from position 0.
+// DevCmdSetTravel narrows it per scanner with a 4-byte payload:
+// [min (2 bytes), max (2 bytes)], big-endian.
+const ScannerTravelSteps = 3000
+
+// ScannerMaxStepHz is the fastest the mechanism can step. Notes above it
+// are handled by NoteRangePolicy: folded down an octave at a time,
+// clamped, or dropped.
+const ScannerMaxStepHz = 1000
+
+// ScannerHomeStepMs is the interval between steps while homing.
+const ScannerHomeStepMs = 2
+
+// ScannerPhraseMode is OptPhraseMode's power-on value.
+const ScannerPhraseMode = false
+
+// =============================================================================
+// DC MOTORS (instruments.DCMotor)
+// =============================================================================
+
+// A brushed DC motor behind an H-bridge such as an L298N whines at its PWM
+// carrier frequency, so a note's frequency as the carrier at a low duty
+// makes it sing without spinning up much.
+
+// NumDCMotors is the number of sub addresses a DCMotor answers to. With
+// fewer PWM outputs than that, sub addresses share motors round-robin.
+const NumDCMotors = 2
+
+// DCMotorDutyPercent is the PWM duty a sounding motor is driven at. Raise
+// it if a motor is too quiet; the motor turns faster and runs hotter.
+const DCMotorDutyPercent = 10
+
+// DCMotorMaxOnMs is the longest a motor is driven for one note, so a long
+// sustain or a lost NoteOff can't cook it. 0 disables the limit.
+const DCMotorMaxOnMs = 4000
+
+// =============================================================================
+// LIGHT ORGAN (instruments.LightOrgan)
+// =============================================================================
+
+// A WS2812/SK6812 strip split into one segment per sub address, lit in the
+// colour of each note's pitch class. Mirror it beside the real instrument
+// on a Router so the same messages drive both.
+
+// LightOrganLEDs is the number of LEDs on the strip.
+const LightOrganLEDs = 30
+
+// LightOrganSegments is the number of sub addresses the strip answers to.
+// Each lights LightOrganLEDs/LightOrganSegments LEDs in turn.
+const LightOrganSegments = 6
+
+// LightOrganBrightness caps the strip's brightness (1..255), keeping the
+// supply current in check. A full-velocity note reaches it.
+const LightOrganBrightness = 96
+
+// LightOrganDecayMs is how long a segment fades for after its NoteOff.
+// 0 blanks it at once.
+const LightOrganDecayMs = 300
+
+// LightOrganFrameMs is the shortest interval between strip writes. Writing
+// a WS2812 strip holds interrupts off for about 30µs per LED, so every
+// frame delays the tick; this bounds how often.
+const LightOrganFrameMs = 40
+
+// =============================================================================
+// CNC SHIELD (instruments.CNC)
+// =============================================================================
+
+// A 3D printer or CNC router's axes on a standard Arduino CNC Shield (V3):
+// X, Y and Z step on pins 2, 3 and 4 with direction on 5, 6 and 7, the
+// cloned A axis steps on 12 with direction on 13, and every driver shares
+// the active-low ENABLE on pin 8. The pinout is fixed by the shield.
+
+// NumCNCAxes is the number of axes played, X, Y, Z then A (1..4).
+const NumCNCAxes = 3
+
+// CNCTravelXSteps, CNCTravelYSteps, CNCTravelZSteps and CNCTravelASteps
+// are each axis's soft travel limit in steps from home. An axis reverses
+// rather than step past either end, so set them inside the real travel.
+const (
+	CNCTravelXSteps = 8000
+	CNCTravelYSteps = 8000
+	CNCTravelZSteps = 2000
+	CNCTravelASteps = 8000
+)
+
+// CNCLimitSwitches says limit switches are wired to the shield's X-, Y-
+// and Z- inputs (pins 9, 10 and 11), closing to ground at home. The A axis
+// has no input and, like every axis without switches, homes blindly by
+// driving against its end for the whole travel.
+const CNCLimitSwitches = true
+
+// CNCHomeStepMs is the interval between steps while homing.
+const CNCHomeStepMs = 1
+
+// CNCHoldMs is how long the drivers stay energised, holding position,
+// after every axis falls silent (a SequenceStop included) before ENABLE
+// is released so the motors cool.
+const CNCHoldMs = 2000
+
+// =============================================================================
+// TESLA COIL INTERRUPTERS (instruments.Interrupter)
+// =============================================================================
+
+// A musical Tesla coil's optical interrupter input fires the coil for as
+// long as it is high, so each pulse must stay short and sparse whatever
+// the music asks. The Interrupter* limits below are enforced in firmware
+// and can't be raised over the wire. Pulses are timed in whole ticks of
+// TimerResolution, rounded down.
+
+// NumInterrupters is the number of interrupter outputs.
+const NumInterrupters = 2
+
+// InterrupterFirstPin is the first interrupter output. Output N is on
+// InterrupterFirstPin + N-1.
+const InterrupterFirstPin = 4
+
+// InterrupterPulseUs is the pulse width outputs start with, settable per
+// output with OptPulseWidth.
+const InterrupterPulseUs = 80
+
+// InterrupterMaxPulseUs is the longest pulse ever sent.
+const InterrupterMaxPulseUs = 200
+
+// InterrupterMaxDutyPercent is the largest share of each period a pulse
+// may take. High notes get shorter pulses to stay within it, and a note
+// too high for even a one-tick pulse stays silent.
+const InterrupterMaxDutyPercent = 5
+
+// InterrupterMaxOnMs is the longest one note may keep firing. The note
+// then stops until the next NoteOn.
+const InterrupterMaxOnMs = 1000
+
+// InterrupterWatchdogMs is how long outputs may fire without any message
+// arriving before they are all dropped, in case the host has died
+// mid-note.
+const InterrupterWatchdogMs = 1500
+
+// =============================================================================
+// NOW PLAYING DISPLAY (instruments.Display)
+// =============================================================================
+
+// A 128x64 SSD1306 or SH1106 OLED on I2C, showing the sequence state and
+// error count on its top line and a line per drive beneath: the note
+// playing and a bar for the head position.
+
+// DisplayAddress is the display's I2C address (0x3C on most modules,
+// 0x3D with the address jumper moved).
+const DisplayAddress = 0x3C
+
+// DisplaySH1106 selects an SH1106 controller, whose 132-column memory
+// puts the visible 128 columns 2 in.
+const DisplaySH1106 = false
+
+// DisplayDrives is the number of drives shown, from drive 1 (1..7).
+const DisplayDrives = 7
+
+// DisplayFrameMs is the shortest interval between redraws. A redraw is
+// sent a 128-byte page per main loop pass (about 3ms at 400kHz), and
+// only pages that changed, so message handling never waits long.
+const DisplayFrameMs = 50
+
+
+// =============================================================================
+
+// Range policies decide what happens to a note (after transpose) that falls
+// outside the range an instrument can play.
+const (
+	// RangeDrop ignores the note-on entirely.
+	RangeDrop byte = iota
+	// RangeClamp plays the nearest playable note.
+	RangeClamp
+	// RangeFold shifts the note by whole octaves until it fits.
+	RangeFold
+)
+
+// NoteRangePolicy is the range policy used by the instruments.
+const NoteRangePolicy = RangeDrop
+
 // =============================================================================
 // FEATURE FLAGS
 // =============================================================================
 
+// StaggerStepEdges offsets each drive's tick counter by its drive index at
+// note-on, so drives started together don't step on the same tick. This
+// spreads the coil current peaks that can brown out a weak 5V supply.
+// Pitch is unaffected. Drives in a unison zone are never staggered, since
+// they are meant to step in lockstep.
+const StaggerStepEdges = false
+
+// ParkIdleMs is how long a drive must stay silent before its head is
+// quietly stepped back to the park position. 0 disables idle parking.
+// Parking never starts between SEQUENCE_START and SEQUENCE_STOP.
+const ParkIdleMs = 10000
+
+// LinkWatchdogMs is how long a sequence may go on with notes sounding
+// but no message arriving before every drive is silenced, in case the
+// controller went away mid-song. MoppyControlGUI sends nothing while a
+// note is held, so keep it longer than the longest held note. 0 disables
+// the watchdog; it never fires outside SEQUENCE_START..SEQUENCE_STOP.
+const LinkWatchdogMs = 10000
+
+// ParkStepMs is the interval between head steps while parking.
+// Slow enough to be nearly inaudible.
+const ParkStepMs = 30
+
+// ParkAtCenter parks heads at the middle of their travel instead of at 0.
+const ParkAtCenter = false
+
+// CenterOnSequenceStart moves every idle drive's head to the middle of its
+// travel window when SEQUENCE_START arrives, so the first note of a song
+// doesn't bounce off an end stop straight away. The move runs in the
+// background; a drive that gets a note before it's centred just plays.
+const CenterOnSequenceStart = true
+
+// CenterStepMs is the interval between head steps while centring.
+const CenterStepMs = 1
+
+// PersistSettings saves each drive's transpose, detune, bend range and
+// DevCmdSetOption settings, and the DevCmdSetZone zones, to EEPROM and
+// restores them at boot.
+const PersistSettings = true
+
+// SaveDelayMs is how long settings must stay unchanged before they are
+// written, so a burst of changes costs one EEPROM write. Nothing is
+// written between SEQUENCE_START and SEQUENCE_STOP.
+const SaveDelayMs = 2000
+
 // PlayStartupSound determines whether to play a short tune on boot.
 // This confirms that all drives are working and helps with debugging.
 // Set to false for silent startup.
@@ -0,0 +1,102 @@
+//go:build !tinygo
+
+// Package drivesim models where the floppy drives' heads physically are,
+// from nothing but the edges on their step and direction lines, to check
+// the firmware's own position bookkeeping against.
+//
+// The model counts one position per step line edge, in the direction the
+// direction line gives (high towards 0), the same units as
+// config.MaxPosition. A head can't travel below its end stop or past
+// MaxPosition: an edge that would take it there leaves it where it is and
+// is recorded as over-travel, which on real drives is the grinding of a
+// head against its stop. The end stop is at position 0 unless Calibrate
+// puts it further back, for drives whose stop sits before track 0.
+package drivesim
+
+import (
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/hal"
+)
+
+// Overtravel is a step that would have taken a head past a stop.
+type Overtravel struct {
+	Drive byte
+	// Position is where the head was, against the stop it was pushed at.
+	Position int
+	// Step counts the drive's steps before this one.
+	Step uint32
+}
+
+// Model tracks every drive's head. The zero Model has every head at 0,
+// moving away from it.
+type Model struct {
+	// Position is each drive's head position, indexed by drive number.
+	Position [config.NumDrives + 1]int
+	// Overtravel records every step that pushed a head at a stop.
+	Overtravel []Overtravel
+
+	steps   [config.NumDrives + 1]uint32
+	reverse [config.NumDrives + 1]bool // direction line high: towards 0
+	stop    [config.NumDrives + 1]int  // end stop position, 0 or below
+}
+
+// Calibrate tells the model a drive's end stop sits steps head steps
+// (two positions each, see OptCalibration) before position 0. The head
+// stays where it is; only the positions it is measured in move.
+func (m *Model) Calibrate(drive byte, steps byte) {
+	stop := -2 * int(steps)
+	m.Position[drive] += stop - m.stop[drive]
+	m.stop[drive] = stop
+}
+
+// Attach follows the drives' pins through hal.OnChange until the returned
+// function is called.
+func (m *Model) Attach() (detach func()) {
+	hal.OnChange = m.Pin
+	return func() { hal.OnChange = nil }
+}
+
+// Pin takes a change on pin p. Pins that aren't a drive's are ignored.
+func (m *Model) Pin(p hal.Pin, high bool) {
+	if config.ShiftRegister {
+		return
+	}
+	if config.SharedDirPin != 0 {
+		if p == config.SharedDirPin {
+			for d := 1; d <= config.NumDrives; d++ {
+				m.reverse[d] = high
+			}
+			return
+		}
+		if p >= config.FirstPin && p < config.FirstPin+config.NumDrives {
+			m.step(byte(p-config.FirstPin) + 1)
+		}
+		return
+	}
+	if p < config.FirstPin || p >= config.FirstPin+2*config.NumDrives {
+		return
+	}
+	d := byte(p-config.FirstPin)/2 + 1
+	if (p-config.FirstPin)%2 == 1 {
+		m.reverse[d] = high
+		return
+	}
+	m.step(d)
+}
+
+// step moves a drive's head one position, unless it is against the stop
+// it is being moved towards.
+func (m *Model) step(d byte) {
+	pos := m.Position[d]
+	if m.reverse[d] {
+		pos--
+	} else {
+		pos++
+	}
+	if pos < m.stop[d] || pos > config.MaxPosition {
+		m.Overtravel = append(m.Overtravel, Overtravel{Drive: d, Position: m.Position[d], Step: m.steps[d]})
+	} else {
+		m.Position[d] = pos
+	}
+	m.steps[d]++
+}
@@ -0,0 +1,378 @@
+//go:build !tinygo
+
+package drivesim_test
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"testing"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/drivesim"
+	"github.com/ystepanoff/goppy/firmware/hal"
+	"github.com/ystepanoff/goppy/firmware/instruments"
+	"github.com/ystepanoff/goppy/firmware/networks"
+	"github.com/ystepanoff/goppy/firmware/networks/networkstest"
+	"github.com/ystepanoff/goppy/firmware/notes"
+)
+
+// logTail is how much of the log a failure shows.
+const logTail = 20
+
+// homeStepMs is the firmware's pace when re-homing, a pulse per 5ms.
+const homeStepMs = 5
+
+// rig is FloppyDrives behind the real parser, with a Model on its pins.
+type rig struct {
+	t      *testing.T
+	model  drivesim.Model
+	drives *instruments.FloppyDrives
+	port   *networkstest.MockPort
+	serial *networks.Serial
+	log    []string // what was sent, for the failure message
+}
+
+// newRig starts the drives with their lines low, as at power-on, whatever
+// the last rig left on the simulated pins.
+func newRig(t *testing.T) *rig {
+	for p := config.FirstPin; p < config.FirstPin+2*config.NumDrives; p++ {
+		hal.Pin(p).Low()
+	}
+	if config.SharedDirPin != 0 {
+		hal.Pin(config.SharedDirPin).Low()
+	}
+	r := &rig{t: t, drives: instruments.NewFloppyDrives(), port: networkstest.NewMockPort()}
+	r.serial = networks.NewSerialPort(r.drives, r.port)
+	t.Cleanup(r.model.Attach())
+	return r
+}
+
+// send delivers a message to a drive, or to the system for sub address 0
+// with a system command.
+func (r *rig) send(addr, sub, command byte, payload ...byte) {
+	r.log = append(r.log, fmt.Sprintf("%02X %02X %02X % X", addr, sub, command, payload))
+	r.port.Feed(config.StartByte, addr, sub, byte(1+len(payload)), command)
+	r.port.Feed(payload...)
+	r.serial.ReadMessages()
+}
+
+func (r *rig) device(sub, command byte, payload ...byte) {
+	r.send(config.DeviceAddress, sub, command, payload...)
+}
+
+func (r *rig) run(ticks int) {
+	r.log = append(r.log, fmt.Sprintf("run %d", ticks))
+	for range ticks {
+		r.drives.Tick()
+	}
+}
+
+// positions asks for the drives' positions and returns the replies.
+func (r *rig) positions() [config.NumDrives + 1]int {
+	r.port.Written = r.port.Written[:0]
+	r.send(config.SystemAddress, 0, config.CmdGetPositions)
+	var got [config.NumDrives + 1]int
+	for b := r.port.Written; len(b) >= 8; b = b[8:] {
+		if b[4] != config.CmdPosition {
+			r.t.Fatalf("reply % X isn't a position", b[:8])
+		}
+		got[b[2]] = int(b[6])<<8 | int(b[7])
+	}
+	return got
+}
+
+// check fails the test if a head was pushed at a stop, or if a reported
+// position is more than a step from the model's.
+func (r *rig) check(seed uint64) {
+	fail := func(format string, args ...any) {
+		r.t.Helper()
+		log := r.log[max(0, len(r.log)-logTail):]
+		r.t.Fatalf("seed %d: %s\nafter:\n%s", seed, fmt.Sprintf(format, args...), strings.Join(log, "\n"))
+	}
+	if len(r.model.Overtravel) > 0 {
+		fail("over-travel %+v", r.model.Overtravel[0])
+	}
+	got := r.positions()
+	for d := 1; d <= config.NumDrives; d++ {
+		if diff := got[d] - r.model.Position[d]; diff < -1 || diff > 1 {
+			fail("drive %d reports position %d, the head is at %d", d, got[d], r.model.Position[d])
+		}
+	}
+}
+
+// rehome calibrates a drive and re-homes it, running until it is back.
+// Homing pushes the head at the stop on purpose, so over-travel while it
+// runs is expected and dropped.
+func (r *rig) rehome(d, calibration byte) {
+	r.device(d, config.DevCmdSetOption, config.OptCalibration, calibration)
+	r.model.Calibrate(d, calibration)
+	n := len(r.model.Overtravel)
+	r.device(d, config.DevCmdReset)
+	// Back across the travel and the offset, forward across the offset,
+	// and a last wait before the drive counts itself home.
+	pulses := config.MaxPosition/2 + 2*int(calibration) + 1
+	r.run(pulses * homeStepMs * notes.TicksPerMs)
+	var kept []drivesim.Overtravel
+	for _, o := range r.model.Overtravel[n:] {
+		if o.Drive != d {
+			kept = append(kept, o)
+		}
+	}
+	r.model.Overtravel = append(r.model.Overtravel[:n], kept...)
+}
+
+// step sends one random message, then runs a random stretch of ticks.
+func (r *rig) step(rng *rand.Rand) {
+	d := byte(1 + rng.IntN(config.NumDrives))
+	note := func() byte { return byte(24 + rng.IntN(60)) }
+	switch rng.IntN(16) {
+	case 0, 1, 2, 3:
+		r.device(d, config.DevCmdNoteOn, note(), byte(1+rng.IntN(127)))
+	case 4, 5:
+		r.device(d, config.DevCmdNoteOff)
+	case 6:
+		bend := uint16(rng.IntN(1 << 14))
+		r.device(d, config.DevCmdBendPitch, byte(bend>>8), byte(bend))
+	case 7:
+		ms := uint16(10 + rng.IntN(500))
+		r.device(d, config.DevCmdGliss, note(), note(), byte(ms>>8), byte(ms), byte(rng.IntN(2)))
+	case 8:
+		r.device(d, config.DevCmdTrill, note(), note(), byte(1+rng.IntN(100)))
+	case 9:
+		r.device(d, config.DevCmdTremolo, byte(rng.IntN(20)), byte(rng.IntN(101)))
+	case 10:
+		r.device(d, config.DevCmdChannelPressure, byte(rng.IntN(128)))
+	case 11:
+		lo := rng.IntN(config.MaxPosition)
+		hi := lo + 1 + rng.IntN(config.MaxPosition-lo)
+		r.device(d, config.DevCmdSetTravel, byte(lo), byte(hi))
+	case 12:
+		r.device(d, config.DevCmdSetMovement, byte(rng.IntN(2)))
+	case 13:
+		options := []byte{config.OptDirCadence, config.OptRegisterTravel, config.OptLegato}
+		r.device(d, config.DevCmdSetOption, options[rng.IntN(len(options))], byte(rng.IntN(20)))
+	case 14:
+		if rng.IntN(2) == 0 {
+			r.send(config.SystemAddress, 0, config.CmdSequenceStart)
+		} else {
+			r.send(config.SystemAddress, 0, config.CmdSequenceStop)
+		}
+	case 15:
+		if rng.IntN(4) == 0 {
+			r.rehome(d, byte(rng.IntN(8)))
+		}
+	}
+	r.run(rng.IntN(200 * notes.TicksPerMs))
+}
+
+// TestModelAgrees plays random sequences and checks the firmware against
+// the model after every message.
+func TestModelAgrees(t *testing.T) {
+	sequences, length := 2000, 30
+	if testing.Short() {
+		sequences = 200
+	}
+	for seed := range uint64(sequences) {
+		r := newRig(t)
+		rng := rand.New(rand.NewPCG(seed, 0))
+		for range length {
+			r.step(rng)
+			r.check(seed)
+		}
+	}
+}
+
+// TestBounce runs each drive end to end at the fastest note for long
+// enough to bounce many times, in the full window and a narrow one.
+func TestBounce(t *testing.T) {
+	for _, window := range [][2]byte{{0, config.MaxPosition}, {10, 12}, {0, 1}, {config.MaxPosition - 1, config.MaxPosition}} {
+		r := newRig(t)
+		r.device(0, config.DevCmdSetTravel, window[0], window[1])
+		for d := byte(1); d <= config.NumDrives; d++ {
+			r.device(d, config.DevCmdNoteOn, instruments.MaxFloppyNote, 100)
+		}
+		r.run(2000 * notes.TicksPerMs)
+		r.check(0)
+		for d := 1; d <= config.NumDrives; d++ {
+			if pos := r.model.Position[d]; pos < int(window[0]) || pos > int(window[1]) {
+				t.Errorf("window %v: drive %d ended at %d", window, d, pos)
+			}
+		}
+	}
+}
+
+// TestCalibratedHoming re-homes a drive whose end stop sits before track 0
+// from each end of its travel.
+func TestCalibratedHoming(t *testing.T) {
+	for _, calibration := range []byte{0, 1, 5, 20} {
+		r := newRig(t)
+		r.rehome(1, calibration)
+		r.check(0)
+		r.device(1, config.DevCmdSetTravel, config.MaxPosition-1, config.MaxPosition)
+		r.device(1, config.DevCmdNoteOn, instruments.MaxFloppyNote, 100)
+		r.run(2000 * notes.TicksPerMs)
+		r.device(1, config.DevCmdNoteOff)
+		r.rehome(1, calibration)
+		r.check(0)
+		if pos := r.model.Position[1]; pos != 0 {
+			t.Errorf("calibration %d: re-homed to %d, want 0", calibration, pos)
+		}
+	}
+}
+
+// TestCadence reverses drive 1 every N steps and checks, against the
+// model, that the head swings N positions each way and never leaves its
+// travel.
+func TestCadence(t *testing.T) {
+	if config.ShiftRegister {
+		t.Skip("step lines go through the shift register")
+	}
+	for _, n := range []byte{1, 2, 4} {
+		r := newRig(t)
+		// Runs of steps between direction changes, as the model saw them.
+		var runs []int
+		last := 0
+		step := hal.Pin(config.FirstPin) // drive 1's, either wiring
+		hal.OnChange = func(p hal.Pin, high bool) {
+			r.model.Pin(p, high)
+			if p != step {
+				return
+			}
+			pos := r.model.Position[1]
+			dir := pos - last
+			last = pos
+			if len(runs) > 0 && (runs[len(runs)-1] > 0) == (dir > 0) {
+				runs[len(runs)-1] += dir
+			} else {
+				runs = append(runs, dir)
+			}
+		}
+		r.device(1, config.DevCmdSetOption, config.OptDirCadence, n)
+		r.device(1, config.DevCmdNoteOn, 60)
+		r.run(1000 * notes.TicksPerMs)
+		r.check(0)
+		if len(runs) < 20 {
+			t.Fatalf("cadence %d: only %d runs", n, len(runs))
+		}
+		for i, run := range runs {
+			if run != int(n) && run != -int(n) {
+				t.Errorf("cadence %d: run %d went %d positions, want %d each way", n, i, run, n)
+				break
+			}
+		}
+		if pos := r.model.Position[1]; pos < 0 || pos > int(n) {
+			t.Errorf("cadence %d: head at %d, want within %d of the end stop", n, pos, n)
+		}
+	}
+}
+
+// TestRegisterTravel plays a low, a middle and a high note with register
+// travel on, in the full window and a narrower one, and checks against the
+// model that each head covers all of its register's share of the window,
+// no more, and never leaves it.
+func TestRegisterTravel(t *testing.T) {
+	if config.ShiftRegister {
+		t.Skip("step lines go through the shift register")
+	}
+	// Notes and the share of the window each gets, with the high split
+	// moved down within reach of the drives.
+	const splitHigh = 65
+	played := [config.NumDrives + 1]byte{1: 45, 2: 60, 3: 68}
+	share := [config.NumDrives + 1]int{1: 1, 2: 2, 3: 4}
+	for _, window := range [][2]int{{0, config.MaxPosition}, {20, 140}} {
+		r := newRig(t)
+		var lo, hi [config.NumDrives + 1]int
+		for d := range lo {
+			lo[d], hi[d] = config.MaxPosition, 0
+		}
+		playing := false
+		hal.OnChange = func(p hal.Pin, high bool) {
+			r.model.Pin(p, high)
+			if !playing {
+				return
+			}
+			for d := 1; d <= 3; d++ {
+				lo[d] = min(lo[d], r.model.Position[d])
+				hi[d] = max(hi[d], r.model.Position[d])
+			}
+		}
+		for d := byte(1); d <= 3; d++ {
+			r.device(d, config.DevCmdSetOption, config.OptRegisterTravel, 1)
+			r.device(d, config.DevCmdSetOption, config.OptTravelSplitHigh, splitHigh)
+			r.device(d, config.DevCmdSetTravel, byte(window[0]), byte(window[1]))
+			// Bring the head into the window first, from the end stop.
+			r.device(d, config.DevCmdNoteOn, 30)
+		}
+		r.run(3000 * notes.TicksPerMs)
+		playing = true
+		for d := byte(1); d <= 3; d++ {
+			r.device(d, config.DevCmdNoteOn, played[d])
+		}
+		r.run(4000 * notes.TicksPerMs)
+		r.check(0)
+		width := window[1] - window[0]
+		for d := 1; d <= 3; d++ {
+			if lo[d] < window[0] || hi[d] > window[1] {
+				t.Errorf("window %v: note %d went over %d..%d", window, played[d], lo[d], hi[d])
+			}
+			if got, want := hi[d]-lo[d], width/share[d]; got < want-1 || got > want+1 {
+				t.Errorf("window %v: note %d covered %d positions, want %d", window, played[d], got, want)
+			}
+		}
+	}
+}
+
+// TestResetTravel narrows drives' travel windows, lets the heads settle in
+// them and resets: the heads home to the end stop and the next notes
+// bounce across the whole physical travel again, one drive reset alone and
+// the rest all at once.
+func TestResetTravel(t *testing.T) {
+	if config.ShiftRegister {
+		t.Skip("step lines go through the shift register")
+	}
+	r := newRig(t)
+	var lo, hi [config.NumDrives + 1]int
+	hal.OnChange = func(p hal.Pin, high bool) {
+		r.model.Pin(p, high)
+		for d := 1; d <= config.NumDrives; d++ {
+			lo[d] = min(lo[d], r.model.Position[d])
+			hi[d] = max(hi[d], r.model.Position[d])
+		}
+	}
+	play := func() {
+		for d := byte(1); d <= config.NumDrives; d++ {
+			r.device(d, config.DevCmdNoteOn, instruments.MaxFloppyNote)
+		}
+		r.run(3000 * notes.TicksPerMs)
+	}
+	r.device(0, config.DevCmdSetTravel, 100, 120)
+	play()
+	for d := 1; d <= config.NumDrives; d++ {
+		if pos := r.model.Position[d]; pos < 100 || pos > 120 {
+			t.Fatalf("drive %d at %d, outside its window", d, pos)
+		}
+	}
+	r.device(0, config.DevCmdNoteOff)
+	r.rehome(1, 0)
+	// Like re-homing, the reset pushes heads at the stop on purpose.
+	r.device(0, config.DevCmdReset)
+	r.model.Overtravel = nil
+	r.check(0)
+	for d := 1; d <= config.NumDrives; d++ {
+		if pos := r.model.Position[d]; pos != 0 {
+			t.Errorf("drive %d homed to %d", d, pos)
+		}
+		lo[d], hi[d] = 0, 0
+	}
+	play()
+	r.check(0)
+	for d := byte(1); d <= config.NumDrives; d++ {
+		if lo[d] != 0 || hi[d] != config.MaxPosition {
+			t.Errorf("drive %d bounced over %d..%d after the reset", d, lo[d], hi[d])
+		}
+		if c := r.drives.DriveConfig(d, nil); c[len(c)-2] != 0 || c[len(c)-1] != config.MaxPosition {
+			t.Errorf("drive %d reports travel %d..%d after the reset", d, c[len(c)-2], c[len(c)-1])
+		}
+	}
+}
@@ -0,0 +1,26 @@
+//go:build tinygo
+
+// Buzzer plays Moppy songs on piezo buzzers instead of floppy drives, to
+// try the firmware on a bare board. The voices are board-specific; see
+// voices_*.go.
+//
+// Flash with: tinygo flash -target=arduino ./examples/buzzer
+// (or -target=pico).
+package main
+
+import (
+	"github.com/ystepanoff/goppy/firmware/instruments"
+	"github.com/ystepanoff/goppy/firmware/networks"
+)
+
+func main() {
+	buzzer := instruments.NewBuzzer(voices()...)
+	buzzer.Setup()
+
+	serial := networks.NewSerial(buzzer)
+	serial.Begin()
+
+	for {
+		serial.ReadMessages()
+	}
+}
@@ -0,0 +1,19 @@
+//go:build rp2040
+
+package main
+
+import (
+	"machine"
+
+	"github.com/ystepanoff/goppy/firmware/instruments"
+)
+
+// voices returns four voices on separate PWM slices, GPIO 0, 2, 4 and 6.
+func voices() []instruments.BuzzerVoice {
+	return []instruments.BuzzerVoice{
+		{PWM: machine.PWM0, Pin: machine.GPIO0},
+		{PWM: machine.PWM1, Pin: machine.GPIO2},
+		{PWM: machine.PWM2, Pin: machine.GPIO4},
+		{PWM: machine.PWM3, Pin: machine.GPIO6},
+	}
+}
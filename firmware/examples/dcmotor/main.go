@@ -0,0 +1,40 @@
+//go:build tinygo
+
+// DCMotor sings Moppy songs on brushed DC motors, whining at the PWM
+// carrier. The motors are board-specific; see motors_*.go.
+//
+// Wiring, per motor, with an L298N:
+//
+//	board PWM pin -> ENA    (the motor's PWM output, see motors_*.go)
+//	5V            -> IN1    (fixed direction)
+//	GND           -> IN2
+//	OUT1, OUT2    -> motor
+//	+12V / GND    -> motor supply, GND shared with the board
+//
+// Remove the ENA jumper so the pin drives it. Small 3-12V motors with the
+// gearbox removed sing best; clamp the shaft or load it lightly if it
+// creeps. config.DCMotorDutyPercent sets loudness against speed and heat.
+//
+// Flash with: tinygo flash -target=arduino ./examples/dcmotor
+// (or -target=pico).
+package main
+
+import (
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/instruments"
+	"github.com/ystepanoff/goppy/firmware/networks"
+)
+
+func main() {
+	motor := instruments.NewDCMotor(motors()...)
+	motor.Setup()
+
+	instruments.InitTimer(config.TimerResolution, motor.Tick)
+
+	serial := networks.NewSerial(motor)
+	serial.Begin()
+
+	for {
+		serial.ReadMessages()
+	}
+}
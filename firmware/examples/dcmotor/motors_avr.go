@@ -0,0 +1,18 @@
+//go:build avr
+
+package main
+
+import (
+	"machine"
+
+	"github.com/ystepanoff/goppy/firmware/instruments"
+)
+
+// motors returns the Uno's one free PWM output: Timer1 drives the tick and
+// the runtime needs Timer0, leaving Timer2 on pin 3. Every sub address
+// shares it.
+func motors() []instruments.BuzzerVoice {
+	return []instruments.BuzzerVoice{
+		{PWM: machine.Timer2, Pin: machine.Pin(3)},
+	}
+}
@@ -0,0 +1,17 @@
+//go:build rp2040
+
+package main
+
+import (
+	"machine"
+
+	"github.com/ystepanoff/goppy/firmware/instruments"
+)
+
+// motors returns two motors on separate PWM slices, GPIO 0 and 2.
+func motors() []instruments.BuzzerVoice {
+	return []instruments.BuzzerVoice{
+		{PWM: machine.PWM0, Pin: machine.GPIO0},
+		{PWM: machine.PWM1, Pin: machine.GPIO2},
+	}
+}
@@ -0,0 +1,83 @@
+//go:build tinygo
+
+// Sensorplay plays a floppy drive from a light sensor instead of Moppy
+// messages, driving FloppyDrives directly with no networks package.
+//
+// Wire a photoresistor and a 10k resistor as a divider into A0. Darkness
+// is silence; more light plays higher, from C3 up to the top floppy note.
+// Small changes in light bend the sounding note, so the pitch slides
+// smoothly, and a new note only starts once the light has moved further
+// than the drive's bend range.
+//
+// Flash with: tinygo flash -target=arduino ./examples/sensorplay
+package main
+
+import (
+	"machine"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/instruments"
+)
+
+const (
+	drive     = 1
+	sensorPin = machine.ADC0
+
+	lowNote  = 48 // C3
+	highNote = instruments.MaxFloppyNote
+
+	// darkLevel is the ADC reading (0..65535) below which the drive is silent.
+	darkLevel = 0x1000
+
+	pollInterval = 20 * time.Millisecond
+)
+
+func main() {
+	floppy := instruments.NewFloppyDrives()
+	floppy.Setup()
+	instruments.InitTimer(config.TimerResolution, floppy.Tick)
+
+	machine.InitADC()
+	sensor := machine.ADC{Pin: sensorPin}
+	sensor.Configure(machine.ADCConfig{})
+
+	var note byte // sounding note, 0 when silent
+	for {
+		level := sensor.Get()
+		switch {
+		case level < darkLevel:
+			if note != 0 {
+				floppy.StopNote(drive)
+				note = 0
+			}
+		case note != 0 && inBendRange(pitch(level), note):
+			floppy.Bend(drive, bendTo(pitch(level), note))
+		default:
+			note = byte((pitch(level) + 128) >> 8)
+			if floppy.PlayNote(drive, note) != nil {
+				note = 0
+			}
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// pitch maps a light level from darkLevel up to lowNote..highNote, in
+// 1/256ths of a semitone.
+func pitch(level uint16) int32 {
+	span := uint32(highNote-lowNote) << 8
+	return lowNote<<8 + int32(uint32(level-darkLevel)*span/(0x10000-darkLevel))
+}
+
+// inBendRange reports whether p can be reached by bending note.
+func inBendRange(p int32, note byte) bool {
+	off := p - int32(note)<<8
+	return off > -config.DefaultBendRange<<8 && off < config.DefaultBendRange<<8
+}
+
+// bendTo returns the MIDI pitch bend value that bends note to p.
+func bendTo(p int32, note byte) uint16 {
+	off := p - int32(note)<<8
+	return uint16(8192 + off*8192/(config.DefaultBendRange<<8))
+}
@@ -0,0 +1,141 @@
+//go:build !tinygo
+
+// Package fakeclock is a hal.Ticker for tests: a clock that only moves
+// when the test moves it, running every tick and scheduled callback that
+// falls due on the way, in order, on the test's goroutine. Anything the
+// firmware does on a timer - parking, watchdogs, reset sweeps, tremolo,
+// the startup tune - then happens at the same tick on every run.
+//
+// The pattern for a time-driven feature is to give the instrument the
+// clock, tick it from the clock, and advance:
+//
+//	clock := fakeclock.New()
+//	drives := instruments.NewFloppyDrives()
+//	drives.SetTicker(clock)
+//	clock.Start(config.TimerResolution, drives.Tick)
+//
+//	drives.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{57})
+//	clock.AdvanceMs(config.LinkWatchdogMs)
+//	// ... assert on what the drives did by now
+//
+// Code that blocks, such as ResetAll, waits on the clock's Sleep, which
+// advances it; At schedules a callback for a moment during such a wait,
+// to send a message or look at the state midway.
+package fakeclock
+
+import (
+	"sort"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/hal"
+)
+
+// Clock is a manually advanced hal.Ticker. Its time starts at 0. The
+// zero Clock is ready to use; it isn't safe for concurrent use.
+type Clock struct {
+	now      time.Duration
+	interval time.Duration // 0 until Start
+	tick     func()
+	nextTick time.Duration
+	ticks    uint64
+
+	scheduled []event // in time order
+}
+
+// event is a callback scheduled with At.
+type event struct {
+	at time.Duration
+	f  func()
+}
+
+// New returns a Clock at time 0 with nothing to tick.
+func New() *Clock {
+	return &Clock{}
+}
+
+// Start has tick run every microseconds µs of clock time, the first one
+// interval from now, replacing any callback started before. tick runs
+// with interrupts held off, as on the board.
+func (c *Clock) Start(microseconds uint32, tick func()) {
+	c.interval = time.Duration(microseconds) * time.Microsecond
+	c.tick = tick
+	c.nextTick = c.now + c.interval
+}
+
+// Sleep advances the clock by d, standing in for a blocking wait.
+func (c *Clock) Sleep(d time.Duration) {
+	c.Advance(d)
+}
+
+// At schedules f to run once the clock reaches at, between ticks; at a
+// tick's own time, the tick runs first. Callbacks due at the same time run
+// in the order they were scheduled. f may advance the clock itself.
+func (c *Clock) At(at time.Duration, f func()) {
+	i := sort.Search(len(c.scheduled), func(i int) bool { return c.scheduled[i].at > at })
+	c.scheduled = append(c.scheduled, event{})
+	copy(c.scheduled[i+1:], c.scheduled[i:])
+	c.scheduled[i] = event{at: at, f: f}
+}
+
+// After schedules f to run d from now, as At does.
+func (c *Clock) After(d time.Duration, f func()) {
+	c.At(c.now+d, f)
+}
+
+// Advance moves the clock forward by d, running every tick and scheduled
+// callback due up to and including the new time.
+func (c *Clock) Advance(d time.Duration) {
+	c.advanceTo(c.now + d)
+}
+
+// AdvanceTicks moves the clock forward to the n-th tick from now, running
+// it and everything due before it. Without a tick started, it does
+// nothing.
+func (c *Clock) AdvanceTicks(n int) {
+	if c.tick == nil || n <= 0 {
+		return
+	}
+	c.advanceTo(c.nextTick + time.Duration(n-1)*c.interval)
+}
+
+// AdvanceMs moves the clock forward by ms milliseconds, as Advance does.
+func (c *Clock) AdvanceMs(ms int) {
+	c.Advance(time.Duration(ms) * time.Millisecond)
+}
+
+// Now returns the clock's time.
+func (c *Clock) Now() time.Duration {
+	return c.now
+}
+
+// Ticks returns how many ticks have run.
+func (c *Clock) Ticks() uint64 {
+	return c.ticks
+}
+
+// advanceTo runs everything due up to target, in time order, and leaves
+// the clock at target. A callback that advances the clock further moves
+// it past target; the clock doesn't go back.
+func (c *Clock) advanceTo(target time.Duration) {
+	for {
+		tickDue := c.tick != nil && c.nextTick <= target
+		eventDue := len(c.scheduled) > 0 && c.scheduled[0].at <= target
+		switch {
+		case tickDue && (!eventDue || c.nextTick <= c.scheduled[0].at):
+			c.now = max(c.now, c.nextTick)
+			c.nextTick += c.interval
+			c.ticks++
+			state := hal.DisableInterrupts()
+			c.tick()
+			hal.RestoreInterrupts(state)
+		case eventDue:
+			e := c.scheduled[0]
+			c.scheduled = c.scheduled[1:]
+			c.now = max(c.now, e.at)
+			e.f()
+		default:
+			c.now = max(c.now, target)
+			return
+		}
+	}
+}
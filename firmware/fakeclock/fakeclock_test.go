@@ -0,0 +1,96 @@
+//go:build !tinygo
+
+package fakeclock_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/fakeclock"
+)
+
+const us = time.Microsecond
+
+func TestAdvanceRunsDueTicks(t *testing.T) {
+	c := fakeclock.New()
+	var at []time.Duration
+	c.Start(40, func() { at = append(at, c.Now()) })
+
+	c.Advance(100 * us)
+	if want := []time.Duration{40 * us, 80 * us}; !reflect.DeepEqual(at, want) {
+		t.Fatalf("ticks at %v, want %v", at, want)
+	}
+	if c.Now() != 100*us {
+		t.Errorf("Now = %v, want 100µs", c.Now())
+	}
+
+	c.AdvanceTicks(3)
+	if c.Now() != 200*us || c.Ticks() != 5 {
+		t.Errorf("after AdvanceTicks(3): Now = %v, Ticks = %d, want 200µs and 5", c.Now(), c.Ticks())
+	}
+
+	c.AdvanceMs(1)
+	if c.Ticks() != 30 {
+		t.Errorf("after AdvanceMs(1): Ticks = %d, want 30", c.Ticks())
+	}
+}
+
+func TestAdvanceWithoutStart(t *testing.T) {
+	c := fakeclock.New()
+	c.AdvanceTicks(10)
+	if c.Now() != 0 {
+		t.Errorf("AdvanceTicks with nothing started moved the clock to %v", c.Now())
+	}
+	c.AdvanceMs(5)
+	if c.Now() != 5*time.Millisecond || c.Ticks() != 0 {
+		t.Errorf("Now = %v, Ticks = %d, want 5ms and 0", c.Now(), c.Ticks())
+	}
+}
+
+func TestOrder(t *testing.T) {
+	c := fakeclock.New()
+	var got []string
+	log := func(what string) func() {
+		return func() { got = append(got, fmt.Sprintf("%s@%v", what, c.Now())) }
+	}
+	c.Start(40, log("tick"))
+	c.At(80*us, log("b"))
+	c.At(50*us, log("a"))
+	c.At(80*us, log("c"))
+	c.After(120*us, log("d"))
+
+	c.Advance(120 * us)
+	want := []string{"tick@40µs", "a@50µs", "tick@80µs", "b@80µs", "c@80µs", "tick@120µs", "d@120µs"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ran %v\nwant %v", got, want)
+	}
+}
+
+// A callback that sleeps, as a message handler starting ResetAll would,
+// runs the ticks in its sleep and leaves the clock after it.
+func TestSleepInCallback(t *testing.T) {
+	c := fakeclock.New()
+	c.Start(40, func() {})
+	c.At(100*us, func() { c.Sleep(time.Millisecond) })
+	c.Advance(200 * us)
+	if c.Now() != 1100*us {
+		t.Errorf("Now = %v, want 1.1ms", c.Now())
+	}
+	if c.Ticks() != 27 {
+		t.Errorf("Ticks = %d, want 27", c.Ticks())
+	}
+}
+
+func TestStartReplaces(t *testing.T) {
+	c := fakeclock.New()
+	var first, second int
+	c.Start(40, func() { first++ })
+	c.AdvanceTicks(2)
+	c.Start(100, func() { second++ })
+	c.Advance(300 * us)
+	if first != 2 || second != 3 {
+		t.Errorf("first ticked %d times, second %d, want 2 and 3", first, second)
+	}
+}
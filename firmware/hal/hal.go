@@ -0,0 +1,19 @@
+// Package hal is the slice of TinyGo's machine package the instruments
+// use: pins, PWM and SPI configuration, and interrupt masking. Under
+// TinyGo it aliases machine; elsewhere it simulates the pins in memory, so
+// the instruments build and run in host tests and simulators.
+package hal
+
+import "time"
+
+// Ticker is a source of timer ticks and of the time blocking code waits
+// out between them. Real builds use the board's timer (see
+// instruments.HardwareTicker); tests use a fakeclock.Clock, which moves
+// only when told to, so time-driven behaviour runs the same every time.
+type Ticker interface {
+	// Start calls tick every microseconds µs from then on, with
+	// interrupts held off, replacing any callback started before.
+	Start(microseconds uint32, tick func())
+	// Sleep blocks for d while the ticks carry on.
+	Sleep(d time.Duration)
+}
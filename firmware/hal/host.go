@@ -0,0 +1,114 @@
+//go:build !tinygo
+
+package hal
+
+import "sync"
+
+// Pin is a simulated pin. Its level is kept in memory, and every change
+// is passed to OnChange, so host tests and simulators can watch the
+// instruments drive their outputs.
+type Pin uint8
+
+// PinMode is a pin's direction and pull.
+type PinMode uint8
+
+// Pin modes.
+const (
+	PinOutput PinMode = iota
+	PinInput
+	PinInputPullup
+)
+
+// PinConfig configures a pin.
+type PinConfig struct {
+	Mode PinMode
+}
+
+// PWMConfig configures a PWM peripheral.
+type PWMConfig struct {
+	Period uint64
+}
+
+// SPIConfig configures an SPI bus.
+type SPIConfig struct {
+	Frequency uint32
+	SCK       Pin
+	SDO       Pin
+	SDI       Pin
+	LSBFirst  bool
+	Mode      uint8
+}
+
+// levels holds every simulated pin's level.
+var levels [256]bool
+
+// OnChange, if set, is called whenever a pin's level changes.
+var OnChange func(p Pin, high bool)
+
+// Configure sets a pin up. An input with a pull-up reads high.
+func (p Pin) Configure(config PinConfig) {
+	if config.Mode == PinInputPullup {
+		levels[p] = true
+	}
+}
+
+// High drives a pin high.
+func (p Pin) High() { p.Set(true) }
+
+// Low drives a pin low.
+func (p Pin) Low() { p.Set(false) }
+
+// Set drives a pin to a level.
+func (p Pin) Set(high bool) {
+	if levels[p] == high {
+		return
+	}
+	levels[p] = high
+	if OnChange != nil {
+		OnChange(p, high)
+	}
+}
+
+// Get returns a pin's level.
+func (p Pin) Get() bool { return levels[p] }
+
+// SPI is a simulated SPI bus that records what is sent.
+type SPI struct {
+	// Sent holds every byte transferred since the last Reset.
+	Sent []byte
+}
+
+// SPI0 is the simulated hardware SPI.
+var SPI0 = &SPI{}
+
+// Configure does nothing.
+func (s *SPI) Configure(config SPIConfig) error { return nil }
+
+// Transfer records b and reads back 0.
+func (s *SPI) Transfer(b byte) (byte, error) {
+	s.Sent = append(s.Sent, b)
+	return 0, nil
+}
+
+// Reset forgets what was sent.
+func (s *SPI) Reset() { s.Sent = s.Sent[:0] }
+
+// InterruptState is what DisableInterrupts returns for RestoreInterrupts.
+type InterruptState uintptr
+
+// interrupts stands in for the interrupt mask. The host timer (see
+// instruments.InitTimer) holds it while its callback runs, as the board
+// runs an interrupt handler with interrupts off, so main loop code that
+// holds interrupts off excludes the timer here too.
+var interrupts sync.Mutex
+
+// DisableInterrupts holds off the host timer until RestoreInterrupts.
+// Unlike on the board, it doesn't nest: code already holding interrupts
+// off, including the timer's callback, must not call it again.
+func DisableInterrupts() InterruptState {
+	interrupts.Lock()
+	return 0
+}
+
+// RestoreInterrupts undoes the DisableInterrupts that returned state.
+func RestoreInterrupts(state InterruptState) { interrupts.Unlock() }
@@ -0,0 +1,41 @@
+//go:build tinygo
+
+package hal
+
+import (
+	"machine"
+	"runtime/interrupt"
+)
+
+// Pin types, aliases for the machine package's under TinyGo, so values
+// from machine and hal mix freely.
+type (
+	Pin       = machine.Pin
+	PinMode   = machine.PinMode
+	PinConfig = machine.PinConfig
+	PWMConfig = machine.PWMConfig
+	SPIConfig = machine.SPIConfig
+)
+
+// Pin modes.
+const (
+	PinOutput      = machine.PinOutput
+	PinInput       = machine.PinInput
+	PinInputPullup = machine.PinInputPullup
+)
+
+// SPI0 is the board's hardware SPI.
+var SPI0 = machine.SPI0
+
+// InterruptState is what DisableInterrupts returns for RestoreInterrupts.
+type InterruptState = interrupt.State
+
+// DisableInterrupts holds off interrupts until RestoreInterrupts.
+func DisableInterrupts() InterruptState {
+	return interrupt.Disable()
+}
+
+// RestoreInterrupts undoes the DisableInterrupts that returned state.
+func RestoreInterrupts(state InterruptState) {
+	interrupt.Restore(state)
+}
@@ -0,0 +1,105 @@
+//go:build !tinygo
+
+package instruments
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ystepanoff/goppy/firmware/benchtest"
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/hal"
+)
+
+// Effects layered on the sounding notes in the Tick benchmarks.
+const (
+	plain = iota
+	vibrato
+	tremolo
+)
+
+var effectNames = [...]string{"plain", "vibrato", "tremolo"}
+
+// playing returns drives with n notes sounding under effect, and the
+// heads already moving, as they would be mid-song.
+func playing(n int, effect int) *FloppyDrives {
+	fd := NewFloppyDrives()
+	for d := byte(1); d <= byte(n); d++ {
+		fd.HandleDeviceMessage(d, config.DevCmdNoteOn, []byte{48 + 3*d, 64})
+		switch effect {
+		case vibrato:
+			fd.HandleDeviceMessage(d, config.DevCmdChannelPressure, []byte{100})
+		case tremolo:
+			fd.HandleDeviceMessage(d, config.DevCmdTremolo, []byte{8, 50})
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		fd.Tick()
+	}
+	return fd
+}
+
+func BenchmarkTick(b *testing.B) {
+	for _, n := range []int{1, 4, 8} {
+		if n > config.NumDrives {
+			continue
+		}
+		for effect, name := range effectNames {
+			b.Run(fmt.Sprintf("%dnotes/%s", n, name), func(b *testing.B) {
+				fd := playing(n, effect)
+				b.ReportAllocs()
+				for b.Loop() {
+					fd.Tick()
+				}
+				benchtest.ReportAVR(b, benchtest.TickBudget)
+			})
+		}
+	}
+}
+
+// fillChain sets every drive's lines in the chain, as a busy Tick would,
+// and latches them.
+func fillChain(c *shiftChain, phase bool) {
+	for d := byte(firstDrive); d <= lastDrive; d++ {
+		c.set(stepBit(d), phase)
+		c.set(dirBit(d), !phase)
+	}
+	c.latch()
+	hal.SPI0.Reset()
+}
+
+func BenchmarkShiftChain(b *testing.B) {
+	var c shiftChain
+	phase := false
+	b.ReportAllocs()
+	for b.Loop() {
+		fillChain(&c, phase)
+		phase = !phase
+	}
+	benchtest.ReportAVR(b, benchtest.TickBudget)
+}
+
+func TestHotPathAllocs(t *testing.T) {
+	for _, n := range []int{1, 4, 8} {
+		if n > config.NumDrives {
+			continue
+		}
+		for effect, name := range effectNames {
+			fd := playing(n, effect)
+			if allocs := testing.AllocsPerRun(1000, fd.Tick); allocs != 0 {
+				t.Errorf("Tick with %d notes, %s: %v allocs, want 0", n, name, allocs)
+			}
+		}
+	}
+
+	var c shiftChain
+	fillChain(&c, true) // let SPI0's record grow once
+	phase := false
+	allocs := testing.AllocsPerRun(1000, func() {
+		fillChain(&c, phase)
+		phase = !phase
+	})
+	if allocs != 0 {
+		t.Errorf("shift chain: %v allocs, want 0", allocs)
+	}
+}
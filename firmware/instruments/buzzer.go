@@ -0,0 +1,237 @@
+package instruments
+
+import (
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/hal"
+	"github.com/ystepanoff/goppy/firmware/notes"
+)
+
+// PWM is the part of a machine PWM peripheral (such as machine.Timer2 on
+// AVR or machine.PWM0 on RP2040) that Buzzer uses.
+type PWM interface {
+	Configure(config hal.PWMConfig) error
+	Channel(pin hal.Pin) (uint8, error)
+	Set(channel uint8, value uint32)
+	SetPeriod(period uint64) error
+	Top() uint32
+}
+
+// BuzzerVoice is one independent tone generator: a PWM peripheral and the
+// pin the buzzer hangs off. Every channel of a peripheral shares its
+// period, so give each voice a peripheral of its own.
+type BuzzerVoice struct {
+	PWM PWM
+	Pin hal.Pin
+}
+
+// Buzzer plays square waves on piezo buzzers or small speakers through PWM
+// peripherals, so the firmware can be heard on a board with no drives.
+// Sub addresses 1..config.NumBuzzers map onto the voices round-robin;
+// sub addresses sharing a voice take turns, the latest note-on winning.
+// The hardware makes the tone, so Buzzer needs no Tick. Its methods hold
+// interrupts off while they reprogram a voice: an interrupt between a new
+// period and its duty would leave the old duty against the new period,
+// stuck on or off, for as long as the interrupt runs.
+type Buzzer struct {
+	// Stats counts ignored messages. Only ever incremented.
+	Stats Stats
+
+	voices   []BuzzerVoice
+	channels []uint8
+
+	// owner is the sub address each voice is sounding for, 0 if silent.
+	owner []byte
+
+	// note and bend are each sub address's note (0 = none) and pitch bend
+	// deflection.
+	note [config.NumBuzzers + 1]byte
+	bend [config.NumBuzzers + 1]int16
+}
+
+// NewBuzzer creates a Buzzer playing through voices.
+func NewBuzzer(voices ...BuzzerVoice) *Buzzer {
+	return &Buzzer{
+		voices:   voices,
+		channels: make([]uint8, len(voices)),
+		owner:    make([]byte, len(voices)),
+	}
+}
+
+// Setup configures each voice's PWM peripheral and pin, silent. Voices
+// whose pin their peripheral can't drive are left silent for good.
+func (b *Buzzer) Setup() {
+	for i, v := range b.voices {
+		v.PWM.Configure(hal.PWMConfig{})
+		ch, err := v.PWM.Channel(v.Pin)
+		if err != nil {
+			b.voices[i].PWM = nil
+			continue
+		}
+		b.channels[i] = ch
+		v.PWM.Set(ch, 0)
+	}
+}
+
+// voice returns the voice index sub address sub plays on.
+func (b *Buzzer) voice(sub byte) int {
+	return int(sub-1) % len(b.voices)
+}
+
+// PlayNote sounds a note on a sub address's voice, taking the voice over
+// from any other sub address. Returns ErrNoDrive for a sub address outside
+// 1..config.NumBuzzers and ErrBadNote for a note above 127.
+func (b *Buzzer) PlayNote(sub, note byte) error {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	return b.playNote(sub, note)
+}
+
+// playNote is PlayNote with interrupts held off.
+func (b *Buzzer) playNote(sub, note byte) error {
+	if sub < 1 || sub > config.NumBuzzers || len(b.voices) == 0 {
+		return ErrNoDrive
+	}
+	if note > 127 {
+		return ErrBadNote
+	}
+	b.note[sub] = note
+	b.bend[sub] = 0
+	b.owner[b.voice(sub)] = sub
+	b.sound(sub)
+	return nil
+}
+
+// StopNote silences a sub address, and its voice if it holds it.
+func (b *Buzzer) StopNote(sub byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	b.stopNote(sub)
+}
+
+// stopNote is StopNote with interrupts held off.
+func (b *Buzzer) stopNote(sub byte) {
+	if sub < 1 || sub > config.NumBuzzers || len(b.voices) == 0 {
+		return
+	}
+	b.note[sub] = 0
+	v := b.voice(sub)
+	if b.owner[v] != sub {
+		return
+	}
+	b.owner[v] = 0
+	if b.voices[v].PWM != nil {
+		b.voices[v].PWM.Set(b.channels[v], 0)
+	}
+}
+
+// StopAll silences every voice.
+func (b *Buzzer) StopAll() {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	b.stopAll()
+}
+
+// stopAll is StopAll with interrupts held off.
+func (b *Buzzer) stopAll() {
+	for sub := byte(1); sub <= config.NumBuzzers; sub++ {
+		b.stopNote(sub)
+	}
+}
+
+// Bend bends a sub address's note by a 14-bit MIDI pitch bend value
+// (0..16383, 8192 = unbent) across config.DefaultBendRange semitones.
+func (b *Buzzer) Bend(sub byte, bend uint16) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	b.bendNote(sub, bend)
+}
+
+// bendNote is Bend with interrupts held off.
+func (b *Buzzer) bendNote(sub byte, bend uint16) {
+	if sub < 1 || sub > config.NumBuzzers || len(b.voices) == 0 {
+		return
+	}
+	if bend > 0x3FFF {
+		bend = 0x3FFF
+	}
+	b.bend[sub] = int16(bend) - 8192
+	if b.owner[b.voice(sub)] == sub {
+		b.sound(sub)
+	}
+}
+
+// sound sets a sub address's voice to its bent note at 50% duty. A period
+// the peripheral can't produce silences the voice.
+func (b *Buzzer) sound(sub byte) {
+	v := b.voice(sub)
+	pwm := b.voices[v].PWM
+	if pwm == nil {
+		return
+	}
+	if err := pwm.SetPeriod(BuzzerPeriod(b.note[sub], b.bend[sub], config.DefaultBendRange)); err != nil {
+		pwm.Set(b.channels[v], 0)
+		return
+	}
+	pwm.Set(b.channels[v], pwm.Top()/2)
+}
+
+// BuzzerPeriod returns the period in nanoseconds of a note bent by a
+// signed deflection (-8192..8191), where full deflection reaches
+// rangeSemitones. It works from notes.NotePeriods rather than the tick
+// tables, so it keeps the full microsecond resolution.
+func BuzzerPeriod(note byte, deflection int16, rangeSemitones byte) uint64 {
+	p := uint64(notes.NotePeriods[note&0x7F]) * 1000
+	if deflection == 0 {
+		return p
+	}
+	cents := int32(deflection) * int32(rangeSemitones) * 100 / 8192
+	return (p*uint64(notes.SemitoneRatioQ16(int16(-cents))) + 0x8000) >> 16
+}
+
+// HandleSystemMessage processes system-wide commands (address 0x00).
+func (b *Buzzer) HandleSystemMessage(command byte, payload []byte) {
+	switch command {
+	case config.CmdReset, config.CmdSequenceStop:
+		b.StopAll()
+	}
+}
+
+// HandleDeviceMessage processes commands for one sub address. A NoteOff
+// or Reset to sub address 0x00 silences everything. Unknown commands and
+// unusable payloads are counted in Stats and dropped.
+func (b *Buzzer) HandleDeviceMessage(subAddress byte, command byte, payload []byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	switch command {
+	case config.DevCmdNoteOn:
+		if len(payload) < 1 || payload[0] > 127 {
+			b.Stats.InvalidPayloads++
+			return
+		}
+		b.playNote(subAddress, payload[0])
+	case config.DevCmdNoteOff, config.DevCmdReset:
+		if subAddress == 0x00 {
+			b.stopAll()
+			return
+		}
+		if subAddress > config.NumBuzzers {
+			return
+		}
+		if command == config.DevCmdNoteOff && len(payload) > 0 && payload[0] != b.note[subAddress] {
+			return
+		}
+		b.stopNote(subAddress)
+	case config.DevCmdBendPitch:
+		if len(payload) < 2 {
+			b.Stats.InvalidPayloads++
+			return
+		}
+		bend := int32(int16(payload[0])<<8|int16(payload[1])) + 8192
+		if bend < 0 {
+			bend = 0
+		}
+		b.bendNote(subAddress, uint16(bend))
+	default:
+		b.Stats.UnknownCommands++
+	}
+}
@@ -0,0 +1,128 @@
+//go:build !tinygo
+
+package instruments
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/hal"
+	"github.com/ystepanoff/goppy/firmware/notes"
+)
+
+// fakePWM is a PWM peripheral that keeps its settings for the test to
+// read. Its top is period/1000, so a duty reads back in microseconds.
+type fakePWM struct {
+	period uint64
+	duty   map[uint8]uint32
+	// max is the longest period it can produce, 0 for no limit.
+	max uint64
+	// log records every SetPeriod and Set, in order.
+	log []string
+}
+
+func (p *fakePWM) Configure(config hal.PWMConfig) error {
+	p.period = config.Period
+	p.duty = map[uint8]uint32{}
+	return nil
+}
+
+func (p *fakePWM) Channel(pin hal.Pin) (uint8, error) { return uint8(pin) % 2, nil }
+
+func (p *fakePWM) Set(channel uint8, value uint32) {
+	p.duty[channel] = value
+	p.log = append(p.log, fmt.Sprintf("set %d %d", channel, value))
+}
+
+func (p *fakePWM) SetPeriod(period uint64) error {
+	if p.max != 0 && period > p.max {
+		return errors.New("period out of range")
+	}
+	p.period = period
+	p.log = append(p.log, fmt.Sprintf("period %d", period))
+	return nil
+}
+
+func (p *fakePWM) Top() uint32 { return uint32(p.period / 1000) }
+
+// within reports whether got is within permille thousandths of want.
+func within(got, want uint64, permille uint64) bool {
+	diff := max(got, want) - min(got, want)
+	return diff*1000 <= want*permille
+}
+
+// TestBuzzerBend plays a note and bends it fully either way: the period
+// lands on the note DefaultBendRange semitones away, at 50% duty, and a
+// centred bend puts it back exactly.
+func TestBuzzerBend(t *testing.T) {
+	pwm := &fakePWM{}
+	b := NewBuzzer(BuzzerVoice{PWM: pwm, Pin: 2})
+	b.Setup()
+	const note = 69
+	b.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{note})
+	if want := uint64(notes.NotePeriods[note]) * 1000; pwm.period != want {
+		t.Fatalf("period %dns, want %dns", pwm.period, want)
+	}
+	for _, c := range []struct {
+		name    string
+		payload []byte
+		note    byte
+	}{
+		{"full up", []byte{0x1F, 0xFF}, note + config.DefaultBendRange},
+		{"full down", []byte{0xE0, 0x00}, note - config.DefaultBendRange},
+		{"centre", []byte{0, 0}, note},
+	} {
+		b.HandleDeviceMessage(1, config.DevCmdBendPitch, c.payload)
+		want := uint64(notes.NotePeriods[c.note]) * 1000
+		if !within(pwm.period, want, 2) {
+			t.Errorf("%s: period %dns, want about %dns", c.name, pwm.period, want)
+		}
+		if duty := pwm.duty[0]; duty != pwm.Top()/2 {
+			t.Errorf("%s: duty %d, want %d", c.name, duty, pwm.Top()/2)
+		}
+	}
+	if want := uint64(notes.NotePeriods[note]) * 1000; pwm.period != want {
+		t.Errorf("period %dns after centring, want %dns", pwm.period, want)
+	}
+}
+
+// TestBuzzerVoices shares one voice between two sub addresses: the latest
+// note-on wins, the loser's note-off leaves it sounding and the winner's
+// silences it. A period the peripheral can't produce silences it too.
+func TestBuzzerVoices(t *testing.T) {
+	pwm := &fakePWM{}
+	b := NewBuzzer(BuzzerVoice{PWM: pwm, Pin: 2})
+	b.Setup()
+	if err := b.PlayNote(1, 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.PlayNote(2, 72); err != nil {
+		t.Fatal(err)
+	}
+	if want := uint64(notes.NotePeriods[72]) * 1000; pwm.period != want {
+		t.Errorf("period %dns, want sub 2's %dns", pwm.period, want)
+	}
+	b.HandleDeviceMessage(1, config.DevCmdNoteOff, []byte{60})
+	if pwm.duty[0] == 0 {
+		t.Error("sub 1's note-off silenced sub 2")
+	}
+	b.HandleDeviceMessage(2, config.DevCmdNoteOff, []byte{72})
+	if pwm.duty[0] != 0 {
+		t.Errorf("duty %d after the note-off, want 0", pwm.duty[0])
+	}
+
+	pwm.max = uint64(notes.NotePeriods[60]) * 1000
+	b.PlayNote(1, 48)
+	if pwm.duty[0] != 0 {
+		t.Errorf("duty %d for a period out of range, want 0", pwm.duty[0])
+	}
+
+	if err := b.PlayNote(config.NumBuzzers+1, 60); err != ErrNoDrive {
+		t.Errorf("sub %d: %v, want ErrNoDrive", config.NumBuzzers+1, err)
+	}
+	if err := b.PlayNote(1, 128); err != ErrBadNote {
+		t.Errorf("note 128: %v, want ErrBadNote", err)
+	}
+}
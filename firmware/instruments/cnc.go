@@ -0,0 +1,378 @@
+package instruments
+
+import (
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/hal"
+	"github.com/ystepanoff/goppy/firmware/notes"
+)
+
+// CNC timing: ticks per homing toggle, and idle checks before release.
+const (
+	cncHomeTicks  = config.CNCHomeStepMs * notes.TicksPerMs / 2
+	cncHoldChecks = config.CNCHoldMs * notes.TicksPerMs / idleCheckTicks
+)
+
+// cncEnablePin is the CNC Shield's shared active-low ENABLE.
+const cncEnablePin = hal.Pin(8)
+
+// CNC Shield pins and travel limits per axis, X, Y, Z then A. An end stop
+// of 0 means the axis has no limit switch.
+var (
+	cncStepPins = [5]hal.Pin{0, 2, 3, 4, 12}
+	cncDirPins  = [5]hal.Pin{0, 5, 6, 7, 13}
+	cncEndStops = [5]hal.Pin{0, 9, 10, 11, 0}
+	cncTravel   = [5]uint16{0, config.CNCTravelXSteps, config.CNCTravelYSteps,
+		config.CNCTravelZSteps, config.CNCTravelASteps}
+)
+
+// The shield has four axes.
+var _ [4 - config.NumCNCAxes]struct{}
+
+// CNC plays notes on the axes of a 3D printer or CNC router through an
+// Arduino CNC Shield, as Stepper does on loose motors: the same start-up
+// ramp, config.StepperMaxNote and pitch bend. Sub addresses 1..
+// config.NumCNCAxes are the X, Y, Z and A axes.
+//
+// Each axis stays between home and its soft travel limit: a step that
+// would pass either end reverses the axis first, whatever the note or a
+// glissando asks, so the limits hold at any speed. Axes home on Setup and
+// on Reset, against their limit switches or blindly, in the background;
+// notes are refused until they are done. Once every axis is silent, a
+// SequenceStop included, the drivers hold position for config.CNCHoldMs
+// and are then de-energised. CNC needs Tick called from the timer
+// interrupt, directly or through a Router.
+type CNC struct {
+	// Stats counts ignored messages. Only ever incremented.
+	Stats Stats
+
+	// period is the current half-period in ticks (0 = silent) and tick
+	// counts towards it; target, ramp and rampDelta run the start-up ramp
+	// as in Stepper. unbent is the note's half-period before bend.
+	period    [config.NumCNCAxes + 1]uint16
+	tick      [config.NumCNCAxes + 1]uint16
+	target    [config.NumCNCAxes + 1]uint16
+	ramp      [config.NumCNCAxes + 1]byte
+	rampDelta [config.NumCNCAxes + 1]uint16
+	unbent    [config.NumCNCAxes + 1]uint16
+	note      [config.NumCNCAxes + 1]byte
+
+	// position is the axis position in steps from home; reverse is set
+	// while it moves towards home.
+	position  [config.NumCNCAxes + 1]uint16
+	reverse   [config.NumCNCAxes + 1]bool
+	stepState [config.NumCNCAxes + 1]bool
+
+	// Background homing: homeSteps is how many more steps the sweep may
+	// take, one toggle every cncHomeTicks.
+	homing        [config.NumCNCAxes + 1]bool
+	homeSteps     [config.NumCNCAxes + 1]uint16
+	homeCountdown [config.NumCNCAxes + 1]uint16
+
+	// Driver power: enabled is set while ENABLE is asserted; holdChecks
+	// counts idle checks with every axis silent.
+	enabled    bool
+	holdChecks uint16
+	ticks      uint16
+}
+
+// NewCNC creates a CNC instance for config.NumCNCAxes axes.
+func NewCNC() *CNC {
+	return &CNC{}
+}
+
+// Setup configures the shield's pins and starts homing every axis. Must
+// be called before Tick or message handling.
+func (c *CNC) Setup() {
+	for a := byte(1); a <= config.NumCNCAxes; a++ {
+		cncStepPins[a].Configure(hal.PinConfig{Mode: hal.PinOutput})
+		cncDirPins[a].Configure(hal.PinConfig{Mode: hal.PinOutput})
+		if c.hasEndStop(a) {
+			cncEndStops[a].Configure(hal.PinConfig{Mode: hal.PinInputPullup})
+		}
+	}
+	cncEnablePin.Configure(hal.PinConfig{Mode: hal.PinOutput})
+	c.setEnabled(false)
+	for a := byte(1); a <= config.NumCNCAxes; a++ {
+		c.startHoming(a)
+	}
+}
+
+// hasEndStop reports whether an axis has a limit switch.
+func (c *CNC) hasEndStop(axis byte) bool {
+	return config.CNCLimitSwitches && cncEndStops[axis] != 0
+}
+
+// Tick advances homing sweeps, steps every sounding axis whose
+// half-period is up and releases the drivers after the hold. Called by
+// the timer interrupt at TimerResolution intervals.
+func (c *CNC) Tick() {
+	silent := true
+	for a := 1; a <= config.NumCNCAxes; a++ {
+		if c.homing[a] {
+			silent = false
+			c.advanceHoming(a)
+			continue
+		}
+		if c.period[a] == 0 {
+			continue
+		}
+		silent = false
+		c.tick[a]++
+		if c.tick[a] < c.period[a] {
+			continue
+		}
+		c.tick[a] = 0
+		c.togglePin(a)
+		if c.ramp[a] > 0 {
+			c.ramp[a]--
+			if c.ramp[a] == 0 {
+				c.period[a] = c.target[a]
+			} else {
+				c.period[a] -= c.rampDelta[a]
+			}
+		}
+	}
+
+	c.ticks++
+	if c.ticks%idleCheckTicks != 0 {
+		return
+	}
+	if !silent || !c.enabled {
+		c.holdChecks = 0
+		return
+	}
+	c.holdChecks++
+	if c.holdChecks >= cncHoldChecks {
+		c.setEnabled(false)
+	}
+}
+
+// togglePin flips an axis's STEP pin. The driver steps on the rising
+// edge, so that is when the position moves - after reversing if the step
+// would take the axis past home or its travel limit.
+func (c *CNC) togglePin(a int) {
+	if !c.stepState[a] {
+		if c.reverse[a] && c.position[a] == 0 {
+			c.setDirection(a, false)
+		} else if !c.reverse[a] && c.position[a] >= cncTravel[a] {
+			c.setDirection(a, true)
+		}
+		if c.reverse[a] {
+			c.position[a]--
+		} else {
+			c.position[a]++
+		}
+	}
+	c.stepState[a] = !c.stepState[a]
+	cncStepPins[a].Set(c.stepState[a])
+}
+
+// setDirection sets an axis's direction (reverse = towards home).
+func (c *CNC) setDirection(a int, reverse bool) {
+	c.reverse[a] = reverse
+	cncDirPins[a].Set(reverse)
+}
+
+// setEnabled energises or de-energises every driver.
+func (c *CNC) setEnabled(on bool) {
+	c.enabled = on
+	c.holdChecks = 0
+	cncEnablePin.Set(!on)
+}
+
+// startHoming silences an axis and starts sweeping it back home.
+func (c *CNC) startHoming(axis byte) {
+	a := int(axis)
+	c.period[a] = 0
+	c.ramp[a] = 0
+	c.setDirection(a, true)
+	c.homeSteps[a] = cncTravel[a] + cncTravel[a]/8
+	c.homeCountdown[a] = cncHomeTicks
+	c.homing[a] = true
+	if !c.enabled {
+		c.setEnabled(true)
+	}
+}
+
+// advanceHoming takes the next homing step once its interval is up,
+// finishing at the switch or, without one, after a sweep of the whole
+// travel and an eighth more.
+func (c *CNC) advanceHoming(a int) {
+	c.homeCountdown[a]--
+	if c.homeCountdown[a] > 0 {
+		return
+	}
+	c.homeCountdown[a] = cncHomeTicks
+	atStop := c.hasEndStop(byte(a)) && !cncEndStops[a].Get()
+	if atStop || c.homeSteps[a] == 0 {
+		c.homing[a] = false
+		c.position[a] = 0
+		c.setDirection(a, false)
+		return
+	}
+	if !c.stepState[a] {
+		c.homeSteps[a]--
+	}
+	c.stepState[a] = !c.stepState[a]
+	cncStepPins[a].Set(c.stepState[a])
+}
+
+// PlayNote starts a note on an axis. Returns ErrNoDrive for an axis
+// outside 1..config.NumCNCAxes, ErrHoming while it homes and ErrBadNote
+// for a note above config.StepperMaxNote.
+func (c *CNC) PlayNote(axis, note byte) error {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	return c.playNote(axis, note)
+}
+
+// playNote is PlayNote with interrupts held off.
+func (c *CNC) playNote(axis, note byte) error {
+	if axis < 1 || axis > config.NumCNCAxes {
+		return ErrNoDrive
+	}
+	if c.homing[axis] {
+		return ErrHoming
+	}
+	if note > config.StepperMaxNote {
+		return ErrBadNote
+	}
+	if !c.enabled {
+		c.setEnabled(true)
+	}
+	ticks := notes.NoteDoubleTicks[note]
+	c.note[axis] = note
+	c.unbent[axis] = ticks
+	c.target[axis] = ticks
+	c.ramp[axis] = 0
+	if config.StepperRampSteps == 0 || ticks >= stepperStartTicks || c.period[axis] != 0 {
+		c.period[axis] = ticks
+		return nil
+	}
+	toggles := byte(2 * config.StepperRampSteps)
+	c.rampDelta[axis] = (stepperStartTicks - ticks) / uint16(toggles)
+	c.ramp[axis] = toggles
+	c.period[axis] = stepperStartTicks
+	c.tick[axis] = 0
+	return nil
+}
+
+// StopNote silences an axis, which holds its position.
+func (c *CNC) StopNote(axis byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	c.stopNote(axis)
+}
+
+// stopNote is StopNote with interrupts held off.
+func (c *CNC) stopNote(axis byte) {
+	if axis < 1 || axis > config.NumCNCAxes {
+		return
+	}
+	c.period[axis] = 0
+	c.ramp[axis] = 0
+}
+
+// StopAll silences every axis: a feed hold.
+func (c *CNC) StopAll() {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	c.stopAll()
+}
+
+// stopAll is StopAll with interrupts held off.
+func (c *CNC) stopAll() {
+	for a := byte(1); a <= config.NumCNCAxes; a++ {
+		c.stopNote(a)
+	}
+}
+
+// Bend bends the note an axis is playing by a 14-bit MIDI pitch bend
+// value (0..16383, 8192 = unbent) across config.DefaultBendRange
+// semitones. A ramp in progress carries on towards the bent pitch.
+func (c *CNC) Bend(axis byte, bend uint16) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	c.bendNote(axis, bend)
+}
+
+// bendNote is Bend with interrupts held off.
+func (c *CNC) bendNote(axis byte, bend uint16) {
+	if axis < 1 || axis > config.NumCNCAxes || c.period[axis] == 0 {
+		return
+	}
+	if bend > 0x3FFF {
+		bend = 0x3FFF
+	}
+	c.target[axis] = notes.BendTicks(c.unbent[axis], int16(bend)-8192, config.DefaultBendRange)
+	if c.ramp[axis] == 0 {
+		c.period[axis] = c.target[axis]
+	}
+}
+
+// DrivePosition returns an axis's position in steps from home.
+func (c *CNC) DrivePosition(axis byte) (uint16, bool) {
+	if axis < 1 || axis > config.NumCNCAxes {
+		return 0, false
+	}
+	return c.position[axis], true
+}
+
+// HandleSystemMessage processes system-wide commands (address 0x00).
+func (c *CNC) HandleSystemMessage(command byte, payload []byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	switch command {
+	case config.CmdReset:
+		for a := byte(1); a <= config.NumCNCAxes; a++ {
+			c.startHoming(a)
+		}
+	case config.CmdSequenceStop:
+		c.stopAll()
+	}
+}
+
+// HandleDeviceMessage processes commands for one axis, or for sub address
+// 0x00 all of them. Unknown commands and unusable payloads are counted in
+// Stats and dropped.
+func (c *CNC) HandleDeviceMessage(subAddress byte, command byte, payload []byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	if subAddress > config.NumCNCAxes {
+		return
+	}
+	first, last := subAddress, subAddress
+	if subAddress == 0x00 {
+		first, last = 1, config.NumCNCAxes
+	}
+	switch command {
+	case config.DevCmdNoteOn:
+		if len(payload) < 1 || payload[0] > 127 {
+			c.Stats.InvalidPayloads++
+			return
+		}
+		c.playNote(subAddress, payload[0])
+	case config.DevCmdNoteOff:
+		for a := first; a <= last; a++ {
+			if len(payload) == 0 || payload[0] == c.note[a] {
+				c.stopNote(a)
+			}
+		}
+	case config.DevCmdReset:
+		for a := first; a <= last; a++ {
+			c.startHoming(a)
+		}
+	case config.DevCmdBendPitch:
+		if len(payload) < 2 {
+			c.Stats.InvalidPayloads++
+			return
+		}
+		bend := int32(int16(payload[0])<<8|int16(payload[1])) + 8192
+		if bend < 0 {
+			bend = 0
+		}
+		c.bendNote(subAddress, uint16(bend))
+	default:
+		c.Stats.UnknownCommands++
+	}
+}
@@ -0,0 +1,71 @@
+//go:build !tinygo
+
+package instruments
+
+import (
+	"testing"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/fakeclock"
+	"github.com/ystepanoff/goppy/firmware/hal"
+	"github.com/ystepanoff/goppy/firmware/notes"
+)
+
+// TestCNCTravel plays every axis at its fastest, bent up, for long enough
+// to cross the longest travel several times, and checks each axis sweeps
+// exactly from home to its own limit: the short Z travel holds while X
+// and Y run on to theirs.
+func TestCNCTravel(t *testing.T) {
+	c := NewCNC()
+	c.Setup()
+	for a := 1; a <= config.NumCNCAxes; a++ {
+		if c.hasEndStop(byte(a)) {
+			cncEndStops[a].Low() // at home already
+		}
+	}
+	clock := fakeclock.New()
+	clock.Start(config.TimerResolution, c.Tick)
+	// A blind sweep takes the travel and an eighth at a step per
+	// CNCHomeStepMs.
+	clock.AdvanceMs(int(cncTravel[1]+cncTravel[1]/8+1) * config.CNCHomeStepMs)
+	for a := byte(1); a <= config.NumCNCAxes; a++ {
+		if c.homing[a] || c.position[a] != 0 {
+			t.Fatalf("axis %d: homing %v at %d", a, c.homing[a], c.position[a])
+		}
+	}
+
+	var lo, hi [config.NumCNCAxes + 1]uint16
+	for a := range lo {
+		lo[a] = 0xFFFF
+	}
+	hal.OnChange = func(p hal.Pin, high bool) {
+		for a := 1; a <= config.NumCNCAxes; a++ {
+			if p == cncStepPins[a] && high {
+				lo[a], hi[a] = min(lo[a], c.position[a]), max(hi[a], c.position[a])
+			}
+		}
+	}
+	t.Cleanup(func() { hal.OnChange = nil })
+
+	longest := uint16(0)
+	for a := byte(1); a <= config.NumCNCAxes; a++ {
+		if err := c.PlayNote(a, config.StepperMaxNote); err != nil {
+			t.Fatal(err)
+		}
+		c.HandleDeviceMessage(a, config.DevCmdBendPitch, []byte{0x1F, 0xFF})
+		longest = max(longest, cncTravel[a])
+	}
+	// Each half-period is at least a tick, so a step takes two or more.
+	ticks := int(4*longest) * 2 * int(c.period[1])
+	clock.AdvanceMs(ticks/notes.TicksPerMs + 1)
+	c.StopAll()
+
+	for a := 1; a <= config.NumCNCAxes; a++ {
+		if lo[a] != 0 || hi[a] != cncTravel[a] {
+			t.Errorf("axis %d: stepped to %d..%d, want 0..%d", a, lo[a], hi[a], cncTravel[a])
+		}
+	}
+	if config.NumCNCAxes >= 3 && cncTravel[3] >= cncTravel[1] {
+		t.Errorf("Z travel %d not shorter than X's %d, nothing asymmetric tested", cncTravel[3], cncTravel[1])
+	}
+}
@@ -0,0 +1,271 @@
+package instruments
+
+import (
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/hal"
+	"github.com/ystepanoff/goppy/firmware/notes"
+)
+
+// dcMotorMaxOn is config.DCMotorMaxOnMs in ticks.
+const dcMotorMaxOn = uint32(config.DCMotorMaxOnMs) * notes.TicksPerMs
+
+// DCMotor sings notes on brushed DC motors by setting each motor's PWM
+// carrier to the note's frequency at config.DCMotorDutyPercent. Each motor
+// is a BuzzerVoice: a PWM peripheral and the pin driving the H-bridge's
+// enable input. Sub addresses 1..config.NumDCMotors map onto the motors
+// round-robin, the latest note-on winning a shared motor.
+//
+// DCMotor needs Tick called from the timer interrupt, directly or through
+// a Router, to enforce config.DCMotorMaxOnMs.
+type DCMotor struct {
+	// Stats counts ignored messages. Only ever incremented.
+	Stats Stats
+
+	// Overruns counts notes cut short by config.DCMotorMaxOnMs.
+	Overruns uint16
+
+	motors   []BuzzerVoice
+	channels []uint8
+
+	// owner is the sub address each motor is sounding for, 0 if silent;
+	// period is each motor's carrier period in ns, 0 if never set; onTicks
+	// is how many more ticks it may stay on.
+	owner   []byte
+	period  []uint64
+	onTicks []uint32
+
+	// note and bend are each sub address's note (0 = none) and pitch bend
+	// deflection.
+	note [config.NumDCMotors + 1]byte
+	bend [config.NumDCMotors + 1]int16
+}
+
+// NewDCMotor creates a DCMotor driving motors.
+func NewDCMotor(motors ...BuzzerVoice) *DCMotor {
+	return &DCMotor{
+		motors:   motors,
+		channels: make([]uint8, len(motors)),
+		owner:    make([]byte, len(motors)),
+		period:   make([]uint64, len(motors)),
+		onTicks:  make([]uint32, len(motors)),
+	}
+}
+
+// Setup configures each motor's PWM peripheral and pin, stopped. Motors
+// whose pin their peripheral can't drive stay stopped for good.
+func (m *DCMotor) Setup() {
+	for i, v := range m.motors {
+		v.PWM.Configure(hal.PWMConfig{})
+		ch, err := v.PWM.Channel(v.Pin)
+		if err != nil {
+			m.motors[i].PWM = nil
+			continue
+		}
+		m.channels[i] = ch
+		v.PWM.Set(ch, 0)
+	}
+}
+
+// Tick stops motors that have sounded for config.DCMotorMaxOnMs. Called by
+// the timer interrupt at TimerResolution intervals.
+func (m *DCMotor) Tick() {
+	if dcMotorMaxOn == 0 {
+		return
+	}
+	for i := range m.onTicks {
+		if m.onTicks[i] == 0 {
+			continue
+		}
+		m.onTicks[i]--
+		if m.onTicks[i] == 0 && m.owner[i] != 0 {
+			m.Overruns++
+			m.stop(i)
+		}
+	}
+}
+
+// motor returns the motor index sub address sub plays on.
+func (m *DCMotor) motor(sub byte) int {
+	return int(sub-1) % len(m.motors)
+}
+
+// PlayNote sings a note on a sub address's motor, taking the motor over
+// from any other sub address. Returns ErrNoDrive for a sub address outside
+// 1..config.NumDCMotors and ErrBadNote for a note above 127.
+func (m *DCMotor) PlayNote(sub, note byte) error {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	return m.playNote(sub, note)
+}
+
+// playNote is PlayNote with interrupts held off.
+func (m *DCMotor) playNote(sub, note byte) error {
+	if sub < 1 || sub > config.NumDCMotors || len(m.motors) == 0 {
+		return ErrNoDrive
+	}
+	if note > 127 {
+		return ErrBadNote
+	}
+	m.note[sub] = note
+	m.bend[sub] = 0
+	i := m.motor(sub)
+	m.owner[i] = sub
+	m.onTicks[i] = dcMotorMaxOn
+	m.sound(sub)
+	return nil
+}
+
+// StopNote stops a sub address, and its motor if it holds it.
+func (m *DCMotor) StopNote(sub byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	m.stopNote(sub)
+}
+
+// stopNote is StopNote with interrupts held off.
+func (m *DCMotor) stopNote(sub byte) {
+	if sub < 1 || sub > config.NumDCMotors || len(m.motors) == 0 {
+		return
+	}
+	m.note[sub] = 0
+	if i := m.motor(sub); m.owner[i] == sub {
+		m.stop(i)
+	}
+}
+
+// StopAll stops every motor.
+func (m *DCMotor) StopAll() {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	m.stopAll()
+}
+
+// stopAll is StopAll with interrupts held off.
+func (m *DCMotor) stopAll() {
+	for sub := byte(1); sub <= config.NumDCMotors; sub++ {
+		m.stopNote(sub)
+	}
+}
+
+// Bend bends a sub address's note by a 14-bit MIDI pitch bend value
+// (0..16383, 8192 = unbent) across config.DefaultBendRange semitones.
+func (m *DCMotor) Bend(sub byte, bend uint16) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	m.bendNote(sub, bend)
+}
+
+// bendNote is Bend with interrupts held off.
+func (m *DCMotor) bendNote(sub byte, bend uint16) {
+	if sub < 1 || sub > config.NumDCMotors || len(m.motors) == 0 {
+		return
+	}
+	if bend > 0x3FFF {
+		bend = 0x3FFF
+	}
+	m.bend[sub] = int16(bend) - 8192
+	if m.owner[m.motor(sub)] == sub {
+		m.sound(sub)
+	}
+}
+
+// stop drops a motor's duty to zero and frees it.
+func (m *DCMotor) stop(i int) {
+	m.owner[i] = 0
+	m.onTicks[i] = 0
+	if m.motors[i].PWM != nil {
+		m.motors[i].PWM.Set(m.channels[i], 0)
+	}
+}
+
+// sound sets a sub address's motor carrier to its bent note. The period is
+// only written when it changes, as reprogramming the peripheral can upset
+// the cycle in progress. A shorter period could leave the old compare
+// value beyond the new top and hold the output on for a whole cycle, so
+// the duty is zeroed across the change; a longer one just runs a cycle at
+// lower duty. A period the peripheral can't produce stops the motor.
+func (m *DCMotor) sound(sub byte) {
+	i := m.motor(sub)
+	pwm := m.motors[i].PWM
+	if pwm == nil {
+		return
+	}
+	p := BuzzerPeriod(m.note[sub], m.bend[sub], config.DefaultBendRange)
+	if p != m.period[i] {
+		if p < m.period[i] {
+			pwm.Set(m.channels[i], 0)
+		}
+		if err := pwm.SetPeriod(p); err != nil {
+			m.period[i] = 0
+			m.stop(i)
+			return
+		}
+		m.period[i] = p
+	}
+	pwm.Set(m.channels[i], DCMotorDuty(pwm.Top(), config.DCMotorDutyPercent))
+}
+
+// DCMotorDuty returns the channel value for a duty of percent (capped at
+// 100) on a peripheral counting to top. Any non-zero percent gives at
+// least 1, so a motor on a coarse peripheral never falls silent.
+func DCMotorDuty(top uint32, percent byte) uint32 {
+	if percent == 0 {
+		return 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	d := uint32(uint64(top) * uint64(percent) / 100)
+	if d == 0 {
+		d = 1
+	}
+	return d
+}
+
+// HandleSystemMessage processes system-wide commands (address 0x00).
+func (m *DCMotor) HandleSystemMessage(command byte, payload []byte) {
+	switch command {
+	case config.CmdReset, config.CmdSequenceStop:
+		m.StopAll()
+	}
+}
+
+// HandleDeviceMessage processes commands for one sub address. A NoteOff
+// or Reset to sub address 0x00 stops everything. Unknown commands and
+// unusable payloads are counted in Stats and dropped.
+func (m *DCMotor) HandleDeviceMessage(subAddress byte, command byte, payload []byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	switch command {
+	case config.DevCmdNoteOn:
+		if len(payload) < 1 || payload[0] > 127 {
+			m.Stats.InvalidPayloads++
+			return
+		}
+		m.playNote(subAddress, payload[0])
+	case config.DevCmdNoteOff, config.DevCmdReset:
+		if subAddress == 0x00 {
+			m.stopAll()
+			return
+		}
+		if subAddress > config.NumDCMotors {
+			return
+		}
+		if command == config.DevCmdNoteOff && len(payload) > 0 && payload[0] != m.note[subAddress] {
+			return
+		}
+		m.stopNote(subAddress)
+	case config.DevCmdBendPitch:
+		if len(payload) < 2 {
+			m.Stats.InvalidPayloads++
+			return
+		}
+		bend := int32(int16(payload[0])<<8|int16(payload[1])) + 8192
+		if bend < 0 {
+			bend = 0
+		}
+		m.bendNote(subAddress, uint16(bend))
+	default:
+		m.Stats.UnknownCommands++
+	}
+}
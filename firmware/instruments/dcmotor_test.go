@@ -0,0 +1,94 @@
+//go:build !tinygo
+
+package instruments
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/fakeclock"
+)
+
+// TestDCMotorCarrier plays a note and bends it both ways: the carrier
+// follows the note at config.DCMotorDutyPercent, the duty drops to zero
+// before a shorter period goes in, and an unchanged period isn't written
+// again.
+func TestDCMotorCarrier(t *testing.T) {
+	pwm := &fakePWM{}
+	m := NewDCMotor(BuzzerVoice{PWM: pwm, Pin: 4})
+	m.Setup()
+	pwm.log = nil
+	duty := func(period uint64) string {
+		return fmt.Sprintf("set 0 %d", DCMotorDuty(uint32(period/1000), config.DCMotorDutyPercent))
+	}
+	base := BuzzerPeriod(45, 0, config.DefaultBendRange)
+	up := BuzzerPeriod(45, 8191, config.DefaultBendRange)
+	down := BuzzerPeriod(45, -8192, config.DefaultBendRange)
+
+	m.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{45})
+	m.HandleDeviceMessage(1, config.DevCmdBendPitch, []byte{0x1F, 0xFF})
+	m.HandleDeviceMessage(1, config.DevCmdBendPitch, []byte{0xE0, 0x00})
+	m.HandleDeviceMessage(1, config.DevCmdBendPitch, []byte{0x00, 0x00})
+	m.HandleDeviceMessage(1, config.DevCmdBendPitch, []byte{0x00, 0x00})
+	m.HandleDeviceMessage(1, config.DevCmdNoteOff, []byte{45})
+	want := []string{
+		fmt.Sprintf("period %d", base), duty(base),
+		"set 0 0", fmt.Sprintf("period %d", up), duty(up), // shorter
+		fmt.Sprintf("period %d", down), duty(down), // longer
+		"set 0 0", fmt.Sprintf("period %d", base), duty(base),
+		duty(base), // same period
+		"set 0 0",
+	}
+	if !slices.Equal(pwm.log, want) {
+		t.Errorf("PWM writes:\n%q\nwant:\n%q", pwm.log, want)
+	}
+	if !within(up, BuzzerPeriod(45+config.DefaultBendRange, 0, 0), 2) {
+		t.Errorf("bent up to %dns, not note %d", up, 45+config.DefaultBendRange)
+	}
+}
+
+// TestDCMotorDuty checks the duty scaling, its floor of 1 on a coarse
+// peripheral and its cap at 100%.
+func TestDCMotorDuty(t *testing.T) {
+	for _, c := range []struct {
+		top     uint32
+		percent byte
+		want    uint32
+	}{
+		{1000, 10, 100},
+		{1000, 0, 0},
+		{1000, 100, 1000},
+		{1000, 150, 1000},
+		{5, 10, 1},
+		{0xFFFF, 50, 0x7FFF},
+	} {
+		if got := DCMotorDuty(c.top, c.percent); got != c.want {
+			t.Errorf("DCMotorDuty(%d, %d) = %d, want %d", c.top, c.percent, got, c.want)
+		}
+	}
+}
+
+// TestDCMotorMaxOn holds a note past config.DCMotorMaxOnMs and checks the
+// motor stops then, and counts it, while a fresh note-on restarts the
+// limit.
+func TestDCMotorMaxOn(t *testing.T) {
+	pwm := &fakePWM{}
+	m := NewDCMotor(BuzzerVoice{PWM: pwm, Pin: 4})
+	m.Setup()
+	clock := fakeclock.New()
+	clock.Start(config.TimerResolution, m.Tick)
+
+	m.PlayNote(1, 45)
+	clock.AdvanceMs(config.DCMotorMaxOnMs / 2)
+	m.PlayNote(1, 47)
+	clock.AdvanceMs(config.DCMotorMaxOnMs - 1)
+	if pwm.duty[0] == 0 || m.Overruns != 0 {
+		t.Fatalf("stopped before the limit: duty %d, %d overruns", pwm.duty[0], m.Overruns)
+	}
+	clock.AdvanceMs(1)
+	if pwm.duty[0] != 0 || m.Overruns != 1 {
+		t.Errorf("at the limit: duty %d, %d overruns, want 0 and 1", pwm.duty[0], m.Overruns)
+	}
+}
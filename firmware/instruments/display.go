@@ -0,0 +1,357 @@
+package instruments
+
+import (
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/notes"
+)
+
+// Display layout: 8 pages of 8 pixel rows, text in 6 pixel cells and a
+// position bar from displayBarX to the right edge.
+const (
+	displayPages = 8
+	displayWidth = 128
+	displayCell  = 6
+	displayBarX  = 40
+	displayFrame = config.DisplayFrameMs * notes.TicksPerMs
+)
+
+// Page 0 is the status line, leaving a page each for up to 7 drives.
+var _ [displayPages - 1 - config.DisplayDrives]struct{}
+
+// displayInit sets a 128x64 SSD1306 up for page addressing, which the
+// SH1106 always uses, and turns it on. The leading 0x00 marks commands.
+var displayInit = [...]byte{0x00,
+	0xAE,       // display off
+	0xD5, 0x80, // clock divide
+	0xA8, 0x3F, // multiplex: 64 rows
+	0xD3, 0x00, // no display offset
+	0x40,       // start line 0
+	0x8D, 0x14, // charge pump on
+	0x20, 0x02, // page addressing
+	0xA1,       // columns mirrored
+	0xC8,       // rows mirrored
+	0xDA, 0x12, // COM pins
+	0x81, 0xCF, // contrast
+	0xD9, 0xF1, // precharge
+	0xDB, 0x40, // VCOMH level
+	0xA4, // show RAM
+	0xA6, // not inverted
+	0xAF, // display on
+}
+
+// I2C is the part of a machine I2C bus (such as machine.I2C0) that
+// Display uses.
+type I2C interface {
+	Tx(addr uint16, w, r []byte) error
+}
+
+// Display shows what is playing on a 128x64 SSD1306 or SH1106 OLED: the
+// sequence state and error count on the top line, then a line per drive
+// up to config.DisplayDrives with the note name and, given a position
+// source, a bar for the head position.
+//
+// Mirror it on a Router beside the instrument it follows, passing that
+// instrument's Stats and the instrument or Router as the position source:
+//
+//	display := instruments.NewDisplay(machine.I2C0, &floppy.Stats, router)
+//	router.Mirror(display)
+//	...
+//	for {
+//		serial.ReadMessages()
+//		display.Show()
+//	}
+//
+// Tick, from the timer interrupt, paces redraws to one every
+// config.DisplayFrameMs; Show, from the main loop, sends at most one
+// changed page per call, so a redraw never holds up message handling for
+// more than a page's transfer.
+type Display struct {
+	bus       I2C
+	stats     *Stats
+	positions positionReporter
+	column    byte
+
+	// What is playing, from the messages: note per drive, valid while
+	// playing is set, and whether a sequence is running.
+	note     [config.DisplayDrives + 1]byte
+	playing  [config.DisplayDrives + 1]bool
+	sequence bool
+
+	// What each page shows now, to spot changes: the drive pages' note
+	// (0xFF = none) and bar width, and the status line's state and error
+	// count.
+	shownNote   [config.DisplayDrives + 1]byte
+	shownBar    [config.DisplayDrives + 1]byte
+	shownSeq    bool
+	shownErrors uint16
+
+	// pending has a bit set for every page waiting to be sent.
+	pending uint8
+
+	frameTicks uint16
+	frameDue   bool
+
+	// buf holds one page being sent, after its data marker; line is
+	// scratch for a line of text.
+	buf  [1 + displayWidth]byte
+	line [displayWidth / displayCell]byte
+}
+
+// NewDisplay creates a Display on an I2C bus. stats, the followed
+// instrument's counters, may be nil to show no error count; positions,
+// usually that instrument or the Router, may be nil to show no bars.
+func NewDisplay(bus I2C, stats *Stats, positions positionReporter) *Display {
+	d := &Display{bus: bus, stats: stats, positions: positions, frameTicks: displayFrame}
+	if config.DisplaySH1106 {
+		d.column = 2
+	}
+	return d
+}
+
+// Setup initialises the display and queues a full redraw. Must be called
+// before Show.
+func (d *Display) Setup() error {
+	if err := d.bus.Tx(config.DisplayAddress, displayInit[:], nil); err != nil {
+		return err
+	}
+	for i := range d.shownNote {
+		d.shownNote[i] = 0xFF
+	}
+	d.pending = 0xFF
+	return nil
+}
+
+// Tick marks a redraw due every config.DisplayFrameMs. Called by the
+// timer interrupt at TimerResolution intervals.
+func (d *Display) Tick() {
+	d.frameTicks--
+	if d.frameTicks == 0 {
+		d.frameTicks = displayFrame
+		d.frameDue = true
+	}
+}
+
+// Show queues the pages that changed when a redraw is due and sends the
+// next queued page, if any. Call it from the main loop, never from
+// interrupt context.
+func (d *Display) Show() {
+	if d.frameDue {
+		d.frameDue = false
+		d.update()
+	}
+	for p := byte(0); p < displayPages; p++ {
+		if d.pending&(1<<p) != 0 {
+			d.pending &^= 1 << p
+			d.send(p)
+			return
+		}
+	}
+}
+
+// update queues every page whose content changed since it was drawn.
+func (d *Display) update() {
+	errors := d.errors()
+	if d.sequence != d.shownSeq || errors != d.shownErrors {
+		d.shownSeq, d.shownErrors = d.sequence, errors
+		d.pending |= 1
+	}
+	for drive := byte(1); drive <= config.DisplayDrives; drive++ {
+		note, bar := byte(0xFF), d.bar(drive)
+		if d.playing[drive] {
+			note = d.note[drive]
+		}
+		if note != d.shownNote[drive] || bar != d.shownBar[drive] {
+			d.shownNote[drive], d.shownBar[drive] = note, bar
+			d.pending |= 1 << drive
+		}
+	}
+}
+
+// errors returns the followed instrument's count of ignored messages.
+func (d *Display) errors() uint16 {
+	if d.stats == nil {
+		return 0
+	}
+	return d.stats.InvalidPayloads + d.stats.UnknownCommands
+}
+
+// bar returns the width of a drive's position bar in pixels, 0 without a
+// position. Positions beyond config.MaxPosition fill the bar.
+func (d *Display) bar(drive byte) byte {
+	if d.positions == nil {
+		return 0
+	}
+	pos, ok := d.positions.DrivePosition(drive)
+	if !ok {
+		return 0
+	}
+	if pos > config.MaxPosition {
+		pos = config.MaxPosition
+	}
+	return byte(uint32(pos) * (displayWidth - displayBarX) / config.MaxPosition)
+}
+
+// send draws a page as last recorded by update and writes it out.
+func (d *Display) send(page byte) {
+	var text []byte
+	var bar byte
+	if page == 0 {
+		text = StatusText(d.line[:0], d.shownSeq, d.shownErrors)
+	} else {
+		text = DriveText(d.line[:0], page, d.shownNote[page])
+		bar = d.shownBar[page]
+	}
+	px := d.buf[1:]
+	for i := range px {
+		px[i] = 0
+	}
+	for i, ch := range text {
+		glyph := displayGlyph(ch)
+		copy(px[i*displayCell:], glyph[:])
+	}
+	for x := 0; x < int(bar); x++ {
+		px[displayBarX+x] = 0x3C
+	}
+
+	cmd := [4]byte{0x00, 0xB0 | page, d.column & 0x0F, 0x10 | d.column>>4}
+	if d.bus.Tx(config.DisplayAddress, cmd[:], nil) != nil {
+		return
+	}
+	d.buf[0] = 0x40
+	d.bus.Tx(config.DisplayAddress, d.buf[:], nil)
+}
+
+// StatusText appends the status line's text to dst: the sequence state,
+// then the error count when there are errors, as in "PLAY      ERR 3".
+func StatusText(dst []byte, playing bool, errors uint16) []byte {
+	if playing {
+		dst = append(dst, "PLAY"...)
+	} else {
+		dst = append(dst, "STOP"...)
+	}
+	if errors == 0 {
+		return dst
+	}
+	for len(dst) < 10 {
+		dst = append(dst, ' ')
+	}
+	dst = append(dst, "ERR "...)
+	var digits [5]byte
+	i := len(digits)
+	for {
+		i--
+		digits[i] = byte('0' + errors%10)
+		errors /= 10
+		if errors == 0 {
+			break
+		}
+	}
+	return append(dst, digits[i:]...)
+}
+
+// DriveText appends a drive line's text to dst: the drive number and the
+// note's name, or "-" for note 0xFF (nothing playing), as in "3 C#4".
+func DriveText(dst []byte, drive, note byte) []byte {
+	dst = append(dst, byte('0'+drive%10), ' ')
+	if note == 0xFF {
+		return append(dst, '-')
+	}
+	return notes.Name(dst, note)
+}
+
+// displayChars lists the characters displayFont draws, in its order.
+const displayChars = "0123456789ABCDEFGHIKLNOPRSTUY#-:"
+
+// displayFont is a 5x7 font, a byte per column with the top row in bit 0.
+var displayFont = [len(displayChars)][5]byte{
+	{0x3E, 0x51, 0x49, 0x45, 0x3E}, // 0
+	{0x00, 0x42, 0x7F, 0x40, 0x00}, // 1
+	{0x42, 0x61, 0x51, 0x49, 0x46}, // 2
+	{0x21, 0x41, 0x45, 0x4B, 0x31}, // 3
+	{0x18, 0x14, 0x12, 0x7F, 0x10}, // 4
+	{0x27, 0x45, 0x45, 0x45, 0x39}, // 5
+	{0x3C, 0x4A, 0x49, 0x49, 0x30}, // 6
+	{0x01, 0x71, 0x09, 0x05, 0x03}, // 7
+	{0x36, 0x49, 0x49, 0x49, 0x36}, // 8
+	{0x06, 0x49, 0x49, 0x29, 0x1E}, // 9
+	{0x7E, 0x11, 0x11, 0x11, 0x7E}, // A
+	{0x7F, 0x49, 0x49, 0x49, 0x36}, // B
+	{0x3E, 0x41, 0x41, 0x41, 0x22}, // C
+	{0x7F, 0x41, 0x41, 0x22, 0x1C}, // D
+	{0x7F, 0x49, 0x49, 0x49, 0x41}, // E
+	{0x7F, 0x09, 0x09, 0x09, 0x01}, // F
+	{0x3E, 0x41, 0x49, 0x49, 0x7A}, // G
+	{0x7F, 0x08, 0x08, 0x08, 0x7F}, // H
+	{0x00, 0x41, 0x7F, 0x41, 0x00}, // I
+	{0x7F, 0x08, 0x14, 0x22, 0x41}, // K
+	{0x7F, 0x40, 0x40, 0x40, 0x40}, // L
+	{0x7F, 0x04, 0x08, 0x10, 0x7F}, // N
+	{0x3E, 0x41, 0x41, 0x41, 0x3E}, // O
+	{0x7F, 0x09, 0x09, 0x09, 0x06}, // P
+	{0x7F, 0x09, 0x19, 0x29, 0x46}, // R
+	{0x46, 0x49, 0x49, 0x49, 0x31}, // S
+	{0x01, 0x01, 0x7F, 0x01, 0x01}, // T
+	{0x3F, 0x40, 0x40, 0x40, 0x3F}, // U
+	{0x07, 0x08, 0x70, 0x08, 0x07}, // Y
+	{0x14, 0x7F, 0x14, 0x7F, 0x14}, // #
+	{0x08, 0x08, 0x08, 0x08, 0x08}, // -
+	{0x00, 0x36, 0x36, 0x00, 0x00}, // :
+}
+
+// displayGlyph returns a character's columns, blank for characters the
+// font lacks.
+func displayGlyph(ch byte) [5]byte {
+	for i := 0; i < len(displayChars); i++ {
+		if displayChars[i] == ch {
+			return displayFont[i]
+		}
+	}
+	return [5]byte{}
+}
+
+// HandleSystemMessage tracks the sequence state (address 0x00).
+func (d *Display) HandleSystemMessage(command byte, payload []byte) {
+	switch command {
+	case config.CmdSequenceStart:
+		d.sequence = true
+	case config.CmdSequenceStop, config.CmdReset:
+		d.sequence = false
+		d.clear(0)
+	}
+}
+
+// HandleDeviceMessage tracks the notes each drive plays. Other commands
+// don't change the display and are ignored.
+func (d *Display) HandleDeviceMessage(subAddress byte, command byte, payload []byte) {
+	switch command {
+	case config.DevCmdNoteOn:
+		if subAddress < 1 || subAddress > config.DisplayDrives || len(payload) < 1 || payload[0] > 127 {
+			return
+		}
+		d.note[subAddress] = payload[0]
+		d.playing[subAddress] = true
+	case config.DevCmdNoteOff:
+		if subAddress > config.DisplayDrives {
+			return
+		}
+		if subAddress != 0x00 && len(payload) > 0 && payload[0] != d.note[subAddress] {
+			return
+		}
+		d.clear(subAddress)
+	case config.DevCmdReset:
+		if subAddress <= config.DisplayDrives {
+			d.clear(subAddress)
+		}
+	}
+}
+
+// clear shows a drive, or for 0 every drive, as silent.
+func (d *Display) clear(drive byte) {
+	if drive != 0 {
+		d.playing[drive] = false
+		return
+	}
+	for i := range d.playing {
+		d.playing[i] = false
+	}
+}
@@ -0,0 +1,156 @@
+//go:build !tinygo
+
+package instruments
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/fakeclock"
+)
+
+// fakeOLED is an SSD1306/SH1106 on an I2C bus, reduced to what Display
+// uses: an init sequence, page and column addressing, and data writes
+// into a framebuffer of 8 pages of 132 columns (the SH1106's RAM width).
+type fakeOLED struct {
+	ram       [displayPages][132]byte
+	page, col int
+	inits     int
+	// pages counts data writes, one per page sent.
+	pages int
+}
+
+func (o *fakeOLED) Tx(addr uint16, w, r []byte) error {
+	if addr != config.DisplayAddress || len(w) == 0 {
+		return fmt.Errorf("tx to %#x: % X", addr, w)
+	}
+	switch {
+	case w[0] == 0x40:
+		o.pages++
+		for _, b := range w[1:] {
+			o.ram[o.page][o.col] = b
+			o.col++
+		}
+	case bytes.Equal(w, displayInit[:]):
+		o.inits++
+	case len(w) == 4 && w[0] == 0x00 && w[1]&0xF8 == 0xB0 && w[2]&0xF0 == 0x00 && w[3]&0xF0 == 0x10:
+		o.page = int(w[1] & 0x07)
+		o.col = int(w[3]&0x0F)<<4 | int(w[2])
+	default:
+		return fmt.Errorf("unexpected command % X", w)
+	}
+	return nil
+}
+
+// text reads a page's text back through the font, cell by cell from
+// column first, trailing blanks dropped. Drive pages stop at the position
+// bar; the status line runs the full width.
+func (o *fakeOLED) text(page, first int) string {
+	end := first + displayBarX
+	if page == 0 {
+		end = first + displayWidth
+	}
+	var s []byte
+	for x := first; x+5 <= end; x += displayCell {
+		var glyph [5]byte
+		copy(glyph[:], o.ram[page][x:x+5])
+		ch := byte('?')
+		if glyph == ([5]byte{}) {
+			ch = ' '
+		}
+		for i, g := range displayFont {
+			if g == glyph {
+				ch = displayChars[i]
+			}
+		}
+		s = append(s, ch)
+	}
+	return string(bytes.TrimRight(s, " "))
+}
+
+// bar returns the width of a page's position bar.
+func (o *fakeOLED) bar(page, first int) int {
+	n := 0
+	for x := first + displayBarX; x < first+displayWidth && o.ram[page][x] == 0x3C; x++ {
+		n++
+	}
+	return n
+}
+
+// fixedPositions reports fixed drive positions.
+type fixedPositions map[byte]uint16
+
+func (p fixedPositions) DrivePosition(drive byte) (uint16, bool) {
+	pos, ok := p[drive]
+	return pos, ok
+}
+
+// TestDisplayLayout draws the display through a fake OLED and reads the
+// framebuffer back: the status line, a line per drive with its note and
+// position bar, and only changed pages redrawn.
+func TestDisplayLayout(t *testing.T) {
+	oled := &fakeOLED{}
+	stats := &Stats{}
+	positions := fixedPositions{1: 0, 2: config.MaxPosition / 2, 3: config.MaxPosition + 10}
+	d := NewDisplay(oled, stats, positions)
+	if err := d.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	clock := fakeclock.New()
+	clock.Start(config.TimerResolution, d.Tick)
+	redraw := func() {
+		clock.AdvanceMs(config.DisplayFrameMs)
+		for range displayPages + 1 {
+			d.Show()
+		}
+	}
+	first := int(d.column)
+
+	redraw()
+	if oled.inits != 1 || oled.pages != displayPages {
+		t.Fatalf("%d inits and %d pages sent, want 1 and %d", oled.inits, oled.pages, displayPages)
+	}
+	if got := oled.text(0, first); got != "STOP" {
+		t.Errorf("status line %q, want STOP", got)
+	}
+	for drive := 1; drive <= config.DisplayDrives; drive++ {
+		if got, want := oled.text(drive, first), fmt.Sprintf("%d -", drive); got != want {
+			t.Errorf("drive %d line %q, want %q", drive, got, want)
+		}
+	}
+
+	d.HandleSystemMessage(config.CmdSequenceStart, nil)
+	d.HandleDeviceMessage(2, config.DevCmdNoteOn, []byte{61})
+	stats.InvalidPayloads = 12
+	oled.pages = 0
+	redraw()
+	if oled.pages != 2 {
+		t.Errorf("%d pages sent for two changed lines", oled.pages)
+	}
+	if got, want := oled.text(0, first), "PLAY      ERR 12"; got != want {
+		t.Errorf("status line %q, want %q", got, want)
+	}
+	if got := oled.text(2, first); got != "2 C#4" {
+		t.Errorf("drive 2 line %q, want \"2 C#4\"", got)
+	}
+	const barWidth = displayWidth - displayBarX
+	for drive, want := range map[int]int{1: 0, 2: barWidth / 2, 3: barWidth, 4: 0} {
+		if got := oled.bar(drive, first); got != want {
+			t.Errorf("drive %d bar %d pixels, want %d", drive, got, want)
+		}
+	}
+
+	d.HandleDeviceMessage(2, config.DevCmdNoteOff, []byte{60}) // not its note
+	oled.pages = 0
+	redraw()
+	if oled.pages != 0 {
+		t.Errorf("%d pages sent with nothing changed", oled.pages)
+	}
+	d.HandleSystemMessage(config.CmdReset, nil)
+	redraw()
+	if got := oled.text(2, first); got != "2 -" {
+		t.Errorf("drive 2 line %q after reset, want \"2 -\"", got)
+	}
+}
@@ -1,123 +1,709 @@
 // Package instruments provides hardware instrument drivers for Moppy.
 // FloppyDrives is the original Moppy instrument - floppy drive stepper motor music.
+//
+// FloppyDrives doesn't depend on the networks package: besides consuming
+// Moppy messages it can be played directly, from any source of notes:
+//
+//	floppy := instruments.NewFloppyDrives()
+//	floppy.Setup()
+//	instruments.InitTimer(config.TimerResolution, floppy.Tick)
+//	floppy.PlayNote(1, 60)
+//	floppy.Bend(1, 8192+2048)
+//	floppy.StopNote(1)
+//
+// The message handlers go through the same methods.
+//
+// Tick runs in the timer interrupt and everything else in the main loop,
+// so every exported method that touches what Tick reads holds interrupts
+// off while it does (see hal.DisableInterrupts); the unexported methods
+// they share expect that already done. Only ResetAll, which sleeps, and
+// SaveDriveSettings, which waits on the EEPROM, hold them off in pieces.
 package instruments
 
 import (
-	"machine"
+	"errors"
 	"time"
 
 	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/hal"
 	"github.com/ystepanoff/goppy/firmware/notes"
+	"github.com/ystepanoff/goppy/firmware/settings"
+	"github.com/ystepanoff/goppy/firmware/status"
 )
 
-// BendOctaves is the pitch bend range in octaves at full deflection.
-// 200 cents / 1200 cents-per-octave = 1/6 octave.
-const BendOctaves = 200.0 / 1200.0
+// Errors returned by PlayNote.
+var (
+	ErrNoDrive = errors.New("instruments: no such drive")
+	ErrBadNote = errors.New("instruments: note out of range")
+)
 
 // MaxFloppyNote is the highest MIDI note to attempt on floppy drives.
 // Higher notes may work but can cause instability.
 const MaxFloppyNote = 71
 
+// homeStepTicks is the tick interval between head steps while re-homing
+// a drive in the background (5ms, the same pace as the blocking reset).
+const homeStepTicks = 5 * notes.TicksPerMs
+
+// Load shedding (see TickLoad). Counts are in load samples, one every 64
+// ticks (about 2.5ms).
+const (
+	shedAfterSamples    = 4   // busy samples before shedding a level
+	recoverAfterSamples = 400 // calm samples (about 1s) before restoring one
+)
+
+// Background head moves. Idle time is counted in units of idleCheckTicks
+// ticks so the check runs once every 256 interrupts rather than on every one.
+const (
+	idleCheckTicks  = 256
+	parkIdleChecks  = config.ParkIdleMs * notes.TicksPerMs / idleCheckTicks
+	parkStepTicks   = config.ParkStepMs * notes.TicksPerMs
+	centerStepTicks = config.CenterStepMs * notes.TicksPerMs
+	saveDelayChecks = config.SaveDelayMs * notes.TicksPerMs / idleCheckTicks
+	watchdogChecks  = config.LinkWatchdogMs * notes.TicksPerMs / idleCheckTicks
+	ticksPerSecond  = 1000 * notes.TicksPerMs
+)
+
+// Every drive needs a settings slot; this fails to compile if
+// config.NumDrives outgrows them.
+var _ [settings.MaxDrives - lastDrive]struct{}
+
+// The zones are saved as the device's settings, 3 bytes each (see
+// zoneSettings); this fails to compile if config.MaxZones outgrows them.
+var _ [settings.MaxData - 3*config.MaxZones]struct{}
+
+// savedOptions lists the DevCmdSetOption settings kept in EEPROM, in their
+// order in a drive's settings block (after transpose, detune and bend
+// range). Append new options at the end so older blocks still load.
+var savedOptions = [...]byte{
+	config.OptDirCadence,
+	config.OptCalibration,
+	config.OptAccentMs,
+	config.OptAccentStyle,
+	config.OptVibratoRate,
+	config.OptVibratoDepth,
+	config.OptRegisterTravel,
+	config.OptTravelSplitLow,
+	config.OptTravelSplitHigh,
+	config.OptStartDelay,
+	config.OptLegato,
+	config.OptTravelMin,
+	config.OptTravelMax,
+	config.OptMovementClamp,
+}
+
+// legatoDepth is how many held notes a legato drive remembers.
+const legatoDepth = 4
+
 // firstDrive and lastDrive define the 1-based drive range.
 const (
 	firstDrive = 1
 	lastDrive  = config.NumDrives
 )
 
+// zone is a contiguous group of drives addressed through one alias sub address.
+// A zone with first == 0 is unused.
+type zone struct {
+	first, last byte
+	mode        byte // config.ZoneUnison, config.ZonePool or config.ZonePoolLRU
+	next        byte // pool zones: where the search for a free drive starts
+}
+
+// Stats counts messages the drives had to ignore.
+type Stats struct {
+	// InvalidPayloads counts known commands whose payload was too short or
+	// out of range (e.g. a NoteOn without a note, or a note above 127).
+	InvalidPayloads uint16
+
+	// UnknownCommands counts device commands the drives don't implement.
+	UnknownCommands uint16
+
+	// Overruns counts sampled ticks whose handler used most of its slot or
+	// ran past it (see TickLoad).
+	Overruns uint16
+
+	// LinkTimeouts counts the times the link watchdog silenced the drives
+	// (see config.LinkWatchdogMs).
+	LinkTimeouts uint16
+
+	// BadSubAddress counts commands only one drive can take - a note-on,
+	// a gliss or a trill - sent to sub address 0x00, which is every drive.
+	BadSubAddress uint16
+}
+
 // FloppyDrives controls an array of floppy drives to produce music.
 // Each drive's stepper motor head is pulsed at specific frequencies to
 // generate audible tones.
 type FloppyDrives struct {
+	// Stats counts ignored messages. Only ever incremented.
+	Stats Stats
+
 	// All arrays are 1-indexed (index 0 unused) to match sub-address numbering.
 
 	// currentPosition tracks the head position for each drive (0 to MaxPosition).
 	currentPosition [lastDrive + 1]uint16
 
-	// minPosition and maxPosition define the movement range per drive.
-	// Can be narrowed to restrict head travel.
+	// minPosition and maxPosition define the movement range per drive:
+	// the travel window, or a 2-track wiggle with movement disabled.
 	minPosition [lastDrive + 1]uint16
 	maxPosition [lastDrive + 1]uint16
 
+	// travelMin and travelMax are the travel window (DevCmdSetTravel);
+	// wiggle is set while movement is disabled.
+	travelMin [lastDrive + 1]uint16
+	travelMax [lastDrive + 1]uint16
+	wiggle    [lastDrive + 1]bool
+
+	// bounceMin and bounceMax are where a sounding head actually reverses:
+	// the movement range, or a narrower window inside it with register
+	// travel (see config.OptRegisterTravel).
+	bounceMin [lastDrive + 1]uint16
+	bounceMax [lastDrive + 1]uint16
+
+	// Soft bounce, on while soft is set (config.SoftBounce). softSqueeze is
+	// how much the steps between the eased ends are shortened, in 1/65536ths
+	// of the period (0 = the window is too narrow, bounce hard). softExtra is
+	// the tick offset for the current step; softResidue carries its rounding
+	// remainder.
+	soft        bool
+	softSqueeze [lastDrive + 1]uint16
+	softExtra   [lastDrive + 1]int16
+	softResidue [lastDrive + 1]int32
+
+	// Register travel settings.
+	registerTravel [lastDrive + 1]bool
+	splitLow       [lastDrive + 1]byte
+	splitHigh      [lastDrive + 1]byte
+
 	// currentPeriod is the current note period in timer ticks (0 = silent).
 	currentPeriod [lastDrive + 1]uint16
 
 	// originalPeriod is the period before pitch bend modifications.
 	originalPeriod [lastDrive + 1]uint16
 
+	// transpose is a signed semitone offset added to every note-on.
+	transpose [lastDrive + 1]int8
+
+	// detune is a drive's fine tuning in cents. periodScale is the matching
+	// Q16.16 period multiplier, only consulted when detune is non-zero.
+	detune      [lastDrive + 1]int8
+	periodScale [lastDrive + 1]uint32
+
+	// bendRange is how many semitones a full pitch bend reaches; bend is
+	// the deflection last applied to the sounding note (0 = none).
+	bendRange [lastDrive + 1]byte
+	bend      [lastDrive + 1]int16
+
+	// Tremolo gate. tremoloPeriod is the cycle length in ticks (0 = off);
+	// steps are only output while tremoloTick < tremoloOnTicks.
+	tremoloPeriod  [lastDrive + 1]uint16
+	tremoloOnTicks [lastDrive + 1]uint16
+	tremoloTick    [lastDrive + 1]uint16
+
+	// Accented attacks. For accentMs milliseconds after an accented note-on
+	// the drive plays an altered period (see config.OptAccentStyle), then
+	// Tick restores originalPeriod. accentCountdown is 0 when no attack runs.
+	accentMs        [lastDrive + 1]byte
+	accentStyle     [lastDrive + 1]byte
+	accentCountdown [lastDrive + 1]uint16
+
+	// Pressure vibrato. vibratoDepth is the peak swing as a Q16.16 fraction
+	// of the period (0 = off); vibratoPos runs 0..vibratoCycle ticks. Tick
+	// works out the modulated half-period, stepPeriod, at each pin toggle.
+	vibratoRate     [lastDrive + 1]byte
+	vibratoMaxCents [lastDrive + 1]byte
+	vibratoDepth    [lastDrive + 1]uint32
+	vibratoCycle    [lastDrive + 1]uint16
+	vibratoPos      [lastDrive + 1]uint16
+	stepPeriod      [lastDrive + 1]uint16
+
+	// soundingTicks counts the ticks each drive has spent playing a note,
+	// for balancing wear. lastUsed is noteCount at the drive's latest
+	// note-on; noteCount counts note-ons across all drives.
+	soundingTicks [lastDrive + 1]uint32
+	lastUsed      [lastDrive + 1]uint16
+	noteCount     uint16
+
+	// Trill (dual-note) mode. While trillCountdown is non-zero, Tick swaps
+	// the drive between two periods every trillTicks ticks. trillBase holds
+	// the unbent periods, trillBent the ones played; trillNote is the
+	// second note (currentNote is the first).
+	trillBase      [lastDrive + 1][2]uint16
+	trillBent      [lastDrive + 1][2]uint16
+	trillOnSecond  [lastDrive + 1]bool
+	trillNote      [lastDrive + 1]byte
+	trillTicks     [lastDrive + 1]uint16
+	trillCountdown [lastDrive + 1]uint16
+
+	// Start delay. A note-on waits startDelay ms before it sounds; while
+	// startCountdown is non-zero Tick leaves the drive alone.
+	startDelay     [lastDrive + 1]byte
+	startCountdown [lastDrive + 1]uint16
+
+	// currentNote is the MIDI note a drive is sounding, valid while
+	// originalPeriod is non-zero. Used to match note-offs to their note-on.
+	currentNote [lastDrive + 1]byte
+
 	// currentTick counts timer ticks since last pin toggle per drive.
 	currentTick [lastDrive + 1]uint16
 
+	// Glissando state. glissNote walks one semitone towards glissEnd every
+	// glissStepTicks ticks; glissCountdown counts down to the next step and
+	// is 0 when no slide is running.
+	glissNote      [lastDrive + 1]byte
+	glissEnd       [lastDrive + 1]byte
+	glissStepTicks [lastDrive + 1]uint32
+	glissCountdown [lastDrive + 1]uint32
+	glissSmooth    [lastDrive + 1]bool
+
+	// sustain is set while the sustain pedal is held for a drive.
+	sustain [lastDrive + 1]bool
+
+	// released marks a sustained drive whose note-off already arrived.
+	// It keeps sounding until the pedal lifts.
+	released [lastDrive + 1]bool
+
 	// directionState tracks the direction pin state per drive (false=forward, true=reverse).
 	directionState [lastDrive + 1]bool
 
-	// stepState tracks the step pin toggle state per drive.
+	// dirCadence reverses direction every N steps (0 = only at the limits);
+	// stepsSinceReverse counts steps since the last reversal.
+	dirCadence        [lastDrive + 1]byte
+	stepsSinceReverse [lastDrive + 1]byte
+
+	// calibration is how many steps past the end stop a drive's position 0 is.
+	calibration [lastDrive + 1]byte
+
+	// Background re-homing (DevCmdReset on a single drive). While homing,
+	// Tick steps the head back homeSteps pulses, then forward homeForward
+	// pulses for the calibration offset, one pulse every homeStepTicks.
+	// A note-on received meanwhile waits in pendingNote.
+	homing        [lastDrive + 1]bool
+	homeSteps     [lastDrive + 1]uint16
+	homeForward   [lastDrive + 1]byte
+	homeCountdown [lastDrive + 1]uint16
+	hasPending    [lastDrive + 1]bool
+	pendingNote   [lastDrive + 1]byte
+
+	// Background head moves (idle parking, centring on SEQUENCE_START).
+	// While moving, Tick steps the head one position towards moveTarget
+	// every moveStepTicks ticks; parked is set once it arrives, until the
+	// next note. idleChecks counts idle checks a silent drive sat through.
+	idleChecks    [lastDrive + 1]uint16
+	moving        [lastDrive + 1]bool
+	parked        [lastDrive + 1]bool
+	moveTarget    [lastDrive + 1]uint16
+	moveStepTicks [lastDrive + 1]uint16
+	moveCountdown [lastDrive + 1]uint16
+
+	// ticks counts timer interrupts; it paces the idle check.
+	ticks uint16
+
+	// uptime counts the seconds since the drives started, upTicks the
+	// ticks towards the next, a idleCheckTicks at a time.
+	uptime  uint32
+	upTicks uint16
+
+	// fault is the config.Fault of the last message ignored or tick
+	// overrun counted in Stats, faults how many there have been. See
+	// DeviceStatus.
+	fault  byte
+	faults uint16
+
+	// led is the board's status LED, told of faults and reset sweeps; nil
+	// for none (see SetStatusLED).
+	led *status.LED
+
+	// Load shedding state. effectsShed turns vibrato and tremolo off;
+	// muted drives stay silent while keeping their notes. busySamples and
+	// calmSamples count load samples towards the next change.
+	effectsShed bool
+	muted       [lastDrive + 1]bool
+	busySamples byte
+	calmSamples uint16
+
+	// Mono legato (OptLegato): held lists the notes whose keys are down,
+	// most recent last, heldCount of them.
+	legato    [lastDrive + 1]bool
+	held      [lastDrive + 1][legatoDepth]byte
+	heldCount [lastDrive + 1]byte
+
+	// playing is set between SEQUENCE_START and SEQUENCE_STOP.
+	playing bool
+
+	// quietChecks counts idle checks since the last message, for the link
+	// watchdog.
+	quietChecks uint16
+
+	// Settings waiting to be saved (see SaveDriveSettings). saveCountdown
+	// counts idle checks until the last change is old enough to write.
+	saveDirty     [lastDrive + 1]bool
+	saveZones     bool
+	saveCountdown uint16
+
+	// stepState is the level each drive's step line was last set to.
 	stepState [lastDrive + 1]bool
 
-	// pins caches the machine.Pin for each drive's step and direction pins.
-	stepPins [lastDrive + 1]machine.Pin
-	dirPins  [lastDrive + 1]machine.Pin
+	// zones maps the alias sub addresses ZoneSubAddress.. to drive groups.
+	zones [config.MaxZones]zone
+
+	// stagger skews each note's first step by its drive's index
+	// (config.StaggerStepEdges).
+	stagger bool
+
+	// Shared direction line (config.SharedDirPin; see sharedReverse).
+	// dirOwner is the drive that last turned the line round; sharedMoved
+	// marks the drives that have stepped since, and heldSteps counts the
+	// steps a drive pinned at a limit has sat out.
+	sharedDir   bool
+	dirOwner    byte
+	sharedMoved [lastDrive + 1]bool
+	heldSteps   [lastDrive + 1]uint16
+
+	// pins caches the hal.Pin for each drive's step and direction pins.
+	stepPins [lastDrive + 1]hal.Pin
+	dirPins  [lastDrive + 1]hal.Pin
+
+	// shift holds the lines when they go through 74HC595s
+	// (config.ShiftRegister).
+	shift shiftChain
+
+	// ticker is what Setup and ResetAll wait on (see SetTicker).
+	ticker hal.Ticker
 }
 
-// NewFloppyDrives creates a new FloppyDrives instance.
+// NewFloppyDrives creates a new FloppyDrives instance. The drive count,
+// pins and everything else not set through messages come from the config
+// package at compile time.
 func NewFloppyDrives() *FloppyDrives {
-	fd := &FloppyDrives{}
+	fd := &FloppyDrives{
+		ticker:    HardwareTicker,
+		stagger:   config.StaggerStepEdges,
+		sharedDir: config.SharedDirPin != 0,
+		soft:      config.SoftBounce,
+	}
 
 	// Pre-calculate pin mappings and set default movement range.
 	for d := byte(firstDrive); d <= lastDrive; d++ {
-		fd.stepPins[d] = machine.Pin(config.FirstPin + (d-1)*2)
-		fd.dirPins[d] = machine.Pin(config.FirstPin + (d-1)*2 + 1)
-		fd.maxPosition[d] = config.MaxPosition
+		if config.SharedDirPin != 0 {
+			fd.stepPins[d] = hal.Pin(config.FirstPin + (d - 1))
+			fd.dirPins[d] = hal.Pin(config.SharedDirPin)
+		} else {
+			fd.stepPins[d] = hal.Pin(config.FirstPin + (d-1)*2)
+			fd.dirPins[d] = hal.Pin(config.FirstPin + (d-1)*2 + 1)
+		}
+		fd.defaultSettings(d)
 	}
 
 	return fd
 }
 
+// SetTicker sets the hal.Ticker that Setup, ResetAll and the startup
+// sound wait on, HardwareTicker by default. Tick the drives from the same
+// one: give them a fakeclock.Clock in tests, and those waits take no time
+// but run every tick that falls due in them.
+func (fd *FloppyDrives) SetTicker(t hal.Ticker) {
+	fd.ticker = t
+}
+
+// SetStatusLED has the drives show their faults, and the sweeps ResetAll
+// makes, on led. Setup's own sweep shows as led's Booting.
+func (fd *FloppyDrives) SetStatusLED(led *status.LED) {
+	fd.led = led
+}
+
 // Setup configures all drive pins as outputs and resets drives to position 0.
 // Must be called before Tick or message handling.
 func (fd *FloppyDrives) Setup() {
 	// Configure all drive pins as outputs.
-	for d := byte(firstDrive); d <= lastDrive; d++ {
-		fd.stepPins[d].Configure(machine.PinConfig{Mode: machine.PinOutput})
-		fd.dirPins[d].Configure(machine.PinConfig{Mode: machine.PinOutput})
+	if config.ShiftRegister {
+		fd.shift.setup()
+	} else {
+		for d := byte(firstDrive); d <= lastDrive; d++ {
+			fd.stepPins[d].Configure(hal.PinConfig{Mode: hal.PinOutput})
+			fd.dirPins[d].Configure(hal.PinConfig{Mode: hal.PinOutput})
+		}
 	}
 
-	// Reset all drives to position 0.
-	fd.ResetAll()
-	time.Sleep(500 * time.Millisecond)
+	// Saved calibration offsets are needed by the reset below.
+	if config.PersistSettings {
+		fd.loadSettings()
+	}
+
+	// Home all drives to position 0, keeping their saved travel windows.
+	fd.homeAll()
+	fd.ticker.Sleep(500 * time.Millisecond)
 
 	// Play startup sound if configured.
 	if config.PlayStartupSound {
 		fd.startupSound(firstDrive)
-		time.Sleep(500 * time.Millisecond)
-		fd.ResetAll()
+		fd.ticker.Sleep(500 * time.Millisecond)
+		fd.homeAll()
 	}
 }
 
 // Tick is called by the timer interrupt at TimerResolution intervals.
 // It advances each active drive's tick counter and toggles the step pin
 // when the note period is reached. This must be kept fast.
+//
+// Pass it to InitTimer after Setup; nothing sounds until it runs.
 func (fd *FloppyDrives) Tick() {
 	for d := byte(firstDrive); d <= lastDrive; d++ {
+		if fd.homing[d] {
+			fd.advanceHoming(d)
+			continue
+		}
+		if fd.moving[d] {
+			fd.advanceMove(d)
+			continue
+		}
+		if fd.startCountdown[d] > 0 {
+			fd.startCountdown[d]--
+			continue
+		}
+		if fd.muted[d] {
+			continue
+		}
+		if fd.glissCountdown[d] > 0 {
+			fd.advanceGliss(d)
+		}
+		if fd.trillCountdown[d] > 0 {
+			fd.advanceTrill(d)
+		}
+		if fd.accentCountdown[d] > 0 {
+			fd.accentCountdown[d]--
+			if fd.accentCountdown[d] == 0 {
+				fd.currentPeriod[d] = fd.originalPeriod[d]
+			}
+		}
 		if fd.currentPeriod[d] > 0 {
+			fd.soundingTicks[d]++
 			fd.currentTick[d]++
-			if fd.currentTick[d] >= fd.currentPeriod[d] {
-				fd.togglePin(d)
+			vibrato := fd.vibratoDepth[d] != 0 && !fd.effectsShed
+			tremolo := fd.tremoloPeriod[d] > 0 && !fd.effectsShed
+			period := fd.currentPeriod[d]
+			if vibrato {
+				period = fd.stepPeriod[d]
+			}
+			if fd.soft && fd.softExtra[d] != 0 {
+				if p := int32(period) + int32(fd.softExtra[d]); p > 0 {
+					period = uint16(p)
+				}
+			}
+			if fd.currentTick[d] >= period {
+				// The tremolo gate only drops pulses; the period runs on,
+				// so pitch (and any bend) is untouched.
+				if !tremolo || fd.tremoloTick[d] < fd.tremoloOnTicks[d] {
+					fd.togglePin(d)
+				}
 				fd.currentTick[d] = 0
+				if vibrato {
+					fd.stepPeriod[d] = notes.Vibrato(fd.currentPeriod[d], fd.vibratoDepth[d],
+						fd.vibratoPos[d], fd.vibratoCycle[d])
+				}
+				if fd.soft {
+					fd.softBounce(d)
+				}
+			}
+			if vibrato {
+				fd.vibratoPos[d]++
+				if fd.vibratoPos[d] >= fd.vibratoCycle[d] {
+					fd.vibratoPos[d] = 0
+				}
+			}
+			if tremolo {
+				fd.tremoloTick[d]++
+				if fd.tremoloTick[d] >= fd.tremoloPeriod[d] {
+					fd.tremoloTick[d] = 0
+				}
+			}
+		}
+	}
+
+	fd.flush()
+
+	fd.ticks++
+	if fd.ticks%idleCheckTicks == 0 {
+		fd.upTicks += idleCheckTicks
+		if fd.upTicks >= ticksPerSecond {
+			fd.upTicks -= ticksPerSecond
+			fd.uptime++
+		}
+		fd.checkLink()
+		fd.checkIdle()
+		if fd.saveCountdown > 0 {
+			fd.saveCountdown--
+		}
+	}
+}
+
+// TickLoad takes a load sample from the timer (see MonitorLoad): busy
+// means the sampled tick used most of its slot or overran it, which would
+// put every drive out of tune. Sustained load sheds work one level at a
+// time - first vibrato and tremolo, then the highest-numbered sounding
+// drive, then the next - and a calm spell restores it in reverse order.
+// Runs in interrupt context.
+func (fd *FloppyDrives) TickLoad(busy bool) {
+	if busy {
+		fd.Stats.Overruns++
+		fd.noteFault(config.FaultOverrun)
+		fd.calmSamples = 0
+		fd.busySamples++
+		if fd.busySamples >= shedAfterSamples {
+			fd.busySamples = 0
+			fd.shedLoad()
+		}
+		return
+	}
+	if fd.busySamples > 0 {
+		fd.busySamples--
+	}
+	if !fd.effectsShed {
+		return
+	}
+	fd.calmSamples++
+	if fd.calmSamples >= recoverAfterSamples {
+		fd.calmSamples = 0
+		fd.restoreLoad()
+	}
+}
+
+// Degraded reports whether load shedding currently has effects turned off
+// or drives muted.
+func (fd *FloppyDrives) Degraded() bool {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	return fd.effectsShed
+}
+
+// shedLoad drops the next piece of work: the effects, then the highest-
+// numbered drive that is sounding and not yet muted.
+func (fd *FloppyDrives) shedLoad() {
+	if !fd.effectsShed {
+		fd.effectsShed = true
+		return
+	}
+	for d := byte(lastDrive); d >= firstDrive; d-- {
+		if !fd.muted[d] && fd.currentPeriod[d] != 0 {
+			fd.muted[d] = true
+			return
+		}
+	}
+}
+
+// restoreLoad undoes the most recent shedLoad step.
+func (fd *FloppyDrives) restoreLoad() {
+	for d := byte(firstDrive); d <= lastDrive; d++ {
+		if fd.muted[d] {
+			fd.muted[d] = false
+			return
+		}
+	}
+	fd.effectsShed = false
+}
+
+// checkLink silences every drive once a sequence has had notes sounding
+// for config.LinkWatchdogMs without a message. Called from Tick.
+func (fd *FloppyDrives) checkLink() {
+	if config.LinkWatchdogMs == 0 || !fd.playing {
+		return
+	}
+	fd.quietChecks++
+	if fd.quietChecks < watchdogChecks {
+		return
+	}
+	fd.quietChecks = 0
+	for d := byte(firstDrive); d <= lastDrive; d++ {
+		if fd.currentPeriod[d] != 0 {
+			fd.Stats.LinkTimeouts++
+			fd.noteFault(config.FaultLinkTimeout)
+			fd.silenceAll()
+			return
+		}
+	}
+}
+
+// checkIdle advances the idle time of silent drives and starts parking the
+// ones that have been idle for config.ParkIdleMs. Called from Tick.
+func (fd *FloppyDrives) checkIdle() {
+	if config.ParkIdleMs == 0 || fd.playing {
+		return
+	}
+	for d := byte(firstDrive); d <= lastDrive; d++ {
+		if fd.currentPeriod[d] != 0 || fd.homing[d] || fd.moving[d] || fd.parked[d] {
+			continue
+		}
+		fd.idleChecks[d]++
+		if fd.idleChecks[d] >= parkIdleChecks {
+			target := uint16(0)
+			if config.ParkAtCenter {
+				target = config.MaxPosition / 2
 			}
+			fd.startMove(d, target, parkStepTicks)
 		}
 	}
 }
 
-// togglePin advances the stepper motor one step, reversing direction at boundaries.
+// startMove walks a silent drive's head to target in the background, one
+// position every stepTicks ticks. Playing a note cancels the move.
+func (fd *FloppyDrives) startMove(driveNum byte, target, stepTicks uint16) {
+	fd.moving[driveNum] = false
+	fd.moveTarget[driveNum] = target
+	fd.moveStepTicks[driveNum] = stepTicks
+	fd.moveCountdown[driveNum] = stepTicks
+	fd.moving[driveNum] = true
+}
+
+// advanceMove runs one tick of a background head move. Called from Tick.
+func (fd *FloppyDrives) advanceMove(driveNum byte) {
+	fd.moveCountdown[driveNum]--
+	if fd.moveCountdown[driveNum] > 0 {
+		return
+	}
+	fd.moveCountdown[driveNum] = fd.moveStepTicks[driveNum]
+
+	target := fd.moveTarget[driveNum]
+	pos := fd.currentPosition[driveNum]
+	if pos == target {
+		fd.moving[driveNum] = false
+		fd.parked[driveNum] = true
+		return
+	}
+
+	fd.setDirection(driveNum, pos > target)
+	if pos > target {
+		fd.currentPosition[driveNum]--
+	} else {
+		fd.currentPosition[driveNum]++
+	}
+	fd.stepState[driveNum] = !fd.stepState[driveNum]
+	fd.setStep(driveNum, fd.stepState[driveNum])
+}
+
+// wake cancels any background move or parking for a drive about to play.
+func (fd *FloppyDrives) wake(driveNum byte) {
+	fd.moving[driveNum] = false
+	fd.parked[driveNum] = false
+	fd.idleChecks[driveNum] = 0
+}
+
+// togglePin advances the stepper motor one step, reversing direction at
+// boundaries and, with a direction cadence set, every dirCadence steps.
+// With a shared direction line, see sharedReverse instead.
 func (fd *FloppyDrives) togglePin(driveNum byte) {
 	// Reverse direction at position boundaries.
-	if fd.currentPosition[driveNum] >= fd.maxPosition[driveNum] {
-		fd.directionState[driveNum] = true // reverse
-		fd.dirPins[driveNum].High()
-	} else if fd.currentPosition[driveNum] <= fd.minPosition[driveNum] {
-		fd.directionState[driveNum] = false // forward
-		fd.dirPins[driveNum].Low()
+	if fd.sharedDir {
+		if !fd.sharedReverse(driveNum) {
+			return
+		}
+	} else if fd.currentPosition[driveNum] >= fd.bounceMax[driveNum] {
+		fd.setDirection(driveNum, true) // reverse
+	} else if fd.currentPosition[driveNum] <= fd.bounceMin[driveNum] {
+		fd.setDirection(driveNum, false) // forward
+	} else if c := fd.dirCadence[driveNum]; c > 0 && fd.stepsSinceReverse[driveNum] >= c {
+		fd.setDirection(driveNum, !fd.directionState[driveNum])
 	}
+	fd.stepsSinceReverse[driveNum]++
 
 	// Update position.
 	if fd.directionState[driveNum] {
@@ -126,139 +712,1569 @@ func (fd *FloppyDrives) togglePin(driveNum byte) {
 		fd.currentPosition[driveNum]++
 	}
 
-	// Pulse the step pin.
-	if fd.stepState[driveNum] {
-		fd.stepPins[driveNum].High()
-	} else {
-		fd.stepPins[driveNum].Low()
-	}
+	// Pulse the step pin. The line changes first, so every position
+	// counted is an edge the drive sees.
 	fd.stepState[driveNum] = !fd.stepState[driveNum]
+	fd.setStep(driveNum, fd.stepState[driveNum])
 }
 
-// HandleSystemMessage processes system-wide commands (address 0x00).
-func (fd *FloppyDrives) HandleSystemMessage(command byte, payload []byte) {
-	switch command {
-	case config.CmdReset:
-		fd.ResetAll()
-	case config.CmdSequenceStop:
-		fd.haltAllDrives()
+// sharedReverse decides a step for a drive on a shared direction line,
+// reporting whether it may take it. A drive at the limit the line is
+// taking it to turns the line round for every drive, provided it has
+// stepped since the line last turned: a drive that hasn't is one another
+// drive left pinned at its opposite limit, and it sits its steps out until
+// the line comes back round. Otherwise two heads at opposite ends would
+// turn the line on every step, wiggling in place and dragging every other
+// head with them. A pinned drive takes the line anyway once the drive
+// that turned it goes quiet, or after a full travel's worth of steps.
+// Direction cadences don't apply. Called from Tick.
+func (fd *FloppyDrives) sharedReverse(driveNum byte) bool {
+	pos, reverse := fd.currentPosition[driveNum], fd.directionState[driveNum]
+	if reverse && pos > fd.bounceMin[driveNum] || !reverse && pos < fd.bounceMax[driveNum] {
+		fd.sharedMoved[driveNum] = true
+		fd.heldSteps[driveNum] = 0
+		return true
+	}
+	if o := fd.dirOwner; !fd.sharedMoved[driveNum] && o != 0 && o != driveNum &&
+		fd.currentPeriod[o] != 0 && !fd.muted[o] && !fd.homing[o] &&
+		fd.heldSteps[driveNum] < config.MaxPosition {
+		fd.heldSteps[driveNum]++
+		return false
 	}
+	fd.setDirection(driveNum, !reverse)
+	fd.dirOwner = driveNum
+	for d := byte(firstDrive); d <= lastDrive; d++ {
+		fd.sharedMoved[d] = false
+	}
+	fd.sharedMoved[driveNum] = true
+	fd.heldSteps[driveNum] = 0
+	return true
 }
 
-// HandleDeviceMessage processes commands for individual drives.
-func (fd *FloppyDrives) HandleDeviceMessage(subAddress byte, command byte, payload []byte) {
-	switch command {
-	case config.DevCmdReset:
-		if subAddress == 0x00 {
-			fd.ResetAll()
-		} else {
-			fd.reset(subAddress)
-		}
-	case config.DevCmdNoteOn:
-		if len(payload) > 0 && payload[0] <= MaxFloppyNote {
-			fd.currentPeriod[subAddress] = notes.NoteDoubleTicks[payload[0]]
-			fd.originalPeriod[subAddress] = fd.currentPeriod[subAddress]
-		}
-	case config.DevCmdNoteOff:
-		fd.currentPeriod[subAddress] = 0
-		fd.originalPeriod[subAddress] = 0
-	case config.DevCmdBendPitch:
-		if len(payload) >= 2 {
-			fd.bendPitch(subAddress, payload)
-		}
-	case config.DevCmdSetMovement:
-		if len(payload) > 0 {
-			fd.setMovement(subAddress, payload[0] == 0)
+// setDirection drives the direction pin (reverse = towards position 0)
+// and restarts the cadence count whenever the direction actually changes.
+// With a shared direction pin every drive's direction changes with it.
+func (fd *FloppyDrives) setDirection(driveNum byte, reverse bool) {
+	if fd.directionState[driveNum] != reverse {
+		fd.stepsSinceReverse[driveNum] = 0
+	}
+	if fd.sharedDir {
+		for d := byte(firstDrive); d <= lastDrive; d++ {
+			fd.directionState[d] = reverse
 		}
+	} else {
+		fd.directionState[driveNum] = reverse
 	}
+	fd.setDir(driveNum, reverse)
 }
 
-// bendPitch applies pitch bend to a drive's current note.
-//
-// 14-bit signed value: -8192 to 8191. Full deflection bends by BendOctaves,
-// so the exponent x = BendOctaves * deflection/8192 lies in [-1/6, 1/6].
-// In that tiny range we approximate 2^x = e^(x*ln2) with a 4-term Taylor
-// series instead of pulling in libm's exp() (TinyGo can't link it on AVR).
-// Worst-case error at |x|=1/6 is well below 0.01%.
-func (fd *FloppyDrives) bendPitch(driveNum byte, payload []byte) {
-	bendDeflection := int16(payload[0])<<8 | int16(payload[1])
+// setStep drives a drive's STEP line.
+func (fd *FloppyDrives) setStep(driveNum byte, high bool) {
+	if config.ShiftRegister {
+		fd.shift.set(stepBit(driveNum), high)
+		return
+	}
+	fd.stepPins[driveNum].Set(high)
+}
 
-	if fd.originalPeriod[driveNum] == 0 {
+// setDir drives a drive's DIRECTION line (high = towards position 0).
+func (fd *FloppyDrives) setDir(driveNum byte, high bool) {
+	if config.ShiftRegister {
+		fd.shift.set(dirBit(driveNum), high)
 		return
 	}
+	fd.dirPins[driveNum].Set(high)
+}
 
-	const ln2 = 0.6931471805599453
-	x := BendOctaves * float32(bendDeflection) / 8192.0 * ln2
-	divisor := 1 + x*(1+x*(0.5+x*(1.0/6.0+x*(1.0/24.0))))
-	fd.currentPeriod[driveNum] = uint16(float32(fd.originalPeriod[driveNum]) / divisor)
+// flush latches pending shift register changes.
+func (fd *FloppyDrives) flush() {
+	if config.ShiftRegister && fd.shift.dirty {
+		fd.shift.latch()
+	}
 }
 
-// haltAllDrives immediately stops all notes.
-func (fd *FloppyDrives) haltAllDrives() {
-	for d := byte(firstDrive); d <= lastDrive; d++ {
-		fd.currentPeriod[d] = 0
+// pulseStep sends a drive's STEP line high and low again. Through the
+// shift register the high is latched straight away; the low goes out with
+// the next latch.
+func (fd *FloppyDrives) pulseStep(driveNum byte) {
+	fd.setStep(driveNum, true)
+	if config.ShiftRegister {
+		fd.shift.latch()
 	}
+	fd.setStep(driveNum, false)
 }
 
-// reset returns a single drive's head to position 0.
-func (fd *FloppyDrives) reset(driveNum byte) {
-	fd.currentPeriod[driveNum] = 0
+// Caps returns the config.Cap bits of the commands the drives take, for
+// the pong: every one.
+func (fd *FloppyDrives) Caps() uint16 {
+	return config.CapVelocity | config.CapBendRange | config.CapTuning | config.CapTremolo |
+		config.CapPressure | config.CapSustain | config.CapGliss | config.CapTrill |
+		config.CapZones | config.CapTravel | config.CapOptions
+}
 
-	// Step backwards to position 0.
-	fd.dirPins[driveNum].High()
-	for s := uint16(0); s < fd.maxPosition[driveNum]; s += 2 {
-		fd.stepPins[driveNum].High()
-		fd.stepPins[driveNum].Low()
-		time.Sleep(5 * time.Millisecond)
+// HandleSystemMessage processes system-wide commands (address 0x00).
+func (fd *FloppyDrives) HandleSystemMessage(command byte, payload []byte) {
+	state := hal.DisableInterrupts()
+	fd.quietChecks = 0
+	switch command {
+	case config.CmdReset:
+		fd.playing = false
+	case config.CmdSequenceStart:
+		fd.playing = true
+		if config.CenterOnSequenceStart {
+			fd.centerIdleDrives()
+		}
+	case config.CmdSequenceStop:
+		fd.playing = false
+		fd.silenceAll()
 	}
+	hal.RestoreInterrupts(state)
 
-	fd.currentPosition[driveNum] = 0
-	fd.stepState[driveNum] = false
-	fd.dirPins[driveNum].Low()
-	fd.directionState[driveNum] = false
-	fd.setMovement(driveNum, true)
+	if command == config.CmdReset {
+		// ResetAll sleeps, so it holds interrupts off itself, in pieces.
+		fd.ResetAll()
+	}
 }
 
-// ResetAll returns all drives to position 0 simultaneously.
-func (fd *FloppyDrives) ResetAll() {
-	// Stop all drives and set direction to reverse.
+// centerIdleDrives starts moving every silent drive's head to the middle
+// of its travel window.
+func (fd *FloppyDrives) centerIdleDrives() {
 	for d := byte(firstDrive); d <= lastDrive; d++ {
-		fd.currentPeriod[d] = 0
-		fd.dirPins[d].High()
+		if fd.currentPeriod[d] != 0 || fd.homing[d] {
+			continue
+		}
+		center := (fd.minPosition[d] + fd.maxPosition[d]) / 2
+		fd.startMove(d, center, centerStepTicks)
 	}
+}
 
-	// Step all drives back together.
-	for s := uint16(0); s < config.MaxPosition; s += 2 {
-		for d := byte(firstDrive); d <= lastDrive; d++ {
-			fd.stepPins[d].High()
-			fd.stepPins[d].Low()
+// HandleDeviceMessage processes commands for individual drives.
+// Messages addressed to a zone alias are routed to the zone's drives.
+// Unknown commands and unusable payloads are counted in Stats and dropped,
+// as are commands only one drive can take sent to sub address 0x00.
+func (fd *FloppyDrives) HandleDeviceMessage(subAddress byte, command byte, payload []byte) {
+	if subAddress == 0x00 && command == config.DevCmdReset {
+		// ResetAll sleeps, so it holds interrupts off itself, in pieces.
+		fd.ResetAll()
+		return
+	}
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	fd.handleDeviceMessage(subAddress, command, payload)
+}
+
+// handleDeviceMessage is HandleDeviceMessage with interrupts held off.
+func (fd *FloppyDrives) handleDeviceMessage(subAddress byte, command byte, payload []byte) {
+	fd.quietChecks = 0
+	need, known := payloadSize(command)
+	if !known {
+		fd.Stats.UnknownCommands++
+		fd.noteFault(config.FaultUnknownCommand)
+		return
+	}
+	if len(payload) < need {
+		fd.Stats.InvalidPayloads++
+		fd.noteFault(config.FaultBadPayload)
+		return
+	}
+
+	if command == config.DevCmdSetZone {
+		fd.setZone(payload[0], payload[1], payload[2], payload[3])
+		fd.zonesChanged()
+		return
+	}
+	if subAddress >= config.ZoneSubAddress {
+		if z := int(subAddress - config.ZoneSubAddress); z < config.MaxZones {
+			fd.handleZoneMessage(&fd.zones[z], command, payload)
+		}
+		return
+	}
+	if subAddress > lastDrive {
+		return
+	}
+	if subAddress == 0x00 {
+		switch command {
+		case config.DevCmdNoteOn, config.DevCmdGliss, config.DevCmdTrill:
+			fd.Stats.BadSubAddress++
+			fd.noteFault(config.FaultBadSubAddress)
+			return
 		}
-		time.Sleep(5 * time.Millisecond)
 	}
 
-	// Reset all tracking state.
-	for d := byte(firstDrive); d <= lastDrive; d++ {
-		fd.currentPosition[d] = 0
-		fd.stepState[d] = false
-		fd.dirPins[d].Low()
-		fd.directionState[d] = false
-		fd.setMovement(d, true)
+	switch command {
+	case config.DevCmdReset:
+		// HandleDeviceMessage takes sub address 0x00 to ResetAll; should
+		// it come here, every drive homes.
+		if subAddress == 0x00 {
+			for d := byte(firstDrive); d <= lastDrive; d++ {
+				fd.startHoming(d)
+			}
+		} else {
+			fd.startHoming(subAddress)
+		}
+	case config.DevCmdNoteOn:
+		if payload[0] > 127 {
+			fd.Stats.InvalidPayloads++
+			fd.noteFault(config.FaultBadPayload)
+			return
+		}
+		if fd.startNote(subAddress, payload[0]) != nil || fd.homing[subAddress] {
+			return
+		}
+		if len(payload) > 1 && payload[1] >= config.AccentVelocity {
+			fd.accent(subAddress)
+		}
+	case config.DevCmdNoteOff:
+		if subAddress == 0x00 {
+			fd.silenceAll()
+			return
+		}
+		// A note-off naming a note only stops that note, so an overlapping
+		// legato note-on isn't cut short by its predecessor's note-off.
+		// Without a payload, stop whatever is playing.
+		if len(payload) > 0 && fd.legato[subAddress] && fd.releaseHeld(subAddress, payload[0]) {
+			return
+		}
+		if len(payload) > 0 && !fd.holds(subAddress, payload[0]) {
+			return
+		}
+		fd.stopNote(subAddress)
+	case config.DevCmdBendPitch:
+		// The wire carries a signed deflection; Bend takes the MIDI value.
+		bend := int32(int16(payload[0])<<8|int16(payload[1])) + 8192
+		if bend < 0 {
+			bend = 0
+		}
+		if subAddress == 0x00 {
+			for d := byte(firstDrive); d <= lastDrive; d++ {
+				fd.bendNote(d, uint16(bend))
+			}
+		} else {
+			fd.bendNote(subAddress, uint16(bend))
+		}
+	case config.DevCmdSetMovement:
+		if subAddress == 0x00 {
+			for d := byte(firstDrive); d <= lastDrive; d++ {
+				fd.setMovement(d, payload[0] == 0)
+			}
+		} else {
+			fd.setMovement(subAddress, payload[0] == 0)
+		}
+	case config.DevCmdGliss:
+		if payload[0] > 127 || payload[1] > 127 {
+			fd.Stats.InvalidPayloads++
+			fd.noteFault(config.FaultBadPayload)
+			return
+		}
+		smooth := len(payload) > 4 && payload[4]&config.GlissFlagSmooth != 0
+		fd.startGliss(subAddress, payload[0], payload[1],
+			uint16(payload[2])<<8|uint16(payload[3]), smooth)
+	case config.DevCmdTrill:
+		if payload[0] > 127 || payload[1] > 127 || payload[2] == 0 {
+			fd.Stats.InvalidPayloads++
+			fd.noteFault(config.FaultBadPayload)
+			return
+		}
+		fd.startTrill(subAddress, payload[0], payload[1], payload[2])
+	case config.DevCmdTranspose:
+		if subAddress == 0x00 {
+			for d := byte(firstDrive); d <= lastDrive; d++ {
+				fd.transpose[d] = int8(payload[0])
+			}
+		} else {
+			fd.transpose[subAddress] = int8(payload[0])
+		}
+	case config.DevCmdDetune:
+		if subAddress == 0x00 {
+			for d := byte(firstDrive); d <= lastDrive; d++ {
+				fd.setDetune(d, int8(payload[0]))
+			}
+		} else {
+			fd.setDetune(subAddress, int8(payload[0]))
+		}
+	case config.DevCmdBendRange:
+		if payload[0] < 1 || payload[0] > config.MaxBendRange {
+			fd.Stats.InvalidPayloads++
+			fd.noteFault(config.FaultBadPayload)
+			return
+		}
+		if subAddress == 0x00 {
+			for d := byte(firstDrive); d <= lastDrive; d++ {
+				fd.setBendRange(d, payload[0])
+			}
+		} else {
+			fd.setBendRange(subAddress, payload[0])
+		}
+	case config.DevCmdTremolo:
+		if payload[1] > 100 {
+			fd.Stats.InvalidPayloads++
+			fd.noteFault(config.FaultBadPayload)
+			return
+		}
+		if subAddress == 0x00 {
+			for d := byte(firstDrive); d <= lastDrive; d++ {
+				fd.setTremolo(d, payload[0], payload[1])
+			}
+		} else {
+			fd.setTremolo(subAddress, payload[0], payload[1])
+		}
+	case config.DevCmdChannelPressure:
+		if payload[0] > 127 {
+			fd.Stats.InvalidPayloads++
+			fd.noteFault(config.FaultBadPayload)
+			return
+		}
+		if subAddress == 0x00 {
+			for d := byte(firstDrive); d <= lastDrive; d++ {
+				fd.setPressure(d, payload[0])
+			}
+		} else {
+			fd.setPressure(subAddress, payload[0])
+		}
+	case config.DevCmdSetOption:
+		if subAddress == 0x00 {
+			for d := byte(firstDrive); d <= lastDrive; d++ {
+				fd.setOption(d, payload[0], payload[1])
+			}
+		} else {
+			fd.setOption(subAddress, payload[0], payload[1])
+		}
+	case config.DevCmdSustain:
+		if subAddress == 0x00 {
+			for d := byte(firstDrive); d <= lastDrive; d++ {
+				fd.setSustain(d, payload[0] != 0)
+			}
+		} else {
+			fd.setSustain(subAddress, payload[0] != 0)
+		}
+	case config.DevCmdFactoryReset:
+		fd.factoryReset(subAddress)
+	case config.DevCmdSetTravel:
+		// Four bytes are two big-endian 16-bit ends, as a scanner takes.
+		lo, hi := uint16(payload[0]), uint16(payload[1])
+		if len(payload) >= 4 {
+			lo = uint16(payload[0])<<8 | uint16(payload[1])
+			hi = uint16(payload[2])<<8 | uint16(payload[3])
+		}
+		if lo >= hi || hi > config.MaxPosition {
+			fd.Stats.InvalidPayloads++
+			fd.noteFault(config.FaultBadPayload)
+			return
+		}
+		if subAddress == 0x00 {
+			for d := byte(firstDrive); d <= lastDrive; d++ {
+				fd.setTravel(d, lo, hi)
+			}
+		} else {
+			fd.setTravel(subAddress, lo, hi)
+		}
+	}
+
+	switch command {
+	case config.DevCmdTranspose, config.DevCmdDetune, config.DevCmdBendRange,
+		config.DevCmdSetOption, config.DevCmdSetTravel, config.DevCmdSetMovement:
+		fd.settingsChanged(subAddress)
+	}
+}
+
+// PlayNote starts note (before transpose) on a drive, replacing whatever
+// it was playing, as a DevCmdNoteOn without velocity does. A drive that is
+// re-homing plays the note once it is back. Returns ErrNoDrive for a drive
+// outside 1..config.NumDrives and ErrBadNote for a note the drive won't
+// play under config.NoteRangePolicy.
+func (fd *FloppyDrives) PlayNote(drive, note byte) error {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	return fd.startNote(drive, note)
+}
+
+// startNote is PlayNote with interrupts held off.
+func (fd *FloppyDrives) startNote(drive, note byte) error {
+	if drive < firstDrive || drive > lastDrive {
+		return ErrNoDrive
+	}
+	if note > 127 {
+		return ErrBadNote
+	}
+	if fd.homing[drive] {
+		fd.pendingNote[drive] = note
+		fd.hasPending[drive] = true
+		fd.holdNote(drive, note)
+		return nil
+	}
+	// Hold the drive before the note is set up, so Tick can't step it early.
+	fd.startCountdown[drive] = uint16(fd.startDelay[drive]) * notes.TicksPerMs
+	if !fd.playNote(drive, note) {
+		fd.startCountdown[drive] = 0
+		return ErrBadNote
+	}
+	fd.holdNote(drive, note)
+	return nil
+}
+
+// StopNote stops whatever a drive is playing, or is waiting to play once
+// re-homed. While the sustain pedal is down the note rings on until it
+// lifts. Drives outside 1..config.NumDrives are ignored.
+func (fd *FloppyDrives) StopNote(drive byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	fd.stopNote(drive)
+}
+
+// stopNote is StopNote with interrupts held off.
+func (fd *FloppyDrives) stopNote(drive byte) {
+	if drive < firstDrive || drive > lastDrive {
+		return
+	}
+	fd.heldCount[drive] = 0
+	if fd.homing[drive] {
+		fd.hasPending[drive] = false
+		return
+	}
+	fd.glissCountdown[drive] = 0
+	fd.accentCountdown[drive] = 0
+	fd.trillCountdown[drive] = 0
+	fd.startCountdown[drive] = 0
+	fd.vibratoDepth[drive] = 0
+	if fd.sustain[drive] {
+		fd.released[drive] = true
+		return
+	}
+	fd.currentPeriod[drive] = 0
+	fd.originalPeriod[drive] = 0
+}
+
+// Bend bends the note a drive is playing by a 14-bit MIDI pitch bend value
+// (0..16383, 8192 = unbent); either end reaches the drive's bend range.
+// Drives outside 1..config.NumDrives are ignored.
+func (fd *FloppyDrives) Bend(drive byte, bend uint16) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	fd.bendNote(drive, bend)
+}
+
+// bendNote is Bend with interrupts held off.
+func (fd *FloppyDrives) bendNote(drive byte, bend uint16) {
+	if drive < firstDrive || drive > lastDrive {
+		return
+	}
+	if bend > 0x3FFF {
+		bend = 0x3FFF
+	}
+	fd.bendPitch(drive, int16(bend)-8192)
+}
+
+// holdNote pushes a note onto a legato drive's held notes, moving it to
+// the top if it is already there and forgetting the oldest if full.
+func (fd *FloppyDrives) holdNote(drive, note byte) {
+	if !fd.legato[drive] {
+		return
+	}
+	fd.dropHeld(drive, note)
+	held := &fd.held[drive]
+	if fd.heldCount[drive] == legatoDepth {
+		copy(held[:], held[1:])
+		fd.heldCount[drive]--
+	}
+	held[fd.heldCount[drive]] = note
+	fd.heldCount[drive]++
+}
+
+// dropHeld removes a note from a drive's held notes, reporting whether it
+// was there.
+func (fd *FloppyDrives) dropHeld(drive, note byte) bool {
+	held := fd.held[drive][:fd.heldCount[drive]]
+	for i, n := range held {
+		if n == note {
+			copy(held[i:], held[i+1:])
+			fd.heldCount[drive]--
+			return true
+		}
+	}
+	return false
+}
+
+// releaseHeld handles a note-off on a legato drive. The note is forgotten;
+// if it was sounding and other notes are still held, the drive goes back
+// to the most recent of them, keeping any bend. Returns false when the
+// note-off should be handled as usual: the note wasn't held, or was the
+// last one.
+func (fd *FloppyDrives) releaseHeld(drive, note byte) bool {
+	if !fd.dropHeld(drive, note) {
+		return false
+	}
+	if !fd.holds(drive, note) {
+		return true
+	}
+	if fd.heldCount[drive] == 0 {
+		return false
+	}
+	prev := fd.held[drive][fd.heldCount[drive]-1]
+	if fd.homing[drive] {
+		fd.pendingNote[drive] = prev
+		return true
+	}
+	bend := fd.bend[drive]
+	fd.startCountdown[drive] = 0
+	if !fd.playNote(drive, prev) {
+		fd.stopNote(drive)
+		return true
+	}
+	if bend != 0 {
+		fd.bendPitch(drive, bend)
+	}
+	return true
+}
+
+// holds reports whether note is the one a drive is playing (either note of
+// a trill), or while re-homing, the one it is waiting to play.
+func (fd *FloppyDrives) holds(drive, note byte) bool {
+	if fd.homing[drive] {
+		return note == fd.pendingNote[drive]
+	}
+	return note == fd.currentNote[drive] ||
+		(fd.trillCountdown[drive] != 0 && note == fd.trillNote[drive])
+}
+
+// payloadSize returns the minimum payload length of a device command, and
+// whether the drives implement the command at all.
+func payloadSize(command byte) (int, bool) {
+	switch command {
+	case config.DevCmdReset, config.DevCmdNoteOff, config.DevCmdFactoryReset:
+		return 0, true
+	case config.DevCmdNoteOn, config.DevCmdSetMovement, config.DevCmdTranspose,
+		config.DevCmdDetune, config.DevCmdBendRange, config.DevCmdChannelPressure,
+		config.DevCmdSustain:
+		return 1, true
+	case config.DevCmdBendPitch, config.DevCmdSetOption, config.DevCmdTremolo,
+		config.DevCmdSetTravel:
+		return 2, true
+	case config.DevCmdTrill:
+		return 3, true
+	case config.DevCmdGliss, config.DevCmdSetZone:
+		return 4, true
+	}
+	return 0, false
+}
+
+// playNote starts note (before transpose) on a drive, cancelling any slide.
+// It reports false if the note is out of range and was dropped.
+func (fd *FloppyDrives) playNote(driveNum, note byte) bool {
+	n, ok := fd.playable(driveNum, note)
+	if !ok {
+		return false
+	}
+	fd.wake(driveNum)
+	fd.glissCountdown[driveNum] = 0
+	fd.accentCountdown[driveNum] = 0
+	fd.trillCountdown[driveNum] = 0
+	fd.fitTravel(driveNum, n)
+	fd.currentPeriod[driveNum] = fd.noteTicks(driveNum, n)
+	fd.originalPeriod[driveNum] = fd.currentPeriod[driveNum]
+	fd.bend[driveNum] = 0
+	fd.tremoloTick[driveNum] = 0
+	fd.noteCount++
+	fd.lastUsed[driveNum] = fd.noteCount
+	fd.currentNote[driveNum] = note
+	fd.released[driveNum] = false
+	if fd.stagger && !fd.inUnisonZone(driveNum) {
+		fd.currentTick[driveNum] = uint16(driveNum-firstDrive) % fd.currentPeriod[driveNum]
+	}
+	return true
+}
+
+// inUnisonZone reports whether a drive belongs to a unison zone.
+func (fd *FloppyDrives) inUnisonZone(driveNum byte) bool {
+	for i := range fd.zones {
+		z := &fd.zones[i]
+		if z.first != 0 && z.mode == config.ZoneUnison && driveNum >= z.first && driveNum <= z.last {
+			return true
+		}
+	}
+	return false
+}
+
+// startGliss begins a slide from start to end over durationMs, stepping
+// chromatically (or interpolating the period when smooth is set). The
+// slide is advanced from Tick and leaves end sounding.
+func (fd *FloppyDrives) startGliss(driveNum, start, end byte, durationMs uint16, smooth bool) {
+	from, ok := fd.playable(driveNum, start)
+	if !ok {
+		return
+	}
+	to, ok := fd.playable(driveNum, end)
+	if !ok {
+		return
+	}
+	fd.glissCountdown[driveNum] = 0
+	fd.accentCountdown[driveNum] = 0
+	fd.trillCountdown[driveNum] = 0
+	fd.startCountdown[driveNum] = 0
+	fd.wake(driveNum)
+	fd.fitTravel(driveNum, from)
+
+	fd.currentPeriod[driveNum] = fd.noteTicks(driveNum, from)
+	fd.originalPeriod[driveNum] = fd.currentPeriod[driveNum]
+	fd.bend[driveNum] = 0
+	fd.tremoloTick[driveNum] = 0
+	fd.noteCount++
+	fd.lastUsed[driveNum] = fd.noteCount
+	fd.currentNote[driveNum] = end
+	fd.released[driveNum] = false
+	if from == to || durationMs == 0 {
+		fd.currentPeriod[driveNum] = fd.noteTicks(driveNum, to)
+		fd.originalPeriod[driveNum] = fd.currentPeriod[driveNum]
+		return
+	}
+
+	fd.glissNote[driveNum] = from
+	fd.glissEnd[driveNum] = to
+	fd.glissSmooth[driveNum] = smooth
+	fd.glissStepTicks[driveNum] = notes.Gliss(from, to, durationMs)
+	// Arm last: Tick only looks at a slide once the countdown is non-zero.
+	fd.glissCountdown[driveNum] = fd.glissStepTicks[driveNum]
+}
+
+// fitTravel sets a drive's bounce window for a starting note (after
+// transpose). Without register travel it is the whole movement range;
+// with it, a half or quarter of the range around the head's position.
+func (fd *FloppyDrives) fitTravel(driveNum, note byte) {
+	lo, hi := fd.minPosition[driveNum], fd.maxPosition[driveNum]
+	if !fd.registerTravel[driveNum] || note < fd.splitLow[driveNum] {
+		fd.setBounce(driveNum, lo, hi)
+		return
+	}
+	width := (hi - lo) / 2
+	if note >= fd.splitHigh[driveNum] {
+		width = (hi - lo) / 4
+	}
+	pos := fd.currentPosition[driveNum]
+	if pos < lo {
+		pos = lo
+	} else if pos > hi {
+		pos = hi
+	}
+	start := lo
+	if pos-lo > width/2 {
+		start = pos - width/2
+	}
+	if start > hi-width {
+		start = hi - width
+	}
+	fd.setBounce(driveNum, start, start+width)
+}
+
+// setBounce sets a drive's bounce window, working out the soft bounce
+// squeeze that balances the eased ends.
+func (fd *FloppyDrives) setBounce(driveNum byte, lo, hi uint16) {
+	fd.bounceMin[driveNum] = lo
+	fd.bounceMax[driveNum] = hi
+	if !fd.soft {
+		return
+	}
+	fd.softSqueeze[driveNum] = 0
+	if hi-lo <= 2*config.SoftBounceSteps {
+		return
+	}
+	// A traversal passes each eased position once, save the limit it starts
+	// from, and hi-lo-2K+1 positions in between.
+	var ends uint32
+	for dist := uint16(0); dist < config.SoftBounceSteps; dist++ {
+		ends += 2 * softStretch(dist)
+	}
+	ends -= softStretch(0)
+	inner := uint32(hi - lo - 2*config.SoftBounceSteps + 1)
+	fd.softSqueeze[driveNum] = uint16((ends + inner/2) / inner)
+}
+
+// softStretch is the soft bounce stretch dist steps from a limit, in
+// 1/65536ths of the period.
+func softStretch(dist uint16) uint32 {
+	const atLimit = config.SoftBounceStretch * 65536 / 100
+	return atLimit * uint32(config.SoftBounceSteps-dist) / config.SoftBounceSteps
+}
+
+// softBounce works out the soft bounce offset for a drive's next step from
+// its head position. Called from Tick after each step.
+func (fd *FloppyDrives) softBounce(driveNum byte) {
+	if fd.softSqueeze[driveNum] == 0 {
+		fd.softExtra[driveNum] = 0
+		return
+	}
+	pos, lo, hi := fd.currentPosition[driveNum], fd.bounceMin[driveNum], fd.bounceMax[driveNum]
+	dist := uint16(0)
+	if pos > lo && pos < hi {
+		dist = pos - lo
+		if hi-pos < dist {
+			dist = hi - pos
+		}
+	}
+	scale := -int32(fd.softSqueeze[driveNum])
+	if dist < config.SoftBounceSteps {
+		scale = int32(softStretch(dist))
+	}
+	period := fd.currentPeriod[driveNum]
+	if fd.vibratoDepth[driveNum] != 0 && !fd.effectsShed {
+		period = fd.stepPeriod[driveNum]
+	}
+	x := int32(period)*scale + fd.softResidue[driveNum]
+	extra := x >> 16
+	fd.softResidue[driveNum] = x - extra<<16
+	fd.softExtra[driveNum] = int16(extra)
+}
+
+// accent starts an accented attack on the note a drive just began, if
+// accents are enabled for it. Tick ends the attack.
+func (fd *FloppyDrives) accent(driveNum byte) {
+	if fd.accentMs[driveNum] == 0 || fd.originalPeriod[driveNum] == 0 {
+		return
+	}
+	period := fd.originalPeriod[driveNum]
+	if fd.accentStyle[driveNum] == config.AccentDoubleRate {
+		if period > 1 {
+			period /= 2
+		}
+	} else if period <= 0x7FFF {
+		period *= 2
+	}
+	fd.currentPeriod[driveNum] = period
+	fd.accentCountdown[driveNum] = uint16(fd.accentMs[driveNum]) * notes.TicksPerMs
+}
+
+// noteTicks returns the half-period in ticks of a (playable) note on a
+// drive, including its detune. With no detune this is exactly the table value.
+func (fd *FloppyDrives) noteTicks(driveNum, note byte) uint16 {
+	if fd.detune[driveNum] == 0 {
+		return notes.NoteDoubleTicks[note]
+	}
+	return notes.ScalePeriod(notes.NoteDoubleTicks[note], fd.periodScale[driveNum])
+}
+
+// setDetune sets a drive's fine tuning in cents. The held note is retuned
+// at its next note-on.
+func (fd *FloppyDrives) setDetune(driveNum byte, cents int8) {
+	// A higher pitch means a shorter period, hence the negated cents.
+	fd.periodScale[driveNum] = notes.SemitoneRatioQ16(-int16(cents))
+	fd.detune[driveNum] = cents
+}
+
+// playable applies the drive's transpose to a requested note and fits the
+// result into 0..MaxFloppyNote according to config.NoteRangePolicy.
+// ok is false if the note should not be played at all.
+func (fd *FloppyDrives) playable(driveNum, note byte) (byte, bool) {
+	if note > 127 {
+		return 0, false
+	}
+	return fitNote(int16(note)+int16(fd.transpose[driveNum]), config.NoteRangePolicy)
+}
+
+// fitNote fits a transposed note into 0..MaxFloppyNote under a range
+// policy. ok is false if the policy drops it.
+func fitNote(n int16, policy byte) (note byte, ok bool) {
+	switch policy {
+	case config.RangeClamp:
+		if n < 0 {
+			n = 0
+		} else if n > MaxFloppyNote {
+			n = MaxFloppyNote
+		}
+	case config.RangeFold:
+		for n > MaxFloppyNote {
+			n -= 12
+		}
+		for n < 0 {
+			n += 12
+		}
+	default:
+		if n < 0 || n > MaxFloppyNote {
+			return 0, false
+		}
+	}
+	return byte(n), true
+}
+
+// setOption applies one DevCmdSetOption setting to a drive.
+// Unknown options are ignored.
+func (fd *FloppyDrives) setOption(driveNum, option, value byte) {
+	switch option {
+	case config.OptDirCadence:
+		fd.dirCadence[driveNum] = value
+	case config.OptCalibration:
+		fd.calibration[driveNum] = value
+	case config.OptAccentMs:
+		fd.accentMs[driveNum] = value
+	case config.OptAccentStyle:
+		fd.accentStyle[driveNum] = value
+	case config.OptVibratoRate:
+		fd.vibratoRate[driveNum] = value
+	case config.OptVibratoDepth:
+		fd.vibratoMaxCents[driveNum] = value
+	case config.OptRegisterTravel:
+		fd.registerTravel[driveNum] = value != 0
+		if value == 0 {
+			fd.setBounce(driveNum, fd.minPosition[driveNum], fd.maxPosition[driveNum])
+		}
+	case config.OptTravelSplitLow:
+		fd.splitLow[driveNum] = value
+	case config.OptTravelSplitHigh:
+		fd.splitHigh[driveNum] = value
+	case config.OptStartDelay:
+		if value > config.MaxStartDelayMs {
+			value = config.MaxStartDelayMs
+		}
+		fd.startDelay[driveNum] = value
+	case config.OptLegato:
+		fd.legato[driveNum] = value != 0
+		fd.heldCount[driveNum] = 0
+	case config.OptTravelMin:
+		if hi := fd.travelMax[driveNum]; uint16(value) < hi {
+			fd.setTravel(driveNum, uint16(value), hi)
+		}
+	case config.OptTravelMax:
+		if lo := fd.travelMin[driveNum]; uint16(value) > lo && value <= config.MaxPosition {
+			fd.setTravel(driveNum, lo, uint16(value))
+		}
+	case config.OptMovementClamp:
+		fd.setMovement(driveNum, value == 0)
+	}
+}
+
+// option returns a drive's current value of a DevCmdSetOption setting,
+// or 0 for an unknown option.
+func (fd *FloppyDrives) option(driveNum, option byte) byte {
+	switch option {
+	case config.OptDirCadence:
+		return fd.dirCadence[driveNum]
+	case config.OptCalibration:
+		return fd.calibration[driveNum]
+	case config.OptAccentMs:
+		return fd.accentMs[driveNum]
+	case config.OptAccentStyle:
+		return fd.accentStyle[driveNum]
+	case config.OptVibratoRate:
+		return fd.vibratoRate[driveNum]
+	case config.OptVibratoDepth:
+		return fd.vibratoMaxCents[driveNum]
+	case config.OptRegisterTravel:
+		if fd.registerTravel[driveNum] {
+			return 1
+		}
+	case config.OptTravelSplitLow:
+		return fd.splitLow[driveNum]
+	case config.OptTravelSplitHigh:
+		return fd.splitHigh[driveNum]
+	case config.OptStartDelay:
+		return fd.startDelay[driveNum]
+	case config.OptLegato:
+		if fd.legato[driveNum] {
+			return 1
+		}
+	case config.OptTravelMin:
+		return byte(fd.travelMin[driveNum])
+	case config.OptTravelMax:
+		return byte(fd.travelMax[driveNum])
+	case config.OptMovementClamp:
+		if fd.wiggle[driveNum] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// defaultSettings puts a drive's saved settings back to their power-on
+// values.
+func (fd *FloppyDrives) defaultSettings(driveNum byte) {
+	fd.transpose[driveNum] = 0
+	fd.setDetune(driveNum, 0)
+	fd.setBendRange(driveNum, config.DefaultBendRange)
+	fd.dirCadence[driveNum] = 0
+	fd.calibration[driveNum] = 0
+	fd.accentMs[driveNum] = 0
+	fd.accentStyle[driveNum] = config.AccentOctaveDown
+	fd.vibratoRate[driveNum] = config.DefaultVibratoRate
+	fd.vibratoMaxCents[driveNum] = config.DefaultVibratoDepth
+	fd.splitLow[driveNum] = config.TravelSplitLow
+	fd.splitHigh[driveNum] = config.TravelSplitHigh
+	fd.startDelay[driveNum] = 0
+	fd.legato[driveNum] = false
+	fd.heldCount[driveNum] = 0
+	fd.wiggle[driveNum] = false
+	fd.setTravel(driveNum, 0, config.MaxPosition)
+	fd.registerTravel[driveNum] = config.RegisterTravel
+	if !config.RegisterTravel {
+		fd.setBounce(driveNum, fd.minPosition[driveNum], fd.maxPosition[driveNum])
+	}
+}
+
+// driveSettings appends a drive's settings block to dst: [transpose,
+// detune, bend_range], then each of savedOptions.
+func (fd *FloppyDrives) driveSettings(driveNum byte, dst []byte) []byte {
+	dst = append(dst, byte(fd.transpose[driveNum]), byte(fd.detune[driveNum]),
+		fd.bendRange[driveNum])
+	for _, opt := range savedOptions {
+		dst = append(dst, fd.option(driveNum, opt))
+	}
+	return dst
+}
+
+// applySettings restores a drive's settings from a block written by
+// driveSettings. A short block, from older firmware, leaves the missing
+// settings as they are.
+func (fd *FloppyDrives) applySettings(driveNum byte, data []byte) {
+	for i, v := range data {
+		switch {
+		case i == 0:
+			fd.transpose[driveNum] = int8(v)
+		case i == 1:
+			fd.setDetune(driveNum, int8(v))
+		case i == 2:
+			if v >= 1 && v <= config.MaxBendRange {
+				fd.setBendRange(driveNum, v)
+			}
+		case i-3 < len(savedOptions):
+			fd.setOption(driveNum, savedOptions[i-3], v)
+		}
+	}
+}
+
+// zoneSettings appends the zones to dst, as the device's settings block:
+// [first, last, mode] for each of config.MaxZones, first 0 for none.
+func (fd *FloppyDrives) zoneSettings(dst []byte) []byte {
+	for _, z := range fd.zones {
+		dst = append(dst, z.first, z.last, z.mode)
+	}
+	return dst
+}
+
+// applyZoneSettings restores the zones from a block written by
+// zoneSettings. A zone that no longer fits the drives is left undefined.
+func (fd *FloppyDrives) applyZoneSettings(data []byte) {
+	for i := 0; i+3 <= len(data) && i/3 < config.MaxZones; i += 3 {
+		fd.setZone(byte(i/3+1), data[i], data[i+1], data[i+2])
+	}
+}
+
+// loadSettings restores every drive's settings, and the zones, from
+// EEPROM. Drives with nothing valid saved keep their defaults.
+func (fd *FloppyDrives) loadSettings() {
+	var buf [settings.MaxData]byte
+	for d := byte(firstDrive); d <= lastDrive; d++ {
+		n := settings.LoadDrive(d, buf[:])
+		fd.applySettings(d, buf[:n])
+	}
+	n := settings.LoadDevice(buf[:])
+	fd.applyZoneSettings(buf[:n])
+}
+
+// settingsChanged schedules a save of a drive's settings, or of every
+// drive's for sub address 0x00, once they have stopped changing.
+func (fd *FloppyDrives) settingsChanged(subAddress byte) {
+	if !config.PersistSettings {
+		return
+	}
+	if subAddress == 0x00 {
+		for d := byte(firstDrive); d <= lastDrive; d++ {
+			fd.saveDirty[d] = true
+		}
+	} else {
+		fd.saveDirty[subAddress] = true
+	}
+	fd.saveCountdown = saveDelayChecks
+}
+
+// zonesChanged schedules a save of the zones, as settingsChanged does a
+// drive's settings.
+func (fd *FloppyDrives) zonesChanged() {
+	if !config.PersistSettings {
+		return
+	}
+	fd.saveZones = true
+	fd.saveCountdown = saveDelayChecks
+}
+
+// SaveDriveSettings writes changed drive settings and zones to EEPROM once
+// they have been left alone for config.SaveDelayMs, unless a sequence is
+// playing.
+// It blocks - for about 3.4ms per changed EEPROM byte on the ATmega328P,
+// for a flash erase on the RP2040 - so call it from the main loop, never
+// from interrupt context.
+func (fd *FloppyDrives) SaveDriveSettings() {
+	if !config.PersistSettings || fd.playing {
+		return
+	}
+	state := hal.DisableInterrupts()
+	waiting := fd.saveCountdown > 0
+	hal.RestoreInterrupts(state)
+	if waiting {
+		return
+	}
+	var buf [settings.MaxData]byte
+	for d := byte(firstDrive); d <= lastDrive; d++ {
+		if fd.saveDirty[d] {
+			fd.saveDirty[d] = false
+			settings.SaveDrive(d, fd.driveSettings(d, buf[:0]))
+		}
+	}
+	if fd.saveZones {
+		fd.saveZones = false
+		settings.SaveDevice(fd.zoneSettings(buf[:0]))
+	}
+}
+
+// factoryReset forgets the saved settings of a drive, or of every drive
+// and the zones for sub address 0x00, and restores their defaults.
+func (fd *FloppyDrives) factoryReset(subAddress byte) {
+	if subAddress == 0x00 {
+		if config.PersistSettings {
+			settings.ClearAll()
+		}
+		for d := byte(firstDrive); d <= lastDrive; d++ {
+			fd.saveDirty[d] = false
+			fd.defaultSettings(d)
+		}
+		fd.saveZones = false
+		fd.zones = [config.MaxZones]zone{}
+		return
+	}
+	if config.PersistSettings {
+		settings.ClearDrive(subAddress)
+	}
+	fd.saveDirty[subAddress] = false
+	fd.defaultSettings(subAddress)
+}
+
+// DriveConfig appends driveNum's settings to dst in CmdConfig payload order
+// (after the device address): [transpose, dir_cadence, calibration, detune,
+// bend_range, sounding_ticks (big-endian uint32), start_delay, travel_min,
+// travel_max]. Drives
+// outside 1..config.NumDrives leave dst unchanged.
+func (fd *FloppyDrives) DriveConfig(driveNum byte, dst []byte) []byte {
+	if driveNum < firstDrive || driveNum > lastDrive {
+		return dst
+	}
+	state := hal.DisableInterrupts()
+	t := fd.soundingTicks[driveNum]
+	hal.RestoreInterrupts(state)
+	return append(dst, byte(fd.transpose[driveNum]), fd.dirCadence[driveNum],
+		fd.calibration[driveNum], byte(fd.detune[driveNum]), fd.bendRange[driveNum],
+		byte(t>>24), byte(t>>16), byte(t>>8), byte(t), fd.startDelay[driveNum],
+		byte(fd.travelMin[driveNum]), byte(fd.travelMax[driveNum]))
+}
+
+// DrivePosition returns a drive's head position, 0..config.MaxPosition.
+func (fd *FloppyDrives) DrivePosition(driveNum byte) (uint16, bool) {
+	if driveNum < firstDrive || driveNum > lastDrive {
+		return 0, false
+	}
+	// Two bytes on AVR: a Tick between them could tear the read.
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	return fd.currentPosition[driveNum], true
+}
+
+// DeviceStatus returns the drives' part of a CmdStatus reply: the
+// seconds since they started, the drives sounding (bit 0 for drive 1),
+// and the last config.Fault they ran into, with how many there have been.
+func (fd *FloppyDrives) DeviceStatus() (uptime uint32, drives uint16, fault byte, faults uint16) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	for d := byte(firstDrive); d <= lastDrive; d++ {
+		if fd.currentPeriod[d] != 0 && !fd.muted[d] {
+			drives |= 1 << (d - 1)
+		}
+	}
+	return fd.uptime, drives, fd.fault, fd.faults
+}
+
+// noteFault records fault as the last the drives ran into.
+func (fd *FloppyDrives) noteFault(fault byte) {
+	fd.fault = fault
+	fd.faults++
+	fd.led.SetState(status.Fault)
+}
+
+// DrivePins returns the pins a drive's STEP and DIRECTION lines are on,
+// and false with the lines behind the shift register or for a drive out
+// of range.
+func (fd *FloppyDrives) DrivePins(driveNum byte) (step, dir hal.Pin, ok bool) {
+	if config.ShiftRegister || driveNum < firstDrive || driveNum > lastDrive {
+		return 0, 0, false
+	}
+	return fd.stepPins[driveNum], fd.dirPins[driveNum], true
+}
+
+// SetLines drives a silent drive's STEP and DIRECTION lines directly, for
+// wiring checks such as cmd/selftest. A STEP edge moves the head without
+// the position following it: re-home the drive afterwards.
+func (fd *FloppyDrives) SetLines(driveNum byte, step, dir bool) {
+	if driveNum < firstDrive || driveNum > lastDrive {
+		return
+	}
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	fd.setDirection(driveNum, dir)
+	fd.setStep(driveNum, step)
+	fd.stepState[driveNum] = step
+	fd.flush()
+}
+
+// startTrill plays noteA and noteB (before transpose) alternately on a
+// drive, switching every rateMs, until the next note-on, note-off or reset.
+func (fd *FloppyDrives) startTrill(driveNum, noteA, noteB, rateMs byte) {
+	b, ok := fd.playable(driveNum, noteB)
+	if !ok {
+		return
+	}
+	if !fd.playNote(driveNum, noteA) {
+		return
+	}
+	fd.trillBase[driveNum][0] = fd.originalPeriod[driveNum]
+	fd.trillBase[driveNum][1] = fd.noteTicks(driveNum, b)
+	fd.trillBent[driveNum] = fd.trillBase[driveNum]
+	fd.startCountdown[driveNum] = 0
+	fd.trillOnSecond[driveNum] = false
+	fd.trillNote[driveNum] = noteB
+	fd.trillTicks[driveNum] = uint16(rateMs) * notes.TicksPerMs
+	// Arm last: Tick only alternates once the countdown is non-zero.
+	fd.trillCountdown[driveNum] = fd.trillTicks[driveNum]
+}
+
+// advanceTrill counts down to a drive's next trill switch. Called from Tick.
+func (fd *FloppyDrives) advanceTrill(driveNum byte) {
+	fd.trillCountdown[driveNum]--
+	if fd.trillCountdown[driveNum] > 0 {
+		return
+	}
+	fd.trillOnSecond[driveNum] = !fd.trillOnSecond[driveNum]
+	if fd.trillOnSecond[driveNum] {
+		fd.currentPeriod[driveNum] = fd.trillBent[driveNum][1]
+	} else {
+		fd.currentPeriod[driveNum] = fd.trillBent[driveNum][0]
+	}
+	fd.trillCountdown[driveNum] = fd.trillTicks[driveNum]
+}
+
+// advanceGliss moves a running slide on by one tick. Called from Tick.
+func (fd *FloppyDrives) advanceGliss(driveNum byte) {
+	next := fd.glissNote[driveNum] + 1
+	if fd.glissEnd[driveNum] < fd.glissNote[driveNum] {
+		next = fd.glissNote[driveNum] - 1
+	}
+
+	fd.glissCountdown[driveNum]--
+	if fd.glissCountdown[driveNum] == 0 {
+		fd.glissNote[driveNum] = next
+		fd.currentPeriod[driveNum] = fd.noteTicks(driveNum, next)
+		fd.originalPeriod[driveNum] = fd.currentPeriod[driveNum]
+		if next != fd.glissEnd[driveNum] {
+			fd.glissCountdown[driveNum] = fd.glissStepTicks[driveNum]
+		}
+		return
+	}
+
+	// Smooth slides refresh the period every 32 ticks, not every tick,
+	// to keep the division out of most interrupts.
+	if fd.glissSmooth[driveNum] && fd.glissCountdown[driveNum]&31 == 0 {
+		step := fd.glissStepTicks[driveNum]
+		fd.currentPeriod[driveNum] = notes.Glide(
+			fd.noteTicks(driveNum, fd.glissNote[driveNum]), fd.noteTicks(driveNum, next),
+			step-fd.glissCountdown[driveNum], step)
+		fd.originalPeriod[driveNum] = fd.currentPeriod[driveNum]
+	}
+}
+
+// setZone defines zone number (1-based) as drives first..last in mode.
+// first == 0 clears the zone. Invalid definitions are ignored.
+func (fd *FloppyDrives) setZone(number, first, last, mode byte) {
+	if number == 0 || number > config.MaxZones {
+		return
+	}
+	z := &fd.zones[number-1]
+	if first == 0 {
+		*z = zone{}
+		return
+	}
+	if last < first || last > lastDrive || mode > config.ZonePoolLRU {
+		return
+	}
+	*z = zone{first: first, last: last, mode: mode, next: first}
+}
+
+// handleZoneMessage routes a message addressed to a zone. Unison zones
+// forward everything to every member. Pool zones place each note-on on a
+// free member (a drive only held by the sustain pedal counts as free if
+// nothing else is), send note-offs to the member playing that note, and
+// forward everything else to all members.
+func (fd *FloppyDrives) handleZoneMessage(z *zone, command byte, payload []byte) {
+	if z.first == 0 {
+		return
+	}
+	if z.mode != config.ZoneUnison && len(payload) > 0 {
+		switch command {
+		case config.DevCmdNoteOn:
+			if d := fd.poolDrive(z); d != 0 {
+				fd.handleDeviceMessage(d, command, payload)
+			}
+			return
+		case config.DevCmdNoteOff:
+			for d := z.first; d <= z.last; d++ {
+				if fd.originalPeriod[d] != 0 && fd.currentNote[d] == payload[0] {
+					fd.handleDeviceMessage(d, command, payload)
+					return
+				}
+			}
+			return
+		}
+	}
+	for d := z.first; d <= z.last; d++ {
+		fd.handleDeviceMessage(d, command, payload)
+	}
+}
+
+// poolDrive picks the drive in a pool zone for a new note: a silent drive
+// (the next one round-robin, or for ZonePoolLRU the one idle longest), else
+// a drive only sounding under the sustain pedal. Returns 0 when every member
+// is busy.
+func (fd *FloppyDrives) poolDrive(z *zone) byte {
+	var sustained, idlest byte
+	var idlestAge uint16
+	d := z.next
+	for i := z.first; i <= z.last; i++ {
+		if fd.originalPeriod[d] == 0 {
+			if z.mode != config.ZonePoolLRU {
+				z.next = d + 1
+				if z.next > z.last {
+					z.next = z.first
+				}
+				return d
+			}
+			if age := fd.noteCount - fd.lastUsed[d]; idlest == 0 || age > idlestAge {
+				idlest, idlestAge = d, age
+			}
+		}
+		if sustained == 0 && fd.released[d] {
+			sustained = d
+		}
+		d++
+		if d > z.last {
+			d = z.first
+		}
+	}
+	if idlest != 0 {
+		return idlest
+	}
+	return sustained
+}
+
+// setSustain presses or lifts the sustain pedal for a drive. Lifting it
+// stops a note whose note-off arrived while the pedal was down.
+func (fd *FloppyDrives) setSustain(driveNum byte, on bool) {
+	fd.sustain[driveNum] = on
+	if !on && fd.released[driveNum] {
+		fd.released[driveNum] = false
+		fd.currentPeriod[driveNum] = 0
+		fd.originalPeriod[driveNum] = 0
+	}
+}
+
+// bendPitch applies a signed pitch bend deflection (-8192..8191) to a
+// drive's current note. The deflection is kept so a bend range change can
+// re-apply it.
+func (fd *FloppyDrives) bendPitch(driveNum byte, deflection int16) {
+	if fd.originalPeriod[driveNum] == 0 {
+		return
+	}
+	// A bend ends an accented attack early rather than being undone by it.
+	fd.accentCountdown[driveNum] = 0
+	fd.bend[driveNum] = deflection
+	if fd.trillCountdown[driveNum] > 0 {
+		r := fd.bendRange[driveNum]
+		fd.trillBent[driveNum][0] = notes.BendTicks(fd.trillBase[driveNum][0], deflection, r)
+		fd.trillBent[driveNum][1] = notes.BendTicks(fd.trillBase[driveNum][1], deflection, r)
+		if fd.trillOnSecond[driveNum] {
+			fd.currentPeriod[driveNum] = fd.trillBent[driveNum][1]
+		} else {
+			fd.currentPeriod[driveNum] = fd.trillBent[driveNum][0]
+		}
+		return
+	}
+	fd.currentPeriod[driveNum] = notes.BendTicks(fd.originalPeriod[driveNum],
+		deflection, fd.bendRange[driveNum])
+}
+
+// setTremolo gates a drive's steps at rateHz, sounding for dutyPercent of
+// each cycle. Rate 0 turns the gate off.
+func (fd *FloppyDrives) setTremolo(driveNum, rateHz, dutyPercent byte) {
+	if rateHz == 0 {
+		fd.tremoloPeriod[driveNum] = 0
+		return
+	}
+	period := uint16(1000 * notes.TicksPerMs / uint32(rateHz))
+	fd.tremoloOnTicks[driveNum] = uint16(uint32(period) * uint32(dutyPercent) / 100)
+	fd.tremoloTick[driveNum] = 0
+	// Arm last: Tick only gates once the period is non-zero.
+	fd.tremoloPeriod[driveNum] = period
+}
+
+// setPressure turns channel pressure (0..127) into vibrato on a drive's
+// sounding note, up to its OptVibratoDepth at full pressure.
+func (fd *FloppyDrives) setPressure(driveNum, pressure byte) {
+	cents := int16(uint16(fd.vibratoMaxCents[driveNum]) * uint16(pressure) / 127)
+	if cents == 0 || fd.vibratoRate[driveNum] == 0 || fd.currentPeriod[driveNum] == 0 {
+		fd.vibratoDepth[driveNum] = 0
+		return
+	}
+	if fd.vibratoDepth[driveNum] == 0 {
+		// Starting afresh: begin the cycle at the unmodulated pitch.
+		fd.vibratoCycle[driveNum] = uint16(1000 * notes.TicksPerMs / uint32(fd.vibratoRate[driveNum]))
+		fd.vibratoPos[driveNum] = 0
+		fd.stepPeriod[driveNum] = fd.currentPeriod[driveNum]
+	}
+	// Arm last: Tick only modulates once the depth is non-zero.
+	fd.vibratoDepth[driveNum] = notes.SemitoneRatioQ16(cents) - 65536
+}
+
+// setBendRange sets a drive's pitch bend range in semitones, re-bending
+// the sounding note if a bend is in effect.
+func (fd *FloppyDrives) setBendRange(driveNum, semitones byte) {
+	fd.bendRange[driveNum] = semitones
+	if fd.bend[driveNum] != 0 {
+		fd.bendPitch(driveNum, fd.bend[driveNum])
+	}
+}
+
+// SilenceAll immediately stops every drive's note and lifts the sustain
+// pedal, as a note-off to sub address 0x00 does. Heads that are re-homing
+// finish doing so, but their pending notes are dropped.
+func (fd *FloppyDrives) SilenceAll() {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	fd.silenceAll()
+}
+
+// silenceAll is SilenceAll with interrupts held off, as in Tick.
+func (fd *FloppyDrives) silenceAll() {
+	for d := byte(firstDrive); d <= lastDrive; d++ {
+		fd.currentPeriod[d] = 0
+		fd.originalPeriod[d] = 0
+		fd.bend[d] = 0
+		fd.hasPending[d] = false
+		fd.heldCount[d] = 0
+		fd.glissCountdown[d] = 0
+		fd.accentCountdown[d] = 0
+		fd.trillCountdown[d] = 0
+		fd.startCountdown[d] = 0
+		fd.vibratoDepth[d] = 0
+		fd.sustain[d] = false
+		fd.released[d] = false
+		fd.wake(d)
+	}
+}
+
+// startHoming silences a drive, restores its full travel window and starts
+// re-homing it from Tick, leaving the other drives playing. See
+// advanceHoming.
+func (fd *FloppyDrives) startHoming(driveNum byte) {
+	fd.homing[driveNum] = false
+	fd.wake(driveNum)
+	fd.currentPeriod[driveNum] = 0
+	fd.originalPeriod[driveNum] = 0
+	fd.glissCountdown[driveNum] = 0
+	fd.accentCountdown[driveNum] = 0
+	fd.trillCountdown[driveNum] = 0
+	fd.startCountdown[driveNum] = 0
+	fd.vibratoDepth[driveNum] = 0
+	fd.sustain[driveNum] = false
+	fd.released[driveNum] = false
+	fd.hasPending[driveNum] = false
+	fd.heldCount[driveNum] = 0
+	fd.resetTravel(driveNum)
+
+	// Sweep back across the full physical travel, whatever the window:
+	// the calibration offset lies between the end stop and position 0.
+	// A step line left high would swallow the first pulse's edge.
+	fd.setDirection(driveNum, true)
+	fd.setStep(driveNum, false)
+	fd.stepState[driveNum] = false
+	fd.homeSteps[driveNum] = config.MaxPosition/2 + uint16(fd.calibration[driveNum])
+	fd.homeForward[driveNum] = fd.calibration[driveNum]
+	fd.homeCountdown[driveNum] = homeStepTicks
+	fd.homing[driveNum] = true
+}
+
+// advanceHoming runs one tick of a drive's background re-homing: a step
+// pulse every homeStepTicks, first back to the end stop, then forward by
+// the calibration offset. When done, the drive is at position 0 and plays
+// any note-on that arrived meanwhile. Called from Tick.
+func (fd *FloppyDrives) advanceHoming(driveNum byte) {
+	fd.homeCountdown[driveNum]--
+	if fd.homeCountdown[driveNum] > 0 {
+		return
+	}
+	fd.homeCountdown[driveNum] = homeStepTicks
+
+	// Set the direction before every pulse: with a shared direction pin,
+	// the other drives may have turned it around since the last one.
+	if fd.homeSteps[driveNum] > 0 {
+		fd.homeSteps[driveNum]--
+		fd.setDirection(driveNum, true)
+		fd.pulseStep(driveNum)
+		return
+	}
+	if fd.homeForward[driveNum] > 0 {
+		fd.homeForward[driveNum]--
+		fd.setDirection(driveNum, false)
+		fd.pulseStep(driveNum)
+		return
+	}
+
+	fd.currentPosition[driveNum] = 0
+	fd.stepState[driveNum] = false
+	fd.setDirection(driveNum, false)
+	fd.setMovement(driveNum, !fd.wiggle[driveNum])
+	fd.homing[driveNum] = false
+	if fd.hasPending[driveNum] {
+		fd.hasPending[driveNum] = false
+		fd.playNote(driveNum, fd.pendingNote[driveNum])
+	}
+}
+
+// ResetAll stops every note, restores every drive's full physical travel
+// window and returns all drives to position 0 simultaneously. It blocks
+// for a few hundred milliseconds, so never call it from interrupt context.
+// Interrupts are held off only while it steps, not while it waits between
+// steps.
+func (fd *FloppyDrives) ResetAll() {
+	fd.led.SetState(status.Resetting)
+	defer fd.led.SetState(status.Idle)
+	state := hal.DisableInterrupts()
+	for d := byte(firstDrive); d <= lastDrive; d++ {
+		fd.resetTravel(d)
+	}
+	hal.RestoreInterrupts(state)
+	fd.homeAll()
+}
+
+// homeAll is ResetAll keeping the drives' travel windows, for Setup.
+func (fd *FloppyDrives) homeAll() {
+	// Stop all drives and set direction to reverse.
+	state := hal.DisableInterrupts()
+	for d := byte(firstDrive); d <= lastDrive; d++ {
+		fd.homing[d] = false
+		fd.hasPending[d] = false
+		fd.heldCount[d] = 0
+		fd.wake(d)
+		fd.currentPeriod[d] = 0
+		fd.originalPeriod[d] = 0
+		fd.glissCountdown[d] = 0
+		fd.accentCountdown[d] = 0
+		fd.trillCountdown[d] = 0
+		fd.startCountdown[d] = 0
+		fd.vibratoDepth[d] = 0
+		fd.sustain[d] = false
+		fd.released[d] = false
+		fd.setDir(d, true)
+		// A step line left high would swallow the first pulse's edge.
+		fd.setStep(d, false)
+		fd.stepState[d] = false
+	}
+	fd.flush()
+	hal.RestoreInterrupts(state)
+
+	// Step all drives back together, each across its full physical
+	// travel: the calibration offset lies between the end stop and 0.
+	sweep := uint16(0)
+	for d := byte(firstDrive); d <= lastDrive; d++ {
+		sweep = max(sweep, config.MaxPosition/2+uint16(fd.calibration[d]))
+	}
+	for s := uint16(0); s < sweep; s++ {
+		state := hal.DisableInterrupts()
+		for d := byte(firstDrive); d <= lastDrive; d++ {
+			if s < config.MaxPosition/2+uint16(fd.calibration[d]) {
+				fd.pulseStep(d)
+			}
+		}
+		fd.flush()
+		hal.RestoreInterrupts(state)
+		fd.ticker.Sleep(5 * time.Millisecond)
+	}
+
+	// Step forward off the end stops by each drive's calibration offset.
+	state = hal.DisableInterrupts()
+	for d := byte(firstDrive); d <= lastDrive; d++ {
+		fd.setDir(d, false)
+	}
+	hal.RestoreInterrupts(state)
+	for s := byte(0); s < 255; s++ {
+		moved := false
+		state := hal.DisableInterrupts()
+		for d := byte(firstDrive); d <= lastDrive; d++ {
+			if s < fd.calibration[d] {
+				fd.pulseStep(d)
+				moved = true
+			}
+		}
+		fd.flush()
+		hal.RestoreInterrupts(state)
+		if !moved {
+			break
+		}
+		fd.ticker.Sleep(5 * time.Millisecond)
+	}
+
+	// Reset all tracking state.
+	state = hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	for d := byte(firstDrive); d <= lastDrive; d++ {
+		fd.currentPosition[d] = 0
+		fd.stepState[d] = false
+		fd.setDirection(d, false)
+		fd.setMovement(d, !fd.wiggle[d])
+	}
+}
+
+// resetTravel restores a drive's travel window to the full physical
+// travel, as a reset does, taking effect when the drive is next homed. A
+// narrowed window is saved widened again.
+func (fd *FloppyDrives) resetTravel(driveNum byte) {
+	if fd.travelMin[driveNum] == 0 && fd.travelMax[driveNum] == config.MaxPosition {
+		return
+	}
+	fd.travelMin[driveNum] = 0
+	fd.travelMax[driveNum] = config.MaxPosition
+	fd.settingsChanged(driveNum)
+}
+
+// setTravel sets a drive's travel window to lo..hi, which the caller has
+// checked lies in 0..config.MaxPosition with lo < hi. It takes effect at
+// once unless movement is disabled. There is no jump: togglePin reverses
+// a head that is past a limit, so one outside the new window walks in a
+// step per pulse and then bounces as usual.
+func (fd *FloppyDrives) setTravel(driveNum byte, lo, hi uint16) {
+	fd.travelMin[driveNum] = lo
+	fd.travelMax[driveNum] = hi
+	if !fd.wiggle[driveNum] {
+		fd.setMovement(driveNum, true)
 	}
 }
 
 // setMovement enables or restricts head movement for a drive.
-// When disabled, the head is constrained to a tiny range around the center.
+// When enabled, the head bounces across its travel window; when disabled,
+// it is constrained to a tiny range around the center.
 func (fd *FloppyDrives) setMovement(driveNum byte, enabled bool) {
+	fd.wiggle[driveNum] = !enabled
 	if enabled {
-		fd.minPosition[driveNum] = 0
-		fd.maxPosition[driveNum] = config.MaxPosition
+		fd.minPosition[driveNum] = fd.travelMin[driveNum]
+		fd.maxPosition[driveNum] = fd.travelMax[driveNum]
 	} else {
 		fd.minPosition[driveNum] = 79
 		fd.maxPosition[driveNum] = 81
 	}
+	fd.setBounce(driveNum, fd.minPosition[driveNum], fd.maxPosition[driveNum])
 }
 
-// startupSound plays a short confirmation tune on a single drive.
+// startupSound plays a short confirmation tune on a single drive, waiting
+// it out on the ticker. It is only heard if the ticker is running Tick.
 func (fd *FloppyDrives) startupSound(driveNum byte) {
 	chargeNotes := [5]uint16{
 		notes.NoteDoubleTicks[31], // G1
@@ -268,13 +2284,12 @@ func (fd *FloppyDrives) startupSound(driveNum byte) {
 		0,                         // silence
 	}
 
-	var lastRun time.Time
-	for i := 0; i < 5; {
-		now := time.Now()
-		if now.Sub(lastRun) > 200*time.Millisecond {
-			lastRun = now
-			fd.currentPeriod[driveNum] = chargeNotes[i]
-			i++
+	for _, period := range chargeNotes {
+		state := hal.DisableInterrupts()
+		fd.currentPeriod[driveNum] = period
+		hal.RestoreInterrupts(state)
+		if period != 0 {
+			fd.ticker.Sleep(200 * time.Millisecond)
 		}
 	}
 }
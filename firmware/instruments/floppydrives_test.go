@@ -0,0 +1,1662 @@
+//go:build !tinygo
+
+package instruments
+
+import (
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/fakeclock"
+	"github.com/ystepanoff/goppy/firmware/hal"
+	"github.com/ystepanoff/goppy/firmware/notes"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+	"github.com/ystepanoff/goppy/firmware/settings"
+	"github.com/ystepanoff/goppy/firmware/status"
+)
+
+// clocked returns drives ticked by a fake clock, with their lines low as
+// at power-on.
+func clocked() (*FloppyDrives, *fakeclock.Clock) {
+	for p := config.FirstPin; p < config.FirstPin+2*config.NumDrives; p++ {
+		hal.Pin(p).Low()
+	}
+	clock := fakeclock.New()
+	fd := NewFloppyDrives()
+	fd.SetTicker(clock)
+	clock.Start(config.TimerResolution, fd.Tick)
+	return fd, clock
+}
+
+func TestResetAllSweep(t *testing.T) {
+	if config.ShiftRegister {
+		t.Skip("step lines go through the shift register")
+	}
+	fd, clock := clocked()
+	const calibration = 3
+	fd.HandleDeviceMessage(1, config.DevCmdSetOption, []byte{config.OptCalibration, calibration})
+	fd.HandleDeviceMessage(2, config.DevCmdNoteOn, []byte{45})
+	clock.AdvanceMs(300)
+	fd.HandleDeviceMessage(2, config.DevCmdNoteOff, nil)
+
+	// When each drive's step line rose, from the start of the reset.
+	start := clock.Now()
+	var rises [lastDrive + 1][]time.Duration
+	hal.OnChange = func(p hal.Pin, high bool) {
+		for d := byte(firstDrive); d <= lastDrive; d++ {
+			if p == fd.stepPins[d] && high {
+				rises[d] = append(rises[d], clock.Now()-start)
+			}
+		}
+	}
+	defer func() { hal.OnChange = nil }()
+	ticks := clock.Ticks()
+	fd.ResetAll()
+
+	// Every drive sweeps back across the whole travel, a pulse every 5ms;
+	// drive 1 then further for its calibration, and forward again.
+	const pulse = 5 * time.Millisecond
+	back := config.MaxPosition / 2
+	for d := byte(firstDrive); d <= lastDrive; d++ {
+		want := back
+		if d == 1 {
+			want = back + 2*calibration
+		}
+		if len(rises[d]) != want {
+			t.Errorf("drive %d pulsed %d times, want %d", d, len(rises[d]), want)
+			continue
+		}
+		for i, at := range rises[d] {
+			if at != time.Duration(i)*pulse {
+				t.Errorf("drive %d pulse %d at %v, want %v", d, i, at, time.Duration(i)*pulse)
+				break
+			}
+		}
+		if pos, _ := fd.DrivePosition(d); pos != 0 {
+			t.Errorf("drive %d at %d after the reset, want 0", d, pos)
+		}
+	}
+
+	// The reset took its time, and Tick ran all through it.
+	want := time.Duration(back+2*calibration) * pulse
+	if took := clock.Now() - start; took != want {
+		t.Errorf("reset took %v, want %v", took, want)
+	}
+	if ran, want := clock.Ticks()-ticks, uint64(want/(config.TimerResolution*time.Microsecond)); ran != want {
+		t.Errorf("%d ticks ran during the reset, want %d", ran, want)
+	}
+}
+
+func TestLinkWatchdog(t *testing.T) {
+	if config.LinkWatchdogMs == 0 {
+		t.Skip("link watchdog disabled in config")
+	}
+	fd, clock := clocked()
+	fd.HandleSystemMessage(config.CmdSequenceStart, nil)
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{57})
+
+	// The link is checked every idleCheckTicks, so the watchdog fires up
+	// to a check early.
+	const slack = 2 * idleCheckTicks / notes.TicksPerMs
+	clock.AdvanceMs(config.LinkWatchdogMs - slack)
+	if fd.currentPeriod[1] == 0 || fd.Stats.LinkTimeouts != 0 {
+		t.Fatalf("silenced %v before the watchdog was due", clock.Now())
+	}
+	clock.AdvanceMs(2 * slack)
+	if fd.currentPeriod[1] != 0 {
+		t.Fatalf("still sounding %v after the last message", clock.Now())
+	}
+	if fd.Stats.LinkTimeouts != 1 {
+		t.Errorf("LinkTimeouts = %d, want 1", fd.Stats.LinkTimeouts)
+	}
+
+	// A message keeps the link alive.
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{57})
+	for range 3 {
+		clock.AdvanceMs(config.LinkWatchdogMs - slack)
+		fd.HandleDeviceMessage(1, config.DevCmdBendPitch, []byte{0, 0})
+	}
+	if fd.currentPeriod[1] == 0 {
+		t.Errorf("silenced with messages arriving every %dms", config.LinkWatchdogMs-slack)
+	}
+}
+
+// TestStatus counts uptime in the timer's ticks, and reports the drives
+// sounding and the last message ignored.
+func TestStatus(t *testing.T) {
+	fd, clock := clocked()
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{57})
+	fd.HandleDeviceMessage(3, config.DevCmdNoteOn, []byte{60})
+	clock.AdvanceMs(2999)
+	up, drives, fault, faults := fd.DeviceStatus()
+	if up != 2 || drives != 0b101 || fault != config.FaultNone || faults != 0 {
+		t.Errorf("status %d %b %d %d, want 2 101 0 0", up, drives, fault, faults)
+	}
+	// The idle check runs every idleCheckTicks, so a second may end up
+	// to a check late.
+	clock.AdvanceMs(1 + idleCheckTicks/notes.TicksPerMs)
+	if up, _, _, _ := fd.DeviceStatus(); up != 3 {
+		t.Errorf("up %ds after 3s, want 3", up)
+	}
+
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOff, nil)
+	fd.HandleDeviceMessage(1, 0x7E, nil)
+	if _, drives, fault, faults := fd.DeviceStatus(); drives != 0b100 || fault != config.FaultUnknownCommand || faults != 1 {
+		t.Errorf("drives %b, fault %d of %d, want 100, %d of 1", drives, fault, faults, config.FaultUnknownCommand)
+	}
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{128})
+	if _, _, fault, faults := fd.DeviceStatus(); fault != config.FaultBadPayload || faults != 2 {
+		t.Errorf("fault %d of %d, want %d of 2", fault, faults, config.FaultBadPayload)
+	}
+}
+
+// TestStatusLED shows a reset sweep on the status LED for as long as it
+// runs, and a bad message after it.
+func TestStatusLED(t *testing.T) {
+	clock := fakeclock.New()
+	fd := NewFloppyDrives()
+	fd.SetTicker(clock)
+	led := status.New(200, status.DefaultPatterns)
+	led.Setup()
+	fd.SetStatusLED(led)
+	var shown [status.Resetting + 1]time.Duration
+	clock.Start(config.TimerResolution, func() {
+		fd.Tick()
+		led.Tick()
+		shown[led.State()] += config.TimerResolution * time.Microsecond
+	})
+	led.SetState(status.Idle)
+	clock.AdvanceMs(10)
+
+	start := clock.Now()
+	fd.ResetAll()
+	took := clock.Now() - start
+	clock.AdvanceMs(1)
+	if shown[status.Resetting] < took-time.Millisecond || shown[status.Resetting] > took {
+		t.Errorf("Resetting shown %v of the %v reset", shown[status.Resetting], took)
+	}
+	if led.State() != status.Idle {
+		t.Errorf("state %d after the reset, want Idle", led.State())
+	}
+
+	fd.HandleDeviceMessage(1, 0x7E, nil)
+	clock.AdvanceMs(1)
+	if led.State() != status.Fault {
+		t.Errorf("state %d after an unknown command, want Fault", led.State())
+	}
+}
+
+func TestStartupSound(t *testing.T) {
+	fd, clock := clocked()
+	tune := []byte{31, 36, 38, 43}
+	for i, note := range tune {
+		clock.At(time.Duration(100+200*i)*time.Millisecond, func() {
+			if got, want := fd.currentPeriod[1], notes.NoteDoubleTicks[note]; got != want {
+				t.Errorf("note %d: period %d at %v, want %d", i, got, clock.Now(), want)
+			}
+		})
+	}
+	fd.startupSound(1)
+	if clock.Now() != 800*time.Millisecond {
+		t.Errorf("tune took %v, want 800ms", clock.Now())
+	}
+	if fd.currentPeriod[1] != 0 {
+		t.Error("still sounding after the tune")
+	}
+}
+
+// TestNoteOffMatching overlaps two notes on a drive, as legato playing
+// does: the first note's note-off mustn't cut the second short, while a
+// note-off without a note, from older controllers, stops whatever plays.
+func TestNoteOffMatching(t *testing.T) {
+	const c4, e4 = 60, 64
+	tests := []struct {
+		name    string
+		off     []byte
+		playing bool
+	}{
+		{"matching", []byte{c4}, true},
+		{"legacy", nil, false},
+	}
+	for _, tt := range tests {
+		fd, clock := clocked()
+		fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{c4})
+		clock.AdvanceMs(50)
+		fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{e4})
+		clock.AdvanceMs(50)
+		fd.HandleDeviceMessage(1, config.DevCmdNoteOff, tt.off)
+		clock.AdvanceMs(50)
+		if playing := fd.currentPeriod[1] != 0; playing != tt.playing {
+			t.Errorf("%s: sounding %v after the note-off, want %v", tt.name, playing, tt.playing)
+		}
+		if tt.playing && fd.currentPeriod[1] != notes.NoteDoubleTicks[e4] {
+			t.Errorf("%s: period %d, want E4's %d", tt.name, fd.currentPeriod[1], notes.NoteDoubleTicks[e4])
+		}
+
+		// E4's own note-off stops it either way.
+		fd.HandleDeviceMessage(1, config.DevCmdNoteOff, []byte{e4})
+		if fd.currentPeriod[1] != 0 {
+			t.Errorf("%s: still sounding after E4's note-off", tt.name)
+		}
+	}
+}
+
+// TestLegato plays note sequences on a legato drive, checking what it
+// sounds at the end: a note-off for the sounding note goes back to the
+// most recent note still held, ahead of the sustain pedal.
+func TestLegato(t *testing.T) {
+	const c4, d4, e4, f4, g4 = 60, 62, 64, 65, 67
+	type step struct {
+		command byte
+		payload []byte
+	}
+	on := func(n byte) step { return step{config.DevCmdNoteOn, []byte{n}} }
+	off := func(n byte) step { return step{config.DevCmdNoteOff, []byte{n}} }
+	pedal := step{config.DevCmdSustain, []byte{127}}
+	legacyOff := step{config.DevCmdNoteOff, nil}
+	tests := []struct {
+		name  string
+		steps []step
+		want  byte // note sounding at the end, 0 for none
+	}{
+		{"back to the held note", []step{on(c4), on(g4), off(g4)}, c4},
+		{"held note dropped", []step{on(c4), on(e4), on(g4), off(e4)}, g4},
+		{"dropped note forgotten", []step{on(c4), on(e4), on(g4), off(e4), off(g4)}, c4},
+		{"fifth note pushes out the first", []step{on(c4), on(d4), on(e4), on(f4), on(g4), off(g4), off(f4), off(e4), off(c4)}, d4},
+		{"pushed-out note forgotten", []step{on(c4), on(d4), on(e4), on(f4), on(g4), off(g4), off(f4), off(e4), off(d4)}, 0},
+		{"held note beats the pedal", []step{pedal, on(c4), on(g4), off(g4)}, c4},
+		{"pedal keeps the last note", []step{pedal, on(c4), on(g4), off(g4), off(c4)}, c4},
+		{"last note stops without the pedal", []step{on(c4), on(g4), off(g4), off(c4)}, 0},
+		{"legacy note-off clears the held notes", []step{on(c4), on(g4), legacyOff}, 0},
+		{"nothing held after a legacy note-off", []step{on(c4), on(g4), legacyOff, on(e4), off(e4)}, 0},
+	}
+	for _, tt := range tests {
+		fd, clock := clocked()
+		fd.HandleDeviceMessage(1, config.DevCmdSetOption, []byte{config.OptLegato, 1})
+		for _, s := range tt.steps {
+			fd.HandleDeviceMessage(1, s.command, s.payload)
+			clock.AdvanceMs(20)
+		}
+		want := uint16(0)
+		if tt.want != 0 {
+			want = notes.NoteDoubleTicks[tt.want]
+		}
+		if fd.currentPeriod[1] != want {
+			t.Errorf("%s: period %d, want %d", tt.name, fd.currentPeriod[1], want)
+		}
+	}
+}
+
+// TestSustain holds a note past its note-off while the pedal is down.
+func TestSustain(t *testing.T) {
+	fd, clock := clocked()
+	sustain := func(sub, on byte) { fd.HandleDeviceMessage(sub, config.DevCmdSustain, []byte{on}) }
+	sustain(1, 1)
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{60})
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOff, []byte{60})
+	clock.AdvanceMs(100)
+	if fd.currentPeriod[1] == 0 || !fd.released[1] {
+		t.Fatal("note stopped under the pedal")
+	}
+	sustain(1, 0)
+	if fd.currentPeriod[1] != 0 || fd.released[1] {
+		t.Error("note still sounding after the pedal lifted")
+	}
+
+	// A note-on replaces a released note, which the pedal then doesn't stop.
+	sustain(1, 1)
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{60})
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOff, []byte{60})
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{64})
+	sustain(1, 0)
+	if fd.currentPeriod[1] != notes.NoteDoubleTicks[64] {
+		t.Errorf("period %d after the pedal lifted, want the new note's %d", fd.currentPeriod[1], notes.NoteDoubleTicks[64])
+	}
+
+	// SEQUENCE_STOP lifts the pedal.
+	sustain(0, 1)
+	fd.HandleSystemMessage(config.CmdSequenceStop, nil)
+	for d := byte(firstDrive); d <= lastDrive; d++ {
+		if fd.sustain[d] || fd.currentPeriod[d] != 0 {
+			t.Errorf("drive %d: sustain %v, period %d after SEQUENCE_STOP", d, fd.sustain[d], fd.currentPeriod[d])
+		}
+	}
+}
+
+// TestSustainPool only gives a pool zone's released drive to a new note
+// once every other member is busy.
+func TestSustainPool(t *testing.T) {
+	fd, _ := clocked()
+	const alias = config.ZoneSubAddress
+	fd.HandleDeviceMessage(0, config.DevCmdSetZone, []byte{1, 1, 2, config.ZonePool})
+	fd.HandleDeviceMessage(alias, config.DevCmdSustain, []byte{1})
+	fd.HandleDeviceMessage(alias, config.DevCmdNoteOn, []byte{60})
+	fd.HandleDeviceMessage(alias, config.DevCmdNoteOff, []byte{60})
+	fd.HandleDeviceMessage(alias, config.DevCmdNoteOn, []byte{62})
+	if fd.currentNote[1] != 60 || fd.currentNote[2] != 62 {
+		t.Fatalf("notes %d, %d; want the released 60 left on drive 1 and 62 on 2", fd.currentNote[1], fd.currentNote[2])
+	}
+	fd.HandleDeviceMessage(alias, config.DevCmdNoteOn, []byte{64})
+	if fd.currentNote[1] != 64 || fd.released[1] {
+		t.Errorf("drive 1 plays %d, released %v; want 64 stealing the released drive", fd.currentNote[1], fd.released[1])
+	}
+}
+
+// TestGliss slides an octave less two semitones over 500ms: a semitone
+// every 50ms, each landing on its tick, then the end note held.
+func TestGliss(t *testing.T) {
+	const from, to = 48, 58
+	fd, clock := clocked()
+	fd.HandleDeviceMessage(1, config.DevCmdGliss, []byte{from, to, 0x01, 0xF4})
+	const stepTicks = 500 * notes.TicksPerMs / (to - from)
+	for k := 0; k <= to-from; k++ {
+		if k > 0 {
+			// The tick before the step still plays the previous note.
+			clock.AdvanceTicks(stepTicks - 1)
+			if got, want := fd.currentPeriod[1], notes.NoteDoubleTicks[from+k-1]; got != want {
+				t.Fatalf("tick %d: period %d, want note %d's %d", clock.Ticks(), got, from+k-1, want)
+			}
+			clock.AdvanceTicks(1)
+		}
+		if got, want := fd.currentPeriod[1], notes.NoteDoubleTicks[from+k]; got != want {
+			t.Fatalf("tick %d: period %d, want note %d's %d", clock.Ticks(), got, from+k, want)
+		}
+	}
+	clock.AdvanceMs(1000)
+	if fd.currentPeriod[1] != notes.NoteDoubleTicks[to] {
+		t.Errorf("period %d after the slide, want the end note held", fd.currentPeriod[1])
+	}
+
+	// A note-on or note-off midway cancels the slide.
+	fd.HandleDeviceMessage(1, config.DevCmdGliss, []byte{from, to, 0x01, 0xF4})
+	clock.AdvanceMs(120)
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{40})
+	clock.AdvanceMs(500)
+	if fd.currentPeriod[1] != notes.NoteDoubleTicks[40] {
+		t.Errorf("period %d after a note-on during the slide, want note 40's", fd.currentPeriod[1])
+	}
+	fd.HandleDeviceMessage(1, config.DevCmdGliss, []byte{from, to, 0x01, 0xF4})
+	clock.AdvanceMs(120)
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOff, nil)
+	clock.AdvanceMs(500)
+	if fd.currentPeriod[1] != 0 || fd.glissCountdown[1] != 0 {
+		t.Errorf("period %d, countdown %d after a note-off during the slide", fd.currentPeriod[1], fd.glissCountdown[1])
+	}
+}
+
+// TestGlissSmooth interpolates the period between semitones.
+func TestGlissSmooth(t *testing.T) {
+	fd, clock := clocked()
+	fd.HandleDeviceMessage(1, config.DevCmdGliss, []byte{48, 49, 0x01, 0xF4, config.GlissFlagSmooth})
+	a, b := notes.NoteDoubleTicks[48], notes.NoteDoubleTicks[49]
+	clock.AdvanceMs(250)
+	if p := fd.currentPeriod[1]; p >= a || p <= b {
+		t.Errorf("period %d halfway, want between %d and %d", p, b, a)
+	}
+	clock.AdvanceMs(250)
+	if p := fd.currentPeriod[1]; p != b {
+		t.Errorf("period %d at the end, want %d", p, b)
+	}
+}
+
+// TestTranspose moves notes by whole octaves before they are looked up.
+func TestTranspose(t *testing.T) {
+	fd, _ := clocked()
+	fd.HandleDeviceMessage(1, config.DevCmdTranspose, []byte{12})
+	fd.HandleDeviceMessage(2, config.DevCmdTranspose, []byte{0xF4}) // -12
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{48})
+	fd.HandleDeviceMessage(2, config.DevCmdNoteOn, []byte{48})
+	fd.HandleDeviceMessage(3, config.DevCmdNoteOn, []byte{48})
+	for d, want := range map[byte]byte{1: 60, 2: 36, 3: 48} {
+		if got := fd.currentPeriod[d]; got != notes.NoteDoubleTicks[want] {
+			t.Errorf("drive %d: period %d, want note %d's %d", d, got, want, notes.NoteDoubleTicks[want])
+		}
+	}
+
+	// The glissando's ends are transposed too.
+	fd.HandleDeviceMessage(1, config.DevCmdGliss, []byte{40, 41, 0, 0})
+	if got := fd.currentPeriod[1]; got != notes.NoteDoubleTicks[53] {
+		t.Errorf("gliss: period %d, want note 53's %d", got, notes.NoteDoubleTicks[53])
+	}
+
+	// Past the top of the range, the note goes by the configured policy.
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{MaxFloppyNote})
+	want, ok := fitNote(MaxFloppyNote+12, config.NoteRangePolicy)
+	if ok && fd.currentPeriod[1] != notes.NoteDoubleTicks[want] || !ok && fd.currentPeriod[1] != notes.NoteDoubleTicks[53] {
+		t.Errorf("out of range: period %d", fd.currentPeriod[1])
+	}
+}
+
+// TestFitNote fits transposed notes under each range policy.
+func TestFitNote(t *testing.T) {
+	tests := []struct {
+		n      int16
+		policy byte
+		want   byte
+		ok     bool
+	}{
+		{60, config.RangeDrop, 60, true},
+		{MaxFloppyNote + 12, config.RangeDrop, 0, false},
+		{-12, config.RangeDrop, 0, false},
+		{MaxFloppyNote + 12, config.RangeClamp, MaxFloppyNote, true},
+		{-12, config.RangeClamp, 0, true},
+		{MaxFloppyNote + 12, config.RangeFold, MaxFloppyNote, true},
+		{MaxFloppyNote + 13, config.RangeFold, MaxFloppyNote - 11, true},
+		{-12, config.RangeFold, 0, true},
+		{-1, config.RangeFold, 11, true},
+	}
+	for _, tt := range tests {
+		if got, ok := fitNote(tt.n, tt.policy); got != tt.want || ok != tt.ok {
+			t.Errorf("fitNote(%d, %d) = %d, %v; want %d, %v", tt.n, tt.policy, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// TestZones plays notes through a pool zone, which puts each on a free
+// member, and a unison zone, which plays it on all of them.
+func TestZones(t *testing.T) {
+	fd, _ := clocked()
+	fd.HandleDeviceMessage(0, config.DevCmdSetZone, []byte{1, 3, 6, config.ZonePool})
+	fd.HandleDeviceMessage(0, config.DevCmdSetZone, []byte{2, 7, 8, config.ZoneUnison})
+	pool, unison := config.ZoneSubAddress, config.ZoneSubAddress+1
+
+	fd.HandleDeviceMessage(3, config.DevCmdNoteOn, []byte{40}) // a member already busy
+	fd.HandleDeviceMessage(pool, config.DevCmdNoteOn, []byte{60})
+	fd.HandleDeviceMessage(pool, config.DevCmdNoteOn, []byte{62})
+	if fd.currentNote[4] != 60 || fd.currentNote[5] != 62 || fd.currentNote[3] != 40 {
+		t.Errorf("pool: drives 3-5 play %v, want 40 kept and 60, 62 on the free ones", fd.currentNote[3:6])
+	}
+	fd.HandleDeviceMessage(pool, config.DevCmdNoteOff, []byte{60})
+	if fd.currentPeriod[4] != 0 || fd.currentPeriod[5] == 0 {
+		t.Error("pool: note-off didn't stop just the drive playing it")
+	}
+
+	fd.HandleDeviceMessage(unison, config.DevCmdNoteOn, []byte{50})
+	for d := byte(7); d <= 8; d++ {
+		if fd.currentPeriod[d] != notes.NoteDoubleTicks[50] {
+			t.Errorf("unison: drive %d period %d", d, fd.currentPeriod[d])
+		}
+	}
+	if fd.currentPeriod[1] != 0 || fd.currentPeriod[2] != 0 {
+		t.Error("unison note reached drives outside the zone")
+	}
+	fd.HandleDeviceMessage(unison, config.DevCmdNoteOff, nil)
+	if fd.currentPeriod[7] != 0 || fd.currentPeriod[8] != 0 {
+		t.Error("unison note-off left a member sounding")
+	}
+
+	// A full pool drops the note; a cleared zone ignores it.
+	for _, n := range []byte{61, 63, 64, 65} {
+		fd.HandleDeviceMessage(pool, config.DevCmdNoteOn, []byte{n})
+	}
+	for d := byte(3); d <= 6; d++ {
+		if fd.currentNote[d] == 65 {
+			t.Errorf("drive %d took a note with the pool full", d)
+		}
+	}
+	fd.HandleDeviceMessage(0, config.DevCmdSetZone, []byte{2, 0, 0, 0})
+	fd.HandleDeviceMessage(unison, config.DevCmdNoteOn, []byte{50})
+	if fd.currentPeriod[7] != 0 {
+		t.Error("cleared zone still plays")
+	}
+}
+
+// TestRehomeOneDrive re-homes drive 1 while drive 2 plays on: drive 2's
+// steps keep their exact spacing, and a note sent to drive 1 midway plays
+// once it is home.
+func TestRehomeOneDrive(t *testing.T) {
+	if config.ShiftRegister {
+		t.Skip("step lines go through the shift register")
+	}
+	fd, clock := clocked()
+	fd.HandleDeviceMessage(2, config.DevCmdNoteOn, []byte{45})
+	clock.AdvanceMs(20)
+
+	var edges []uint64
+	hal.OnChange = func(p hal.Pin, high bool) {
+		if p == fd.stepPins[2] {
+			edges = append(edges, clock.Ticks())
+		}
+	}
+	defer func() { hal.OnChange = nil }()
+
+	fd.HandleDeviceMessage(1, config.DevCmdReset, nil)
+	clock.AdvanceMs(100)
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{50})
+	if !fd.homing[1] || fd.currentPeriod[1] != 0 {
+		t.Fatal("drive 1 played the note before it was home")
+	}
+	// A pulse every 5ms back across the travel, and one wait to finish.
+	const home = (config.MaxPosition/2 + 1) * 5
+	clock.AdvanceMs(home - 100 - 5)
+	if !fd.homing[1] || fd.currentPeriod[1] != 0 {
+		t.Fatal("drive 1 stopped homing early")
+	}
+	clock.AdvanceMs(10)
+	if fd.homing[1] || fd.currentPeriod[1] != notes.NoteDoubleTicks[50] {
+		t.Errorf("drive 1 homing %v, period %d after the sweep; want the queued note", fd.homing[1], fd.currentPeriod[1])
+	}
+	if pos, _ := fd.DrivePosition(1); pos != 0 {
+		t.Errorf("drive 1 at %d, want 0", pos)
+	}
+
+	period := uint64(notes.NoteDoubleTicks[45])
+	if len(edges) < 20 {
+		t.Fatalf("drive 2 stepped %d times", len(edges))
+	}
+	for i := 1; i < len(edges); i++ {
+		if gap := edges[i] - edges[i-1]; gap != period {
+			t.Fatalf("drive 2 step %d came %d ticks after the last, want %d", i, gap, period)
+		}
+	}
+}
+
+// TestStagger starts every drive on the same note at once and counts the
+// ticks on which more than two of them step together: every period without
+// stagger, never with it. Each drive's pitch is the same either way, and a
+// unison zone isn't staggered.
+func TestStagger(t *testing.T) {
+	if config.ShiftRegister {
+		t.Skip("step lines go through the shift register")
+	}
+	const note, k = 60, 2
+	crowded := func(stagger, unison bool) (n int) {
+		fd, clock := clocked()
+		fd.stagger = stagger
+		if unison {
+			fd.HandleDeviceMessage(0, config.DevCmdSetZone, []byte{1, firstDrive, lastDrive, config.ZoneUnison})
+		}
+		edges := map[uint64]int{}
+		var last [lastDrive + 1]uint64
+		hal.OnChange = func(p hal.Pin, high bool) {
+			for d := byte(firstDrive); d <= lastDrive; d++ {
+				if p != fd.stepPins[d] {
+					continue
+				}
+				now := clock.Ticks()
+				if last[d] != 0 && now-last[d] != uint64(notes.NoteDoubleTicks[note]) {
+					t.Errorf("stagger %v: drive %d stepped %d ticks after its last step", stagger, d, now-last[d])
+				}
+				last[d] = now
+				edges[now]++
+			}
+		}
+		defer func() { hal.OnChange = nil }()
+		if unison {
+			fd.HandleDeviceMessage(config.ZoneSubAddress, config.DevCmdNoteOn, []byte{note})
+		} else {
+			for d := byte(firstDrive); d <= lastDrive; d++ {
+				fd.HandleDeviceMessage(d, config.DevCmdNoteOn, []byte{note})
+			}
+		}
+		clock.AdvanceMs(1000)
+		for _, c := range edges {
+			if c > k {
+				n++
+			}
+		}
+		return n
+	}
+	if n := crowded(true, false); n != 0 {
+		t.Errorf("staggered: %d ticks with more than %d drives stepping", n, k)
+	}
+	if n := crowded(false, false); n == 0 {
+		t.Error("unstaggered: no ticks with the drives stepping together")
+	}
+	if n, m := crowded(true, true), crowded(false, true); n != m {
+		t.Errorf("unison zone: %d crowded ticks staggered, %d not; want the same", n, m)
+	}
+}
+
+// TestParking leaves a drive idle until its head is walked back to the
+// park position a step every config.ParkStepMs, then cancels the walk
+// with a note; during a sequence nothing parks.
+func TestParking(t *testing.T) {
+	if config.ParkIdleMs == 0 || config.ShiftRegister {
+		t.Skip("parking disabled, or step lines behind the shift register")
+	}
+	var target uint16
+	if config.ParkAtCenter {
+		target = config.MaxPosition / 2
+	}
+	fd, clock := clocked()
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{60})
+	clock.AdvanceMs(300)
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOff, nil)
+	start, _ := fd.DrivePosition(1)
+	if diff := int(start) - int(target); diff < 10 && diff > -10 {
+		t.Fatalf("head at %d, too near the park position to watch it walk", start)
+	}
+
+	var edges []time.Duration
+	hal.OnChange = func(p hal.Pin, high bool) {
+		if p == fd.stepPins[1] {
+			edges = append(edges, clock.Now())
+		}
+	}
+	defer func() { hal.OnChange = nil }()
+
+	// Idle time is checked every idleCheckTicks, so parking starts up to
+	// a check late.
+	idleFrom := clock.Now()
+	clock.AdvanceMs(config.ParkIdleMs - 20)
+	if fd.moving[1] || len(edges) > 0 {
+		t.Fatalf("parking began %v into the idle time", clock.Now()-idleFrom)
+	}
+	clock.AdvanceMs(40 + config.ParkStepMs)
+	if !fd.moving[1] {
+		t.Fatalf("not parking %v into the idle time", clock.Now()-idleFrom)
+	}
+	clock.AdvanceMs(5 * config.ParkStepMs)
+	for i := 1; i < len(edges); i++ {
+		if gap := edges[i] - edges[i-1]; gap != config.ParkStepMs*time.Millisecond {
+			t.Fatalf("park step %d came %v after the last, want %dms", i, gap, config.ParkStepMs)
+		}
+	}
+	pos, _ := fd.DrivePosition(1)
+	if pos == start || (pos > start) != (target > start) {
+		t.Fatalf("head went from %d to %d parking towards %d", start, pos, target)
+	}
+
+	// A note stops the walk at once.
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{50})
+	if fd.moving[1] || fd.currentPeriod[1] != notes.NoteDoubleTicks[50] {
+		t.Error("note-on didn't cancel parking")
+	}
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOff, nil)
+
+	// Left alone, the head arrives and stays parked.
+	clock.AdvanceMs(config.ParkIdleMs + config.MaxPosition*config.ParkStepMs + 100)
+	if pos, _ := fd.DrivePosition(1); pos != target || !fd.parked[1] || fd.moving[1] {
+		t.Errorf("head at %d, parked %v; want parked at %d", pos, fd.parked[1], target)
+	}
+
+	// Nothing parks during a sequence.
+	fd.HandleSystemMessage(config.CmdSequenceStart, nil)
+	fd.HandleDeviceMessage(2, config.DevCmdNoteOn, []byte{60})
+	clock.AdvanceMs(300)
+	fd.HandleDeviceMessage(2, config.DevCmdNoteOff, nil)
+	clock.AdvanceMs(2 * config.ParkIdleMs)
+	if fd.moving[2] || fd.parked[2] {
+		t.Error("drive parked during a sequence")
+	}
+}
+
+// sharedClocked returns clocked drives on a shared direction line, and a
+// check, run on every step edge, that each head moved one position the
+// way the line points and stays in 0..MaxPosition (from its first step
+// on). It returns the number
+// of times the line turned and the steps taken.
+func sharedClocked(t *testing.T) (fd *FloppyDrives, clock *fakeclock.Clock, counts func() (turns, steps int)) {
+	fd, clock = clocked()
+	fd.sharedDir = true
+	var last [lastDrive + 1]uint16
+	var seen [lastDrive + 1]bool
+	var turns, steps int
+	reverse := false
+	hal.OnChange = func(p hal.Pin, high bool) {
+		if fd.directionState[1] != reverse {
+			reverse = !reverse
+			turns++
+		}
+		for d := byte(firstDrive); d <= lastDrive; d++ {
+			if p != fd.stepPins[d] {
+				continue
+			}
+			steps++
+			pos, want := fd.currentPosition[d], int(last[d])+1
+			if fd.directionState[d] {
+				want = int(last[d]) - 1
+			}
+			if seen[d] && int(pos) != want || pos > config.MaxPosition || fd.directionState[d] != reverse {
+				t.Fatalf("drive %d stepped from %d to %d, reverse %v with the line %v", d, last[d], pos, fd.directionState[d], reverse)
+			}
+			last[d], seen[d] = pos, true
+		}
+	}
+	t.Cleanup(func() { hal.OnChange = nil })
+	return fd, clock, func() (int, int) { return turns, steps }
+}
+
+// TestSharedDirection plays random notes and windows on drives sharing a
+// direction line: every head stays in its travel, and the line turns at
+// most once per traversal's worth of steps rather than thrashing.
+func TestSharedDirection(t *testing.T) {
+	if config.ShiftRegister {
+		t.Skip("step lines go through the shift register")
+	}
+	fd, clock, counts := sharedClocked(t)
+	rng := rand.New(rand.NewPCG(1379, 0))
+	for range 200 {
+		d := byte(firstDrive + rng.IntN(lastDrive))
+		switch rng.IntN(4) {
+		case 0, 1:
+			fd.HandleDeviceMessage(d, config.DevCmdNoteOn, []byte{byte(24 + rng.IntN(48))})
+		case 2:
+			fd.HandleDeviceMessage(d, config.DevCmdNoteOff, nil)
+		case 3:
+			lo := rng.IntN(config.MaxPosition)
+			hi := lo + 1 + rng.IntN(config.MaxPosition-lo)
+			fd.HandleDeviceMessage(d, config.DevCmdSetTravel, []byte{byte(lo), byte(hi)})
+		}
+		clock.AdvanceMs(rng.IntN(200))
+	}
+	turns, steps := counts()
+	if steps < 1000 || turns > steps/4 {
+		t.Errorf("the line turned %d times in %d steps", turns, steps)
+	}
+}
+
+// TestSharedDirectionOpposite starts two drives at opposite ends of their
+// travel. The first to step turns the line; the other sits out its steps
+// until the line comes back, rather than turning it straight back.
+func TestSharedDirectionOpposite(t *testing.T) {
+	if config.ShiftRegister {
+		t.Skip("step lines go through the shift register")
+	}
+	fd, clock, counts := sharedClocked(t)
+	fd.currentPosition[1] = config.MaxPosition
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{MaxFloppyNote})
+	fd.HandleDeviceMessage(2, config.DevCmdNoteOn, []byte{MaxFloppyNote})
+	clock.AdvanceMs(5000)
+	turns, steps := counts()
+	// Drive 1 crosses the travel and back between turns.
+	if max := steps/config.MaxPosition + 2; turns > max {
+		t.Errorf("the line turned %d times in %d steps, want at most %d", turns, steps, max)
+	}
+	for d := byte(1); d <= 2; d++ {
+		if pos := fd.currentPosition[d]; pos > config.MaxPosition {
+			t.Errorf("drive %d at %d", d, pos)
+		}
+	}
+}
+
+// TestCenterOnStart moves idle heads to the middle of their travel on
+// SEQUENCE_START; a note arriving first takes its drive straight over.
+func TestCenterOnStart(t *testing.T) {
+	if !config.CenterOnSequenceStart {
+		t.Skip("centring disabled in config")
+	}
+	fd, clock := clocked()
+	fd.HandleDeviceMessage(3, config.DevCmdSetTravel, []byte{20, 60})
+	fd.HandleDeviceMessage(4, config.DevCmdSetMovement, []byte{1}) // wiggle: 79..81
+	fd.HandleSystemMessage(config.CmdSequenceStart, nil)
+	clock.AdvanceMs(10 * config.CenterStepMs)
+	fd.HandleDeviceMessage(2, config.DevCmdNoteOn, []byte{50})
+	if fd.moving[2] || fd.currentPeriod[2] != notes.NoteDoubleTicks[50] {
+		t.Fatal("note-on didn't take drive 2 over from centring")
+	}
+	early, _ := fd.DrivePosition(2)
+
+	clock.AdvanceMs(config.MaxPosition * config.CenterStepMs)
+	for d, want := range map[byte]uint16{1: config.MaxPosition / 2, 3: 40, 4: 80} {
+		if pos, _ := fd.DrivePosition(d); pos != want || fd.moving[d] {
+			t.Errorf("drive %d at %d, moving %v; want centred at %d", d, pos, fd.moving[d], want)
+		}
+	}
+	if early < 5 || early > 15 {
+		t.Errorf("drive 2 had centred to %d by the note, want about 10", early)
+	}
+	// Drive 2 kept playing from where it was, not walking on to the centre.
+	if fd.currentPeriod[2] != notes.NoteDoubleTicks[50] {
+		t.Error("drive 2 stopped playing")
+	}
+}
+
+// TestTravelSteps sets travel windows in the 16-bit form a scanner takes,
+// as SetTravelSteps encodes it: the drives read the same ends from it as
+// from the byte form, and refuse windows past MaxPosition.
+func TestTravelSteps(t *testing.T) {
+	fd, _ := clocked()
+	set := func(min, max uint16) {
+		fd.HandleDeviceMessage(1, config.DevCmdSetTravel, protocol.SetTravelSteps(1, 1, min, max).Payload)
+	}
+	set(20, 60)
+	if fd.travelMin[1] != 20 || fd.travelMax[1] != 60 {
+		t.Fatalf("window %d-%d, want 20-60", fd.travelMin[1], fd.travelMax[1])
+	}
+	for _, w := range [][2]uint16{{0x0010, 0x0400}, {60, 20}, {0x0100, 0x0110}} {
+		before := fd.Stats.InvalidPayloads
+		set(w[0], w[1])
+		if fd.Stats.InvalidPayloads != before+1 {
+			t.Errorf("window %d-%d: not counted as invalid", w[0], w[1])
+		}
+		if fd.travelMin[1] != 20 || fd.travelMax[1] != 60 {
+			t.Errorf("window %d-%d: moved the window to %d-%d", w[0], w[1], fd.travelMin[1], fd.travelMax[1])
+		}
+	}
+}
+
+// TestBadPayloads checks the payloads the drives must refuse are counted
+// and change nothing.
+func TestBadPayloads(t *testing.T) {
+	fd, _ := clocked()
+	for _, m := range []struct {
+		command byte
+		payload []byte
+	}{
+		{config.DevCmdNoteOn, nil},
+		{config.DevCmdNoteOn, []byte{128}},
+		{config.DevCmdNoteOn, []byte{0xFF, 100}},
+		{config.DevCmdBendPitch, nil},
+		{config.DevCmdBendPitch, []byte{0x20}},
+	} {
+		before := fd.Stats.InvalidPayloads
+		fd.HandleDeviceMessage(1, m.command, m.payload)
+		if fd.Stats.InvalidPayloads != before+1 {
+			t.Errorf("% X % X: not counted as invalid", m.command, m.payload)
+		}
+		if fd.currentPeriod[1] != 0 || fd.originalPeriod[1] != 0 {
+			t.Fatalf("% X % X: drive 1 is sounding", m.command, m.payload)
+		}
+	}
+	fd.HandleDeviceMessage(1, 0x7E, []byte{1, 2})
+	if fd.Stats.UnknownCommands != 1 {
+		t.Errorf("unknown command counted %d times, want 1", fd.Stats.UnknownCommands)
+	}
+	for _, payload := range [][]byte{nil, {60}} {
+		fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{60})
+		fd.HandleDeviceMessage(1, config.DevCmdNoteOff, payload)
+		if fd.originalPeriod[1] != 0 {
+			t.Errorf("note-off % X left drive 1 sounding", payload)
+		}
+	}
+}
+
+// TestSubAddressZero sends every command to sub address 0x00: those one
+// drive alone can take are refused and counted, the rest go to every
+// drive, and none touches the unused drive slot 0.
+func TestSubAddressZero(t *testing.T) {
+	fd, clock := clocked()
+	refused := map[byte]bool{config.DevCmdNoteOn: true, config.DevCmdGliss: true, config.DevCmdTrill: true}
+
+	// Slot 0 of each per-drive array, as NewFloppyDrives leaves it.
+	slotZero := func(fd *FloppyDrives) map[string]string {
+		slots := make(map[string]string)
+		v := reflect.ValueOf(fd).Elem()
+		for i := range v.NumField() {
+			if f := v.Field(i); f.Kind() == reflect.Array && f.Len() == lastDrive+1 {
+				slots[v.Type().Field(i).Name] = fmt.Sprint(f.Index(0))
+			}
+		}
+		return slots
+	}
+	want := slotZero(NewFloppyDrives())
+
+	for command := range 256 {
+		need, known := payloadSize(byte(command))
+		if !known || command == int(config.DevCmdReset) || command == int(config.DevCmdSetZone) {
+			continue // resets have their own tests; zones take any sub address
+		}
+		payload := []byte{60, 64, 10, 100}[:need]
+		if command == int(config.DevCmdSetOption) {
+			payload = []byte{config.OptStartDelay, 5}
+		}
+		for d := byte(firstDrive); d <= lastDrive; d++ {
+			fd.HandleDeviceMessage(d, config.DevCmdNoteOn, []byte{48 + d})
+		}
+		played, before := fd.currentPeriod, fd.Stats.BadSubAddress
+		fd.HandleDeviceMessage(0, byte(command), payload)
+		if counted := fd.Stats.BadSubAddress != before; counted != refused[byte(command)] {
+			t.Errorf("command %02X to sub address 0: counted %v, want %v", command, counted, refused[byte(command)])
+		}
+		if refused[byte(command)] && fd.currentPeriod != played {
+			t.Errorf("command %02X to sub address 0 changed the drives' periods", command)
+		}
+		if command == int(config.DevCmdBendPitch) {
+			for d := byte(firstDrive); d <= lastDrive; d++ {
+				if fd.bend[d] == 0 {
+					t.Errorf("a bend to sub address 0 didn't bend drive %d", d)
+				}
+			}
+		}
+		if command == int(config.DevCmdSetMovement) {
+			for d := byte(firstDrive); d <= lastDrive; d++ {
+				if !fd.wiggle[d] {
+					t.Errorf("movement off to sub address 0 left drive %d moving", d)
+				}
+			}
+		}
+		clock.AdvanceMs(1)
+	}
+	if got := slotZero(fd); !maps.Equal(got, want) {
+		for name, v := range got {
+			if v != want[name] {
+				t.Errorf("%s[0] = %s, want %s", name, v, want[name])
+			}
+		}
+	}
+}
+
+// TestRandomMessages feeds random commands and payloads, of any length, to
+// random sub addresses and checks no drive is left sounding without a
+// period to step at.
+func TestRandomMessages(t *testing.T) {
+	messages := 20000
+	if testing.Short() {
+		messages = 2000
+	}
+	fd, clock := clocked()
+	rng := rand.New(rand.NewPCG(1381, 0))
+	for i := range messages {
+		sub := byte(rng.IntN(config.NumDrives + 4))
+		command := byte(rng.IntN(256))
+		if command == config.DevCmdReset {
+			continue // re-homing is slow, and has its own tests
+		}
+		payload := make([]byte, rng.IntN(7))
+		for j := range payload {
+			// Mostly valid MIDI data, now and then anything.
+			payload[j] = byte(rng.IntN(128))
+			if rng.IntN(8) == 0 {
+				payload[j] = byte(rng.IntN(256))
+			}
+		}
+		fd.HandleDeviceMessage(sub, command, payload)
+		clock.Advance(time.Duration(rng.IntN(2000)) * time.Microsecond)
+		for d := byte(firstDrive); d <= lastDrive; d++ {
+			if fd.originalPeriod[d] != 0 && fd.startCountdown[d] == 0 && fd.currentPeriod[d] == 0 {
+				t.Fatalf("message %d (%d % X % X): drive %d sounds note %d with no period",
+					i, sub, command, payload, d, fd.currentNote[d])
+			}
+			if fd.currentPeriod[d] != 0 && fd.originalPeriod[d] == 0 {
+				t.Fatalf("message %d (%d % X % X): drive %d steps at %d with no note",
+					i, sub, command, payload, d, fd.currentPeriod[d])
+			}
+		}
+	}
+}
+
+// TestDetune checks a drive detuned up 100 cents plays every note within a
+// tick of the semitone above, and that detune 0 is the plain table again.
+func TestDetune(t *testing.T) {
+	fd, _ := clocked()
+	fd.HandleDeviceMessage(1, config.DevCmdDetune, []byte{100})
+	fd.HandleDeviceMessage(2, config.DevCmdDetune, []byte{byte(0x100 - 37)})
+	fd.HandleDeviceMessage(2, config.DevCmdDetune, []byte{0})
+	for note := byte(0); note < MaxFloppyNote; note++ {
+		fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{note})
+		fd.HandleDeviceMessage(2, config.DevCmdNoteOn, []byte{note})
+		fd.HandleDeviceMessage(3, config.DevCmdNoteOn, []byte{note + 1})
+		got, want := int(fd.currentPeriod[1]), int(fd.currentPeriod[3])
+		if got < want-1 || got > want+1 {
+			t.Errorf("note %d +100 cents: %d ticks, note %d is %d", note, got, note+1, want)
+		}
+		if fd.currentPeriod[2] != notes.NoteDoubleTicks[note] {
+			t.Errorf("note %d with detune back at 0: %d ticks, want %d", note, fd.currentPeriod[2], notes.NoteDoubleTicks[note])
+		}
+	}
+}
+
+// TestBendRange bends fully both ways at ranges of 2 and 12 semitones, and
+// changes the range under a held bend.
+func TestBendRange(t *testing.T) {
+	fd, _ := clocked()
+	const note = 40
+	near := func(what string, got uint16, want byte) {
+		t.Helper()
+		w := int(notes.NoteDoubleTicks[want])
+		if diff := int(got) - w; diff < -1-w/1000 || diff > 1+w/1000 {
+			t.Errorf("%s: %d ticks, want about %d (note %d)", what, got, w, want)
+		}
+	}
+	for _, r := range []byte{2, 12} {
+		fd.HandleDeviceMessage(1, config.DevCmdBendRange, []byte{r})
+		fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{note})
+		fd.HandleDeviceMessage(1, config.DevCmdBendPitch, []byte{0x1F, 0xFF})
+		near(fmt.Sprintf("±%d full up", r), fd.currentPeriod[1], note+r)
+		fd.HandleDeviceMessage(1, config.DevCmdBendPitch, []byte{0xE0, 0})
+		near(fmt.Sprintf("±%d full down", r), fd.currentPeriod[1], note-r)
+		fd.HandleDeviceMessage(1, config.DevCmdBendPitch, []byte{0, 0})
+		if fd.currentPeriod[1] != notes.NoteDoubleTicks[note] {
+			t.Errorf("±%d centred: %d ticks, want %d", r, fd.currentPeriod[1], notes.NoteDoubleTicks[note])
+		}
+	}
+
+	// Widening the range under a full bend re-bends the note at once.
+	fd.HandleDeviceMessage(1, config.DevCmdBendRange, []byte{2})
+	fd.HandleDeviceMessage(1, config.DevCmdBendPitch, []byte{0xE0, 0})
+	near("±2 full down", fd.currentPeriod[1], note-2)
+	fd.HandleDeviceMessage(1, config.DevCmdBendRange, []byte{12})
+	near("full down, range widened to ±12", fd.currentPeriod[1], note-12)
+	fd.HandleDeviceMessage(1, config.DevCmdBendRange, []byte{2})
+	near("full down, range back to ±2", fd.currentPeriod[1], note-2)
+}
+
+// TestTremolo gates a drive at 10Hz, 30% duty for a second: it steps only
+// in the first 30ms of every 100ms, 30% as often as an ungated drive, at
+// the same pitch.
+func TestTremolo(t *testing.T) {
+	if config.ShiftRegister {
+		t.Skip("step lines go through the shift register")
+	}
+	const note, rate, duty = 60, 10, 30
+	fd, clock := clocked()
+	cycle := uint64(1000 * notes.TicksPerMs / rate)
+	var start uint64
+	var edges [3]int
+	gated := true
+	hal.OnChange = func(p hal.Pin, high bool) {
+		for d := byte(1); d <= 2; d++ {
+			if p != fd.stepPins[d] {
+				continue
+			}
+			edges[d]++
+			if phase := (clock.Ticks() - start) % cycle; gated && d == 1 && phase > cycle*duty/100 {
+				t.Fatalf("gated drive stepped %d ticks into its %d tick cycle", phase, cycle)
+			}
+		}
+	}
+	defer func() { hal.OnChange = nil }()
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{note})
+	fd.HandleDeviceMessage(2, config.DevCmdNoteOn, []byte{note})
+	fd.HandleDeviceMessage(1, config.DevCmdTremolo, []byte{rate, duty})
+	start = clock.Ticks()
+	clock.AdvanceMs(1000)
+	if fd.currentPeriod[1] != notes.NoteDoubleTicks[note] {
+		t.Errorf("gated drive's period is %d, want %d", fd.currentPeriod[1], notes.NoteDoubleTicks[note])
+	}
+	if got := 100 * edges[1] / edges[2]; got < duty-2 || got > duty+2 {
+		t.Errorf("gated drive stepped %d times to the ungated one's %d: %d%%, want %d%%",
+			edges[1], edges[2], got, duty)
+	}
+
+	// Rate 0 lifts the gate.
+	fd.HandleDeviceMessage(1, config.DevCmdTremolo, []byte{0, duty})
+	edges = [3]int{}
+	gated = false
+	clock.AdvanceMs(1000)
+	if diff := edges[1] - edges[2]; diff < -1 || diff > 1 {
+		t.Errorf("gate off: drive 1 stepped %d times, drive 2 %d", edges[1], edges[2])
+	}
+}
+
+// TestAccent plays an accented and a plain note side by side in each accent
+// style: the accented one steps at the altered period for OptAccentMs, then
+// at the note's own, while the plain one never changes.
+func TestAccent(t *testing.T) {
+	if config.ShiftRegister {
+		t.Skip("step lines go through the shift register")
+	}
+	const note, ms = 60, 20
+	p := uint64(notes.NoteDoubleTicks[note])
+	for style, attack := range map[byte]uint64{config.AccentOctaveDown: 2 * p, config.AccentDoubleRate: p / 2} {
+		fd, clock := clocked()
+		var steps [3][]uint64
+		hal.OnChange = func(pin hal.Pin, high bool) {
+			for d := byte(1); d <= 2; d++ {
+				if pin == fd.stepPins[d] {
+					steps[d] = append(steps[d], clock.Ticks())
+				}
+			}
+		}
+		for d := byte(1); d <= 2; d++ {
+			fd.HandleDeviceMessage(d, config.DevCmdSetOption, []byte{config.OptAccentMs, ms})
+			fd.HandleDeviceMessage(d, config.DevCmdSetOption, []byte{config.OptAccentStyle, style})
+		}
+		start := clock.Ticks()
+		fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{note, config.AccentVelocity})
+		fd.HandleDeviceMessage(2, config.DevCmdNoteOn, []byte{note, config.AccentVelocity - 1})
+		clock.AdvanceMs(200)
+		hal.OnChange = nil
+
+		end := start + ms*notes.TicksPerMs
+		for i := 1; i < len(steps[1]); i++ {
+			at, gap := steps[1][i], steps[1][i]-steps[1][i-1]
+			switch {
+			case at < end && gap != attack:
+				t.Errorf("style %d: accented step %d at tick %d came %d ticks after the last, want %d",
+					style, i, at-start, gap, attack)
+			case at > end+attack && gap != p:
+				t.Errorf("style %d: step %d after the attack came %d ticks after the last, want %d",
+					style, i, gap, p)
+			}
+		}
+		if n := len(steps[1]); n < 10 || steps[1][0] > start+attack {
+			t.Errorf("style %d: accented drive stepped %d times, first at tick %d", style, n, steps[1][0]-start)
+		}
+		for i := 1; i < len(steps[2]); i++ {
+			if gap := steps[2][i] - steps[2][i-1]; gap != p {
+				t.Errorf("style %d: plain step %d came %d ticks after the last, want %d", style, i, gap, p)
+			}
+		}
+	}
+}
+
+// TestPanic gives every drive something to remember - held legato notes,
+// the sustain pedal, a bend, a slide, a trill, a delayed start, vibrato -
+// then sends a note-off to sub address 0: all of it is forgotten, nothing
+// steps afterwards, and no head is re-homed.
+func TestPanic(t *testing.T) {
+	fd, clock := clocked()
+	msg := func(d, command byte, payload ...byte) { fd.HandleDeviceMessage(d, command, payload) }
+	msg(1, config.DevCmdSetOption, config.OptLegato, 1)
+	msg(1, config.DevCmdNoteOn, 50)
+	msg(1, config.DevCmdNoteOn, 52)
+	msg(2, config.DevCmdSustain, 127)
+	msg(2, config.DevCmdNoteOn, 55)
+	msg(2, config.DevCmdNoteOff, 55)
+	msg(3, config.DevCmdNoteOn, 57)
+	msg(3, config.DevCmdBendPitch, 0x10, 0)
+	msg(4, config.DevCmdGliss, 40, 60, 0x03, 0xE8)
+	msg(5, config.DevCmdTrill, 60, 62, 20)
+	msg(6, config.DevCmdSetOption, config.OptStartDelay, 50)
+	msg(6, config.DevCmdNoteOn, 64)
+	msg(7, config.DevCmdSetOption, config.OptVibratoDepth, 50)
+	msg(7, config.DevCmdNoteOn, 65)
+	msg(7, config.DevCmdChannelPressure, 127)
+	clock.AdvanceMs(20)
+	var positions [lastDrive + 1]uint16
+	copy(positions[:], fd.currentPosition[:])
+
+	msg(0, config.DevCmdNoteOff)
+	for d := byte(firstDrive); d <= lastDrive; d++ {
+		switch {
+		case fd.currentPeriod[d] != 0 || fd.originalPeriod[d] != 0:
+			t.Errorf("drive %d still sounding", d)
+		case fd.bend[d] != 0, fd.heldCount[d] != 0, fd.sustain[d], fd.released[d]:
+			t.Errorf("drive %d kept its bend, held notes or pedal", d)
+		case fd.glissCountdown[d] != 0, fd.trillCountdown[d] != 0, fd.startCountdown[d] != 0,
+			fd.accentCountdown[d] != 0, fd.vibratoDepth[d] != 0:
+			t.Errorf("drive %d kept a slide, trill, delayed start, accent or vibrato running", d)
+		case fd.homing[d]:
+			t.Errorf("drive %d is re-homing", d)
+		}
+	}
+	clock.AdvanceMs(100)
+	if fd.currentPosition != positions {
+		t.Errorf("heads moved after the panic: %v, were at %v", fd.currentPosition, positions)
+	}
+
+	// The drives take new notes plainly: unbent, and a note-off ends them,
+	// with no legato note or pedal to fall back on.
+	for _, d := range []byte{1, 2, 3} {
+		msg(d, config.DevCmdNoteOn, 60)
+		if fd.currentPeriod[d] != notes.NoteDoubleTicks[60] {
+			t.Errorf("drive %d plays 60 at %d ticks, want %d", d, fd.currentPeriod[d], notes.NoteDoubleTicks[60])
+		}
+		msg(d, config.DevCmdNoteOff, 60)
+		if fd.originalPeriod[d] != 0 {
+			t.Errorf("drive %d still sounds after its note-off", d)
+		}
+	}
+}
+
+// TestPressure presses a held note at full and half pressure for a second
+// each and measures how far its step gaps swing either side of the note's,
+// then releases to 0 and expects the plain note back.
+func TestPressure(t *testing.T) {
+	if config.ShiftRegister {
+		t.Skip("step lines go through the shift register")
+	}
+	const note, maxCents = 36, 100
+	p := int(notes.NoteDoubleTicks[note])
+	fd, clock := clocked()
+	var gaps []int
+	var last uint64
+	hal.OnChange = func(pin hal.Pin, high bool) {
+		if pin == fd.stepPins[1] {
+			now := clock.Ticks()
+			gaps = append(gaps, int(now-last))
+			last = now
+		}
+	}
+	defer func() { hal.OnChange = nil }()
+	fd.HandleDeviceMessage(1, config.DevCmdSetOption, []byte{config.OptVibratoDepth, maxCents})
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{note})
+	clock.AdvanceMs(100)
+	for _, c := range []struct {
+		pressure byte
+		cents    int16
+	}{{127, maxCents}, {64, maxCents * 64 / 127}, {0, 0}} {
+		fd.HandleDeviceMessage(1, config.DevCmdChannelPressure, []byte{c.pressure})
+		clock.AdvanceMs(10)
+		gaps = gaps[:0]
+		clock.AdvanceMs(1000)
+		lo, hi := slices.Min(gaps), slices.Max(gaps)
+		// The gaps sample the swing once a step, so they may fall short of
+		// its peaks, by up to a third at this rate, but never past them.
+		swing := p * int(notes.SemitoneRatioQ16(c.cents)-65536) >> 16
+		if hi-p < swing*2/3 || hi-p > swing+1 || p-lo < swing*2/3 || p-lo > swing+1 {
+			t.Errorf("pressure %d: steps every %d..%d ticks, want %d±%d", c.pressure, lo, hi, p, swing)
+		}
+	}
+	if fd.vibratoDepth[1] != 0 || fd.currentPeriod[1] != uint16(p) {
+		t.Errorf("pressure 0 left depth %d, period %d", fd.vibratoDepth[1], fd.currentPeriod[1])
+	}
+
+	// A note-off clears the vibrato too; the next note starts plain.
+	fd.HandleDeviceMessage(1, config.DevCmdChannelPressure, []byte{127})
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOff, nil)
+	fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{note})
+	if fd.vibratoDepth[1] != 0 {
+		t.Error("vibrato outlived its note")
+	}
+}
+
+// TestPoolWear plays 1000 notes of a melody with some overlap through an
+// eight-drive pool and compares how long each drive sounded, as the config
+// report gives it: round-robin and least-recently-used both spread the
+// wear evenly.
+func TestPoolWear(t *testing.T) {
+	for _, mode := range []byte{config.ZonePool, config.ZonePoolLRU} {
+		fd, clock := clocked()
+		fd.HandleDeviceMessage(0, config.DevCmdSetZone, []byte{1, firstDrive, lastDrive, mode})
+		rng := rand.New(rand.NewPCG(1388, 0))
+		var sounding []byte
+		for range 1000 {
+			n := byte(40 + rng.IntN(30))
+			if slices.Contains(sounding, n) {
+				continue
+			}
+			fd.HandleDeviceMessage(config.ZoneSubAddress, config.DevCmdNoteOn, []byte{n})
+			sounding = append(sounding, n)
+			// One to three notes ring at once, held for varying lengths.
+			for len(sounding) > 1+rng.IntN(3) {
+				fd.HandleDeviceMessage(config.ZoneSubAddress, config.DevCmdNoteOff, []byte{sounding[0]})
+				sounding = sounding[1:]
+			}
+			clock.AdvanceMs(20 + rng.IntN(200))
+		}
+		var ticks []uint32
+		for d := byte(firstDrive); d <= lastDrive; d++ {
+			c := fd.DriveConfig(d, nil)
+			ticks = append(ticks, uint32(c[5])<<24|uint32(c[6])<<16|uint32(c[7])<<8|uint32(c[8]))
+		}
+		if lo, hi := slices.Min(ticks), slices.Max(ticks); lo == 0 || hi > lo*3/2 {
+			t.Errorf("mode %d: drives sounded for %v ticks, want within a factor of 1.5", mode, ticks)
+		}
+	}
+}
+
+// TestTrill samples a trill every millisecond: it alternates between its
+// two notes every rate ms, a bend bends both, and a note-off for either
+// note ends it.
+func TestTrill(t *testing.T) {
+	const a, b, rate = 60, 62, 20
+	fd, clock := clocked()
+	pa, pb := notes.NoteDoubleTicks[a], notes.NoteDoubleTicks[b]
+	for _, off := range []byte{a, b} {
+		fd.HandleDeviceMessage(1, config.DevCmdTrill, []byte{a, b, rate})
+		// Where the period changed, in ms since the trill started.
+		var changes []string
+		last := fd.currentPeriod[1]
+		for ms := 1; ms <= 5*rate; ms++ {
+			clock.AdvanceMs(1)
+			if p := fd.currentPeriod[1]; p != last {
+				changes = append(changes, fmt.Sprintf("%dms %d", ms, p))
+				last = p
+			}
+		}
+		want := []string{
+			fmt.Sprintf("%dms %d", rate, pb),
+			fmt.Sprintf("%dms %d", 2*rate, pa),
+			fmt.Sprintf("%dms %d", 3*rate, pb),
+			fmt.Sprintf("%dms %d", 4*rate, pa),
+			fmt.Sprintf("%dms %d", 5*rate, pb),
+		}
+		if !slices.Equal(changes, want) {
+			t.Errorf("trill %d/%d every %dms: %q, want %q", a, b, rate, changes, want)
+		}
+
+		// Full bend down by the default 2 semitones takes b to a, a to a-2.
+		fd.HandleDeviceMessage(1, config.DevCmdBendPitch, []byte{0xE0, 0})
+		// (Within a tick: a bend scales the period, the table rounds it.)
+		bent, target := fd.trillBent[1], [2]uint16{notes.NoteDoubleTicks[a-2], pa}
+		for i := range bent {
+			if diff := int(bent[i]) - int(target[i]); diff < -1 || diff > 1 {
+				t.Errorf("bent trill plays %v, want %v", bent, target)
+				break
+			}
+		}
+		fd.HandleDeviceMessage(1, config.DevCmdNoteOff, []byte{off})
+		clock.AdvanceMs(2 * rate)
+		if fd.currentPeriod[1] != 0 || fd.trillCountdown[1] != 0 {
+			t.Errorf("note-off %d left the trill running", off)
+		}
+	}
+}
+
+// TestStartDelay starts the same note on a delayed and an undelayed drive:
+// the delayed one's first step comes exactly the delay later. A note-off
+// inside the delay cancels the note before it is heard, and a delay past
+// MaxStartDelayMs is clamped.
+func TestStartDelay(t *testing.T) {
+	if config.ShiftRegister {
+		t.Skip("step lines go through the shift register")
+	}
+	const note, delay = 60, 15
+	fd, clock := clocked()
+	var first [lastDrive + 1]uint64
+	var steps [lastDrive + 1]int
+	hal.OnChange = func(p hal.Pin, high bool) {
+		for d := byte(firstDrive); d <= lastDrive; d++ {
+			if p == fd.stepPins[d] {
+				if steps[d] == 0 {
+					first[d] = clock.Ticks()
+				}
+				steps[d]++
+			}
+		}
+	}
+	defer func() { hal.OnChange = nil }()
+	fd.HandleDeviceMessage(1, config.DevCmdSetOption, []byte{config.OptStartDelay, delay})
+	fd.HandleDeviceMessage(3, config.DevCmdSetOption, []byte{config.OptStartDelay, delay})
+	fd.HandleDeviceMessage(4, config.DevCmdSetOption, []byte{config.OptStartDelay, 200})
+	for d := byte(1); d <= 4; d++ {
+		fd.HandleDeviceMessage(d, config.DevCmdNoteOn, []byte{note})
+	}
+	clock.AdvanceMs(delay - 5)
+	fd.HandleDeviceMessage(3, config.DevCmdNoteOff, nil)
+	clock.AdvanceMs(100)
+
+	if got := first[1] - first[2]; got != delay*notes.TicksPerMs {
+		t.Errorf("delayed drive started %d ticks after the undelayed one, want %d", got, delay*notes.TicksPerMs)
+	}
+	if got := first[4] - first[2]; got != config.MaxStartDelayMs*notes.TicksPerMs {
+		t.Errorf("drive delayed 200ms started %d ticks late, want %d", got, config.MaxStartDelayMs*notes.TicksPerMs)
+	}
+	if steps[3] != 0 || fd.currentPeriod[3] != 0 {
+		t.Errorf("note cancelled in its delay stepped %d times", steps[3])
+	}
+}
+
+// TestShedding keeps the load high and logs what is shed after each run of
+// busy samples - the effects, then the sounding drives from the highest
+// down, skipping silent ones - then calms it and logs the restores, in
+// reverse. A muted drive keeps its note without stepping.
+func TestShedding(t *testing.T) {
+	fd, clock := clocked()
+	for _, d := range []byte{1, 2, 3, 5} {
+		fd.HandleDeviceMessage(d, config.DevCmdNoteOn, []byte{60})
+	}
+	state := func() string {
+		s := fmt.Sprintf("effects shed %v, muted", fd.effectsShed)
+		for d := byte(firstDrive); d <= lastDrive; d++ {
+			if fd.muted[d] {
+				s += fmt.Sprintf(" %d", d)
+			}
+		}
+		return s
+	}
+	var got []string
+	for range 5 {
+		for range shedAfterSamples {
+			fd.TickLoad(true)
+		}
+		got = append(got, state())
+	}
+	if fd.Stats.Overruns != 5*shedAfterSamples {
+		t.Errorf("%d overruns counted, want %d", fd.Stats.Overruns, 5*shedAfterSamples)
+	}
+	pos := fd.currentPosition[5]
+	clock.AdvanceMs(100)
+	if fd.currentPosition[5] != pos || fd.currentNote[5] != 60 || fd.currentPeriod[5] == 0 {
+		t.Error("muted drive 5 stepped, or lost its note")
+	}
+	for range 5 {
+		for range recoverAfterSamples {
+			fd.TickLoad(false)
+		}
+		got = append(got, state())
+	}
+	want := []string{
+		"effects shed true, muted",
+		"effects shed true, muted 5",
+		"effects shed true, muted 3 5",
+		"effects shed true, muted 2 3 5",
+		"effects shed true, muted 1 2 3 5",
+		"effects shed true, muted 2 3 5",
+		"effects shed true, muted 3 5",
+		"effects shed true, muted 5",
+		"effects shed true, muted",
+		"effects shed false, muted",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("shedding:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+// TestSoftBounce plays a note with soft bounce for whole round trips in
+// windows of several widths: the steps stretch towards the limits and
+// shorten between them, yet average the note's own period to within a
+// quarter tick. A window too narrow to ease bounces hard.
+func TestSoftBounce(t *testing.T) {
+	if config.ShiftRegister {
+		t.Skip("step lines go through the shift register")
+	}
+	const note = 60
+	p := float64(notes.NoteDoubleTicks[note])
+	for _, window := range [][2]byte{{0, config.MaxPosition}, {20, 60}, {30, 47}, {10, 20}} {
+		fd, clock := clocked()
+		fd.soft = true
+		fd.HandleDeviceMessage(1, config.DevCmdSetTravel, []byte{window[0], window[1]})
+		// The ticks of the steps that reach the window's low end, and the
+		// longest and shortest gaps between steps.
+		var lows []uint64
+		var last uint64
+		shortest, longest := uint64(1<<16), uint64(0)
+		hal.OnChange = func(pin hal.Pin, high bool) {
+			if pin != fd.stepPins[1] || fd.currentPeriod[1] == 0 {
+				return
+			}
+			now := clock.Ticks()
+			if last != 0 {
+				shortest, longest = min(shortest, now-last), max(longest, now-last)
+			}
+			last = now
+			if fd.currentPosition[1] == uint16(window[0]) {
+				lows = append(lows, now)
+			}
+		}
+		fd.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{note})
+		clock.AdvanceMs(5000)
+		hal.OnChange = nil
+
+		if len(lows) < 3 {
+			t.Fatalf("window %v: %d round trips", window, len(lows)-1)
+		}
+		trips := len(lows) - 1
+		steps := trips * 2 * int(window[1]-window[0])
+		avg := float64(lows[trips]-lows[0]) / float64(steps)
+		if avg < p-0.25 || avg > p+0.25 {
+			t.Errorf("window %v: steps average %.2f ticks, want %.0f±0.25", window, avg, p)
+		}
+		eased := window[1]-window[0] > 2*config.SoftBounceSteps
+		if got := longest > uint64(p)+1; got != eased {
+			t.Errorf("window %v: steps %d..%d ticks apart, note's %.0f; eased %v, want %v",
+				window, shortest, longest, p, got, eased)
+		}
+		if eased && shortest >= uint64(p) {
+			t.Errorf("window %v: no step shortened to make up for the eased ends", window)
+		}
+	}
+}
+
+// TestSavedSettings changes some drive settings, saves them once they have
+// settled and boots fresh drives on them; then boots on a block older
+// firmware saved, which has only the first three settings.
+func TestSavedSettings(t *testing.T) {
+	if !config.PersistSettings {
+		t.Skip("settings aren't saved")
+	}
+	settings.ClearAll()
+	t.Cleanup(settings.ClearAll)
+	boot := func() *FloppyDrives {
+		fd, _ := clocked()
+		fd.Setup()
+		return fd
+	}
+	defaults := boot()
+
+	fd, clock := clocked()
+	fd.HandleDeviceMessage(2, config.DevCmdTranspose, []byte{0xF4})
+	fd.HandleDeviceMessage(2, config.DevCmdDetune, []byte{15})
+	fd.HandleDeviceMessage(2, config.DevCmdSetOption, []byte{config.OptStartDelay, 7})
+	fd.HandleDeviceMessage(2, config.DevCmdSetOption, []byte{config.OptTravelMax, 120})
+	fd.HandleDeviceMessage(0, config.DevCmdBendRange, []byte{12})
+	fd.HandleDeviceMessage(4, config.DevCmdSetMovement, []byte{1})
+	fd.SaveDriveSettings()
+	if booted := boot(); booted.transpose[2] != 0 {
+		t.Fatal("settings saved before they had settled")
+	}
+	clock.AdvanceMs(config.SaveDelayMs + 100)
+	fd.SaveDriveSettings()
+	booted := boot()
+	for d := byte(firstDrive); d <= lastDrive; d++ {
+		got, want := booted.driveSettings(d, nil), fd.driveSettings(d, nil)
+		if !slices.Equal(got, want) {
+			t.Errorf("drive %d booted with % X, saved % X", d, got, want)
+		}
+	}
+	// Homing at boot kept drive 4's head clamped.
+	if !booted.wiggle[4] || booted.minPosition[4] != 79 || booted.maxPosition[4] != 81 {
+		t.Errorf("drive 4 booted moving %d..%d, want clamped to 79..81", booted.minPosition[4], booted.maxPosition[4])
+	}
+
+	// [transpose, detune, bend range] only, with the rest left at their
+	// defaults.
+	settings.SaveDrive(3, []byte{5, 0, 7})
+	booted = boot()
+	want := defaults.driveSettings(3, nil)
+	want[0], want[2] = 5, 7
+	if got := booted.driveSettings(3, nil); !slices.Equal(got, want) {
+		t.Errorf("drive 3 booted on an old block with % X, want % X", got, want)
+	}
+
+	// A factory reset forgets it again.
+	booted.HandleDeviceMessage(0, config.DevCmdFactoryReset, nil)
+	if got := boot().driveSettings(3, nil); !slices.Equal(got, defaults.driveSettings(3, nil)) {
+		t.Errorf("drive 3 booted with % X after a factory reset", got)
+	}
+}
+
+// TestSavedZones saves zones with the drives' settings and boots fresh
+// drives on them; a factory reset of one drive keeps them, of them all
+// forgets them.
+func TestSavedZones(t *testing.T) {
+	if !config.PersistSettings || lastDrive < 3 {
+		t.Skip("settings aren't saved, or too few drives for two zones")
+	}
+	settings.ClearAll()
+	t.Cleanup(settings.ClearAll)
+	boot := func() *FloppyDrives {
+		fd, _ := clocked()
+		fd.Setup()
+		return fd
+	}
+	none := boot().zoneSettings(nil)
+
+	fd, clock := clocked()
+	fd.HandleDeviceMessage(0, config.DevCmdSetZone, []byte{1, 1, 2, config.ZonePool})
+	fd.HandleDeviceMessage(5, config.DevCmdSetZone, []byte{config.MaxZones, 3, lastDrive, config.ZoneUnison})
+	clock.AdvanceMs(config.SaveDelayMs + 100)
+	fd.SaveDriveSettings()
+	booted := boot()
+	want := fd.zoneSettings(nil)
+	if got := booted.zoneSettings(nil); !slices.Equal(got, want) {
+		t.Errorf("booted with zones % X, saved % X", got, want)
+	}
+	booted.HandleDeviceMessage(config.ZoneSubAddress+config.MaxZones-1, config.DevCmdNoteOn, []byte{60})
+	if booted.currentPeriod[3] == 0 || booted.currentPeriod[lastDrive] == 0 || booted.currentPeriod[1] != 0 {
+		t.Error("a note to the restored unison zone didn't sound on its drives alone")
+	}
+
+	booted.HandleDeviceMessage(2, config.DevCmdFactoryReset, nil)
+	if got := boot().zoneSettings(nil); !slices.Equal(got, want) {
+		t.Errorf("booted with zones % X after drive 2's factory reset, want % X", got, want)
+	}
+	booted.HandleDeviceMessage(0, config.DevCmdFactoryReset, nil)
+	if got := booted.zoneSettings(nil); !slices.Equal(got, none) {
+		t.Errorf("zones % X after a factory reset, want none", got)
+	}
+	if got := boot().zoneSettings(nil); !slices.Equal(got, none) {
+		t.Errorf("booted with zones % X after a factory reset, want none", got)
+	}
+}
+
+// TestAPIErrors checks what PlayNote refuses, and that refused calls and
+// calls for drives that don't exist change nothing.
+func TestAPIErrors(t *testing.T) {
+	if config.NoteRangePolicy != config.RangeDrop {
+		t.Skip("notes out of range are played, not refused")
+	}
+	fd, _ := clocked()
+	fd.HandleDeviceMessage(2, config.DevCmdTranspose, []byte{12})
+	for _, c := range []struct {
+		drive, note byte
+		err         error
+	}{
+		{0, 60, ErrNoDrive},
+		{lastDrive + 1, 60, ErrNoDrive},
+		{0xFF, 60, ErrNoDrive},
+		{1, 128, ErrBadNote},
+		{1, 0xFF, ErrBadNote},
+		{1, MaxFloppyNote + 1, ErrBadNote},
+		{2, MaxFloppyNote - 11, ErrBadNote}, // transposed out of range
+		{1, MaxFloppyNote, nil},
+		{2, MaxFloppyNote - 12, nil},
+	} {
+		if err := fd.PlayNote(c.drive, c.note); err != c.err {
+			t.Errorf("PlayNote(%d, %d) = %v, want %v", c.drive, c.note, err, c.err)
+		}
+	}
+	before := *fd
+	fd.StopNote(0)
+	fd.StopNote(lastDrive + 1)
+	fd.Bend(0, 0)
+	fd.Bend(lastDrive+1, 0x3FFF)
+	fd.PlayNote(3, 200)
+	if *fd != before {
+		t.Error("calls for no drive, or refused, changed the drives")
+	}
+}
+
+// TestAPIAgrees drives two sets of drives through the same random
+// sequence, one by PlayNote, StopNote, Bend and SilenceAll and the other by
+// the matching messages, and checks they end up alike at every step.
+func TestAPIAgrees(t *testing.T) {
+	api, apiClock := clocked()
+	msg, msgClock := clocked()
+	rng := rand.New(rand.NewPCG(1395, 0))
+	for i := range 3000 {
+		d := byte(firstDrive + rng.IntN(lastDrive))
+		var what string
+		switch rng.IntN(8) {
+		case 0, 1, 2:
+			note := byte(20 + rng.IntN(60))
+			what = fmt.Sprintf("play %d on %d", note, d)
+			api.PlayNote(d, note)
+			msg.HandleDeviceMessage(d, config.DevCmdNoteOn, []byte{note})
+		case 3, 4:
+			what = fmt.Sprintf("stop %d", d)
+			api.StopNote(d)
+			msg.HandleDeviceMessage(d, config.DevCmdNoteOff, nil)
+		case 5, 6:
+			bend := uint16(rng.IntN(1 << 14))
+			what = fmt.Sprintf("bend %d by %d", d, bend)
+			api.Bend(d, bend)
+			deflection := uint16(int16(bend) - 8192)
+			msg.HandleDeviceMessage(d, config.DevCmdBendPitch, []byte{byte(deflection >> 8), byte(deflection)})
+		case 7:
+			what = "silence"
+			api.SilenceAll()
+			msg.HandleDeviceMessage(0, config.DevCmdNoteOff, nil)
+		}
+		ms := rng.IntN(50)
+		apiClock.AdvanceMs(ms)
+		msgClock.AdvanceMs(ms)
+		a, m := *api, *msg
+		a.ticker, m.ticker = nil, nil
+		a.Stats, m.Stats = Stats{}, Stats{} // only messages count bad notes
+		if a != m {
+			t.Fatalf("step %d (%s): drives differ:\nperiods %v / %v\npositions %v / %v", i, what,
+				a.currentPeriod, m.currentPeriod, a.currentPosition, m.currentPosition)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package instruments
+
+import (
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/hal"
+	"github.com/ystepanoff/goppy/firmware/notes"
+)
+
+// Duty cycle limit, in ticks: each HDD may drive its coil for hddBudget
+// ticks in every hddWindowTicks.
+const (
+	hddWindowTicks = config.HDDDutyWindowMs * notes.TicksPerMs
+	hddBudget      = hddWindowTicks * config.HDDMaxDutyPercent / 100
+)
+
+// HDD plays percussion on hard drive actuators. Each sub address 1..
+// config.NumHDDs is one drive; a NoteOn fires a single pulse through its
+// coil, with the length and polarity of the General MIDI drum the note
+// names (see hddHit). NoteOff does nothing: a click has no sustain.
+//
+// HDD needs Tick called from the timer interrupt, directly or through a
+// Router, to end its pulses.
+type HDD struct {
+	// Stats counts ignored messages. Only ever incremented.
+	Stats Stats
+
+	// Limited counts hits shortened or dropped by the duty cycle limit.
+	Limited uint16
+
+	// pulse is how many more ticks each coil stays driven.
+	pulse [config.NumHDDs + 1]uint16
+
+	// used counts each coil's driven ticks in the current duty window,
+	// which window counts through.
+	used   [config.NumHDDs + 1]uint16
+	window uint16
+
+	// pinA and pinB are each H-bridge's inputs. A high drives the coil
+	// forwards, B high backwards, both low leaves it idle.
+	pinA [config.NumHDDs + 1]hal.Pin
+	pinB [config.NumHDDs + 1]hal.Pin
+}
+
+// NewHDD creates an HDD instance for config.NumHDDs drives.
+func NewHDD() *HDD {
+	h := &HDD{}
+	for d := 1; d <= config.NumHDDs; d++ {
+		h.pinA[d] = hal.Pin(config.HDDFirstPin + (d-1)*2)
+		h.pinB[d] = hal.Pin(config.HDDFirstPin + (d-1)*2 + 1)
+	}
+	return h
+}
+
+// Setup configures the H-bridge pins as outputs with every coil idle.
+// Must be called before Tick or message handling.
+func (h *HDD) Setup() {
+	for d := 1; d <= config.NumHDDs; d++ {
+		h.pinA[d].Configure(hal.PinConfig{Mode: hal.PinOutput})
+		h.pinB[d].Configure(hal.PinConfig{Mode: hal.PinOutput})
+	}
+	h.StopAll()
+}
+
+// Tick ends pulses that have run their length and keeps the duty cycle
+// accounts. Called by the timer interrupt at TimerResolution intervals.
+func (h *HDD) Tick() {
+	for d := 1; d <= config.NumHDDs; d++ {
+		if h.pulse[d] == 0 {
+			continue
+		}
+		h.used[d]++
+		h.pulse[d]--
+		if h.pulse[d] == 0 {
+			h.pinA[d].Low()
+			h.pinB[d].Low()
+		}
+	}
+	h.window++
+	if h.window >= hddWindowTicks {
+		h.window = 0
+		for d := 1; d <= config.NumHDDs; d++ {
+			h.used[d] = 0
+		}
+	}
+}
+
+// Hit fires the click for a General MIDI drum note on an HDD, cutting
+// short any click still sounding. Drives outside 1..config.NumHDDs are
+// ignored.
+func (h *HDD) Hit(drive, note byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	h.hit(drive, note)
+}
+
+// hit is Hit with interrupts held off.
+func (h *HDD) hit(drive, note byte) {
+	if drive < 1 || drive > config.NumHDDs {
+		return
+	}
+	ticks, reverse := hddHit(note)
+	left := uint16(0)
+	if h.used[drive] < hddBudget {
+		left = hddBudget - h.used[drive]
+	}
+	if ticks > left {
+		h.Limited++
+		ticks = left
+	}
+	h.pinA[drive].Low()
+	h.pinB[drive].Low()
+	h.pulse[drive] = ticks
+	if ticks == 0 {
+		return
+	}
+	if reverse {
+		h.pinB[drive].High()
+	} else {
+		h.pinA[drive].High()
+	}
+}
+
+// StopAll idles every coil at once.
+func (h *HDD) StopAll() {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	h.stopAll()
+}
+
+// stopAll is StopAll with interrupts held off.
+func (h *HDD) stopAll() {
+	for d := 1; d <= config.NumHDDs; d++ {
+		h.pulse[d] = 0
+		h.pinA[d].Low()
+		h.pinB[d].Low()
+	}
+}
+
+// HandleSystemMessage processes system-wide commands (address 0x00).
+func (h *HDD) HandleSystemMessage(command byte, payload []byte) {
+	switch command {
+	case config.CmdReset, config.CmdSequenceStop:
+		h.StopAll()
+	}
+}
+
+// HandleDeviceMessage processes commands for one HDD, or for sub address
+// 0x00 all of them. Unknown commands and unusable payloads are counted in
+// Stats and dropped.
+func (h *HDD) HandleDeviceMessage(subAddress byte, command byte, payload []byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	switch command {
+	case config.DevCmdNoteOn:
+		if len(payload) < 1 || payload[0] > 127 {
+			h.Stats.InvalidPayloads++
+			return
+		}
+		if subAddress == 0x00 {
+			for d := byte(1); d <= config.NumHDDs; d++ {
+				h.hit(d, payload[0])
+			}
+		} else {
+			h.hit(subAddress, payload[0])
+		}
+	case config.DevCmdNoteOff:
+		// A click has already finished.
+	case config.DevCmdReset:
+		if subAddress == 0x00 {
+			h.stopAll()
+		} else if subAddress <= config.NumHDDs {
+			h.pulse[subAddress] = 0
+			h.pinA[subAddress].Low()
+			h.pinB[subAddress].Low()
+		}
+	default:
+		h.Stats.UnknownCommands++
+	}
+}
+
+// hddHit returns the pulse length in ticks and polarity for a General MIDI
+// drum note. Longer pulses swing the arm further for a deeper thud; the
+// return stroke of a reversed pulse sounds brighter.
+func hddHit(note byte) (ticks uint16, reverse bool) {
+	const us = config.TimerResolution
+	switch note {
+	case 35, 36: // bass drums
+		return 4000 / us, false
+	case 38, 40: // snares
+		return 2000 / us, true
+	case 37, 39: // side stick, hand clap
+		return 1000 / us, true
+	case 41, 43, 45, 47, 48, 50: // toms
+		return 3000 / us, false
+	case 42, 44: // closed and pedal hi-hat
+		return 400 / us, false
+	case 46: // open hi-hat
+		return 800 / us, true
+	case 49, 51, 52, 55, 57, 59: // cymbals
+		return 1500 / us, false
+	}
+	return 1000 / us, false
+}
@@ -0,0 +1,100 @@
+//go:build !tinygo
+
+package instruments
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/fakeclock"
+	"github.com/ystepanoff/goppy/firmware/hal"
+)
+
+// hddPulses ticks an HDD from a fake clock and records each pulse through
+// HDD 1's coil: its length in ticks, negative for a reversed one.
+func hddPulses(t *testing.T) (*HDD, *fakeclock.Clock, *[]int) {
+	h := NewHDD()
+	h.Setup()
+	clock := fakeclock.New()
+	clock.Start(config.TimerResolution, h.Tick)
+	var pulses []int
+	var since uint64
+	on := false
+	hal.OnChange = func(p hal.Pin, high bool) {
+		if p != h.pinA[1] && p != h.pinB[1] {
+			return
+		}
+		if high {
+			since, on = clock.Ticks(), true
+			return
+		}
+		if h.pinA[1].Get() || h.pinB[1].Get() || !on {
+			return
+		}
+		n := int(clock.Ticks() - since)
+		if p == h.pinB[1] {
+			n = -n
+		}
+		pulses = append(pulses, n)
+		on = false
+	}
+	t.Cleanup(func() { hal.OnChange = nil })
+	return h, clock, &pulses
+}
+
+// TestHDDPulse hits a kick, a snare, a closed hi-hat and an unmapped note
+// and checks each pulse's width and polarity.
+func TestHDDPulse(t *testing.T) {
+	h, clock, pulses := hddPulses(t)
+	const us = config.TimerResolution
+	hits := []struct {
+		note  byte
+		ticks int
+	}{{36, 4000 / us}, {38, -2000 / us}, {42, 400 / us}, {100, 1000 / us}}
+	for _, hit := range hits {
+		h.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{hit.note})
+		clock.AdvanceMs(config.HDDDutyWindowMs) // a fresh duty window each
+	}
+	if len(*pulses) != len(hits) {
+		t.Fatalf("pulses %v for %d hits", *pulses, len(hits))
+	}
+	for i, hit := range hits {
+		if got := (*pulses)[i]; got != hit.ticks {
+			t.Errorf("note %d: pulse of %d ticks, want %d", hit.note, got, hit.ticks)
+		}
+	}
+	if h.Limited != 0 {
+		t.Errorf("%d hits limited", h.Limited)
+	}
+}
+
+// TestHDDDuty hits kicks back to back and checks the coil is driven for no
+// more than its budget in any duty window, with the hits over it cut short
+// or dropped and counted, and the budget back in the next window.
+func TestHDDDuty(t *testing.T) {
+	h, clock, pulses := hddPulses(t)
+	kick := 4000 / config.TimerResolution
+	for range 10 {
+		h.Hit(1, 36)
+		clock.Advance(4*time.Millisecond + config.TimerResolution*time.Microsecond)
+	}
+	driven := 0
+	for _, p := range *pulses {
+		driven += p
+	}
+	if driven != hddBudget {
+		t.Errorf("pulses %v drove the coil %d ticks, budget %d", *pulses, driven, hddBudget)
+	}
+	if want := uint16(10 - hddBudget/kick); h.Limited != want {
+		t.Errorf("%d hits limited, want %d", h.Limited, want)
+	}
+
+	clock.AdvanceMs(config.HDDDutyWindowMs)
+	*pulses = (*pulses)[:0]
+	h.Hit(1, 36)
+	clock.AdvanceMs(10)
+	if len(*pulses) != 1 || (*pulses)[0] != kick {
+		t.Errorf("next window: pulses %v, want one of %d", *pulses, kick)
+	}
+}
@@ -0,0 +1,328 @@
+package instruments
+
+import (
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/hal"
+	"github.com/ystepanoff/goppy/firmware/notes"
+)
+
+// Interrupter limits and timing, in ticks.
+const (
+	interrupterMaxPulse = config.InterrupterMaxPulseUs / config.TimerResolution
+	interrupterMaxOn    = uint32(config.InterrupterMaxOnMs) * notes.TicksPerMs
+	interrupterWatchdog = uint32(config.InterrupterWatchdogMs) * notes.TicksPerMs
+)
+
+// The limits must leave room for a pulse below 100% duty.
+var _ [100 - config.InterrupterMaxDutyPercent - 1]struct{}
+
+// Interrupter drives Tesla coil interrupter inputs: each sub address 1..
+// config.NumInterrupters is an output sending one pulse per period of its
+// note, OptPulseWidth wide. Whatever is asked, a pulse never exceeds
+// config.InterrupterMaxPulseUs or config.InterrupterMaxDutyPercent of the
+// bent period (see InterrupterPulse), a note never fires for longer than
+// config.InterrupterMaxOnMs, and everything drops low at once on a
+// SequenceStop, a Reset, a call to Trip, or config.InterrupterWatchdogMs
+// without a message.
+//
+// Interrupter needs Tick called from the timer interrupt, directly or
+// through a Router. Its methods hold interrupts off while they change
+// what Tick reads: on AVR a 16 or 32-bit store takes several
+// instructions, and a Tick landing between a new period and its pulse
+// could fire the old, wider pulse on the new period.
+type Interrupter struct {
+	// Stats counts ignored messages. Only ever incremented.
+	Stats Stats
+
+	// Limited counts notes stopped by config.InterrupterMaxOnMs; Trips
+	// counts watchdog trips.
+	Limited uint16
+	Trips   uint16
+
+	// firing is set while an output plays. period is its bent period and
+	// pulse its safe pulse width, in ticks; tick counts through the
+	// period and pulseLeft through the pulse. onLeft is how many more
+	// ticks the note may fire.
+	firing    [config.NumInterrupters + 1]bool
+	period    [config.NumInterrupters + 1]uint16
+	pulse     [config.NumInterrupters + 1]uint16
+	tick      [config.NumInterrupters + 1]uint16
+	pulseLeft [config.NumInterrupters + 1]uint16
+	onLeft    [config.NumInterrupters + 1]uint32
+
+	// note and bend are each output's note and pitch bend deflection;
+	// widthUs is its requested pulse width.
+	note    [config.NumInterrupters + 1]byte
+	bend    [config.NumInterrupters + 1]int16
+	widthUs [config.NumInterrupters + 1]uint16
+
+	// quiet counts ticks since the last message.
+	quiet uint32
+
+	pins [config.NumInterrupters + 1]hal.Pin
+}
+
+// NewInterrupter creates an Interrupter for config.NumInterrupters outputs.
+func NewInterrupter() *Interrupter {
+	t := &Interrupter{}
+	for o := 1; o <= config.NumInterrupters; o++ {
+		t.pins[o] = hal.Pin(config.InterrupterFirstPin + o - 1)
+		t.widthUs[o] = config.InterrupterPulseUs
+	}
+	return t
+}
+
+// Setup configures the outputs, low. Must be called before Tick or
+// message handling.
+func (t *Interrupter) Setup() {
+	for o := 1; o <= config.NumInterrupters; o++ {
+		t.pins[o].Configure(hal.PinConfig{Mode: hal.PinOutput})
+	}
+	t.StopAll()
+}
+
+// Tick fires and ends pulses, ends notes that have fired for
+// config.InterrupterMaxOnMs and runs the watchdog. Called by the timer
+// interrupt at TimerResolution intervals.
+func (t *Interrupter) Tick() {
+	active := false
+	for o := 1; o <= config.NumInterrupters; o++ {
+		if !t.firing[o] {
+			continue
+		}
+		active = true
+		t.onLeft[o]--
+		if t.onLeft[o] == 0 {
+			t.Limited++
+			t.stop(o)
+			continue
+		}
+		if t.pulseLeft[o] > 0 {
+			t.pulseLeft[o]--
+			if t.pulseLeft[o] == 0 {
+				t.pins[o].Low()
+			}
+		}
+		t.tick[o]++
+		if t.tick[o] >= t.period[o] {
+			t.tick[o] = 0
+			t.pulseLeft[o] = t.pulse[o]
+			t.pins[o].High()
+		}
+	}
+	if !active {
+		t.quiet = 0
+		return
+	}
+	t.quiet++
+	if t.quiet >= interrupterWatchdog {
+		t.Trips++
+		t.trip()
+	}
+}
+
+// Trip drops every output low at once and stops its note. Call it from
+// any watchdog that finds the link or the firmware in trouble.
+func (t *Interrupter) Trip() {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	t.trip()
+}
+
+// trip is Trip with interrupts held off. It restarts the watchdog, so a
+// note started straight after a trip gets the full interval.
+func (t *Interrupter) trip() {
+	for o := 1; o <= config.NumInterrupters; o++ {
+		t.stop(o)
+	}
+	t.quiet = 0
+}
+
+// stop drops an output low and stops its note.
+func (t *Interrupter) stop(o int) {
+	t.firing[o] = false
+	t.pulseLeft[o] = 0
+	t.pins[o].Low()
+}
+
+// InterrupterPulse returns the pulse width in ticks for a requested width
+// in µs on a period of periodTicks: the request rounded down to whole
+// ticks, then clamped to config.InterrupterMaxPulseUs and to
+// config.InterrupterMaxDutyPercent of the period. 0 means no pulse can be
+// sent within the limits.
+func InterrupterPulse(widthUs uint16, periodTicks uint16) uint16 {
+	p := widthUs / config.TimerResolution
+	if p > interrupterMaxPulse {
+		p = interrupterMaxPulse
+	}
+	if d := uint16(uint32(periodTicks) * config.InterrupterMaxDutyPercent / 100); p > d {
+		p = d
+	}
+	return p
+}
+
+// retime recomputes an output's period and safe pulse width from its
+// note, bend and requested width, with interrupts held off. A pulse in
+// progress is cut to the new width, counting what it has already run, so
+// it never outlasts the new limit. A note that can't pulse within the
+// limits stops, and retime reports false.
+func (t *Interrupter) retime(o int) bool {
+	half := notes.BendTicks(notes.NoteDoubleTicks[t.note[o]], t.bend[o], config.DefaultBendRange)
+	period := 2 * half
+	pulse := InterrupterPulse(t.widthUs[o], period)
+	if pulse == 0 {
+		t.stop(o)
+		return false
+	}
+	t.pulse[o] = pulse
+	t.period[o] = period
+	// During a pulse, tick has counted the ticks since it began.
+	if t.pulseLeft[o] > 0 && t.tick[o]+t.pulseLeft[o] > pulse {
+		if t.tick[o] >= pulse {
+			t.pulseLeft[o] = 0
+			t.pins[o].Low()
+		} else {
+			t.pulseLeft[o] = pulse - t.tick[o]
+		}
+	}
+	return true
+}
+
+// PlayNote starts an output firing at a note's frequency. Returns
+// ErrNoDrive for an output outside 1..config.NumInterrupters and
+// ErrBadNote for a note above 127 or too high to pulse within the limits.
+func (t *Interrupter) PlayNote(output, note byte) error {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	return t.playNote(output, note)
+}
+
+// playNote is PlayNote with interrupts held off.
+func (t *Interrupter) playNote(output, note byte) error {
+	if output < 1 || output > config.NumInterrupters {
+		return ErrNoDrive
+	}
+	if note > 127 {
+		return ErrBadNote
+	}
+	o := int(output)
+	t.stop(o)
+	t.note[o] = note
+	t.bend[o] = 0
+	if !t.retime(o) {
+		return ErrBadNote
+	}
+	t.tick[o] = t.period[o] - 1
+	t.onLeft[o] = interrupterMaxOn
+	t.firing[o] = true
+	return nil
+}
+
+// StopNote drops an output low.
+func (t *Interrupter) StopNote(output byte) {
+	if output < 1 || output > config.NumInterrupters {
+		return
+	}
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	t.stop(int(output))
+}
+
+// StopAll drops every output low.
+func (t *Interrupter) StopAll() {
+	t.Trip()
+}
+
+// Bend bends the note an output is playing by a 14-bit MIDI pitch bend
+// value (0..16383, 8192 = unbent) across config.DefaultBendRange
+// semitones. The pulse shrinks as needed to stay within the duty limit.
+func (t *Interrupter) Bend(output byte, bend uint16) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	t.bendNote(output, bend)
+}
+
+// bendNote is Bend with interrupts held off.
+func (t *Interrupter) bendNote(output byte, bend uint16) {
+	if output < 1 || output > config.NumInterrupters || !t.firing[output] {
+		return
+	}
+	if bend > 0x3FFF {
+		bend = 0x3FFF
+	}
+	t.bend[output] = int16(bend) - 8192
+	t.retime(int(output))
+}
+
+// HandleSystemMessage processes system-wide commands (address 0x00).
+func (t *Interrupter) HandleSystemMessage(command byte, payload []byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	t.quiet = 0
+	switch command {
+	case config.CmdReset, config.CmdSequenceStop:
+		t.trip()
+	}
+}
+
+// HandleDeviceMessage processes commands for one output, or for sub
+// address 0x00 all of them. Unknown commands and unusable payloads are
+// counted in Stats and dropped.
+func (t *Interrupter) HandleDeviceMessage(subAddress byte, command byte, payload []byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	t.quiet = 0
+	if subAddress > config.NumInterrupters {
+		return
+	}
+	first, last := subAddress, subAddress
+	if subAddress == 0x00 {
+		first, last = 1, config.NumInterrupters
+	}
+	switch command {
+	case config.DevCmdNoteOn:
+		if len(payload) < 1 || payload[0] > 127 {
+			t.Stats.InvalidPayloads++
+			return
+		}
+		t.playNote(subAddress, payload[0])
+	case config.DevCmdNoteOff:
+		for o := first; o <= last; o++ {
+			if len(payload) == 0 || payload[0] == t.note[o] {
+				t.stop(int(o))
+			}
+		}
+	case config.DevCmdReset:
+		for o := first; o <= last; o++ {
+			t.stop(int(o))
+		}
+	case config.DevCmdBendPitch:
+		if len(payload) < 2 {
+			t.Stats.InvalidPayloads++
+			return
+		}
+		bend := int32(int16(payload[0])<<8|int16(payload[1])) + 8192
+		if bend < 0 {
+			bend = 0
+		}
+		for o := first; o <= last; o++ {
+			t.bendNote(o, uint16(bend))
+		}
+	case config.DevCmdSetOption:
+		if len(payload) < 2 {
+			t.Stats.InvalidPayloads++
+			return
+		}
+		if payload[0] != config.OptPulseWidth {
+			return
+		}
+		for o := first; o <= last; o++ {
+			t.widthUs[o] = uint16(payload[1]) * 10
+			if t.firing[o] {
+				t.retime(int(o))
+			}
+		}
+	default:
+		t.Stats.UnknownCommands++
+	}
+}
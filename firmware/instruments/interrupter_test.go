@@ -0,0 +1,196 @@
+//go:build !tinygo
+
+package instruments
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/fakeclock"
+	"github.com/ystepanoff/goppy/firmware/hal"
+	"github.com/ystepanoff/goppy/firmware/notes"
+)
+
+// interrupterPulses ticks an Interrupter from a fake clock and records
+// output 1's pulses as the tick each rose at and its width in ticks.
+func interrupterPulses(t *testing.T) (*Interrupter, *fakeclock.Clock, *[][2]int) {
+	it := NewInterrupter()
+	it.Setup()
+	clock := fakeclock.New()
+	clock.Start(config.TimerResolution, it.Tick)
+	var pulses [][2]int
+	hal.OnChange = func(p hal.Pin, high bool) {
+		if p != it.pins[1] {
+			return
+		}
+		if high {
+			pulses = append(pulses, [2]int{int(clock.Ticks()), -1})
+			return
+		}
+		last := &pulses[len(pulses)-1]
+		last[1] = int(clock.Ticks()) - last[0]
+	}
+	t.Cleanup(func() { hal.OnChange = nil })
+	return it, clock, &pulses
+}
+
+// checkDuty fails for any pulse wider than config.InterrupterMaxPulseUs,
+// or than config.InterrupterMaxDutyPercent of the time to the next rise.
+func checkDuty(t *testing.T, pulses [][2]int) {
+	t.Helper()
+	for i, p := range pulses {
+		if p[1] > interrupterMaxPulse {
+			t.Errorf("pulse %d at tick %d: %d ticks, over %d", i, p[0], p[1], interrupterMaxPulse)
+		}
+		if i+1 == len(pulses) {
+			break
+		}
+		gap := pulses[i+1][0] - p[0]
+		if p[1]*100 > gap*config.InterrupterMaxDutyPercent {
+			t.Errorf("pulse %d at tick %d: %d ticks of %d, over %d%% duty", i, p[0], p[1], gap, config.InterrupterMaxDutyPercent)
+		}
+	}
+}
+
+// TestInterrupterPulse checks InterrupterPulse against the three limits
+// for every requested width OptPulseWidth can ask for, on every period up
+// to 5000 ticks.
+func TestInterrupterPulse(t *testing.T) {
+	for width := uint16(0); width <= 2550; width += 10 {
+		for period := uint16(0); period <= 5000; period++ {
+			want := min(width/config.TimerResolution, interrupterMaxPulse,
+				uint16(uint32(period)*config.InterrupterMaxDutyPercent/100))
+			if got := InterrupterPulse(width, period); got != want {
+				t.Fatalf("InterrupterPulse(%d, %d) = %d, want %d", width, period, got, want)
+			}
+		}
+	}
+}
+
+// TestInterrupterBend bends every note that can pulse fully up and down,
+// and checks the output retimes to the bent period with the pulse the
+// limits allow, or stops if there is none.
+func TestInterrupterBend(t *testing.T) {
+	it := NewInterrupter()
+	it.Setup()
+	it.HandleDeviceMessage(1, config.DevCmdSetOption, []byte{config.OptPulseWidth, 25}) // 250µs, over the cap
+	for note := byte(0); note <= 127; note++ {
+		if it.PlayNote(1, note) != nil {
+			continue
+		}
+		for _, c := range []struct {
+			payload    []byte
+			deflection int16
+		}{{[]byte{0x1F, 0xFF}, 8191}, {[]byte{0xE0, 0x00}, -8192}} {
+			it.PlayNote(1, note)
+			it.HandleDeviceMessage(1, config.DevCmdBendPitch, c.payload)
+			period := 2 * notes.BendTicks(notes.NoteDoubleTicks[note], c.deflection, config.DefaultBendRange)
+			pulse := InterrupterPulse(250, period)
+			if pulse == 0 {
+				if it.firing[1] {
+					t.Errorf("note %d bent %d: still firing with no pulse possible", note, c.deflection)
+				}
+				continue
+			}
+			if !it.firing[1] || it.period[1] != period || it.pulse[1] != pulse {
+				t.Errorf("note %d bent %d: firing %v, period %d pulse %d, want %d and %d",
+					note, c.deflection, it.firing[1], it.period[1], it.pulse[1], period, pulse)
+			}
+		}
+	}
+}
+
+// TestInterrupterMidPulseBend bends a note whose pulse is at the width cap
+// up to where the duty limit makes it narrower, at each tick through a
+// pulse, and checks no pulse ever breaks the width or duty limit, the one
+// the bend lands in included.
+func TestInterrupterMidPulseBend(t *testing.T) {
+	it, clock, pulses := interrupterPulses(t)
+	tick := config.TimerResolution * time.Microsecond
+	it.HandleDeviceMessage(1, config.DevCmdSetOption, []byte{config.OptPulseWidth, config.InterrupterMaxPulseUs / 10})
+	var note byte
+	for n := byte(0); n <= 127 && note == 0; n++ {
+		period := 2 * notes.NoteDoubleTicks[n]
+		bent := 2 * notes.BendTicks(notes.NoteDoubleTicks[n], 8191, config.DefaultBendRange)
+		if InterrupterPulse(config.InterrupterMaxPulseUs, period) == interrupterMaxPulse &&
+			InterrupterPulse(config.InterrupterMaxPulseUs, bent) < interrupterMaxPulse {
+			note = n
+		}
+	}
+	if note == 0 {
+		t.Fatal("no note whose bend narrows its pulse")
+	}
+	for step := range interrupterMaxPulse {
+		it.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{note})
+		clock.AdvanceMs(50) // a few pulses at the full width
+
+		for it.pulseLeft[1] == 0 {
+			clock.Advance(tick)
+		}
+		clock.Advance(time.Duration(step) * tick)
+		it.HandleDeviceMessage(1, config.DevCmdBendPitch, []byte{0x1F, 0xFF})
+		clock.AdvanceMs(20)
+		it.StopNote(1)
+		clock.AdvanceMs(20) // rest, so the next note-on's pulse has its own gap
+	}
+	if len(*pulses) == 0 {
+		t.Fatal("no pulses")
+	}
+	checkDuty(t, *pulses)
+}
+
+// TestInterrupterMaxOn holds a note past config.InterrupterMaxOnMs and
+// checks it stops then, counted, with the output low, while a fresh
+// note-on restarts the limit.
+func TestInterrupterMaxOn(t *testing.T) {
+	it, clock, pulses := interrupterPulses(t)
+	it.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{60})
+	clock.AdvanceMs(config.InterrupterMaxOnMs / 2)
+	it.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{62})
+	clock.AdvanceMs(config.InterrupterMaxOnMs - 1)
+	if !it.firing[1] || it.Limited != 0 {
+		t.Fatalf("stopped before the limit: firing %v, %d limited", it.firing[1], it.Limited)
+	}
+	clock.AdvanceMs(1)
+	if it.firing[1] || it.Limited != 1 || it.pins[1].Get() {
+		t.Errorf("at the limit: firing %v, %d limited, output high %v", it.firing[1], it.Limited, it.pins[1].Get())
+	}
+	n := len(*pulses)
+	clock.AdvanceMs(100)
+	if len(*pulses) != n {
+		t.Errorf("%d pulses after the limit", len(*pulses)-n)
+	}
+}
+
+// TestInterrupterWatchdog keeps an output firing with no messages, by
+// starting notes through the API, and checks the watchdog trips at
+// config.InterrupterWatchdogMs, dropping everything, while a message
+// before then feeds it.
+func TestInterrupterWatchdog(t *testing.T) {
+	it, clock, _ := interrupterPulses(t)
+	// Output 2 starts before output 1 reaches InterrupterMaxOnMs and
+	// carries on past the watchdog interval.
+	second := config.InterrupterWatchdogMs - config.InterrupterMaxOnMs + 100
+	it.PlayNote(1, 60)
+	clock.AdvanceMs(second)
+	it.PlayNote(2, 60)
+	clock.AdvanceMs(config.InterrupterWatchdogMs - second - 1)
+	if it.Trips != 0 {
+		t.Fatalf("tripped %d times before the watchdog interval", it.Trips)
+	}
+	clock.AdvanceMs(1)
+	if it.Trips != 1 || it.firing[1] || it.firing[2] || it.pins[1].Get() || it.pins[2].Get() {
+		t.Errorf("after the interval: %d trips, firing %v %v", it.Trips, it.firing[1], it.firing[2])
+	}
+
+	it.PlayNote(1, 60)
+	clock.AdvanceMs(second)
+	it.PlayNote(2, 60)
+	clock.AdvanceMs(config.InterrupterWatchdogMs - second - 100)
+	it.HandleDeviceMessage(2, config.DevCmdNoteOn, []byte{62})
+	clock.AdvanceMs(200)
+	if it.Trips != 1 {
+		t.Errorf("tripped with the watchdog fed: %d trips", it.Trips)
+	}
+}
@@ -0,0 +1,300 @@
+package instruments
+
+import (
+	"image/color"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/hal"
+	"github.com/ystepanoff/goppy/firmware/notes"
+)
+
+// LightOrgan timing: ticks per frame, and frames per fade.
+const (
+	lightFrame      = config.LightOrganFrameMs * notes.TicksPerMs
+	lightFadeFrames = config.LightOrganDecayMs / config.LightOrganFrameMs
+)
+
+// lightSegmentLEDs is how many LEDs each sub address lights.
+const lightSegmentLEDs = config.LightOrganLEDs / config.LightOrganSegments
+
+// LEDStrip is an addressable LED strip. The WS2812 driver from
+// tinygo.org/x/drivers (ws2812.New(pin)) satisfies it, SK6812s included.
+type LEDStrip interface {
+	WriteColors(buf []color.RGBA) error
+}
+
+// LightOrgan lights a WS2812/SK6812 strip in time with the music. Sub
+// addresses 1..config.LightOrganSegments each own a run of LEDs, lit on a
+// NoteOn in a hue set by the note's pitch class (C red, round the colour
+// wheel to B), as bright as its velocity. A NoteOff fades the segment over
+// config.LightOrganDecayMs; pitch bend moves the hue with the pitch.
+//
+// Mirror it on a Router beside the instrument it follows:
+//
+//	organ := instruments.NewLightOrgan(ws2812.New(machine.D6))
+//	router.Add(1, 6, floppy)
+//	router.Mirror(organ)
+//	instruments.InitTimer(config.TimerResolution, router.Tick)
+//	...
+//	for {
+//		serial.ReadMessages()
+//		organ.Show()
+//	}
+//
+// Tick, from the timer interrupt, runs the fades and paces frames; Show,
+// from the main loop, writes the strip at most once per
+// config.LightOrganFrameMs and only when something changed.
+type LightOrgan struct {
+	// Stats counts ignored messages. Only ever incremented.
+	Stats Stats
+
+	strip LEDStrip
+	buf   [config.LightOrganLEDs]color.RGBA
+
+	// note, bend and peak are each segment's note, pitch bend deflection
+	// and full brightness; level is its brightness now, and fade the
+	// frames left of its fade, 0 if lit or dark.
+	note  [config.LightOrganSegments + 1]byte
+	bend  [config.LightOrganSegments + 1]int16
+	peak  [config.LightOrganSegments + 1]byte
+	level [config.LightOrganSegments + 1]byte
+	fade  [config.LightOrganSegments + 1]uint16
+
+	// frameTicks counts down to the next frame; frameDue is set when it
+	// arrives and dirty when the strip needs writing.
+	frameTicks uint16
+	frameDue   bool
+	dirty      bool
+}
+
+// NewLightOrgan creates a LightOrgan writing to strip.
+func NewLightOrgan(strip LEDStrip) *LightOrgan {
+	return &LightOrgan{strip: strip, frameTicks: lightFrame}
+}
+
+// Tick steps the fades once a frame and marks the frame due. Called by the
+// timer interrupt at TimerResolution intervals.
+func (l *LightOrgan) Tick() {
+	l.frameTicks--
+	if l.frameTicks > 0 {
+		return
+	}
+	l.frameTicks = lightFrame
+	l.frameDue = true
+	for s := 1; s <= config.LightOrganSegments; s++ {
+		if l.fade[s] == 0 {
+			continue
+		}
+		l.fade[s]--
+		l.level[s] = FadeLevel(l.peak[s], l.fade[s], lightFadeFrames)
+		l.dirty = true
+	}
+}
+
+// Show writes the strip if a frame is due and anything changed since the
+// last one. Call it from the main loop, never from interrupt context.
+// The frame is copied out with interrupts held off, so a fade step can't
+// land halfway through it, and written with them back on.
+func (l *LightOrgan) Show() {
+	state := hal.DisableInterrupts()
+	if !l.frameDue || !l.dirty {
+		hal.RestoreInterrupts(state)
+		return
+	}
+	l.frameDue = false
+	l.dirty = false
+	for s := 1; s <= config.LightOrganSegments; s++ {
+		c := color.RGBA{A: 0xFF}
+		if l.level[s] > 0 {
+			c = NoteColor(l.note[s], l.bend[s], config.DefaultBendRange, l.level[s])
+		}
+		for i := (s - 1) * lightSegmentLEDs; i < s*lightSegmentLEDs; i++ {
+			l.buf[i] = c
+		}
+	}
+	hal.RestoreInterrupts(state)
+	l.strip.WriteColors(l.buf[:])
+}
+
+// Light lights a segment for a note at a velocity (1..127).
+func (l *LightOrgan) Light(segment, note, velocity byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	l.light(segment, note, velocity)
+}
+
+// light is Light with interrupts held off.
+func (l *LightOrgan) light(segment, note, velocity byte) {
+	if segment < 1 || segment > config.LightOrganSegments {
+		return
+	}
+	if velocity > 127 {
+		velocity = 127
+	}
+	l.note[segment] = note
+	l.bend[segment] = 0
+	l.peak[segment] = byte(uint16(velocity) * config.LightOrganBrightness / 127)
+	l.level[segment] = l.peak[segment]
+	l.fade[segment] = 0
+	l.dirty = true
+}
+
+// Release starts a segment fading, or blanks it with no decay configured.
+func (l *LightOrgan) Release(segment byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	l.release(segment)
+}
+
+// release is Release with interrupts held off.
+func (l *LightOrgan) release(segment byte) {
+	if segment < 1 || segment > config.LightOrganSegments || l.level[segment] == 0 {
+		return
+	}
+	l.peak[segment] = l.level[segment]
+	l.fade[segment] = lightFadeFrames
+	if lightFadeFrames == 0 {
+		l.level[segment] = 0
+	}
+	l.dirty = true
+}
+
+// Blank darkens every segment at once.
+func (l *LightOrgan) Blank() {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	l.blank()
+}
+
+// blank is Blank with interrupts held off.
+func (l *LightOrgan) blank() {
+	for s := 1; s <= config.LightOrganSegments; s++ {
+		l.level[s] = 0
+		l.fade[s] = 0
+	}
+	l.dirty = true
+}
+
+// bendSegment moves a segment's hue with a signed pitch bend deflection.
+func (l *LightOrgan) bendSegment(segment byte, deflection int16) {
+	if segment < 1 || segment > config.LightOrganSegments {
+		return
+	}
+	l.bend[segment] = deflection
+	if l.level[segment] > 0 {
+		l.dirty = true
+	}
+}
+
+// NoteColor returns the colour for a note bent by a signed deflection
+// (-8192..8191, full deflection reaching rangeSemitones) at a brightness.
+// The twelve pitch classes sit evenly round the colour wheel from C at
+// red, so octaves share a colour and a bend slides between neighbours.
+func NoteColor(note byte, deflection int16, rangeSemitones byte, brightness byte) color.RGBA {
+	cents := int32(note%12)*100 + int32(deflection)*int32(rangeSemitones)*100/8192
+	cents %= 1200
+	if cents < 0 {
+		cents += 1200
+	}
+	return hueColor(byte(cents*256/1200), brightness)
+}
+
+// hueColor returns a fully saturated colour of hue (0..255 round the
+// wheel) and brightness.
+func hueColor(hue, brightness byte) color.RGBA {
+	sector := hue / 43
+	rise := uint16(hue-sector*43) * 6 // 0..252 through the sector
+	v := uint16(brightness)
+	up := byte(v * rise / 255)
+	down := byte(v * (255 - rise) / 255)
+	b := brightness
+	switch sector {
+	case 0:
+		return color.RGBA{R: b, G: up, A: 0xFF}
+	case 1:
+		return color.RGBA{R: down, G: b, A: 0xFF}
+	case 2:
+		return color.RGBA{G: b, B: up, A: 0xFF}
+	case 3:
+		return color.RGBA{G: down, B: b, A: 0xFF}
+	case 4:
+		return color.RGBA{R: up, B: b, A: 0xFF}
+	default:
+		return color.RGBA{R: b, B: down, A: 0xFF}
+	}
+}
+
+// FadeLevel returns the brightness of a fade from peak with left of total
+// frames to go, falling linearly to 0.
+func FadeLevel(peak byte, left, total uint16) byte {
+	if total == 0 || left == 0 {
+		return 0
+	}
+	if left >= total {
+		return peak
+	}
+	return byte(uint32(peak) * uint32(left) / uint32(total))
+}
+
+// Caps returns the config.Cap bits of the commands the organ takes, for
+// the pong: velocity, as brightness.
+func (l *LightOrgan) Caps() uint16 { return config.CapVelocity }
+
+// HandleSystemMessage processes system-wide commands (address 0x00).
+func (l *LightOrgan) HandleSystemMessage(command byte, payload []byte) {
+	switch command {
+	case config.CmdReset, config.CmdSequenceStop:
+		l.Blank()
+	}
+}
+
+// HandleDeviceMessage processes commands for one segment. A NoteOff or
+// Reset to sub address 0x00 fades or blanks every segment. Commands that
+// don't change the light, such as options, are ignored; unusable payloads
+// are counted in Stats and dropped.
+func (l *LightOrgan) HandleDeviceMessage(subAddress byte, command byte, payload []byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	switch command {
+	case config.DevCmdNoteOn:
+		if len(payload) < 1 || payload[0] > 127 {
+			l.Stats.InvalidPayloads++
+			return
+		}
+		velocity := byte(100)
+		if len(payload) > 1 && payload[1] > 0 {
+			velocity = payload[1]
+		}
+		l.light(subAddress, payload[0], velocity)
+	case config.DevCmdNoteOff:
+		if subAddress == 0x00 {
+			for s := byte(1); s <= config.LightOrganSegments; s++ {
+				l.release(s)
+			}
+			return
+		}
+		if subAddress > config.LightOrganSegments {
+			return
+		}
+		if len(payload) > 0 && payload[0] != l.note[subAddress] {
+			return
+		}
+		l.release(subAddress)
+	case config.DevCmdReset:
+		if subAddress == 0x00 {
+			l.blank()
+			return
+		}
+		if subAddress <= config.LightOrganSegments {
+			l.level[subAddress] = 0
+			l.fade[subAddress] = 0
+			l.dirty = true
+		}
+	case config.DevCmdBendPitch:
+		if len(payload) < 2 {
+			l.Stats.InvalidPayloads++
+			return
+		}
+		l.bendSegment(subAddress, int16(payload[0])<<8|int16(payload[1]))
+	}
+}
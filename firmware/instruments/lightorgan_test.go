@@ -0,0 +1,102 @@
+//go:build !tinygo
+
+package instruments
+
+import (
+	"image/color"
+	"slices"
+	"testing"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/fakeclock"
+)
+
+// fakeStrip is an LED strip that keeps every frame written to it.
+type fakeStrip struct {
+	frames [][]color.RGBA
+}
+
+func (s *fakeStrip) WriteColors(buf []color.RGBA) error {
+	s.frames = append(s.frames, slices.Clone(buf))
+	return nil
+}
+
+// TestNoteColor checks C is red and the other pitch classes go round the
+// wheel from it, that octaves share a colour, and that a bend of a
+// semitone either way lands on the neighbouring note's colour.
+func TestNoteColor(t *testing.T) {
+	for _, c := range []struct {
+		note byte
+		want color.RGBA
+	}{
+		{60, color.RGBA{R: 255, A: 0xFF}},         // C
+		{64, color.RGBA{R: 3, G: 255, A: 0xFF}},   // E, a third of the way
+		{68, color.RGBA{G: 9, B: 255, A: 0xFF}},   // G#, two thirds
+		{71, color.RGBA{R: 255, B: 141, A: 0xFF}}, // B, nearly back to red
+	} {
+		if got := NoteColor(c.note, 0, 2, 255); got != c.want {
+			t.Errorf("note %d: %v, want %v", c.note, got, c.want)
+		}
+	}
+	for note := range byte(116) {
+		c := NoteColor(note, 0, 2, 200)
+		if octave := NoteColor(note+12, 0, 2, 200); octave != c {
+			t.Errorf("note %d: %v, an octave up %v", note, c, octave)
+		}
+		if r, g, b := c.R, c.G, c.B; max(r, g, b) != 200 {
+			t.Errorf("note %d: %v, brightest channel not 200", note, c)
+		}
+		if note == 0 {
+			continue
+		}
+		// 4096 of 8192 across two semitones is one semitone.
+		if up := NoteColor(note-1, 4096, 2, 200); up != c {
+			t.Errorf("note %d bent up a semitone: %v, want %v", note-1, up, c)
+		}
+		if down := NoteColor(note+1, -4096, 2, 200); down != c {
+			t.Errorf("note %d bent down a semitone: %v, want %v", note+1, down, c)
+		}
+	}
+}
+
+// TestLightDecay lights a segment at full velocity and releases it: the
+// strip shows the peak, then each frame steps down FadeLevel's ramp to
+// dark, with no frame written once nothing changes.
+func TestLightDecay(t *testing.T) {
+	strip := &fakeStrip{}
+	l := NewLightOrgan(strip)
+	clock := fakeclock.New()
+	clock.Start(config.TimerResolution, l.Tick)
+	frame := func() {
+		clock.AdvanceMs(config.LightOrganFrameMs)
+		l.Show()
+	}
+	level := func(f []color.RGBA) byte { return f[0].R } // C is pure red
+
+	l.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{60, 127})
+	frame()
+	l.HandleDeviceMessage(1, config.DevCmdNoteOff, []byte{60})
+	for range lightFadeFrames + 3 {
+		frame()
+	}
+	var got []byte
+	for _, f := range strip.frames {
+		got = append(got, level(f))
+		if f[lightSegmentLEDs] != (color.RGBA{A: 0xFF}) {
+			t.Fatalf("segment 2 lit: %v", f[lightSegmentLEDs])
+		}
+	}
+	want := []byte{config.LightOrganBrightness}
+	for left := uint16(lightFadeFrames - 1); ; left-- {
+		want = append(want, FadeLevel(config.LightOrganBrightness, left, lightFadeFrames))
+		if left == 0 {
+			break
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("segment 1 levels %v, want %v", got, want)
+	}
+	if want[len(want)-1] != 0 {
+		t.Errorf("fade ended at %d, not dark", want[len(want)-1])
+	}
+}
@@ -0,0 +1,416 @@
+package instruments
+
+import (
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/hal"
+	"github.com/ystepanoff/goppy/firmware/notes"
+)
+
+// PWMSynth plays square waves, a voice per sub address, on boards with a
+// PWM peripheral to spare for each: the same Moppy stream that drives the
+// floppies, played on a speaker array. Each BuzzerVoice needs a peripheral
+// of its own (an RP2040 slice, say), as channels of one share its period;
+// mixing is left to resistors outside.
+//
+// Sub addresses 1..config.NumSynthVoices map onto the outputs in turn;
+// when there are fewer outputs they are shared, the latest note-on
+// winning. It takes the drives' Transpose, Detune, BendRange and SetZone
+// commands, zones included (unison and pool), and the drives' range
+// policy over config.SynthMinNote..config.SynthMaxNote. The drives' other
+// commands, such as SetMovement and SetOption, are accepted and ignored,
+// so a stream meant for the drives plays unchanged. The hardware makes the
+// tone, so PWMSynth needs no Tick; as with Buzzer, its methods hold
+// interrupts off so an output's period and duty change together.
+type PWMSynth struct {
+	// Stats counts ignored messages. Only ever incremented.
+	Stats Stats
+
+	outputs  []BuzzerVoice
+	channels []uint8
+
+	// owner is the sub address each output sounds for, 0 if silent;
+	// period is each output's period in ns, 0 if never set.
+	owner  []byte
+	period []uint64
+
+	// Per sub address: the note requested (before transpose) and sounding
+	// (after), whether it sounds, the bend deflection and its settings.
+	note      [config.NumSynthVoices + 1]byte
+	sounding  [config.NumSynthVoices + 1]byte
+	on        [config.NumSynthVoices + 1]bool
+	bend      [config.NumSynthVoices + 1]int16
+	transpose [config.NumSynthVoices + 1]int8
+	detune    [config.NumSynthVoices + 1]int8
+	bendRange [config.NumSynthVoices + 1]byte
+
+	// lastUsed is the noteCount at each sub address's last note-on, for
+	// ZonePoolLRU.
+	lastUsed  [config.NumSynthVoices + 1]uint16
+	noteCount uint16
+
+	zones [config.MaxZones]zone
+}
+
+// NewPWMSynth creates a PWMSynth playing through outputs.
+func NewPWMSynth(outputs ...BuzzerVoice) *PWMSynth {
+	s := &PWMSynth{
+		outputs:  outputs,
+		channels: make([]uint8, len(outputs)),
+		owner:    make([]byte, len(outputs)),
+		period:   make([]uint64, len(outputs)),
+	}
+	for v := 1; v <= config.NumSynthVoices; v++ {
+		s.bendRange[v] = config.DefaultBendRange
+	}
+	return s
+}
+
+// Setup configures each output's PWM peripheral and pin, silent. Outputs
+// whose pin their peripheral can't drive stay silent for good.
+func (s *PWMSynth) Setup() {
+	for i, o := range s.outputs {
+		o.PWM.Configure(hal.PWMConfig{})
+		ch, err := o.PWM.Channel(o.Pin)
+		if err != nil {
+			s.outputs[i].PWM = nil
+			continue
+		}
+		s.channels[i] = ch
+		o.PWM.Set(ch, 0)
+	}
+}
+
+// output returns the output index sub address sub plays on.
+func (s *PWMSynth) output(sub byte) int {
+	return int(sub-1) % len(s.outputs)
+}
+
+// fit applies a sub address's transpose to a note and fits it into
+// config.SynthMinNote..config.SynthMaxNote by config.NoteRangePolicy.
+func (s *PWMSynth) fit(sub, note byte) (byte, bool) {
+	n := int16(note) + int16(s.transpose[sub])
+	switch config.NoteRangePolicy {
+	case config.RangeClamp:
+		if n < config.SynthMinNote {
+			n = config.SynthMinNote
+		} else if n > config.SynthMaxNote {
+			n = config.SynthMaxNote
+		}
+	case config.RangeFold:
+		for n > config.SynthMaxNote {
+			n -= 12
+		}
+		for n < config.SynthMinNote {
+			n += 12
+		}
+	default:
+		if n < config.SynthMinNote || n > config.SynthMaxNote {
+			return 0, false
+		}
+	}
+	return byte(n), true
+}
+
+// PlayNote sounds a note (before transpose) on a sub address, taking its
+// output over from any other sub address. Returns ErrNoDrive for a sub
+// address outside 1..config.NumSynthVoices and ErrBadNote for a note the
+// range policy drops.
+func (s *PWMSynth) PlayNote(sub, note byte) error {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	return s.playNote(sub, note)
+}
+
+// playNote is PlayNote with interrupts held off.
+func (s *PWMSynth) playNote(sub, note byte) error {
+	if sub < 1 || sub > config.NumSynthVoices || len(s.outputs) == 0 {
+		return ErrNoDrive
+	}
+	if note > 127 {
+		return ErrBadNote
+	}
+	n, ok := s.fit(sub, note)
+	if !ok {
+		return ErrBadNote
+	}
+	s.noteCount++
+	s.lastUsed[sub] = s.noteCount
+	s.note[sub] = note
+	s.sounding[sub] = n
+	s.on[sub] = true
+	s.bend[sub] = 0
+	if o := s.output(sub); s.owner[o] != sub {
+		if prev := s.owner[o]; prev != 0 {
+			s.on[prev] = false
+		}
+		s.owner[o] = sub
+	}
+	s.sound(sub)
+	return nil
+}
+
+// StopNote silences a sub address, and its output if it holds it.
+func (s *PWMSynth) StopNote(sub byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	s.stopNote(sub)
+}
+
+// stopNote is StopNote with interrupts held off.
+func (s *PWMSynth) stopNote(sub byte) {
+	if sub < 1 || sub > config.NumSynthVoices || len(s.outputs) == 0 {
+		return
+	}
+	s.on[sub] = false
+	o := s.output(sub)
+	if s.owner[o] != sub {
+		return
+	}
+	s.owner[o] = 0
+	if s.outputs[o].PWM != nil {
+		s.outputs[o].PWM.Set(s.channels[o], 0)
+	}
+}
+
+// StopAll silences every output.
+func (s *PWMSynth) StopAll() {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	for sub := byte(1); sub <= config.NumSynthVoices; sub++ {
+		s.stopNote(sub)
+	}
+}
+
+// Bend bends a sub address's note by a 14-bit MIDI pitch bend value
+// (0..16383, 8192 = unbent) across its bend range.
+func (s *PWMSynth) Bend(sub byte, bend uint16) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	s.bendNote(sub, bend)
+}
+
+// bendNote is Bend with interrupts held off.
+func (s *PWMSynth) bendNote(sub byte, bend uint16) {
+	if sub < 1 || sub > config.NumSynthVoices || len(s.outputs) == 0 {
+		return
+	}
+	if bend > 0x3FFF {
+		bend = 0x3FFF
+	}
+	s.bend[sub] = int16(bend) - 8192
+	if s.on[sub] {
+		s.sound(sub)
+	}
+}
+
+// sound sets a sub address's output to its note, bent and detuned, at 50%
+// duty. The period is only rewritten when it changes. A period the
+// peripheral can't produce silences the output.
+func (s *PWMSynth) sound(sub byte) {
+	o := s.output(sub)
+	pwm := s.outputs[o].PWM
+	if pwm == nil {
+		return
+	}
+	p := SynthPeriod(s.sounding[sub], s.bend[sub], s.bendRange[sub], s.detune[sub])
+	if p != s.period[o] {
+		if err := pwm.SetPeriod(p); err != nil {
+			s.period[o] = 0
+			pwm.Set(s.channels[o], 0)
+			return
+		}
+		s.period[o] = p
+	}
+	pwm.Set(s.channels[o], pwm.Top()/2)
+}
+
+// SynthPeriod returns the period in nanoseconds of a note bent by a signed
+// deflection (-8192..8191, full deflection reaching rangeSemitones) and
+// detuned by cents.
+func SynthPeriod(note byte, deflection int16, rangeSemitones byte, cents int8) uint64 {
+	p := BuzzerPeriod(note, deflection, rangeSemitones)
+	if cents == 0 {
+		return p
+	}
+	return (p*uint64(notes.SemitoneRatioQ16(-int16(cents))) + 0x8000) >> 16
+}
+
+// setZone defines zone number (1-based) as sub addresses first..last in
+// mode, as for the drives. first == 0 clears the zone.
+func (s *PWMSynth) setZone(number, first, last, mode byte) {
+	if number == 0 || number > config.MaxZones {
+		return
+	}
+	z := &s.zones[number-1]
+	if first == 0 {
+		*z = zone{}
+		return
+	}
+	if last < first || last > config.NumSynthVoices || mode > config.ZonePoolLRU {
+		return
+	}
+	*z = zone{first: first, last: last, mode: mode, next: first}
+}
+
+// handleZoneMessage routes a message addressed to a zone as the drives
+// do: pool zones place each note-on on a free member and send note-offs to
+// the member playing that note; everything else goes to every member.
+func (s *PWMSynth) handleZoneMessage(z *zone, command byte, payload []byte) {
+	if z.first == 0 {
+		return
+	}
+	if z.mode != config.ZoneUnison && len(payload) > 0 {
+		switch command {
+		case config.DevCmdNoteOn:
+			if v := s.poolVoice(z); v != 0 {
+				s.handleDeviceMessage(v, command, payload)
+			}
+			return
+		case config.DevCmdNoteOff:
+			for v := z.first; v <= z.last; v++ {
+				if s.on[v] && s.note[v] == payload[0] {
+					s.handleDeviceMessage(v, command, payload)
+					return
+				}
+			}
+			return
+		}
+	}
+	for v := z.first; v <= z.last; v++ {
+		s.handleDeviceMessage(v, command, payload)
+	}
+}
+
+// poolVoice picks the sub address in a pool zone for a new note: a silent
+// one, the next round-robin or for ZonePoolLRU the one idle longest. With
+// none silent the round-robin one is taken over anyway.
+func (s *PWMSynth) poolVoice(z *zone) byte {
+	var idlest byte
+	var idlestAge uint16
+	v := z.next
+	for i := z.first; i <= z.last; i++ {
+		if !s.on[v] {
+			if z.mode != config.ZonePoolLRU {
+				break
+			}
+			if age := s.noteCount - s.lastUsed[v]; idlest == 0 || age > idlestAge {
+				idlest, idlestAge = v, age
+			}
+		}
+		v++
+		if v > z.last {
+			v = z.first
+		}
+	}
+	if idlest != 0 {
+		return idlest
+	}
+	z.next = v + 1
+	if z.next > z.last {
+		z.next = z.first
+	}
+	return v
+}
+
+// Caps returns the config.Cap bits of the commands the voices take, for
+// the pong.
+func (s *PWMSynth) Caps() uint16 {
+	return config.CapBendRange | config.CapTuning | config.CapZones
+}
+
+// HandleSystemMessage processes system-wide commands (address 0x00).
+func (s *PWMSynth) HandleSystemMessage(command byte, payload []byte) {
+	switch command {
+	case config.CmdReset, config.CmdSequenceStop:
+		s.StopAll()
+	}
+}
+
+// HandleDeviceMessage processes commands for one sub address, for every
+// one at 0x00, or for a zone at its alias. Unknown commands and unusable
+// payloads are counted in Stats and dropped.
+func (s *PWMSynth) HandleDeviceMessage(subAddress byte, command byte, payload []byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	s.handleDeviceMessage(subAddress, command, payload)
+}
+
+// handleDeviceMessage is HandleDeviceMessage with interrupts held off.
+func (s *PWMSynth) handleDeviceMessage(subAddress byte, command byte, payload []byte) {
+	need, known := payloadSize(command)
+	if !known {
+		s.Stats.UnknownCommands++
+		return
+	}
+	if len(payload) < need {
+		s.Stats.InvalidPayloads++
+		return
+	}
+
+	if command == config.DevCmdSetZone {
+		s.setZone(payload[0], payload[1], payload[2], payload[3])
+		return
+	}
+	if subAddress >= config.ZoneSubAddress {
+		if z := int(subAddress - config.ZoneSubAddress); z < config.MaxZones {
+			s.handleZoneMessage(&s.zones[z], command, payload)
+		}
+		return
+	}
+	if subAddress > config.NumSynthVoices {
+		return
+	}
+	first, last := subAddress, subAddress
+	if subAddress == 0x00 {
+		first, last = 1, config.NumSynthVoices
+	}
+
+	switch command {
+	case config.DevCmdNoteOn:
+		if payload[0] > 127 {
+			s.Stats.InvalidPayloads++
+			return
+		}
+		s.playNote(subAddress, payload[0])
+	case config.DevCmdNoteOff:
+		for v := first; v <= last; v++ {
+			if len(payload) == 0 || payload[0] == s.note[v] {
+				s.stopNote(v)
+			}
+		}
+	case config.DevCmdReset:
+		for v := first; v <= last; v++ {
+			s.stopNote(v)
+		}
+	case config.DevCmdBendPitch:
+		bend := int32(int16(payload[0])<<8|int16(payload[1])) + 8192
+		if bend < 0 {
+			bend = 0
+		}
+		for v := first; v <= last; v++ {
+			s.bendNote(v, uint16(bend))
+		}
+	case config.DevCmdBendRange:
+		if payload[0] < 1 || payload[0] > config.MaxBendRange {
+			s.Stats.InvalidPayloads++
+			return
+		}
+		for v := first; v <= last; v++ {
+			s.bendRange[v] = payload[0]
+			if s.on[v] {
+				s.sound(v)
+			}
+		}
+	case config.DevCmdTranspose:
+		for v := first; v <= last; v++ {
+			s.transpose[v] = int8(payload[0])
+		}
+	case config.DevCmdDetune:
+		for v := first; v <= last; v++ {
+			s.detune[v] = int8(payload[0])
+			if s.on[v] {
+				s.sound(v)
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+//go:build !tinygo
+
+package instruments
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+)
+
+// synthOn sets up a PWMSynth on n fake outputs.
+func synthOn(n int) (*PWMSynth, []*fakePWM) {
+	var pwms []*fakePWM
+	var outputs []BuzzerVoice
+	for i := range n {
+		pwms = append(pwms, &fakePWM{})
+		outputs = append(outputs, BuzzerVoice{PWM: pwms[i], Pin: 2})
+	}
+	s := NewPWMSynth(outputs...)
+	s.Setup()
+	return s, pwms
+}
+
+// heard returns the note each output sounds, 0 if silent, read back from
+// its period.
+func heard(pwms []*fakePWM) []byte {
+	got := make([]byte, len(pwms))
+	for i, p := range pwms {
+		if p.duty[0] == 0 {
+			continue
+		}
+		for n := byte(config.SynthMinNote); n <= config.SynthMaxNote; n++ {
+			if SynthPeriod(n, 0, config.DefaultBendRange, 0) == p.period {
+				got[i] = n
+			}
+		}
+	}
+	return got
+}
+
+// TestSynthSharing plays sub addresses 1 and 5, which share output 1 of
+// four: the later note takes it over, the earlier one's note-off and bends
+// leave it alone, and its own note-off silences it.
+func TestSynthSharing(t *testing.T) {
+	s, pwms := synthOn(4)
+	s.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{60})
+	s.HandleDeviceMessage(2, config.DevCmdNoteOn, []byte{62})
+	s.HandleDeviceMessage(5, config.DevCmdNoteOn, []byte{64})
+	if got, want := heard(pwms), []byte{64, 62, 0, 0}; !slices.Equal(got, want) {
+		t.Fatalf("outputs play %v, want %v", got, want)
+	}
+	s.HandleDeviceMessage(1, config.DevCmdBendPitch, []byte{0x1F, 0xFF})
+	s.HandleDeviceMessage(1, config.DevCmdNoteOff, []byte{60})
+	if got, want := heard(pwms), []byte{64, 62, 0, 0}; !slices.Equal(got, want) {
+		t.Errorf("after sub 1's bend and note-off, outputs play %v, want %v", got, want)
+	}
+	s.HandleDeviceMessage(5, config.DevCmdNoteOff, []byte{64})
+	if got, want := heard(pwms), []byte{0, 62, 0, 0}; !slices.Equal(got, want) {
+		t.Errorf("after sub 5's note-off, outputs play %v, want %v", got, want)
+	}
+}
+
+// TestSynthPool plays chords into a pool zone over sub addresses 1..4:
+// notes spread over the free outputs, a note-off finds the output playing
+// its note, and a note with none free steals one round-robin, or in an
+// LRU pool the one whose note started longest ago.
+func TestSynthPool(t *testing.T) {
+	for _, c := range []struct {
+		mode byte
+		want []byte
+	}{
+		{config.ZonePool, []byte{60, 71, 72, 64}},    // 72 takes the next turn
+		{config.ZonePoolLRU, []byte{72, 71, 67, 64}}, // 72 takes the oldest, 60's
+	} {
+		s, pwms := synthOn(4)
+		s.HandleDeviceMessage(0, config.DevCmdSetZone, []byte{1, 1, 4, c.mode})
+		zone := config.ZoneSubAddress
+		for _, n := range []byte{60, 64, 67} {
+			s.HandleDeviceMessage(zone, config.DevCmdNoteOn, []byte{n})
+		}
+		if got, want := heard(pwms), []byte{60, 64, 67, 0}; !slices.Equal(got, want) {
+			t.Errorf("mode %d: chord on %v, want %v", c.mode, got, want)
+		}
+		s.HandleDeviceMessage(zone, config.DevCmdNoteOff, []byte{64})
+		s.HandleDeviceMessage(zone, config.DevCmdNoteOn, []byte{64})
+		s.HandleDeviceMessage(zone, config.DevCmdNoteOn, []byte{71})
+		// 64 goes to the free output not used yet, 71 to the one 64 left.
+		if got, want := heard(pwms), []byte{60, 71, 67, 64}; !slices.Equal(got, want) {
+			t.Errorf("mode %d: refilled to %v, want %v", c.mode, got, want)
+		}
+		s.HandleDeviceMessage(zone, config.DevCmdNoteOn, []byte{72})
+		if got := heard(pwms); !slices.Equal(got, c.want) {
+			t.Errorf("mode %d: stolen to %v, want %v", c.mode, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+//go:build !tinygo
+
+package instruments
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/hal"
+)
+
+// TestTickRace runs Tick on the host timer, as fast as the host allows,
+// while this goroutine plays the main loop and fires random messages at
+// the drives. At every checkpoint, with interrupts held off, it checks
+// that the drives are in the state the messages put them in, so that no
+// message was lost or half applied, and that every step moved a head by
+// exactly one position. Run it with -race to check the locking as well.
+//
+// The messages come from a seeded generator; the interleaving with the
+// ticks is whatever the scheduler makes of it, which is the point.
+func TestTickRace(t *testing.T) {
+	const seed = 1419
+	commands, budget := 20000, 2*time.Second
+	if testing.Short() {
+		commands, budget = 2000, 200*time.Millisecond
+	}
+	const checkEvery = 100
+
+	fd := NewFloppyDrives()
+	rng := rand.New(rand.NewPCG(seed, 0))
+
+	// Every step line edge must come with a one-position move. The pins
+	// only change from Tick or with interrupts held off, so the watcher
+	// runs with them off too.
+	for p := config.FirstPin; p < config.FirstPin+2*config.NumDrives; p++ {
+		hal.Pin(p).Low()
+	}
+	var last [lastDrive + 1]uint16
+	var badSteps []string
+	hal.OnChange = func(p hal.Pin, high bool) {
+		for d := byte(firstDrive); d <= lastDrive; d++ {
+			if p != fd.stepPins[d] {
+				continue
+			}
+			pos := fd.currentPosition[d]
+			if diff := int(pos) - int(last[d]); diff != 1 && diff != -1 {
+				badSteps = append(badSteps, fmt.Sprintf("drive %d stepped from %d to %d", d, last[d], pos))
+			}
+			last[d] = pos
+		}
+	}
+	defer func() { hal.OnChange = nil }()
+
+	var ticks int
+	InitTimer(1, func() {
+		ticks++
+		fd.Tick()
+	})
+	defer StopTimer()
+
+	// What the messages sent so far should have left on each drive, and
+	// the number of the message that set it.
+	type want struct {
+		note, noteSeq       int // note 0: silent
+		cadence, cadenceSeq int
+		lo, hi, travelSeq   int
+	}
+	var wants [lastDrive + 1]want
+	for d := range wants {
+		wants[d].hi = config.MaxPosition
+	}
+
+	deadline := time.Now().Add(budget)
+	lastTicks := 0
+	for seq := 1; seq <= commands && time.Now().Before(deadline); seq++ {
+		d := byte(firstDrive + rng.IntN(lastDrive))
+		w := &wants[d]
+		switch rng.IntN(9) {
+		case 0, 1, 2:
+			note := 24 + rng.IntN(MaxFloppyNote-24+1)
+			fd.HandleDeviceMessage(d, config.DevCmdNoteOn, []byte{byte(note), byte(1 + rng.IntN(127))})
+			w.note, w.noteSeq = note, seq
+		case 3:
+			fd.HandleDeviceMessage(d, config.DevCmdNoteOff, nil)
+			w.note, w.noteSeq = 0, seq
+		case 4:
+			fd.HandleDeviceMessage(d, config.DevCmdBendPitch, []byte{byte(rng.IntN(256)), byte(rng.IntN(256))})
+		case 5:
+			fd.HandleDeviceMessage(d, config.DevCmdChannelPressure, []byte{byte(rng.IntN(128))})
+		case 6:
+			fd.HandleDeviceMessage(d, config.DevCmdTremolo, []byte{byte(rng.IntN(20)), byte(rng.IntN(101))})
+		case 7:
+			cadence := rng.IntN(20)
+			fd.HandleDeviceMessage(d, config.DevCmdSetOption, []byte{config.OptDirCadence, byte(cadence)})
+			w.cadence, w.cadenceSeq = cadence, seq
+		case 8:
+			lo := rng.IntN(config.MaxPosition)
+			hi := lo + 1 + rng.IntN(config.MaxPosition-lo)
+			fd.HandleDeviceMessage(d, config.DevCmdSetTravel, []byte{byte(lo), byte(hi)})
+			w.lo, w.hi, w.travelSeq = lo, hi, seq
+		}
+		runtime.Gosched()
+		if seq%checkEvery != 0 {
+			continue
+		}
+
+		// Let the timer run between checkpoints, or there is nothing to
+		// race with.
+		for {
+			state := hal.DisableInterrupts()
+			n := ticks
+			hal.RestoreInterrupts(state)
+			if n-lastTicks >= checkEvery || time.Now().After(deadline) {
+				lastTicks = n
+				break
+			}
+			time.Sleep(50 * time.Microsecond)
+		}
+
+		state := hal.DisableInterrupts()
+		for d := byte(firstDrive); d <= lastDrive; d++ {
+			w := wants[d]
+			switch {
+			case w.note != 0 && (fd.currentNote[d] != byte(w.note) || fd.currentPeriod[d] == 0):
+				t.Errorf("message %d: drive %d note-on %d lost: note %d, period %d",
+					w.noteSeq, d, w.note, fd.currentNote[d], fd.currentPeriod[d])
+			case w.note == 0 && fd.currentPeriod[d] != 0:
+				t.Errorf("message %d: drive %d note-off lost: period %d", w.noteSeq, d, fd.currentPeriod[d])
+			}
+			if int(fd.dirCadence[d]) != w.cadence {
+				t.Errorf("message %d: drive %d cadence %d lost: cadence %d", w.cadenceSeq, d, w.cadence, fd.dirCadence[d])
+			}
+			if int(fd.travelMin[d]) != w.lo || int(fd.travelMax[d]) != w.hi {
+				t.Errorf("message %d: drive %d travel %d..%d lost: travel %d..%d",
+					w.travelSeq, d, w.lo, w.hi, fd.travelMin[d], fd.travelMax[d])
+			}
+			if fd.currentPosition[d] > config.MaxPosition {
+				t.Errorf("drive %d at position %d, past %d", d, fd.currentPosition[d], config.MaxPosition)
+			}
+		}
+		for _, s := range badSteps {
+			t.Error(s)
+		}
+		badSteps = badSteps[:0]
+		if n := fd.Stats.InvalidPayloads + fd.Stats.UnknownCommands; n != 0 {
+			t.Errorf("%d messages rejected", n)
+		}
+		failed := t.Failed()
+		hal.RestoreInterrupts(state)
+		if failed {
+			t.Fatalf("seed %d: failed at message %d", seed, seq)
+		}
+	}
+
+	StopTimer()
+	if ticks == 0 {
+		t.Fatal("the timer never ticked")
+	}
+}
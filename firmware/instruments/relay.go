@@ -0,0 +1,190 @@
+package instruments
+
+import (
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/hal"
+	"github.com/ystepanoff/goppy/firmware/notes"
+)
+
+// Relay timing, in ticks.
+const (
+	relayMaxPulse  = config.RelayMaxPulseMs * notes.TicksPerMs
+	relayRetrigger = config.RelayRetriggerMs * notes.TicksPerMs
+)
+
+// Relay plays percussion on relays and solenoids. Each sub address 1..
+// config.NumRelays is one output; a NoteOn energises its coil for the
+// length the General MIDI drum table gives the note (see relayPulse), up
+// to config.RelayMaxPulseMs. Hits closer together than
+// config.RelayRetriggerMs are dropped.
+//
+// Relay needs Tick called from the timer interrupt, directly or through a
+// Router, to end its pulses.
+type Relay struct {
+	// Stats counts ignored messages. Only ever incremented.
+	Stats Stats
+
+	// Limited counts hits dropped by the re-trigger interval.
+	Limited uint16
+
+	// pulse is how many more ticks each coil stays energised; since
+	// counts ticks from the start of its last hit, up to relayRetrigger.
+	pulse [config.NumRelays + 1]uint16
+	since [config.NumRelays + 1]uint16
+
+	pins [config.NumRelays + 1]hal.Pin
+}
+
+// NewRelay creates a Relay instance for config.NumRelays outputs.
+func NewRelay() *Relay {
+	r := &Relay{}
+	for d := 1; d <= config.NumRelays; d++ {
+		r.pins[d] = hal.Pin(config.RelayFirstPin + d - 1)
+		r.since[d] = relayRetrigger
+	}
+	return r
+}
+
+// Setup configures the outputs, de-energised. Must be called before Tick
+// or message handling.
+func (r *Relay) Setup() {
+	for d := 1; d <= config.NumRelays; d++ {
+		r.pins[d].Configure(hal.PinConfig{Mode: hal.PinOutput})
+	}
+	r.StopAll()
+}
+
+// Tick ends pulses that have run their length and times the re-trigger
+// interval. Called by the timer interrupt at TimerResolution intervals.
+func (r *Relay) Tick() {
+	for d := 1; d <= config.NumRelays; d++ {
+		if r.since[d] < relayRetrigger {
+			r.since[d]++
+		}
+		if r.pulse[d] == 0 {
+			continue
+		}
+		r.pulse[d]--
+		if r.pulse[d] == 0 {
+			r.pins[d].Low()
+		}
+	}
+}
+
+// Hit energises an output for a General MIDI drum note, unless its last
+// hit started less than config.RelayRetriggerMs ago. Outputs outside
+// 1..config.NumRelays are ignored.
+func (r *Relay) Hit(output, note byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	r.hit(output, note)
+}
+
+// hit is Hit with interrupts held off.
+func (r *Relay) hit(output, note byte) {
+	if output < 1 || output > config.NumRelays {
+		return
+	}
+	if r.since[output] < relayRetrigger {
+		r.Limited++
+		return
+	}
+	r.since[output] = 0
+	r.pulse[output] = relayPulse(note)
+	r.pins[output].High()
+}
+
+// Cut de-energises an output straight away.
+func (r *Relay) Cut(output byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	r.cut(output)
+}
+
+// cut is Cut with interrupts held off.
+func (r *Relay) cut(output byte) {
+	if output < 1 || output > config.NumRelays {
+		return
+	}
+	r.pulse[output] = 0
+	r.pins[output].Low()
+}
+
+// StopAll de-energises every output.
+func (r *Relay) StopAll() {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	for d := byte(1); d <= config.NumRelays; d++ {
+		r.cut(d)
+	}
+}
+
+// HandleSystemMessage processes system-wide commands (address 0x00).
+func (r *Relay) HandleSystemMessage(command byte, payload []byte) {
+	switch command {
+	case config.CmdReset, config.CmdSequenceStop:
+		r.StopAll()
+	}
+}
+
+// HandleDeviceMessage processes commands for one output, or for sub
+// address 0x00 all of them. Unknown commands and unusable payloads are
+// counted in Stats and dropped.
+func (r *Relay) HandleDeviceMessage(subAddress byte, command byte, payload []byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	if subAddress > config.NumRelays {
+		return
+	}
+	first, last := subAddress, subAddress
+	if subAddress == 0x00 {
+		first, last = 1, config.NumRelays
+	}
+	switch command {
+	case config.DevCmdNoteOn:
+		if len(payload) < 1 || payload[0] > 127 {
+			r.Stats.InvalidPayloads++
+			return
+		}
+		for d := first; d <= last; d++ {
+			r.hit(d, payload[0])
+		}
+	case config.DevCmdNoteOff:
+		if !config.RelayNoteOffCuts {
+			return
+		}
+		for d := first; d <= last; d++ {
+			r.cut(d)
+		}
+	case config.DevCmdReset:
+		for d := first; d <= last; d++ {
+			r.cut(d)
+		}
+	default:
+		r.Stats.UnknownCommands++
+	}
+}
+
+// relayPulse returns how long to energise a coil for a General MIDI drum
+// note, in ticks. Longer pulses strike harder.
+func relayPulse(note byte) uint16 {
+	var ms uint16
+	switch note {
+	case 35, 36: // bass drums
+		ms = 20
+	case 38, 40: // snares
+		ms = 12
+	case 41, 43, 45, 47, 48, 50: // toms
+		ms = 15
+	case 42, 44, 46: // hi-hats
+		ms = 6
+	case 49, 51, 52, 55, 57, 59: // cymbals
+		ms = 10
+	default:
+		ms = 10
+	}
+	if t := ms * notes.TicksPerMs; t < relayMaxPulse {
+		return t
+	}
+	return relayMaxPulse
+}
@@ -0,0 +1,94 @@
+//go:build !tinygo
+
+package instruments
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/fakeclock"
+	"github.com/ystepanoff/goppy/firmware/hal"
+	"github.com/ystepanoff/goppy/firmware/notes"
+)
+
+// relayPulses ticks a Relay from a fake clock and records each pulse on
+// output 1 as the tick it started at and its length in ticks.
+func relayPulses(t *testing.T) (*Relay, *fakeclock.Clock, *[][2]int) {
+	r := NewRelay()
+	r.Setup()
+	clock := fakeclock.New()
+	clock.Start(config.TimerResolution, r.Tick)
+	var pulses [][2]int
+	var since uint64
+	hal.OnChange = func(p hal.Pin, high bool) {
+		if p != r.pins[1] {
+			return
+		}
+		if high {
+			since = clock.Ticks()
+			return
+		}
+		pulses = append(pulses, [2]int{int(since), int(clock.Ticks() - since)})
+	}
+	t.Cleanup(func() { hal.OnChange = nil })
+	return r, clock, &pulses
+}
+
+// TestRelayPulse hits a kick, a snare, a hi-hat and an unmapped note, far
+// enough apart, and checks each pulse's length.
+func TestRelayPulse(t *testing.T) {
+	r, clock, pulses := relayPulses(t)
+	hits := []struct {
+		note byte
+		ms   int
+	}{{36, 20}, {38, 12}, {42, 6}, {100, 10}}
+	for _, hit := range hits {
+		r.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{hit.note})
+		clock.AdvanceMs(config.RelayRetriggerMs)
+	}
+	if len(*pulses) != len(hits) {
+		t.Fatalf("pulses %v for %d hits", *pulses, len(hits))
+	}
+	for i, hit := range hits {
+		if got, want := (*pulses)[i][1], hit.ms*notes.TicksPerMs; got != want {
+			t.Errorf("note %d: pulse of %d ticks, want %d", hit.note, got, want)
+		}
+	}
+	for note := range byte(128) {
+		if p := relayPulse(note); p > relayMaxPulse {
+			t.Errorf("note %d: pulse of %d ticks, over the %d limit", note, p, relayMaxPulse)
+		}
+	}
+}
+
+// TestRelayRetrigger hits output 1 every 10ms: only every
+// RelayRetriggerMs/10th hit gets through, the rest are counted, and a
+// NoteOff leaves a pulse alone.
+func TestRelayRetrigger(t *testing.T) {
+	r, clock, pulses := relayPulses(t)
+	const hits = 12
+	for range hits {
+		r.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{42})
+		r.HandleDeviceMessage(1, config.DevCmdNoteOff, []byte{42})
+		clock.AdvanceMs(10)
+	}
+	var starts []int
+	for _, p := range *pulses {
+		starts = append(starts, p[0])
+		if p[1] != 6*notes.TicksPerMs {
+			t.Errorf("pulse %v cut short", p)
+		}
+	}
+	every := config.RelayRetriggerMs / 10
+	var want []int
+	for i := 0; i < hits; i += every {
+		want = append(want, i*10*notes.TicksPerMs)
+	}
+	if !slices.Equal(starts, want) {
+		t.Errorf("pulses started at ticks %v, want %v", starts, want)
+	}
+	if n := uint16(hits - len(want)); r.Limited != n {
+		t.Errorf("%d hits limited, want %d", r.Limited, n)
+	}
+}
@@ -0,0 +1,379 @@
+package instruments
+
+import (
+	"errors"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/hal"
+)
+
+// Errors returned by Router.Add and RouterFor.
+var (
+	ErrRouteRange      = errors.New("instruments: invalid route range")
+	ErrRouteOverlap    = errors.New("instruments: route overlaps another")
+	ErrRoutesFull      = errors.New("instruments: too many routes")
+	ErrRouteInstrument = errors.New("instruments: route to an unknown instrument")
+)
+
+// Consumer handles Moppy messages; it matches networks.MessageConsumer.
+type Consumer interface {
+	HandleSystemMessage(command byte, payload []byte)
+	HandleDeviceMessage(subAddress byte, command byte, payload []byte)
+}
+
+// Ticker is implemented by instruments that need the timer interrupt,
+// such as FloppyDrives and HDD.
+type Ticker interface {
+	Tick()
+}
+
+// configReporter matches networks.ConfigReporter.
+type configReporter interface {
+	DriveConfig(driveNum byte, dst []byte) []byte
+}
+
+// positionReporter matches networks.PositionReporter.
+type positionReporter interface {
+	DrivePosition(driveNum byte) (uint16, bool)
+}
+
+// statusReporter matches networks.StatusReporter.
+type statusReporter interface {
+	DeviceStatus() (uptime uint32, drives uint16, fault byte, faults uint16)
+}
+
+// capsReporter matches networks.CapsReporter.
+type capsReporter interface {
+	Caps() uint16
+}
+
+// routable is an instrument RouterFor can create and route to.
+type routable interface {
+	Consumer
+	Setup()
+}
+
+// route hands sub addresses first..last to a consumer as 1..last-first+1.
+type route struct {
+	first, last byte
+	consumer    Consumer
+}
+
+// Router lets one board carry several kinds of instrument by handing each
+// a range of sub addresses. For example, with floppies on 1-6, an HDD kick
+// on 7 and a relay snare on 8:
+//
+//	router := instruments.NewRouter()
+//	router.Add(1, 6, floppy)
+//	router.Add(7, 7, hdd)   // the HDD sees itself as drive 1
+//	router.Add(8, 8, relay) // and so does the relay
+//	instruments.InitTimer(config.TimerResolution, router.Tick)
+//	serial := networks.NewSerial(router)
+//
+// Device messages go to the route covering their sub address, renumbered
+// so each child counts its drives from 1; sub address 0x00 goes to every
+// child as 0x00, once per child. Messages for sub addresses outside every
+// route, zone aliases included, are dropped. System messages go to every
+// child in the order they were added.
+//
+// A mirror, added with Mirror, sees every message exactly as sent, after
+// the routes have had it. It suits consumers that follow the music rather
+// than play it, such as a LightOrgan beside the drives.
+//
+// Pass the Router's Tick to InitTimer in place of the children's: it ticks
+// every child that is a Ticker.
+type Router struct {
+	routes [config.MaxRoutes]route
+	count  int
+
+	mirrors     [config.MaxRoutes]Consumer
+	mirrorCount int
+
+	tickers     [2 * config.MaxRoutes]Ticker
+	tickerCount int
+
+	// DeviceStatus's last fault, and each route's child's fault count
+	// when it last looked.
+	fault      byte
+	faultsSeen [config.MaxRoutes]uint16
+}
+
+// NewRouter creates a Router with no routes.
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// RouterFor creates a Router with the routes of a route table such as
+// config.Routes: the floppy routes go to floppy, and every other kind of
+// instrument the table names is created once, for all its routes. It sets
+// up each instrument it routes to, floppy included, in the order of the
+// table, so call it in place of floppy.Setup.
+func RouterFor(routes []config.Route, floppy *FloppyDrives) (*Router, error) {
+	r := NewRouter()
+	var made [config.InstrumentInterrupter + 1]routable
+	for _, rt := range routes {
+		if rt.Instrument == config.InstrumentOther || rt.Instrument >= byte(len(made)) {
+			return nil, ErrRouteInstrument
+		}
+		child := made[rt.Instrument]
+		if child == nil {
+			switch rt.Instrument {
+			case config.InstrumentFloppy:
+				child = floppy
+			case config.InstrumentHDD:
+				child = NewHDD()
+			case config.InstrumentRelay:
+				child = NewRelay()
+			case config.InstrumentStepper:
+				child = NewStepper()
+			case config.InstrumentScanner:
+				child = NewScanner()
+			case config.InstrumentInterrupter:
+				child = NewInterrupter()
+			}
+			made[rt.Instrument] = child
+			child.Setup()
+		}
+		if err := r.Add(rt.First, rt.Last, child); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Add hands sub addresses first..last (1..255) to consumer.
+func (r *Router) Add(first, last byte, consumer Consumer) error {
+	if first == 0 || last < first || consumer == nil {
+		return ErrRouteRange
+	}
+	if r.count == len(r.routes) {
+		return ErrRoutesFull
+	}
+	for _, rt := range r.routes[:r.count] {
+		if first <= rt.last && last >= rt.first {
+			return ErrRouteOverlap
+		}
+	}
+	r.routes[r.count] = route{first: first, last: last, consumer: consumer}
+	r.count++
+	r.addTicker(consumer)
+	return nil
+}
+
+// Mirror copies every message to consumer unchanged. Mirrors don't count
+// towards DriveRange and aren't asked for drive config or positions.
+func (r *Router) Mirror(consumer Consumer) error {
+	if consumer == nil {
+		return ErrRouteRange
+	}
+	if r.mirrorCount == len(r.mirrors) {
+		return ErrRoutesFull
+	}
+	r.mirrors[r.mirrorCount] = consumer
+	r.mirrorCount++
+	r.addTicker(consumer)
+	return nil
+}
+
+// addTicker has the Router tick consumer if it is a Ticker and isn't
+// ticked already. Routes may be added with the timer running, so the
+// tickers change with interrupts held off.
+func (r *Router) addTicker(consumer Consumer) {
+	if t, ok := consumer.(Ticker); ok && !r.ticks(t) {
+		state := hal.DisableInterrupts()
+		r.tickers[r.tickerCount] = t
+		r.tickerCount++
+		hal.RestoreInterrupts(state)
+	}
+}
+
+// Tick ticks every child that is a Ticker, once each however many routes
+// it has. Called by the timer interrupt.
+func (r *Router) Tick() {
+	for _, t := range r.tickers[:r.tickerCount] {
+		t.Tick()
+	}
+}
+
+// ticks reports whether t is already ticked by the Router.
+func (r *Router) ticks(t Ticker) bool {
+	for _, have := range r.tickers[:r.tickerCount] {
+		if have == t {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleSystemMessage passes a system message to every child in turn,
+// then to the mirrors.
+func (r *Router) HandleSystemMessage(command byte, payload []byte) {
+	for i, rt := range r.routes[:r.count] {
+		if r.firstRoute(i) {
+			rt.consumer.HandleSystemMessage(command, payload)
+		}
+	}
+	for _, m := range r.mirrors[:r.mirrorCount] {
+		m.HandleSystemMessage(command, payload)
+	}
+}
+
+// HandleDeviceMessage passes a device message to the child owning its sub
+// address, or to every child for sub address 0x00, then to the mirrors.
+func (r *Router) HandleDeviceMessage(subAddress byte, command byte, payload []byte) {
+	if subAddress == 0x00 {
+		for i, rt := range r.routes[:r.count] {
+			if r.firstRoute(i) {
+				rt.consumer.HandleDeviceMessage(0x00, command, payload)
+			}
+		}
+	} else if rt := r.find(subAddress); rt != nil {
+		rt.consumer.HandleDeviceMessage(subAddress-rt.first+1, command, payload)
+	}
+	for _, m := range r.mirrors[:r.mirrorCount] {
+		m.HandleDeviceMessage(subAddress, command, payload)
+	}
+}
+
+// DriveRange returns the lowest and highest sub address any route covers,
+// so the pong advertises every child's drives. Both are 0 with no routes.
+func (r *Router) DriveRange() (first, last byte) {
+	for i, rt := range r.routes[:r.count] {
+		if i == 0 || rt.first < first {
+			first = rt.first
+		}
+		if rt.last > last {
+			last = rt.last
+		}
+	}
+	return first, last
+}
+
+// Caps returns the config.Cap bits of the commands every route's child
+// takes, as one pong advertises for all of them. A child that doesn't
+// report them takes none, and 0 with no routes.
+func (r *Router) Caps() uint16 {
+	var caps uint16
+	for i, rt := range r.routes[:r.count] {
+		var c uint16
+		if reporter, ok := rt.consumer.(capsReporter); ok {
+			c = reporter.Caps()
+		}
+		if i == 0 {
+			caps = c
+		}
+		caps &= c
+	}
+	return caps
+}
+
+// DriveConfig reports a drive's settings from the child owning it. Drives
+// of children that can't report, and sub addresses outside every route,
+// leave dst unchanged.
+func (r *Router) DriveConfig(driveNum byte, dst []byte) []byte {
+	rt := r.find(driveNum)
+	if rt == nil {
+		return dst
+	}
+	reporter, ok := rt.consumer.(configReporter)
+	if !ok {
+		return dst
+	}
+	return reporter.DriveConfig(driveNum-rt.first+1, dst)
+}
+
+// firstRoute reports whether route i is its child's first, so a child with
+// several routes gets broadcasts once.
+func (r *Router) firstRoute(i int) bool {
+	for _, rt := range r.routes[:i] {
+		if rt.consumer == r.routes[i].consumer {
+			return false
+		}
+	}
+	return true
+}
+
+// DrivePosition reports a drive's position from the child owning it, if
+// the child can.
+func (r *Router) DrivePosition(driveNum byte) (uint16, bool) {
+	rt := r.find(driveNum)
+	if rt == nil {
+		return 0, false
+	}
+	reporter, ok := rt.consumer.(positionReporter)
+	if !ok {
+		return 0, false
+	}
+	return reporter.DrivePosition(driveNum - rt.first + 1)
+}
+
+// DeviceStatus reports the children's status as one: the longest uptime,
+// the drives sounding by sub address, and the faults of every child, the
+// last being the first child's, in the order added, to have run into one
+// since the last call. Children that can't report count as silent.
+func (r *Router) DeviceStatus() (uptime uint32, drives uint16, fault byte, faults uint16) {
+	fault = r.fault
+	found := false
+	for i, rt := range r.routes[:r.count] {
+		reporter, ok := rt.consumer.(statusReporter)
+		if !ok {
+			continue
+		}
+		up, d, f, n := reporter.DeviceStatus()
+		drives |= d & (1<<(rt.last-rt.first+1) - 1) << (rt.first - 1)
+		if !r.firstRoute(i) {
+			continue
+		}
+		uptime = max(uptime, up)
+		faults += n
+		if n != r.faultsSeen[i] {
+			r.faultsSeen[i] = n
+			if !found {
+				fault, found = f, true
+			}
+		}
+	}
+	r.fault = fault
+	return uptime, drives, fault, faults
+}
+
+// Route returns the nth route, from 1: the sub addresses it covers and the
+// config.Instrument its child is, InstrumentOther for a consumer of no
+// kind it knows, and false past the last route. Serial reports them in
+// its answer to CmdGetConfig.
+func (r *Router) Route(n byte) (first, last, instrument byte, ok bool) {
+	if n == 0 || int(n) > r.count {
+		return 0, 0, 0, false
+	}
+	rt := r.routes[n-1]
+	return rt.first, rt.last, instrumentOf(rt.consumer), true
+}
+
+// instrumentOf returns the config.Instrument c is.
+func instrumentOf(c Consumer) byte {
+	switch c.(type) {
+	case *FloppyDrives:
+		return config.InstrumentFloppy
+	case *HDD:
+		return config.InstrumentHDD
+	case *Relay:
+		return config.InstrumentRelay
+	case *Stepper:
+		return config.InstrumentStepper
+	case *Scanner:
+		return config.InstrumentScanner
+	case *Interrupter:
+		return config.InstrumentInterrupter
+	}
+	return config.InstrumentOther
+}
+
+// find returns the route covering a sub address, or nil.
+func (r *Router) find(subAddress byte) *route {
+	for i := range r.routes[:r.count] {
+		if rt := &r.routes[i]; subAddress >= rt.first && subAddress <= rt.last {
+			return rt
+		}
+	}
+	return nil
+}
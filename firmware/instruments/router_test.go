@@ -0,0 +1,282 @@
+//go:build !tinygo
+
+package instruments
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+)
+
+// recorder is a child that logs the messages it gets to a shared log.
+type recorder struct {
+	name  string
+	log   *[]string
+	ticks int
+}
+
+func (c *recorder) HandleSystemMessage(command byte, payload []byte) {
+	*c.log = append(*c.log, fmt.Sprintf("%s system %02X", c.name, command))
+}
+
+func (c *recorder) HandleDeviceMessage(subAddress byte, command byte, payload []byte) {
+	*c.log = append(*c.log, fmt.Sprintf("%s %d %02X % X", c.name, subAddress, command, payload))
+}
+
+func (c *recorder) Tick() { c.ticks++ }
+
+func (c *recorder) DrivePosition(driveNum byte) (uint16, bool) {
+	return uint16(driveNum) * 10, true
+}
+
+// quiet is a child that neither ticks nor reports.
+type quiet struct{}
+
+func (quiet) HandleSystemMessage(command byte, payload []byte)                  {}
+func (quiet) HandleDeviceMessage(subAddress byte, command byte, payload []byte) {}
+
+// routed sets up floppies on 1-6, an HDD on 7, a relay on 8 and a light
+// organ mirroring them all.
+func routed(t *testing.T) (*Router, *[]string, map[string]*recorder) {
+	var log []string
+	children := map[string]*recorder{}
+	for _, name := range []string{"floppy", "hdd", "relay", "lights"} {
+		children[name] = &recorder{name: name, log: &log}
+	}
+	r := NewRouter()
+	for _, err := range []error{
+		r.Add(1, 6, children["floppy"]),
+		r.Add(7, 7, children["hdd"]),
+		r.Add(8, 8, children["relay"]),
+		r.Mirror(children["lights"]),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r, &log, children
+}
+
+func TestRouterDevice(t *testing.T) {
+	r, log, _ := routed(t)
+	for sub := byte(1); sub <= 9; sub++ {
+		r.HandleDeviceMessage(sub, config.DevCmdNoteOn, []byte{60})
+	}
+	want := []string{
+		"floppy 1 09 3C", "lights 1 09 3C",
+		"floppy 2 09 3C", "lights 2 09 3C",
+		"floppy 3 09 3C", "lights 3 09 3C",
+		"floppy 4 09 3C", "lights 4 09 3C",
+		"floppy 5 09 3C", "lights 5 09 3C",
+		"floppy 6 09 3C", "lights 6 09 3C",
+		"hdd 1 09 3C", "lights 7 09 3C",
+		"relay 1 09 3C", "lights 8 09 3C",
+		"lights 9 09 3C", // no route: only the mirror hears it
+	}
+	if !slices.Equal(*log, want) {
+		t.Errorf("routed note-ons:\n%q\nwant:\n%q", *log, want)
+	}
+}
+
+// TestRouterFanOut checks broadcasts and system messages reach every child
+// once, in the order they were added, and the mirrors last.
+func TestRouterFanOut(t *testing.T) {
+	r, log, children := routed(t)
+	// A second range for the floppies doesn't make them hear twice.
+	if err := r.Add(10, 12, children["floppy"]); err != nil {
+		t.Fatal(err)
+	}
+	r.HandleDeviceMessage(0, config.DevCmdNoteOff, nil)
+	r.HandleSystemMessage(config.CmdSequenceStart, nil)
+	r.HandleDeviceMessage(11, config.DevCmdNoteOff, nil)
+	want := []string{
+		"floppy 0 08 ", "hdd 0 08 ", "relay 0 08 ", "lights 0 08 ",
+		"floppy system FA", "hdd system FA", "relay system FA", "lights system FA",
+		"floppy 2 08 ", "lights 11 08 ",
+	}
+	if !slices.Equal(*log, want) {
+		t.Errorf("fan-out:\n%q\nwant:\n%q", *log, want)
+	}
+
+	r.Tick()
+	r.Tick()
+	for name, c := range children {
+		if c.ticks != 2 {
+			t.Errorf("%s ticked %d times for 2 router ticks", name, c.ticks)
+		}
+	}
+}
+
+func TestRouterAdd(t *testing.T) {
+	r, _, children := routed(t)
+	if first, last := r.DriveRange(); first != 1 || last != 8 {
+		t.Errorf("drive range %d..%d, want 1..8", first, last)
+	}
+	c := children["hdd"]
+	for _, bad := range []struct {
+		first, last byte
+		consumer    Consumer
+		err         error
+	}{
+		{0, 3, c, ErrRouteRange},
+		{5, 4, c, ErrRouteRange},
+		{20, 20, nil, ErrRouteRange},
+		{8, 9, c, ErrRouteOverlap},
+		{2, 2, c, ErrRouteOverlap},
+	} {
+		if err := r.Add(bad.first, bad.last, bad.consumer); err != bad.err {
+			t.Errorf("Add(%d, %d) = %v, want %v", bad.first, bad.last, err, bad.err)
+		}
+	}
+	if err := r.Add(20, 30, quiet{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Add(40, 40, c); err != ErrRoutesFull {
+		t.Errorf("fifth route: %v, want %v", err, ErrRoutesFull)
+	}
+	if first, last := r.DriveRange(); first != 1 || last != 30 {
+		t.Errorf("drive range %d..%d, want 1..30", first, last)
+	}
+
+	// Positions come from the child, in its numbering; children that
+	// can't report, and gaps, report nothing.
+	for sub, want := range map[byte]uint16{3: 30, 7: 10, 8: 10} {
+		if got, ok := r.DrivePosition(sub); !ok || got != want {
+			t.Errorf("position of %d: %d %v, want %d", sub, got, ok, want)
+		}
+	}
+	for _, sub := range []byte{9, 25} {
+		if _, ok := r.DrivePosition(sub); ok {
+			t.Errorf("sub address %d reported a position", sub)
+		}
+	}
+}
+
+// TestRouterCaps advertises only the optional commands every routed
+// child takes, the mirror's aside.
+func TestRouterCaps(t *testing.T) {
+	r := NewRouter()
+	if caps := r.Caps(); caps != 0 {
+		t.Errorf("caps %04X with no routes, want none", caps)
+	}
+	for _, err := range []error{
+		r.Add(1, 4, NewFloppyDrives()),
+		r.Add(5, 6, NewStepper()),
+		r.Mirror(quiet{}),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if caps, want := r.Caps(), config.CapBendRange|config.CapTuning|config.CapOptions; caps != want {
+		t.Errorf("caps %04X, want %04X", caps, want)
+	}
+	if err := r.Add(7, 7, quiet{}); err != nil {
+		t.Fatal(err)
+	}
+	if caps := r.Caps(); caps != 0 {
+		t.Errorf("caps %04X with a child taking none, want none", caps)
+	}
+}
+
+// reporting is a child with a status to report.
+type reporting struct {
+	quiet
+	uptime uint32
+	drives uint16
+	fault  byte
+	faults uint16
+}
+
+func (c *reporting) DeviceStatus() (uint32, uint16, byte, uint16) {
+	return c.uptime, c.drives, c.fault, c.faults
+}
+
+// TestRouterStatus renumbers each child's drives by sub address and
+// reports the last fault any child ran into.
+func TestRouterStatus(t *testing.T) {
+	floppy := &reporting{uptime: 90, drives: 0b100101}
+	hdd := &reporting{uptime: 91, drives: 0b11}
+	r := NewRouter()
+	for _, err := range []error{
+		r.Add(1, 4, floppy), // drive 6 is past its route
+		r.Add(5, 5, quiet{}),
+		r.Add(6, 6, hdd),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if up, drives, fault, faults := r.DeviceStatus(); up != 91 || drives != 0b100101 || fault != config.FaultNone || faults != 0 {
+		t.Errorf("status %d %b %d %d, want 91 100101 0 0", up, drives, fault, faults)
+	}
+	hdd.fault, hdd.faults = config.FaultOverrun, 1
+	if _, _, fault, faults := r.DeviceStatus(); fault != config.FaultOverrun || faults != 1 {
+		t.Errorf("fault %d of %d, want the hdd's %d of 1", fault, faults, config.FaultOverrun)
+	}
+	floppy.fault, floppy.faults = config.FaultBadPayload, 3
+	if _, _, fault, faults := r.DeviceStatus(); fault != config.FaultBadPayload || faults != 4 {
+		t.Errorf("fault %d of %d, want the floppy's %d of 4", fault, faults, config.FaultBadPayload)
+	}
+	if _, _, fault, _ := r.DeviceStatus(); fault != config.FaultBadPayload {
+		t.Errorf("fault %d with none since, want the last, %d", fault, config.FaultBadPayload)
+	}
+}
+
+// TestRouterFor builds a Router from a route table, one instrument of each
+// kind, and reports its routes; the board's own table builds too.
+func TestRouterFor(t *testing.T) {
+	floppy, _ := clocked()
+	route := func(first, last, instrument byte) config.Route {
+		return config.Route{First: first, Last: last, Instrument: instrument}
+	}
+	table := []config.Route{
+		route(1, 6, config.InstrumentFloppy),
+		route(7, 7, config.InstrumentHDD),
+		route(8, 8, config.InstrumentRelay),
+		route(9, 9, config.InstrumentHDD), // the same HDD, its drive 1 again
+	}
+	r, err := RouterFor(table, floppy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, want := range table {
+		first, last, instrument, ok := r.Route(byte(n + 1))
+		if got := (config.Route{First: first, Last: last, Instrument: instrument}); !ok || got != want {
+			t.Errorf("route %d = %v, %v; want %v", n+1, got, ok, want)
+		}
+	}
+	if _, _, _, ok := r.Route(byte(len(table) + 1)); ok {
+		t.Error("a route past the table")
+	}
+	if r.routes[1].consumer != r.routes[3].consumer {
+		t.Error("two HDDs made for one kind")
+	}
+	r.HandleDeviceMessage(6, config.DevCmdNoteOn, []byte{60})
+	r.HandleDeviceMessage(9, config.DevCmdNoteOn, []byte{36})
+	if floppy.currentPeriod[6] == 0 || r.routes[1].consumer.(*HDD).pulse[1] == 0 {
+		t.Error("note-ons didn't reach drive 6 and the HDD")
+	}
+
+	for _, bad := range []struct {
+		table []config.Route
+		want  error
+	}{
+		{[]config.Route{route(1, 1, config.InstrumentOther)}, ErrRouteInstrument},
+		{[]config.Route{route(1, 1, 0xFF)}, ErrRouteInstrument},
+		{[]config.Route{route(1, 4, config.InstrumentFloppy), route(4, 4, config.InstrumentRelay)}, ErrRouteOverlap},
+		{[]config.Route{route(0, 4, config.InstrumentFloppy)}, ErrRouteRange},
+	} {
+		if _, err := RouterFor(bad.table, floppy); err != bad.want {
+			t.Errorf("%v: error %v, want %v", bad.table, err, bad.want)
+		}
+	}
+
+	if len(config.Routes) > 0 {
+		if _, err := RouterFor(config.Routes[:], floppy); err != nil {
+			t.Errorf("config.Routes: %v", err)
+		}
+	}
+}
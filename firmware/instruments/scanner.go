@@ -0,0 +1,396 @@
+package instruments
+
+import (
+	"errors"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/hal"
+	"github.com/ystepanoff/goppy/firmware/notes"
+)
+
+// ErrHoming is returned by Scanner.PlayNote while the carriage homes.
+var ErrHoming = errors.New("instruments: drive is homing")
+
+// Scanner timing, in ticks. As with steppers the STEP pin toggles every
+// half period, so the fastest half-period is scannerMinTicks.
+const (
+	scannerMinTicks  = (1000000/config.TimerResolution + 2*config.ScannerMaxStepHz - 1) / (2 * config.ScannerMaxStepHz)
+	scannerHomeTicks = config.ScannerHomeStepMs * notes.TicksPerMs / 2
+
+	// scannerHomeSteps bounds a homing sweep: the whole travel, plus an
+	// eighth in case the position was lost.
+	scannerHomeSteps = config.ScannerTravelSteps + config.ScannerTravelSteps/8
+)
+
+// Scanner plays notes on flatbed scanner carriages behind STEP/DIR
+// drivers. Sub addresses 1..config.NumScanners are carriages.
+//
+// A carriage never leaves its travel window (config.ScannerTravelSteps, or
+// what DevCmdSetTravel narrowed it to). In the default bounce mode it
+// reverses wherever it meets an end, like a floppy head. In phrase mode
+// (OptPhraseMode) it reverses at the start of a note once less than a
+// quarter of the window is left ahead, so mid-note reversals only happen
+// on notes long enough to cross three quarters of it; ForcedReversals
+// counts those.
+//
+// Carriages home on Setup and on Reset, against a switch or blindly (see
+// config.ScannerEndStopPin), in the background; notes are refused until
+// they are done. Scanner needs Tick called from the timer interrupt,
+// directly or through a Router.
+type Scanner struct {
+	// Stats counts ignored messages. Only ever incremented.
+	Stats Stats
+
+	// ForcedReversals counts phrase mode carriages that met an end of
+	// their window mid-note.
+	ForcedReversals uint16
+
+	// maxNote is the highest note within config.ScannerMaxStepHz.
+	maxNote byte
+
+	// period is the current half-period in ticks (0 = silent) and tick
+	// counts towards it. unbent is the note's half-period before bend.
+	period [config.NumScanners + 1]uint16
+	tick   [config.NumScanners + 1]uint16
+	unbent [config.NumScanners + 1]uint16
+	note   [config.NumScanners + 1]byte
+
+	// position is the carriage position in steps; reverse is set while
+	// it moves towards 0.
+	position  [config.NumScanners + 1]uint16
+	reverse   [config.NumScanners + 1]bool
+	stepState [config.NumScanners + 1]bool
+	travelMin [config.NumScanners + 1]uint16
+	travelMax [config.NumScanners + 1]uint16
+	phrase    [config.NumScanners + 1]bool
+
+	// Background homing: homeSteps is how many more steps the sweep may
+	// take, one toggle every scannerHomeTicks.
+	homing        [config.NumScanners + 1]bool
+	homeSteps     [config.NumScanners + 1]uint16
+	homeCountdown [config.NumScanners + 1]uint16
+
+	stepPins [config.NumScanners + 1]hal.Pin
+	dirPins  [config.NumScanners + 1]hal.Pin
+	endStops [config.NumScanners + 1]hal.Pin
+}
+
+// NewScanner creates a Scanner instance for config.NumScanners carriages.
+func NewScanner() *Scanner {
+	s := &Scanner{}
+	for n := 127; n >= 0; n-- {
+		if notes.NoteDoubleTicks[n] >= scannerMinTicks {
+			s.maxNote = byte(n)
+			break
+		}
+	}
+	for d := 1; d <= config.NumScanners; d++ {
+		s.stepPins[d] = hal.Pin(config.ScannerFirstPin + (d-1)*2)
+		s.dirPins[d] = hal.Pin(config.ScannerFirstPin + (d-1)*2 + 1)
+		if config.ScannerEndStopPin != 0 {
+			s.endStops[d] = hal.Pin(config.ScannerEndStopPin + d - 1)
+		}
+		s.travelMax[d] = config.ScannerTravelSteps
+		s.phrase[d] = config.ScannerPhraseMode
+	}
+	return s
+}
+
+// Setup configures the driver pins and end-stop inputs, then starts
+// homing every carriage. Must be called before Tick or message handling.
+func (s *Scanner) Setup() {
+	for d := byte(1); d <= config.NumScanners; d++ {
+		s.stepPins[d].Configure(hal.PinConfig{Mode: hal.PinOutput})
+		s.dirPins[d].Configure(hal.PinConfig{Mode: hal.PinOutput})
+		if config.ScannerEndStopPin != 0 {
+			s.endStops[d].Configure(hal.PinConfig{Mode: hal.PinInputPullup})
+		}
+		s.startHoming(d)
+	}
+}
+
+// Tick advances homing sweeps and steps every sounding carriage whose
+// half-period is up. Called by the timer interrupt at TimerResolution
+// intervals.
+func (s *Scanner) Tick() {
+	for d := 1; d <= config.NumScanners; d++ {
+		if s.homing[d] {
+			s.advanceHoming(d)
+			continue
+		}
+		if s.period[d] == 0 {
+			continue
+		}
+		s.tick[d]++
+		if s.tick[d] >= s.period[d] {
+			s.tick[d] = 0
+			s.togglePin(d)
+		}
+	}
+}
+
+// togglePin flips a carriage's STEP pin. The driver steps on the rising
+// edge, so that is when the position moves - after reversing if the
+// carriage is at the end of its window.
+func (s *Scanner) togglePin(d int) {
+	if !s.stepState[d] {
+		if s.reverse[d] && s.position[d] <= s.travelMin[d] {
+			s.setDirection(d, false)
+		} else if !s.reverse[d] && s.position[d] >= s.travelMax[d] {
+			s.setDirection(d, true)
+		}
+		if s.reverse[d] {
+			s.position[d]--
+		} else {
+			s.position[d]++
+		}
+	}
+	s.stepState[d] = !s.stepState[d]
+	s.stepPins[d].Set(s.stepState[d])
+}
+
+// setDirection sets a carriage's direction (reverse = towards 0). In
+// phrase mode, a change not made by PlayNote is a forced reversal.
+func (s *Scanner) setDirection(d int, reverse bool) {
+	if s.phrase[d] {
+		s.ForcedReversals++
+	}
+	s.reverse[d] = reverse
+	s.dirPins[d].Set(reverse)
+}
+
+// startHoming silences a carriage and starts sweeping it back to 0.
+func (s *Scanner) startHoming(d byte) {
+	s.period[d] = 0
+	s.reverse[d] = true
+	s.dirPins[d].High()
+	s.homeSteps[d] = scannerHomeSteps
+	s.homeCountdown[d] = scannerHomeTicks
+	s.homing[d] = true
+}
+
+// advanceHoming takes the next homing step once its interval is up,
+// finishing at the switch or, without one, after a full sweep.
+func (s *Scanner) advanceHoming(d int) {
+	s.homeCountdown[d]--
+	if s.homeCountdown[d] > 0 {
+		return
+	}
+	s.homeCountdown[d] = scannerHomeTicks
+	atStop := config.ScannerEndStopPin != 0 && !s.endStops[d].Get()
+	if atStop || s.homeSteps[d] == 0 {
+		s.homing[d] = false
+		s.position[d] = 0
+		s.reverse[d] = false
+		s.dirPins[d].Low()
+		return
+	}
+	if !s.stepState[d] {
+		s.homeSteps[d]--
+	}
+	s.stepState[d] = !s.stepState[d]
+	s.stepPins[d].Set(s.stepState[d])
+}
+
+// fit fits a note into 0..maxNote according to config.NoteRangePolicy.
+func (s *Scanner) fit(note byte) (byte, bool) {
+	if note <= s.maxNote {
+		return note, true
+	}
+	switch config.NoteRangePolicy {
+	case config.RangeClamp:
+		return s.maxNote, true
+	case config.RangeFold:
+		for note > s.maxNote {
+			note -= 12
+		}
+		return note, true
+	}
+	return 0, false
+}
+
+// PlayNote starts a note on a carriage. Returns ErrNoDrive for a carriage
+// outside 1..config.NumScanners, ErrHoming while it homes and ErrBadNote
+// for a note above 127 or, with RangeDrop, above the step rate limit.
+func (s *Scanner) PlayNote(carriage, note byte) error {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	return s.playNote(carriage, note)
+}
+
+// playNote is PlayNote with interrupts held off.
+func (s *Scanner) playNote(carriage, note byte) error {
+	if carriage < 1 || carriage > config.NumScanners {
+		return ErrNoDrive
+	}
+	if s.homing[carriage] {
+		return ErrHoming
+	}
+	if note > 127 {
+		return ErrBadNote
+	}
+	n, ok := s.fit(note)
+	if !ok {
+		return ErrBadNote
+	}
+	d := int(carriage)
+	if s.phrase[d] {
+		quarter := (s.travelMax[d] - s.travelMin[d]) / 4
+		pos := s.position[d]
+		if s.reverse[d] && pos < s.travelMin[d]+quarter {
+			s.reverse[d] = false
+			s.dirPins[d].Low()
+		} else if !s.reverse[d] && pos > s.travelMax[d]-quarter {
+			s.reverse[d] = true
+			s.dirPins[d].High()
+		}
+	}
+	s.note[d] = note
+	s.unbent[d] = notes.NoteDoubleTicks[n]
+	s.period[d] = s.unbent[d]
+	return nil
+}
+
+// StopNote silences a carriage.
+func (s *Scanner) StopNote(carriage byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	s.stopNote(carriage)
+}
+
+// stopNote is StopNote with interrupts held off.
+func (s *Scanner) stopNote(carriage byte) {
+	if carriage < 1 || carriage > config.NumScanners {
+		return
+	}
+	s.period[carriage] = 0
+}
+
+// Bend bends the note a carriage is playing by a 14-bit MIDI pitch bend
+// value (0..16383, 8192 = unbent) across config.DefaultBendRange
+// semitones. Bending never steps faster than config.ScannerMaxStepHz.
+func (s *Scanner) Bend(carriage byte, bend uint16) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	s.bendNote(carriage, bend)
+}
+
+// bendNote is Bend with interrupts held off.
+func (s *Scanner) bendNote(carriage byte, bend uint16) {
+	if carriage < 1 || carriage > config.NumScanners || s.period[carriage] == 0 {
+		return
+	}
+	if bend > 0x3FFF {
+		bend = 0x3FFF
+	}
+	t := notes.BendTicks(s.unbent[carriage], int16(bend)-8192, config.DefaultBendRange)
+	if t < scannerMinTicks {
+		t = scannerMinTicks
+	}
+	s.period[carriage] = t
+}
+
+// setTravel narrows a carriage's window to lo..hi within
+// config.ScannerTravelSteps. A carriage outside it walks back in a step at
+// a time. Returns false, changing nothing, for an invalid window.
+func (s *Scanner) setTravel(carriage byte, lo, hi uint16) bool {
+	if lo >= hi || hi > config.ScannerTravelSteps {
+		return false
+	}
+	s.travelMin[carriage] = lo
+	s.travelMax[carriage] = hi
+	return true
+}
+
+// DrivePosition returns a carriage's position in steps.
+func (s *Scanner) DrivePosition(carriage byte) (uint16, bool) {
+	if carriage < 1 || carriage > config.NumScanners {
+		return 0, false
+	}
+	return s.position[carriage], true
+}
+
+// HandleSystemMessage processes system-wide commands (address 0x00).
+func (s *Scanner) HandleSystemMessage(command byte, payload []byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	switch command {
+	case config.CmdReset:
+		for d := byte(1); d <= config.NumScanners; d++ {
+			s.startHoming(d)
+		}
+	case config.CmdSequenceStop:
+		for d := byte(1); d <= config.NumScanners; d++ {
+			s.stopNote(d)
+		}
+	}
+}
+
+// HandleDeviceMessage processes commands for one carriage, or for sub
+// address 0x00 all of them. Unknown commands and unusable payloads are
+// counted in Stats and dropped.
+func (s *Scanner) HandleDeviceMessage(subAddress byte, command byte, payload []byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	if subAddress > config.NumScanners {
+		return
+	}
+	first, last := subAddress, subAddress
+	if subAddress == 0x00 {
+		first, last = 1, config.NumScanners
+	}
+	switch command {
+	case config.DevCmdNoteOn:
+		if len(payload) < 1 || payload[0] > 127 {
+			s.Stats.InvalidPayloads++
+			return
+		}
+		s.playNote(subAddress, payload[0])
+	case config.DevCmdNoteOff:
+		for d := first; d <= last; d++ {
+			if len(payload) == 0 || payload[0] == s.note[d] {
+				s.stopNote(d)
+			}
+		}
+	case config.DevCmdReset:
+		for d := first; d <= last; d++ {
+			s.startHoming(d)
+		}
+	case config.DevCmdBendPitch:
+		if len(payload) < 2 {
+			s.Stats.InvalidPayloads++
+			return
+		}
+		bend := int32(int16(payload[0])<<8|int16(payload[1])) + 8192
+		if bend < 0 {
+			bend = 0
+		}
+		s.bendNote(subAddress, uint16(bend))
+	case config.DevCmdSetTravel:
+		if len(payload) < 4 {
+			s.Stats.InvalidPayloads++
+			return
+		}
+		lo := uint16(payload[0])<<8 | uint16(payload[1])
+		hi := uint16(payload[2])<<8 | uint16(payload[3])
+		for d := first; d <= last; d++ {
+			if !s.setTravel(d, lo, hi) {
+				s.Stats.InvalidPayloads++
+				return
+			}
+		}
+	case config.DevCmdSetOption:
+		if len(payload) < 2 {
+			s.Stats.InvalidPayloads++
+			return
+		}
+		if payload[0] != config.OptPhraseMode {
+			return
+		}
+		for d := first; d <= last; d++ {
+			s.phrase[d] = payload[1] != 0
+		}
+	default:
+		s.Stats.UnknownCommands++
+	}
+}
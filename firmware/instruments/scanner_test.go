@@ -0,0 +1,87 @@
+//go:build !tinygo
+
+package instruments
+
+import (
+	"testing"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/fakeclock"
+	"github.com/ystepanoff/goppy/firmware/hal"
+)
+
+// homedScanner sets up a Scanner ticked from a fake clock and waits for
+// its carriages to home.
+func homedScanner(t *testing.T) (*Scanner, *fakeclock.Clock) {
+	t.Helper()
+	s := NewScanner()
+	s.Setup()
+	clock := fakeclock.New()
+	clock.Start(config.TimerResolution, s.Tick)
+	for range 100 {
+		if !s.homing[1] {
+			return s, clock
+		}
+		clock.AdvanceMs(100)
+	}
+	t.Fatal("carriage 1 never finished homing")
+	return nil, nil
+}
+
+// sweep plays s.maxNote on carriage 1 for ms milliseconds and returns the
+// lowest and highest positions it stepped to.
+func sweep(t *testing.T, s *Scanner, clock *fakeclock.Clock, ms int) (lo, hi uint16) {
+	t.Helper()
+	lo, hi = 0xFFFF, 0
+	hal.OnChange = func(p hal.Pin, high bool) {
+		if p != s.stepPins[1] || !high {
+			return
+		}
+		lo, hi = min(lo, s.position[1]), max(hi, s.position[1])
+	}
+	defer func() { hal.OnChange = nil }()
+	if err := s.PlayNote(1, s.maxNote); err != nil {
+		t.Fatal(err)
+	}
+	clock.AdvanceMs(ms)
+	s.StopNote(1)
+	return lo, hi
+}
+
+// TestScannerTravel bounces a carriage across its full travel, then
+// across a narrowed window it has to walk back into, and checks it
+// reaches both ends of each and never goes past them. Invalid windows are
+// refused and leave the window alone.
+func TestScannerTravel(t *testing.T) {
+	s, clock := homedScanner(t)
+	if s.position[1] != 0 {
+		t.Fatalf("homed to %d, want 0", s.position[1])
+	}
+	// Long enough for several sweeps of the full travel.
+	const ms = 4 * config.ScannerTravelSteps * 1000 / config.ScannerMaxStepHz
+	if lo, hi := sweep(t, s, clock, ms); lo != 0 || hi != config.ScannerTravelSteps {
+		t.Errorf("full travel: stepped to %d..%d, want 0..%d", lo, hi, config.ScannerTravelSteps)
+	}
+
+	// Park the carriage below the window before narrowing it.
+	for s.position[1] > 100 {
+		sweep(t, s, clock, 10)
+	}
+	const winLo, winHi = 1000, 1500
+	s.HandleDeviceMessage(1, config.DevCmdSetTravel, []byte{winLo >> 8, winLo & 0xFF, winHi >> 8, winHi & 0xFF})
+	sweep(t, s, clock, ms) // walk in
+	if lo, hi := sweep(t, s, clock, ms); lo != winLo || hi != winHi {
+		t.Errorf("window %d..%d: stepped to %d..%d", winLo, winHi, lo, hi)
+	}
+
+	for _, w := range [][2]uint16{{1500, 1500}, {1500, 1000}, {0, config.ScannerTravelSteps + 1}} {
+		before := s.Stats.InvalidPayloads
+		s.HandleDeviceMessage(1, config.DevCmdSetTravel, []byte{byte(w[0] >> 8), byte(w[0]), byte(w[1] >> 8), byte(w[1])})
+		if s.Stats.InvalidPayloads != before+1 {
+			t.Errorf("window %d..%d not counted invalid", w[0], w[1])
+		}
+		if s.travelMin[1] != winLo || s.travelMax[1] != winHi {
+			t.Errorf("window %d..%d changed it to %d..%d", w[0], w[1], s.travelMin[1], s.travelMax[1])
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package instruments
+
+import (
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/hal"
+)
+
+// Every drive needs its two bits in the chain when config.ShiftRegister is
+// on; this fails to compile if config.NumDrives outgrows the chain.
+var _ [config.ShiftChainLength*8 - 2*lastDrive]struct{}
+
+// shiftChain mirrors the outputs of a daisy chain of 74HC595s. Lines are
+// changed with set and reach the outputs together on the next latch.
+type shiftChain struct {
+	bits  [config.ShiftChainLength]byte
+	dirty bool
+}
+
+// stepBit and dirBit are a drive's lines in the chain.
+func stepBit(driveNum byte) byte { return (driveNum - 1) * 2 }
+func dirBit(driveNum byte) byte  { return (driveNum-1)*2 + 1 }
+
+// setup configures SPI and the latch pin, and clears the chain.
+func (c *shiftChain) setup() {
+	hal.SPI0.Configure(hal.SPIConfig{Frequency: 8000000})
+	latch := hal.Pin(config.ShiftLatchPin)
+	latch.Configure(hal.PinConfig{Mode: hal.PinOutput})
+	latch.Low()
+	c.bits = [config.ShiftChainLength]byte{}
+	c.latch()
+}
+
+// set sets one line of the chain.
+func (c *shiftChain) set(bit byte, high bool) {
+	i, mask := bit/8, byte(1)<<(bit%8)
+	old := c.bits[i]
+	if high {
+		c.bits[i] |= mask
+	} else {
+		c.bits[i] &^= mask
+	}
+	if c.bits[i] != old {
+		c.dirty = true
+	}
+}
+
+// latch shifts the chain out, the far chip's byte first and each byte
+// most significant bit first, then pulses the latch so every output
+// changes at once. Outside Tick, call it with interrupts held off, so a
+// Tick cannot start a transfer in the middle of one from ResetAll.
+func (c *shiftChain) latch() {
+	for i := len(c.bits) - 1; i >= 0; i-- {
+		hal.SPI0.Transfer(c.bits[i])
+	}
+	latch := hal.Pin(config.ShiftLatchPin)
+	latch.High()
+	latch.Low()
+	c.dirty = false
+}
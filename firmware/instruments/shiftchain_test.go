@@ -0,0 +1,77 @@
+//go:build !tinygo
+
+package instruments
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/hal"
+)
+
+// latched latches c and returns the bytes shifted out and, for each latch
+// pin change, how many had been shifted out when it happened.
+func latched(t *testing.T, c *shiftChain) (sent []byte, edges []string) {
+	t.Helper()
+	hal.SPI0.Reset()
+	hal.OnChange = func(p hal.Pin, high bool) {
+		if p == config.ShiftLatchPin {
+			edges = append(edges, fmt.Sprintf("%v after %d", high, len(hal.SPI0.Sent)))
+		}
+	}
+	defer func() { hal.OnChange = nil }()
+	c.latch()
+	return slices.Clone(hal.SPI0.Sent), edges
+}
+
+// TestShiftChainBits sets each drive's STEP and DIR lines alone and checks
+// they land on the right output: byte (bit/8) of the chain, counted from
+// the chip nearest the board and shifted out last, at bit (bit%8).
+func TestShiftChainBits(t *testing.T) {
+	var c shiftChain
+	for d := byte(firstDrive); d <= lastDrive; d++ {
+		for _, line := range []struct {
+			name string
+			bit  byte
+		}{{"step", stepBit(d)}, {"dir", dirBit(d)}} {
+			c.set(line.bit, true)
+			if !c.dirty {
+				t.Errorf("drive %d %s: not dirty after a change", d, line.name)
+			}
+			sent, _ := latched(t, &c)
+			want := make([]byte, config.ShiftChainLength)
+			want[config.ShiftChainLength-1-int(line.bit/8)] = 1 << (line.bit % 8)
+			if !slices.Equal(sent, want) {
+				t.Errorf("drive %d %s: shifted % X, want % X", d, line.name, sent, want)
+			}
+			c.set(line.bit, false)
+		}
+	}
+	if stepBit(firstDrive) != 0 || dirBit(lastDrive) != 2*lastDrive-1 {
+		t.Errorf("drives span bits %d..%d, want 0..%d", stepBit(firstDrive), dirBit(lastDrive), 2*lastDrive-1)
+	}
+
+	c.latch()
+	c.set(stepBit(firstDrive), false)
+	if c.dirty {
+		t.Error("dirty after setting a line to what it was")
+	}
+}
+
+// TestShiftChainLatch checks the latch pulses once, after the whole chain
+// has been shifted out, and is left low.
+func TestShiftChainLatch(t *testing.T) {
+	var c shiftChain
+	c.set(stepBit(firstDrive), true)
+	_, edges := latched(t, &c)
+	n := config.ShiftChainLength
+	want := []string{fmt.Sprintf("true after %d", n), fmt.Sprintf("false after %d", n)}
+	if !slices.Equal(edges, want) {
+		t.Errorf("latch edges %q, want %q", edges, want)
+	}
+	if c.dirty {
+		t.Error("dirty after latching")
+	}
+}
@@ -0,0 +1,372 @@
+package instruments
+
+import (
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/hal"
+	"github.com/ystepanoff/goppy/firmware/notes"
+)
+
+// Stepper timing, in ticks. A step is one full period of the STEP pin, so
+// the pin toggles every half period, as with floppies.
+const (
+	stepperStartTicks = 1000000 / (config.StepperStartHz * 2 * config.TimerResolution)
+	stepperIdleChecks = config.StepperIdleMs * notes.TicksPerMs / idleCheckTicks
+)
+
+// Stepper plays notes on stepper motors behind STEP/DIR drivers such as
+// the A4988 or DRV8825. Sub addresses 1..config.NumSteppers are motors.
+// Unlike a floppy head a motor has no end stops: it turns continuously,
+// or reverses every OptDirCadence steps.
+//
+// It understands NoteOn, NoteOff, Reset, BendPitch, BendRange, Transpose,
+// Detune and the OptDirCadence option. Stepper needs Tick called from the
+// timer interrupt, directly or through a Router.
+type Stepper struct {
+	// Stats counts ignored messages. Only ever incremented.
+	Stats Stats
+
+	// period is the current half-period in ticks (0 = silent) and tick
+	// counts towards it.
+	period [config.NumSteppers + 1]uint16
+	tick   [config.NumSteppers + 1]uint16
+
+	// Start-up ramp: target is the note's half-period, which period
+	// falls towards by rampDelta a toggle for ramp more toggles.
+	target    [config.NumSteppers + 1]uint16
+	ramp      [config.NumSteppers + 1]byte
+	rampDelta [config.NumSteppers + 1]uint16
+
+	// unbent is the note's half-period before pitch bend.
+	unbent [config.NumSteppers + 1]uint16
+	bend   [config.NumSteppers + 1]int16
+	note   [config.NumSteppers + 1]byte
+
+	// Per-motor settings.
+	transpose   [config.NumSteppers + 1]int8
+	detune      [config.NumSteppers + 1]int8
+	periodScale [config.NumSteppers + 1]uint32
+	bendRange   [config.NumSteppers + 1]byte
+	cadence     [config.NumSteppers + 1]byte
+
+	// toggles counts STEP pin toggles since the last reversal.
+	toggles   [config.NumSteppers + 1]uint16
+	reverse   [config.NumSteppers + 1]bool
+	stepState [config.NumSteppers + 1]bool
+
+	// Coil power: enabled is set while ENABLE is asserted; idleChecks
+	// counts idle checks with every motor silent.
+	enabled    bool
+	idleChecks uint16
+	ticks      uint16
+
+	stepPins [config.NumSteppers + 1]hal.Pin
+	dirPins  [config.NumSteppers + 1]hal.Pin
+}
+
+// NewStepper creates a Stepper instance for config.NumSteppers motors.
+func NewStepper() *Stepper {
+	s := &Stepper{}
+	for d := 1; d <= config.NumSteppers; d++ {
+		s.stepPins[d] = hal.Pin(config.StepperFirstPin + (d-1)*2)
+		s.dirPins[d] = hal.Pin(config.StepperFirstPin + (d-1)*2 + 1)
+		s.periodScale[d] = 1 << 16
+		s.bendRange[d] = config.DefaultBendRange
+		s.cadence[d] = config.StepperReverseSteps
+	}
+	return s
+}
+
+// Setup configures the driver pins as outputs with the coils
+// de-energised. Must be called before Tick or message handling.
+func (s *Stepper) Setup() {
+	for d := 1; d <= config.NumSteppers; d++ {
+		s.stepPins[d].Configure(hal.PinConfig{Mode: hal.PinOutput})
+		s.dirPins[d].Configure(hal.PinConfig{Mode: hal.PinOutput})
+		s.stepPins[d].Low()
+		s.dirPins[d].Low()
+	}
+	if config.StepperEnablePin != 0 {
+		hal.Pin(config.StepperEnablePin).Configure(hal.PinConfig{Mode: hal.PinOutput})
+	}
+	s.setEnabled(false)
+}
+
+// Tick steps every sounding motor whose half-period is up, advancing
+// start-up ramps, and de-energises the coils once all are idle. Called by
+// the timer interrupt at TimerResolution intervals.
+func (s *Stepper) Tick() {
+	silent := true
+	for d := 1; d <= config.NumSteppers; d++ {
+		if s.period[d] == 0 {
+			continue
+		}
+		silent = false
+		s.tick[d]++
+		if s.tick[d] < s.period[d] {
+			continue
+		}
+		s.tick[d] = 0
+		s.togglePin(d)
+		if s.ramp[d] > 0 {
+			s.ramp[d]--
+			if s.ramp[d] == 0 {
+				s.period[d] = s.target[d]
+			} else {
+				s.period[d] -= s.rampDelta[d]
+			}
+		}
+	}
+
+	s.ticks++
+	if s.ticks%idleCheckTicks != 0 {
+		return
+	}
+	if !silent || !s.enabled {
+		s.idleChecks = 0
+		return
+	}
+	s.idleChecks++
+	if s.idleChecks >= stepperIdleChecks {
+		s.setEnabled(false)
+	}
+}
+
+// togglePin flips a motor's STEP pin, reversing it first every
+// cadence steps.
+func (s *Stepper) togglePin(d int) {
+	if c := s.cadence[d]; c > 0 && s.toggles[d] >= 2*uint16(c) {
+		s.reverse[d] = !s.reverse[d]
+		s.dirPins[d].Set(s.reverse[d])
+		s.toggles[d] = 0
+	}
+	s.toggles[d]++
+	s.stepState[d] = !s.stepState[d]
+	s.stepPins[d].Set(s.stepState[d])
+}
+
+// setEnabled energises or de-energises every motor's coils.
+func (s *Stepper) setEnabled(on bool) {
+	s.enabled = on
+	s.idleChecks = 0
+	if config.StepperEnablePin != 0 {
+		hal.Pin(config.StepperEnablePin).Set(!on)
+	}
+}
+
+// PlayNote starts note (before transpose) on a motor. Returns ErrNoDrive
+// for a motor outside 1..config.NumSteppers and ErrBadNote for a note
+// outside 0..config.StepperMaxNote after transpose.
+func (s *Stepper) PlayNote(motor, note byte) error {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	return s.playNote(motor, note)
+}
+
+// playNote is PlayNote with interrupts held off.
+func (s *Stepper) playNote(motor, note byte) error {
+	if motor < 1 || motor > config.NumSteppers {
+		return ErrNoDrive
+	}
+	n := int16(note) + int16(s.transpose[motor])
+	if note > 127 || n < 0 || n > config.StepperMaxNote {
+		return ErrBadNote
+	}
+	ticks := notes.NoteDoubleTicks[n]
+	if s.detune[motor] != 0 {
+		ticks = notes.ScalePeriod(ticks, s.periodScale[motor])
+	}
+	if !s.enabled {
+		s.setEnabled(true)
+	}
+	s.note[motor] = note
+	s.unbent[motor] = ticks
+	s.bend[motor] = 0
+	s.start(motor, ticks)
+	return nil
+}
+
+// start sets a motor going at half-period ticks. A note faster than the
+// motor can start at ramps up from config.StepperStartHz instead; a motor
+// already turning just changes speed.
+func (s *Stepper) start(motor byte, ticks uint16) {
+	s.target[motor] = ticks
+	s.ramp[motor] = 0
+	if config.StepperRampSteps == 0 || ticks >= stepperStartTicks || s.period[motor] != 0 {
+		s.period[motor] = ticks
+		return
+	}
+	toggles := byte(2 * config.StepperRampSteps)
+	s.rampDelta[motor] = (stepperStartTicks - ticks) / uint16(toggles)
+	s.ramp[motor] = toggles
+	s.period[motor] = stepperStartTicks
+	s.tick[motor] = 0
+}
+
+// StopNote silences a motor. Motors outside 1..config.NumSteppers are
+// ignored.
+func (s *Stepper) StopNote(motor byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	s.stopNote(motor)
+}
+
+// stopNote is StopNote with interrupts held off.
+func (s *Stepper) stopNote(motor byte) {
+	if motor < 1 || motor > config.NumSteppers {
+		return
+	}
+	s.period[motor] = 0
+	s.ramp[motor] = 0
+	s.bend[motor] = 0
+}
+
+// StopAll silences every motor.
+func (s *Stepper) StopAll() {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	s.stopAll()
+}
+
+// stopAll is StopAll with interrupts held off.
+func (s *Stepper) stopAll() {
+	for d := byte(1); d <= config.NumSteppers; d++ {
+		s.stopNote(d)
+	}
+}
+
+// Bend bends the note a motor is playing by a 14-bit MIDI pitch bend
+// value (0..16383, 8192 = unbent); either end reaches the motor's bend
+// range. A ramp in progress carries on towards the bent pitch.
+func (s *Stepper) Bend(motor byte, bend uint16) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	s.bendNote(motor, bend)
+}
+
+// bendNote is Bend with interrupts held off.
+func (s *Stepper) bendNote(motor byte, bend uint16) {
+	if motor < 1 || motor > config.NumSteppers || s.period[motor] == 0 {
+		return
+	}
+	if bend > 0x3FFF {
+		bend = 0x3FFF
+	}
+	s.bend[motor] = int16(bend) - 8192
+	s.target[motor] = notes.BendTicks(s.unbent[motor], s.bend[motor], s.bendRange[motor])
+	if s.ramp[motor] == 0 {
+		s.period[motor] = s.target[motor]
+	}
+}
+
+// Caps returns the config.Cap bits of the commands the motors take, for
+// the pong.
+func (s *Stepper) Caps() uint16 {
+	return config.CapBendRange | config.CapTuning | config.CapOptions
+}
+
+// HandleSystemMessage processes system-wide commands (address 0x00).
+func (s *Stepper) HandleSystemMessage(command byte, payload []byte) {
+	switch command {
+	case config.CmdReset, config.CmdSequenceStop:
+		s.StopAll()
+	}
+}
+
+// HandleDeviceMessage processes commands for one motor, or for sub
+// address 0x00 all of them. Unknown commands and unusable payloads are
+// counted in Stats and dropped.
+func (s *Stepper) HandleDeviceMessage(subAddress byte, command byte, payload []byte) {
+	state := hal.DisableInterrupts()
+	defer hal.RestoreInterrupts(state)
+	need, known := stepperPayloadSize(command)
+	if !known {
+		s.Stats.UnknownCommands++
+		return
+	}
+	if len(payload) < need {
+		s.Stats.InvalidPayloads++
+		return
+	}
+	if subAddress > config.NumSteppers {
+		return
+	}
+	first, last := subAddress, subAddress
+	if subAddress == 0x00 {
+		first, last = 1, config.NumSteppers
+	}
+
+	switch command {
+	case config.DevCmdNoteOn:
+		if payload[0] > 127 {
+			s.Stats.InvalidPayloads++
+			return
+		}
+		s.playNote(subAddress, payload[0])
+	case config.DevCmdNoteOff:
+		for d := first; d <= last; d++ {
+			if len(payload) == 0 || payload[0] == s.note[d] {
+				s.stopNote(d)
+			}
+		}
+	case config.DevCmdReset:
+		for d := first; d <= last; d++ {
+			s.stopNote(d)
+		}
+	case config.DevCmdBendPitch:
+		bend := int32(int16(payload[0])<<8|int16(payload[1])) + 8192
+		if bend < 0 {
+			bend = 0
+		}
+		s.bendNote(subAddress, uint16(bend))
+	case config.DevCmdBendRange:
+		if payload[0] < 1 || payload[0] > config.MaxBendRange {
+			s.Stats.InvalidPayloads++
+			return
+		}
+		for d := first; d <= last; d++ {
+			s.bendRange[d] = payload[0]
+		}
+	case config.DevCmdTranspose:
+		for d := first; d <= last; d++ {
+			s.transpose[d] = int8(payload[0])
+		}
+	case config.DevCmdDetune:
+		for d := first; d <= last; d++ {
+			s.detune[d] = int8(payload[0])
+			s.periodScale[d] = notes.SemitoneRatioQ16(-int16(int8(payload[0])))
+		}
+	case config.DevCmdSetOption:
+		if payload[0] != config.OptDirCadence {
+			return
+		}
+		for d := first; d <= last; d++ {
+			s.cadence[d] = payload[1]
+		}
+	}
+}
+
+// DriveConfig appends a motor's settings to dst in CmdConfig payload
+// order, as far as bend_range. Steppers have no calibration; it reads 0.
+// Motors outside 1..config.NumSteppers leave dst unchanged.
+func (s *Stepper) DriveConfig(motor byte, dst []byte) []byte {
+	if motor < 1 || motor > config.NumSteppers {
+		return dst
+	}
+	return append(dst, byte(s.transpose[motor]), s.cadence[motor], 0,
+		byte(s.detune[motor]), s.bendRange[motor])
+}
+
+// stepperPayloadSize returns the minimum payload length of a device
+// command, and whether steppers implement the command at all.
+func stepperPayloadSize(command byte) (int, bool) {
+	switch command {
+	case config.DevCmdReset, config.DevCmdNoteOff:
+		return 0, true
+	case config.DevCmdNoteOn, config.DevCmdTranspose, config.DevCmdDetune,
+		config.DevCmdBendRange:
+		return 1, true
+	case config.DevCmdBendPitch, config.DevCmdSetOption:
+		return 2, true
+	}
+	return 0, false
+}
@@ -0,0 +1,78 @@
+//go:build !tinygo
+
+package instruments
+
+import (
+	"testing"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/fakeclock"
+	"github.com/ystepanoff/goppy/firmware/hal"
+	"github.com/ystepanoff/goppy/firmware/notes"
+)
+
+// TestStepperRamp starts a note too fast for a motor at rest: its STEP
+// toggles start at config.StepperStartHz and close in steadily over
+// config.StepperRampSteps steps to the note's pace. A slow note, and a
+// change of note on a turning motor, go straight to their pace.
+func TestStepperRamp(t *testing.T) {
+	if config.StepperRampSteps == 0 {
+		t.Skip("ramp disabled in config")
+	}
+	s := NewStepper()
+	s.Setup()
+	clock := fakeclock.New()
+	clock.Start(config.TimerResolution, s.Tick)
+	var gaps []int
+	var last uint64
+	hal.OnChange = func(p hal.Pin, high bool) {
+		if p == s.stepPins[1] {
+			gaps = append(gaps, int(clock.Ticks()-last))
+			last = clock.Ticks()
+		}
+	}
+	defer func() { hal.OnChange = nil }()
+	play := func(note byte) {
+		s.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{note})
+		gaps, last = gaps[:0], clock.Ticks()
+		clock.AdvanceMs(500)
+	}
+
+	const fast, slow = 90, 50
+	target := int(notes.NoteDoubleTicks[fast])
+	if target >= stepperStartTicks {
+		t.Fatalf("note %d isn't too fast to start at", fast)
+	}
+	play(fast)
+	toggles := 2 * config.StepperRampSteps
+	if gaps[0] != stepperStartTicks {
+		t.Errorf("first toggle after %d ticks, want %d", gaps[0], stepperStartTicks)
+	}
+	for i := 1; i < toggles; i++ {
+		if gaps[i] >= gaps[i-1] {
+			t.Fatalf("ramp toggle %d after %d ticks, the one before %d", i, gaps[i], gaps[i-1])
+		}
+	}
+	if gaps[toggles-1] < target {
+		t.Errorf("ramp overshot to %d ticks, note is %d", gaps[toggles-1], target)
+	}
+	for i, g := range gaps[toggles:] {
+		if g != target {
+			t.Fatalf("toggle %d after the ramp came after %d ticks, want %d", i, g, target)
+		}
+	}
+
+	// Already turning: straight to the new pace.
+	play(fast - 2)
+	if want := int(notes.NoteDoubleTicks[fast-2]); gaps[1] != want {
+		t.Errorf("note change on a turning motor: toggles every %d ticks, want %d", gaps[1], want)
+	}
+
+	s.HandleDeviceMessage(1, config.DevCmdNoteOff, nil)
+	play(slow)
+	for i, g := range gaps[1:] {
+		if want := int(notes.NoteDoubleTicks[slow]); g != want {
+			t.Fatalf("slow note: toggle %d after %d ticks, want %d", i, g, want)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package instruments
+
+import (
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/hal"
+)
+
+// HardwareTicker is the hal.Ticker real builds run on: InitTimer's timer
+// and the runtime's sleep.
+var HardwareTicker hal.Ticker = hardwareTicker{}
+
+type hardwareTicker struct{}
+
+func (hardwareTicker) Start(microseconds uint32, tick func()) { InitTimer(microseconds, tick) }
+func (hardwareTicker) Sleep(d time.Duration)                  { time.Sleep(d) }
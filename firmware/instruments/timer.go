@@ -28,6 +28,17 @@ const cpuFrequencyMHz = 16
 // Stored at package scope because the ISR cannot capture closures.
 var timerCallback func()
 
+// loadSampleTicks is how often (in ticks) the ISR checks its own run time.
+const loadSampleTicks = 64
+
+// Load monitoring state, see MonitorLoad. busyCount is the Timer1 count
+// past which a tick counts as busy: 7/8 of the slot.
+var (
+	loadCallback func(busy bool)
+	loadSample   byte
+	busyCount    uint16
+)
+
 // InitTimer configures Timer1 to fire callback every microseconds µs.
 //
 // Uses CTC mode with prescaler 1, so the maximum interval at 16 MHz is
@@ -50,6 +61,7 @@ func InitTimer(microseconds uint32, callback func()) {
 	ticks := uint16(cpuFrequencyMHz*microseconds - 1)
 	avr.OCR1AH.Set(byte(ticks >> 8))
 	avr.OCR1AL.Set(byte(ticks))
+	busyCount = ticks - ticks/8
 
 	// Wire the ISR before unmasking the interrupt.
 	interrupt.New(avr.IRQ_TIMER1_COMPA, timerISR)
@@ -59,10 +71,33 @@ func InitTimer(microseconds uint32, callback func()) {
 	avr.TCCR1B.Set(avr.TCCR1B_WGM10 | avr.TCCR1B_CS10)
 }
 
+// MonitorLoad registers callback to be told, every loadSampleTicks ticks,
+// whether that tick's handler used most of its slot or overran it.
+// callback runs in interrupt context - keep it tight.
+func MonitorLoad(callback func(busy bool)) {
+	loadCallback = callback
+}
+
 // timerISR is the Timer1 Compare A interrupt handler.
 // It dispatches to the registered callback.
 func timerISR(interrupt.Interrupt) {
 	if timerCallback != nil {
 		timerCallback()
 	}
+	if loadCallback == nil {
+		return
+	}
+	loadSample++
+	if loadSample < loadSampleTicks {
+		return
+	}
+	loadSample = 0
+
+	// The counter restarted at the compare match that raised this
+	// interrupt, so it now holds the cycles spent since. Entering the
+	// handler cleared OCF1A; if it is set again, the next match has
+	// already passed. Read TCNT1L first: it latches TCNT1H.
+	lo := avr.TCNT1L.Get()
+	count := uint16(avr.TCNT1H.Get())<<8 | uint16(lo)
+	loadCallback(avr.TIFR1.HasBits(avr.TIFR1_OCF1A) || count >= busyCount)
 }
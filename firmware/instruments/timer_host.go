@@ -0,0 +1,60 @@
+// Timer stand-in for host builds, where there is no Timer1. A goroutine
+// stands in for the interrupt, so the instruments meet the same
+// concurrency on the host as on the board. Tests and simulators that want
+// ticks on their own terms call the instruments' Tick themselves.
+
+//go:build !tinygo
+
+package instruments
+
+import (
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/hal"
+)
+
+// The running host timer, if any.
+var (
+	timerStop chan struct{}
+	timerDone chan struct{}
+)
+
+// InitTimer starts calling callback every microseconds µs from a goroutine
+// of its own, replacing any timer already running. callback runs with
+// interrupts held off (see hal.DisableInterrupts), as it would in the
+// interrupt. Ticks the host can't keep up with are dropped rather than
+// bunched, so a tiny interval ticks as fast as the host allows.
+func InitTimer(microseconds uint32, callback func()) {
+	StopTimer()
+	stop, done := make(chan struct{}), make(chan struct{})
+	timerStop, timerDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(time.Duration(microseconds) * time.Microsecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			state := hal.DisableInterrupts()
+			callback()
+			hal.RestoreInterrupts(state)
+		}
+	}()
+}
+
+// StopTimer stops the timer InitTimer started, returning once its last
+// callback has. It does nothing if no timer is running. Host only.
+func StopTimer() {
+	if timerStop == nil {
+		return
+	}
+	close(timerStop)
+	<-timerDone
+	timerStop, timerDone = nil, nil
+}
+
+// MonitorLoad does nothing on the host.
+func MonitorLoad(callback func(busy bool)) {}
@@ -4,18 +4,50 @@ import (
 	"github.com/ystepanoff/goppy/firmware/config"
 	"github.com/ystepanoff/goppy/firmware/instruments"
 	"github.com/ystepanoff/goppy/firmware/networks"
+	"github.com/ystepanoff/goppy/firmware/status"
 )
 
 func main() {
 	floppy := instruments.NewFloppyDrives()
-	floppy.Setup()
 
-	instruments.InitTimer(config.TimerResolution, floppy.Tick)
+	// The status LED, lit solid from here until the firmware is ready.
+	var led *status.LED
+	if config.StatusLEDPin != 0 {
+		led = status.New(config.StatusLEDPin, status.DefaultPatterns)
+		led.Setup()
+		floppy.SetStatusLED(led)
+	}
+
+	// The floppies alone, or every instrument of the route table.
+	var consumer networks.MessageConsumer = floppy
+	tick := floppy.Tick
+	if len(config.Routes) == 0 {
+		floppy.Setup()
+	} else {
+		router, err := instruments.RouterFor(config.Routes[:], floppy)
+		if err != nil {
+			panic("config.Routes: " + err.Error())
+		}
+		consumer, tick = router, router.Tick
+	}
+	if led != nil {
+		play := tick
+		tick = func() {
+			play()
+			led.Tick()
+		}
+	}
+
+	instruments.InitTimer(config.TimerResolution, tick)
+	instruments.MonitorLoad(floppy.TickLoad)
 
-	serial := networks.NewSerial(floppy)
+	serial := networks.NewSerial(consumer)
+	serial.SetStatusLED(led)
 	serial.Begin()
+	led.SetState(status.Idle)
 
 	for {
 		serial.ReadMessages()
+		floppy.SaveDriveSettings()
 	}
 }
@@ -0,0 +1,85 @@
+package networks_test
+
+import (
+	"testing"
+
+	"github.com/ystepanoff/goppy/firmware/benchtest"
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/networks"
+)
+
+// loopPort replays the same stream every time it is rewound, without
+// allocating, unlike MockPort, which grows with every Feed.
+type loopPort struct {
+	stream []byte
+	pos    int
+}
+
+func (p *loopPort) Buffered() int { return len(p.stream) - p.pos }
+
+func (p *loopPort) Read(b []byte) (int, error) {
+	n := copy(b, p.stream[p.pos:])
+	p.pos += n
+	return n, nil
+}
+
+func (p *loopPort) Write(b []byte) (int, error) { return len(b), nil }
+
+// nopConsumer drops every message.
+type nopConsumer struct{}
+
+func (nopConsumer) HandleSystemMessage(command byte, payload []byte)             {}
+func (nopConsumer) HandleDeviceMessage(subAddress, command byte, payload []byte) {}
+
+// mixedStream is 1000 frames of the kind a song sends: mostly notes, with
+// bends, pressure, a foreign device and the odd system message.
+func mixedStream() []byte {
+	var stream []byte
+	for i := 0; i < 1000; i++ {
+		d := byte(i%int(config.MaxSubAddress)) + 1
+		var f []byte
+		switch i % 10 {
+		case 0, 2, 4:
+			f = frame(config.DeviceAddress, d, config.DevCmdNoteOn, byte(48+i%24), 100)
+		case 1, 3, 5:
+			f = frame(config.DeviceAddress, d, config.DevCmdNoteOff, byte(48+i%24))
+		case 6:
+			f = frame(config.DeviceAddress, d, config.DevCmdBendPitch, byte(i), byte(i>>8))
+		case 7:
+			f = frame(config.DeviceAddress, d, config.DevCmdChannelPressure, byte(i%128))
+		case 8:
+			f = frame(config.DeviceAddress+1, d, config.DevCmdNoteOn, 60, 100)
+		case 9:
+			f = frame(config.SystemAddress, 0, config.CmdSequenceStart)
+		}
+		stream = append(stream, f...)
+	}
+	return stream
+}
+
+func BenchmarkParse1000(b *testing.B) {
+	port := &loopPort{stream: mixedStream()}
+	s := networks.NewSerialPort(nopConsumer{}, port)
+	b.SetBytes(int64(len(port.stream)))
+	b.ReportAllocs()
+	for b.Loop() {
+		port.pos = 0
+		s.ReadMessages()
+	}
+	// Per byte, against the time between bytes on the wire.
+	perByte := benchtest.Cycles(b) / float64(len(port.stream))
+	b.ReportMetric(perByte, "avr-cycles/byte")
+	b.ReportMetric(100*perByte/benchtest.ByteBudget, "%budget")
+}
+
+func TestParseAllocs(t *testing.T) {
+	port := &loopPort{stream: mixedStream()}
+	s := networks.NewSerialPort(nopConsumer{}, port)
+	allocs := testing.AllocsPerRun(100, func() {
+		port.pos = 0
+		s.ReadMessages()
+	})
+	if allocs != 0 {
+		t.Errorf("parsing 1000 messages allocates %v times, want 0", allocs)
+	}
+}
@@ -0,0 +1,271 @@
+// Package capture reads and writes recordings of the byte stream sent to
+// the device, and the outcome of replaying one through the parser.
+//
+// A capture is text, one write to the port per line, as hex bytes
+// separated by whitespace:
+//
+//	# goppy play song.mid
+//	@0ms      4d 00 00 01 fa
+//	@12.5ms   4d 01 01 03 09 3c 64
+//
+// A line may start with an @offset token (anything time.ParseDuration
+// takes, such as @250ms) recording when it was sent, from the start of
+// the capture. A line without one was sent along with the line before.
+// Everything after # is a comment. goppy's --record flag writes this
+// format, the conformance fixtures in networks/testdata/conformance use
+// it, and goppy replay reads it. A binary capture, as goppy-play --record
+// writes it in package protocol's format, reads as a timed chunk for each
+// entry. A file of raw bytes, as a serial sniffer saves them, reads as a
+// single untimed chunk.
+//
+// The outcome of a replay, an Outcome, is stored as JSON: the conformance
+// golden files and goppy replay --assert share it.
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ystepanoff/goppy/firmware/networks/networkstest"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// Chunk is one line of a capture: bytes written to the port together.
+type Chunk struct {
+	// At is when the chunk was sent, from the start of the capture. For an
+	// untimed chunk it is the time of the last timed chunk before it.
+	At    time.Duration
+	Timed bool
+	Data  []byte
+}
+
+// ReadFile reads the capture at path, text or raw.
+func ReadFile(path string) ([]Chunk, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", path, err)
+	}
+	return chunks, nil
+}
+
+// Parse parses a capture. Data that isn't text or a binary capture is
+// taken as raw bytes.
+func Parse(data []byte) ([]Chunk, error) {
+	if bytes.HasPrefix(data, []byte(protocol.CaptureMagic)) {
+		return parseBinary(data)
+	}
+	if !isText(data) {
+		return []Chunk{{Data: bytes.Clone(data)}}, nil
+	}
+	var chunks []Chunk
+	var at time.Duration
+	for n, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		timed := len(fields) > 0 && strings.HasPrefix(fields[0], "@")
+		if timed {
+			d, err := time.ParseDuration(fields[0][1:])
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("%d: bad offset %q", n+1, fields[0])
+			}
+			at = d
+			fields = fields[1:]
+		}
+		var chunk []byte
+		for _, field := range fields {
+			b, err := hex.DecodeString(field)
+			if err != nil || len(b) != 1 {
+				return nil, fmt.Errorf("%d: bad byte %q", n+1, field)
+			}
+			chunk = append(chunk, b[0])
+		}
+		if chunk != nil {
+			chunks = append(chunks, Chunk{At: at, Timed: timed, Data: chunk})
+		}
+	}
+	return chunks, nil
+}
+
+// parseBinary parses a binary capture.
+func parseBinary(data []byte) ([]Chunk, error) {
+	_, n, err := protocol.DecodeCaptureHeader(data)
+	if err != nil {
+		return nil, fmt.Errorf(" %w", err)
+	}
+	var chunks []Chunk
+	var at time.Duration
+	for pos := n; pos < len(data); pos += n {
+		var delta time.Duration
+		var frame []byte
+		if delta, frame, n, err = protocol.DecodeCaptureEntry(data[pos:]); err != nil {
+			return nil, fmt.Errorf(" entry at byte %d: %w", pos, err)
+		}
+		at += delta
+		chunks = append(chunks, Chunk{At: at, Timed: true, Data: bytes.Clone(frame)})
+	}
+	return chunks, nil
+}
+
+// isText reports whether data looks like a text capture rather than raw
+// bytes, which always hold a control character: the zero system address
+// if nothing else.
+func isText(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, b := range data {
+		if b < 0x20 && b != '\t' && b != '\n' && b != '\r' {
+			return false
+		}
+	}
+	return true
+}
+
+// Stream joins the chunks back into the byte stream they were cut from.
+func Stream(chunks []Chunk) []byte {
+	var stream []byte
+	for _, c := range chunks {
+		stream = append(stream, c.Data...)
+	}
+	return stream
+}
+
+// Writer writes a capture. Writes go through a buffer: call Flush when
+// done.
+type Writer struct {
+	w *bufio.Writer
+}
+
+// NewWriter returns a Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Comment writes text as a comment line.
+func (w *Writer) Comment(text string) error {
+	for _, line := range strings.Split(text, "\n") {
+		if _, err := fmt.Fprintf(w.w, "# %s\n", line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write writes data as a line sent at at, to the microsecond.
+func (w *Writer) Write(at time.Duration, data []byte) error {
+	ms := strconv.FormatFloat(float64(at.Round(time.Microsecond))/float64(time.Millisecond), 'f', -1, 64)
+	_, err := fmt.Fprintf(w.w, "%-9s % x\n", "@"+ms+"ms", data)
+	return err
+}
+
+// Line writes data as an untimed line, with comment after it unless it is
+// empty.
+func (w *Writer) Line(data []byte, comment string) error {
+	var err error
+	if comment == "" {
+		_, err = fmt.Fprintf(w.w, "% x\n", data)
+	} else {
+		_, err = fmt.Fprintf(w.w, "%-31s # %s\n", fmt.Sprintf("% x", data), comment)
+	}
+	return err
+}
+
+// Flush writes out anything buffered.
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// Outcome is what replaying a capture through networks.Serial did: the
+// messages handed to the consumer, in order, and the frames sent back.
+type Outcome struct {
+	Calls   []Call  `json:"calls"`
+	Written []Bytes `json:"written"`
+}
+
+// Call is a networkstest.Call with hex bytes, to keep the files readable
+// next to the captures.
+type Call struct {
+	System     bool  `json:"system,omitempty"`
+	SubAddress byte  `json:"sub"`
+	Command    Bytes `json:"command"`
+	Payload    Bytes `json:"payload,omitempty"`
+}
+
+// Bytes marshals as space-separated hex, such as "4d 00 00 01 80".
+type Bytes []byte
+
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("% x", []byte(b)))
+}
+
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	h, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	*b = h
+	return err
+}
+
+// NewOutcome builds an Outcome from a Recorder's calls and what was
+// written to the port, split back into frames.
+func NewOutcome(calls []networkstest.Call, written []byte) Outcome {
+	var o Outcome
+	for _, c := range calls {
+		o.Calls = append(o.Calls, Call{
+			System:     c.System,
+			SubAddress: c.SubAddress,
+			Command:    Bytes{c.Command},
+			Payload:    c.Payload,
+		})
+	}
+	for len(written) >= 4 {
+		n := min(4+int(written[3]), len(written))
+		o.Written = append(o.Written, written[:n])
+		written = written[n:]
+	}
+	return o
+}
+
+// ReadOutcome reads an Outcome stored as JSON at path. An empty list reads
+// as a missing one, so that Outcomes compare with reflect.DeepEqual.
+func ReadOutcome(path string) (Outcome, error) {
+	var o Outcome
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return o, err
+	}
+	if err := json.Unmarshal(data, &o); err != nil {
+		return o, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(o.Calls) == 0 {
+		o.Calls = nil
+	}
+	if len(o.Written) == 0 {
+		o.Written = nil
+	}
+	return o, nil
+}
+
+// WriteOutcome stores o as indented JSON at path.
+func WriteOutcome(path string, o Outcome) error {
+	data, err := json.MarshalIndent(o, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,125 @@
+package networks_test
+
+import (
+	"encoding/json"
+	"flag"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ystepanoff/goppy/firmware/networks"
+	"github.com/ystepanoff/goppy/firmware/networks/capture"
+	"github.com/ystepanoff/goppy/firmware/networks/networkstest"
+)
+
+// Conformance fixtures live in testdata/conformance, one pair of files
+// per capture:
+//
+//   - NAME.hex is the byte stream sent to the device, in the capture
+//     format goppy --record writes (see package capture). The timing is
+//     ignored.
+//   - NAME.json is what the firmware must do with it, a capture.Outcome:
+//     "calls" lists every message handed to the consumer, in order, and
+//     "written" every frame sent back, as the reference Moppy firmware
+//     sends it for the same input.
+//
+// The streams follow the traffic MoppyControlGUI 2.x sends, and the
+// replies the reference Arduino firmware. Fixtures assume the default
+// config: device 0x01 with drives 1-8.
+//
+// To add a capture, save it as NAME.hex and run
+//
+//	go test ./networks -run TestConformance -update
+//
+// or goppy replay --update, to write NAME.json, then check "written"
+// against the reference firmware by hand before committing it.
+var update = flag.Bool("update", false, "rewrite the conformance golden files from the parser's output")
+
+// intentional lists the fixtures that differ from the reference firmware
+// on purpose, and why. A fixture that differs belongs here and nowhere
+// else.
+var intentional = map[string]string{
+	"divergences": "zone alias sub addresses (0x10..0x13) are ours and dispatched; " +
+		"a size 0 frame is dropped rather than taking the next frame's start byte as its command; " +
+		"CmdGetConfig, CmdGetPositions and CmdGetStatus are answered by Serial and never reach the consumer",
+}
+
+// replay runs stream through a Serial, delivered in chunks of the given
+// size, and returns the outcome.
+func replay(stream []byte, chunk int) capture.Outcome {
+	var chunks [][]byte
+	for len(stream) > chunk {
+		chunks = append(chunks, stream[:chunk])
+		stream = stream[chunk:]
+	}
+	chunks = append(chunks, stream)
+
+	port := networkstest.NewMockPort(chunks...)
+	rec := &networkstest.Recorder{}
+	s := networks.NewSerialPort(rec, port)
+	for port.Deliver() {
+		s.ReadMessages()
+	}
+
+	return capture.NewOutcome(rec.Calls, port.Written)
+}
+
+func TestConformance(t *testing.T) {
+	captures, err := filepath.Glob(filepath.Join("testdata", "conformance", "*.hex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(captures) == 0 {
+		t.Fatal("no conformance fixtures found")
+	}
+	names := map[string]bool{}
+	for _, path := range captures {
+		name := strings.TrimSuffix(filepath.Base(path), ".hex")
+		names[name] = true
+		t.Run(name, func(t *testing.T) {
+			chunks, err := capture.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream := capture.Stream(chunks)
+			got := replay(stream, len(stream))
+
+			goldenPath := strings.TrimSuffix(path, ".hex") + ".json"
+			if *update {
+				if err := capture.WriteOutcome(goldenPath, got); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			want, err := capture.ReadOutcome(goldenPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.Calls, want.Calls) {
+				t.Errorf("calls differ from %s\n got: %s\nwant: %s", goldenPath, show(got.Calls), show(want.Calls))
+			}
+			if !reflect.DeepEqual(got.Written, want.Written) {
+				t.Errorf("written differs from %s\n got: %s\nwant: %s", goldenPath, show(got.Written), show(want.Written))
+			}
+
+			// Timing is gone from the fixtures, so delivery mustn't matter:
+			// the same stream a byte at a time gives the same outcome.
+			if bytewise := replay(stream, 1); !reflect.DeepEqual(bytewise, got) {
+				t.Errorf("byte-at-a-time delivery differs\n got: %s\nwant: %s", show(bytewise), show(got))
+			}
+		})
+	}
+	for name := range intentional {
+		if !names[name] {
+			t.Errorf("intentional divergence %q has no fixture", name)
+		}
+	}
+}
+
+// show renders v as the golden files would, for failure messages.
+func show(v any) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
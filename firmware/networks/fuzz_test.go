@@ -0,0 +1,92 @@
+package networks
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/networks/networkstest"
+)
+
+// fuzzConsumer checks every dispatch against the bytes Serial has read:
+// the command and payload must be the last size bytes taken from the
+// port, so the whole frame arrived, and the payload must be size-1 long.
+type fuzzConsumer struct {
+	t      *testing.T
+	s      *Serial
+	port   *networkstest.MockPort
+	stream []byte // everything fed to port so far
+}
+
+func (c *fuzzConsumer) check(command byte, payload []byte) {
+	size := int(c.s.messageBuffer[3])
+	if size == 0 {
+		c.t.Fatalf("dispatched command 0x%02X from a size 0 frame", command)
+	}
+	if len(payload) != size-1 {
+		c.t.Fatalf("payload is %d bytes, size byte says %d", len(payload), size-1)
+	}
+	read := len(c.stream) - c.port.Buffered()
+	if read < size {
+		c.t.Fatalf("dispatched after reading %d bytes, frame body is %d", read, size)
+	}
+	body := c.stream[read-size : read]
+	if body[0] != command || !bytes.Equal(body[1:], payload) {
+		c.t.Fatalf("dispatched % X % X, last bytes read were % X", command, payload, body)
+	}
+}
+
+func (c *fuzzConsumer) HandleSystemMessage(command byte, payload []byte) {
+	c.check(command, payload)
+}
+
+func (c *fuzzConsumer) HandleDeviceMessage(subAddress byte, command byte, payload []byte) {
+	c.check(command, payload)
+}
+
+// FuzzParser feeds arbitrary bytes to Serial in chunks whose sizes come
+// from seed, checking the parser state after every chunk and every
+// dispatch as it happens. Besides the seeds added here, the corpus in
+// testdata/fuzz/FuzzParser holds streams built and damaged with the
+// host's internal/moppytest; its TestFuzzSeeds rewrites them.
+func FuzzParser(f *testing.F) {
+	valid := []byte{config.StartByte, config.DeviceAddress, 1, 3, config.DevCmdNoteOn, 60, 100}
+	ping := []byte{config.StartByte, config.SystemAddress, 0, 1, config.CmdPing}
+	maxSize := append([]byte{config.StartByte, config.DeviceAddress, 1, 255}, bytes.Repeat([]byte{0x4D}, 255)...)
+	f.Add(valid, byte(0))
+	f.Add(append(valid, ping...), byte(3))
+	f.Add(valid[:5], byte(1))
+	f.Add(append(valid[:4], valid...), byte(7))
+	f.Add(bytes.Repeat([]byte{config.StartByte}, 64), byte(2))
+	f.Add([]byte{0x4D, 0x4D, 0x00, 0x4D, 0x4D, 0x01, 0x4D, 0x4D}, byte(5))
+	f.Add(maxSize, byte(0))
+	f.Add(maxSize[:200], byte(9))
+	f.Add([]byte{config.StartByte, config.DeviceAddress, 1, 0, config.StartByte}, byte(4))
+
+	f.Fuzz(func(t *testing.T, data []byte, seed byte) {
+		port := networkstest.NewMockPort()
+		c := &fuzzConsumer{t: t, port: port}
+		s := NewSerialPort(c, port)
+		c.s = s
+
+		rng := uint32(seed) | 1
+		for len(data) > 0 {
+			rng = rng*1103515245 + 12345
+			n := 1 + int(rng>>16)%16
+			if n > len(data) {
+				n = len(data)
+			}
+			port.Feed(data[:n]...)
+			c.stream = append(c.stream, data[:n]...)
+			data = data[n:]
+
+			s.ReadMessages()
+			if s.messagePos < 0 || s.messagePos > 4 {
+				t.Fatalf("messagePos = %d", s.messagePos)
+			}
+			if s.messagePos == 4 && port.Buffered() >= int(s.messageBuffer[3]) {
+				t.Fatalf("stalled with a complete frame buffered")
+			}
+		}
+	})
+}
@@ -0,0 +1,94 @@
+// Package networkstest provides test doubles for the networks package: a
+// MockPort standing in for the serial port and a Recorder standing in for
+// the instruments.
+package networkstest
+
+// MockPort is a scriptable networks.Port. Bytes given to Feed can be read
+// straight away; chunks given to Queue arrive one at a time with Deliver,
+// to play out fragmented delivery. Everything written is captured.
+type MockPort struct {
+	// Written holds every byte written to the port.
+	Written []byte
+
+	in     []byte
+	queued [][]byte
+}
+
+// NewMockPort returns a MockPort with chunks queued for Deliver.
+func NewMockPort(chunks ...[]byte) *MockPort {
+	p := &MockPort{}
+	p.Queue(chunks...)
+	return p
+}
+
+// Feed makes bytes available to read.
+func (p *MockPort) Feed(b ...byte) {
+	p.in = append(p.in, b...)
+}
+
+// Queue adds chunks to be delivered in turn by Deliver.
+func (p *MockPort) Queue(chunks ...[]byte) {
+	p.queued = append(p.queued, chunks...)
+}
+
+// Deliver makes the next queued chunk available to read, reporting false
+// when none is left.
+func (p *MockPort) Deliver() bool {
+	if len(p.queued) == 0 {
+		return false
+	}
+	p.Feed(p.queued[0]...)
+	p.queued = p.queued[1:]
+	return true
+}
+
+// Buffered returns how many bytes are available to read.
+func (p *MockPort) Buffered() int {
+	return len(p.in)
+}
+
+// Read reads available bytes into b.
+func (p *MockPort) Read(b []byte) (int, error) {
+	n := copy(b, p.in)
+	p.in = p.in[n:]
+	return n, nil
+}
+
+// Write captures b.
+func (p *MockPort) Write(b []byte) (int, error) {
+	p.Written = append(p.Written, b...)
+	return len(b), nil
+}
+
+// Call is one message a Recorder received.
+type Call struct {
+	// System is set for HandleSystemMessage, when SubAddress is 0.
+	System     bool
+	SubAddress byte
+	Command    byte
+	// Payload is a copy of the payload, nil when it was empty.
+	Payload []byte
+}
+
+// Recorder is a networks.MessageConsumer that records every call.
+type Recorder struct {
+	Calls []Call
+}
+
+// HandleSystemMessage records a system message.
+func (r *Recorder) HandleSystemMessage(command byte, payload []byte) {
+	r.Calls = append(r.Calls, Call{System: true, Command: command, Payload: clone(payload)})
+}
+
+// HandleDeviceMessage records a device message.
+func (r *Recorder) HandleDeviceMessage(subAddress byte, command byte, payload []byte) {
+	r.Calls = append(r.Calls, Call{SubAddress: subAddress, Command: command, Payload: clone(payload)})
+}
+
+// clone copies a payload, which the caller may reuse, keeping nil for empty.
+func clone(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
@@ -0,0 +1,12 @@
+//go:build !tinygo
+
+package networks
+
+// defaultPort returns nil on the host, which has no board serial port:
+// use NewSerialPort there.
+func defaultPort() Port {
+	return nil
+}
+
+// configurePort does nothing on the host.
+func configurePort(port Port) {}
@@ -0,0 +1,24 @@
+//go:build tinygo
+
+package networks
+
+import (
+	"machine"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+)
+
+// defaultPort returns the board's USB serial port.
+func defaultPort() Port {
+	return machine.Serial
+}
+
+// configurePort sets a board serial port to config.SerialBaudRate. Other
+// ports are left alone.
+func configurePort(port Port) {
+	if uart, ok := port.(interface {
+		Configure(machine.UARTConfig) error
+	}); ok {
+		uart.Configure(machine.UARTConfig{BaudRate: config.SerialBaudRate})
+	}
+}
@@ -1,217 +1,515 @@
-// Package networks provides communication handlers for the Moppy protocol.
-// This package implements serial (USB) communication with the Moppy controller.
-package networks
-
-import (
-	"machine"
-
-	"github.com/ystepanoff/goppy/firmware/config"
-)
-
-// =============================================================================
-// MESSAGE CONSUMER INTERFACE
-// =============================================================================
-
-// MessageConsumer defines the interface for handling Moppy messages.
-// Instruments (like FloppyDrives) implement this interface to receive commands.
-type MessageConsumer interface {
-	// HandleSystemMessage processes system-wide commands (sent to address 0x00).
-	// These affect all devices: reset, sequence start/stop, etc.
-	HandleSystemMessage(command byte, payload []byte)
-
-	// HandleDeviceMessage processes device-specific commands.
-	// subAddress identifies the specific drive (1-8).
-	// command is the action (note on/off, pitch bend, etc.).
-	// payload contains command-specific data.
-	HandleDeviceMessage(subAddress byte, command byte, payload []byte)
-}
-
-// =============================================================================
-// SERIAL HANDLER
-// =============================================================================
-
-// Serial handles USB serial communication with the Moppy controller.
-// It reads incoming bytes, parses the Moppy protocol, and dispatches
-// messages to a MessageConsumer (typically a FloppyDrives instance).
-type Serial struct {
-	consumer MessageConsumer
-
-	// Message parsing state
-	messagePos    int                            // Current position in message parsing state machine
-	messageBuffer [config.MessageBufferSize]byte // Buffer for incoming message
-
-	// Pre-built pong response
-	// Format: [START][DEVICE=0x00][SUB=0x00][SIZE=4][PONG][ADDR][MIN][MAX]
-	pongBytes [8]byte
-}
-
-// NewSerial creates a new Serial handler with the given message consumer.
-func NewSerial(consumer MessageConsumer) *Serial {
-	s := &Serial{
-		consumer:   consumer,
-		messagePos: 0,
-	}
-
-	// Pre-build the pong response bytes
-	s.pongBytes = [8]byte{
-		config.StartByte,
-		config.SystemAddress,  // Device address (system)
-		0x00,                  // Sub address
-		0x04,                  // Size: 4 bytes follow
-		config.CmdPong,        // Pong command
-		config.DeviceAddress,  // Our device address
-		config.MinSubAddress,  // First drive we control
-		config.MaxSubAddress,  // Last drive we control
-	}
-
-	return s
-}
-
-// Begin initialises the serial port for Moppy communication.
-// Must be called before ReadMessages.
-func (s *Serial) Begin() {
-	machine.Serial.Configure(machine.UARTConfig{
-		BaudRate: config.SerialBaudRate,
-	})
-}
-
-// =============================================================================
-// MESSAGE READING STATE MACHINE
-// =============================================================================
-
-// ReadMessages reads and processes any available Moppy messages from serial.
-// This should be called repeatedly in the main loop.
-//
-// Moppy message format:
-//
-//	Byte 0: START_BYTE (0x4D)
-//	Byte 1: Device address (0x00 for system-wide)
-//	Byte 2: Sub address (drive number, ignored for system messages)
-//	Byte 3: Size of message body (bytes following this one)
-//	Byte 4: Command byte
-//	Byte 5+: Optional payload
-//
-// The state machine handles partial reads gracefully, allowing it to be
-// called from a non-blocking main loop.
-func (s *Serial) ReadMessages() {
-	for s.processNextByte() {
-		// Keep processing while there's data and we can make progress
-	}
-}
-
-// processNextByte handles the next byte in the message parsing state machine.
-// Returns true if processing should continue, false if we should wait for more data.
-func (s *Serial) processNextByte() bool {
-	// State 4 is special: we need to wait for the full payload
-	if s.messagePos == 4 {
-		payloadSize := int(s.messageBuffer[3])
-		if machine.Serial.Buffered() < payloadSize {
-			return false // Wait for full payload
-		}
-		s.readPayloadAndDispatch()
-		return true
-	}
-
-	// For other states, we need at least one byte
-	if machine.Serial.Buffered() == 0 {
-		return false
-	}
-
-	// Read single byte for state machine progression
-	var b [1]byte
-	_, err := machine.Serial.Read(b[:])
-	if err != nil {
-		return false
-	}
-
-	switch s.messagePos {
-	case 0:
-		// State 0: Waiting for START_BYTE
-		if b[0] == config.StartByte {
-			s.messagePos = 1
-		}
-		// Otherwise, keep scanning for start byte
-
-	case 1:
-		// State 1: Read device address
-		s.messageBuffer[1] = b[0]
-
-		if b[0] == config.SystemAddress {
-			// System messages are for everyone
-			s.messagePos = 2
-		} else if b[0] == config.DeviceAddress {
-			// Message is for us
-			s.messagePos = 2
-		} else {
-			// Not for us, reset
-			s.messagePos = 0
-		}
-
-	case 2:
-		// State 2: Read sub address (drive number)
-		s.messageBuffer[2] = b[0]
-
-		// Accept: 0x00 (all drives) or valid drive range
-		if b[0] == 0x00 || (b[0] >= config.MinSubAddress && b[0] <= config.MaxSubAddress) {
-			s.messagePos = 3
-		} else {
-			// Invalid sub address, reset
-			s.messagePos = 0
-		}
-
-	case 3:
-		// State 3: Read message body size
-		s.messageBuffer[3] = b[0]
-		s.messagePos = 4
-	}
-
-	return true
-}
-
-// readPayloadAndDispatch reads the command and payload, then dispatches to consumer.
-func (s *Serial) readPayloadAndDispatch() {
-	payloadSize := int(s.messageBuffer[3])
-
-	// Read command byte and payload into buffer starting at position 4
-	if payloadSize > 0 {
-		machine.Serial.Read(s.messageBuffer[4 : 4+payloadSize])
-	}
-
-	// Dispatch based on message type
-	if s.messageBuffer[1] == config.SystemAddress {
-		// System message
-		command := s.messageBuffer[4]
-		if command == config.CmdPing {
-			s.sendPong()
-		} else {
-			// Pass to consumer with payload (bytes after command)
-			var payload []byte
-			if payloadSize > 1 {
-				payload = s.messageBuffer[5 : 4+payloadSize]
-			}
-			s.consumer.HandleSystemMessage(command, payload)
-		}
-	} else {
-		// Device message
-		subAddress := s.messageBuffer[2]
-		command := s.messageBuffer[4]
-		var payload []byte
-		if payloadSize > 1 {
-			payload = s.messageBuffer[5 : 4+payloadSize]
-		}
-		s.consumer.HandleDeviceMessage(subAddress, command, payload)
-	}
-
-	// Reset for next message
-	s.messagePos = 0
-}
-
-// =============================================================================
-// PONG RESPONSE
-// =============================================================================
-
-// sendPong sends a pong response to a ping request.
-// This tells the controller what device address and drive range we handle.
-func (s *Serial) sendPong() {
-	machine.Serial.Write(s.pongBytes[:])
-}
+// Package networks provides communication handlers for the Moppy protocol.
+// This package implements serial (USB) communication with the Moppy controller.
+package networks
+
+import (
+	"math/bits"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+	"github.com/ystepanoff/goppy/firmware/status"
+)
+
+// =============================================================================
+// MESSAGE CONSUMER INTERFACE
+// =============================================================================
+
+// MessageConsumer defines the interface for handling Moppy messages.
+// Instruments (like FloppyDrives) implement this interface to receive commands.
+type MessageConsumer interface {
+	// HandleSystemMessage processes system-wide commands (sent to address 0x00).
+	// These affect all devices: reset, sequence start/stop, etc.
+	HandleSystemMessage(command byte, payload []byte)
+
+	// HandleDeviceMessage processes device-specific commands.
+	// subAddress identifies the specific drive (1-8), or a zone alias.
+	// command is the action (note on/off, pitch bend, etc.).
+	// payload contains command-specific data.
+	HandleDeviceMessage(subAddress byte, command byte, payload []byte)
+}
+
+// ConfigReporter is implemented by consumers that can report their per-drive
+// settings. Serial uses it to answer CmdGetConfig.
+type ConfigReporter interface {
+	// DriveConfig appends the settings of one drive to dst and returns the
+	// extended slice. It must not allocate beyond dst's capacity.
+	DriveConfig(driveNum byte, dst []byte) []byte
+}
+
+// PositionReporter is implemented by consumers that can report where their
+// heads are. Serial uses it to answer CmdGetPositions.
+type PositionReporter interface {
+	// DrivePosition returns a drive's position in steps, and false for a
+	// drive the consumer has no position for.
+	DrivePosition(driveNum byte) (uint16, bool)
+}
+
+// StatusReporter is implemented by consumers that can say how they are.
+// Serial uses it to answer CmdGetStatus, adding what it knows itself: the
+// sequence state, and the faults it found in the frames.
+type StatusReporter interface {
+	// DeviceStatus returns the seconds since the consumer started, the
+	// drives sounding (bit 0 for drive 1), and the last config.Fault it
+	// ran into, with how many there have been, wrapping.
+	DeviceStatus() (uptime uint32, drives uint16, fault byte, faults uint16)
+}
+
+// RouteReporter is implemented by consumers that hand ranges of sub
+// addresses to several instruments, such as instruments.Router. Serial
+// adds their routes to its answer to CmdGetConfig.
+type RouteReporter interface {
+	// Route returns the nth route, from 1: the sub addresses it covers
+	// and the config.Instrument it hands them to, and false past the last.
+	Route(n byte) (first, last, instrument byte, ok bool)
+}
+
+// Port is the byte stream Serial talks over: the board's USB serial in
+// the firmware (see NewSerial), or a networkstest.MockPort in tests.
+type Port interface {
+	// Buffered returns how many received bytes are waiting to be read.
+	Buffered() int
+	Read(p []byte) (int, error)
+	Write(p []byte) (int, error)
+}
+
+// DriveRangeProvider is implemented by consumers whose drives aren't
+// config.MinSubAddress..config.MaxSubAddress, such as instruments.Router.
+// Serial advertises the range in its pong and reports config for it.
+type DriveRangeProvider interface {
+	// DriveRange returns the first and last sub address the consumer handles.
+	DriveRange() (first, last byte)
+}
+
+// CapsReporter is implemented by consumers that take optional commands.
+// Serial advertises them in its pong, adding config.CapConfig and
+// config.CapPositions or config.CapStatus if the consumer is a
+// ConfigReporter, a PositionReporter or a StatusReporter. A consumer with
+// none takes only Moppy's commands, and Serial answers a ping with Moppy's
+// pong, without caps.
+type CapsReporter interface {
+	// Caps returns the config.Cap bits of the commands the consumer takes.
+	Caps() uint16
+}
+
+// =============================================================================
+// SERIAL HANDLER
+// =============================================================================
+
+// Stats counts what the parser made of the bytes it read. Counters wrap.
+type Stats struct {
+	// Frames counts frames dispatched to the consumer or answered by
+	// Serial itself.
+	Frames uint16
+
+	// SkippedBytes counts bytes skipped looking for a start byte,
+	// including the rest of every frame dropped below.
+	SkippedBytes uint16
+
+	// OtherDevice counts frames for another device address.
+	OtherDevice uint16
+
+	// BadSubAddress counts frames for a sub address outside the drive
+	// range and the zone aliases.
+	BadSubAddress uint16
+
+	// EmptyFrames counts frames of size 0, without a command.
+	EmptyFrames uint16
+}
+
+// Serial handles USB serial communication with the Moppy controller.
+// It reads incoming bytes, parses the Moppy protocol, and dispatches
+// messages to a MessageConsumer (typically a FloppyDrives instance).
+type Serial struct {
+	// Stats counts frames and dropped input. Only ever incremented.
+	Stats Stats
+
+	consumer MessageConsumer
+	port     Port
+
+	// Message parsing state
+	messagePos    int                            // Current position in message parsing state machine
+	messageBuffer [config.MessageBufferSize]byte // Buffer for incoming message
+	nextByte      [1]byte                        // Single-byte reads; a local would escape through Port
+
+	// Pre-built pong response
+	// Format: [START][DEVICE=0x00][SUB=0x00][SIZE=4][PONG][ADDR][MIN][MAX],
+	// then [CAPS MSB][CAPS LSB] with SIZE=6 if the consumer has caps.
+	pongBytes [10]byte
+	pongLen   int
+
+	// Scratch space for building replies other than pong.
+	replyBuffer [config.MessageBufferSize]byte
+
+	// Drive range advertised in the pong and reported by sendConfig.
+	firstDrive, lastDrive byte
+
+	// What sendStatus reports besides the consumer's status: the
+	// config.Sequence state the frames put the device in, and the last
+	// config.Fault found in them, with the consumer's Faults count when
+	// it was, to tell which of the two faults came last.
+	status         StatusReporter // the consumer, if it is one
+	sequence       byte
+	fault          byte
+	consumerFaults uint16
+
+	// The board's status LED, told of frames and faults; nil for none.
+	led *status.LED
+}
+
+// NewSerial creates a new Serial handler with the given message consumer,
+// talking over the board's serial port.
+func NewSerial(consumer MessageConsumer) *Serial {
+	return NewSerialPort(consumer, defaultPort())
+}
+
+// NewSerialPort creates a new Serial handler with the given message
+// consumer, talking over port.
+func NewSerialPort(consumer MessageConsumer, port Port) *Serial {
+	s := &Serial{
+		consumer:   consumer,
+		port:       port,
+		messagePos: 0,
+		firstDrive: config.MinSubAddress,
+		lastDrive:  config.MaxSubAddress,
+	}
+	if p, ok := consumer.(DriveRangeProvider); ok {
+		s.firstDrive, s.lastDrive = p.DriveRange()
+	}
+	s.status, _ = consumer.(StatusReporter)
+
+	// Pre-build the pong response bytes
+	var caps uint16
+	if r, ok := consumer.(CapsReporter); ok {
+		caps = r.Caps()
+	}
+	if _, ok := consumer.(ConfigReporter); ok {
+		caps |= config.CapConfig
+	}
+	if _, ok := consumer.(PositionReporter); ok {
+		caps |= config.CapPositions
+	}
+	if s.status != nil {
+		caps |= config.CapStatus
+	}
+	pong := protocol.Pong(config.DeviceAddress, s.firstDrive, s.lastDrive)
+	if caps != 0 {
+		pong = protocol.PongCaps(config.DeviceAddress, s.firstDrive, s.lastDrive, caps)
+	}
+	s.pongLen, _ = pong.Encode(s.pongBytes[:])
+
+	return s
+}
+
+// Begin initialises the serial port for Moppy communication.
+// Must be called before ReadMessages.
+func (s *Serial) Begin() {
+	configurePort(s.port)
+}
+
+// SetStatusLED has Serial show the frames it dispatches, and the faults it
+// finds in them, on led.
+func (s *Serial) SetStatusLED(led *status.LED) {
+	s.led = led
+}
+
+// Pending reports how far into a frame the parser is: 0 between frames, 1
+// to 4 once it has read the start byte, device address, sub address and
+// size. goppy lint uses it to find where the frames it checks begin.
+func (s *Serial) Pending() int {
+	return s.messagePos
+}
+
+// =============================================================================
+// MESSAGE READING STATE MACHINE
+// =============================================================================
+
+// ReadMessages reads and processes any available Moppy messages from serial.
+// This should be called repeatedly in the main loop.
+//
+// Moppy message format:
+//
+//	Byte 0: START_BYTE (0x4D)
+//	Byte 1: Device address (0x00 for system-wide)
+//	Byte 2: Sub address (drive number, ignored for system messages)
+//	Byte 3: Size of message body (bytes following this one)
+//	Byte 4: Command byte
+//	Byte 5+: Optional payload
+//
+// The state machine handles partial reads gracefully, allowing it to be
+// called from a non-blocking main loop.
+func (s *Serial) ReadMessages() {
+	for s.processNextByte() {
+		// Keep processing while there's data and we can make progress
+	}
+}
+
+// processNextByte handles the next byte in the message parsing state machine.
+// Returns true if processing should continue, false if we should wait for more data.
+func (s *Serial) processNextByte() bool {
+	// State 4 is special: we need to wait for the full payload
+	if s.messagePos == 4 {
+		payloadSize := int(s.messageBuffer[3])
+		if s.port.Buffered() < payloadSize {
+			return false // Wait for full payload
+		}
+		s.readPayloadAndDispatch()
+		return true
+	}
+
+	// For other states, we need at least one byte
+	if s.port.Buffered() == 0 {
+		return false
+	}
+
+	// Read single byte for state machine progression
+	b := s.nextByte[:]
+	_, err := s.port.Read(b)
+	if err != nil {
+		return false
+	}
+
+	switch s.messagePos {
+	case 0:
+		// State 0: Waiting for START_BYTE
+		if b[0] == config.StartByte {
+			s.messagePos = 1
+		} else {
+			s.Stats.SkippedBytes++
+		}
+		// Otherwise, keep scanning for start byte
+
+	case 1:
+		// State 1: Read device address
+		s.messageBuffer[1] = b[0]
+
+		if b[0] == config.SystemAddress {
+			// System messages are for everyone
+			s.messagePos = 2
+		} else if b[0] == config.DeviceAddress {
+			// Message is for us
+			s.messagePos = 2
+		} else {
+			// Not for us, reset
+			s.Stats.OtherDevice++
+			s.messagePos = 0
+		}
+
+	case 2:
+		// State 2: Read sub address (drive number)
+		s.messageBuffer[2] = b[0]
+
+		// Accept: 0x00 (all drives), valid drive range, or a zone alias
+		if protocol.SubAddressOK(b[0]) {
+			s.messagePos = 3
+		} else {
+			// Invalid sub address, reset
+			s.Stats.BadSubAddress++
+			s.noteFault(config.FaultBadSubAddress)
+			s.messagePos = 0
+		}
+
+	case 3:
+		// State 3: Read message body size
+		s.messageBuffer[3] = b[0]
+		s.messagePos = 4
+	}
+
+	return true
+}
+
+// readPayloadAndDispatch reads the command and payload, then dispatches to consumer.
+func (s *Serial) readPayloadAndDispatch() {
+	payloadSize := int(s.messageBuffer[3])
+
+	// A frame without even a command byte carries nothing to dispatch.
+	if payloadSize == 0 {
+		s.Stats.EmptyFrames++
+		s.noteFault(config.FaultEmptyFrame)
+		s.messagePos = 0
+		return
+	}
+
+	// Read command byte and payload into buffer starting at position 4
+	if payloadSize > 0 {
+		s.port.Read(s.messageBuffer[4 : 4+payloadSize])
+	}
+
+	// Dispatch based on message type. The LED hears of the frame first,
+	// so a fault the consumer finds in it shows over it.
+	s.Stats.Frames++
+	s.led.SetState(status.Receiving)
+	if s.messageBuffer[1] == config.SystemAddress {
+		// System message
+		command := s.messageBuffer[4]
+		if command == config.CmdPing {
+			s.sendPong()
+		} else if command == config.CmdGetConfig {
+			s.sendConfig()
+		} else if command == config.CmdGetPositions {
+			s.sendPositions()
+		} else if command == config.CmdGetStatus {
+			s.sendStatus()
+		} else {
+			switch command {
+			case config.CmdSequenceStart:
+				s.sequence = config.SequencePlaying
+			case config.CmdSequenceStop, config.CmdReset:
+				s.sequence = config.SequenceIdle
+			}
+			// Pass to consumer with payload (bytes after command)
+			var payload []byte
+			if payloadSize > 1 {
+				payload = s.messageBuffer[5 : 4+payloadSize]
+			}
+			s.consumer.HandleSystemMessage(command, payload)
+		}
+	} else {
+		// Device message
+		subAddress := s.messageBuffer[2]
+		command := s.messageBuffer[4]
+		// A note off to every drive mid-sequence is how the host pauses;
+		// the next note on plays on.
+		if command == config.DevCmdNoteOff && subAddress == 0x00 && s.sequence == config.SequencePlaying {
+			s.sequence = config.SequencePaused
+		} else if command == config.DevCmdNoteOn && s.sequence == config.SequencePaused {
+			s.sequence = config.SequencePlaying
+		}
+		var payload []byte
+		if payloadSize > 1 {
+			payload = s.messageBuffer[5 : 4+payloadSize]
+		}
+		s.consumer.HandleDeviceMessage(subAddress, command, payload)
+	}
+
+	// Reset for next message
+	s.messagePos = 0
+}
+
+// =============================================================================
+// PONG RESPONSE
+// =============================================================================
+
+// sendPong sends a pong response to a ping request.
+// This tells the controller what device address and drive range we handle.
+func (s *Serial) sendPong() {
+	s.port.Write(s.pongBytes[:s.pongLen])
+}
+
+// =============================================================================
+// CONFIG RESPONSE
+// =============================================================================
+
+// sendConfig answers CmdGetConfig with one CmdConfig message per drive,
+// then, for a RouteReporter, one CmdRoute message per route. Consumers
+// that don't implement ConfigReporter send no CmdConfig, as drives the
+// consumer reports nothing for don't.
+func (s *Serial) sendConfig() {
+	s.sendDriveConfig()
+	reporter, ok := s.consumer.(RouteReporter)
+	if !ok {
+		return
+	}
+	for n := byte(1); n != 0; n++ {
+		first, last, instrument, ok := reporter.Route(n)
+		if !ok {
+			return
+		}
+		payload := append(s.replyBuffer[protocol.HeaderSize+1:protocol.HeaderSize+1],
+			config.DeviceAddress, first, last, instrument)
+		m := protocol.Message{Device: config.SystemAddress, Sub: n, Command: config.CmdRoute, Payload: payload}
+		k, _ := m.Encode(s.replyBuffer[:])
+		s.port.Write(s.replyBuffer[:k])
+	}
+}
+
+// sendDriveConfig sends sendConfig's CmdConfig messages.
+func (s *Serial) sendDriveConfig() {
+	reporter, ok := s.consumer.(ConfigReporter)
+	if !ok || s.firstDrive == 0 {
+		return
+	}
+	for i := int(s.firstDrive); i <= int(s.lastDrive); i++ {
+		d := byte(i)
+		// Build the payload where Encode puts it, so it isn't copied.
+		payload := append(s.replyBuffer[protocol.HeaderSize+1:protocol.HeaderSize+1], config.DeviceAddress)
+		header := len(payload)
+		payload = reporter.DriveConfig(d, payload)
+		if len(payload) == header {
+			continue
+		}
+		m := protocol.Message{Device: config.SystemAddress, Sub: d, Command: config.CmdConfig, Payload: payload}
+		n, _ := m.Encode(s.replyBuffer[:])
+		s.port.Write(s.replyBuffer[:n])
+	}
+}
+
+// sendPositions answers CmdGetPositions with one CmdPosition message per
+// drive. Consumers that don't implement PositionReporter stay silent, as
+// do drives the consumer has no position for.
+func (s *Serial) sendPositions() {
+	reporter, ok := s.consumer.(PositionReporter)
+	if !ok || s.firstDrive == 0 {
+		return
+	}
+	for i := int(s.firstDrive); i <= int(s.lastDrive); i++ {
+		d := byte(i)
+		pos, ok := reporter.DrivePosition(d)
+		if !ok {
+			continue
+		}
+		payload := append(s.replyBuffer[protocol.HeaderSize+1:protocol.HeaderSize+1],
+			config.DeviceAddress,
+			byte(pos>>8),
+			byte(pos),
+		)
+		m := protocol.Message{Device: config.SystemAddress, Sub: d, Command: config.CmdPosition, Payload: payload}
+		n, _ := m.Encode(s.replyBuffer[:])
+		s.port.Write(s.replyBuffer[:n])
+	}
+}
+
+// =============================================================================
+// STATUS RESPONSE
+// =============================================================================
+
+// noteFault records fault as the last Serial found.
+func (s *Serial) noteFault(fault byte) {
+	s.fault = fault
+	s.led.SetState(status.Fault)
+	if s.status != nil {
+		_, _, _, s.consumerFaults = s.status.DeviceStatus()
+	}
+}
+
+// sendStatus answers CmdGetStatus with a CmdStatus message: the
+// consumer's uptime and drives sounding, none for a consumer that isn't a
+// StatusReporter, the sequence state, and the last fault, Serial's or the
+// consumer's, whichever came later.
+func (s *Serial) sendStatus() {
+	var (
+		uptime uint32
+		drives uint16
+	)
+	fault := s.fault
+	if s.status != nil {
+		var (
+			last   byte
+			faults uint16
+		)
+		uptime, drives, last, faults = s.status.DeviceStatus()
+		if fault == config.FaultNone || faults != s.consumerFaults {
+			fault = last
+		}
+	}
+	payload := append(s.replyBuffer[protocol.HeaderSize+1:protocol.HeaderSize+1],
+		config.DeviceAddress,
+		byte(uptime>>24), byte(uptime>>16), byte(uptime>>8), byte(uptime),
+		byte(bits.OnesCount16(drives)),
+		byte(drives>>8), byte(drives),
+		s.sequence,
+		fault,
+	)
+	m := protocol.Message{Device: config.SystemAddress, Command: config.CmdStatus, Payload: payload}
+	n, _ := m.Encode(s.replyBuffer[:])
+	s.port.Write(s.replyBuffer[:n])
+}
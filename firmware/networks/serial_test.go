@@ -0,0 +1,347 @@
+package networks_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/fakeclock"
+	"github.com/ystepanoff/goppy/firmware/networks"
+	"github.com/ystepanoff/goppy/firmware/networks/networkstest"
+	"github.com/ystepanoff/goppy/firmware/status"
+)
+
+// frame builds a Moppy frame: start byte, device and sub address, size,
+// command and payload.
+func frame(device, sub, command byte, payload ...byte) []byte {
+	f := []byte{config.StartByte, device, sub, byte(1 + len(payload)), command}
+	return append(f, payload...)
+}
+
+// concat joins frames into one stream.
+func concat(frames ...[]byte) []byte {
+	return bytes.Join(frames, nil)
+}
+
+// run feeds stream to a Serial in one go and returns what its consumer
+// received and what it wrote back.
+func run(stream []byte) ([]networkstest.Call, []byte) {
+	port := networkstest.NewMockPort()
+	rec := &networkstest.Recorder{}
+	s := networks.NewSerialPort(rec, port)
+	port.Feed(stream...)
+	s.ReadMessages()
+	return rec.Calls, port.Written
+}
+
+var (
+	noteOn    = frame(config.DeviceAddress, 1, config.DevCmdNoteOn, 60, 100)
+	noteOff   = frame(config.DeviceAddress, 1, config.DevCmdNoteOff, 60)
+	reset     = frame(config.SystemAddress, 0, config.CmdReset)
+	bend      = frame(config.DeviceAddress, 2, config.DevCmdBendPitch, 0x10, 0x00)
+	zoneOn    = frame(config.DeviceAddress, config.ZoneSubAddress, config.DevCmdNoteOn, 64)
+	allOff    = frame(config.DeviceAddress, 0, config.DevCmdNoteOff)
+	seqStart  = frame(config.SystemAddress, 0, config.CmdSequenceStart)
+	noteOnRec = networkstest.Call{SubAddress: 1, Command: config.DevCmdNoteOn, Payload: []byte{60, 100}}
+)
+
+func TestDispatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream []byte
+		want   []networkstest.Call
+	}{
+		{"note on", noteOn, []networkstest.Call{noteOnRec}},
+		{"note off", noteOff, []networkstest.Call{
+			{SubAddress: 1, Command: config.DevCmdNoteOff, Payload: []byte{60}},
+		}},
+		{"system reset", reset, []networkstest.Call{
+			{System: true, Command: config.CmdReset},
+		}},
+		{"pitch bend", bend, []networkstest.Call{
+			{SubAddress: 2, Command: config.DevCmdBendPitch, Payload: []byte{0x10, 0x00}},
+		}},
+		{"zone alias", zoneOn, []networkstest.Call{
+			{SubAddress: config.ZoneSubAddress, Command: config.DevCmdNoteOn, Payload: []byte{64}},
+		}},
+		{"every drive", allOff, []networkstest.Call{
+			{SubAddress: 0, Command: config.DevCmdNoteOff},
+		}},
+		{"back to back", concat(seqStart, noteOn, noteOff), []networkstest.Call{
+			{System: true, Command: config.CmdSequenceStart},
+			noteOnRec,
+			{SubAddress: 1, Command: config.DevCmdNoteOff, Payload: []byte{60}},
+		}},
+		{"noise before frame", concat([]byte{0x00, 0xFF, 0x12}, noteOn), []networkstest.Call{noteOnRec}},
+		{"sub address out of range", frame(config.DeviceAddress, config.MaxSubAddress+1, config.DevCmdNoteOn, 60), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := run(tt.stream)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("calls = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPingPong(t *testing.T) {
+	calls, written := run(frame(config.SystemAddress, 0, config.CmdPing))
+	if len(calls) != 0 {
+		t.Errorf("ping reached the consumer: %+v", calls)
+	}
+	want := []byte{
+		config.StartByte, config.SystemAddress, 0x00, 0x04,
+		config.CmdPong, config.DeviceAddress, config.MinSubAddress, config.MaxSubAddress,
+	} // a consumer taking only Moppy's commands answers as Moppy's firmware
+	if !bytes.Equal(written, want) {
+		t.Errorf("pong = % X, want % X", written, want)
+	}
+
+	// A consumer reporting its caps and its drives' config gets both
+	// advertised.
+	port := networkstest.NewMockPort()
+	s := networks.NewSerialPort(&capsConsumer{caps: config.CapVelocity | config.CapTremolo}, port)
+	port.Feed(frame(config.SystemAddress, 0, config.CmdPing)...)
+	s.ReadMessages()
+	caps := config.CapVelocity | config.CapTremolo | config.CapConfig
+	if w := port.Written; len(w) != 10 || uint16(w[8])<<8|uint16(w[9]) != caps {
+		t.Errorf("pong = % X, want caps %04X", w, caps)
+	}
+}
+
+// capsConsumer takes the optional commands caps names, and reports no
+// drive's config.
+type capsConsumer struct {
+	networkstest.Recorder
+	caps uint16
+}
+
+func (c *capsConsumer) Caps() uint16                          { return c.caps }
+func (c *capsConsumer) DriveConfig(_ byte, dst []byte) []byte { return dst }
+
+func TestStatus(t *testing.T) {
+	getStatus := frame(config.SystemAddress, 0, config.CmdGetStatus)
+	seqStop := frame(config.SystemAddress, 0, config.CmdSequenceStop)
+	tests := []struct {
+		name     string
+		consumer networks.MessageConsumer
+		stream   []byte
+		want     []byte // uptime, sounding, drives, sequence, fault
+	}{
+		{"idle", &networkstest.Recorder{}, nil, []byte{0, 0, 0, 0, 0, 0, 0, config.SequenceIdle, config.FaultNone}},
+		{"playing", &networkstest.Recorder{}, seqStart, []byte{0, 0, 0, 0, 0, 0, 0, config.SequencePlaying, config.FaultNone}},
+		{"paused", &networkstest.Recorder{}, concat(seqStart, noteOn, allOff), []byte{0, 0, 0, 0, 0, 0, 0, config.SequencePaused, config.FaultNone}},
+		{"played on", &networkstest.Recorder{}, concat(seqStart, allOff, noteOn), []byte{0, 0, 0, 0, 0, 0, 0, config.SequencePlaying, config.FaultNone}},
+		{"stopped", &networkstest.Recorder{}, concat(seqStart, allOff, seqStop), []byte{0, 0, 0, 0, 0, 0, 0, config.SequenceIdle, config.FaultNone}},
+		{"reset", &networkstest.Recorder{}, concat(seqStart, reset), []byte{0, 0, 0, 0, 0, 0, 0, config.SequenceIdle, config.FaultNone}},
+		{"note off to every drive while idle", &networkstest.Recorder{}, allOff, []byte{0, 0, 0, 0, 0, 0, 0, config.SequenceIdle, config.FaultNone}},
+		{"bad sub address", &networkstest.Recorder{}, frame(config.DeviceAddress, config.MaxSubAddress+1, config.DevCmdNoteOn, 60),
+			[]byte{0, 0, 0, 0, 0, 0, 0, config.SequenceIdle, config.FaultBadSubAddress}},
+		{"empty frame", &networkstest.Recorder{}, []byte{config.StartByte, config.DeviceAddress, 1, 0},
+			[]byte{0, 0, 0, 0, 0, 0, 0, config.SequenceIdle, config.FaultEmptyFrame}},
+		{"the consumer's", &statusConsumer{uptime: 0x01020304, drives: 0b1011, fault: config.FaultOverrun, faults: 1}, seqStart,
+			[]byte{1, 2, 3, 4, 3, 0, 0b1011, config.SequencePlaying, config.FaultOverrun}},
+		// Serial's fault came after the consumer's last, so it is the last.
+		{"Serial's after the consumer's", &statusConsumer{fault: config.FaultOverrun, faults: 1}, []byte{config.StartByte, config.DeviceAddress, 1, 0},
+			[]byte{0, 0, 0, 0, 0, 0, 0, config.SequenceIdle, config.FaultEmptyFrame}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := networkstest.NewMockPort()
+			s := networks.NewSerialPort(tt.consumer, port)
+			port.Feed(concat(tt.stream, getStatus)...)
+			s.ReadMessages()
+			want := append([]byte{config.StartByte, config.SystemAddress, 0x00, 0x0B, config.CmdStatus, config.DeviceAddress}, tt.want...)
+			if !bytes.Equal(port.Written, want) {
+				t.Errorf("status = % X, want % X", port.Written, want)
+			}
+		})
+	}
+
+	// A fault the consumer ran into after Serial's is the last.
+	c := &statusConsumer{}
+	port := networkstest.NewMockPort()
+	s := networks.NewSerialPort(c, port)
+	port.Feed(config.StartByte, config.DeviceAddress, 1, 0)
+	s.ReadMessages()
+	c.fault, c.faults = config.FaultUnknownCommand, 1
+	port.Feed(getStatus...)
+	s.ReadMessages()
+	if w := port.Written; len(w) != 15 || w[14] != config.FaultUnknownCommand {
+		t.Errorf("status = % X, want the consumer's fault %02X", w, config.FaultUnknownCommand)
+	}
+
+	// A consumer reporting its status gets it advertised.
+	port = networkstest.NewMockPort()
+	s = networks.NewSerialPort(c, port)
+	port.Feed(frame(config.SystemAddress, 0, config.CmdPing)...)
+	s.ReadMessages()
+	if w := port.Written; len(w) != 10 || uint16(w[8])<<8|uint16(w[9]) != config.CapStatus {
+		t.Errorf("pong = % X, want caps %04X", w, config.CapStatus)
+	}
+}
+
+// statusConsumer reports its fields as its status.
+type statusConsumer struct {
+	networkstest.Recorder
+	uptime uint32
+	drives uint16
+	fault  byte
+	faults uint16
+}
+
+func (c *statusConsumer) DeviceStatus() (uint32, uint16, byte, uint16) {
+	return c.uptime, c.drives, c.fault, c.faults
+}
+
+// TestStatusLED flickers the status LED as frames come in, and blinks it
+// fast for a bad one.
+func TestStatusLED(t *testing.T) {
+	clock := fakeclock.New()
+	led := status.New(200, status.DefaultPatterns)
+	clock.Start(config.TimerResolution, led.Tick)
+	led.SetState(status.Idle)
+	port := networkstest.NewMockPort()
+	s := networks.NewSerialPort(&networkstest.Recorder{}, port)
+	s.SetStatusLED(led)
+
+	steps := []struct {
+		stream []byte
+		want   status.State
+	}{
+		{nil, status.Idle},
+		{noteOn, status.Receiving},
+		{frame(config.DeviceAddress, config.MaxSubAddress+1, config.DevCmdNoteOn, 60), status.Fault},
+		{noteOn, status.Fault},
+	}
+	for i, step := range steps {
+		port.Feed(step.stream...)
+		s.ReadMessages()
+		clock.AdvanceMs(1)
+		if got := led.State(); got != step.want {
+			t.Errorf("step %d: state %d, want %d", i, got, step.want)
+		}
+	}
+}
+
+// TestConfigRoutes answers a config query with each drive's config, then
+// the consumer's routes.
+func TestConfigRoutes(t *testing.T) {
+	port := networkstest.NewMockPort()
+	s := networks.NewSerialPort(&routeConsumer{}, port)
+	port.Feed(frame(config.SystemAddress, 0, config.CmdGetConfig)...)
+	s.ReadMessages()
+	want := concat(
+		frame(config.SystemAddress, 1, config.CmdConfig, config.DeviceAddress, 1),
+		frame(config.SystemAddress, 2, config.CmdConfig, config.DeviceAddress, 2),
+		frame(config.SystemAddress, 3, config.CmdConfig, config.DeviceAddress, 3),
+		frame(config.SystemAddress, 1, config.CmdRoute, config.DeviceAddress, 1, 2, config.InstrumentFloppy),
+		frame(config.SystemAddress, 2, config.CmdRoute, config.DeviceAddress, 3, 3, config.InstrumentHDD),
+	)
+	if !bytes.Equal(port.Written, want) {
+		t.Errorf("config = % X\nwant     % X", port.Written, want)
+	}
+}
+
+// routeConsumer hands drives 1-2 to floppies and 3 to an HDD, and reports
+// each drive's number as its config.
+type routeConsumer struct {
+	networkstest.Recorder
+}
+
+func (c *routeConsumer) DriveRange() (first, last byte) { return 1, 3 }
+
+func (c *routeConsumer) DriveConfig(driveNum byte, dst []byte) []byte {
+	return append(dst, driveNum)
+}
+
+func (c *routeConsumer) Route(n byte) (first, last, instrument byte, ok bool) {
+	switch n {
+	case 1:
+		return 1, 2, config.InstrumentFloppy, true
+	case 2:
+		return 3, 3, config.InstrumentHDD, true
+	}
+	return 0, 0, 0, false
+}
+
+func TestForeignAddress(t *testing.T) {
+	other := config.DeviceAddress + 1
+	tests := []struct {
+		name   string
+		stream []byte
+		want   []networkstest.Call
+	}{
+		{"skipped", frame(other, 1, config.DevCmdNoteOn, 60), nil},
+		{"then ours", concat(frame(other, 1, config.DevCmdNoteOn, 60), noteOn), []networkstest.Call{noteOnRec}},
+		{"ours then foreign", concat(noteOn, frame(other, 3, config.DevCmdNoteOff, 62)), []networkstest.Call{noteOnRec}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, written := run(tt.stream)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("calls = %+v, want %+v", got, tt.want)
+			}
+			if len(written) != 0 {
+				t.Errorf("wrote % X for a foreign frame", written)
+			}
+		})
+	}
+}
+
+func TestFragmentedDelivery(t *testing.T) {
+	stream := concat(seqStart, noteOn, bend, noteOff, reset)
+	want, _ := run(stream)
+	if len(want) != 5 {
+		t.Fatalf("whole stream gave %d calls, want 5", len(want))
+	}
+
+	// Every split into two chunks, then one byte at a time.
+	var splits [][][]byte
+	for i := 1; i < len(stream); i++ {
+		splits = append(splits, [][]byte{stream[:i], stream[i:]})
+	}
+	var bytewise [][]byte
+	for i := range stream {
+		bytewise = append(bytewise, stream[i:i+1])
+	}
+	splits = append(splits, bytewise)
+
+	for _, chunks := range splits {
+		port := networkstest.NewMockPort(chunks...)
+		rec := &networkstest.Recorder{}
+		s := networks.NewSerialPort(rec, port)
+		for port.Deliver() {
+			s.ReadMessages()
+		}
+		if !reflect.DeepEqual(rec.Calls, want) {
+			t.Errorf("split after %d bytes: calls = %+v, want %+v", len(chunks[0]), rec.Calls, want)
+		}
+	}
+}
+
+func TestZeroPayload(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream []byte
+		want   []networkstest.Call
+	}{
+		{"system command only", frame(config.SystemAddress, 0, config.CmdSequenceStop), []networkstest.Call{
+			{System: true, Command: config.CmdSequenceStop},
+		}},
+		{"device command only", frame(config.DeviceAddress, 3, config.DevCmdReset), []networkstest.Call{
+			{SubAddress: 3, Command: config.DevCmdReset},
+		}},
+		{"size zero dropped", concat([]byte{config.StartByte, config.DeviceAddress, 1, 0}, noteOn), []networkstest.Call{noteOnRec}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := run(tt.stream)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("calls = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package notes
+
+import (
+	"testing"
+
+	"github.com/ystepanoff/goppy/firmware/benchtest"
+)
+
+// sink keeps the compiler from dropping the benchmarked calls.
+var sink uint16
+
+func BenchmarkBendTicks(b *testing.B) {
+	deflection := int16(-8192)
+	b.ReportAllocs()
+	for b.Loop() {
+		sink = BendTicks(NoteDoubleTicks[60], deflection, 12)
+		deflection += 97
+	}
+	benchtest.ReportAVR(b, benchtest.TickBudget)
+}
+
+func TestBendTicksAllocs(t *testing.T) {
+	deflection := int16(-8192)
+	allocs := testing.AllocsPerRun(1000, func() {
+		sink = BendTicks(NoteDoubleTicks[60], deflection, 12)
+		deflection += 97
+	})
+	if allocs != 0 {
+		t.Errorf("BendTicks: %v allocs, want 0", allocs)
+	}
+}
@@ -0,0 +1,17 @@
+package notes
+
+// pitchNames are the pitch class names, sharps for the black keys.
+var pitchNames = [12]string{"C", "C#", "D", "D#", "E", "F", "F#", "G", "G#", "A", "A#", "B"}
+
+// Name appends a MIDI note's name to dst in scientific pitch notation,
+// with middle C (note 60) as C4: note 0 is "C-1", note 61 "C#4". It
+// appends rather than returning a string so display code needn't allocate.
+func Name(dst []byte, note byte) []byte {
+	note &= 0x7F
+	dst = append(dst, pitchNames[note%12]...)
+	octave := int(note/12) - 1
+	if octave < 0 {
+		return append(dst, '-', byte('0'-octave))
+	}
+	return append(dst, byte('0'+octave))
+}
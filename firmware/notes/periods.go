@@ -61,6 +61,118 @@ var NoteDoubleTicks = [128]uint16{
 	3, 3, 3, 3, 2, 2, 2, 2,
 }
 
+// TicksPerMs is the number of timer ticks in one millisecond.
+const TicksPerMs = 1000 / config.TimerResolution
+
+// Gliss returns how many timer ticks each semitone lasts when sliding
+// chromatically from start to end over durationMs. Never returns 0.
+func Gliss(start, end byte, durationMs uint16) uint32 {
+	steps := uint32(end) - uint32(start)
+	if end < start {
+		steps = uint32(start) - uint32(end)
+	}
+	if steps == 0 {
+		steps = 1
+	}
+	perStep := uint32(durationMs) * TicksPerMs / steps
+	if perStep == 0 {
+		perStep = 1
+	}
+	return perStep
+}
+
+// Glide linearly interpolates between two tick values, pos/span of the
+// way from `from` to `to`. Used for smooth (non-chromatic) glissandi.
+func Glide(from, to uint16, pos, span uint32) uint16 {
+	if span == 0 || pos >= span {
+		return to
+	}
+	if to >= from {
+		return from + uint16(uint32(to-from)*pos/span)
+	}
+	return from - uint16(uint32(from-to)*pos/span)
+}
+
+// SemitoneRatioQ16 returns the frequency ratio 2^(cents/1200) as a Q16.16
+// fixed-point value (65536 = unison). Valid for |cents| <= 9600.
+//
+// Whole octaves are split off as shifts, leaving |x| <= ln2/2 for a
+// 6-term Taylor series of e^x - libm's exp() can't be linked on AVR.
+// Error is below 0.01% within two octaves; further down, the Q16
+// resolution of the shifted result dominates.
+func SemitoneRatioQ16(cents int16) uint32 {
+	const ln2 = 0.6931471805599453
+	octaves := 0
+	for cents > 600 {
+		cents -= 1200
+		octaves++
+	}
+	for cents < -600 {
+		cents += 1200
+		octaves--
+	}
+	x := float32(cents) * (ln2 / 1200)
+	r := 1 + x*(1+x*(0.5+x*(1.0/6.0+x*(1.0/24.0+x*(1.0/120.0)))))
+	q := uint32(r*65536 + 0.5)
+	if octaves >= 0 {
+		return q << octaves
+	}
+	return q >> -octaves
+}
+
+// ScalePeriod multiplies a tick value by a Q16.16 factor, rounding to
+// nearest and never returning 0. Integer-only, so it is safe in the tick
+// interrupt; ticks * factor must fit in 32 bits.
+func ScalePeriod(ticks uint16, factorQ16 uint32) uint16 {
+	v := (uint32(ticks)*factorQ16 + 0x8000) >> 16
+	if v == 0 {
+		return 1
+	}
+	if v > 0xFFFF {
+		return 0xFFFF
+	}
+	return uint16(v)
+}
+
+// BendTicks returns ticks bent by a signed pitch bend deflection
+// (-8192..8191), where full deflection reaches rangeSemitones. Bending up
+// shortens the period.
+func BendTicks(ticks uint16, deflection int16, rangeSemitones byte) uint16 {
+	if deflection == 0 {
+		return ticks
+	}
+	cents := int32(deflection) * int32(rangeSemitones) * 100 / 8192
+	return ScalePeriod(ticks, SemitoneRatioQ16(int16(-cents)))
+}
+
+// Vibrato returns ticks modulated by a triangle wave pos/cycle of the way
+// through one vibrato cycle. depthQ16 is the peak change as a Q16.16
+// fraction of ticks (SemitoneRatioQ16(cents) - 65536). Integer-only, so it
+// is safe in the tick interrupt.
+func Vibrato(ticks uint16, depthQ16 uint32, pos, cycle uint16) uint16 {
+	if cycle == 0 {
+		return ticks
+	}
+	swing := int32((uint32(ticks) * depthQ16) >> 16)
+	x := swing * 4 * int32(pos) / int32(cycle)
+	switch {
+	case x < swing:
+		// Rising from 0 to +swing.
+	case x < 3*swing:
+		x = 2*swing - x
+	default:
+		x -= 4 * swing
+	}
+	v := int32(ticks) + x
+	if v < 1 {
+		return 1
+	}
+	if v > 0xFFFF {
+		return 0xFFFF
+	}
+	return uint16(v)
+}
+
 // Compile-time assertion that TimerResolution is used correctly.
 // This ensures the tables stay in sync with config if it ever changes.
 var _ = config.TimerResolution
@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// A baked file, .gopb by name, holds a song ready to stream verbatim to
+// the devices, mapped, arranged and thinned already, for a player with no
+// host attached:
+//
+//	header: "GOPB" [VERSION] [TICK RATE: uint32, little-endian] [CAPS: uint16, little-endian]
+//	entry:  [DELTA: uvarint] [LENGTH: uvarint] [FRAME...]
+//
+// DELTA is in ticks, TICK RATE of them a second, since the entry before,
+// or since the song started for the first; LENGTH is the frame's, one
+// message. CAPS are the optional commands, config's Cap bits, the frames
+// use: a device must take them all to play the file as baked.
+
+// BakedMagic starts every baked file.
+const BakedMagic = "GOPB"
+
+// BakedVersion is the version of the format this package writes and
+// reads.
+const BakedVersion = 1
+
+// BakedHeaderSize is the length of a baked file's header.
+const BakedHeaderSize = len(BakedMagic) + 7
+
+// BakedTickRate is the tick rate a baked file is written at if its header
+// doesn't say: milliseconds.
+const BakedTickRate = 1000
+
+var (
+	// ErrNotBaked is returned for a header without BakedMagic.
+	ErrNotBaked = errors.New("protocol: not a baked file")
+	// ErrBakedVersion is returned for a baked file of a version this
+	// package doesn't read.
+	ErrBakedVersion = errors.New("protocol: unknown baked file version")
+	// ErrBakedTickRate is returned for a baked file with no tick rate.
+	ErrBakedTickRate = errors.New("protocol: baked file has no tick rate")
+)
+
+// BakedHeader is what a baked file's header says.
+type BakedHeader struct {
+	Version  byte
+	TickRate uint32 // ticks a second
+	Caps     uint16 // config's Cap bits, of the commands the frames use
+}
+
+// AppendBakedHeader appends h to dst, with BakedVersion if h.Version is 0
+// and BakedTickRate if h.TickRate is.
+func AppendBakedHeader(dst []byte, h BakedHeader) []byte {
+	if h.Version == 0 {
+		h.Version = BakedVersion
+	}
+	if h.TickRate == 0 {
+		h.TickRate = BakedTickRate
+	}
+	dst = append(dst, BakedMagic...)
+	dst = append(dst, h.Version)
+	dst = binary.LittleEndian.AppendUint32(dst, h.TickRate)
+	return binary.LittleEndian.AppendUint16(dst, h.Caps)
+}
+
+// DecodeBakedHeader reads the header at the start of src and returns it
+// with its length. It returns ErrIncomplete if src is shorter than a
+// header.
+func DecodeBakedHeader(src []byte) (BakedHeader, int, error) {
+	if len(src) < BakedHeaderSize {
+		return BakedHeader{}, 0, ErrIncomplete
+	}
+	if string(src[:len(BakedMagic)]) != BakedMagic {
+		return BakedHeader{}, 0, ErrNotBaked
+	}
+	src = src[len(BakedMagic):]
+	h := BakedHeader{
+		Version:  src[0],
+		TickRate: binary.LittleEndian.Uint32(src[1:]),
+		Caps:     binary.LittleEndian.Uint16(src[5:]),
+	}
+	switch {
+	case h.Version != BakedVersion:
+		return h, BakedHeaderSize, ErrBakedVersion
+	case h.TickRate == 0:
+		return h, BakedHeaderSize, ErrBakedTickRate
+	}
+	return h, BakedHeaderSize, nil
+}
+
+// AppendBakedEntry appends an entry for frame, ticks after the entry
+// before, to dst.
+func AppendBakedEntry(dst []byte, ticks uint64, frame []byte) []byte {
+	dst = binary.AppendUvarint(dst, ticks)
+	dst = binary.AppendUvarint(dst, uint64(len(frame)))
+	return append(dst, frame...)
+}
+
+// DecodeBakedEntry reads the entry at the start of src and returns its
+// delta in ticks and its frame, with its length. The frame shares memory
+// with src. It returns ErrIncomplete if src ends inside the entry, and
+// ErrCaptureEntry, as a capture's entry would, if its varints overflow.
+func DecodeBakedEntry(src []byte) (uint64, []byte, int, error) {
+	ticks, n := binary.Uvarint(src)
+	if n < 0 {
+		return 0, nil, 0, ErrCaptureEntry
+	}
+	if n == 0 {
+		return 0, nil, 0, ErrIncomplete
+	}
+	size, m := binary.Uvarint(src[n:])
+	if m < 0 {
+		return 0, nil, 0, ErrCaptureEntry
+	}
+	if m == 0 || uint64(len(src)-n-m) < size {
+		return 0, nil, 0, ErrIncomplete
+	}
+	end := n + m + int(size)
+	return ticks, src[n+m : end], end, nil
+}
@@ -0,0 +1,111 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// A capture file, .gop by name, records the frames a host sent, and when,
+// to be replayed later without whatever made them:
+//
+//	header: "GOPC" [VERSION] [TRANSPORT] [BAUD: uint32, little-endian]
+//	entry:  [DELTA: uvarint] [LENGTH: uvarint] [FRAME...]
+//
+// DELTA is in microseconds since the entry before, or since the capture
+// started for the first; LENGTH is the frame's, usually one message but
+// whatever was written to the port at once. TRANSPORT and BAUD say what
+// the frames went over, as a hint to whatever replays them.
+
+// CaptureMagic starts every capture file.
+const CaptureMagic = "GOPC"
+
+// CaptureVersion is the version of the format this package writes and
+// reads.
+const CaptureVersion = 1
+
+// CaptureHeaderSize is the length of a capture's header.
+const CaptureHeaderSize = len(CaptureMagic) + 6
+
+// Capture transports.
+const (
+	CaptureUnknown byte = iota
+	CaptureSerial
+	CaptureUDP
+)
+
+var (
+	// ErrNotCapture is returned for a header without CaptureMagic.
+	ErrNotCapture = errors.New("protocol: not a capture")
+	// ErrCaptureVersion is returned for a capture of a version this
+	// package doesn't read.
+	ErrCaptureVersion = errors.New("protocol: unknown capture version")
+	// ErrCaptureEntry is returned for an entry whose varints overflow.
+	ErrCaptureEntry = errors.New("protocol: bad capture entry")
+)
+
+// CaptureHeader is what a capture's header says.
+type CaptureHeader struct {
+	Version   byte
+	Transport byte   // CaptureSerial, CaptureUDP, or CaptureUnknown
+	Baud      uint32 // the serial port's, or 0
+}
+
+// AppendCaptureHeader appends h to dst, with CaptureVersion if h.Version
+// is 0.
+func AppendCaptureHeader(dst []byte, h CaptureHeader) []byte {
+	if h.Version == 0 {
+		h.Version = CaptureVersion
+	}
+	dst = append(dst, CaptureMagic...)
+	dst = append(dst, h.Version, h.Transport)
+	return binary.LittleEndian.AppendUint32(dst, h.Baud)
+}
+
+// DecodeCaptureHeader reads the header at the start of src and returns it
+// with its length. It returns ErrIncomplete if src is shorter than a
+// header.
+func DecodeCaptureHeader(src []byte) (CaptureHeader, int, error) {
+	if len(src) < CaptureHeaderSize {
+		return CaptureHeader{}, 0, ErrIncomplete
+	}
+	if string(src[:len(CaptureMagic)]) != CaptureMagic {
+		return CaptureHeader{}, 0, ErrNotCapture
+	}
+	src = src[len(CaptureMagic):]
+	h := CaptureHeader{Version: src[0], Transport: src[1], Baud: binary.LittleEndian.Uint32(src[2:])}
+	if h.Version != CaptureVersion {
+		return h, CaptureHeaderSize, ErrCaptureVersion
+	}
+	return h, CaptureHeaderSize, nil
+}
+
+// AppendCaptureEntry appends an entry for frame, sent delta after the
+// entry before, to the microsecond, to dst.
+func AppendCaptureEntry(dst []byte, delta time.Duration, frame []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(max(delta, 0).Round(time.Microsecond)/time.Microsecond))
+	dst = binary.AppendUvarint(dst, uint64(len(frame)))
+	return append(dst, frame...)
+}
+
+// DecodeCaptureEntry reads the entry at the start of src and returns its
+// delta and frame, with its length. The frame shares memory with src. It
+// returns ErrIncomplete if src ends inside the entry.
+func DecodeCaptureEntry(src []byte) (time.Duration, []byte, int, error) {
+	us, n := binary.Uvarint(src)
+	if n < 0 || us > uint64(1<<63-1)/uint64(time.Microsecond) {
+		return 0, nil, 0, ErrCaptureEntry
+	}
+	if n == 0 {
+		return 0, nil, 0, ErrIncomplete
+	}
+	size, m := binary.Uvarint(src[n:])
+	if m < 0 {
+		return 0, nil, 0, ErrCaptureEntry
+	}
+	if m == 0 || uint64(len(src)-n-m) < size {
+		return 0, nil, 0, ErrIncomplete
+	}
+	end := n + m + int(size)
+	return time.Duration(us) * time.Microsecond, src[n+m : end], end, nil
+}
@@ -0,0 +1,311 @@
+// Package protocol is the Moppy v2 wire format, shared by the firmware and
+// the host tooling so that there is one encoder in the codebase:
+//
+//	[START=0x4D] [DEVICE] [SUB] [SIZE] [COMMAND] [PAYLOAD...]
+//
+// SIZE counts the bytes after it, the command and its payload. The
+// constants are in package config; this package only frames them. It
+// imports nothing from machine and allocates only in the helpers, so the
+// firmware can encode its replies with it.
+package protocol
+
+import (
+	"errors"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+)
+
+// HeaderSize is the number of bytes before the command: start byte,
+// device address, sub address and size.
+const HeaderSize = 4
+
+// MaxPayload is the longest payload a message can carry: SIZE is a byte
+// and counts the command too.
+const MaxPayload = 254
+
+var (
+	// ErrShortBuffer is returned by Encode when dst can't hold the message.
+	ErrShortBuffer = errors.New("protocol: buffer too short for message")
+	// ErrPayloadTooLong is returned for a payload over MaxPayload bytes.
+	ErrPayloadTooLong = errors.New("protocol: payload too long")
+	// ErrNoStartByte is returned by Decode when src doesn't start a frame.
+	ErrNoStartByte = errors.New("protocol: no start byte")
+	// ErrIncomplete is returned by Decode when src ends inside a frame.
+	ErrIncomplete = errors.New("protocol: incomplete frame")
+	// ErrEmptyFrame is returned by Decode for a frame of size 0, which has
+	// no command.
+	ErrEmptyFrame = errors.New("protocol: frame without a command")
+	// ErrReservedSubAddress is returned for a device message to a sub
+	// address no drive or zone answers at.
+	ErrReservedSubAddress = errors.New("protocol: reserved sub address")
+)
+
+// Message is one frame: a command for a device's sub address, or for
+// every device when Device is config.SystemAddress.
+type Message struct {
+	Device  byte
+	Sub     byte
+	Command byte
+	Payload []byte
+}
+
+// Len returns the length of m encoded.
+func (m Message) Len() int {
+	return HeaderSize + 1 + len(m.Payload)
+}
+
+// Validate reports whether m is a message the firmware would act on: its
+// size fits the size byte, and a device message goes to sub address 0,
+// a drive or a zone alias (see SubAddressOK). System messages carry the
+// drive in their sub address in replies, so any goes there.
+func (m Message) Validate() error {
+	if len(m.Payload) > MaxPayload {
+		return ErrPayloadTooLong
+	}
+	if m.Device != config.SystemAddress && !SubAddressOK(m.Sub) {
+		return ErrReservedSubAddress
+	}
+	return nil
+}
+
+// SubAddressOK reports whether a device built with this config answers at
+// sub address sub: 0 for all drives, one of its drives, or a zone alias.
+func SubAddressOK(sub byte) bool {
+	return sub == 0x00 || (sub >= config.MinSubAddress && sub <= config.MaxSubAddress) ||
+		(sub >= config.ZoneSubAddress && sub < config.ZoneSubAddress+config.MaxZones)
+}
+
+// Encode writes m to the start of dst and returns how many bytes it wrote.
+// It checks the payload fits the size byte, but not the addresses: the
+// host may address devices built with another config. The payload may
+// already sit where it goes, at dst[HeaderSize+1:], as when it was built
+// there.
+func (m Message) Encode(dst []byte) (int, error) {
+	if len(m.Payload) > MaxPayload {
+		return 0, ErrPayloadTooLong
+	}
+	n := m.Len()
+	if len(dst) < n {
+		return 0, ErrShortBuffer
+	}
+	copy(dst[HeaderSize+1:], m.Payload)
+	dst[0] = config.StartByte
+	dst[1] = m.Device
+	dst[2] = m.Sub
+	dst[3] = byte(1 + len(m.Payload))
+	dst[4] = m.Command
+	return n, nil
+}
+
+// Decode reads the message at the start of src and returns it with the
+// number of bytes it took. The payload shares memory with src.
+//
+// On error the count says how much of src to skip before trying again: 1
+// for ErrNoStartByte, 0 for ErrIncomplete (wait for more), the header for
+// ErrEmptyFrame, and the whole frame for ErrReservedSubAddress.
+func Decode(src []byte) (Message, int, error) {
+	if len(src) == 0 {
+		return Message{}, 0, ErrIncomplete
+	}
+	if src[0] != config.StartByte {
+		return Message{}, 1, ErrNoStartByte
+	}
+	if len(src) < HeaderSize {
+		return Message{}, 0, ErrIncomplete
+	}
+	size := int(src[3])
+	if size == 0 {
+		return Message{}, HeaderSize, ErrEmptyFrame
+	}
+	n := HeaderSize + size
+	if len(src) < n {
+		return Message{}, 0, ErrIncomplete
+	}
+	m := Message{Device: src[1], Sub: src[2], Command: src[4]}
+	if size > 1 {
+		m.Payload = src[HeaderSize+1 : n]
+	}
+	if err := m.Validate(); err != nil {
+		return Message{}, n, err
+	}
+	return m, n, nil
+}
+
+// System messages -----------------------------------------------------------
+
+func system(command byte, payload ...byte) Message {
+	return Message{Device: config.SystemAddress, Command: command, Payload: payload}
+}
+
+// Ping asks every device to answer with a Pong.
+func Ping() Message { return system(config.CmdPing) }
+
+// Pong is a device's answer to a Ping: its address and drive range, as
+// Moppy's firmware answers.
+func Pong(device, first, last byte) Message { return system(config.CmdPong, device, first, last) }
+
+// PongCaps is Pong extended with caps, the Cap bits of the commands the
+// device takes, as goppy firmware answers.
+func PongCaps(device, first, last byte, caps uint16) Message {
+	return system(config.CmdPong, device, first, last, byte(caps>>8), byte(caps))
+}
+
+// GetConfig asks every device for one Config message per drive.
+func GetConfig() Message { return system(config.CmdGetConfig) }
+
+// Config is a device's report of one drive's settings, settings being
+// what FloppyDrives.DriveConfig appends.
+func Config(device, drive byte, settings []byte) Message {
+	m := system(config.CmdConfig, append([]byte{device}, settings...)...)
+	m.Sub = drive
+	return m
+}
+
+// Route is a device's report of its nth route, from 1: sub addresses
+// first..last, handed to a config.Instrument.
+func Route(device, n, first, last, instrument byte) Message {
+	m := system(config.CmdRoute, device, first, last, instrument)
+	m.Sub = n
+	return m
+}
+
+// GetPositions asks every device for one Position message per drive.
+func GetPositions() Message { return system(config.CmdGetPositions) }
+
+// Position is a device's report of where one drive's head is.
+func Position(device, drive byte, steps uint16) Message {
+	m := system(config.CmdPosition, device, byte(steps>>8), byte(steps))
+	m.Sub = drive
+	return m
+}
+
+// GetStatus asks every device for a Status message.
+func GetStatus() Message { return system(config.CmdGetStatus) }
+
+// Status is a device's report of how it is: the seconds it has been up,
+// how many drives are sounding and which, bit 0 for drive 1, its
+// config.Sequence state and its last config.Fault.
+func Status(device byte, uptime uint32, sounding byte, drives uint16, state, fault byte) Message {
+	return system(config.CmdStatus, device, byte(uptime>>24), byte(uptime>>16), byte(uptime>>8), byte(uptime),
+		sounding, byte(drives>>8), byte(drives), state, fault)
+}
+
+// SequenceStart, SequenceStop and Reset frame a song and clear up after
+// one.
+func SequenceStart() Message { return system(config.CmdSequenceStart) }
+func SequenceStop() Message  { return system(config.CmdSequenceStop) }
+func Reset() Message         { return system(config.CmdReset) }
+
+// Device messages -----------------------------------------------------------
+
+func flag(on bool) byte {
+	if on {
+		return 1
+	}
+	return 0
+}
+
+// DriveReset re-homes a drive, or every drive at sub address 0.
+func DriveReset(device, sub byte) Message {
+	return Message{Device: device, Sub: sub, Command: config.DevCmdReset}
+}
+
+// NoteOn starts note on a drive without a velocity, so never accented.
+func NoteOn(device, sub, note byte) Message {
+	return Message{Device: device, Sub: sub, Command: config.DevCmdNoteOn, Payload: []byte{note}}
+}
+
+// NoteOnVelocity starts note on a drive at velocity.
+func NoteOnVelocity(device, sub, note, velocity byte) Message {
+	return Message{Device: device, Sub: sub, Command: config.DevCmdNoteOn, Payload: []byte{note, velocity}}
+}
+
+// NoteOff stops note on a drive, if it is the one sounding.
+func NoteOff(device, sub, note byte) Message {
+	return Message{Device: device, Sub: sub, Command: config.DevCmdNoteOff, Payload: []byte{note}}
+}
+
+// AllNotesOff silences every drive on a device without re-homing.
+func AllNotesOff(device byte) Message {
+	return Message{Device: device, Command: config.DevCmdNoteOff}
+}
+
+// PitchBend bends a drive's note by deflection, -8192..8191.
+func PitchBend(device, sub byte, deflection int16) Message {
+	d := uint16(deflection)
+	return Message{Device: device, Sub: sub, Command: config.DevCmdBendPitch, Payload: []byte{byte(d >> 8), byte(d)}}
+}
+
+// Gliss slides a drive from start to end over ms milliseconds; flags is 0
+// or config.GlissFlagSmooth.
+func Gliss(device, sub, start, end byte, ms uint16, flags byte) Message {
+	return Message{Device: device, Sub: sub, Command: config.DevCmdGliss,
+		Payload: []byte{start, end, byte(ms >> 8), byte(ms), flags}}
+}
+
+// Transpose sets a drive's transpose in semitones.
+func Transpose(device, sub byte, semitones int8) Message {
+	return Message{Device: device, Sub: sub, Command: config.DevCmdTranspose, Payload: []byte{byte(semitones)}}
+}
+
+// SetZone makes zone an alias for drives first..last in mode; first 0
+// clears it.
+func SetZone(device, zone, first, last, mode byte) Message {
+	return Message{Device: device, Command: config.DevCmdSetZone, Payload: []byte{zone, first, last, mode}}
+}
+
+// Detune sets a drive's fine tuning in cents.
+func Detune(device, sub byte, cents int8) Message {
+	return Message{Device: device, Sub: sub, Command: config.DevCmdDetune, Payload: []byte{byte(cents)}}
+}
+
+// BendRange sets how many semitones a full bend reaches on a drive.
+func BendRange(device, sub, semitones byte) Message {
+	return Message{Device: device, Sub: sub, Command: config.DevCmdBendRange, Payload: []byte{semitones}}
+}
+
+// Tremolo gates a drive at rateHz for dutyPercent of each cycle.
+func Tremolo(device, sub, rateHz, dutyPercent byte) Message {
+	return Message{Device: device, Sub: sub, Command: config.DevCmdTremolo, Payload: []byte{rateHz, dutyPercent}}
+}
+
+// ChannelPressure applies aftertouch to a drive as vibrato.
+func ChannelPressure(device, sub, pressure byte) Message {
+	return Message{Device: device, Sub: sub, Command: config.DevCmdChannelPressure, Payload: []byte{pressure}}
+}
+
+// Trill alternates a drive between noteA and noteB every rateMs.
+func Trill(device, sub, noteA, noteB, rateMs byte) Message {
+	return Message{Device: device, Sub: sub, Command: config.DevCmdTrill, Payload: []byte{noteA, noteB, rateMs}}
+}
+
+// FactoryReset forgets a drive's saved settings.
+func FactoryReset(device, sub byte) Message {
+	return Message{Device: device, Sub: sub, Command: config.DevCmdFactoryReset}
+}
+
+// SetTravel sets a drive's travel window in head positions.
+func SetTravel(device, sub, min, max byte) Message {
+	return Message{Device: device, Sub: sub, Command: config.DevCmdSetTravel, Payload: []byte{min, max}}
+}
+
+// SetTravelSteps sets a scanner carriage's travel window in steps.
+func SetTravelSteps(device, sub byte, min, max uint16) Message {
+	return Message{Device: device, Sub: sub, Command: config.DevCmdSetTravel,
+		Payload: []byte{byte(min >> 8), byte(min), byte(max >> 8), byte(max)}}
+}
+
+// Sustain presses or lifts the sustain pedal on a drive.
+func Sustain(device, sub byte, on bool) Message {
+	return Message{Device: device, Sub: sub, Command: config.DevCmdSustain, Payload: []byte{flag(on)}}
+}
+
+// SetMovement clamps a drive's head to a wiggle, or restores full travel.
+func SetMovement(device, sub byte, clamp bool) Message {
+	return Message{Device: device, Sub: sub, Command: config.DevCmdSetMovement, Payload: []byte{flag(clamp)}}
+}
+
+// SetOption sets one of a drive's Opt* options.
+func SetOption(device, sub, option, value byte) Message {
+	return Message{Device: device, Sub: sub, Command: config.DevCmdSetOption, Payload: []byte{option, value}}
+}
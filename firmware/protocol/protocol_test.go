@@ -0,0 +1,306 @@
+package protocol_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+func encode(t *testing.T, m protocol.Message) []byte {
+	t.Helper()
+	b := make([]byte, m.Len())
+	n, err := m.Encode(b)
+	if err != nil || n != len(b) {
+		t.Fatalf("Encode(%+v) = %d, %v; want %d, nil", m, n, err, len(b))
+	}
+	return b
+}
+
+// TestGolden pins the bytes of every command, built by its helper.
+func TestGolden(t *testing.T) {
+	const dev = 0x01
+	tests := []struct {
+		name string
+		m    protocol.Message
+		want []byte
+	}{
+		{"ping", protocol.Ping(), []byte{0x4D, 0x00, 0x00, 0x01, config.CmdPing}},
+		{"pong", protocol.Pong(dev, 1, 8), []byte{0x4D, 0x00, 0x00, 0x04, config.CmdPong, 0x01, 0x01, 0x08}},
+		{"pong caps", protocol.PongCaps(dev, 1, 8, 0x0102), []byte{0x4D, 0x00, 0x00, 0x06, config.CmdPong, 0x01, 0x01, 0x08, 0x01, 0x02}},
+		{"get config", protocol.GetConfig(), []byte{0x4D, 0x00, 0x00, 0x01, config.CmdGetConfig}},
+		{"config", protocol.Config(dev, 3, []byte{0xFE, 0x00}), []byte{0x4D, 0x00, 0x03, 0x04, config.CmdConfig, 0x01, 0xFE, 0x00}},
+		{"route", protocol.Route(dev, 2, 7, 7, config.InstrumentHDD), []byte{0x4D, 0x00, 0x02, 0x05, config.CmdRoute, 0x01, 0x07, 0x07, config.InstrumentHDD}},
+		{"get positions", protocol.GetPositions(), []byte{0x4D, 0x00, 0x00, 0x01, config.CmdGetPositions}},
+		{"position", protocol.Position(dev, 2, 0x0102), []byte{0x4D, 0x00, 0x02, 0x04, config.CmdPosition, 0x01, 0x01, 0x02}},
+		{"get status", protocol.GetStatus(), []byte{0x4D, 0x00, 0x00, 0x01, config.CmdGetStatus}},
+		{"sequence start", protocol.SequenceStart(), []byte{0x4D, 0x00, 0x00, 0x01, config.CmdSequenceStart}},
+		{"sequence stop", protocol.SequenceStop(), []byte{0x4D, 0x00, 0x00, 0x01, config.CmdSequenceStop}},
+		{"reset", protocol.Reset(), []byte{0x4D, 0x00, 0x00, 0x01, config.CmdReset}},
+		{"drive reset", protocol.DriveReset(dev, 2), []byte{0x4D, 0x01, 0x02, 0x01, config.DevCmdReset}},
+		{"note on", protocol.NoteOn(dev, 1, 60), []byte{0x4D, 0x01, 0x01, 0x02, config.DevCmdNoteOn, 60}},
+		{"note on velocity", protocol.NoteOnVelocity(dev, 1, 60, 100), []byte{0x4D, 0x01, 0x01, 0x03, config.DevCmdNoteOn, 60, 100}},
+		{"note off", protocol.NoteOff(dev, 1, 60), []byte{0x4D, 0x01, 0x01, 0x02, config.DevCmdNoteOff, 60}},
+		{"all notes off", protocol.AllNotesOff(dev), []byte{0x4D, 0x01, 0x00, 0x01, config.DevCmdNoteOff}},
+		{"pitch bend", protocol.PitchBend(dev, 1, -8192), []byte{0x4D, 0x01, 0x01, 0x03, config.DevCmdBendPitch, 0xE0, 0x00}},
+		{"gliss", protocol.Gliss(dev, 1, 48, 60, 500, config.GlissFlagSmooth), []byte{0x4D, 0x01, 0x01, 0x06, config.DevCmdGliss, 48, 60, 0x01, 0xF4, 0x01}},
+		{"transpose", protocol.Transpose(dev, 0, -12), []byte{0x4D, 0x01, 0x00, 0x02, config.DevCmdTranspose, 0xF4}},
+		{"set zone", protocol.SetZone(dev, 1, 1, 4, config.ZonePool), []byte{0x4D, 0x01, 0x00, 0x05, config.DevCmdSetZone, 1, 1, 4, config.ZonePool}},
+		{"detune", protocol.Detune(dev, 1, -5), []byte{0x4D, 0x01, 0x01, 0x02, config.DevCmdDetune, 0xFB}},
+		{"bend range", protocol.BendRange(dev, 1, 12), []byte{0x4D, 0x01, 0x01, 0x02, config.DevCmdBendRange, 12}},
+		{"tremolo", protocol.Tremolo(dev, 1, 6, 50), []byte{0x4D, 0x01, 0x01, 0x03, config.DevCmdTremolo, 6, 50}},
+		{"channel pressure", protocol.ChannelPressure(dev, 1, 90), []byte{0x4D, 0x01, 0x01, 0x02, config.DevCmdChannelPressure, 90}},
+		{"trill", protocol.Trill(dev, 1, 60, 62, 80), []byte{0x4D, 0x01, 0x01, 0x04, config.DevCmdTrill, 60, 62, 80}},
+		{"factory reset", protocol.FactoryReset(dev, 0), []byte{0x4D, 0x01, 0x00, 0x01, config.DevCmdFactoryReset}},
+		{"set travel", protocol.SetTravel(dev, 1, 20, 140), []byte{0x4D, 0x01, 0x01, 0x03, config.DevCmdSetTravel, 20, 140}},
+		{"set travel steps", protocol.SetTravelSteps(dev, 1, 0x0010, 0x0400), []byte{0x4D, 0x01, 0x01, 0x05, config.DevCmdSetTravel, 0x00, 0x10, 0x04, 0x00}},
+		{"sustain", protocol.Sustain(dev, 1, true), []byte{0x4D, 0x01, 0x01, 0x02, config.DevCmdSustain, 1}},
+		{"set movement", protocol.SetMovement(dev, 1, false), []byte{0x4D, 0x01, 0x01, 0x02, config.DevCmdSetMovement, 0}},
+		{"set option", protocol.SetOption(dev, 1, config.OptLegato, 1), []byte{0x4D, 0x01, 0x01, 0x03, config.DevCmdSetOption, config.OptLegato, 1}},
+	}
+	for _, tt := range tests {
+		if got := encode(t, tt.m); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: encoded % x, want % x", tt.name, got, tt.want)
+		}
+	}
+}
+
+// StatusLayout is one of the status reports in testdata/status.json, the
+// fixture the host's decoder is tested against too: the fields, and the
+// frame that carries them.
+type StatusLayout struct {
+	Name     string
+	Device   byte
+	Uptime   uint32
+	Sounding byte
+	Drives   uint16
+	Sequence byte
+	Fault    byte
+	Frame    string // hex bytes
+}
+
+// TestStatusLayout checks Status lays out each report in
+// testdata/status.json as its frame.
+func TestStatusLayout(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "status.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var layouts []StatusLayout
+	if err := json.Unmarshal(data, &layouts); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range layouts {
+		want, err := hex.DecodeString(strings.ReplaceAll(l.Frame, " ", ""))
+		if err != nil {
+			t.Fatalf("%s: %v", l.Name, err)
+		}
+		if got := encode(t, protocol.Status(l.Device, l.Uptime, l.Sounding, l.Drives, l.Sequence, l.Fault)); !bytes.Equal(got, want) {
+			t.Errorf("%s: encoded % x, want % x", l.Name, got, want)
+		}
+	}
+}
+
+// TestRoundTrip checks that decoding what Encode wrote gives back the
+// message, for random valid messages of every length.
+func TestRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	subs := []byte{0x00, config.MinSubAddress, config.MaxSubAddress, config.ZoneSubAddress}
+	for i := 0; i < 5000; i++ {
+		m := protocol.Message{
+			Device:  byte(rng.IntN(256)),
+			Sub:     subs[rng.IntN(len(subs))],
+			Command: byte(rng.IntN(256)),
+		}
+		if n := rng.IntN(protocol.MaxPayload + 1); n > 0 {
+			m.Payload = make([]byte, n)
+			for j := range m.Payload {
+				m.Payload[j] = byte(rng.IntN(256))
+			}
+		}
+		b := encode(t, m)
+		got, n, err := protocol.Decode(append(b, config.StartByte))
+		if err != nil || n != len(b) || !reflect.DeepEqual(got, m) {
+			t.Fatalf("Decode(Encode(%+v)) = %+v, %d, %v", m, got, n, err)
+		}
+	}
+}
+
+// TestEncodeInPlace checks a payload built where Encode puts it, as the
+// firmware's replies are, comes out intact.
+func TestEncodeInPlace(t *testing.T) {
+	buf := make([]byte, 16)
+	payload := append(buf[protocol.HeaderSize+1:protocol.HeaderSize+1], 1, 2, 3)
+	n, err := protocol.Message{Command: config.CmdPosition, Sub: 4, Payload: payload}.Encode(buf)
+	want := []byte{0x4D, 0x00, 0x04, 0x04, config.CmdPosition, 1, 2, 3}
+	if err != nil || !bytes.Equal(buf[:n], want) {
+		t.Errorf("encoded % x, %v; want % x", buf[:n], err, want)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	long := protocol.Message{Device: 1, Sub: 1, Payload: make([]byte, protocol.MaxPayload+1)}
+	if _, err := long.Encode(make([]byte, 300)); !errors.Is(err, protocol.ErrPayloadTooLong) {
+		t.Errorf("long payload: %v", err)
+	}
+	if _, err := protocol.Ping().Encode(make([]byte, 4)); !errors.Is(err, protocol.ErrShortBuffer) {
+		t.Errorf("short buffer: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		src  []byte
+		n    int
+		err  error
+	}{
+		{"empty", nil, 0, protocol.ErrIncomplete},
+		{"noise", []byte{0x12, 0x4D}, 1, protocol.ErrNoStartByte},
+		{"header cut", []byte{0x4D, 0x01, 0x01}, 0, protocol.ErrIncomplete},
+		{"body cut", []byte{0x4D, 0x01, 0x01, 0x03, 0x09, 60}, 0, protocol.ErrIncomplete},
+		{"size 0", []byte{0x4D, 0x01, 0x01, 0x00, 0x4D}, 4, protocol.ErrEmptyFrame},
+		{"reserved sub", []byte{0x4D, 0x01, config.MaxSubAddress + 1, 0x02, 0x09, 60}, 6, protocol.ErrReservedSubAddress},
+	}
+	for _, tt := range tests {
+		_, n, err := protocol.Decode(tt.src)
+		if n != tt.n || !errors.Is(err, tt.err) {
+			t.Errorf("%s: Decode(% x) = %d, %v; want %d, %v", tt.name, tt.src, n, err, tt.n, tt.err)
+		}
+	}
+	// A system reply carries a drive in its sub address: not reserved.
+	if _, _, err := protocol.Decode(encode(t, protocol.Position(1, 0x7F, 0))); err != nil {
+		t.Errorf("system reply to sub 0x7f: %v", err)
+	}
+}
+
+// TestCapture pins a capture's bytes, and reads them back entry by entry.
+func TestCapture(t *testing.T) {
+	on := encode(t, protocol.NoteOnVelocity(1, 1, 60, 100))
+	b := protocol.AppendCaptureHeader(nil, protocol.CaptureHeader{Transport: protocol.CaptureSerial, Baud: 57600})
+	b = protocol.AppendCaptureEntry(b, 0, encode(t, protocol.SequenceStart()))
+	b = protocol.AppendCaptureEntry(b, 1500*time.Microsecond+400, on) // rounds to 1.5ms
+	want := []byte{
+		'G', 'O', 'P', 'C', 1, protocol.CaptureSerial, 0x00, 0xE1, 0x00, 0x00, // 57600
+		0x00, 0x05, 0x4D, 0x00, 0x00, 0x01, config.CmdSequenceStart,
+		0xDC, 0x0B, 0x07, 0x4D, 0x01, 0x01, 0x03, config.DevCmdNoteOn, 60, 100, // 1500µs
+	}
+	if !bytes.Equal(b, want) {
+		t.Fatalf("capture % x\nwant    % x", b, want)
+	}
+
+	h, n, err := protocol.DecodeCaptureHeader(b)
+	if err != nil || n != protocol.CaptureHeaderSize || h != (protocol.CaptureHeader{Version: 1, Transport: protocol.CaptureSerial, Baud: 57600}) {
+		t.Fatalf("header %+v, %d, %v", h, n, err)
+	}
+	rest := b[n:]
+	var deltas []time.Duration
+	var frames [][]byte
+	for len(rest) > 0 {
+		d, frame, n, err := protocol.DecodeCaptureEntry(rest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deltas, frames = append(deltas, d), append(frames, frame)
+		rest = rest[n:]
+	}
+	if !reflect.DeepEqual(deltas, []time.Duration{0, 1500 * time.Microsecond}) || len(frames) != 2 || !bytes.Equal(frames[1], on) {
+		t.Errorf("entries %v % x", deltas, frames)
+	}
+
+	for cut := protocol.CaptureHeaderSize + 1; cut < len(b); cut++ {
+		if cut == protocol.CaptureHeaderSize+7 {
+			continue // between the entries
+		}
+		src := b[protocol.CaptureHeaderSize:cut]
+		for len(src) > 0 {
+			_, _, n, err := protocol.DecodeCaptureEntry(src)
+			if errors.Is(err, protocol.ErrIncomplete) {
+				break
+			}
+			if err != nil {
+				t.Fatalf("cut at %d: %v", cut, err)
+			}
+			src = src[n:]
+		}
+		if len(src) == 0 {
+			t.Errorf("cut at %d: read every entry", cut)
+		}
+	}
+	if _, _, err := protocol.DecodeCaptureHeader([]byte("MThd\x00\x00\x00\x06\x00\x01")); !errors.Is(err, protocol.ErrNotCapture) {
+		t.Errorf("a MIDI file's header: %v", err)
+	}
+	if _, _, err := protocol.DecodeCaptureHeader([]byte("GOPC\x02\x00\x00\x00\x00\x00")); !errors.Is(err, protocol.ErrCaptureVersion) {
+		t.Errorf("version 2: %v", err)
+	}
+	if _, _, err := protocol.DecodeCaptureHeader([]byte("GOPC")); !errors.Is(err, protocol.ErrIncomplete) {
+		t.Errorf("short header: %v", err)
+	}
+	if _, _, _, err := protocol.DecodeCaptureEntry(bytes.Repeat([]byte{0xFF}, 11)); !errors.Is(err, protocol.ErrCaptureEntry) {
+		t.Errorf("overlong varint: %v", err)
+	}
+}
+
+// TestBaked pins a baked file's bytes, and reads them back entry by
+// entry.
+func TestBaked(t *testing.T) {
+	on := encode(t, protocol.NoteOnVelocity(1, 1, 60, 100))
+	b := protocol.AppendBakedHeader(nil, protocol.BakedHeader{Caps: config.CapVelocity})
+	b = protocol.AppendBakedEntry(b, 0, encode(t, protocol.SequenceStart()))
+	b = protocol.AppendBakedEntry(b, 1500, on)
+	want := []byte{
+		'G', 'O', 'P', 'B', 1, 0xE8, 0x03, 0x00, 0x00, 0x01, 0x00, // milliseconds, velocity
+		0x00, 0x05, 0x4D, 0x00, 0x00, 0x01, config.CmdSequenceStart,
+		0xDC, 0x0B, 0x07, 0x4D, 0x01, 0x01, 0x03, config.DevCmdNoteOn, 60, 100, // 1500 ticks
+	}
+	if !bytes.Equal(b, want) {
+		t.Fatalf("baked % x\nwant  % x", b, want)
+	}
+
+	h, n, err := protocol.DecodeBakedHeader(b)
+	if err != nil || n != protocol.BakedHeaderSize || h != (protocol.BakedHeader{Version: 1, TickRate: 1000, Caps: config.CapVelocity}) {
+		t.Fatalf("header %+v, %d, %v", h, n, err)
+	}
+	rest := b[n:]
+	var deltas []uint64
+	var frames [][]byte
+	for len(rest) > 0 {
+		d, frame, n, err := protocol.DecodeBakedEntry(rest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deltas, frames = append(deltas, d), append(frames, frame)
+		rest = rest[n:]
+	}
+	if !reflect.DeepEqual(deltas, []uint64{0, 1500}) || len(frames) != 2 || !bytes.Equal(frames[1], on) {
+		t.Errorf("entries %v % x", deltas, frames)
+	}
+	if _, _, _, err := protocol.DecodeBakedEntry(b[n : len(b)-1]); err != nil {
+		t.Errorf("first entry of a cut file: %v", err)
+	}
+	if _, _, _, err := protocol.DecodeBakedEntry(b[n+7 : len(b)-1]); !errors.Is(err, protocol.ErrIncomplete) {
+		t.Errorf("cut entry: %v", err)
+	}
+
+	for _, tt := range []struct {
+		header string
+		err    error
+	}{
+		{"GOPC\x01\x00\x00\x00\x00\x00\x00", protocol.ErrNotBaked},
+		{"GOPB\x02\xE8\x03\x00\x00\x00\x00", protocol.ErrBakedVersion},
+		{"GOPB\x01\x00\x00\x00\x00\x00\x00", protocol.ErrBakedTickRate},
+		{"GOPB\x01", protocol.ErrIncomplete},
+	} {
+		if _, _, err := protocol.DecodeBakedHeader([]byte(tt.header)); !errors.Is(err, tt.err) {
+			t.Errorf("header % x: %v, want %v", tt.header, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Package selftest holds the drive checks cmd/selftest runs when
+// commissioning a tower, apart from the board, so they run on the host
+// against the host hal and a fake clock.
+//
+// Check walks one drive through its wiring with the production drive
+// code:
+//
+//  1. it toggles the STEP line, then the DIRECTION line, slowly, printing
+//     which line and pin is active, so a meter or the head's clicks can
+//     follow along;
+//  2. it re-homes the drive, as DevCmdReset does;
+//  3. it plays a short scale.
+//
+// With a sense input, such as the drive's TRACK 0 line or a current
+// sensor's comparator, a drive whose input never changed during steps 2
+// and 3 never moved and is Stuck; without one the drive is Unchecked and
+// the ear has to judge.
+package selftest
+
+import (
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/hal"
+	"github.com/ystepanoff/goppy/firmware/instruments"
+)
+
+const (
+	lineToggles = 4
+	lineHold    = 250 * time.Millisecond
+
+	// homeWait covers the slowest re-homing: a 5ms step back across the
+	// whole travel and twice the largest calibration offset.
+	homeWait = (config.MaxPosition/2 + 2*255) * 5 * time.Millisecond
+
+	noteLength = 150 * time.Millisecond
+	sensePoll  = time.Millisecond
+)
+
+// Scale is played on each drive: C major from C3.
+var Scale = [...]byte{48, 50, 52, 53, 55, 57, 59, 60}
+
+// Result is what Check found out about a drive.
+type Result byte
+
+const (
+	// Unchecked drives have no sense input to tell.
+	Unchecked Result = iota
+	// Moved drives' sense input changed while homing or playing.
+	Moved
+	// Stuck drives' sense input never changed: the drive never moved.
+	Stuck
+)
+
+// Checker runs the checks on the drives of Floppy, which must be set up
+// and ticking from Ticker.
+type Checker struct {
+	Floppy *instruments.FloppyDrives
+
+	// Ticker is what the checks wait on: instruments.HardwareTicker on the
+	// board, a fakeclock.Clock in the tests.
+	Ticker hal.Ticker
+
+	// SenseFirstPin is drive 1's sense input, drive N's being
+	// SenseFirstPin + N-1, pulled up; 0 means there are none. See
+	// config.SenseFirstPin.
+	SenseFirstPin hal.Pin
+}
+
+// Check runs the three steps on drive d and returns its result. It takes
+// about 8 seconds.
+func (c *Checker) Check(d byte) Result {
+	println("drive", d)
+	c.toggleLines(d)
+
+	var sense *hal.Pin
+	if c.SenseFirstPin != 0 {
+		p := c.SenseFirstPin + hal.Pin(d-1)
+		p.Configure(hal.PinConfig{Mode: hal.PinInputPullup})
+		sense = &p
+	}
+
+	println("  homing")
+	c.Floppy.HandleDeviceMessage(d, config.DevCmdReset, nil)
+	changes := c.watch(sense, homeWait)
+
+	println("  scale")
+	for _, note := range Scale {
+		if err := c.Floppy.PlayNote(d, note); err != nil {
+			println("  note", note, "refused:", err.Error())
+		}
+		changes += c.watch(sense, noteLength)
+	}
+	c.Floppy.StopNote(d)
+
+	switch {
+	case sense == nil:
+		return Unchecked
+	case changes == 0:
+		return Stuck
+	default:
+		return Moved
+	}
+}
+
+// toggleLines toggles drive d's STEP and then DIRECTION line, printing
+// where each is wired, and leaves both low.
+func (c *Checker) toggleLines(d byte) {
+	step, dir, ok := c.Floppy.DrivePins(d)
+	for line := 0; line < 2; line++ {
+		if line == 0 {
+			print("  step line")
+		} else {
+			print("  direction line")
+		}
+		if ok {
+			pin := step
+			if line == 1 {
+				pin = dir
+			}
+			println(" on pin", pin)
+		} else {
+			println(" on shift register bit", (d-1)*2+byte(line))
+		}
+		for i := 0; i < 2*lineToggles; i++ {
+			high := i%2 == 0
+			c.Floppy.SetLines(d, line == 0 && high, line == 1 && high)
+			c.Ticker.Sleep(lineHold)
+		}
+	}
+	c.Floppy.SetLines(d, false, false)
+}
+
+// watch polls sense for d, returning how many times it changed level. With
+// no sense input it just waits.
+func (c *Checker) watch(sense *hal.Pin, d time.Duration) int {
+	if sense == nil {
+		c.Ticker.Sleep(d)
+		return 0
+	}
+	changes := 0
+	last := sense.Get()
+	for waited := time.Duration(0); waited < d; waited += sensePoll {
+		c.Ticker.Sleep(sensePoll)
+		if level := sense.Get(); level != last {
+			changes++
+			last = level
+		}
+	}
+	return changes
+}
@@ -0,0 +1,69 @@
+//go:build !tinygo
+
+package selftest
+
+import (
+	"testing"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/fakeclock"
+	"github.com/ystepanoff/goppy/firmware/hal"
+	"github.com/ystepanoff/goppy/firmware/instruments"
+)
+
+// senseFirst is an input no drive uses.
+const senseFirst hal.Pin = 200
+
+// checker sets up drives ticking from a fake clock and a Checker on them
+// with sense inputs from senseFirst, or none if sense is false.
+func checker(t *testing.T, sense bool) *Checker {
+	clock := fakeclock.New()
+	floppy := instruments.NewFloppyDrives()
+	floppy.SetTicker(clock)
+	clock.Start(config.TimerResolution, floppy.Tick)
+	floppy.Setup()
+	t.Cleanup(func() { hal.OnChange = nil })
+	c := &Checker{Floppy: floppy, Ticker: clock}
+	if sense {
+		c.SenseFirstPin = senseFirst
+	}
+	return c
+}
+
+// TestCheck wires drive 1's sense input to follow its STEP line, as a
+// TRACK 0 line follows a head that moves, and leaves drive 2's still:
+// drive 1 has moved, drive 2 is stuck, and with no sense inputs both are
+// unchecked. Along the way both lines toggle, and the STEP line moves on
+// to home and play.
+func TestCheck(t *testing.T) {
+	c := checker(t, true)
+	step, dir, ok := c.Floppy.DrivePins(1)
+	if !ok {
+		t.Skip("drive 1 is behind the shift register")
+	}
+	rises := map[hal.Pin]int{}
+	hal.OnChange = func(p hal.Pin, high bool) {
+		if high {
+			rises[p]++
+		}
+		if p == step {
+			senseFirst.Set(!senseFirst.Get())
+		}
+	}
+	if got := c.Check(1); got != Moved {
+		t.Errorf("drive 1 with its sense input following the head: %d, want Moved", got)
+	}
+	if rises[step] <= lineToggles || rises[dir] < lineToggles {
+		t.Errorf("step rose %d times and direction %d, want over %d from the toggles and homing", rises[step], rises[dir], lineToggles)
+	}
+	if got := c.Check(2); got != Stuck {
+		t.Errorf("drive 2 with a still sense input: %d, want Stuck", got)
+	}
+
+	c = checker(t, false)
+	for d := byte(1); d <= 2; d++ {
+		if got := c.Check(d); got != Unchecked {
+			t.Errorf("drive %d with no sense input: %d, want Unchecked", d, got)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+// EEPROM access for the ATmega328P (1 KB, byte-addressed).
+//
+// A write takes about 3.4ms and wears the cell, so writeByte skips bytes
+// that already hold the value. Both calls busy-wait for a pending write.
+
+//go:build avr
+
+package settings
+
+import (
+	"device/avr"
+	"runtime/interrupt"
+)
+
+// readByte returns the EEPROM byte at addr.
+func readByte(addr uint16) byte {
+	for avr.EECR.HasBits(avr.EECR_EEPE) {
+	}
+	avr.EEARH.Set(byte(addr >> 8))
+	avr.EEARL.Set(byte(addr))
+	avr.EECR.SetBits(avr.EECR_EERE)
+	return avr.EEDR.Get()
+}
+
+// writeByte stores v at addr unless it is already there.
+func writeByte(addr uint16, v byte) {
+	if readByte(addr) == v {
+		return
+	}
+	avr.EEARH.Set(byte(addr >> 8))
+	avr.EEARL.Set(byte(addr))
+	avr.EEDR.Set(v)
+
+	// EEPE must be set within four cycles of EEMPE, so keep the tick
+	// interrupt out of the way. Clearing the EEPM bits selects an atomic
+	// erase and write.
+	state := interrupt.Disable()
+	avr.EECR.Set(avr.EECR_EEMPE)
+	avr.EECR.SetBits(avr.EECR_EEPE)
+	interrupt.Restore(state)
+}
+
+// commit has nothing to do: each byte is written as it changes.
+func commit() {}
@@ -0,0 +1,21 @@
+// Everywhere else - the host build, and boards with neither the AVR's
+// EEPROM nor the RP2040's flash - settings are kept in RAM. They last until
+// the next power cycle, which lets the host run and test the same code.
+
+//go:build !avr && !rp2040
+
+package settings
+
+// memory starts erased, as a new EEPROM does.
+var memory = func() (m [storeSize]byte) {
+	for i := range m {
+		m[i] = emptySlot
+	}
+	return m
+}()
+
+func readByte(addr uint16) byte { return memory[addr] }
+
+func writeByte(addr uint16, v byte) { memory[addr] = v }
+
+func commit() {}
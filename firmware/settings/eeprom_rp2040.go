@@ -0,0 +1,68 @@
+// Settings storage for the RP2040, at the start of the flash left over
+// after the program (machine.Flash).
+//
+// Flash can't be written a byte at a time: a 4 KB sector is erased, then
+// programmed whole, and wears out after about 100,000 erases. So the
+// settings are read into RAM on first use, written there, and commit puts
+// them back in one erase only after a save or clear that changed them.
+
+//go:build rp2040
+
+package settings
+
+import (
+	"machine"
+	"runtime/interrupt"
+)
+
+var (
+	image  [storeSize]byte
+	loaded bool
+	dirty  bool
+)
+
+func readByte(addr uint16) byte {
+	load()
+	return image[addr]
+}
+
+func writeByte(addr uint16, v byte) {
+	load()
+	if image[addr] != v {
+		image[addr] = v
+		dirty = true
+	}
+}
+
+// commit writes the settings back to flash if they changed. The program
+// runs from the same flash, which can't be read while it is erased or
+// programmed, so the tick interrupt is held off for the 50ms or so that
+// takes.
+func commit() {
+	if !dirty {
+		return
+	}
+	size := machine.Flash.EraseBlockSize()
+	state := interrupt.Disable()
+	err := machine.Flash.EraseBlocks(0, (storeSize+size-1)/size)
+	if err == nil {
+		_, err = machine.Flash.WriteAt(image[:], 0)
+	}
+	interrupt.Restore(state)
+	// A failed write is retried by the next commit.
+	dirty = err != nil
+}
+
+// load reads the settings from flash the first time they are needed. If
+// they can't be read every slot starts empty.
+func load() {
+	if loaded {
+		return
+	}
+	loaded = true
+	if _, err := machine.Flash.ReadAt(image[:], 0); err != nil {
+		for i := range image {
+			image[i] = emptySlot
+		}
+	}
+}
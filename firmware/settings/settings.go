@@ -0,0 +1,173 @@
+// Package settings keeps per-drive settings, and the device's own, in
+// EEPROM so they survive a power cycle: the ATmega328P's own, or on the RP2040 a copy in flash.
+// Other builds, the host's included, keep them in RAM.
+//
+// EEPROM layout:
+//
+//	0..3   header: 'G', 'S', layout version, slot size
+//	4..    one SlotSize slot per drive 1..MaxDrives, then one for the
+//	       device's settings that aren't any one drive's, such as zones:
+//	       [length, data[0:length], checksum]
+//
+// A drive's data is an opaque byte string owned by the instrument, which
+// only ever appends fields to it. A block saved by older firmware is just
+// shorter, and the fields it lacks keep their defaults. A block that fails
+// its checksum is ignored on its own; the other drives still load. Older
+// firmware had no device slot: its store reads the slot as erased, and
+// loads nothing for it.
+package settings
+
+const (
+	// MaxDrives is the number of drive slots reserved, whatever the
+	// number of drives currently configured.
+	MaxDrives = 16
+
+	// SlotSize is the EEPROM space per drive, length and checksum included.
+	SlotSize = 32
+
+	// MaxData is the most settings data a drive can store.
+	MaxData = SlotSize - 2
+)
+
+const (
+	headerSize    = 4
+	magic0        = 'G'
+	magic1        = 'S'
+	layoutVersion = 1
+
+	// emptySlot marks a slot with no data (the erased EEPROM value).
+	emptySlot = 0xFF
+
+	// deviceSlot numbers the device's slot, after the drives': its
+	// checksum starts from 0, as no drive's does.
+	deviceSlot = 0
+
+	// storeSize is the EEPROM space the layout takes.
+	storeSize = headerSize + (MaxDrives+1)*SlotSize
+)
+
+// LoadDrive copies drive's stored settings into dst and returns how many
+// bytes it copied. It returns 0, leaving dst in an unspecified state, if
+// nothing valid is stored for the drive.
+func LoadDrive(drive byte, dst []byte) int {
+	if drive == 0 || drive > MaxDrives {
+		return 0
+	}
+	return loadSlot(drive, dst)
+}
+
+// LoadDevice copies the device's stored settings into dst, as LoadDrive
+// does a drive's.
+func LoadDevice(dst []byte) int {
+	return loadSlot(deviceSlot, dst)
+}
+
+// loadSlot copies slot's data into dst and returns how many bytes it copied,
+// or 0 if nothing valid is stored there.
+func loadSlot(slot byte, dst []byte) int {
+	if !headerValid() {
+		return 0
+	}
+	addr := slotAddr(slot)
+	n := readByte(addr)
+	if n > MaxData {
+		return 0
+	}
+	sum := slot ^ n
+	copied := 0
+	for i := byte(0); i < n; i++ {
+		b := readByte(addr + 1 + uint16(i))
+		sum = fold(sum, b)
+		if copied < len(dst) {
+			dst[copied] = b
+			copied++
+		}
+	}
+	if readByte(addr+1+uint16(n)) != sum {
+		return 0
+	}
+	return copied
+}
+
+// SaveDrive stores data (at most MaxData bytes) as drive's settings.
+// Only bytes that changed are written.
+func SaveDrive(drive byte, data []byte) {
+	if drive == 0 || drive > MaxDrives {
+		return
+	}
+	saveSlot(drive, data)
+}
+
+// SaveDevice stores data (at most MaxData bytes) as the device's settings.
+func SaveDevice(data []byte) {
+	saveSlot(deviceSlot, data)
+}
+
+// saveSlot stores data in slot, writing only the bytes that changed.
+func saveSlot(slot byte, data []byte) {
+	if len(data) > MaxData {
+		return
+	}
+	if !headerValid() {
+		writeHeader()
+	}
+	addr := slotAddr(slot)
+	n := byte(len(data))
+	sum := slot ^ n
+	writeByte(addr, n)
+	for i, b := range data {
+		sum = fold(sum, b)
+		writeByte(addr+1+uint16(i), b)
+	}
+	writeByte(addr+1+uint16(n), sum)
+	commit()
+}
+
+// ClearDrive forgets drive's stored settings.
+func ClearDrive(drive byte) {
+	if drive == 0 || drive > MaxDrives {
+		return
+	}
+	writeByte(slotAddr(drive), emptySlot)
+	commit()
+}
+
+// ClearAll forgets the stored settings of every drive, and the device's.
+func ClearAll() {
+	writeByte(0, emptySlot)
+	commit()
+}
+
+// headerValid reports whether the EEPROM holds this layout.
+func headerValid() bool {
+	return readByte(0) == magic0 && readByte(1) == magic1 &&
+		readByte(2) == layoutVersion && readByte(3) == SlotSize
+}
+
+// writeHeader claims the EEPROM for this layout with every slot empty.
+func writeHeader() {
+	for slot := byte(0); slot <= MaxDrives; slot++ {
+		writeByte(slotAddr(slot), emptySlot)
+	}
+	writeByte(1, magic1)
+	writeByte(2, layoutVersion)
+	writeByte(3, SlotSize)
+	// Magic last: a power cut midway leaves the header invalid.
+	writeByte(0, magic0)
+}
+
+// slotAddr returns where slot starts: drive N's is slot N, and the
+// device's, deviceSlot, follows the last drive's.
+func slotAddr(slot byte) uint16 {
+	if slot == deviceSlot {
+		return headerSize + MaxDrives*SlotSize
+	}
+	return headerSize + uint16(slot-1)*SlotSize
+}
+
+// fold adds one byte to a slot's checksum: rotate left, then add, so
+// swapped bytes are caught. The sum starts from the slot number XOR the
+// length, so a block can't pass for another drive's, or the device's.
+func fold(sum, b byte) byte {
+	return (sum<<1 | sum>>7) + b
+}
@@ -0,0 +1,169 @@
+//go:build !tinygo
+
+package settings
+
+import (
+	"bytes"
+	"testing"
+)
+
+// erase puts the store back to a new EEPROM's, now and after the test.
+func erase(t *testing.T) {
+	wipe := func() {
+		for i := range memory {
+			memory[i] = emptySlot
+		}
+	}
+	wipe()
+	t.Cleanup(wipe)
+}
+
+func load(drive byte) []byte {
+	var buf [MaxData]byte
+	n := LoadDrive(drive, buf[:])
+	return buf[:n]
+}
+
+func TestRoundTrip(t *testing.T) {
+	erase(t)
+	if got := load(1); len(got) != 0 {
+		t.Fatalf("erased store loaded % X", got)
+	}
+	full := bytes.Repeat([]byte{0xA5}, MaxData)
+	SaveDrive(1, []byte{1, 2, 3})
+	SaveDrive(MaxDrives, full)
+	SaveDrive(2, []byte{})
+	if got := load(1); !bytes.Equal(got, []byte{1, 2, 3}) {
+		t.Errorf("drive 1 loaded % X", got)
+	}
+	if got := load(MaxDrives); !bytes.Equal(got, full) {
+		t.Errorf("drive %d loaded % X, want % X", MaxDrives, got, full)
+	}
+	if got := load(3); len(got) != 0 {
+		t.Errorf("drive 3, never saved, loaded % X", got)
+	}
+
+	// A block too big for the slot, or for no drive, isn't saved.
+	SaveDrive(1, make([]byte, MaxData+1))
+	SaveDrive(0, []byte{9})
+	SaveDrive(MaxDrives+1, []byte{9})
+	if got := load(1); !bytes.Equal(got, []byte{1, 2, 3}) {
+		t.Errorf("oversized save changed drive 1 to % X", got)
+	}
+
+	// Saving over a block replaces it, shorter or longer.
+	SaveDrive(1, []byte{7})
+	if got := load(1); !bytes.Equal(got, []byte{7}) {
+		t.Errorf("drive 1 resaved as 07 loaded % X", got)
+	}
+	ClearDrive(1)
+	if got := load(1); len(got) != 0 {
+		t.Errorf("cleared drive 1 loaded % X", got)
+	}
+	ClearAll()
+	if got := load(MaxDrives); len(got) != 0 {
+		t.Errorf("after ClearAll drive %d loaded % X", MaxDrives, got)
+	}
+	SaveDrive(2, []byte{4})
+	if got, old := load(2), load(MaxDrives); !bytes.Equal(got, []byte{4}) || len(old) != 0 {
+		t.Errorf("first save after ClearAll: drive 2 % X, drive %d % X", got, MaxDrives, old)
+	}
+}
+
+// TestDeviceSlot keeps the device's settings apart from every drive's.
+func TestDeviceSlot(t *testing.T) {
+	erase(t)
+	loadDevice := func() []byte {
+		var buf [MaxData]byte
+		return buf[:LoadDevice(buf[:])]
+	}
+	// A store from before the device slot, with drives saved.
+	SaveDrive(MaxDrives, []byte{1, 2, 3})
+	if got := loadDevice(); len(got) != 0 {
+		t.Errorf("a store with no device settings loaded % X", got)
+	}
+
+	full := bytes.Repeat([]byte{0x5A}, MaxData)
+	SaveDevice(full)
+	if got, drive := loadDevice(), load(MaxDrives); !bytes.Equal(got, full) || !bytes.Equal(drive, []byte{1, 2, 3}) {
+		t.Errorf("device % X, drive %d % X", got, MaxDrives, drive)
+	}
+	SaveDevice(make([]byte, MaxData+1))
+	ClearDrive(MaxDrives)
+	if got := loadDevice(); !bytes.Equal(got, full) {
+		t.Errorf("after an oversized save and clearing a drive, device % X", got)
+	}
+
+	// Drive 1's block isn't the device's.
+	SaveDrive(1, []byte{7})
+	copy(memory[slotAddr(deviceSlot):], memory[slotAddr(1):slotAddr(2)])
+	if got := loadDevice(); len(got) != 0 {
+		t.Errorf("drive 1's block loaded as the device's: % X", got)
+	}
+	SaveDevice([]byte{4})
+	ClearAll()
+	if got := loadDevice(); len(got) != 0 {
+		t.Errorf("after ClearAll device % X", got)
+	}
+}
+
+// TestCorruptSlot damages drive 1's block in ways a torn write or a bad
+// cell could: it stops loading, and drive 2's still loads.
+func TestCorruptSlot(t *testing.T) {
+	data := []byte{10, 20, 30, 40}
+	for name, damage := range map[string]func(){
+		"data byte":     func() { memory[slotAddr(1)+2] ^= 0x10 },
+		"checksum":      func() { memory[slotAddr(1)+1+4]++ },
+		"length":        func() { memory[slotAddr(1)] = 3 },
+		"huge length":   func() { memory[slotAddr(1)] = MaxData + 1 },
+		"swapped bytes": func() { a := slotAddr(1) + 1; memory[a], memory[a+1] = memory[a+1], memory[a] },
+		"another drive's block": func() {
+			copy(memory[slotAddr(1):slotAddr(2)], memory[slotAddr(3):slotAddr(4)])
+		},
+	} {
+		erase(t)
+		SaveDrive(1, data)
+		SaveDrive(2, data)
+		SaveDrive(3, []byte{20, 10, 30, 40})
+		damage()
+		if got := load(1); len(got) != 0 {
+			t.Errorf("%s damaged: drive 1 loaded % X", name, got)
+		}
+		if got := load(2); !bytes.Equal(got, data) {
+			t.Errorf("%s damaged in drive 1: drive 2 loaded % X", name, got)
+		}
+	}
+}
+
+// TestOlderLayout loads what older firmware left behind: a shorter block
+// loads as far as it goes, and a store in another layout is ignored until
+// the first save claims it.
+func TestOlderLayout(t *testing.T) {
+	erase(t)
+	SaveDrive(1, []byte{1, 2})
+	var buf [MaxData]byte
+	buf[2], buf[3] = 0xEE, 0xEE
+	if n := LoadDrive(1, buf[:]); n != 2 || buf[2] != 0xEE {
+		t.Errorf("a 2-byte block loaded %d bytes: % X", n, buf[:4])
+	}
+	// A caller expecting less gets the start of the block.
+	if n := LoadDrive(1, buf[:1]); n != 1 || buf[0] != 1 {
+		t.Errorf("a 2-byte block into 1 byte loaded %d: % X", n, buf[:1])
+	}
+
+	// Version 0 of the layout had 16-byte slots.
+	erase(t)
+	memory[0], memory[1], memory[2], memory[3] = magic0, magic1, 0, 16
+	old := headerSize + 16
+	memory[old], memory[old+1], memory[old+2] = 1, 5, fold(2^1, 5)
+	if got := load(2); len(got) != 0 {
+		t.Errorf("a version 0 store loaded % X for drive 2", got)
+	}
+	SaveDrive(1, []byte{9})
+	if got, other := load(1), load(2); !bytes.Equal(got, []byte{9}) || len(other) != 0 {
+		t.Errorf("after the first save: drive 1 % X, drive 2 % X", got, other)
+	}
+	if memory[2] != layoutVersion || memory[3] != SlotSize {
+		t.Errorf("header % X not rewritten", memory[:headerSize])
+	}
+}
@@ -0,0 +1,260 @@
+//go:build !tinygo
+
+// Package sim renders roughly what the floppy drives will sound like,
+// without the hardware. It runs the same FloppyDrives code the firmware
+// runs, feeding it frames through the serial parser and ticking it at
+// TimerResolution, and listens to the simulated step and direction pins:
+// each drive becomes a square wave with one cycle per step, so it sounds
+// at the rate the step line toggles, with a short click whenever the head
+// reverses, panned across the stereo field.
+//
+// Only drives wired straight to pins are heard; with ShiftRegister set
+// the simulation is silent.
+package sim
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/hal"
+	"github.com/ystepanoff/goppy/firmware/instruments"
+	"github.com/ystepanoff/goppy/firmware/networks"
+	"github.com/ystepanoff/goppy/firmware/networks/networkstest"
+	"github.com/ystepanoff/goppy/firmware/notes"
+)
+
+// SampleRate is the rendered sample rate in Hz.
+const SampleRate = 44100
+
+// tick is one timer interrupt.
+const tick = config.TimerResolution * time.Microsecond
+
+// A step more than maxStepTicks after the last starts a fresh note, and
+// gets a cycle firstStepTicks long, there being nothing to measure it from.
+const (
+	maxStepTicks   = 50 * notes.TicksPerMs
+	firstStepTicks = 2 * notes.TicksPerMs
+)
+
+// Mixing levels. A drive's square wave swings by ±stepLevel and a head
+// reversal adds a click of bounceLevel dying away over bounceDecay, so
+// every drive sounding together stays clear of clipping.
+const (
+	stepLevel   = 0.08
+	bounceLevel = 0.12
+	bounceDecay = 1500 * time.Microsecond
+)
+
+// Output filters: a one-pole low-pass takes the edge off the square
+// waves, as the drive chassis does, and a DC blocker removes the offset
+// an idle drive's step line leaves behind.
+const (
+	lowPassHz = 5000
+	dcBlockHz = 20
+)
+
+// Event is a frame sent At this long after the start of the song.
+type Event struct {
+	At    time.Duration
+	Frame []byte
+}
+
+// Simulator plays frames on a set of simulated drives. Create it with
+// New; the simulated pins are global, so only one can run at a time.
+type Simulator struct {
+	// BeforeTick, if set, is called before every tick with the simulated
+	// time, to pace the simulation or watch it run.
+	BeforeTick func(now time.Duration)
+
+	drives *instruments.FloppyDrives
+	port   *networkstest.MockPort
+	serial *networks.Serial
+
+	// stepDrive and dirDrive map a pin to the drive it steps or turns, 0
+	// for none.
+	stepDrive [256]byte
+	dirDrive  [256]byte
+
+	ticks uint32 // ticks run so far
+
+	lastStep [config.NumDrives + 1]uint32  // tick of the last step
+	cycle    [config.NumDrives + 1]uint32  // ticks between the last two steps
+	level    [config.NumDrives + 1]float64 // ±1
+	bounce   [config.NumDrives + 1]float64 // current click level
+	panL     [config.NumDrives + 1]float64
+	panR     [config.NumDrives + 1]float64
+}
+
+// New returns a Simulator with every drive at rest. It skips
+// FloppyDrives.Setup, which homes the heads against the wall clock, so
+// the heads start at position 0 as if a reset had just finished. The
+// pins start low, whatever an earlier Simulator left them at, so the same
+// frames always render the same samples.
+func New() *Simulator {
+	s := &Simulator{
+		drives: instruments.NewFloppyDrives(),
+		port:   networkstest.NewMockPort(),
+	}
+	s.serial = networks.NewSerialPort(s.drives, s.port)
+
+	for d := byte(1); d <= config.NumDrives; d++ {
+		if config.SharedDirPin != 0 {
+			s.stepDrive[config.FirstPin+(d-1)] = d
+			hal.Pin(config.FirstPin + (d - 1)).Low()
+		} else {
+			s.stepDrive[config.FirstPin+(d-1)*2] = d
+			s.dirDrive[config.FirstPin+(d-1)*2+1] = d
+			hal.Pin(config.FirstPin + (d-1)*2).Low()
+			hal.Pin(config.FirstPin + (d-1)*2 + 1).Low()
+		}
+
+		// Equal-power pan, drive 1 hard left to the last drive hard right.
+		pan := 0.5
+		if config.NumDrives > 1 {
+			pan = float64(d-1) / float64(config.NumDrives-1)
+		}
+		s.panL[d] = math.Cos(pan * math.Pi / 2)
+		s.panR[d] = math.Sin(pan * math.Pi / 2)
+		s.level[d] = -1
+	}
+	if config.SharedDirPin != 0 {
+		hal.Pin(config.SharedDirPin).Low()
+	}
+	return s
+}
+
+// Drives returns the simulated drives.
+func (s *Simulator) Drives() *instruments.FloppyDrives {
+	return s.drives
+}
+
+// SetConsumer has the parser hand messages to c instead of the drives.
+// c must pass them on to Drives, as a simview.View does.
+func (s *Simulator) SetConsumer(c networks.MessageConsumer) {
+	s.serial = networks.NewSerialPort(c, s.port)
+}
+
+// pinChanged follows the drives' pins.
+func (s *Simulator) pinChanged(p hal.Pin, high bool) {
+	if d := s.stepDrive[p]; d != 0 {
+		// Every edge is a step: start a cycle as long as the last one.
+		s.cycle[d] = s.ticks - s.lastStep[d]
+		if s.cycle[d] > maxStepTicks || s.lastStep[d] == 0 {
+			s.cycle[d] = firstStepTicks
+		}
+		s.lastStep[d] = s.ticks
+		s.level[d] = 1
+		return
+	}
+	if p == config.SharedDirPin && config.SharedDirPin != 0 {
+		for d := 1; d <= config.NumDrives; d++ {
+			s.bounce[d] = bounceLevel
+		}
+		return
+	}
+	if d := s.dirDrive[p]; d != 0 {
+		s.bounce[d] = bounceLevel
+	}
+}
+
+// Render plays events, which must be sorted by At, and tail more of
+// silence after the last, and returns the interleaved left and right
+// samples. Each frame reaches the parser on the first tick at or after
+// its At.
+func (s *Simulator) Render(events []Event, tail time.Duration) []int16 {
+	hal.OnChange = s.pinChanged
+	defer func() { hal.OnChange = nil }()
+
+	var end time.Duration
+	if len(events) > 0 {
+		end = events[len(events)-1].At
+	}
+	end += tail
+	n := int(end * SampleRate / time.Second)
+	out := make([]int16, 0, 2*n)
+
+	decay := math.Exp(-float64(tick) / float64(bounceDecay))
+	lp := 1 - math.Exp(-2*math.Pi*lowPassHz/SampleRate)
+	hp := math.Exp(-2 * math.Pi * dcBlockHz / SampleRate)
+
+	var (
+		now        time.Duration // time of the next tick
+		next       int           // next event to deliver
+		lowL, lowR float64       // low-pass state
+		inL, inR   float64       // DC blocker state
+		dcL, dcR   float64
+	)
+	for i := 0; i < n; i++ {
+		at := time.Duration(i) * time.Second / SampleRate
+		for now <= at {
+			if s.BeforeTick != nil {
+				s.BeforeTick(now)
+			}
+			for next < len(events) && events[next].At <= now {
+				s.port.Feed(events[next].Frame...)
+				next++
+			}
+			s.serial.ReadMessages()
+			s.ticks++
+			s.drives.Tick()
+			for d := 1; d <= config.NumDrives; d++ {
+				s.bounce[d] *= decay
+				if 2*(s.ticks-s.lastStep[d]) >= s.cycle[d] {
+					s.level[d] = -1
+				}
+			}
+			now += tick
+		}
+
+		var l, r float64
+		for d := 1; d <= config.NumDrives; d++ {
+			v := stepLevel*s.level[d] + s.bounce[d]
+			l += v * s.panL[d]
+			r += v * s.panR[d]
+		}
+		lowL += lp * (l - lowL)
+		lowR += lp * (r - lowR)
+		dcL = hp*dcL + lowL - inL
+		dcR = hp*dcR + lowR - inR
+		inL, inR = lowL, lowR
+		out = append(out, sample(dcL), sample(dcR))
+	}
+	return out
+}
+
+// sample converts v to 16 bits, clipping it to ±1.
+func sample(v float64) int16 {
+	v = max(-1, min(v, 1))
+	return int16(math.Round(v * math.MaxInt16))
+}
+
+// WriteWAV writes interleaved stereo samples as a 16-bit PCM WAV file at
+// SampleRate.
+func WriteWAV(w io.Writer, samples []int16) error {
+	const (
+		channels   = 2
+		bytesPer   = 2
+		headerSize = 44
+	)
+	data := uint32(len(samples) * bytesPer)
+	header := make([]byte, 0, headerSize)
+	header = append(header, "RIFF"...)
+	header = binary.LittleEndian.AppendUint32(header, headerSize-8+data)
+	header = append(header, "WAVEfmt "...)
+	header = binary.LittleEndian.AppendUint32(header, 16) // fmt chunk size
+	header = binary.LittleEndian.AppendUint16(header, 1)  // PCM
+	header = binary.LittleEndian.AppendUint16(header, channels)
+	header = binary.LittleEndian.AppendUint32(header, SampleRate)
+	header = binary.LittleEndian.AppendUint32(header, SampleRate*channels*bytesPer)
+	header = binary.LittleEndian.AppendUint16(header, channels*bytesPer)
+	header = binary.LittleEndian.AppendUint16(header, 8*bytesPer)
+	header = append(header, "data"...)
+	header = binary.LittleEndian.AppendUint32(header, data)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, samples)
+}
@@ -0,0 +1,310 @@
+//go:build !tinygo
+
+// Package simview shows what the firmware is doing on a terminal while it
+// runs on the host, for debugging timing by eye: each drive's note, head
+// position and bend, and the instrument's counters.
+//
+// A View sits in front of the consumer it watches and passes every
+// message on, so it fits wherever that consumer did:
+//
+//	drives := instruments.NewFloppyDrives()
+//	view := simview.New(os.Stdout, drives, &drives.Stats, drives)
+//	serial := networks.NewSerialPort(view, port)
+//
+// Call Tick from the loop that ticks the instrument. Redraws come at
+// FrameRate of simulated time and rewrite only the lines that changed.
+// A Clock paces that loop against the wall clock and lets a key pause
+// it or step it a tick at a time.
+package simview
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/instruments"
+	"github.com/ystepanoff/goppy/firmware/networks"
+	"github.com/ystepanoff/goppy/firmware/notes"
+)
+
+// FrameRate is how often the dashboard is redrawn, per simulated second.
+const FrameRate = 20
+
+// barWidth is the width of the head position bar, in characters.
+const barWidth = 40
+
+// ANSI control sequences.
+const (
+	clearScreen = "\x1b[2J"
+	hideCursor  = "\x1b[?25l"
+	showCursor  = "\x1b[?25h"
+	clearLine   = "\x1b[K"
+)
+
+// View is a networks.MessageConsumer that draws a dashboard of the
+// messages it passes on to another consumer. Create it with New.
+type View struct {
+	w         io.Writer
+	inner     networks.MessageConsumer
+	stats     *instruments.Stats
+	positions networks.PositionReporter
+
+	playing  bool
+	note     [config.NumDrives + 1]byte // 0 when silent
+	bend     [config.NumDrives + 1]int16
+	messages uint32
+
+	lastDraw time.Duration
+	drawn    bool
+	lines    []string // what is on the screen, a line each
+	buf      []byte
+}
+
+// New returns a View drawing to w that passes messages on to inner.
+// stats and positions may be nil, leaving the counters and position bars
+// out.
+func New(w io.Writer, inner networks.MessageConsumer, stats *instruments.Stats, positions networks.PositionReporter) *View {
+	return &View{w: w, inner: inner, stats: stats, positions: positions}
+}
+
+// HandleSystemMessage notes sequence starts, stops and resets, then
+// passes the message on.
+func (v *View) HandleSystemMessage(command byte, payload []byte) {
+	v.messages++
+	switch command {
+	case config.CmdSequenceStart:
+		v.playing = true
+	case config.CmdSequenceStop:
+		v.playing = false
+	case config.CmdReset:
+		v.playing = false
+		v.silence(0)
+	}
+	v.inner.HandleSystemMessage(command, payload)
+}
+
+// HandleDeviceMessage notes notes and bends, then passes the message on.
+// Zone aliases are passed on without showing on any drive.
+func (v *View) HandleDeviceMessage(subAddress byte, command byte, payload []byte) {
+	v.messages++
+	if subAddress <= config.NumDrives {
+		switch command {
+		case config.DevCmdNoteOn:
+			if len(payload) > 0 && subAddress != 0 {
+				v.note[subAddress] = payload[0]
+			}
+		case config.DevCmdNoteOff:
+			if subAddress == 0 || len(payload) == 0 || v.note[subAddress] == payload[0] {
+				v.silence(subAddress)
+			}
+		case config.DevCmdReset:
+			v.silence(subAddress)
+		case config.DevCmdBendPitch:
+			if len(payload) >= 2 {
+				v.setBend(subAddress, int16(payload[0])<<8|int16(payload[1]))
+			}
+		}
+	}
+	v.inner.HandleDeviceMessage(subAddress, command, payload)
+}
+
+// silence clears a drive's note and bend, or every drive's for 0.
+func (v *View) silence(subAddress byte) {
+	first, last := subAddress, subAddress
+	if subAddress == 0 {
+		first, last = 1, config.NumDrives
+	}
+	for d := first; d <= last; d++ {
+		v.note[d] = 0
+		v.bend[d] = 0
+	}
+}
+
+// setBend records a drive's bend, or every drive's for 0.
+func (v *View) setBend(subAddress byte, bend int16) {
+	first, last := subAddress, subAddress
+	if subAddress == 0 {
+		first, last = 1, config.NumDrives
+	}
+	for d := first; d <= last; d++ {
+		v.bend[d] = bend
+	}
+}
+
+// Tick redraws the dashboard when a frame is due at now, the simulated
+// time, or straight away if force is set, as it should be after a single
+// step. It returns the first write error.
+func (v *View) Tick(now time.Duration, force bool) error {
+	if !force && v.drawn && now-v.lastDraw < time.Second/FrameRate {
+		return nil
+	}
+	v.lastDraw = now
+	return v.Draw(now)
+}
+
+// Draw redraws the dashboard for now, the simulated time, writing only
+// the lines that differ from the last draw.
+func (v *View) Draw(now time.Duration) error {
+	lines := v.render(now)
+	v.buf = v.buf[:0]
+	if !v.drawn {
+		v.buf = append(v.buf, hideCursor+clearScreen...)
+		v.lines = make([]string, len(lines))
+		v.drawn = true
+	}
+	for i, line := range lines {
+		if line == v.lines[i] {
+			continue
+		}
+		v.buf = fmt.Appendf(v.buf, "\x1b[%d;1H%s%s", i+1, line, clearLine)
+		v.lines[i] = line
+	}
+	if len(v.buf) == 0 {
+		return nil
+	}
+	_, err := v.w.Write(v.buf)
+	return err
+}
+
+// Close moves the cursor below the dashboard and shows it again.
+func (v *View) Close() error {
+	if !v.drawn {
+		return nil
+	}
+	_, err := fmt.Fprintf(v.w, "\x1b[%d;1H%s", len(v.lines)+1, showCursor)
+	return err
+}
+
+// render lays the dashboard out, a string per line: a status line, a
+// line per drive and the counters.
+func (v *View) render(now time.Duration) []string {
+	state := "stopped"
+	if v.playing {
+		state = "playing"
+	}
+	lines := []string{fmt.Sprintf("goppy  %-7s  %s", state, formatTime(now))}
+
+	var name []byte
+	for d := byte(1); d <= config.NumDrives; d++ {
+		name = name[:0]
+		if v.note[d] != 0 {
+			name = notes.Name(name, v.note[d])
+		} else {
+			name = append(name, '-')
+		}
+		line := fmt.Sprintf("%2d  %-4s", d, name)
+		if v.positions != nil {
+			if pos, ok := v.positions.DrivePosition(d); ok {
+				line += "  " + bar(pos)
+			}
+		}
+		if v.bend[d] != 0 {
+			line += fmt.Sprintf("  bend %+5d", v.bend[d])
+		}
+		lines = append(lines, line)
+	}
+
+	counters := fmt.Sprintf("messages %d", v.messages)
+	if v.stats != nil {
+		counters += fmt.Sprintf("  invalid %d  unknown %d  overruns %d  timeouts %d",
+			v.stats.InvalidPayloads, v.stats.UnknownCommands, v.stats.Overruns, v.stats.LinkTimeouts)
+	}
+	return append(lines, counters)
+}
+
+// bar draws a head position as a marker on a track of barWidth.
+func bar(pos uint16) string {
+	at := int(pos) * (barWidth - 1) / config.MaxPosition
+	at = min(at, barWidth-1)
+	return "[" + strings.Repeat(".", at) + "|" + strings.Repeat(".", barWidth-1-at) + "]"
+}
+
+// formatTime shows a simulated time as minutes, seconds and milliseconds.
+func formatTime(t time.Duration) string {
+	ms := t.Milliseconds()
+	return fmt.Sprintf("%d:%02d.%03d", ms/60000, ms/1000%60, ms%1000)
+}
+
+// Clock paces a simulation against the wall clock. Keys handed to Key
+// pause it and step it while paused; Wait blocks the simulation until
+// its next tick is due. It is safe to call Key from another goroutine.
+type Clock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	start  time.Time     // wall time of simulated time 0
+	at     time.Duration // simulated time of the last Wait
+	paused bool
+	steps  int // ticks to run while paused
+}
+
+// Keys understood by Clock.Key.
+const (
+	KeyPause = ' ' // pause or resume
+	KeyStep  = 's' // run one tick while paused
+)
+
+// NewClock returns a running Clock with simulated time 0 now.
+func NewClock() *Clock {
+	c := &Clock{start: time.Now()}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Key handles a key press, ignoring keys it doesn't know.
+func (c *Clock) Key(k byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch k {
+	case KeyPause, 'p':
+		c.paused = !c.paused
+		if !c.paused {
+			// Carry on from where the simulation stands, not where the
+			// wall clock says it should be by now.
+			c.start = time.Now().Add(-c.at)
+			c.steps = 0
+		}
+	case KeyStep:
+		if c.paused {
+			c.steps++
+		}
+	default:
+		return
+	}
+	c.cond.Broadcast()
+}
+
+// Wait blocks until the tick at simulated time at is due: at once while
+// stepping, after the wall clock catches up while running, and not until
+// a step or resume while paused. It reports whether the tick was a
+// single step, so the caller can redraw after it.
+func (c *Clock) Wait(at time.Duration) (stepped bool) {
+	c.mu.Lock()
+	for c.paused && c.steps == 0 {
+		c.cond.Wait()
+	}
+	c.at = at
+	if c.paused {
+		c.steps--
+		c.mu.Unlock()
+		return true
+	}
+	due := c.start.Add(at)
+	c.mu.Unlock()
+
+	// Sleeping for every 40µs tick would spend more time in the scheduler
+	// than simulating, so only sleep once a millisecond ahead.
+	if d := time.Until(due); d > time.Millisecond {
+		time.Sleep(d)
+	}
+	return false
+}
+
+// Paused reports whether the clock is paused.
+func (c *Clock) Paused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused
+}
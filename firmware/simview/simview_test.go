@@ -0,0 +1,172 @@
+//go:build !tinygo
+
+package simview
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/instruments"
+)
+
+// term is a terminal that understands the sequences a View sends, keeping
+// the screen as a line per row, and counts the rows written to.
+type term struct {
+	screen  []string
+	row     int
+	hidden  bool
+	rewrote []int
+}
+
+var ansi = regexp.MustCompile(`^\x1b\[(?:\?25[lh]|2J|K|(\d+);(\d+)H)`)
+
+func (t *term) Write(p []byte) (int, error) {
+	s := string(p)
+	for len(s) > 0 {
+		m := ansi.FindStringSubmatch(s)
+		if m == nil {
+			if s[0] == '\x1b' {
+				return 0, fmt.Errorf("unknown sequence %q", s)
+			}
+			for len(t.screen) <= t.row {
+				t.screen = append(t.screen, "")
+			}
+			t.screen[t.row] += s[:1]
+			s = s[1:]
+			continue
+		}
+		switch seq := m[0]; {
+		case seq == "\x1b[?25l":
+			t.hidden = true
+		case seq == "\x1b[?25h":
+			t.hidden = false
+		case seq == "\x1b[2J":
+			t.screen = nil
+		case seq == "\x1b[K":
+			// The writes always come at the end of the row.
+		default:
+			if m[2] != "1" {
+				return 0, fmt.Errorf("cursor to column %s", m[2])
+			}
+			t.row, _ = strconv.Atoi(m[1])
+			t.row--
+			for len(t.screen) <= t.row {
+				t.screen = append(t.screen, "")
+			}
+			t.screen[t.row] = ""
+			t.rewrote = append(t.rewrote, t.row)
+		}
+		s = s[len(m[0]):]
+	}
+	return len(p), nil
+}
+
+// nop counts the messages passed on to it.
+type nop struct{ system, device int }
+
+func (n *nop) HandleSystemMessage(command byte, payload []byte)                  { n.system++ }
+func (n *nop) HandleDeviceMessage(subAddress byte, command byte, payload []byte) { n.device++ }
+
+// positions reports fixed head positions.
+type positions map[byte]uint16
+
+func (p positions) DrivePosition(drive byte) (uint16, bool) {
+	pos, ok := p[drive]
+	return pos, ok
+}
+
+// TestLayout draws a dashboard with a note, a bend, positions and counters
+// and checks each line of the screen.
+func TestLayout(t *testing.T) {
+	screen := &term{}
+	inner := &nop{}
+	stats := &instruments.Stats{InvalidPayloads: 2, LinkTimeouts: 1}
+	v := New(screen, inner, stats, positions{1: 0, 2: config.MaxPosition})
+	v.HandleSystemMessage(config.CmdSequenceStart, nil)
+	v.HandleDeviceMessage(1, config.DevCmdNoteOn, []byte{61})
+	v.HandleDeviceMessage(2, config.DevCmdNoteOn, []byte{45})
+	v.HandleDeviceMessage(2, config.DevCmdBendPitch, []byte{0xF0, 0x00})
+	if err := v.Draw(61234 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if inner.system != 1 || inner.device != 3 {
+		t.Errorf("passed on %d system and %d device messages, want 1 and 3", inner.system, inner.device)
+	}
+
+	track := func(at int) string {
+		return "[" + strings.Repeat(".", at) + "|" + strings.Repeat(".", barWidth-1-at) + "]"
+	}
+	want := []string{
+		"goppy  playing  1:01.234",
+		" 1  C#4   " + track(0),
+		" 2  A2    " + track(barWidth-1) + "  bend -4096",
+	}
+	for d := 3; d <= config.NumDrives; d++ {
+		want = append(want, fmt.Sprintf("%2d  -   ", d))
+	}
+	want = append(want, "messages 4  invalid 2  unknown 0  overruns 0  timeouts 1")
+	if !screen.hidden {
+		t.Error("cursor shown while drawing")
+	}
+	if len(screen.screen) != len(want) {
+		t.Fatalf("screen:\n%s\nwant %d lines", strings.Join(screen.screen, "\n"), len(want))
+	}
+	for i := range want {
+		if screen.screen[i] != want[i] {
+			t.Errorf("line %d: %q, want %q", i+1, screen.screen[i], want[i])
+		}
+	}
+
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if screen.hidden || screen.row != len(want) {
+		t.Errorf("after Close: cursor hidden %v on row %d, want shown on row %d", screen.hidden, screen.row+1, len(want)+1)
+	}
+}
+
+// TestRedraw checks a redraw rewrites only the lines that changed, that
+// Tick paces redraws to FrameRate unless forced, and that the screen
+// always matches a fresh draw.
+func TestRedraw(t *testing.T) {
+	screen := &term{}
+	v := New(screen, &nop{}, nil, nil)
+	frame := time.Second / FrameRate
+	v.Tick(0, false)
+
+	screen.rewrote = nil
+	v.HandleDeviceMessage(3, config.DevCmdNoteOn, []byte{60})
+	v.Tick(frame/2, false)
+	if len(screen.rewrote) != 0 {
+		t.Errorf("redrew rows %v before a frame was due", screen.rewrote)
+	}
+	v.Tick(frame, false)
+	// The clock on the status line, drive 3, and the message count.
+	if want := []int{0, 3, config.NumDrives + 1}; fmt.Sprint(screen.rewrote) != fmt.Sprint(want) {
+		t.Errorf("rewrote rows %v, want %v", screen.rewrote, want)
+	}
+
+	screen.rewrote = nil
+	v.Tick(frame, true)
+	if len(screen.rewrote) != 0 {
+		t.Errorf("forced redraw with nothing changed rewrote rows %v", screen.rewrote)
+	}
+	v.HandleDeviceMessage(0, config.DevCmdNoteOff, nil)
+	v.Tick(frame, true) // the same time, so the clock stands still
+	if want := []int{3, config.NumDrives + 1}; fmt.Sprint(screen.rewrote) != fmt.Sprint(want) {
+		t.Errorf("forced redraw rewrote rows %v, want %v", screen.rewrote, want)
+	}
+
+	fresh := &term{}
+	w := New(fresh, &nop{}, nil, nil)
+	w.note, w.messages = v.note, v.messages
+	w.Draw(frame)
+	if strings.Join(fresh.screen, "\n") != strings.Join(screen.screen, "\n") {
+		t.Errorf("screen after redraws:\n%s\nfresh draw:\n%s", strings.Join(screen.screen, "\n"), strings.Join(fresh.screen, "\n"))
+	}
+}
@@ -0,0 +1,175 @@
+// Package status blinks a single LED to show what the firmware is doing:
+// lit solid while it boots, a slow heartbeat while idle, a flicker as
+// messages arrive, a fast blink after a bad frame or message, and a long
+// on, short off while a reset sweep runs.
+//
+// The LED owns its pin, config.StatusLEDPin on the board. The networks and
+// instruments code tell it what is happening with SetState; Tick, from
+// the timer interrupt, blinks the pattern of the state:
+//
+//	led := status.New(config.StatusLEDPin, status.DefaultPatterns)
+//	led.Setup()
+//	floppy.SetStatusLED(led)
+//	floppy.Setup()
+//	instruments.InitTimer(config.TimerResolution, func() {
+//		floppy.Tick()
+//		led.Tick()
+//	})
+//	serial := networks.NewSerial(floppy)
+//	serial.SetStatusLED(led)
+//	led.SetState(status.Idle)
+//
+// as main does when the board has the LED.
+//
+// The patterns are data, a Pattern per state, so a board can blink its
+// own by passing New other Patterns.
+package status
+
+import (
+	"github.com/ystepanoff/goppy/firmware/hal"
+	"github.com/ystepanoff/goppy/firmware/notes"
+)
+
+// State is what the LED shows.
+type State byte
+
+const (
+	Booting   State = iota // from Setup until the firmware is ready
+	Idle                   // waiting for music
+	Receiving              // messages arriving; shown over Idle only
+	Fault                  // a bad frame or message, or a drive fault
+	Resetting              // a reset sweep running
+	numStates
+)
+
+// Pattern is how the LED blinks in a state: lit for the first OnMs of
+// every PeriodMs. With a PeriodMs of 0 it stays lit, or dark with an OnMs
+// of 0 too. A state with a HoldMs goes back to Idle that long after it was
+// last set.
+type Pattern struct {
+	PeriodMs uint16
+	OnMs     uint16
+	HoldMs   uint16
+}
+
+// Patterns are a Pattern per State.
+type Patterns [numStates]Pattern
+
+// DefaultPatterns are the patterns the firmware blinks unless the board
+// gives New its own.
+var DefaultPatterns = Patterns{
+	Booting:   {OnMs: 1},
+	Idle:      {PeriodMs: 2000, OnMs: 60},
+	Receiving: {PeriodMs: 80, OnMs: 40, HoldMs: 250},
+	Fault:     {PeriodMs: 200, OnMs: 100, HoldMs: 3000},
+	Resetting: {PeriodMs: 800, OnMs: 600},
+}
+
+// LED blinks a pin as the state it was last set to says.
+//
+// SetState runs in the main loop, with or without interrupts held off, or
+// in the timer interrupt itself, and Tick in the timer interrupt: SetState
+// only leaves the state for the next Tick, a byte at a time, as Display
+// does its frames, so neither waits on the other. A state set in the
+// interrupt as the main loop sets another may be lost; the next one is
+// shown.
+type LED struct {
+	pin      hal.Pin
+	patterns Patterns
+
+	// Left by SetState for Tick: the state asked for, and a count of the
+	// calls, so a state asked for again renews its hold.
+	want  State
+	asked byte
+
+	// Kept by Tick.
+	state State
+	seen  byte   // asked, as of the last look
+	ticks uint16 // towards the next millisecond
+	phase uint16 // milliseconds into the period
+	held  uint16 // since the state was last set
+	lit   bool
+}
+
+// New returns an LED on pin blinking patterns, lit solid as Booting until
+// set otherwise.
+func New(pin hal.Pin, patterns Patterns) *LED {
+	return &LED{pin: pin, patterns: patterns}
+}
+
+// Setup makes the pin an output and shows the Booting pattern's start.
+func (l *LED) Setup() {
+	l.pin.Configure(hal.PinConfig{Mode: hal.PinOutput})
+	l.lit = litAt(l.patterns[Booting], 0)
+	l.pin.Set(l.lit)
+}
+
+// SetState shows s from the next millisecond on. Receiving is only shown
+// over Idle or itself, so a fault or a reset sweep isn't lost in a stream
+// of messages. A nil LED ignores it, for code with no LED to tell.
+func (l *LED) SetState(s State) {
+	if l == nil || s >= numStates {
+		return
+	}
+	if s == Receiving && (!underReceiving(l.state) || l.asked != l.seen && !underReceiving(l.want)) {
+		return // nor lose a state Tick has yet to show
+	}
+	l.want = s
+	l.asked++
+}
+
+// State returns what the LED is showing.
+func (l *LED) State() State {
+	return l.state
+}
+
+// Tick advances the pattern. Called by the timer interrupt at
+// TimerResolution intervals; it only does work once a millisecond.
+func (l *LED) Tick() {
+	l.ticks++
+	if l.ticks < notes.TicksPerMs {
+		return
+	}
+	l.ticks = 0
+
+	if l.asked != l.seen {
+		l.seen = l.asked
+		if s := l.want; s != Receiving || l.state == Idle || l.state == Receiving {
+			if s != l.state {
+				l.state, l.phase = s, 0
+			}
+			l.held = 0
+		}
+	}
+	p := l.patterns[l.state]
+	if p.HoldMs != 0 && l.held >= p.HoldMs {
+		l.state, l.phase, l.held = Idle, 0, 0
+		p = l.patterns[Idle]
+	}
+	if l.held < 0xFFFF {
+		l.held++
+	}
+
+	if lit := litAt(p, l.phase); lit != l.lit {
+		l.lit = lit
+		l.pin.Set(lit)
+	}
+	l.phase++
+	if l.phase >= p.PeriodMs {
+		l.phase = 0
+	}
+}
+
+// litAt reports whether p has the LED lit phase milliseconds into its
+// period.
+func litAt(p Pattern, phase uint16) bool {
+	if p.PeriodMs == 0 {
+		return p.OnMs != 0
+	}
+	return phase < p.OnMs
+}
+
+// underReceiving reports whether Receiving may be shown over s.
+func underReceiving(s State) bool {
+	return s == Idle || s == Receiving
+}
@@ -0,0 +1,175 @@
+//go:build !tinygo
+
+package status_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/fakeclock"
+	"github.com/ystepanoff/goppy/firmware/hal"
+	"github.com/ystepanoff/goppy/firmware/status"
+)
+
+const pin hal.Pin = 200
+
+// edge is the LED lit or put out, and when.
+type edge struct {
+	at  time.Duration
+	lit bool
+}
+
+// clocked returns an LED set up on pin, ticked by a fake clock, and the
+// edges it makes from then on.
+func clocked(t *testing.T, patterns status.Patterns) (*status.LED, *fakeclock.Clock, *[]edge) {
+	pin.Low()
+	clock := fakeclock.New()
+	var edges []edge
+	hal.OnChange = func(p hal.Pin, high bool) {
+		if p == pin {
+			edges = append(edges, edge{clock.Now(), high})
+		}
+	}
+	t.Cleanup(func() { hal.OnChange = nil })
+	led := status.New(pin, patterns)
+	led.Setup()
+	clock.Start(config.TimerResolution, led.Tick)
+	return led, clock, &edges
+}
+
+// since returns the edges from at on, with their times from at.
+func since(edges []edge, at time.Duration) []edge {
+	var out []edge
+	for _, e := range edges {
+		if e.at >= at {
+			out = append(out, edge{e.at - at, e.lit})
+		}
+	}
+	return out
+}
+
+func equal(a, b []edge) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+const ms = time.Millisecond
+
+// TestPatterns blinks each state's default pattern.
+func TestPatterns(t *testing.T) {
+	led, clock, edges := clocked(t, status.DefaultPatterns)
+	if len(*edges) != 1 || !(*edges)[0].lit {
+		t.Fatalf("edges %v at Setup, want lit for Booting", *edges)
+	}
+	clock.AdvanceMs(5000)
+	if len(*edges) != 1 || led.State() != status.Booting {
+		t.Errorf("edges %v while booting, want it lit solid", *edges)
+	}
+
+	tests := []struct {
+		state status.State
+		want  []edge // from the first millisecond after SetState, for 2.5s
+	}{
+		// Lit already, from Booting.
+		{status.Idle, []edge{{60 * ms, false}, {2000 * ms, true}, {2060 * ms, false}}},
+		// Dark, 440ms into the heartbeat's period.
+		{status.Resetting, []edge{{0, true}, {600 * ms, false}, {800 * ms, true}, {1400 * ms, false}, {1600 * ms, true}, {2200 * ms, false}, {2400 * ms, true}}},
+	}
+	for _, tt := range tests {
+		start := clock.Now() + ms
+		*edges = nil
+		led.SetState(tt.state)
+		clock.AdvanceMs(2500)
+		if got := since(*edges, start); !equal(got, tt.want) {
+			t.Errorf("state %d: edges %v, want %v", tt.state, got, tt.want)
+		}
+		if led.State() != tt.state {
+			t.Errorf("state %d, want %d", led.State(), tt.state)
+		}
+	}
+}
+
+// TestHold shows a fault for its hold, renewed while faults keep coming,
+// and the receiving flicker only over the heartbeat.
+func TestHold(t *testing.T) {
+	led, clock, edges := clocked(t, status.DefaultPatterns)
+	led.SetState(status.Idle)
+	clock.AdvanceMs(100)
+
+	// Messages flicker the LED 40ms on, 40ms off, and it goes back to
+	// idle 250ms after the last.
+	start := clock.Now()
+	led.SetState(status.Receiving)
+	clock.AdvanceMs(100)
+	led.SetState(status.Receiving)
+	clock.AdvanceMs(200)
+	if led.State() != status.Receiving {
+		t.Fatalf("state %d 200ms after a message, want Receiving", led.State())
+	}
+	clock.AdvanceMs(100)
+	if led.State() != status.Idle {
+		t.Errorf("state %d 300ms after the last message, want Idle", led.State())
+	}
+	if got := since(*edges, start); len(got) < 8 || got[1].at-got[0].at != 40*ms || got[2].at-got[1].at != 40*ms {
+		t.Errorf("edges %v, want a 40ms flicker", got)
+	}
+
+	// A fault blinks for 3s after the last, and messages don't hide it.
+	led.SetState(status.Fault)
+	clock.AdvanceMs(2000)
+	led.SetState(status.Fault)
+	led.SetState(status.Receiving)
+	clock.AdvanceMs(2900)
+	if led.State() != status.Fault {
+		t.Fatalf("state %d 2.9s after a fault, with messages since, want Fault", led.State())
+	}
+	start = clock.Now()
+	clock.AdvanceMs(200)
+	if led.State() != status.Idle {
+		t.Errorf("state %d 3.1s after the last fault, want Idle", led.State())
+	}
+	if got := since(*edges, start); len(got) == 0 || got[len(got)-1].lit {
+		t.Errorf("edges %v back to idle, want the heartbeat's dark", got)
+	}
+
+	// Nor does a reset sweep end for them.
+	led.SetState(status.Resetting)
+	led.SetState(status.Receiving)
+	clock.AdvanceMs(5000)
+	if led.State() != status.Resetting {
+		t.Errorf("state %d during a reset sweep, want Resetting", led.State())
+	}
+	var none *status.LED
+	none.SetState(status.Fault) // no LED to tell
+}
+
+// TestCustomPatterns blinks a board's own patterns.
+func TestCustomPatterns(t *testing.T) {
+	patterns := status.DefaultPatterns
+	patterns[status.Booting] = status.Pattern{}
+	patterns[status.Idle] = status.Pattern{PeriodMs: 10, OnMs: 5}
+	patterns[status.Fault] = status.Pattern{OnMs: 1, HoldMs: 20}
+	led, clock, edges := clocked(t, patterns)
+	if len(*edges) != 0 {
+		t.Errorf("edges %v at Setup, want a dark boot", *edges)
+	}
+	led.SetState(status.Fault)
+	clock.AdvanceMs(20)
+	if led.State() != status.Fault {
+		t.Errorf("state %d, want Fault for its 20ms hold", led.State())
+	}
+	// Lit through the hold, and on into the heartbeat's first 5ms.
+	clock.AdvanceMs(15)
+	want := []edge{{ms, true}, {26 * ms, false}, {31 * ms, true}}
+	if !equal(*edges, want) || led.State() != status.Idle {
+		t.Errorf("edges %v, state %d, want %v, Idle", *edges, led.State(), want)
+	}
+}
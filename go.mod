@@ -8,3 +8,7 @@ require (
 	github.com/creack/goselect v0.1.2 // indirect
 	golang.org/x/sys v0.21.0 // indirect
 )
+
+require github.com/ystepanoff/goppy/firmware v0.0.0
+
+replace github.com/ystepanoff/goppy/firmware => ./firmware
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/fakeclock"
+	"github.com/ystepanoff/goppy/firmware/hal"
+	"github.com/ystepanoff/goppy/firmware/instruments"
+	"github.com/ystepanoff/goppy/firmware/networks"
+	"github.com/ystepanoff/goppy/firmware/notes"
+	"github.com/ystepanoff/goppy/internal/protocol"
+	"github.com/ystepanoff/goppy/internal/smf"
+	"go.bug.st/serial"
+)
+
+// The integration harness joins the host commands to the firmware built
+// for the host: a link carries bytes between a serial.Port for the host
+// side and a networks.Port for the firmware, which runs FloppyDrives
+// behind the real parser. Time is a fake clock ticking the firmware;
+// nothing sleeps. Every edge on a drive's pins lands on a timeline the
+// tests assert over.
+
+const tick = config.TimerResolution * time.Microsecond
+
+// errClosed is what the host side gets once the link is cut.
+var errClosed = errors.New("link closed")
+
+// edge is one change on a drive's pins.
+type edge struct {
+	tick  uint32
+	drive byte
+	dir   bool // the direction line rather than the step line
+}
+
+// rig is the firmware end of the link and everything behind it.
+type rig struct {
+	t      *testing.T
+	drives *instruments.FloppyDrives
+	serial *networks.Serial
+	clock  *fakeclock.Clock
+
+	toDevice []byte // written by the host, not yet read by the firmware
+	toHost   []byte // written by the firmware, not yet read by the host
+	cut      bool
+
+	timeline []edge
+	pins     [256]edge // the edge each pin makes, tick aside
+}
+
+// newRig starts the firmware with every head at 0 and every line low, as
+// after a reset, and records its pins until the test ends.
+func newRig(t *testing.T) *rig {
+	for p := config.FirstPin; p < config.FirstPin+2*config.NumDrives; p++ {
+		hal.Pin(p).Low()
+	}
+	r := &rig{t: t, drives: instruments.NewFloppyDrives(), clock: fakeclock.New()}
+	r.serial = networks.NewSerialPort(r.drives, (*firmwarePort)(r))
+	r.drives.SetTicker(r.clock)
+	r.clock.Start(config.TimerResolution, r.drives.Tick)
+	for d := byte(1); d <= config.NumDrives; d++ {
+		if config.SharedDirPin != 0 {
+			r.pins[config.FirstPin+(d-1)] = edge{drive: d}
+		} else {
+			r.pins[config.FirstPin+(d-1)*2] = edge{drive: d}
+			r.pins[config.FirstPin+(d-1)*2+1] = edge{drive: d, dir: true}
+		}
+	}
+	hal.OnChange = func(p hal.Pin, high bool) {
+		if e := r.pins[p]; e.drive != 0 {
+			e.tick = r.ticks()
+			r.timeline = append(r.timeline, e)
+		}
+	}
+	t.Cleanup(func() { hal.OnChange = nil })
+	return r
+}
+
+// run reads whatever has arrived, then runs n ticks, reading again after
+// each as the main loop would.
+func (r *rig) run(n uint32) {
+	r.serial.ReadMessages()
+	for i := uint32(0); i < n; i++ {
+		r.clock.AdvanceTicks(1)
+		r.serial.ReadMessages()
+	}
+}
+
+// ticks returns how many ticks have run.
+func (r *rig) ticks() uint32 { return uint32(r.clock.Ticks()) }
+
+// runUntil runs up to the tick due at offset at.
+func (r *rig) runUntil(at time.Duration) {
+	if due := uint32(at / tick); due > r.ticks() {
+		r.run(due - r.ticks())
+	}
+	r.serial.ReadMessages()
+}
+
+// steps returns the ticks at which drive stepped in [from, to).
+func (r *rig) steps(drive byte, from, to uint32) []uint32 {
+	var ticks []uint32
+	for _, e := range r.timeline {
+		if e.drive == drive && !e.dir && e.tick >= from && e.tick < to {
+			ticks = append(ticks, e.tick)
+		}
+	}
+	return ticks
+}
+
+// host returns the host end of the link.
+func (r *rig) host() serial.Port { return (*hostPort)(r) }
+
+// firmwarePort is the rig seen by the firmware's parser.
+type firmwarePort rig
+
+func (p *firmwarePort) Buffered() int { return len(p.toDevice) }
+
+func (p *firmwarePort) Read(b []byte) (int, error) {
+	n := copy(b, p.toDevice)
+	p.toDevice = p.toDevice[n:]
+	return n, nil
+}
+
+func (p *firmwarePort) Write(b []byte) (int, error) {
+	if !p.cut {
+		p.toHost = append(p.toHost, b...)
+	}
+	return len(b), nil
+}
+
+// hostPort is the rig seen by the host commands. A read with nothing
+// waiting lets the firmware catch up, for a millisecond at most, before
+// giving up with io.EOF, as a read timeout would.
+type hostPort rig
+
+func (p *hostPort) Read(b []byte) (int, error) {
+	r := (*rig)(p)
+	for i := 0; len(r.toHost) == 0 && i < notes.TicksPerMs; i++ {
+		r.run(1)
+	}
+	if len(r.toHost) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, r.toHost)
+	r.toHost = r.toHost[n:]
+	return n, nil
+}
+
+func (p *hostPort) Write(b []byte) (int, error) {
+	if p.cut {
+		return 0, errClosed
+	}
+	p.toDevice = append(p.toDevice, b...)
+	return len(b), nil
+}
+
+func (p *hostPort) Close() error {
+	p.cut = true
+	return nil
+}
+
+func (p *hostPort) SetMode(*serial.Mode) error { return nil }
+func (p *hostPort) Drain() error               { return nil }
+func (p *hostPort) ResetInputBuffer() error    { p.toHost = nil; return nil }
+func (p *hostPort) ResetOutputBuffer() error   { return nil }
+func (p *hostPort) SetDTR(bool) error          { return nil }
+func (p *hostPort) SetRTS(bool) error          { return nil }
+func (p *hostPort) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return &serial.ModemStatusBits{}, nil
+}
+func (p *hostPort) SetReadTimeout(time.Duration) error { return nil }
+func (p *hostPort) Break(time.Duration) error          { return nil }
+
+// play sends song to the rig the way goppy play does, keeping the
+// firmware's clock in step with the song's.
+func (r *rig) play(song []smf.NoteEvent) {
+	port := r.host()
+	allocator := newDriveAllocator(1, config.NumDrives)
+	wait := func(at time.Duration) bool {
+		r.runUntil(at)
+		return true
+	}
+	write := func(frame []byte) error {
+		_, err := port.Write(frame)
+		return err
+	}
+	if _, err := playEvents(song, config.DeviceAddress, allocator, 30*time.Millisecond, wait, write); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+func TestIntegrationDiscovery(t *testing.T) {
+	r := newRig(t)
+	if err := pingAndPrint(r.host()); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	if len(r.toHost) != 0 {
+		t.Errorf("% X left unread after the pong", r.toHost)
+	}
+	if len(r.timeline) != 0 {
+		t.Errorf("a ping moved the drives: %+v", r.timeline)
+	}
+}
+
+// TestIntegrationStatus asks the firmware how it is mid-song, paused and
+// after a bad frame.
+func TestIntegrationStatus(t *testing.T) {
+	r := newRig(t)
+	port := r.host()
+	for _, frame := range [][]byte{
+		protocol.SequenceStart(),
+		protocol.NoteOn(config.DeviceAddress, 1, 57, 80),
+		protocol.NoteOn(config.DeviceAddress, 3, 64, 80),
+	} {
+		port.Write(frame)
+	}
+	r.run(1500 * notes.TicksPerMs)
+	statuses, err := readStatus(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := protocol.Status{DeviceAddress: config.DeviceAddress, Uptime: time.Second, Sounding: 2, Drives: []byte{1, 3}, Sequence: protocol.SequencePlaying}
+	if len(statuses) != 1 || !reflect.DeepEqual(statuses[0], want) {
+		t.Errorf("status %+v, want %+v", statuses, want)
+	}
+
+	port.Write(protocol.AllNotesOff(config.DeviceAddress))
+	port.Write([]byte{config.StartByte, config.DeviceAddress, 1, 0})
+	statuses, err = readStatus(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = protocol.Status{DeviceAddress: config.DeviceAddress, Uptime: time.Second, Sequence: protocol.SequencePaused, Fault: protocol.FaultEmptyFrame}
+	if len(statuses) != 1 || !reflect.DeepEqual(statuses[0], want) {
+		t.Errorf("status %+v, want %+v", statuses, want)
+	}
+}
+
+func TestIntegrationNoteSequence(t *testing.T) {
+	r := newRig(t)
+	ms := time.Millisecond
+	song := []smf.NoteEvent{
+		{At: 0, Kind: smf.EventNoteOn, Note: 57, Velocity: 80},
+		{At: 100 * ms, Kind: smf.EventNoteOn, Note: 64, Velocity: 80},
+		{At: 200 * ms, Kind: smf.EventNoteOff, Note: 57},
+		{At: 300 * ms, Kind: smf.EventNoteOff, Note: 64},
+	}
+	r.play(song)
+	r.run(100 * notes.TicksPerMs)
+
+	// The allocator takes turns, so the first note lands on drive 1 and
+	// the second on drive 2.
+	at := func(d time.Duration) uint32 { return uint32(d / tick) }
+	tests := []struct {
+		drive    byte
+		note     byte
+		from, to time.Duration
+	}{
+		{1, 57, 0, 200 * ms},
+		{2, 64, 100 * ms, 300 * ms},
+	}
+	for _, tt := range tests {
+		steps := r.steps(tt.drive, 0, r.ticks())
+		if len(steps) < 2 {
+			t.Fatalf("drive %d stepped %d times", tt.drive, len(steps))
+		}
+		// Each note starts on the tick its frame arrives and stops at its
+		// note-off.
+		period := uint32(notes.NoteDoubleTicks[tt.note])
+		first, last := steps[0], steps[len(steps)-1]
+		if first < at(tt.from) || first > at(tt.from)+period {
+			t.Errorf("drive %d first stepped at tick %d, want within a period of %d", tt.drive, first, at(tt.from))
+		}
+		if last >= at(tt.to) {
+			t.Errorf("drive %d still stepping at tick %d, after its note-off at %d", tt.drive, last, at(tt.to))
+		}
+		// And at its note's rate.
+		for i := 1; i < len(steps); i++ {
+			if gap := steps[i] - steps[i-1]; gap != period {
+				t.Errorf("drive %d stepped %d ticks apart, want %d", tt.drive, gap, period)
+				break
+			}
+		}
+	}
+	if d1, d2 := r.steps(1, 0, r.ticks()), r.steps(2, 0, r.ticks()); d1[0] >= d2[0] {
+		t.Errorf("drive 2 started at tick %d, before drive 1 at %d", d2[0], d1[0])
+	}
+}
+
+func TestIntegrationDisconnectWatchdog(t *testing.T) {
+	if config.LinkWatchdogMs == 0 {
+		t.Skip("link watchdog disabled in config")
+	}
+	r := newRig(t)
+	port := r.host()
+	if err := sendDriveCmds(func(frame []byte) error {
+		_, err := port.Write(frame)
+		return err
+	}, config.DeviceAddress, []driveCmd{{drive: 1, note: 57, on: true}}); err != nil {
+		t.Fatal(err)
+	}
+	// A note-on alone isn't a sequence: the watchdog leaves it be.
+	r.run(2 * config.LinkWatchdogMs * notes.TicksPerMs)
+	if len(r.steps(1, r.ticks()-notes.TicksPerMs*10, r.ticks())) == 0 {
+		t.Fatal("a note outside a sequence was silenced")
+	}
+
+	// Mid-song, the controller goes away.
+	port.Write(protocol.SequenceStart())
+	r.run(notes.TicksPerMs)
+	cutAt := r.ticks()
+	port.Close()
+	if _, err := port.Write(protocol.SequenceStop()); err == nil {
+		t.Fatal("write after close succeeded")
+	}
+
+	// The firmware looks at the link every 256 ticks, so the watchdog
+	// fires up to that late.
+	const slack = 256
+	watchdog := uint32(config.LinkWatchdogMs * notes.TicksPerMs)
+	r.run(watchdog + 2*slack)
+	steps := r.steps(1, cutAt, r.ticks())
+	if len(steps) == 0 {
+		t.Fatal("the note stopped as soon as the link went")
+	}
+	if last := steps[len(steps)-1]; last-cutAt < watchdog-slack || last-cutAt > watchdog+slack {
+		t.Errorf("note stopped %d ticks after the link went, want about %d", last-cutAt, watchdog)
+	}
+	if got := r.drives.Stats.LinkTimeouts; got != 1 {
+		t.Errorf("LinkTimeouts = %d, want 1", got)
+	}
+}
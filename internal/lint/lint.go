@@ -0,0 +1,420 @@
+// Package lint checks a Moppy byte stream, as goppy sends it to a device,
+// against the protocol, frame by frame.
+//
+// Frames are found by the firmware's own parser, networks.Serial, built
+// with the current firmware config, and checked against the firmware's
+// config constants, so the rules can't drift from what the device does.
+// Each violation carries the offset of the byte at fault, a severity and
+// a rule name:
+//
+//	noise            bytes outside any frame, skipped by the parser
+//	other-device     a frame for another device address, not checked
+//	start-in-frame   a start byte inside another device's frame, which
+//	                 the parser takes for the start of a new one
+//	reserved-sub     a sub address the firmware doesn't answer to
+//	empty-frame      a frame of size 0, without a command
+//	truncated        a frame the stream ends in the middle of
+//	system-sub       a system frame with a sub address other than 0
+//	reply-command    a device-to-host reply sent to the device
+//	unknown-command  a command the firmware doesn't know
+//	payload-length   a payload too short to act on, or with extra bytes
+//	value-range      a payload value the firmware rejects or clamps
+//	unknown-option   a DevCmdSetOption option the firmware doesn't know
+//	instrument       a command only some instruments understand
+//
+// An error is a frame the device drops or misreads, a warning one it acts
+// on other than as the sender likely meant, and info something worth
+// knowing that is allowed.
+package lint
+
+import (
+	"fmt"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/networks"
+	"github.com/ystepanoff/goppy/firmware/networks/networkstest"
+)
+
+// Severity is how bad a Violation is.
+type Severity string
+
+const (
+	Info    Severity = "info"
+	Warning Severity = "warning"
+	Error   Severity = "error"
+)
+
+// Violation is one broken rule.
+type Violation struct {
+	Offset   int      `json:"offset"` // of the byte at fault, from the start of the stream
+	Severity Severity `json:"severity"`
+	Rule     string   `json:"rule"`
+	Message  string   `json:"message"`
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("offset %d: %s: %s [%s]", v.Offset, v.Severity, v.Message, v.Rule)
+}
+
+// Result is what Check found in a stream.
+type Result struct {
+	Bytes      int         `json:"bytes"`
+	Frames     int         `json:"frames"`
+	Violations []Violation `json:"violations"`
+}
+
+// Count returns how many of r's violations are of severity s.
+func (r Result) Count(s Severity) int {
+	n := 0
+	for _, v := range r.Violations {
+		if v.Severity == s {
+			n++
+		}
+	}
+	return n
+}
+
+// Check lints a whole stream.
+func Check(stream []byte) Result {
+	r := Result{Violations: []Violation{}}
+	l := New(func(v Violation) { r.Violations = append(r.Violations, v) })
+	l.Write(stream)
+	l.End()
+	r.Bytes, r.Frames = l.Bytes, l.Frames
+	return r
+}
+
+// Linter lints a stream as it arrives, handing each violation to a report
+// function. It is an io.Writer, to copy a live stream into.
+type Linter struct {
+	// Bytes and Frames count the bytes read and the frames the parser
+	// accepted.
+	Bytes, Frames int
+
+	report func(Violation)
+	port   *networkstest.MockPort
+	parser *networks.Serial
+
+	frame []byte // the frame being read, from its start byte
+	start int    // its offset
+
+	// dropped is the offset of a frame the parser dropped after its
+	// address, until its size is read; -1 otherwise. Its bytes, up to
+	// quietUntil, are skipped by the parser but aren't noise.
+	dropped    int
+	quietUntil int
+
+	noise *Violation // the run of noise being read, reported when it ends
+}
+
+// New returns a Linter that calls report with each violation, in order.
+func New(report func(Violation)) *Linter {
+	l := &Linter{report: report, port: networkstest.NewMockPort(), dropped: -1}
+	l.parser = networks.NewSerialPort(discard{}, l.port)
+	return l
+}
+
+// discard is the parser's consumer: frames are checked from their bytes.
+type discard struct{}
+
+func (discard) HandleSystemMessage(byte, []byte)       {}
+func (discard) HandleDeviceMessage(byte, byte, []byte) {}
+
+// Write lints p, a byte at a time. It never fails.
+func (l *Linter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		l.step(b)
+	}
+	return len(p), nil
+}
+
+// End reports the noise or the frame the stream ended in.
+func (l *Linter) End() {
+	l.endNoise()
+	if l.parser.Pending() > 0 {
+		l.violation(l.start, Error, "truncated", fmt.Sprintf("the stream ends %d bytes into a frame (% x)", len(l.frame), l.frame))
+	}
+}
+
+func (l *Linter) violation(at int, sev Severity, rule, msg string) {
+	l.report(Violation{Offset: at, Severity: sev, Rule: rule, Message: msg})
+}
+
+// step feeds the parser one byte and makes sense of what it did with it
+// from its frame position and counters.
+func (l *Linter) step(b byte) {
+	i := l.Bytes
+	l.Bytes++
+	before, stats := l.parser.Pending(), l.parser.Stats
+	l.port.Feed(b)
+	l.parser.ReadMessages()
+	l.port.Written = l.port.Written[:0]
+	after, st := l.parser.Pending(), l.parser.Stats
+
+	if st.SkippedBytes != stats.SkippedBytes {
+		if i >= l.quietUntil {
+			l.addNoise(i)
+		}
+	} else {
+		l.endNoise()
+	}
+
+	switch {
+	case before == 0 && after > 0:
+		if i < l.quietUntil {
+			l.violation(i, Warning, "start-in-frame",
+				"start byte inside a frame for another device: this device's parser resynchronises on it")
+		}
+		l.frame, l.start = append(l.frame[:0], b), i
+	case before > 0:
+		l.frame = append(l.frame, b)
+	}
+
+	if l.dropped >= 0 && i == l.dropped+3 {
+		l.quietUntil = l.dropped + 4 + int(b)
+		l.dropped = -1
+	}
+
+	switch {
+	case st.OtherDevice != stats.OtherDevice:
+		l.violation(i, Info, "other-device", fmt.Sprintf("frame for device %d, not this one (%d): not checked", b, config.DeviceAddress))
+		l.drop(i - 1)
+	case st.BadSubAddress != stats.BadSubAddress:
+		l.violation(i, Error, "reserved-sub", fmt.Sprintf("sub address 0x%02x is neither 0, a drive (%d..%d) nor a zone (0x%02x..0x%02x): the frame is dropped",
+			b, config.MinSubAddress, config.MaxSubAddress, config.ZoneSubAddress, config.ZoneSubAddress+config.MaxZones-1))
+		l.drop(i - 2)
+	case st.EmptyFrames != stats.EmptyFrames:
+		l.violation(l.start+3, Error, "empty-frame", "frame of size 0 has no command: the frame is dropped")
+	case st.Frames != stats.Frames:
+		l.Frames++
+		for _, f := range checkFrame(l.frame) {
+			l.violation(l.start+f.at, f.severity, f.rule, f.message)
+		}
+	}
+}
+
+// drop notes that the parser dropped the frame starting at offset start,
+// whose remaining bytes it will skip. A frame that only started inside
+// another device's frame isn't one: that frame's end still holds.
+func (l *Linter) drop(start int) {
+	if start < l.quietUntil {
+		return
+	}
+	l.dropped = start
+	l.quietUntil = start + 4
+}
+
+func (l *Linter) addNoise(i int) {
+	if l.noise == nil {
+		l.noise = &Violation{Offset: i, Severity: Warning, Rule: "noise"}
+	}
+	l.noise.Message = fmt.Sprintf("%d bytes outside any frame, skipped", i-l.noise.Offset+1)
+}
+
+func (l *Linter) endNoise() {
+	if l.noise != nil {
+		l.report(*l.noise)
+		l.noise = nil
+	}
+}
+
+// finding is a violation within a frame, at byte at of it.
+type finding struct {
+	at       int
+	severity Severity
+	rule     string
+	message  string
+}
+
+// command describes what a command takes: a payload of min to max bytes
+// after the command byte, and check, if set, for the values in a payload
+// of a valid length. Its findings are at offsets within the payload.
+type command struct {
+	name     string
+	min, max int
+	check    func(p []byte) []finding
+}
+
+var systemCommands = map[byte]command{
+	config.CmdPing:          {name: "ping"},
+	config.CmdGetConfig:     {name: "get config"},
+	config.CmdGetPositions:  {name: "get positions"},
+	config.CmdGetStatus:     {name: "get status"},
+	config.CmdSequenceStart: {name: "sequence start"},
+	config.CmdSequenceStop:  {name: "sequence stop"},
+	config.CmdReset:         {name: "reset"},
+}
+
+// replies are the system commands only a device sends.
+var replies = map[byte]string{
+	config.CmdPong:     "pong",
+	config.CmdConfig:   "config",
+	config.CmdPosition: "position",
+	config.CmdStatus:   "status",
+	config.CmdRoute:    "route",
+}
+
+var deviceCommands = map[byte]command{
+	config.DevCmdReset:   {name: "reset"},
+	config.DevCmdNoteOff: {name: "note off", max: 1, check: checkNotes(0)},
+	config.DevCmdNoteOn: {name: "note on", min: 1, max: 2, check: func(p []byte) []finding {
+		fs := checkNotes(0)(p)
+		if len(p) > 1 && p[1] > 127 {
+			fs = append(fs, finding{1, Warning, "value-range", fmt.Sprintf("velocity %d is above 127", p[1])})
+		}
+		return fs
+	}},
+	config.DevCmdBendPitch: {name: "pitch bend", min: 2, max: 2, check: func(p []byte) []finding {
+		if bend := int16(uint16(p[0])<<8 | uint16(p[1])); bend < -8192 || bend > 8191 {
+			return []finding{{0, Warning, "value-range", fmt.Sprintf("bend %+d is outside -8192..8191", bend)}}
+		}
+		return nil
+	}},
+	config.DevCmdGliss: {name: "gliss", min: 4, max: 5, check: func(p []byte) []finding {
+		fs := checkNotes(0, 1)(p)
+		if len(p) > 4 && p[4]&^config.GlissFlagSmooth != 0 {
+			fs = append(fs, finding{4, Warning, "value-range", fmt.Sprintf("flags 0x%02x set bits other than GlissFlagSmooth", p[4])})
+		}
+		return fs
+	}},
+	config.DevCmdTranspose: {name: "transpose", min: 1, max: 1},
+	config.DevCmdDetune: {name: "detune", min: 1, max: 1, check: func(p []byte) []finding {
+		if int8(p[0]) == -128 {
+			return []finding{{0, Warning, "value-range", "detune -128 cents is outside -127..127"}}
+		}
+		return nil
+	}},
+	config.DevCmdBendRange: {name: "bend range", min: 1, max: 1, check: func(p []byte) []finding {
+		if p[0] < 1 || p[0] > config.MaxBendRange {
+			return []finding{{0, Error, "value-range", fmt.Sprintf("bend range %d is outside 1..%d: ignored", p[0], config.MaxBendRange)}}
+		}
+		return nil
+	}},
+	config.DevCmdTremolo: {name: "tremolo", min: 2, max: 2, check: func(p []byte) []finding {
+		if p[1] > 100 {
+			return []finding{{1, Warning, "value-range", fmt.Sprintf("duty %d%% is above 100%%", p[1])}}
+		}
+		return nil
+	}},
+	config.DevCmdChannelPressure: {name: "channel pressure", min: 1, max: 1, check: func(p []byte) []finding {
+		if p[0] > 127 {
+			return []finding{{0, Warning, "value-range", fmt.Sprintf("pressure %d is above 127", p[0])}}
+		}
+		return nil
+	}},
+	config.DevCmdTrill: {name: "trill", min: 3, max: 3, check: func(p []byte) []finding {
+		fs := checkNotes(0, 1)(p)
+		if p[2] == 0 {
+			fs = append(fs, finding{2, Error, "value-range", "trill rate 0ms is outside 1..255: ignored"})
+		}
+		return fs
+	}},
+	config.DevCmdFactoryReset: {name: "factory reset"},
+	config.DevCmdSetTravel: {name: "set travel", min: 2, max: 4, check: func(p []byte) []finding {
+		switch len(p) {
+		case 2:
+			if p[0] >= p[1] || p[1] > config.MaxPosition {
+				return []finding{{0, Error, "value-range", fmt.Sprintf("travel %d..%d needs min < max <= %d: ignored", p[0], p[1], config.MaxPosition)}}
+			}
+		case 3:
+			return []finding{{2, Error, "payload-length", "set travel takes 2 bytes, or 4 for a scanner, not 3: ignored by scanners"}}
+		case 4:
+			lo, hi := uint16(p[0])<<8|uint16(p[1]), uint16(p[2])<<8|uint16(p[3])
+			if lo >= hi {
+				return []finding{{0, Error, "value-range", fmt.Sprintf("travel %d..%d needs min < max: ignored", lo, hi)}}
+			}
+			if hi > config.MaxPosition {
+				return []finding{{0, Info, "instrument", fmt.Sprintf("travel up to %d is for scanners; drives refuse a max past %d", hi, config.MaxPosition)}}
+			}
+		}
+		return nil
+	}},
+	config.DevCmdSetZone: {name: "set zone", min: 4, max: 4, check: func(p []byte) []finding {
+		var fs []finding
+		if p[0] < 1 || p[0] > config.MaxZones {
+			fs = append(fs, finding{0, Error, "value-range", fmt.Sprintf("zone %d is outside 1..%d", p[0], config.MaxZones)})
+		}
+		if p[1] != 0 && (p[1] > p[2] || p[1] < config.MinSubAddress || p[2] > config.MaxSubAddress) {
+			fs = append(fs, finding{1, Error, "value-range", fmt.Sprintf("drives %d..%d are not a range of %d..%d", p[1], p[2], config.MinSubAddress, config.MaxSubAddress)})
+		}
+		if p[3] != config.ZoneUnison && p[3] != config.ZonePool && p[3] != config.ZonePoolLRU {
+			fs = append(fs, finding{3, Error, "value-range", fmt.Sprintf("zone mode %d is not unison, pool or pool-LRU", p[3])})
+		}
+		return fs
+	}},
+	config.DevCmdSustain:     {name: "sustain", min: 1, max: 1},
+	config.DevCmdSetMovement: {name: "set movement", min: 1, max: 1},
+	config.DevCmdSetOption: {name: "set option", min: 2, max: 2, check: func(p []byte) []finding {
+		switch {
+		case p[0] == config.OptPhraseMode:
+			return []finding{{0, Info, "instrument", "phrase mode only applies to scanners"}}
+		case p[0] == config.OptPulseWidth:
+			return []finding{{0, Info, "instrument", "pulse width only applies to interrupters"}}
+		case p[0] < config.OptDirCadence || p[0] > config.OptMovementClamp:
+			return []finding{{0, Warning, "unknown-option", fmt.Sprintf("option 0x%02x is unknown: ignored", p[0])}}
+		case p[0] == config.OptStartDelay && p[1] > config.MaxStartDelayMs:
+			return []finding{{1, Warning, "value-range", fmt.Sprintf("start delay %dms is clamped to %dms", p[1], config.MaxStartDelayMs)}}
+		}
+		return nil
+	}},
+}
+
+// checkNotes returns a check that the payload bytes at the given indexes,
+// where present, are MIDI notes.
+func checkNotes(indexes ...int) func([]byte) []finding {
+	return func(p []byte) []finding {
+		var fs []finding
+		for _, i := range indexes {
+			if i < len(p) && p[i] > 127 {
+				fs = append(fs, finding{i, Error, "value-range", fmt.Sprintf("note %d is above 127", p[i])})
+			}
+		}
+		return fs
+	}
+}
+
+// checkFrame checks a frame the parser accepted: start byte, addresses,
+// size, command and payload.
+func checkFrame(f []byte) []finding {
+	sub, cmd, p := f[2], f[4], f[5:]
+	var fs []finding
+	commands, what := deviceCommands, "device"
+	if f[1] == config.SystemAddress {
+		commands, what = systemCommands, "system"
+		if sub != 0 {
+			fs = append(fs, finding{2, Warning, "system-sub", fmt.Sprintf("system frame with sub address 0x%02x, not 0", sub)})
+		}
+		if name, ok := replies[cmd]; ok {
+			return append(fs, finding{4, Error, "reply-command", fmt.Sprintf("%s is a reply devices send, not a command: ignored", name)})
+		}
+	}
+	c, ok := commands[cmd]
+	if !ok {
+		return append(fs, finding{4, Error, "unknown-command", fmt.Sprintf("unknown %s command 0x%02x: ignored", what, cmd)})
+	}
+	switch {
+	case len(p) < c.min:
+		return append(fs, finding{3, Error, "payload-length", fmt.Sprintf("%s needs %s, got %d: ignored", c.name, payloadBytes(c), len(p))})
+	case len(p) > c.max:
+		fs = append(fs, finding{5 + c.max, Warning, "payload-length", fmt.Sprintf("%s takes %s, got %d: the rest is ignored", c.name, payloadBytes(c), len(p))})
+		p = p[:c.max]
+	}
+	if c.check != nil {
+		for _, x := range c.check(p) {
+			x.at += 5
+			fs = append(fs, x)
+		}
+	}
+	return fs
+}
+
+// payloadBytes describes how long c's payload is, for messages.
+func payloadBytes(c command) string {
+	switch {
+	case c.max == 0:
+		return "no payload"
+	case c.min == c.max:
+		return fmt.Sprintf("%d payload bytes", c.min)
+	}
+	return fmt.Sprintf("%d to %d payload bytes", c.min, c.max)
+}
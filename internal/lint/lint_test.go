@@ -0,0 +1,89 @@
+package lint
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ystepanoff/goppy/firmware/networks/capture"
+)
+
+var update = flag.Bool("update", false, "rewrite the expected violations from this run")
+
+// TestFixtures lints each capture in testdata and checks the result
+// against the JSON file next to it, as goppy lint --json prints it. Run
+// with -update after changing a rule, and read the diff.
+func TestFixtures(t *testing.T) {
+	paths, err := filepath.Glob("testdata/*.hex")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no fixtures: %v", err)
+	}
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			chunks, err := capture.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := Check(capture.Stream(chunks))
+			golden := strings.TrimSuffix(path, ".hex") + ".json"
+			if *update {
+				data, err := json.MarshalIndent(got, "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(golden, append(data, '\n'), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			data, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want Result
+			if err := json.Unmarshal(data, &want); err != nil {
+				t.Fatalf("%s: %v", golden, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %d violations in %d frames:\n%s\nwant %d in %d, from %s:\n%s",
+					len(got.Violations), got.Frames, list(got.Violations),
+					len(want.Violations), want.Frames, golden, list(want.Violations))
+			}
+		})
+	}
+}
+
+// TestChunking checks a stream linted as it arrives, in pieces, reports
+// what linting it whole does.
+func TestChunking(t *testing.T) {
+	chunks, err := capture.ReadFile("testdata/framing.hex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := capture.Stream(chunks)
+	want := Check(stream).Violations
+
+	var got []Violation
+	l := New(func(v Violation) { got = append(got, v) })
+	for len(stream) > 0 {
+		n := min(3, len(stream))
+		l.Write(stream[:n])
+		stream = stream[n:]
+	}
+	l.End()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("in pieces:\n%s\nwhole:\n%s", list(got), list(want))
+	}
+}
+
+func list(vs []Violation) string {
+	var b strings.Builder
+	for _, v := range vs {
+		b.WriteString("  " + v.String() + "\n")
+	}
+	return b.String()
+}
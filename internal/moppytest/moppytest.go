@@ -0,0 +1,196 @@
+// Package moppytest builds Moppy byte streams for tests, frame by frame,
+// with a note on each frame saying what it is:
+//
+//	s := moppytest.NewStream().
+//		Ping().
+//		NoteOn(1, 1, 60).
+//		Bend(1, 1, 8192).Truncate(5).
+//		NoteOff(1, 1, 60)
+//	port.Feed(s.Bytes()...)
+//
+// Frames are encoded by package protocol, the encoder goppy itself sends
+// with, so a fixture built here can't hide an encoding bug: it shows up as
+// the firmware's parser disagreeing with the test.
+//
+// The corruption helpers (Corrupt, FlipBit, DropByte, InjectStart and
+// Truncate) damage the frame added last and say so in its note, for tests
+// of what the parser makes of a noisy line. WriteCapture writes a stream
+// as an annotated capture, for goppy replay and the conformance fixtures.
+package moppytest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/ystepanoff/goppy/firmware/networks/capture"
+	"github.com/ystepanoff/goppy/internal/protocol"
+)
+
+// Frame is one frame of a Stream and its note. Data may not be a valid
+// frame once corrupted.
+type Frame struct {
+	Data []byte
+	Note string
+}
+
+// Stream is a sequence of frames under construction. Its methods add to
+// it and return it, to chain.
+type Stream struct {
+	frames []Frame
+}
+
+// NewStream returns an empty Stream.
+func NewStream() *Stream {
+	return &Stream{}
+}
+
+// Frame adds data as a frame with the given note, for anything the other
+// methods don't build.
+func (s *Stream) Frame(data []byte, note string) *Stream {
+	s.frames = append(s.frames, Frame{Data: bytes.Clone(data), Note: note})
+	return s
+}
+
+// Ping adds a discovery ping.
+func (s *Stream) Ping() *Stream {
+	return s.Frame(protocol.Ping(), "ping")
+}
+
+// Reset adds a system reset.
+func (s *Stream) Reset() *Stream {
+	return s.Frame(protocol.Reset(), "reset")
+}
+
+// SequenceStart adds a sequence start.
+func (s *Stream) SequenceStart() *Stream {
+	return s.Frame(protocol.SequenceStart(), "sequence start")
+}
+
+// SequenceStop adds a sequence stop.
+func (s *Stream) SequenceStop() *Stream {
+	return s.Frame(protocol.SequenceStop(), "sequence stop")
+}
+
+// NoteOn adds a note-on at protocol.DefaultVelocity.
+func (s *Stream) NoteOn(dev, sub, note byte) *Stream {
+	return s.Frame(protocol.NoteOn(dev, sub, note, protocol.DefaultVelocity),
+		fmt.Sprintf("device %d drive %d: note on %d", dev, sub, note))
+}
+
+// NoteOff adds a note-off.
+func (s *Stream) NoteOff(dev, sub, note byte) *Stream {
+	return s.Frame(protocol.NoteOff(dev, sub, note),
+		fmt.Sprintf("device %d drive %d: note off %d", dev, sub, note))
+}
+
+// Bend adds a pitch bend, bend being the MIDI value: 8192 is no bend.
+func (s *Stream) Bend(dev, sub byte, bend uint16) *Stream {
+	return s.Frame(protocol.PitchBend(dev, sub, bend),
+		fmt.Sprintf("device %d drive %d: bend %d", dev, sub, bend))
+}
+
+// DriveReset adds a reset of one drive, or of every drive with sub 0.
+func (s *Stream) DriveReset(dev, sub byte) *Stream {
+	return s.Frame(protocol.DriveReset(dev, sub),
+		fmt.Sprintf("device %d drive %d: reset", dev, sub))
+}
+
+// Noise adds bytes that aren't a frame.
+func (s *Stream) Noise(b ...byte) *Stream {
+	return s.Frame(b, "noise")
+}
+
+// Corrupt inverts byte i of the last frame.
+func (s *Stream) Corrupt(i int) *Stream {
+	f := s.last("Corrupt", i)
+	f.Data[i] ^= 0xFF
+	f.Note += fmt.Sprintf(", byte %d inverted", i)
+	return s
+}
+
+// FlipBit flips one bit, 0 to 7, of byte i of the last frame.
+func (s *Stream) FlipBit(i int, bit uint) *Stream {
+	f := s.last("FlipBit", i)
+	f.Data[i] ^= 1 << (bit & 7)
+	f.Note += fmt.Sprintf(", bit %d of byte %d flipped", bit&7, i)
+	return s
+}
+
+// DropByte removes byte i of the last frame.
+func (s *Stream) DropByte(i int) *Stream {
+	f := s.last("DropByte", i)
+	f.Data = append(f.Data[:i], f.Data[i+1:]...)
+	f.Note += fmt.Sprintf(", byte %d dropped", i)
+	return s
+}
+
+// InjectStart inserts a stray start byte (0x4D) into the last frame before
+// byte i, or at its end with i the frame's length.
+func (s *Stream) InjectStart(i int) *Stream {
+	f := s.last("InjectStart", i-1)
+	f.Data = append(f.Data[:i], append([]byte{protocol.StartByte}, f.Data[i:]...)...)
+	f.Note += fmt.Sprintf(", start byte injected at %d", i)
+	return s
+}
+
+// Truncate cuts the last frame down to its first n bytes.
+func (s *Stream) Truncate(n int) *Stream {
+	f := s.last("Truncate", n-1)
+	f.Data = f.Data[:n]
+	f.Note += fmt.Sprintf(", cut to %d bytes", n)
+	return s
+}
+
+// last returns the frame added last, panicking if there is none or it has
+// no byte i (i may be -1 for "before the first byte").
+func (s *Stream) last(op string, i int) *Frame {
+	if len(s.frames) == 0 {
+		panic("moppytest: " + op + " on an empty stream")
+	}
+	f := &s.frames[len(s.frames)-1]
+	if i < -1 || i >= len(f.Data) {
+		panic(fmt.Sprintf("moppytest: %s: byte %d out of range for %q (% x)", op, i, f.Note, f.Data))
+	}
+	return f
+}
+
+// Bytes returns the stream's bytes.
+func (s *Stream) Bytes() []byte {
+	var b []byte
+	for _, f := range s.frames {
+		b = append(b, f.Data...)
+	}
+	return b
+}
+
+// Frames returns the stream's frames. They share memory with the Stream.
+func (s *Stream) Frames() []Frame {
+	return s.frames
+}
+
+// Notes returns each frame's note, in order.
+func (s *Stream) Notes() []string {
+	notes := make([]string, len(s.frames))
+	for i, f := range s.frames {
+		notes[i] = f.Note
+	}
+	return notes
+}
+
+// WriteCapture writes the stream to w as a capture, a frame a line with
+// its note as a comment, under a heading comment unless heading is empty.
+func (s *Stream) WriteCapture(w io.Writer, heading string) error {
+	cw := capture.NewWriter(w)
+	if heading != "" {
+		if err := cw.Comment(heading); err != nil {
+			return err
+		}
+	}
+	for _, f := range s.frames {
+		if err := cw.Line(f.Data, f.Note); err != nil {
+			return err
+		}
+	}
+	return cw.Flush()
+}
@@ -0,0 +1,176 @@
+package moppytest
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/networks"
+	"github.com/ystepanoff/goppy/firmware/networks/networkstest"
+)
+
+var update = flag.Bool("update", false, "rewrite the parser's fuzz seed corpus")
+
+// parse feeds stream to the firmware's parser and returns what it
+// dispatched and wrote back, and its counters.
+func parse(stream []byte) ([]networkstest.Call, []byte, networks.Stats) {
+	port := networkstest.NewMockPort()
+	rec := &networkstest.Recorder{}
+	s := networks.NewSerialPort(rec, port)
+	port.Feed(stream...)
+	s.ReadMessages()
+	return rec.Calls, port.Written, s.Stats
+}
+
+// TestEncoding checks that what protocol encodes is what the firmware
+// reads: the wanted calls are spelled out in the firmware's terms.
+func TestEncoding(t *testing.T) {
+	dev := config.DeviceAddress
+	s := NewStream().
+		SequenceStart().
+		NoteOn(dev, 1, 60).
+		Bend(dev, 1, 8192+4096).
+		Bend(dev, 1, 8192).
+		Bend(dev, 1, 0).
+		NoteOff(dev, 1, 60).
+		DriveReset(dev, 0).
+		SequenceStop().
+		Reset().
+		Ping()
+	calls, written, stats := parse(s.Bytes())
+	want := []networkstest.Call{
+		{System: true, Command: config.CmdSequenceStart},
+		{SubAddress: 1, Command: config.DevCmdNoteOn, Payload: []byte{60, 64}},
+		{SubAddress: 1, Command: config.DevCmdBendPitch, Payload: []byte{0x10, 0x00}},
+		{SubAddress: 1, Command: config.DevCmdBendPitch, Payload: []byte{0x00, 0x00}},
+		{SubAddress: 1, Command: config.DevCmdBendPitch, Payload: []byte{0xE0, 0x00}},
+		{SubAddress: 1, Command: config.DevCmdNoteOff, Payload: []byte{60}},
+		{SubAddress: 0, Command: config.DevCmdReset},
+		{System: true, Command: config.CmdSequenceStop},
+		{System: true, Command: config.CmdReset},
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("parsed %+v\nwant   %+v", calls, want)
+	}
+	if len(written) == 0 || written[4] != config.CmdPong {
+		t.Errorf("ping answered with % x, want a pong", written)
+	}
+	if int(stats.Frames) != len(s.Frames()) || stats.SkippedBytes != 0 {
+		t.Errorf("stats %+v, want %d frames and nothing skipped", stats, len(s.Frames()))
+	}
+}
+
+// sentinel is the frame that follows every damaged one in TestCorruption,
+// to show whether the parser found its feet again.
+var sentinel = []networkstest.Call{{SubAddress: 2, Command: config.DevCmdNoteOn, Payload: []byte{67, 64}}}
+
+func TestCorruption(t *testing.T) {
+	dev := config.DeviceAddress
+	tests := []struct {
+		name   string
+		stream *Stream
+		want   []networkstest.Call
+	}{
+		{"start byte", NewStream().NoteOn(dev, 1, 60).Corrupt(0), sentinel},
+		{"device address", NewStream().NoteOn(dev, 1, 60).Corrupt(1), sentinel},
+		{"sub address", NewStream().NoteOn(dev, 1, 60).FlipBit(2, 6), sentinel},
+		{"stray start byte", NewStream().NoteOn(dev, 1, 60).InjectStart(1), sentinel},
+		{"noise", NewStream().Noise(0x00, 0xFF, 0x12), sentinel},
+		// A sub address bit flipped into the zone aliases still arrives,
+		// at the zone.
+		{"sub address into a zone", NewStream().NoteOn(dev, 1, 60).FlipBit(2, 4), append(
+			[]networkstest.Call{{SubAddress: 0x11, Command: config.DevCmdNoteOn, Payload: []byte{60, 64}}},
+			sentinel...)},
+		// Losing the size byte makes the note its command, and the next
+		// frame its payload.
+		{"size dropped", NewStream().NoteOn(dev, 1, 60).DropByte(3), []networkstest.Call{
+			{SubAddress: 1, Command: 60, Payload: append([]byte{64}, NewStream().NoteOn(dev, 2, 67).Bytes()...)},
+		}},
+		// A frame cut short takes its body from the next one, which is lost.
+		{"truncated", NewStream().NoteOn(dev, 1, 60).Truncate(4), []networkstest.Call{
+			{SubAddress: 1, Command: config.StartByte, Payload: []byte{dev, 2}},
+		}},
+		// As does one that lost its payload.
+		{"payload dropped", NewStream().NoteOn(dev, 1, 60).DropByte(6).DropByte(5), []networkstest.Call{
+			{SubAddress: 1, Command: config.DevCmdNoteOn, Payload: []byte{config.StartByte, dev}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.stream.NoteOn(dev, 2, 67)
+			calls, _, _ := parse(s.Bytes())
+			if !reflect.DeepEqual(calls, tt.want) {
+				var notes strings.Builder
+				s.WriteCapture(&notes, "")
+				t.Errorf("parsed %+v\nwant   %+v\nfrom\n%s", calls, tt.want, notes.String())
+			}
+		})
+	}
+}
+
+func TestWriteCapture(t *testing.T) {
+	var b bytes.Buffer
+	s := NewStream().Ping().NoteOn(1, 1, 60).Truncate(5)
+	if err := s.WriteCapture(&b, "two frames"); err != nil {
+		t.Fatal(err)
+	}
+	want := "# two frames\n" +
+		"4d 00 00 01 80                  # ping\n" +
+		"4d 01 01 03 09                  # device 1 drive 1: note on 60, cut to 5 bytes\n"
+	if b.String() != want {
+		t.Errorf("wrote\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+// seeds are the streams the parser's fuzz corpus starts from, besides
+// the ones FuzzParser adds itself, with the chunking seed for each.
+var seeds = []struct {
+	name   string
+	stream *Stream
+	chunks byte
+}{
+	{"song", NewStream().SequenceStart().NoteOn(1, 1, 60).Bend(1, 1, 12288).NoteOff(1, 1, 60).SequenceStop(), 3},
+	{"discovery", NewStream().Ping().Ping(), 1},
+	{"corrupt-start", NewStream().NoteOn(1, 1, 60).Corrupt(0).NoteOn(1, 2, 64), 5},
+	{"flipped-size", NewStream().NoteOn(1, 1, 60).FlipBit(3, 7).NoteOn(1, 2, 64), 2},
+	{"dropped-size", NewStream().NoteOn(1, 1, 60).DropByte(3).NoteOn(1, 2, 64).Reset(), 6},
+	{"stray-start", NewStream().NoteOn(1, 1, 60).InjectStart(4).NoteOn(1, 2, 64), 4},
+	{"truncated", NewStream().Bend(1, 3, 0).Truncate(5).Ping(), 7},
+	{"other-device", NewStream().NoteOn(2, 1, 60).NoteOn(1, 1, 60), 0},
+}
+
+// TestFuzzSeeds checks the fuzz seed corpus in the firmware's networks
+// package is what seeds describes. Run it with -update after changing
+// seeds.
+func TestFuzzSeeds(t *testing.T) {
+	dir := filepath.Join("..", "..", "firmware", "networks", "testdata", "fuzz", "FuzzParser")
+	if *update {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, seed := range seeds {
+		path := filepath.Join(dir, seed.name)
+		want := fmt.Sprintf("go test fuzz v1\n[]byte(%q)\nbyte(%q)\n", seed.stream.Bytes(), seed.chunks)
+		if *update {
+			if err := os.WriteFile(path, []byte(want), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Errorf("%v; run with -update", err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("%s is out of date; run with -update", path)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+// Package mqtttest is an MQTT broker in memory, for tests of clients. It
+// speaks as much of MQTT 3.1.1 at QoS 0 as package mqtt does, over
+// net.Pipe connections from Dial, and notes each CONNECT and PUBLISH:
+//
+//	b := mqtttest.New()
+//	c := &mqtt.Client{Dial: b.Dial, ...}
+//	go c.Run(ctx)
+//	b.WaitSubscribed(t, "goppy/command")
+//	b.Publish("goppy/command", []byte(`{"action":"stop"}`))
+//	state := b.Wait(t, "goppy/state", func(p []byte) bool { ... })
+//
+// Its decoding is its own, not package mqtt's, so that a test can't pass
+// on an encoding bug the two share.
+package mqtttest
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Broker is an MQTT broker in memory.
+type Broker struct {
+	mu        sync.Mutex
+	changed   chan struct{} // closed, and replaced, on each change
+	conns     []*conn
+	published []Message
+	connects  []Connect
+
+	// Refuse, if set, is the CONNACK return code to answer with, as 4
+	// for a bad user name or password.
+	Refuse byte
+
+	// Deaf, if set, leaves pings unanswered.
+	Deaf bool
+}
+
+// Message is a message published to the broker.
+type Message struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+	Will    bool // published for a client gone without a DISCONNECT
+}
+
+// Connect is what a client connected with.
+type Connect struct {
+	ClientID, Username, Password string
+	KeepAlive                    int // seconds
+	CleanSession                 bool
+	Will                         *Message
+}
+
+type conn struct {
+	net.Conn
+	subs         []string
+	will         *Message
+	disconnected bool
+}
+
+// New returns a Broker.
+func New() *Broker {
+	return &Broker{changed: make(chan struct{})}
+}
+
+// Dial connects a client to b.
+func (b *Broker) Dial(ctx context.Context) (net.Conn, error) {
+	client, far := net.Pipe()
+	c := &conn{Conn: far}
+	b.mu.Lock()
+	b.conns = append(b.conns, c)
+	b.mu.Unlock()
+	go b.serve(c)
+	return client, nil
+}
+
+// Publish sends a message to the clients subscribed to topic.
+func (b *Broker) Publish(topic string, payload []byte) {
+	b.mu.Lock()
+	var to []*conn
+	for _, c := range b.conns {
+		if slices.Contains(c.subs, topic) {
+			to = append(to, c)
+		}
+	}
+	b.mu.Unlock()
+	body := binary.BigEndian.AppendUint16(nil, uint16(len(topic)))
+	body = append(append(body, topic...), payload...)
+	for _, c := range to {
+		writePacket(c, 0x30, body)
+	}
+}
+
+// Drop closes every client's connection, as a broker restarting would,
+// publishing the wills of those that asked for one.
+func (b *Broker) Drop() {
+	b.mu.Lock()
+	conns := b.conns
+	b.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// Published returns the messages published to topic.
+func (b *Broker) Published(topic string) []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []Message
+	for _, m := range b.published {
+		if m.Topic == topic {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// Connects returns what each client connected with.
+func (b *Broker) Connects() []Connect {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Clone(b.connects)
+}
+
+// Wait waits up to a few seconds for a message published to topic that
+// match accepts, or any with a nil match, counting from the first, and
+// returns its payload.
+func (b *Broker) Wait(t testing.TB, topic string, match func(payload []byte) bool) []byte {
+	t.Helper()
+	var got []byte
+	b.waitFor(t, "a message on "+topic, func() bool {
+		for _, m := range b.published {
+			if m.Topic == topic && (match == nil || match(m.Payload)) {
+				got = m.Payload
+				return true
+			}
+		}
+		return false
+	})
+	return got
+}
+
+// WaitPublished waits up to a few seconds for n messages to have been
+// published to topic.
+func (b *Broker) WaitPublished(t testing.TB, topic string, n int) {
+	t.Helper()
+	b.waitFor(t, "messages on "+topic, func() bool {
+		count := 0
+		for _, m := range b.published {
+			if m.Topic == topic {
+				count++
+			}
+		}
+		return count >= n
+	})
+}
+
+// WaitSubscribed waits up to a few seconds for a client connected now to
+// subscribe to topic.
+func (b *Broker) WaitSubscribed(t testing.TB, topic string) {
+	t.Helper()
+	b.waitFor(t, "a subscription to "+topic, func() bool {
+		for _, c := range b.conns {
+			if slices.Contains(c.subs, topic) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// WaitConnects waits up to a few seconds for n clients to have connected.
+func (b *Broker) WaitConnects(t testing.TB, n int) {
+	t.Helper()
+	b.waitFor(t, "connections", func() bool { return len(b.connects) >= n })
+}
+
+// waitFor waits for ok, called with b.mu held, to hold.
+func (b *Broker) waitFor(t testing.TB, what string, ok func() bool) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		b.mu.Lock()
+		done, changed := ok(), b.changed
+		b.mu.Unlock()
+		if done {
+			return
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatalf("mqtttest: no %s", what)
+		}
+	}
+}
+
+// change wakes the waiters, with b.mu held.
+func (b *Broker) change() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+var errProtocol = errors.New("mqtttest: protocol error")
+
+// serve answers a client until its connection closes.
+func (b *Broker) serve(c *conn) {
+	defer func() {
+		c.Close()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.conns = slices.DeleteFunc(b.conns, func(x *conn) bool { return x == c })
+		if c.will != nil && !c.disconnected {
+			b.published = append(b.published, *c.will)
+		}
+		b.change()
+	}()
+	r := bufio.NewReader(c)
+	first := true
+	for {
+		kind, flags, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		if first != (kind == 1) {
+			return // CONNECT first, and only first
+		}
+		first = false
+		switch kind {
+		case 1:
+			cn, err := parseConnect(body)
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.connects = append(b.connects, cn)
+			if b.Refuse == 0 {
+				c.will = cn.Will
+			}
+			refuse := b.Refuse
+			b.change()
+			b.mu.Unlock()
+			writePacket(c, 0x20, []byte{0, refuse})
+			if refuse != 0 {
+				return
+			}
+		case 3:
+			topic, rest, err := readString(body)
+			if err != nil || flags&0x06 != 0 {
+				return // QoS 0 only
+			}
+			b.mu.Lock()
+			b.published = append(b.published, Message{Topic: topic, Payload: rest, Retain: flags&1 != 0})
+			b.change()
+			b.mu.Unlock()
+		case 8:
+			if flags != 0x02 || len(body) < 2 {
+				return
+			}
+			id, rest := body[:2], body[2:]
+			var codes []byte
+			var topics []string
+			for len(rest) > 0 {
+				topic, r, err := readString(rest)
+				if err != nil || len(r) < 1 {
+					return
+				}
+				topics, rest = append(topics, topic), r[1:]
+				codes = append(codes, 0)
+			}
+			b.mu.Lock()
+			c.subs = append(c.subs, topics...)
+			b.change()
+			b.mu.Unlock()
+			writePacket(c, 0x90, append(slices.Clone(id), codes...))
+		case 12:
+			b.mu.Lock()
+			deaf := b.Deaf
+			b.mu.Unlock()
+			if !deaf {
+				writePacket(c, 0xD0, nil)
+			}
+		case 14:
+			b.mu.Lock()
+			c.disconnected = true
+			b.mu.Unlock()
+			return
+		default:
+			return
+		}
+	}
+}
+
+func parseConnect(body []byte) (Connect, error) {
+	name, rest, err := readString(body)
+	if err != nil || name != "MQTT" || len(rest) < 4 || rest[0] != 4 {
+		return Connect{}, errProtocol
+	}
+	flags := rest[1]
+	cn := Connect{KeepAlive: int(binary.BigEndian.Uint16(rest[2:])), CleanSession: flags&0x02 != 0}
+	rest = rest[4:]
+	if cn.ClientID, rest, err = readString(rest); err != nil {
+		return Connect{}, err
+	}
+	if flags&0x04 != 0 {
+		var topic, payload string
+		if topic, rest, err = readString(rest); err != nil {
+			return Connect{}, err
+		}
+		if payload, rest, err = readString(rest); err != nil {
+			return Connect{}, err
+		}
+		cn.Will = &Message{Topic: topic, Payload: []byte(payload), Retain: flags&0x20 != 0, Will: true}
+	}
+	if flags&0x80 != 0 {
+		if cn.Username, rest, err = readString(rest); err != nil {
+			return Connect{}, err
+		}
+	}
+	if flags&0x40 != 0 {
+		if cn.Password, rest, err = readString(rest); err != nil {
+			return Connect{}, err
+		}
+	}
+	if len(rest) != 0 {
+		return Connect{}, errProtocol
+	}
+	return cn, nil
+}
+
+func readPacket(r *bufio.Reader) (kind, flags byte, body []byte, err error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	size := 0
+	for shift := 0; ; shift += 7 {
+		if shift > 21 {
+			return 0, 0, nil, errProtocol
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		size |= int(b&0x7F) << shift
+		if b < 0x80 {
+			break
+		}
+	}
+	body = make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return first >> 4, first & 0x0F, body, nil
+}
+
+func writePacket(w io.Writer, first byte, body []byte) error {
+	out := []byte{first}
+	for n := len(body); ; {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(out, body...))
+	return err
+}
+
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errProtocol
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errProtocol
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
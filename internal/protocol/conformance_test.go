@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/ystepanoff/goppy/firmware/networks/capture"
+)
+
+// The conformance fixtures are shared with the firmware's parser tests;
+// see firmware/networks/conformance_test.go for their format.
+var fixtures = filepath.Join("..", "..", "firmware", "networks", "testdata", "conformance")
+
+// captureFrames reads a .hex fixture one line, and so one frame, at a
+// time.
+func captureFrames(t *testing.T, name string) [][]byte {
+	t.Helper()
+	chunks, err := capture.ReadFile(filepath.Join(fixtures, name+".hex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames [][]byte
+	for _, c := range chunks {
+		frames = append(frames, c.Data)
+	}
+	return frames
+}
+
+// TestConformance checks that what goppy sends matches, byte for byte,
+// what MoppyControlGUI sends for the same song.
+func TestConformance(t *testing.T) {
+	tests := []struct {
+		capture string
+		frames  [][]byte
+	}{
+		{"discovery", [][]byte{Ping(), Ping()}},
+		{"song", [][]byte{
+			SequenceStart(),
+			NoteOn(1, 1, 60, 100),
+			NoteOn(1, 2, 67, 80),
+			NoteOn(2, 1, 48, 100),
+			PitchBend(1, 1, PitchBendCenter+4096),
+			PitchBend(1, 1, PitchBendCenter),
+			NoteOff(1, 1, 60),
+			NoteOff(1, 2, 67),
+			NoteOff(2, 1, 48),
+			NoteOn(1, 1, 64, 127),
+			PitchBend(1, 1, 0),
+			NoteOff(1, 1, 64),
+			SequenceStop(),
+			Reset(),
+			DriveReset(1, 0),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.capture, func(t *testing.T) {
+			want := captureFrames(t, tt.capture)
+			if len(tt.frames) != len(want) {
+				t.Fatalf("built %d frames, capture has %d", len(tt.frames), len(want))
+			}
+			for i := range want {
+				if !bytes.Equal(tt.frames[i], want[i]) {
+					t.Errorf("frame %d = % x, capture has % x", i, tt.frames[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+// TestConformancePong checks that ReadPong understands the reference
+// firmware's reply to discovery.
+func TestConformancePong(t *testing.T) {
+	golden, err := capture.ReadOutcome(filepath.Join(fixtures, "discovery.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(golden.Written) == 0 {
+		t.Fatal("discovery.json has no pong")
+	}
+	got, err := ReadPong(bytes.NewReader(golden.Written[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Pong{DeviceAddress: 0x01, MinSubAddress: 1, MaxSubAddress: 8}
+	if got != want {
+		t.Errorf("pong = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,232 @@
+package protocol
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	"github.com/ystepanoff/goppy/firmware/notes"
+	wire "github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// systemCommandNames and deviceCommandNames name the commands for a log.
+var systemCommandNames = map[byte]string{
+	CmdPing:          "ping",
+	CmdPong:          "pong",
+	CmdGetConfig:     "get config",
+	CmdConfig:        "config",
+	CmdGetPositions:  "get positions",
+	CmdPosition:      "position",
+	CmdGetStatus:     "get status",
+	CmdStatus:        "status",
+	CmdRoute:         "route",
+	CmdSequenceStart: "sequence start",
+	CmdSequenceStop:  "sequence stop",
+	CmdReset:         "reset",
+}
+
+var deviceCommandNames = map[byte]string{
+	DevCmdReset:           "reset",
+	DevCmdNoteOff:         "note off",
+	DevCmdNoteOn:          "note on",
+	DevCmdBendPitch:       "pitch bend",
+	DevCmdGliss:           "gliss",
+	DevCmdTranspose:       "transpose",
+	DevCmdSetZone:         "set zone",
+	DevCmdDetune:          "detune",
+	DevCmdBendRange:       "bend range",
+	DevCmdTremolo:         "tremolo",
+	DevCmdChannelPressure: "channel pressure",
+	DevCmdTrill:           "trill",
+	DevCmdFactoryReset:    "factory reset",
+	DevCmdSetTravel:       "set travel",
+	DevCmdSustain:         "sustain",
+	DevCmdSetMovement:     "set movement",
+	DevCmdSetOption:       "set option",
+}
+
+var optionNames = map[byte]string{
+	OptDirCadence:      "dir cadence",
+	OptCalibration:     "calibration",
+	OptAccentMs:        "accent ms",
+	OptAccentStyle:     "accent style",
+	OptVibratoRate:     "vibrato rate",
+	OptVibratoDepth:    "vibrato depth",
+	OptRegisterTravel:  "register travel",
+	OptTravelSplitLow:  "travel split low",
+	OptTravelSplitHigh: "travel split high",
+	OptStartDelay:      "start delay",
+	OptLegato:          "legato",
+	OptTravelMin:       "travel min",
+	OptTravelMax:       "travel max",
+	OptPhraseMode:      "phrase mode",
+	OptPulseWidth:      "pulse width",
+	OptMovementClamp:   "movement clamp",
+}
+
+var zoneModeNames = map[byte]string{
+	ZoneUnison:  "unison",
+	ZonePool:    "pool",
+	ZonePoolLRU: "pool, least recently used",
+}
+
+// CommandName returns the name a log gives a system command, if system,
+// or a device command: "note on", or "command 0x2a" for one it doesn't
+// know.
+func CommandName(system bool, command byte) string {
+	names := deviceCommandNames
+	if system {
+		names = systemCommandNames
+	}
+	if name, ok := names[command]; ok {
+		return name
+	}
+	return fmt.Sprintf("command 0x%02x", command)
+}
+
+// Described is a message as a log shows it.
+type Described struct {
+	Target  string `json:"target"`           // "system", "all drives", "drive 3" or "zone 1"
+	Command string `json:"command"`          // as CommandName has it
+	Detail  string `json:"detail,omitempty"` // the payload, decoded
+}
+
+// String renders d as a line of a log: its target, padded to line the
+// commands up, its command and its detail.
+func (d Described) String() string {
+	line := fmt.Sprintf("%-10s  %s", d.Target, d.Command)
+	if d.Detail != "" {
+		line += " " + d.Detail
+	}
+	return line
+}
+
+// Describer describes messages for a log, the one pretty-printer of the
+// host's tools: where each goes, its command by name, and its payload
+// decoded, notes by name and bends in cents. It follows each drive's bend
+// range through the bend ranges it describes, from DefaultBendRange, to
+// give its bends in cents. The zero Describer is ready to use.
+type Describer struct {
+	ranges map[[2]byte]byte // device and sub address, to semitones
+}
+
+// Describe describes m, after the messages described before it.
+func (d *Describer) Describe(m wire.Message) Described {
+	system := m.Device == SystemAddress
+	out := Described{Target: fmt.Sprintf("drive %d", m.Sub), Command: CommandName(system, m.Command)}
+	switch {
+	case system:
+		out.Target = "system"
+	case m.Sub == 0:
+		out.Target = "all drives"
+	case m.Sub >= ZoneSubAddress:
+		out.Target = fmt.Sprintf("zone %d", m.Sub-ZoneSubAddress+1)
+	}
+
+	p := m.Payload
+	note := func(n byte) string { return string(notes.Name(nil, n)) }
+	var detail string
+	switch {
+	case system && m.Command == CmdPong && len(p) >= 3:
+		detail, p = fmt.Sprintf("device 0x%02X drives %d-%d", p[0], p[1], p[2]), p[3:]
+	case system:
+	case m.Command == DevCmdNoteOn && len(p) >= 2:
+		detail, p = fmt.Sprintf("%s velocity %d", note(p[0]), p[1]), p[2:]
+	case (m.Command == DevCmdNoteOn || m.Command == DevCmdNoteOff) && len(p) >= 1:
+		detail, p = note(p[0]), p[1:]
+	case m.Command == DevCmdBendPitch && len(p) >= 2:
+		bend := int16(uint16(p[0])<<8 | uint16(p[1]))
+		cents := math.Round(float64(bend) * float64(d.bendRange(m.Device, m.Sub)) * 100 / float64(PitchBendCenter))
+		detail, p = fmt.Sprintf("%+d cents (%+d)", int(cents), bend), p[2:]
+	case m.Command == DevCmdBendRange && len(p) >= 1:
+		d.setBendRange(m.Device, m.Sub, p[0])
+		detail, p = fmt.Sprintf("%d semitones", p[0]), p[1:]
+	case m.Command == DevCmdGliss && len(p) >= 4:
+		ms := time.Duration(uint16(p[2])<<8|uint16(p[3])) * time.Millisecond
+		detail = fmt.Sprintf("%s to %s over %v", note(p[0]), note(p[1]), ms)
+		if len(p) >= 5 && p[4]&config.GlissFlagSmooth != 0 {
+			detail += ", smooth"
+		}
+		p = p[min(len(p), 5):]
+	case m.Command == DevCmdTranspose && len(p) >= 1:
+		detail, p = fmt.Sprintf("%+d semitones", int8(p[0])), p[1:]
+	case m.Command == DevCmdDetune && len(p) >= 1:
+		detail, p = fmt.Sprintf("%+d cents", int8(p[0])), p[1:]
+	case m.Command == DevCmdTremolo && len(p) >= 2:
+		detail, p = fmt.Sprintf("%d Hz, %d%%", p[0], p[1]), p[2:]
+	case m.Command == DevCmdChannelPressure && len(p) >= 1:
+		detail, p = fmt.Sprint(p[0]), p[1:]
+	case m.Command == DevCmdTrill && len(p) >= 3:
+		detail, p = fmt.Sprintf("%s and %s every %dms", note(p[0]), note(p[1]), p[2]), p[3:]
+	case m.Command == DevCmdSetTravel && len(p) >= 4:
+		detail, p = fmt.Sprintf("steps %d to %d", uint16(p[0])<<8|uint16(p[1]), uint16(p[2])<<8|uint16(p[3])), p[4:]
+	case m.Command == DevCmdSetTravel && len(p) >= 2:
+		detail, p = fmt.Sprintf("%d to %d", p[0], p[1]), p[2:]
+	case m.Command == DevCmdSustain && len(p) >= 1:
+		detail, p = "up", p[1:]
+		if m.Payload[0] != 0 {
+			detail = "down"
+		}
+	case m.Command == DevCmdSetMovement && len(p) >= 1:
+		detail, p = "full range", p[1:]
+		if m.Payload[0] != 0 {
+			detail = "clamped"
+		}
+	case m.Command == DevCmdSetZone && len(p) >= 4:
+		mode, ok := zoneModeNames[p[3]]
+		if !ok {
+			mode = fmt.Sprintf("mode %d", p[3])
+		}
+		detail = fmt.Sprintf("%d drives %d-%d, %s", p[0], p[1], p[2], mode)
+		if p[1] == 0 {
+			detail = fmt.Sprintf("%d cleared", p[0])
+		}
+		p = p[4:]
+	case m.Command == DevCmdSetOption && len(p) >= 2:
+		name, ok := optionNames[p[0]]
+		if !ok {
+			name = fmt.Sprintf("option 0x%02x", p[0])
+		}
+		detail, p = fmt.Sprintf("%s %d", name, p[1]), p[2:]
+	}
+	if len(p) > 0 {
+		detail = strings.TrimSpace(detail + fmt.Sprintf(" [% x]", p))
+	}
+	out.Detail = detail
+	return out
+}
+
+// bendRange returns the bend range last described for a drive, or for all
+// of its device's, or DefaultBendRange.
+func (d *Describer) bendRange(device, sub byte) byte {
+	if r, ok := d.ranges[[2]byte{device, sub}]; ok {
+		return r
+	}
+	if r, ok := d.ranges[[2]byte{device, 0}]; ok {
+		return r
+	}
+	return config.DefaultBendRange
+}
+
+// setBendRange notes a drive's bend range, or with sub 0 every drive's
+// of the device.
+func (d *Describer) setBendRange(device, sub, semitones byte) {
+	if d.ranges == nil {
+		d.ranges = make(map[[2]byte]byte)
+	}
+	if sub == 0 {
+		for k := range d.ranges {
+			if k[0] == device {
+				delete(d.ranges, k)
+			}
+		}
+	}
+	d.ranges[[2]byte{device, sub}] = semitones
+}
+
+// Stamp formats an offset for a log, in milliseconds.
+func Stamp(at time.Duration) string {
+	return fmt.Sprintf("%10.3fms", float64(at)/float64(time.Millisecond))
+}
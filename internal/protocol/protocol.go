@@ -4,41 +4,157 @@
 //
 //	[START=0x4D] [DEVICE_ADDR] [SUB_ADDR] [SIZE] [COMMAND] [PAYLOAD...]
 //
-// SIZE counts the bytes that follow it (command + payload).
+// SIZE counts the bytes that follow it (command + payload). The frames are
+// encoded by firmware/protocol, the encoder the firmware answers with;
+// this package adds host conveniences on top, such as durations and MIDI
+// bend values, and reads the device's replies.
 package protocol
 
 import (
 	"errors"
 	"fmt"
 	"io"
+	"time"
+
+	"github.com/ystepanoff/goppy/firmware/config"
+	wire "github.com/ystepanoff/goppy/firmware/protocol"
 )
 
+// Framing and commands are the firmware's own constants, from package
+// config, and frames are built by the firmware's encoder in
+// firmware/protocol: the host has no framing rules of its own.
 const (
-	StartByte     byte = 0x4D
-	SystemAddress byte = 0x00
+	StartByte     = config.StartByte
+	SystemAddress = config.SystemAddress
 )
 
 // System commands (sent to SystemAddress).
 const (
-	CmdPing          byte = 0x80
-	CmdPong          byte = 0x81
-	CmdSequenceStart byte = 0xFA
-	CmdSequenceStop  byte = 0xFC
-	CmdReset         byte = 0xFF
+	CmdPing          = config.CmdPing
+	CmdPong          = config.CmdPong
+	CmdGetConfig     = config.CmdGetConfig
+	CmdConfig        = config.CmdConfig
+	CmdGetPositions  = config.CmdGetPositions
+	CmdPosition      = config.CmdPosition
+	CmdGetStatus     = config.CmdGetStatus
+	CmdStatus        = config.CmdStatus
+	CmdRoute         = config.CmdRoute
+	CmdSequenceStart = config.CmdSequenceStart
+	CmdSequenceStop  = config.CmdSequenceStop
+	CmdReset         = config.CmdReset
+)
+
+// Sequence states and faults a device reports in its status.
+const (
+	SequenceIdle    = config.SequenceIdle
+	SequencePlaying = config.SequencePlaying
+	SequencePaused  = config.SequencePaused
+
+	FaultNone           = config.FaultNone
+	FaultBadSubAddress  = config.FaultBadSubAddress
+	FaultEmptyFrame     = config.FaultEmptyFrame
+	FaultUnknownCommand = config.FaultUnknownCommand
+	FaultBadPayload     = config.FaultBadPayload
+	FaultOverrun        = config.FaultOverrun
+	FaultLinkTimeout    = config.FaultLinkTimeout
+)
+
+// Instruments a device's route table sends sub addresses to.
+const (
+	InstrumentOther       = config.InstrumentOther
+	InstrumentFloppy      = config.InstrumentFloppy
+	InstrumentHDD         = config.InstrumentHDD
+	InstrumentRelay       = config.InstrumentRelay
+	InstrumentStepper     = config.InstrumentStepper
+	InstrumentScanner     = config.InstrumentScanner
+	InstrumentInterrupter = config.InstrumentInterrupter
 )
 
 // Device commands (sent to a specific device address + sub address).
 const (
-	DevCmdReset       byte = 0x00
-	DevCmdNoteOff     byte = 0x08
-	DevCmdNoteOn      byte = 0x09
-	DevCmdBendPitch   byte = 0x0E
-	DevCmdSetMovement byte = 0x64
+	DevCmdReset           = config.DevCmdReset
+	DevCmdNoteOff         = config.DevCmdNoteOff
+	DevCmdNoteOn          = config.DevCmdNoteOn
+	DevCmdBendPitch       = config.DevCmdBendPitch
+	DevCmdGliss           = config.DevCmdGliss
+	DevCmdTranspose       = config.DevCmdTranspose
+	DevCmdSetZone         = config.DevCmdSetZone
+	DevCmdDetune          = config.DevCmdDetune
+	DevCmdBendRange       = config.DevCmdBendRange
+	DevCmdTremolo         = config.DevCmdTremolo
+	DevCmdChannelPressure = config.DevCmdChannelPressure
+	DevCmdTrill           = config.DevCmdTrill
+	DevCmdFactoryReset    = config.DevCmdFactoryReset
+	DevCmdSetTravel       = config.DevCmdSetTravel
+	DevCmdSustain         = config.DevCmdSustain
+	DevCmdSetMovement     = config.DevCmdSetMovement
+	DevCmdSetOption       = config.DevCmdSetOption
+)
+
+// Per-drive options for DevCmdSetOption.
+const (
+	OptDirCadence   = config.OptDirCadence   // reverse direction every N steps; 0 = only at the limits
+	OptCalibration  = config.OptCalibration  // steps from the end stop to position 0 after homing
+	OptAccentMs     = config.OptAccentMs     // length of an accented attack in ms; 0 = no accents
+	OptAccentStyle  = config.OptAccentStyle  // AccentOctaveDown or AccentDoubleRate
+	OptVibratoRate  = config.OptVibratoRate  // pressure vibrato speed in Hz; 0 = no vibrato
+	OptVibratoDepth = config.OptVibratoDepth // pressure vibrato depth in cents at full pressure
+
+	// Register travel: notes from OptTravelSplitLow up bounce in half the
+	// head's range, from OptTravelSplitHigh up in a quarter.
+	OptRegisterTravel  = config.OptRegisterTravel // non-zero turns register travel on
+	OptTravelSplitLow  = config.OptTravelSplitLow
+	OptTravelSplitHigh = config.OptTravelSplitHigh
+
+	OptStartDelay = config.OptStartDelay // hold note-ons back by value ms (0..20)
+	OptLegato     = config.OptLegato     // non-zero returns to held notes on note-off
+
+	// One end of the SetTravel window; values leaving it empty are ignored.
+	OptTravelMin = config.OptTravelMin
+	OptTravelMax = config.OptTravelMax
+
+	OptPhraseMode = config.OptPhraseMode // scanners: non-zero reverses only between notes
+	OptPulseWidth = config.OptPulseWidth // Tesla coil interrupters: pulse width in 10µs units
+
+	OptMovementClamp = config.OptMovementClamp // non-zero clamps the head near centre, as SetMovement
 )
 
+// Accent styles for OptAccentStyle. A note-on at AccentVelocity or above
+// starts with OptAccentMs of the altered attack.
+const (
+	AccentOctaveDown = config.AccentOctaveDown
+	AccentDoubleRate = config.AccentDoubleRate
+
+	AccentVelocity byte = config.AccentVelocity
+)
+
+// DefaultVelocity is sent for note-ons that have no velocity of their own.
+const DefaultVelocity byte = 64
+
+// Zone aliases and modes. Zone N (1-based) answers at ZoneSubAddress+N-1.
+const (
+	ZoneSubAddress = config.ZoneSubAddress
+
+	ZoneUnison  = config.ZoneUnison  // every message goes to all drives in the zone
+	ZonePool    = config.ZonePool    // each note goes to a free drive in the zone, taking turns
+	ZonePoolLRU = config.ZonePoolLRU // each note goes to the zone's free drive idle longest
+)
+
+// TickDuration is the firmware's timer interrupt interval, the unit of its
+// tick counters.
+const TickDuration = config.TimerResolution * time.Microsecond
+
 // PitchBendCenter is the neutral pitch-bend value (no bend).
 const PitchBendCenter uint16 = 8192
 
+// Frame is a decoded Moppy frame.
+type Frame struct {
+	DeviceAddress byte
+	SubAddress    byte
+	Command       byte
+	Payload       []byte
+}
+
 // Pong is the decoded reply to a PING.
 type Pong struct {
 	DeviceAddress byte
@@ -49,68 +165,181 @@ type Pong struct {
 // EncodeFrame builds a complete Moppy frame.
 // payload may be nil; the command byte itself counts toward SIZE.
 func EncodeFrame(deviceAddr, subAddr, command byte, payload []byte) []byte {
-	size := byte(1 + len(payload))
-	frame := make([]byte, 0, 4+int(size))
-	frame = append(frame, StartByte, deviceAddr, subAddr, size, command)
-	frame = append(frame, payload...)
+	return encode(wire.Message{Device: deviceAddr, Sub: subAddr, Command: command, Payload: payload})
+}
+
+// encode encodes m with the firmware's encoder. The helpers below only
+// build messages that fit, so a failure is a bug.
+func encode(m wire.Message) []byte {
+	frame := make([]byte, m.Len())
+	if _, err := m.Encode(frame); err != nil {
+		panic(err)
+	}
 	return frame
 }
 
 // System helpers ------------------------------------------------------------
 
-func Ping() []byte {
-	return EncodeFrame(SystemAddress, 0x00, CmdPing, nil)
-}
+func Ping() []byte          { return encode(wire.Ping()) }
+func Reset() []byte         { return encode(wire.Reset()) }
+func SequenceStart() []byte { return encode(wire.SequenceStart()) }
+func SequenceStop() []byte  { return encode(wire.SequenceStop()) }
 
-func Reset() []byte {
-	return EncodeFrame(SystemAddress, 0x00, CmdReset, nil)
+// GetConfig asks every device to report its per-drive settings.
+func GetConfig() []byte {
+	return encode(wire.GetConfig())
 }
 
-func SequenceStart() []byte {
-	return EncodeFrame(SystemAddress, 0x00, CmdSequenceStart, nil)
+// GetPositions asks every device where its heads and carriages are.
+func GetPositions() []byte {
+	return encode(wire.GetPositions())
 }
 
-func SequenceStop() []byte {
-	return EncodeFrame(SystemAddress, 0x00, CmdSequenceStop, nil)
+// GetStatus asks every device how it is: see Status.
+func GetStatus() []byte {
+	return encode(wire.GetStatus())
 }
 
 // Device helpers ------------------------------------------------------------
 
-func NoteOn(deviceAddr, subAddr, note byte) []byte {
-	return EncodeFrame(deviceAddr, subAddr, DevCmdNoteOn, []byte{note})
+func NoteOn(deviceAddr, subAddr, note, velocity byte) []byte {
+	return encode(wire.NoteOnVelocity(deviceAddr, subAddr, note, velocity))
+}
+
+// NoteOff carries the note being released so the firmware can ignore it
+// when a later note-on has already taken over the drive.
+func NoteOff(deviceAddr, subAddr, note byte) []byte {
+	return encode(wire.NoteOff(deviceAddr, subAddr, note))
 }
 
-func NoteOff(deviceAddr, subAddr byte) []byte {
-	return EncodeFrame(deviceAddr, subAddr, DevCmdNoteOff, nil)
+// AllNotesOff silences every drive on a device at once, without
+// re-homing the heads.
+func AllNotesOff(deviceAddr byte) []byte {
+	return encode(wire.AllNotesOff(deviceAddr))
 }
 
 func DriveReset(deviceAddr, subAddr byte) []byte {
-	return EncodeFrame(deviceAddr, subAddr, DevCmdReset, nil)
+	return encode(wire.DriveReset(deviceAddr, subAddr))
 }
 
-// PitchBend encodes a 14-bit bend value (0..16383, center 8192).
+// FactoryReset erases a drive's saved settings and restores the defaults.
+// Sub address 0x00 resets every drive on the device.
+func FactoryReset(deviceAddr, subAddr byte) []byte {
+	return encode(wire.FactoryReset(deviceAddr, subAddr))
+}
+
+// PitchBend encodes a 14-bit MIDI bend value (0..16383, center 8192).
+// On the wire it travels as a signed 16-bit deflection from center.
 func PitchBend(deviceAddr, subAddr byte, bend uint16) []byte {
 	if bend > 0x3FFF {
 		bend = 0x3FFF
 	}
-	msb := byte((bend >> 7) & 0x7F)
-	lsb := byte(bend & 0x7F)
-	return EncodeFrame(deviceAddr, subAddr, DevCmdBendPitch, []byte{msb, lsb})
+	return encode(wire.PitchBend(deviceAddr, subAddr, int16(bend)-int16(PitchBendCenter)))
+}
+
+// Gliss slides a drive from start to end over duration (clamped to 65535ms),
+// chromatically or, with smooth set, interpolating the period. The end note
+// keeps sounding until a NoteOff.
+func Gliss(deviceAddr, subAddr, start, end byte, duration time.Duration, smooth bool) []byte {
+	ms := duration.Milliseconds()
+	if ms > 0xFFFF {
+		ms = 0xFFFF
+	}
+	flags := byte(0)
+	if smooth {
+		flags = config.GlissFlagSmooth
+	}
+	return encode(wire.Gliss(deviceAddr, subAddr, start, end, uint16(ms), flags))
+}
+
+// Trill alternates a drive between noteA and noteB every rate (1..255ms),
+// starting on noteA, until a note-on, a note-off for either note or a reset.
+func Trill(deviceAddr, subAddr, noteA, noteB byte, rate time.Duration) []byte {
+	ms := rate.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	if ms > 255 {
+		ms = 255
+	}
+	return encode(wire.Trill(deviceAddr, subAddr, noteA, noteB, byte(ms)))
+}
+
+// Transpose sets a drive's signed semitone offset. Sub address 0x00 sets
+// every drive on the device.
+func Transpose(deviceAddr, subAddr byte, semitones int8) []byte {
+	return encode(wire.Transpose(deviceAddr, subAddr, semitones))
+}
+
+// BendRange sets how many semitones (1..24) a full pitch bend reaches on
+// a drive. Sub address 0x00 sets every drive on the device.
+func BendRange(deviceAddr, subAddr, semitones byte) []byte {
+	return encode(wire.BendRange(deviceAddr, subAddr, semitones))
+}
+
+// Tremolo gates a drive's stepping at rateHz, sounding for dutyPercent
+// (0..100) of each cycle. Rate 0 turns tremolo off. Sub address 0x00 sets
+// every drive on the device.
+func Tremolo(deviceAddr, subAddr, rateHz, dutyPercent byte) []byte {
+	return encode(wire.Tremolo(deviceAddr, subAddr, rateHz, dutyPercent))
+}
+
+// ChannelPressure passes channel aftertouch (0..127) to a drive, which
+// plays it as vibrato on the sounding note. Sub address 0x00 applies it to
+// every drive on the device.
+func ChannelPressure(deviceAddr, subAddr, pressure byte) []byte {
+	return encode(wire.ChannelPressure(deviceAddr, subAddr, pressure))
+}
+
+// Detune sets a drive's fine tuning in cents (-127..127). Sub address 0x00
+// sets every drive on the device.
+func Detune(deviceAddr, subAddr byte, cents int8) []byte {
+	return encode(wire.Detune(deviceAddr, subAddr, cents))
+}
+
+// SetZone makes zone (1-based) an alias for drives first..last in mode
+// (ZoneUnison, ZonePool or ZonePoolLRU). first == 0 clears the zone.
+func SetZone(deviceAddr, zone, first, last, mode byte) []byte {
+	return encode(wire.SetZone(deviceAddr, zone, first, last, mode))
+}
+
+// Sustain presses (on=true) or lifts the sustain pedal. Sub address 0x00
+// applies it to every drive on the device.
+func Sustain(deviceAddr, subAddr byte, on bool) []byte {
+	return encode(wire.Sustain(deviceAddr, subAddr, on))
+}
+
+// MaxPosition is the highest head position on a 3.5" drive.
+const MaxPosition = config.MaxPosition
+
+// SetTravel sets the window a drive's head bounces in, min < max <=
+// MaxPosition. A head outside it walks in rather than jumping. Sub address
+// 0x00 sets every drive on the device.
+func SetTravel(deviceAddr, subAddr, min, max byte) []byte {
+	return encode(wire.SetTravel(deviceAddr, subAddr, min, max))
+}
+
+// SetTravelSteps sets the travel window of a scanner carriage, which
+// travels too far for SetTravel's single bytes.
+func SetTravelSteps(deviceAddr, subAddr byte, min, max uint16) []byte {
+	return encode(wire.SetTravelSteps(deviceAddr, subAddr, min, max))
+}
+
+// SetOption sets a per-drive option (one of the Opt* constants). Sub
+// address 0x00 sets it on every drive on the device.
+func SetOption(deviceAddr, subAddr, option, value byte) []byte {
+	return encode(wire.SetOption(deviceAddr, subAddr, option, value))
 }
 
 // SetMovement clamps (clamp=true) head travel to a 2-track wiggle, or
 // restores the full 0-158 range (clamp=false). Polarity matches the firmware.
 func SetMovement(deviceAddr, subAddr byte, clamp bool) []byte {
-	flag := byte(0)
-	if clamp {
-		flag = 1
-	}
-	return EncodeFrame(deviceAddr, subAddr, DevCmdSetMovement, []byte{flag})
+	return encode(wire.SetMovement(deviceAddr, subAddr, clamp))
 }
 
-// ReadPong reads bytes from r until it parses a Pong reply or EOF.
-// It tolerates noise bytes between frames and ignores frames that aren't Pongs.
-func ReadPong(r io.Reader) (Pong, error) {
+// ReadFrame reads bytes from r until it parses a complete frame or EOF.
+// It tolerates noise bytes between frames and skips frames with no command.
+func ReadFrame(r io.Reader) (Frame, error) {
 	var (
 		buf   [1]byte
 		state int
@@ -118,7 +347,7 @@ func ReadPong(r io.Reader) (Pong, error) {
 	)
 	for {
 		if _, err := io.ReadFull(r, buf[:]); err != nil {
-			return Pong{}, err
+			return Frame{}, err
 		}
 		b := buf[0]
 		switch state {
@@ -142,23 +371,228 @@ func ReadPong(r io.Reader) (Pong, error) {
 			}
 			body := make([]byte, size)
 			if _, err := io.ReadFull(r, body); err != nil {
-				return Pong{}, err
-			}
-			state = 0
-			if hdr[1] != SystemAddress || body[0] != CmdPong {
-				continue
+				return Frame{}, err
 			}
-			if size < 4 {
-				return Pong{}, fmt.Errorf("pong payload too short: %d", size)
-			}
-			return Pong{
-				DeviceAddress: body[1],
-				MinSubAddress: body[2],
-				MaxSubAddress: body[3],
+			return Frame{
+				DeviceAddress: hdr[1],
+				SubAddress:    hdr[2],
+				Command:       body[0],
+				Payload:       body[1:],
 			}, nil
 		}
 	}
 }
 
+// ReadPong reads bytes from r until it parses a Pong reply or EOF.
+// It tolerates noise bytes between frames and ignores frames that aren't Pongs.
+func ReadPong(r io.Reader) (Pong, error) {
+	for {
+		f, err := ReadFrame(r)
+		if err != nil {
+			return Pong{}, err
+		}
+		if f.DeviceAddress != SystemAddress || f.Command != CmdPong {
+			continue
+		}
+		if len(f.Payload) < 3 {
+			return Pong{}, fmt.Errorf("pong payload too short: %d", len(f.Payload)+1)
+		}
+		return Pong{
+			DeviceAddress: f.Payload[0],
+			MinSubAddress: f.Payload[1],
+			MaxSubAddress: f.Payload[2],
+		}, nil
+	}
+}
+
+// DriveConfig is one drive's settings as reported in reply to GetConfig.
+type DriveConfig struct {
+	DeviceAddress byte
+	Drive         byte
+	Transpose     int8
+	DirCadence    byte
+	Calibration   byte
+	Detune        int8          // cents
+	BendRange     byte          // semitones
+	Sounding      time.Duration // total time the drive has spent playing notes
+	StartDelay    time.Duration
+	TravelMin     byte // head travel window
+	TravelMax     byte
+}
+
+// DecodeDriveConfig decodes a CmdConfig frame. Fields the firmware doesn't
+// report yet keep their zero values.
+func DecodeDriveConfig(f Frame) (DriveConfig, error) {
+	if f.Command != CmdConfig {
+		return DriveConfig{}, fmt.Errorf("not a config frame: command 0x%02X", f.Command)
+	}
+	if len(f.Payload) < 1 {
+		return DriveConfig{}, fmt.Errorf("config payload too short: %d", len(f.Payload)+1)
+	}
+	c := DriveConfig{DeviceAddress: f.Payload[0], Drive: f.SubAddress}
+	p := f.Payload[1:]
+	if len(p) > 0 {
+		c.Transpose = int8(p[0])
+	}
+	if len(p) > 1 {
+		c.DirCadence = p[1]
+	}
+	if len(p) > 2 {
+		c.Calibration = p[2]
+	}
+	if len(p) > 3 {
+		c.Detune = int8(p[3])
+	}
+	if len(p) > 4 {
+		c.BendRange = p[4]
+	}
+	if len(p) > 8 {
+		ticks := uint32(p[5])<<24 | uint32(p[6])<<16 | uint32(p[7])<<8 | uint32(p[8])
+		c.Sounding = time.Duration(ticks) * TickDuration
+	}
+	if len(p) > 9 {
+		c.StartDelay = time.Duration(p[9]) * time.Millisecond
+	}
+	if len(p) > 11 {
+		c.TravelMin = p[10]
+		c.TravelMax = p[11]
+	}
+	return c, nil
+}
+
+// Position is one drive's head or carriage position as reported in reply
+// to GetPositions.
+type Position struct {
+	DeviceAddress byte
+	Drive         byte
+	Steps         uint16
+}
+
+// DecodePosition decodes a CmdPosition frame.
+func DecodePosition(f Frame) (Position, error) {
+	if f.Command != CmdPosition {
+		return Position{}, fmt.Errorf("not a position frame: command 0x%02X", f.Command)
+	}
+	if len(f.Payload) < 3 {
+		return Position{}, fmt.Errorf("position payload too short: %d", len(f.Payload)+1)
+	}
+	return Position{
+		DeviceAddress: f.Payload[0],
+		Drive:         f.SubAddress,
+		Steps:         uint16(f.Payload[1])<<8 | uint16(f.Payload[2]),
+	}, nil
+}
+
+// Route is one route of a device's route table as reported in reply to
+// GetConfig.
+type Route struct {
+	DeviceAddress byte
+	Number        byte // from 1
+	First, Last   byte // sub addresses
+	Instrument    byte
+}
+
+// DecodeRoute decodes a CmdRoute frame.
+func DecodeRoute(f Frame) (Route, error) {
+	if f.Command != CmdRoute {
+		return Route{}, fmt.Errorf("not a route frame: command 0x%02X", f.Command)
+	}
+	if len(f.Payload) < 4 {
+		return Route{}, fmt.Errorf("route payload too short: %d", len(f.Payload)+1)
+	}
+	return Route{
+		DeviceAddress: f.Payload[0],
+		Number:        f.SubAddress,
+		First:         f.Payload[1],
+		Last:          f.Payload[2],
+		Instrument:    f.Payload[3],
+	}, nil
+}
+
+// Status is a device's report of how it is, in reply to GetStatus.
+type Status struct {
+	DeviceAddress byte
+	Uptime        time.Duration // to the second
+	Sounding      int           // drives sounding
+	Drives        []byte        // which, by sub address
+	Sequence      byte          // SequenceIdle, SequencePlaying or SequencePaused
+	Fault         byte          // the last fault the device ran into, FaultNone for none
+}
+
+// DecodeStatus decodes a CmdStatus frame.
+func DecodeStatus(f Frame) (Status, error) {
+	if f.Command != CmdStatus {
+		return Status{}, fmt.Errorf("not a status frame: command 0x%02X", f.Command)
+	}
+	p := f.Payload
+	if len(p) < 10 {
+		return Status{}, fmt.Errorf("status payload too short: %d", len(p)+1)
+	}
+	s := Status{
+		DeviceAddress: p[0],
+		Uptime:        time.Duration(uint32(p[1])<<24|uint32(p[2])<<16|uint32(p[3])<<8|uint32(p[4])) * time.Second,
+		Sounding:      int(p[5]),
+		Sequence:      p[8],
+		Fault:         p[9],
+	}
+	mask := uint16(p[6])<<8 | uint16(p[7])
+	for d := range 16 {
+		if mask&(1<<d) != 0 {
+			s.Drives = append(s.Drives, byte(d+1))
+		}
+	}
+	return s, nil
+}
+
+// SequenceName names a sequence state, as Status reports it.
+func SequenceName(state byte) string {
+	if name, ok := sequenceNames[state]; ok {
+		return name
+	}
+	return fmt.Sprintf("state 0x%02X", state)
+}
+
+// FaultName names a fault, as Status reports it.
+func FaultName(fault byte) string {
+	if name, ok := faultNames[fault]; ok {
+		return name
+	}
+	return fmt.Sprintf("fault 0x%02X", fault)
+}
+
+// InstrumentName names an instrument, as Route reports it.
+func InstrumentName(instrument byte) string {
+	if name, ok := instrumentNames[instrument]; ok {
+		return name
+	}
+	return fmt.Sprintf("instrument 0x%02X", instrument)
+}
+
+var instrumentNames = map[byte]string{
+	InstrumentOther:       "other",
+	InstrumentFloppy:      "floppy",
+	InstrumentHDD:         "hdd",
+	InstrumentRelay:       "relay",
+	InstrumentStepper:     "stepper",
+	InstrumentScanner:     "scanner",
+	InstrumentInterrupter: "interrupter",
+}
+
+var sequenceNames = map[byte]string{
+	SequenceIdle:    "idle",
+	SequencePlaying: "playing",
+	SequencePaused:  "paused",
+}
+
+var faultNames = map[byte]string{
+	FaultNone:           "none",
+	FaultBadSubAddress:  "bad sub address",
+	FaultEmptyFrame:     "empty frame",
+	FaultUnknownCommand: "unknown command",
+	FaultBadPayload:     "bad payload",
+	FaultOverrun:        "timer overrun",
+	FaultLinkTimeout:    "link timeout",
+}
+
 // ErrNoPong is returned when the device fails to respond to a PING in time.
 var ErrNoPong = errors.New("no pong received")
@@ -0,0 +1,149 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	wire "github.com/ystepanoff/goppy/firmware/protocol"
+)
+
+// TestNoteOff pins the note-off the player sends: it names the note, so
+// the firmware only stops a drive still playing it. AllNotesOff names
+// none and goes to sub address 0.
+func TestNoteOff(t *testing.T) {
+	if got, want := NoteOff(0x01, 0x02, 60), []byte{0x4D, 0x01, 0x02, 0x02, 0x08, 60}; !bytes.Equal(got, want) {
+		t.Errorf("NoteOff = % x, want % x", got, want)
+	}
+	if got, want := AllNotesOff(0x01), []byte{0x4D, 0x01, 0x00, 0x01, 0x08}; !bytes.Equal(got, want) {
+		t.Errorf("AllNotesOff = % x, want % x", got, want)
+	}
+}
+
+// TestGliss checks the duration goes out in milliseconds, big-endian,
+// clamped to what the payload carries.
+func TestGliss(t *testing.T) {
+	tests := []struct {
+		d      time.Duration
+		smooth bool
+		want   []byte
+	}{
+		{500 * time.Millisecond, false, []byte{0x4D, 0x01, 0x01, 0x06, 0x10, 48, 60, 0x01, 0xF4, 0x00}},
+		{time.Second, true, []byte{0x4D, 0x01, 0x01, 0x06, 0x10, 48, 60, 0x03, 0xE8, 0x01}},
+		{time.Hour, false, []byte{0x4D, 0x01, 0x01, 0x06, 0x10, 48, 60, 0xFF, 0xFF, 0x00}},
+	}
+	for _, tt := range tests {
+		if got := Gliss(0x01, 0x01, 48, 60, tt.d, tt.smooth); !bytes.Equal(got, tt.want) {
+			t.Errorf("Gliss(%v, %v) = % x, want % x", tt.d, tt.smooth, got, tt.want)
+		}
+	}
+}
+
+// TestDescribe decodes messages for a log: bends in cents at the range a
+// drive was last given, or its device's, and payloads it can't decode in
+// hex after what it can.
+func TestDescribe(t *testing.T) {
+	var d Describer
+	tests := []struct {
+		m    wire.Message
+		want string
+	}{
+		{wire.Message{Device: SystemAddress, Command: CmdSequenceStart}, "system      sequence start"},
+		{wire.Message{Device: 1, Sub: 1, Command: DevCmdNoteOn, Payload: []byte{60, 100}}, "drive 1     note on C4 velocity 100"},
+		{wire.Message{Device: 1, Sub: 1, Command: DevCmdBendPitch, Payload: []byte{0x10, 0x00}}, "drive 1     pitch bend +100 cents (+4096)"},
+		{wire.Message{Device: 1, Command: DevCmdBendRange, Payload: []byte{12}}, "all drives  bend range 12 semitones"},
+		{wire.Message{Device: 1, Sub: 1, Command: DevCmdBendPitch, Payload: []byte{0xF0, 0x00}}, "drive 1     pitch bend -600 cents (-4096)"},
+		{wire.Message{Device: 1, Sub: 2, Command: DevCmdBendRange, Payload: []byte{1}}, "drive 2     bend range 1 semitones"},
+		{wire.Message{Device: 1, Sub: 2, Command: DevCmdBendPitch, Payload: []byte{0x20, 0x00}}, "drive 2     pitch bend +100 cents (+8192)"},
+		{wire.Message{Device: 1, Sub: ZoneSubAddress + 1, Command: DevCmdNoteOff, Payload: []byte{62, 0xAA}}, "zone 2      note off D4 [aa]"},
+		{wire.Message{Device: 1, Sub: 1, Command: 0x7E, Payload: []byte{1, 2}}, "drive 1     command 0x7e [01 02]"},
+		{wire.Message{Device: 1, Sub: 3, Command: DevCmdSustain, Payload: []byte{1}}, "drive 3     sustain down"},
+	}
+	for _, tt := range tests {
+		if got := d.Describe(tt.m).String(); got != tt.want {
+			t.Errorf("Describe(%+v) = %q, want %q", tt.m, got, tt.want)
+		}
+	}
+}
+
+// TestDecodeStatus decodes the status reports in the firmware's
+// testdata/status.json, the fixture its encoder is tested against.
+func TestDecodeStatus(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("..", "..", "firmware", "protocol", "testdata", "status.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var layouts []struct {
+		Name     string
+		Device   byte
+		Uptime   uint32
+		Sounding byte
+		Drives   uint16
+		Sequence byte
+		Fault    byte
+		Frame    string
+	}
+	if err := json.Unmarshal(data, &layouts); err != nil {
+		t.Fatal(err)
+	}
+	if len(layouts) == 0 {
+		t.Fatal("no status layouts found")
+	}
+	for _, l := range layouts {
+		frame, err := hex.DecodeString(strings.ReplaceAll(l.Frame, " ", ""))
+		if err != nil {
+			t.Fatalf("%s: %v", l.Name, err)
+		}
+		f, err := ReadFrame(bytes.NewReader(frame))
+		if err != nil {
+			t.Fatalf("%s: %v", l.Name, err)
+		}
+		got, err := DecodeStatus(f)
+		if err != nil {
+			t.Fatalf("%s: %v", l.Name, err)
+		}
+		var drives []byte
+		for d := range bits.Len16(l.Drives) {
+			if l.Drives&(1<<d) != 0 {
+				drives = append(drives, byte(d+1))
+			}
+		}
+		if got.DeviceAddress != l.Device || got.Uptime != time.Duration(l.Uptime)*time.Second || got.Sounding != int(l.Sounding) ||
+			!slices.Equal(got.Drives, drives) || got.Sequence != l.Sequence || got.Fault != l.Fault {
+			t.Errorf("%s: decoded %+v", l.Name, got)
+		}
+	}
+
+	if _, err := DecodeStatus(Frame{Command: CmdStatus, Payload: []byte{1, 0, 0}}); err == nil {
+		t.Error("decoded a short status")
+	}
+}
+
+func TestDecodeRoute(t *testing.T) {
+	f, err := ReadFrame(bytes.NewReader(encode(wire.Route(0x01, 2, 7, 8, InstrumentHDD))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeRoute(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Route{DeviceAddress: 0x01, Number: 2, First: 7, Last: 8, Instrument: InstrumentHDD}
+	if got != want {
+		t.Errorf("DecodeRoute = %+v, want %+v", got, want)
+	}
+	if InstrumentName(got.Instrument) != "hdd" {
+		t.Errorf("InstrumentName(%d) = %q", got.Instrument, InstrumentName(got.Instrument))
+	}
+
+	if _, err := DecodeRoute(Frame{Command: CmdRoute, Payload: []byte{1, 7}}); err == nil {
+		t.Error("decoded a short route")
+	}
+}
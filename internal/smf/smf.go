@@ -1,18 +1,36 @@
 // Package smf is a minimal Standard MIDI File (SMF) reader.
 //
-// It supports formats 0/1/2 with PPQN (metric) division, decodes channel
-// note-on/note-off and tempo meta events, and ignores everything else.
-// The output is a flat, time-sorted slice of NoteEvents with absolute
-// nanosecond offsets from the start of playback — exactly what the host
-// CLI needs to drive the floppies.
+// It supports formats 0/1/2 with PPQN (metric) or SMPTE division, decodes
+// channel note-on/note-off, sustain pedal (CC64), pitch bend and its
+// sensitivity (RPN 0), channel pressure, program change, tempo and time
+// signature meta events, and markers named loopStart and loopEnd, and
+// ignores everything else. The output is a flat, time-sorted slice of
+// NoteEvents with absolute nanosecond offsets from the start of playback —
+// exactly what the host CLI needs to drive the floppies. With PPQN
+// division, offsets come from a tempo map of every Set Tempo in the file,
+// whichever track it is on, at 120 BPM until the first; with SMPTE
+// division a tick is a fixed fraction of a frame, whatever the tempo.
+//
+// A format 2 file's tracks are patterns, each timed on its own:
+// ParsePatterns returns them apart, and Parse one after another.
+//
+// Files from the wild are read as far as they go: a track cut short, by
+// a chunk running past the end of the file or an event cut off part way,
+// keeps the events before the cut. Running status carries across meta
+// and SysEx events, as files written by sequencers that don't cancel it
+// there need.
 package smf
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/bits"
 	"os"
 	"sort"
+	"strings"
 	"time"
 )
 
@@ -22,15 +40,26 @@ type EventKind int
 const (
 	EventNoteOn EventKind = iota
 	EventNoteOff
+	EventSustain   // CC64; Velocity carries the pedal value (>= 64 is down)
+	EventBendRange // RPN 0 data entry; Velocity carries the range in semitones
+	EventPressure  // channel aftertouch; Velocity carries the pressure
+	EventPitchBend // Bend carries the 14-bit bend, 8192 at the centre
+	EventTempo     // Tempo carries the new tempo
+	EventMeter     // time signature; Note carries the numerator, Velocity the denominator
+	EventLoopStart // a marker named loopStart, in any case
+	EventLoopEnd   // a marker named loopEnd
+	EventProgram   // program change; Velocity carries the program
 )
 
 // NoteEvent is a flattened, absolutely-timed note event.
 type NoteEvent struct {
 	At       time.Duration // offset from start of song
 	Kind     EventKind
-	Channel  byte // 0..15
-	Note     byte // MIDI note number 0..127
-	Velocity byte // 0..127 (NOTE_OFF is velocity 0 here)
+	Channel  byte   // 0..15
+	Note     byte   // MIDI note number 0..127
+	Velocity byte   // 0..127 (NOTE_OFF is velocity 0 here)
+	Bend     uint16 // EventPitchBend only: 0..16383
+	Tempo    uint32 // EventTempo only: microseconds per quarter note
 }
 
 // Read parses an SMF file at path.
@@ -43,8 +72,37 @@ func Read(path string) ([]NoteEvent, error) {
 	return Parse(f)
 }
 
-// Parse parses an SMF stream.
+// Parse parses an SMF stream. A format 2 file's patterns are played one
+// after another: see Concat.
 func Parse(r io.Reader) ([]NoteEvent, error) {
+	patterns, err := ParsePatterns(r)
+	if err != nil {
+		return nil, err
+	}
+	return Concat(patterns), nil
+}
+
+// Pattern is a song, or one of a format 2 file's patterns.
+type Pattern struct {
+	Events []NoteEvent
+	Length time.Duration // to its last end-of-track, or its last event
+}
+
+// ReadPatterns parses the SMF file at path into its patterns: see
+// ParsePatterns.
+func ReadPatterns(path string) ([]Pattern, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParsePatterns(f)
+}
+
+// ParsePatterns parses an SMF stream into its patterns: one for each
+// track of a format 2 file, timed from its own start through its own
+// tempo changes, and one, the whole song, for format 0 and 1 files.
+func ParsePatterns(r io.Reader) ([]Pattern, error) {
 	data, err := io.ReadAll(r)
 	if err != nil {
 		return nil, err
@@ -53,6 +111,41 @@ func Parse(r io.Reader) ([]NoteEvent, error) {
 	return p.parse()
 }
 
+// Concat returns patterns one after another, each starting at the end of
+// the one before. A pattern starts at 120 BPM in 4/4 unless it says
+// otherwise at its start, as when played alone, so a tempo or time
+// signature the one before left isn't carried into it.
+func Concat(patterns []Pattern) []NoteEvent {
+	var (
+		out   []NoteEvent
+		start time.Duration
+	)
+	for i, pt := range patterns {
+		if i > 0 {
+			var tempo, meter bool
+			for _, ev := range pt.Events {
+				if ev.At > 0 {
+					break
+				}
+				tempo = tempo || ev.Kind == EventTempo
+				meter = meter || ev.Kind == EventMeter
+			}
+			if !tempo {
+				out = append(out, NoteEvent{At: start, Kind: EventTempo, Tempo: defaultTempo})
+			}
+			if !meter {
+				out = append(out, NoteEvent{At: start, Kind: EventMeter, Note: 4, Velocity: 4})
+			}
+		}
+		for _, ev := range pt.Events {
+			ev.At += start
+			out = append(out, ev)
+		}
+		start += pt.Length
+	}
+	return out
+}
+
 type parser struct {
 	buf []byte
 	pos int
@@ -65,14 +158,23 @@ type rawEvent struct {
 	// One of these is set:
 	noteOn       bool
 	noteOff      bool
+	sustain      bool
+	bendRange    bool
+	pressure     bool
+	program      bool
+	pitchBend    bool
 	tempoChange  bool
 	tempoUsPerQN uint32
+	timeSig      bool
+	loopStart    bool
+	loopEnd      bool
 	channel      byte
 	note         byte
 	velocity     byte
+	bend         uint16
 }
 
-func (p *parser) parse() ([]NoteEvent, error) {
+func (p *parser) parse() ([]Pattern, error) {
 	if len(p.buf) < 14 {
 		return nil, fmt.Errorf("smf: file too small")
 	}
@@ -83,19 +185,21 @@ func (p *parser) parse() ([]NoteEvent, error) {
 	if headerLen < 6 {
 		return nil, fmt.Errorf("smf: bad header length %d", headerLen)
 	}
-	division := binary.BigEndian.Uint16(p.buf[12:14])
-	if division&0x8000 != 0 {
-		return nil, fmt.Errorf("smf: SMPTE timing not supported")
+	format := binary.BigEndian.Uint16(p.buf[8:10])
+	if format > 2 {
+		return nil, fmt.Errorf("smf: unknown format %d", format)
 	}
-	ppqn := uint32(division)
-	if ppqn == 0 {
-		return nil, fmt.Errorf("smf: invalid PPQN 0")
+	clock, err := newClock(binary.BigEndian.Uint16(p.buf[12:14]))
+	if err != nil {
+		return nil, err
 	}
 
 	p.pos = 8 + int(headerLen)
 
-	var raws []rawEvent
-	trackIdx := 0
+	var (
+		tracks [][]rawEvent
+		ends   []uint64 // each track's end, in ticks
+	)
 	order := 0
 	for p.pos < len(p.buf) {
 		if p.pos+8 > len(p.buf) {
@@ -104,19 +208,34 @@ func (p *parser) parse() ([]NoteEvent, error) {
 		chunkID := string(p.buf[p.pos : p.pos+4])
 		chunkLen := binary.BigEndian.Uint32(p.buf[p.pos+4 : p.pos+8])
 		p.pos += 8
-		end := p.pos + int(chunkLen)
-		if end > len(p.buf) {
-			return nil, fmt.Errorf("smf: chunk %q overflows file", chunkID)
-		}
+		// A chunk running past the end of the file is read as far as it
+		// goes.
+		end := min(p.pos+int(chunkLen), len(p.buf))
 		if chunkID == "MTrk" {
-			if err := p.parseTrack(p.buf[p.pos:end], trackIdx, &raws, &order); err != nil {
-				return nil, fmt.Errorf("track %d: %w", trackIdx, err)
+			var raws []rawEvent
+			tick, err := p.parseTrack(p.buf[p.pos:end], len(tracks), &raws, &order)
+			if err != nil {
+				return nil, fmt.Errorf("track %d: %w", len(tracks), err)
 			}
-			trackIdx++
+			tracks = append(tracks, raws)
+			ends = append(ends, tick)
 		}
 		p.pos = end
 	}
 
+	if format == 2 {
+		patterns := make([]Pattern, len(tracks))
+		for i, raws := range tracks {
+			patterns[i] = clock.pattern(raws, ends[i])
+		}
+		return patterns, nil
+	}
+	var raws []rawEvent
+	var end uint64
+	for i := range tracks {
+		raws = append(raws, tracks[i]...)
+		end = max(end, ends[i])
+	}
 	// Stable sort by absolute tick, then by track/order for determinism.
 	sort.SliceStable(raws, func(i, j int) bool {
 		if raws[i].absTicks != raws[j].absTicks {
@@ -127,24 +246,83 @@ func (p *parser) parse() ([]NoteEvent, error) {
 		}
 		return raws[i].order < raws[j].order
 	})
+	return []Pattern{clock.pattern(raws, end)}, nil
+}
 
-	// Walk events accumulating real time as tempo changes.
-	const defaultTempo uint32 = 500000 // µs per quarter (120 BPM)
-	tempo := defaultTempo
-	var (
-		out          []NoteEvent
-		lastTicks    uint64
-		curTime      time.Duration
-		usPerTick    = float64(tempo) / float64(ppqn)
-	)
+// clock is a file's division: PPQN, timed through a tempo map, or SMPTE.
+type clock struct {
+	ppqn uint32
+
+	// With SMPTE division a tick lasts nsNum/nsDen ns: a second over the
+	// frame rate, the fraction 30000/1001 for 29.97 drop-frame, times the
+	// ticks a frame.
+	nsNum, nsDen uint64
+}
+
+// newClock reads the header's division word: PPQN, or with the top bit
+// set the negated SMPTE frame rate in the high byte and the ticks a frame
+// in the low.
+func newClock(division uint16) (clock, error) {
+	if division&0x8000 == 0 {
+		if division == 0 {
+			return clock{}, fmt.Errorf("smf: invalid PPQN 0")
+		}
+		return clock{ppqn: uint32(division)}, nil
+	}
+	fps := -int(int8(division >> 8))
+	perFrame := uint64(division & 0xFF)
+	if perFrame == 0 {
+		return clock{}, fmt.Errorf("smf: SMPTE division with 0 ticks a frame")
+	}
+	switch fps {
+	case 24, 25, 30:
+		return clock{nsNum: 1e9, nsDen: uint64(fps) * perFrame}, nil
+	case 29:
+		return clock{nsNum: 1e9 * 1001, nsDen: 30000 * perFrame}, nil
+	}
+	return clock{}, fmt.Errorf("smf: SMPTE frame rate %d: want 24, 25, 29 or 30", fps)
+}
+
+// pattern returns raws, sorted by tick, as a Pattern ending at tick end.
+func (c clock) pattern(raws []rawEvent, end uint64) Pattern {
+	at := c.smpte
+	if c.ppqn != 0 {
+		at = newTempoMap(c.ppqn, raws).at
+	}
+	if n := len(raws); n > 0 {
+		end = max(end, raws[n-1].absTicks)
+	}
+	return Pattern{Events: events(raws, at), Length: at(end)}
+}
+
+// smpte returns the time of tick under SMPTE division, exactly, rounded
+// down to the nanosecond.
+func (c clock) smpte(tick uint64) time.Duration {
+	hi, lo := bits.Mul64(tick, c.nsNum)
+	if hi >= c.nsDen {
+		return math.MaxInt64
+	}
+	q, _ := bits.Div64(hi, lo, c.nsDen)
+	return time.Duration(min(q, math.MaxInt64))
+}
+
+// events returns raws, sorted by tick, as NoteEvents timed by at.
+func events(raws []rawEvent, at func(tick uint64) time.Duration) []NoteEvent {
+	var out []NoteEvent
 	for _, ev := range raws {
-		dt := ev.absTicks - lastTicks
-		curTime += time.Duration(float64(dt)*usPerTick) * time.Microsecond
-		lastTicks = ev.absTicks
+		curTime := at(ev.absTicks)
 		switch {
 		case ev.tempoChange:
-			tempo = ev.tempoUsPerQN
-			usPerTick = float64(tempo) / float64(ppqn)
+			out = append(out, NoteEvent{At: curTime, Kind: EventTempo, Tempo: ev.tempoUsPerQN})
+		case ev.timeSig:
+			out = append(out, NoteEvent{
+				At: curTime, Kind: EventMeter,
+				Note: ev.note, Velocity: ev.velocity,
+			})
+		case ev.loopStart:
+			out = append(out, NoteEvent{At: curTime, Kind: EventLoopStart})
+		case ev.loopEnd:
+			out = append(out, NoteEvent{At: curTime, Kind: EventLoopEnd})
 		case ev.noteOn:
 			out = append(out, NoteEvent{
 				At: curTime, Kind: EventNoteOn,
@@ -155,27 +333,113 @@ func (p *parser) parse() ([]NoteEvent, error) {
 				At: curTime, Kind: EventNoteOff,
 				Channel: ev.channel, Note: ev.note,
 			})
+		case ev.sustain:
+			out = append(out, NoteEvent{
+				At: curTime, Kind: EventSustain,
+				Channel: ev.channel, Velocity: ev.velocity,
+			})
+		case ev.bendRange:
+			out = append(out, NoteEvent{
+				At: curTime, Kind: EventBendRange,
+				Channel: ev.channel, Velocity: ev.velocity,
+			})
+		case ev.pressure:
+			out = append(out, NoteEvent{
+				At: curTime, Kind: EventPressure,
+				Channel: ev.channel, Velocity: ev.velocity,
+			})
+		case ev.pitchBend:
+			out = append(out, NoteEvent{
+				At: curTime, Kind: EventPitchBend,
+				Channel: ev.channel, Bend: ev.bend,
+			})
+		case ev.program:
+			out = append(out, NoteEvent{
+				At: curTime, Kind: EventProgram,
+				Channel: ev.channel, Velocity: ev.velocity,
+			})
 		}
 	}
-	return out, nil
+	return out
+}
+
+// defaultTempo is the tempo until a song's first Set Tempo: 120 BPM.
+const defaultTempo uint32 = 500000 // µs per quarter note
+
+// tempoMap converts ticks to time from the start of the song through
+// every tempo change, on whichever track it is.
+type tempoMap struct {
+	ppqn     uint32
+	segments []tempoSegment // by tick, the first at tick 0
+}
+
+// tempoSegment is a run of ticks at one tempo.
+type tempoSegment struct {
+	tick  uint64
+	start uint64 // the segment's start in µs×PPQN, exact
+	tempo uint32 // µs per quarter note
+}
+
+// newTempoMap builds the tempo map of raws, sorted by tick.
+func newTempoMap(ppqn uint32, raws []rawEvent) *tempoMap {
+	m := &tempoMap{ppqn: ppqn, segments: []tempoSegment{{tempo: defaultTempo}}}
+	for _, ev := range raws {
+		if !ev.tempoChange || ev.tempoUsPerQN == 0 {
+			continue
+		}
+		last := &m.segments[len(m.segments)-1]
+		if last.tick == ev.absTicks {
+			// Changed again on the same tick: the later change holds.
+			last.tempo = ev.tempoUsPerQN
+			continue
+		}
+		m.segments = append(m.segments, tempoSegment{tick: ev.absTicks, start: m.scaled(ev.absTicks), tempo: ev.tempoUsPerQN})
+	}
+	return m
+}
+
+// scaled returns the time of tick in µs×PPQN.
+func (m *tempoMap) scaled(tick uint64) uint64 {
+	i := sort.Search(len(m.segments), func(i int) bool { return m.segments[i].tick > tick }) - 1
+	s := m.segments[i]
+	return s.start + (tick-s.tick)*uint64(s.tempo)
+}
+
+// at returns the time of tick. Tick times are summed exactly, in µs×PPQN,
+// and only rounded down to the nanosecond at the end, so rounding doesn't
+// build up over a song however many events or tempo changes it has.
+func (m *tempoMap) at(tick uint64) time.Duration {
+	return time.Duration(m.scaled(tick) * 1000 / uint64(m.ppqn))
 }
 
-func (p *parser) parseTrack(track []byte, trackIdx int, out *[]rawEvent, order *int) error {
+// parseTrack parses track's events onto out, and returns the tick it ends
+// on, that of its end-of-track. A track cut short ends where it is cut,
+// keeping the events before.
+func (p *parser) parseTrack(track []byte, trackIdx int, out *[]rawEvent, order *int) (uint64, error) {
 	var (
 		pos      int
 		absTicks uint64
 		running  byte
+		// rpn is the registered parameter each channel last selected with
+		// CC101/CC100, as [MSB, LSB]; 0x7F/0x7F is the null parameter.
+		rpn [16][2]byte
 	)
+	for i := range rpn {
+		rpn[i] = [2]byte{0x7F, 0x7F}
+	}
 	for pos < len(track) {
 		delta, n, err := readVarLen(track[pos:])
+		if err == errTruncated {
+			return absTicks, nil
+		}
 		if err != nil {
-			return err
+			return 0, err
 		}
 		pos += n
 		absTicks += uint64(delta)
 
 		if pos >= len(track) {
-			return fmt.Errorf("unexpected end of track")
+			return absTicks, nil
 		}
 		status := track[pos]
 
@@ -183,17 +447,20 @@ func (p *parser) parseTrack(track []byte, trackIdx int, out *[]rawEvent, order *
 			// Meta event
 			pos++
 			if pos >= len(track) {
-				return fmt.Errorf("truncated meta event")
+				return absTicks, nil
 			}
 			metaType := track[pos]
 			pos++
 			length, n, err := readVarLen(track[pos:])
+			if err == errTruncated {
+				return absTicks, nil
+			}
 			if err != nil {
-				return err
+				return 0, err
 			}
 			pos += n
 			if pos+int(length) > len(track) {
-				return fmt.Errorf("truncated meta data")
+				return absTicks, nil
 			}
 			data := track[pos : pos+int(length)]
 			pos += int(length)
@@ -205,26 +472,58 @@ func (p *parser) parseTrack(track []byte, trackIdx int, out *[]rawEvent, order *
 				})
 				*order++
 			}
-			// 0x2F end-of-track and others: ignore
+			if metaType == 0x58 && len(data) >= 2 && data[1] < 8 {
+				*out = append(*out, rawEvent{
+					track: trackIdx, absTicks: absTicks, order: *order,
+					timeSig: true, note: data[0], velocity: 1 << data[1],
+				})
+				*order++
+			}
+			if metaType == 0x06 {
+				start := strings.EqualFold(string(data), "loopStart")
+				if start || strings.EqualFold(string(data), "loopEnd") {
+					*out = append(*out, rawEvent{
+						track: trackIdx, absTicks: absTicks, order: *order,
+						loopStart: start, loopEnd: !start,
+					})
+					*order++
+				}
+			}
+			if metaType == 0x2F {
+				// End of track: anything after it isn't part of the song.
+				return absTicks, nil
+			}
+			// Others: ignore
 			continue
 		}
 
 		if status == 0xF0 || status == 0xF7 {
-			// SysEx: skip its var-len-prefixed body
+			// SysEx: skip its var-len-prefixed body. Running status
+			// carries over it, as over a meta event.
 			pos++
 			length, n, err := readVarLen(track[pos:])
+			if err == errTruncated {
+				return absTicks, nil
+			}
 			if err != nil {
-				return err
+				return 0, err
 			}
 			pos += n + int(length)
+			if pos > len(track) {
+				return absTicks, nil
+			}
 			continue
 		}
+		if status > 0xF0 {
+			// System common and real-time messages have no place in a file.
+			return 0, fmt.Errorf("unexpected status byte 0x%02X", status)
+		}
 
 		// Channel message (with running status support).
 		if status&0x80 == 0 {
 			// Data byte; reuse running status, don't advance.
 			if running == 0 {
-				return fmt.Errorf("running status with no prior status")
+				return 0, fmt.Errorf("running status with no prior status")
 			}
 			status = running
 		} else {
@@ -238,7 +537,7 @@ func (p *parser) parseTrack(track []byte, trackIdx int, out *[]rawEvent, order *
 		case 0x80, 0x90, 0xA0, 0xB0, 0xE0:
 			// Two data bytes
 			if pos+2 > len(track) {
-				return fmt.Errorf("truncated 2-byte channel msg")
+				return absTicks, nil
 			}
 			d1 := track[pos]
 			d2 := track[pos+1]
@@ -263,19 +562,56 @@ func (p *parser) parseTrack(track []byte, trackIdx int, out *[]rawEvent, order *
 					noteOff: true, channel: ch, note: d1,
 				})
 				*order++
+			case 0xE0:
+				*out = append(*out, rawEvent{
+					track: trackIdx, absTicks: absTicks, order: *order,
+					pitchBend: true, channel: ch, bend: uint16(d2&0x7F)<<7 | uint16(d1&0x7F),
+				})
+				*order++
+			case 0xB0:
+				switch d1 {
+				case 64:
+					*out = append(*out, rawEvent{
+						track: trackIdx, absTicks: absTicks, order: *order,
+						sustain: true, channel: ch, velocity: d2,
+					})
+					*order++
+				case 101:
+					rpn[ch][0] = d2
+				case 100:
+					rpn[ch][1] = d2
+				case 6:
+					// Data entry MSB; for RPN 0 it is the bend range in semitones.
+					if rpn[ch] == [2]byte{0, 0} {
+						*out = append(*out, rawEvent{
+							track: trackIdx, absTicks: absTicks, order: *order,
+							bendRange: true, channel: ch, velocity: d2,
+						})
+						*order++
+					}
+				}
 			}
 		case 0xC0, 0xD0:
 			if pos+1 > len(track) {
-				return fmt.Errorf("truncated 1-byte channel msg")
+				return absTicks, nil
 			}
+			*out = append(*out, rawEvent{
+				track: trackIdx, absTicks: absTicks, order: *order,
+				pressure: hi == 0xD0, program: hi == 0xC0, channel: ch, velocity: track[pos],
+			})
+			*order++
 			pos++
 		default:
-			return fmt.Errorf("unknown status byte 0x%02X", status)
+			return 0, fmt.Errorf("unknown status byte 0x%02X", status)
 		}
 	}
-	return nil
+	return absTicks, nil
 }
 
+var errTruncated = errors.New("smf: truncated")
+
+// readVarLen reads a variable-length quantity from the start of b. It
+// returns errTruncated if b ends first.
 func readVarLen(b []byte) (value uint32, n int, err error) {
 	for i := 0; i < 4 && i < len(b); i++ {
 		value = (value << 7) | uint32(b[i]&0x7F)
@@ -283,5 +619,8 @@ func readVarLen(b []byte) (value uint32, n int, err error) {
 			return value, i + 1, nil
 		}
 	}
+	if len(b) < 4 {
+		return 0, 0, errTruncated
+	}
 	return 0, 0, fmt.Errorf("variable-length quantity overran")
 }
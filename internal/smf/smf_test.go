@@ -0,0 +1,268 @@
+package smf
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// timesOf returns when each event of kind happens, in milliseconds.
+func timesOf(events []NoteEvent, kind EventKind) []float64 {
+	var ms []float64
+	for _, ev := range events {
+		if ev.Kind == kind {
+			ms = append(ms, float64(ev.At)/float64(time.Millisecond))
+		}
+	}
+	return ms
+}
+
+func checkTimes(t *testing.T, what string, got, want []float64) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %d events %v, want %d %v", what, len(got), got, len(want), want)
+	}
+	for i := range got {
+		if d := got[i] - want[i]; d < -0.0005 || d > 0.0005 {
+			t.Errorf("%s %d at %.4fms, want %vms", what, i, got[i], want[i])
+		}
+	}
+}
+
+// The fixtures' times are worked out by hand, a segment of the tempo map
+// at a time: a tick lasts tempo/PPQN microseconds.
+func TestTempoMap(t *testing.T) {
+	tests := []struct {
+		song              string
+		ons, offs, tempos []float64
+	}{
+		{
+			// PPQN 480, a note every beat on track 1; track 0 speeds up
+			// from 500000µs a beat to 400000 at beat 2, 300000 at beat 4
+			// and 250000 at beat 5: 500ms, 400ms, 300ms then 250ms a beat.
+			song:   "accelerando.mid",
+			ons:    []float64{0, 500, 1000, 1400, 1800, 2100, 2350, 2600},
+			offs:   []float64{250, 750, 1200, 1600, 1950, 2225, 2475, 2725},
+			tempos: []float64{0, 1000, 1800, 2100},
+		},
+		{
+			// PPQN 96, notes on track 0 and the tempo changes on track 2:
+			// 120 BPM until tick 96, 1000000µs a beat until tick 144, half
+			// way through that beat, then 600000.
+			song:   "latetempo.mid",
+			ons:    []float64{0, 500, 1000, 1300, 1900},
+			offs:   []float64{125, 750, 1150, 1450, 2050},
+			tempos: []float64{500, 1000},
+		},
+		{
+			// PPQN 100 and no tempo: 120 BPM, 5ms a tick.
+			song: "notempo.mid",
+			ons:  []float64{0, 250, 750, 5000},
+			offs: []float64{50, 300, 800, 5050},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.song, func(t *testing.T) {
+			events, err := Read("testdata/" + tt.song)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTimes(t, "note-on", timesOf(events, EventNoteOn), tt.ons)
+			checkTimes(t, "note-off", timesOf(events, EventNoteOff), tt.offs)
+			checkTimes(t, "tempo", timesOf(events, EventTempo), tt.tempos)
+		})
+	}
+}
+
+// TestRubato reads a song whose tempo swings between 500000 and 600000µs
+// a beat every 4 ticks at PPQN 384, with a note every 2 ticks: 768 tempo
+// changes and over 1500 notes, and no time lost to rounding along the
+// way. Every 8 ticks take 4×(500000+600000)/384µs, 11458⅓µs.
+func TestRubato(t *testing.T) {
+	events, err := Read("testdata/rubato.mid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ons := timesOf(events, EventNoteOn)
+	if len(ons) != 769 {
+		t.Fatalf("got %d notes, want 769", len(ons))
+	}
+	checkTimes(t, "note-on", []float64{ons[2], ons[384], ons[768]}, []float64{
+		5.208333, // tick 4: one fast segment
+		1100,     // tick 768: 96 swings
+		2200,     // tick 1536: 192 swings
+	})
+	for i, ms := range ons {
+		tick := 2 * i
+		us := float64(tick/8) * 4 * 1100000 / 384
+		if rest := tick % 8; rest > 4 {
+			us += 4*500000.0/384 + float64(rest-4)*600000/384
+		} else {
+			us += float64(rest) * 500000 / 384
+		}
+		if d := ms*1000 - us; d < -0.001 || d > 0.001 {
+			t.Fatalf("note %d at tick %d: %.4fms, want %.4fms", i, tick, ms, us/1000)
+		}
+	}
+}
+
+// TestMarkers reads a song with three markers, at beats 0, 1 and 3 of
+// PPQN 96, the tempo going from 500000µs a beat to 600000 at beat 2: an
+// intro, ignored, then loopStart and LOOPEND.
+func TestMarkers(t *testing.T) {
+	events, err := Read("testdata/markers.mid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTimes(t, "loop start", timesOf(events, EventLoopStart), []float64{500})
+	checkTimes(t, "loop end", timesOf(events, EventLoopEnd), []float64{1600})
+	checkTimes(t, "note-on", timesOf(events, EventNoteOn), []float64{0, 250, 500, 500, 1000, 1600})
+}
+
+// TestSMPTE reads files with SMPTE division, where a tick is a fixed part
+// of a frame, whatever tempo they set.
+func TestSMPTE(t *testing.T) {
+	tests := []struct {
+		song      string
+		ons, offs []float64
+	}{
+		{
+			// 25 fps, 40 ticks a frame: 1ms a tick, the tempo changes
+			// ignored. The last note-on is at frame 50, subframe 7.
+			song: "smpte25.mid",
+			ons:  []float64{0, 1000, 2007},
+			offs: []float64{500, 1500, 3000},
+		},
+		{
+			// 29.97 drop-frame, 30000/1001 frames a second, 100 ticks a
+			// frame, on track 1 of a format 1 file: a tick is 1001/3000ms,
+			// and 1800 frames, a minute at 30 fps, a minute and 60ms.
+			song: "smpte2997.mid",
+			ons:  []float64{0, 33.366667, 60060},
+			offs: []float64{0.333667, 1001, 60076.683333},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.song, func(t *testing.T) {
+			events, err := Read("testdata/" + tt.song)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTimes(t, "note-on", timesOf(events, EventNoteOn), tt.ons)
+			checkTimes(t, "note-off", timesOf(events, EventNoteOff), tt.offs)
+		})
+	}
+
+	for _, tt := range []struct {
+		division uint16
+		tick     uint64
+		want     time.Duration
+		err      bool
+	}{
+		{0xE8<<8 | 4, 96, time.Second, false},                // 24 fps, 4 ticks a frame
+		{0xE2<<8 | 80, 2400, time.Second, false},             // 30 fps, 80 ticks a frame
+		{0xE3<<8 | 80, 2400, 1001 * time.Millisecond, false}, // 29.97 fps
+		{0xE3<<8 | 1, 1, 33366666 * time.Nanosecond, false},  // one frame, rounded down
+		{0xE6<<8 | 4, 0, 0, true},                            // 26 fps
+		{0xE7<<8 | 0, 0, 0, true},                            // 25 fps, no ticks a frame
+	} {
+		c, err := newClock(tt.division)
+		if tt.err {
+			if err == nil {
+				t.Errorf("division %04X: no error", tt.division)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("division %04X: %v", tt.division, err)
+		}
+		if got := c.smpte(tt.tick); got != tt.want {
+			t.Errorf("division %04X: tick %d at %v, want %v", tt.division, tt.tick, got, tt.want)
+		}
+	}
+}
+
+// TestFormat2 reads a format 2 file of three patterns at PPQN 96: the
+// first at 600000µs a beat, 192 ticks long; the second at the default 120
+// BPM, 384 ticks; the third in 3/4 at 1000000µs a beat, 96 ticks.
+func TestFormat2(t *testing.T) {
+	f, err := os.Open("testdata/format2.mid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	patterns, err := ParsePatterns(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		ons, offs []float64
+		length    time.Duration
+	}{
+		{[]float64{0, 600}, []float64{300, 900}, 1200 * time.Millisecond},
+		{[]float64{0, 1000}, []float64{500, 1500}, 2 * time.Second},
+		{[]float64{0}, []float64{1000}, time.Second},
+	}
+	if len(patterns) != len(want) {
+		t.Fatalf("got %d patterns, want %d", len(patterns), len(want))
+	}
+	for i, pt := range patterns {
+		checkTimes(t, fmt.Sprint("pattern ", i+1, " note-on"), timesOf(pt.Events, EventNoteOn), want[i].ons)
+		checkTimes(t, fmt.Sprint("pattern ", i+1, " note-off"), timesOf(pt.Events, EventNoteOff), want[i].offs)
+		if pt.Length != want[i].length {
+			t.Errorf("pattern %d lasts %v, want %v", i+1, pt.Length, want[i].length)
+		}
+	}
+
+	// One after another, each pattern starts at 120 BPM in 4/4 unless it
+	// says otherwise.
+	events, err := Read("testdata/format2.mid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTimes(t, "note-on", timesOf(events, EventNoteOn), []float64{0, 600, 1200, 2200, 3200})
+	checkTimes(t, "note-off", timesOf(events, EventNoteOff), []float64{300, 900, 1700, 2700, 4200})
+	checkTimes(t, "tempo", timesOf(events, EventTempo), []float64{0, 1200, 3200})
+	checkTimes(t, "meter", timesOf(events, EventMeter), []float64{1200, 3200})
+	var tempos []uint32
+	for _, ev := range events {
+		if ev.Kind == EventTempo {
+			tempos = append(tempos, ev.Tempo)
+		}
+	}
+	if !slices.Equal(tempos, []uint32{600000, 500000, 1000000}) {
+		t.Errorf("tempos %v, want the first pattern's, the default, then the third's", tempos)
+	}
+}
+
+// TestDamaged reads files real sequencers leave: a track cut short part
+// way through a note-on, its chunk claiming more than the file has, and
+// running status carried over a text meta event and a SysEx.
+func TestDamaged(t *testing.T) {
+	events, err := Read("testdata/truncated.mid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTimes(t, "truncated note-on", timesOf(events, EventNoteOn), []float64{0})
+	checkTimes(t, "truncated note-off", timesOf(events, EventNoteOff), []float64{500})
+
+	events, err = Read("testdata/running.mid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTimes(t, "running note-on", timesOf(events, EventNoteOn), []float64{0, 500})
+	checkTimes(t, "running note-off", timesOf(events, EventNoteOff), []float64{250, 1000})
+	if events[2].Note != 62 || events[2].Velocity != 100 {
+		t.Errorf("after the SysEx got %+v, want note 62 struck", events[2])
+	}
+
+	// A status byte no file may hold is an error, not a running status.
+	bad := append([]byte("MThd\x00\x00\x00\x06\x00\x00\x00\x01\x00\x60MTrk\x00\x00\x00\x07"), 0x00, 0x90, 60, 100, 0x00, 0xF8, 60)
+	if _, err := Parse(bytes.NewReader(bad)); err == nil || !strings.Contains(err.Error(), "0xF8") {
+		t.Errorf("a real-time byte in a track: %v, want an error naming it", err)
+	}
+}
@@ -0,0 +1,196 @@
+// Package wstest is a WebSocket client, for tests of servers. It speaks
+// as much of RFC 6455 as package feed does, masking what it sends as a
+// browser would:
+//
+//	c := wstest.Dial(t, srv.URL+"/events")
+//	c.Send(t, `{"action":"pause"}`)
+//	ev := c.Wait(t, func(ev map[string]any) bool { return ev["type"] == "status" })
+//
+// Its framing is its own, not package feed's, so that a test can't pass
+// on an encoding bug the two share.
+package wstest
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Opcodes.
+const (
+	OpText  = 0x1
+	OpClose = 0x8
+	OpPing  = 0x9
+	OpPong  = 0xA
+)
+
+// Timeout is how long Read waits for a frame.
+const Timeout = 5 * time.Second
+
+// Conn is a client's connection.
+type Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Frame is a frame as read.
+type Frame struct {
+	Op      byte
+	Payload []byte
+}
+
+// CloseCode returns a close frame's status code, or 0.
+func (f Frame) CloseCode() int {
+	if f.Op != OpClose || len(f.Payload) < 2 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(f.Payload))
+}
+
+// Dial connects to the WebSocket at rawURL, http:// or ws://, and fails
+// t if the server doesn't take it.
+func Dial(t testing.TB, rawURL string) *Conn {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, Timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", u.RequestURI(), u.Host, key)
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(Timeout))
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		conn.Close()
+		t.Fatalf("handshake answered %s, accept %q", resp.Status, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+	c := &Conn{conn: conn, r: r}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// New returns the client's end of conn, a connection already upgraded,
+// as one end of a net.Pipe.
+func New(conn net.Conn) *Conn {
+	return &Conn{conn: conn, r: bufio.NewReader(conn)}
+}
+
+// Send sends text as a message.
+func (c *Conn) Send(t testing.TB, text string) {
+	t.Helper()
+	if err := c.WriteFrame(OpText, true, []byte(text)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// WriteFrame sends a frame, masked.
+func (c *Conn) WriteFrame(op byte, fin bool, payload []byte) error {
+	head := op
+	if fin {
+		head |= 0x80
+	}
+	b := []byte{head}
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, 0x80|byte(n))
+	case n <= 0xFFFF:
+		b = binary.BigEndian.AppendUint16(append(b, 0x80|126), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint64(append(b, 0x80|127), uint64(n))
+	}
+	var mask [4]byte
+	rand.Read(mask[:])
+	b = append(b, mask[:]...)
+	for i, x := range payload {
+		b = append(b, x^mask[i%4])
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(Timeout))
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// Read reads a frame, waiting at most Timeout.
+func (c *Conn) Read() (Frame, error) {
+	c.conn.SetReadDeadline(time.Now().Add(Timeout))
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return Frame{}, err
+	}
+	if head[1]&0x80 != 0 {
+		return Frame{}, fmt.Errorf("wstest: server masked a frame")
+	}
+	if head[0]&0x80 == 0 {
+		return Frame{}, fmt.Errorf("wstest: server fragmented a frame")
+	}
+	size := uint64(head[1] & 0x7F)
+	switch size {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return Frame{}, err
+		}
+		size = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return Frame{}, err
+		}
+		size = binary.BigEndian.Uint64(b[:])
+	}
+	f := Frame{Op: head[0] & 0x0F, Payload: make([]byte, size)}
+	_, err := io.ReadFull(c.r, f.Payload)
+	return f, err
+}
+
+// Next returns the next message, as JSON, and fails t on anything else.
+func (c *Conn) Next(t testing.TB) map[string]any {
+	t.Helper()
+	f, err := c.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Op != OpText {
+		t.Fatalf("got a frame of opcode %#x, %q; want a message", f.Op, f.Payload)
+	}
+	var ev map[string]any
+	if err := json.Unmarshal(f.Payload, &ev); err != nil {
+		t.Fatalf("%s: %v", f.Payload, err)
+	}
+	return ev
+}
+
+// Wait returns the first message match takes, skipping those before it.
+func (c *Conn) Wait(t testing.TB, match func(ev map[string]any) bool) map[string]any {
+	t.Helper()
+	for {
+		if ev := c.Next(t); match(ev) {
+			return ev
+		}
+	}
+}
+
+// Close hangs up, without a close frame.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
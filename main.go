@@ -4,9 +4,20 @@
 // Usage:
 //
 //	goppy ping   --port /dev/tty.usbmodem...
+//	goppy discover [--bauds 57600,115200] [--all]
 //	goppy note   --port ... --drive 1 --note 60 [--duration 500ms]
 //	goppy reset  --port ... [--drive N]
+//	goppy set    --port ... [--drive N] --transpose -12
+//	goppy config --port ...
+//	goppy status --port ...
 //	goppy play   --port ... song.mid
+//	goppy sim    song.mid song.wav
+//	goppy replay [--speed 0] [--assert golden.json] capture.hex
+//	goppy lint   [--json] capture.hex | --port ...
+//	goppy soak   --port ... [--hours 8] [--seed N] | --dry-run
+//	goppy jam    --port ... --midi /dev/snd/midiC1D0 [--map mapping.yaml]
+//	goppy map check [--policy drop|fold|clamp] song.mid mapping.yaml
+//	goppy analyze [--json] song.mid [mapping.yaml]
 package main
 
 import (
@@ -25,12 +36,34 @@ func main() {
 	switch os.Args[1] {
 	case "ping":
 		err = cmdPing(args)
+	case "discover":
+		err = cmdDiscover(args)
 	case "note":
 		err = cmdNote(args)
 	case "reset":
 		err = cmdReset(args)
 	case "play":
 		err = cmdPlay(args)
+	case "set":
+		err = cmdSet(args)
+	case "config":
+		err = cmdConfig(args)
+	case "status":
+		err = cmdStatus(args)
+	case "sim":
+		err = cmdSim(args)
+	case "replay":
+		err = cmdReplay(args)
+	case "lint":
+		err = cmdLint(args)
+	case "soak":
+		err = cmdSoak(args)
+	case "jam":
+		err = cmdJam(args)
+	case "map":
+		err = cmdMap(args)
+	case "analyze":
+		err = cmdAnalyze(args)
 	case "-h", "--help", "help":
 		usage()
 		return
@@ -51,9 +84,20 @@ func usage() {
 
 Subcommands:
   ping   Discover a connected goppy/Moppy device.
+  discover Ping every serial port and list which device answers where.
   note   Send a single NOTE_ON (and optional auto NOTE_OFF) to a drive.
   reset  Reset all drives, or a specific drive with --drive.
   play   Stream a MIDI file to the device.
+  set    Change per-drive settings such as transpose.
+  config Show the per-drive settings reported by the device.
+  status Show each device's uptime, sequence state, drives sounding and last fault.
+  sim    Render a MIDI file to a WAV file of the drives playing it.
+  replay Feed a capture (see --record) through the firmware's parser and log it.
+  lint   Check a capture, or a live port, against the protocol rules.
+  soak   Play hours of random traffic at a device, or --dry-run, checking its state.
+  jam    Play a MIDI keyboard on the drives live.
+  map    'map check' reports the notes of a song a mapping file drops or folds.
+  analyze Report a song's channels, and suggest devices for them by a mapping.
 
 Run 'goppy <subcommand> -h' for subcommand flags.`)
 }
@@ -3,23 +3,29 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/ystepanoff/goppy/firmware/networks/capture"
 	"go.bug.st/serial"
 )
 
 const defaultBaud = 57600
 
-// portFlags adds shared --port and --baud flags to fs.
+// portFlags adds shared --port, --baud and --record flags to fs.
 type portFlags struct {
-	port string
-	baud int
+	port   string
+	baud   int
+	record string
 }
 
 func addPortFlags(fs *flag.FlagSet) *portFlags {
 	pf := &portFlags{}
 	fs.StringVar(&pf.port, "port", "", "serial port path (e.g. /dev/tty.usbmodem1101 or COM3) — required")
 	fs.IntVar(&pf.baud, "baud", defaultBaud, "serial baud rate")
+	fs.StringVar(&pf.record, "record", "", "write everything sent to the device to this capture file, for goppy replay")
 	return pf
 }
 
@@ -33,5 +39,65 @@ func (pf *portFlags) open() (serial.Port, error) {
 	}
 	// Arduino Uno reboots on DTR; give the bootloader time to hand off.
 	time.Sleep(2 * time.Second)
-	return p, nil
+	if pf.record == "" {
+		return p, nil
+	}
+	f, err := os.Create(pf.record)
+	if err != nil {
+		p.Close()
+		return nil, fmt.Errorf("record: %w", err)
+	}
+	rp := &recordingPort{Port: p, file: f, w: capture.NewWriter(f), start: time.Now()}
+	if err := rp.w.Comment(strings.Join(os.Args, " ")); err != nil {
+		rp.Close()
+		return nil, fmt.Errorf("record: %w", err)
+	}
+	return rp, nil
+}
+
+// recordingPort is a serial port that writes everything sent through it
+// to a capture, one line per write, timed from when the port opened.
+type recordingPort struct {
+	serial.Port
+	file  *os.File
+	w     *capture.Writer
+	start time.Time
+	err   error // the first failure to record, reported by Close
+}
+
+func (p *recordingPort) Write(b []byte) (int, error) {
+	n, err := p.Port.Write(b)
+	if n > 0 && p.err == nil {
+		p.err = p.w.Write(time.Since(p.start), b[:n])
+	}
+	return n, err
+}
+
+// Close closes the port and the capture. The commands defer it, so a
+// capture that couldn't be written is reported here too.
+func (p *recordingPort) Close() error {
+	err := p.Port.Close()
+	if p.err == nil {
+		p.err = p.w.Flush()
+	}
+	if ferr := p.file.Close(); p.err == nil {
+		p.err = ferr
+	}
+	if p.err != nil {
+		fmt.Fprintf(os.Stderr, "warning: recording to %s failed: %v\n", p.file.Name(), p.err)
+		return fmt.Errorf("record %s: %w", p.file.Name(), p.err)
+	}
+	return err
+}
+
+// timeoutReader turns the serial port's (0, nil) read-timeout result into
+// io.EOF so readers built on io.ReadFull stop instead of spinning.
+type timeoutReader struct{ r io.Reader }
+
+func (t timeoutReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n == 0 && err == nil {
+		return 0, io.EOF
+	}
+	return n, err
 }